@@ -17,7 +17,7 @@ import (
 var (
 	testConf = flag.Bool("testConf", false, "Test the configuration file without starting the services")
 	confPath = flag.String("confPath", "", "Path to JSON configuration file")
-	zapConf  = flag.String("zapConf", "", "Preset name or path to JSON configuration file for building the zap logger.\nAvailable presets: console (default), systemd, production, development")
+	zapConf  = flag.String("zapConf", "", "Preset name or path to JSON configuration file for building the zap logger.\nAvailable presets: console (default), systemd, json, production, development")
 	logLevel = flag.String("logLevel", "", "Override the logger configuration's log level.\nAvailable levels: debug, info, warn, error, dpanic, panic, fatal")
 )
 
@@ -40,6 +40,8 @@ func main() {
 		zc = logging.NewProductionConsoleConfig(false)
 	case "systemd":
 		zc = logging.NewProductionConsoleConfig(true)
+	case "json":
+		zc = logging.NewProductionJSONConfig()
 	case "production":
 		zc = zap.NewProductionConfig()
 	case "development":
@@ -117,10 +119,50 @@ func main() {
 	}
 
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	sig := <-sigCh
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	logger.Info("Received signal, stopping...", zap.Stringer("signal", sig))
+	for sig := range sigCh {
+		if sig == syscall.SIGHUP {
+			logger.Info("Received SIGHUP, reloading router...")
+			reloadRouter(m, logger)
+			continue
+		}
+		logger.Info("Received signal, stopping...", zap.Stringer("signal", sig))
+		break
+	}
 
 	m.Stop()
 }
+
+// reloadRouter reads the router configuration from the config file, and replaces the router of m.
+// Other changes to the config file are ignored.
+func reloadRouter(m *service.Manager, logger *zap.Logger) {
+	f, err := os.Open(*confPath)
+	if err != nil {
+		logger.Warn("Failed to open config file",
+			zap.Stringp("confPath", confPath),
+			zap.Error(err),
+		)
+		return
+	}
+
+	var sc service.Config
+	d := json.NewDecoder(f)
+	d.DisallowUnknownFields()
+	err = d.Decode(&sc)
+	f.Close()
+	if err != nil {
+		logger.Warn("Failed to decode config",
+			zap.Stringp("confPath", confPath),
+			zap.Error(err),
+		)
+		return
+	}
+
+	if err = m.ReloadRouter(&sc.Router); err != nil {
+		logger.Warn("Failed to reload router",
+			zap.Stringp("confPath", confPath),
+			zap.Error(err),
+		)
+	}
+}
@@ -1,10 +1,12 @@
 package conn
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/netip"
 	"strconv"
+	"strings"
 	"unsafe"
 )
 
@@ -35,6 +37,16 @@ func (a Addr) Domain() string {
 	return a.domain
 }
 
+// UnixPath returns the Unix domain socket path encoded in the domain name after prefix,
+// and whether the address is a domain name that starts with prefix.
+// The port number is ignored. An empty prefix never matches.
+func (a Addr) UnixPath(prefix string) (string, bool) {
+	if prefix == "" || a.ip.IsValid() || !strings.HasPrefix(a.domain, prefix) {
+		return "", false
+	}
+	return a.domain[len(prefix):], true
+}
+
 // Port returns the port number.
 func (a Addr) Port() uint16 {
 	return a.port
@@ -49,10 +61,15 @@ func (a Addr) IPPort() netip.AddrPort {
 
 // ResolveIP returns the IP address itself or the resolved IP address of the domain name.
 func (a Addr) ResolveIP() (netip.Addr, error) {
+	return a.ResolveIPContext(context.Background())
+}
+
+// ResolveIPContext is like [Addr.ResolveIP] but uses the provided context for name resolution.
+func (a Addr) ResolveIPContext(ctx context.Context) (netip.Addr, error) {
 	if a.ip.IsValid() {
 		return a.ip, nil
 	}
-	return ResolveAddr(a.domain)
+	return ResolveAddrContext(ctx, a.domain)
 }
 
 // ResolveIPPort returns the IP address itself or the resolved IP address of the domain name
@@ -69,6 +86,20 @@ func (a Addr) ResolveIPPort() (netip.AddrPort, error) {
 	return netip.AddrPortFrom(ip, a.port), nil
 }
 
+// ResolveIPPortFamilyContext is like [Addr.ResolveIPPort], but prefers resolved addresses of family,
+// and uses the provided context for name resolution.
+func (a Addr) ResolveIPPortFamilyContext(ctx context.Context, family AddrFamily) (netip.AddrPort, error) {
+	if a.ip.IsValid() {
+		return a.IPPort(), nil
+	}
+
+	ip, err := ResolveAddrFamilyContext(ctx, a.domain, family)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(ip, a.port), nil
+}
+
 // Host returns the string representation of the IP address or the domain name.
 func (a Addr) Host() string {
 	if a.ip.IsValid() {
@@ -93,6 +124,29 @@ func (a Addr) AppendTo(b []byte) []byte {
 	return fmt.Appendf(b, "%s:%d", a.domain, a.port)
 }
 
+// Normalize returns the canonical form of the address.
+//
+// IPv4-mapped IPv6 addresses are unmapped. Domain names are lowercased,
+// and a trailing dot is removed from fully qualified domain names.
+func (a Addr) Normalize() Addr {
+	if a.IsIP() {
+		a.ip = a.ip.Unmap()
+		return a
+	}
+	if len(a.domain) > 1 {
+		a.domain = strings.TrimSuffix(a.domain, ".")
+	}
+	a.domain = strings.ToLower(a.domain)
+	return a
+}
+
+// Equal returns whether the two addresses are equal after normalization.
+//
+// A domain name is never equal to an IP address, even if the domain name resolves to it.
+func (a Addr) Equal(other Addr) bool {
+	return a.Normalize() == other.Normalize()
+}
+
 // MarshalText implements the encoding.TextMarshaler MarshalText method.
 func (a Addr) MarshalText() ([]byte, error) {
 	if a.ip.IsValid() {
@@ -148,21 +202,46 @@ func AddrFromHostPort(host string, port uint16) (Addr, error) {
 	return AddrFromDomainPort(host, port)
 }
 
-// ParseAddr parses the provided string representation of an address
-// and returns the parsed address or an error.
+// ParseAddr parses s in the form of "host:port" and returns the parsed address or an error.
+//
+// The host may be an IPv4 address, an IPv6 address in square brackets with an optional zone,
+// such as "[fe80::1%eth0]:53", or a domain name. Domain names are kept as is, and resolved when used.
+//
+// Inputs with an empty host, a port that is not a number between 0 and 65535, an unbracketed IPv6 address,
+// a bracketed host that is not an IPv6 address, or a domain name containing spaces or control characters
+// are rejected.
 func ParseAddr(s string) (Addr, error) {
+	// SplitHostPort rejects unbracketed IPv6 addresses for having too many colons.
 	host, portString, err := net.SplitHostPort(s)
 	if err != nil {
 		return Addr{}, err
 	}
 
+	if host == "" {
+		return Addr{}, fmt.Errorf("missing host in address %q", s)
+	}
+
 	portNumber, err := strconv.ParseUint(portString, 10, 16)
 	if err != nil {
-		return Addr{}, fmt.Errorf("failed to parse port string: %w", err)
+		return Addr{}, fmt.Errorf("invalid port in address %q: %w", s, err)
 	}
 	port := uint16(portNumber)
 
-	return AddrFromHostPort(host, port)
+	ip, err := netip.ParseAddr(host)
+	bracketed := s[0] == '['
+	switch {
+	case bracketed && (err != nil || !ip.Is6()):
+		return Addr{}, fmt.Errorf("bracketed host in address %q is not an IPv6 address", s)
+	case err == nil:
+		return Addr{ip: ip, port: port}, nil
+	}
+
+	for i := 0; i < len(host); i++ {
+		if c := host[i]; c <= ' ' || c == 0x7f {
+			return Addr{}, fmt.Errorf("invalid character %q in domain name of address %q", c, s)
+		}
+	}
+	return AddrFromDomainPort(host, port)
 }
 
 type addrPortHeader struct {
@@ -56,6 +56,26 @@ func TestAddrDomain(t *testing.T) {
 	}
 }
 
+func TestAddrUnixPath(t *testing.T) {
+	for _, c := range []struct {
+		addr         Addr
+		prefix       string
+		expectedPath string
+		expectedOK   bool
+	}{
+		{MustAddrFromDomainPort("unix:/run/app.sock", 0), "unix:", "/run/app.sock", true},
+		{MustAddrFromDomainPort("unix:@app", 80), "unix:", "@app", true},
+		{MustAddrFromDomainPort("unix:/run/app.sock", 0), "", "", false},
+		{addrDomain, "unix:", "", false},
+		{addrIP, "unix:", "", false},
+	} {
+		path, ok := c.addr.UnixPath(c.prefix)
+		if path != c.expectedPath || ok != c.expectedOK {
+			t.Errorf("%s.UnixPath(%q) returned (%q, %t), expected (%q, %t)", c.addr, c.prefix, path, ok, c.expectedPath, c.expectedOK)
+		}
+	}
+}
+
 func TestAddrPort(t *testing.T) {
 	if addrIP.Port() != addrIPPort {
 		t.Errorf("addrIP.Port() returned %d, expected %d.", addrIP.Port(), addrIPPort)
@@ -235,6 +255,53 @@ func TestAddrParsing(t *testing.T) {
 	}
 }
 
+func TestParseAddr(t *testing.T) {
+	for _, c := range []struct {
+		s        string
+		expected Addr
+	}{
+		{"192.0.2.1:53", AddrFromIPPort(netip.MustParseAddrPort("192.0.2.1:53"))},
+		{"[2001:db8::1]:443", AddrFromIPPort(netip.MustParseAddrPort("[2001:db8::1]:443"))},
+		{"[fe80::1%eth0]:53", AddrFromIPPort(netip.MustParseAddrPort("[fe80::1%eth0]:53"))},
+		{"[::ffff:192.0.2.1]:80", AddrFromIPPort(netip.MustParseAddrPort("[::ffff:192.0.2.1]:80"))},
+		{"example.com:65535", MustAddrFromDomainPort("example.com", 65535)},
+		{"localhost:0", MustAddrFromDomainPort("localhost", 0)},
+	} {
+		addr, err := ParseAddr(c.s)
+		if err != nil {
+			t.Errorf("ParseAddr(%q) returned error: %v", c.s, err)
+			continue
+		}
+		if addr != c.expected {
+			t.Errorf("ParseAddr(%q) returned %s, expected %s", c.s, addr, c.expected)
+		}
+		if addr.IsIP() != c.expected.IsIP() {
+			t.Errorf("ParseAddr(%q) returned IsIP() %v, expected %v", c.s, addr.IsIP(), c.expected.IsIP())
+		}
+	}
+
+	for _, s := range []string{
+		"",
+		"example.com",
+		":443",
+		"[]:443",
+		"example.com:",
+		"example.com:65536",
+		"example.com:-1",
+		"example.com:https",
+		"2001:db8::1:443",
+		"[2001:db8::1]",
+		"[192.0.2.1]:80",
+		"[example.com]:443",
+		"exa mple.com:443",
+		"example.com\n:443",
+	} {
+		if addr, err := ParseAddr(s); err == nil {
+			t.Errorf("ParseAddr(%q) returned %s, expected error", s, addr)
+		}
+	}
+}
+
 var (
 	addrPort4    = netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), 1080)
 	addrPort4in6 = netip.AddrPortFrom(netip.AddrFrom16([16]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 127, 0, 0, 1}), 1080)
@@ -261,3 +328,59 @@ func TestAddrPortMappedEqual(t *testing.T) {
 		t.Error("AddrPortMappedEqual(addrPort4in6, addrIPAddrPort) returned true.")
 	}
 }
+
+func TestAddrNormalize(t *testing.T) {
+	addr4 := AddrFromIPPort(addrPort4)
+	addr4in6 := AddrFromIPPort(addrPort4in6)
+
+	if normalized := addr4in6.Normalize(); normalized != addr4 {
+		t.Errorf("addr4in6.Normalize() returned %s, expected %s.", normalized, addr4)
+	}
+
+	if normalized := addrIP.Normalize(); normalized != addrIP {
+		t.Errorf("addrIP.Normalize() returned %s, expected %s.", normalized, addrIP)
+	}
+
+	for _, domain := range []string{"example.com", "example.com.", "Example.COM", "EXAMPLE.com."} {
+		addr := MustAddrFromDomainPort(domain, addrDomainPort)
+		if normalized := addr.Normalize(); normalized != addrDomain {
+			t.Errorf("%s.Normalize() returned %s, expected %s.", addr, normalized, addrDomain)
+		}
+	}
+
+	root := MustAddrFromDomainPort(".", addrDomainPort)
+	if normalized := root.Normalize(); normalized != root {
+		t.Errorf("root.Normalize() returned %s, expected %s.", normalized, root)
+	}
+}
+
+func TestAddrEqual(t *testing.T) {
+	addr4 := AddrFromIPPort(addrPort4)
+	addr4in6 := AddrFromIPPort(addrPort4in6)
+	addrDomainFQDN := MustAddrFromDomainPort("Example.com.", addrDomainPort)
+
+	if !addr4.Equal(addr4in6) {
+		t.Error("addr4.Equal(addr4in6) returned false.")
+	}
+
+	if !addr4in6.Equal(addr4) {
+		t.Error("addr4in6.Equal(addr4) returned false.")
+	}
+
+	if !addrDomain.Equal(addrDomainFQDN) {
+		t.Error("addrDomain.Equal(addrDomainFQDN) returned false.")
+	}
+
+	if addr4.Equal(addrIP) {
+		t.Error("addr4.Equal(addrIP) returned true.")
+	}
+
+	if addrDomain.Equal(MustAddrFromDomainPort(addrDomainHost, addrDomainPort+1)) {
+		t.Error("addrDomain.Equal() returned true for a different port.")
+	}
+
+	localhost := MustAddrFromDomainPort("localhost", addrPort4.Port())
+	if localhost.Equal(addr4) {
+		t.Error("localhost.Equal(addr4) returned true.")
+	}
+}
@@ -0,0 +1,5 @@
+package conn
+
+import "errors"
+
+var ErrListenBacklogUnsupported = errors.New("setting the listen backlog is not supported on this platform")
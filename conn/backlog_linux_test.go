@@ -0,0 +1,41 @@
+package conn
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSetListenBacklog(t *testing.T) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	const backlog = 16
+
+	if err = SetListenBacklog(l, backlog); err != nil {
+		t.Fatal(err)
+	}
+
+	rawConn, err := l.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// For listening sockets, tcpi_sacked is the maximum length of the accept queue.
+	var info *unix.TCPInfo
+	if cerr := rawConn.Control(func(fd uintptr) {
+		info, err = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	}); cerr != nil {
+		t.Fatal(cerr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Sacked != backlog {
+		t.Errorf("Backlog is %d, expected %d", info.Sacked, backlog)
+	}
+}
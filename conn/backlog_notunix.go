@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+
+package conn
+
+import "net"
+
+// SetListenBacklog returns ErrListenBacklogUnsupported.
+// Go does not expose the listen backlog on this platform.
+func SetListenBacklog(l *net.TCPListener, backlog int) error {
+	return ErrListenBacklogUnsupported
+}
@@ -0,0 +1,34 @@
+//go:build linux || darwin || freebsd
+
+package conn
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// SetListenBacklog sets the accept queue backlog of the listening socket l
+// by calling listen(2) again on it, which updates the backlog of a listening socket.
+//
+// Go listens with the system maximum read at startup, so this is mostly useful
+// for picking a smaller backlog, or a larger one after the maximum has been raised.
+// The kernel silently clamps backlog to the system maximum:
+// net.core.somaxconn on Linux, kern.ipc.somaxconn on FreeBSD and macOS.
+func SetListenBacklog(l *net.TCPListener, backlog int) error {
+	rawConn, err := l.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	if cerr := rawConn.Control(func(fd uintptr) {
+		err = unix.Listen(int(fd), backlog)
+	}); cerr != nil {
+		return cerr
+	}
+
+	if err != nil {
+		return &net.OpError{Op: "listen", Net: "tcp", Addr: l.Addr(), Err: err}
+	}
+	return nil
+}
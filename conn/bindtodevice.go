@@ -0,0 +1,26 @@
+package conn
+
+import (
+	"errors"
+	"net"
+)
+
+// ErrBindToDeviceUnsupported is returned when binding a socket to a network interface is requested on a platform without SO_BINDTODEVICE.
+var ErrBindToDeviceUnsupported = errors.New("binding sockets to network interfaces is not supported on this platform")
+
+// ListenUDPOnInterface is like ListenUDPInNetns, but also binds the socket to the named network interface,
+// so that its packets are sent out of the interface regardless of the routing table.
+// The interface is looked up in the network namespace of the socket.
+//
+// If ifname is empty, it is equivalent to ListenUDPInNetns.
+func ListenUDPOnInterface(network, netns, ifname string, portRange PortRange, pktinfo bool, fwmark int) (*net.UDPConn, error) {
+	c, err := ListenUDPInNetns(network, netns, portRange, pktinfo, fwmark)
+	if err != nil || ifname == "" {
+		return c, err
+	}
+	if err = BindToDevice(c, ifname); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
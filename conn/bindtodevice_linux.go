@@ -0,0 +1,69 @@
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/database64128/tfo-go/v2"
+	"golang.org/x/sys/unix"
+)
+
+// BindToDeviceSupported is true if [BindToDevice] and [NewDialerOnInterface] are supported on this platform.
+const BindToDeviceSupported = true
+
+func setBindToDevice(fd int, ifname string) error {
+	if err := unix.BindToDevice(fd, ifname); err != nil {
+		switch {
+		case errors.Is(err, unix.EPERM):
+			return fmt.Errorf("failed to set socket option SO_BINDTODEVICE to %s: %w (binding to an interface requires CAP_NET_RAW)", ifname, err)
+		case errors.Is(err, unix.ENODEV):
+			return fmt.Errorf("failed to set socket option SO_BINDTODEVICE to %s: %w (no such interface)", ifname, err)
+		default:
+			return fmt.Errorf("failed to set socket option SO_BINDTODEVICE to %s: %w", ifname, err)
+		}
+	}
+	return nil
+}
+
+// BindToDevice sets SO_BINDTODEVICE on c, so that its packets are sent out of the named network interface.
+// It fails with EPERM if the process does not have CAP_NET_RAW.
+func BindToDevice(c syscall.Conn, ifname string) error {
+	rawConn, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	if err = rawConn.Control(func(fd uintptr) {
+		serr = setBindToDevice(int(fd), ifname)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// NewDialerOnInterface is like [NewDialer], but also binds dialed sockets to the named network interface.
+// If ifname is empty, it is equivalent to NewDialer.
+func NewDialerOnInterface(dialerTFO bool, dialerFwmark int, dialerTimeout time.Duration, ifname string) (dialer tfo.Dialer) {
+	dialer = NewDialer(dialerTFO, dialerFwmark, dialerTimeout)
+	if ifname == "" {
+		return
+	}
+	control := dialer.Control
+	dialer.Control = func(network, address string, c syscall.RawConn) (err error) {
+		if control != nil {
+			if err = control(network, address, c); err != nil {
+				return
+			}
+		}
+		if cerr := c.Control(func(fd uintptr) {
+			err = setBindToDevice(int(fd), ifname)
+		}); cerr != nil {
+			return cerr
+		}
+		return
+	}
+	return
+}
@@ -0,0 +1,84 @@
+package conn
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestListenUDPOnInterface(t *testing.T) {
+	c, err := ListenUDPOnInterface("udp", "", "lo", PortRange{}, false, 0)
+	if err != nil {
+		if errors.Is(err, unix.EPERM) {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	rawConn, err := c.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		ifname string
+		gerr   error
+	)
+	if err = rawConn.Control(func(fd uintptr) {
+		ifname, gerr = unix.GetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if gerr != nil {
+		t.Fatal(gerr)
+	}
+	if ifname != "lo" {
+		t.Errorf("Socket is bound to %q, expected %q", ifname, "lo")
+	}
+}
+
+func TestBindToDeviceNoSuchInterface(t *testing.T) {
+	c, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = BindToDevice(c, "nonexistent0")
+	if err == nil {
+		t.Fatal("BindToDevice succeeded on a nonexistent interface")
+	}
+	if !errors.Is(err, unix.ENODEV) && !errors.Is(err, unix.EPERM) {
+		t.Errorf("BindToDevice returned %v, expected ENODEV or EPERM", err)
+	}
+	if !strings.Contains(err.Error(), "nonexistent0") {
+		t.Errorf("BindToDevice returned %v, expected the interface name in the error", err)
+	}
+}
+
+func TestNewDialerOnInterface(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	dialer := NewDialerOnInterface(false, 0, 0, "lo")
+	c, err := dialer.Dial("tcp", ln.Addr().String(), nil)
+	if err != nil {
+		if errors.Is(err, unix.EPERM) {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	c.Close()
+
+	dialer = NewDialerOnInterface(false, 0, 0, "nonexistent0")
+	if c, err = dialer.Dial("tcp", ln.Addr().String(), nil); err == nil {
+		c.Close()
+		t.Error("Dialing with a nonexistent interface succeeded")
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package conn
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/database64128/tfo-go/v2"
+)
+
+// BindToDeviceSupported is true if [BindToDevice] and [NewDialerOnInterface] are supported on this platform.
+const BindToDeviceSupported = false
+
+// BindToDevice returns ErrBindToDeviceUnsupported.
+func BindToDevice(c syscall.Conn, ifname string) error {
+	return ErrBindToDeviceUnsupported
+}
+
+// NewDialerOnInterface is like [NewDialer]. ifname is ignored, since binding sockets to network interfaces is not supported on this platform.
+func NewDialerOnInterface(dialerTFO bool, dialerFwmark int, dialerTimeout time.Duration, ifname string) tfo.Dialer {
+	return NewDialer(dialerTFO, dialerFwmark, dialerTimeout)
+}
@@ -0,0 +1,27 @@
+package conn
+
+import (
+	"net/netip"
+	"time"
+)
+
+// SocketControlMessage contains information parsed from the socket control messages
+// received with a packet. Fields whose control message is absent are left as zero values.
+type SocketControlMessage struct {
+	// PktinfoCmsg is the IP_PKTINFO or IPV6_PKTINFO control message, including its header.
+	// It slices the parsed buffer, and can be passed back as is when sending a reply
+	// to make it leave from the address and interface the packet was received on.
+	PktinfoCmsg []byte
+
+	// PktinfoAddr is the local IP address the packet was received on.
+	PktinfoAddr netip.Addr
+
+	// PktinfoIfindex is the index of the network interface the packet was received from.
+	PktinfoIfindex uint32
+
+	// Timestamp is the receive timestamp of the packet.
+	Timestamp time.Time
+
+	// SegmentSize is the size of each segment of a UDP GRO coalesced packet.
+	SegmentSize int
+}
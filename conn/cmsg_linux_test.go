@@ -0,0 +1,91 @@
+package conn
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// buildCmsg builds a socket control message with the given level, type, and data.
+func buildCmsg(level, typ int32, data []byte) []byte {
+	cmsg := make([]byte, unix.CmsgSpace(len(data)))
+	cmsghdr := (*unix.Cmsghdr)(unsafe.Pointer(&cmsg[0]))
+	cmsghdr.Level = level
+	cmsghdr.Type = typ
+	cmsghdr.SetLen(unix.CmsgLen(len(data)))
+	copy(cmsg[unix.SizeofCmsghdr:], data)
+	return cmsg
+}
+
+func TestParseSocketControlMessage(t *testing.T) {
+	ts := time.Unix(1700000000, 123456789)
+	tspec := unix.NsecToTimespec(ts.UnixNano())
+	tsData := unsafe.Slice((*byte)(unsafe.Pointer(&tspec)), unsafe.Sizeof(tspec))
+
+	segmentSize := int32(1200)
+	groData := unsafe.Slice((*byte)(unsafe.Pointer(&segmentSize)), unsafe.Sizeof(segmentSize))
+
+	for _, addr := range []netip.Addr{
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("2001:db8::1"),
+	} {
+		const ifindex = 42
+
+		pktinfoCmsg := BuildPktinfoCmsg(addr, ifindex)
+
+		// Put an unknown message first, and the pktinfo message in the middle.
+		var cmsg []byte
+		cmsg = append(cmsg, unix.UnixRights(0)...)
+		cmsg = append(cmsg, buildCmsg(unix.SOL_SOCKET, unix.SCM_TIMESTAMPNS, tsData)...)
+		cmsg = append(cmsg, pktinfoCmsg...)
+		cmsg = append(cmsg, buildCmsg(unix.IPPROTO_UDP, UDP_GRO, groData)...)
+
+		if len(cmsg)-len(unix.UnixRights(0)) > SocketControlMessageBufferSize {
+			t.Errorf("Control messages of %d bytes do not fit in the receive buffer size %d", len(cmsg)-len(unix.UnixRights(0)), SocketControlMessageBufferSize)
+		}
+
+		m, err := ParseSocketControlMessage(cmsg)
+		if err != nil {
+			t.Fatalf("ParseSocketControlMessage failed: %v", err)
+		}
+		if !bytes.Equal(m.PktinfoCmsg, pktinfoCmsg) {
+			t.Errorf("PktinfoCmsg = %v, expected %v", m.PktinfoCmsg, pktinfoCmsg)
+		}
+		if m.PktinfoAddr != addr {
+			t.Errorf("PktinfoAddr = %s, expected %s", m.PktinfoAddr, addr)
+		}
+		if m.PktinfoIfindex != ifindex {
+			t.Errorf("PktinfoIfindex = %d, expected %d", m.PktinfoIfindex, ifindex)
+		}
+		if !m.Timestamp.Equal(ts) {
+			t.Errorf("Timestamp = %s, expected %s", m.Timestamp, ts)
+		}
+		if m.SegmentSize != int(segmentSize) {
+			t.Errorf("SegmentSize = %d, expected %d", m.SegmentSize, segmentSize)
+		}
+	}
+}
+
+func TestParseSocketControlMessageEmpty(t *testing.T) {
+	m, err := ParseSocketControlMessage(nil)
+	if err != nil {
+		t.Fatalf("ParseSocketControlMessage(nil) failed: %v", err)
+	}
+	if m.PktinfoCmsg != nil || m.PktinfoAddr.IsValid() || !m.Timestamp.IsZero() || m.SegmentSize != 0 {
+		t.Errorf("ParseSocketControlMessage(nil) = %+v, expected zero value", m)
+	}
+}
+
+func TestParseSocketControlMessageTruncated(t *testing.T) {
+	cmsg := BuildPktinfoCmsg(netip.MustParseAddr("192.0.2.1"), 42)
+	cmsghdr := (*unix.Cmsghdr)(unsafe.Pointer(&cmsg[0]))
+	cmsghdr.SetLen(len(cmsg) + 1)
+
+	if _, err := ParseSocketControlMessage(cmsg); err == nil {
+		t.Error("ParseSocketControlMessage succeeded on a message longer than the buffer")
+	}
+}
@@ -2,21 +2,227 @@ package conn
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net"
 	"net/netip"
+	"sync"
 )
 
+var (
+	// ErrMessageTruncated is returned by [ParseFlagsForError] when MSG_TRUNC is set.
+	ErrMessageTruncated = errors.New("the packet is larger than the supplied buffer")
+
+	// ErrControlMessageTruncated is returned by [ParseFlagsForError] when MSG_CTRUNC is set.
+	ErrControlMessageTruncated = errors.New("the control message is larger than the supplied buffer")
+
+	// ErrNoSourceAddr is returned by [SourceAddrFor] when the routing table has no source address for the destination.
+	ErrNoSourceAddr = errors.New("no source address for destination")
+)
+
+// Resolver looks up IP addresses of domain names.
+//
+// [*net.Resolver] implements Resolver.
+type Resolver interface {
+	// LookupNetIP looks up host and returns its IP addresses.
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// DefaultResolver is the resolver used by [ResolveAddr], [Addr.ResolveIP], and [Addr.ResolveIPPort].
+//
+// Tests may replace it to feed canned answers without network access.
+// It must not be modified while any of the above are being called.
+var DefaultResolver Resolver = net.DefaultResolver
+
 // ResolveAddr resolves a domain name string into an IP address.
 //
 // This function always returns the first IP address returned by the resolver,
 // because the resolver takes care of sorting the IP addresses by address family
 // availability and preference.
 //
+// IPv4-mapped IPv6 addresses are unmapped, so that dialing the returned address
+// always uses an IPv4 socket for IPv4 destinations.
+//
 // String representations of IP addresses are not supported.
 func ResolveAddr(host string) (netip.Addr, error) {
-	ips, err := net.DefaultResolver.LookupNetIP(context.Background(), "ip", host)
+	return ResolveAddrContext(context.Background(), host)
+}
+
+// ResolveAddrContext is like [ResolveAddr] but uses the provided context.
+// Use a context with a timeout to bound the time spent waiting for an unresponsive resolver.
+func ResolveAddrContext(ctx context.Context, host string) (netip.Addr, error) {
+	return ResolveAddrFamilyContext(ctx, host, AddrFamilyAny)
+}
+
+// AddrFamily is an IP address family preference for name resolution.
+type AddrFamily uint8
+
+const (
+	// AddrFamilyAny follows the order of addresses returned by the resolver.
+	AddrFamilyAny AddrFamily = iota
+
+	// AddrFamilyIPv4 prefers IPv4 addresses.
+	AddrFamilyIPv4
+
+	// AddrFamilyIPv6 prefers IPv6 addresses.
+	AddrFamilyIPv6
+)
+
+// AddrFamilyOf returns the address family of addr.
+// IPv4-mapped IPv6 addresses are IPv4. An invalid address returns [AddrFamilyAny].
+func AddrFamilyOf(addr netip.Addr) AddrFamily {
+	switch {
+	case !addr.IsValid():
+		return AddrFamilyAny
+	case addr.Unmap().Is4():
+		return AddrFamilyIPv4
+	default:
+		return AddrFamilyIPv6
+	}
+}
+
+// String returns the string representation of the address family.
+func (f AddrFamily) String() string {
+	switch f {
+	case AddrFamilyIPv4:
+		return "ipv4"
+	case AddrFamilyIPv6:
+		return "ipv6"
+	default:
+		return "any"
+	}
+}
+
+// ResolveAddrFamilyContext is like [ResolveAddrContext], but returns the first address of family
+// if the resolver returned any. Otherwise, the first address is returned.
+func ResolveAddrFamilyContext(ctx context.Context, host string, family AddrFamily) (netip.Addr, error) {
+	ips, err := DefaultResolver.LookupNetIP(ctx, "ip", host)
 	if err != nil {
 		return netip.Addr{}, err
 	}
-	return ips[0], nil
+	if len(ips) == 0 {
+		return netip.Addr{}, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if family != AddrFamilyAny {
+		for _, ip := range ips {
+			if AddrFamilyOf(ip) == family {
+				return ip.Unmap(), nil
+			}
+		}
+	}
+	return ips[0].Unmap(), nil
+}
+
+// ResolveAddrsFamilyContext is like [ResolveAddrFamilyContext], but returns all addresses returned by the resolver.
+// Addresses of family come first. Otherwise, the resolver's order is kept.
+func ResolveAddrsFamilyContext(ctx context.Context, host string, family AddrFamily) ([]netip.Addr, error) {
+	ips, err := DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	addrs := make([]netip.Addr, 0, len(ips))
+	for _, ip := range ips {
+		if family == AddrFamilyAny || AddrFamilyOf(ip) == family {
+			addrs = append(addrs, ip.Unmap())
+		}
+	}
+	if family != AddrFamilyAny {
+		for _, ip := range ips {
+			if AddrFamilyOf(ip) != family {
+				addrs = append(addrs, ip.Unmap())
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// Probe destinations used by [LocalAddrPort] to look up the preferred source address.
+// They are documentation addresses, and no packets are sent to them.
+// Their port is also used by [SourceAddrFor].
+var (
+	sourceProbeAddrPort4 = netip.AddrPortFrom(netip.AddrFrom4([4]byte{192, 0, 2, 1}), 9)
+	sourceProbeAddrPort6 = netip.AddrPortFrom(netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}), 9)
+)
+
+// ListenUDPAddrPort is like [ListenUDP], but also returns the usable local address of the socket,
+// which is useful when binding an ephemeral port that has to be advertised to peers.
+// See [LocalAddrPort] for how the address is chosen.
+func ListenUDPAddrPort(network, laddr string, pktinfo, reuseAddr bool, fwmark int) (*net.UDPConn, netip.AddrPort, error) {
+	c, err := ListenUDP(network, laddr, pktinfo, reuseAddr, fwmark)
+	if err != nil {
+		return nil, netip.AddrPort{}, err
+	}
+	return c, LocalAddrPort(c, fwmark), nil
+}
+
+// LocalAddrPort returns the local address of the UDP socket c.
+//
+// If c is bound to an unspecified address, the returned address is the preferred
+// source address for outbound traffic, as chosen by the routing table with fwmark applied.
+// IPv6 is preferred on dual-stack sockets. If no route is available, the unspecified address is returned.
+func LocalAddrPort(c *net.UDPConn, fwmark int) netip.AddrPort {
+	addrPort := c.LocalAddr().(*net.UDPAddr).AddrPort()
+	addr := addrPort.Addr()
+	if !addr.IsUnspecified() {
+		return addrPort
+	}
+
+	probes := []netip.AddrPort{sourceProbeAddrPort6, sourceProbeAddrPort4}
+	if addr.Is4() {
+		probes = probes[1:]
+	}
+	for _, probe := range probes {
+		if src, err := sourceAddrFor(probe, fwmark); err == nil {
+			return netip.AddrPortFrom(src, addrPort.Port())
+		}
+	}
+	return addrPort
+}
+
+// SourceAddrFor returns the source address the kernel would use to reach dst, as chosen by the routing table.
+//
+// It connects a UDP socket to dst, which only looks up the route. No packets are sent.
+// IPv4-mapped IPv6 destinations are treated as IPv4, and the returned address is always unmapped.
+func SourceAddrFor(dst netip.Addr) (netip.Addr, error) {
+	if !dst.IsValid() {
+		return netip.Addr{}, fmt.Errorf("invalid destination address: %v", dst)
+	}
+	return sourceAddrFor(netip.AddrPortFrom(dst.Unmap(), sourceProbeAddrPort4.Port()), 0)
+}
+
+// sourceAddrFor returns the source address the routing table picks for dst with fwmark applied.
+func sourceAddrFor(dst netip.AddrPort, fwmark int) (netip.Addr, error) {
+	// Connecting a UDP socket only looks up the route. No packets are sent.
+	dialer := NewDialer(false, fwmark, 0)
+	c, err := dialer.Dial("udp", dst.String(), nil)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	src := c.LocalAddr().(*net.UDPAddr).AddrPort().Addr()
+	c.Close()
+	if src.IsUnspecified() {
+		return netip.Addr{}, fmt.Errorf("%w: %s", ErrNoSourceAddr, dst.Addr())
+	}
+	return src.Unmap(), nil
+}
+
+var (
+	ipv6EgressOnce sync.Once
+	ipv6Egress     bool
+)
+
+// HasIPv6Egress reports whether the host has IPv6 connectivity to the internet,
+// that is, the routing table has a route to global IPv6 destinations with a global unicast source address.
+//
+// Detection happens on the first call, and the result is cached for the lifetime of the process.
+func HasIPv6Egress() bool {
+	ipv6EgressOnce.Do(func() {
+		src, err := sourceAddrFor(sourceProbeAddrPort6, 0)
+		ipv6Egress = err == nil && src.Is6() && src.IsGlobalUnicast()
+	})
+	return ipv6Egress
 }
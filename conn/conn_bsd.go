@@ -27,6 +27,9 @@ func setDF(fd int, network string) error {
 	return nil
 }
 
+// ReuseAddrSupported is true if [ListenUDP] supports setting SO_REUSEADDR on this platform.
+const ReuseAddrSupported = true
+
 // ListenUDP wraps [net.ListenConfig.ListenPacket] and sets socket options on supported platforms.
 //
 // On Linux and Windows, IP_MTU_DISCOVER and IPV6_MTU_DISCOVER are set to IP_PMTUDISC_DO to disable IP fragmentation
@@ -35,11 +38,21 @@ func setDF(fd int, network string) error {
 // On Linux, SO_MARK is set to user-specified value.
 //
 // On macOS and FreeBSD, IP_DONTFRAG, IPV6_DONTFRAG are set to 1 (Don't Fragment).
-func ListenUDP(network string, laddr string, pktinfo bool, fwmark int) (*net.UDPConn, error) {
+//
+// On Linux, macOS, and FreeBSD, if reuseAddr is true, SO_REUSEADDR is set to 1,
+// so that the address can be bound again right after a restart. It is ignored on other platforms,
+// because SO_REUSEADDR on Windows allows other sockets to take over the bound address.
+func ListenUDP(network string, laddr string, pktinfo, reuseAddr bool, fwmark int) (*net.UDPConn, error) {
 	lc := net.ListenConfig{
 		Control: func(network, address string, c syscall.RawConn) (err error) {
 			if cerr := c.Control(func(fd uintptr) {
-				err = setDF(int(fd), network)
+				if err = setDF(int(fd), network); err != nil {
+					return
+				}
+
+				if reuseAddr {
+					err = setReuseAddr(int(fd))
+				}
 			}); cerr != nil {
 				return cerr
 			}
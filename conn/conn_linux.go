@@ -7,6 +7,7 @@ import (
 	"net/netip"
 	"os"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/database64128/tfo-go/v2"
@@ -15,12 +16,21 @@ import (
 
 const (
 	// SocketControlMessageBufferSize specifies the buffer size for receiving socket control messages.
-	SocketControlMessageBufferSize = unix.SizeofCmsghdr + (unix.SizeofInet6Pktinfo+unix.SizeofPtr-1) & ^(unix.SizeofPtr-1)
+	// It fits an IPV6_PKTINFO message, an SCM_TIMESTAMPING message, and a UDP_GRO message.
+	SocketControlMessageBufferSize = unix.SizeofCmsghdr + (unix.SizeofInet6Pktinfo+unix.SizeofPtr-1) & ^(unix.SizeofPtr-1) +
+		unix.SizeofCmsghdr + (3*sizeofTimespec+unix.SizeofPtr-1) & ^(unix.SizeofPtr-1) +
+		unix.SizeofCmsghdr + (4+unix.SizeofPtr-1) & ^(unix.SizeofPtr-1)
 
 	// TransparentSocketControlMessageBufferSize specifies the buffer size for receiving IPV6_RECVORIGDSTADDR socket control messages.
 	TransparentSocketControlMessageBufferSize = unix.SizeofCmsghdr + (unix.SizeofSockaddrInet6+unix.SizeofPtr-1) & ^(unix.SizeofPtr-1)
+
+	sizeofTimespec = int(unsafe.Sizeof(unix.Timespec{}))
+	sizeofTimeval  = int(unsafe.Sizeof(unix.Timeval{}))
 )
 
+// Source: include/uapi/linux/udp.h
+const UDP_GRO = 104
+
 func setFwmark(fd, fwmark int) error {
 	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, fwmark); err != nil {
 		return fmt.Errorf("failed to set socket option SO_MARK: %w", err)
@@ -98,8 +108,10 @@ func setRecvOrigDstAddr(fd int, network string) error {
 }
 
 // NewDialer returns a tfo.Dialer with the specified options applied.
-func NewDialer(dialerTFO bool, dialerFwmark int) (dialer tfo.Dialer) {
+// If dialerTimeout is positive, it bounds the time spent establishing a connection.
+func NewDialer(dialerTFO bool, dialerFwmark int, dialerTimeout time.Duration) (dialer tfo.Dialer) {
 	dialer.DisableTFO = !dialerTFO
+	dialer.Timeout = dialerTimeout
 	if dialerFwmark != 0 {
 		dialer.Control = func(network, address string, c syscall.RawConn) (err error) {
 			if cerr := c.Control(func(fd uintptr) {
@@ -136,6 +148,9 @@ func NewListenConfig(listenerTFO, listenerTransparent bool, listenerFwmark int)
 	return
 }
 
+// ReuseAddrSupported is true if [ListenUDP] supports setting SO_REUSEADDR on this platform.
+const ReuseAddrSupported = true
+
 // ListenUDP wraps [net.ListenConfig.ListenPacket] and sets socket options on supported platforms.
 //
 // On Linux and Windows, IP_MTU_DISCOVER and IPV6_MTU_DISCOVER are set to IP_PMTUDISC_DO to disable IP fragmentation
@@ -144,7 +159,11 @@ func NewListenConfig(listenerTFO, listenerTransparent bool, listenerFwmark int)
 // On Linux, SO_MARK is set to user-specified value.
 //
 // On macOS and FreeBSD, IP_DONTFRAG, IPV6_DONTFRAG are set to 1 (Don't Fragment).
-func ListenUDP(network string, laddr string, pktinfo bool, fwmark int) (*net.UDPConn, error) {
+//
+// On Linux, macOS, and FreeBSD, if reuseAddr is true, SO_REUSEADDR is set to 1,
+// so that the address can be bound again right after a restart. It is ignored on other platforms,
+// because SO_REUSEADDR on Windows allows other sockets to take over the bound address.
+func ListenUDP(network string, laddr string, pktinfo, reuseAddr bool, fwmark int) (*net.UDPConn, error) {
 	lc := net.ListenConfig{
 		Control: func(network, address string, c syscall.RawConn) (err error) {
 			if cerr := c.Control(func(fd uintptr) {
@@ -158,6 +177,12 @@ func ListenUDP(network string, laddr string, pktinfo bool, fwmark int) (*net.UDP
 					}
 				}
 
+				if reuseAddr {
+					if err = setReuseAddr(int(fd)); err != nil {
+						return
+					}
+				}
+
 				if fwmark != 0 {
 					err = setFwmark(int(fd), fwmark)
 				}
@@ -242,6 +267,99 @@ func ParsePktinfoCmsg(cmsg []byte) (netip.Addr, uint32, error) {
 	}
 }
 
+// BuildPktinfoCmsg builds a socket control message that specifies addr as the source address
+// and ifindex as the outgoing interface. If addr is an IPv4 address, the message is of type IP_PKTINFO.
+// Otherwise, including for IPv4-mapped IPv6 addresses, the message is of type IPV6_PKTINFO.
+//
+// This function is only implemented for Linux and Windows. On other platforms, it returns nil.
+func BuildPktinfoCmsg(addr netip.Addr, ifindex uint32) []byte {
+	if addr.Is4() {
+		cmsg := make([]byte, unix.CmsgSpace(unix.SizeofInet4Pktinfo))
+		cmsghdr := (*unix.Cmsghdr)(unsafe.Pointer(&cmsg[0]))
+		cmsghdr.Level = unix.IPPROTO_IP
+		cmsghdr.Type = unix.IP_PKTINFO
+		cmsghdr.SetLen(unix.CmsgLen(unix.SizeofInet4Pktinfo))
+		pktinfo := (*unix.Inet4Pktinfo)(unsafe.Pointer(&cmsg[unix.SizeofCmsghdr]))
+		pktinfo.Ifindex = int32(ifindex)
+		pktinfo.Spec_dst = addr.As4()
+		return cmsg
+	}
+
+	cmsg := make([]byte, unix.CmsgSpace(unix.SizeofInet6Pktinfo))
+	cmsghdr := (*unix.Cmsghdr)(unsafe.Pointer(&cmsg[0]))
+	cmsghdr.Level = unix.IPPROTO_IPV6
+	cmsghdr.Type = unix.IPV6_PKTINFO
+	cmsghdr.SetLen(unix.CmsgLen(unix.SizeofInet6Pktinfo))
+	pktinfo := (*unix.Inet6Pktinfo)(unsafe.Pointer(&cmsg[unix.SizeofCmsghdr]))
+	pktinfo.Addr = addr.As16()
+	pktinfo.Ifindex = ifindex
+	return cmsg
+}
+
+// ParseSocketControlMessage parses all socket control messages in cmsg.
+// It recognizes IP_PKTINFO, IPV6_PKTINFO, SCM_TIMESTAMP, SCM_TIMESTAMPNS, SCM_TIMESTAMPING, and UDP_GRO.
+// Other control messages are skipped.
+//
+// This function is only implemented for Linux and Windows. On other platforms, this is a no-op.
+func ParseSocketControlMessage(cmsg []byte) (m SocketControlMessage, err error) {
+	for len(cmsg) > 0 {
+		if len(cmsg) < unix.SizeofCmsghdr {
+			return m, fmt.Errorf("control message length %d is shorter than cmsghdr length", len(cmsg))
+		}
+
+		cmsghdr := (*unix.Cmsghdr)(unsafe.Pointer(&cmsg[0]))
+		msgLen := int(cmsghdr.Len)
+		if msgLen < unix.SizeofCmsghdr || msgLen > len(cmsg) {
+			return m, fmt.Errorf("invalid control message length %d for buffer length %d", msgLen, len(cmsg))
+		}
+
+		// The last message may not be padded to alignment.
+		msgSpace := unix.CmsgSpace(msgLen - unix.SizeofCmsghdr)
+		if msgSpace > len(cmsg) {
+			msgSpace = len(cmsg)
+		}
+		data := cmsg[unix.SizeofCmsghdr:msgLen]
+
+		switch {
+		case cmsghdr.Level == unix.IPPROTO_IP && cmsghdr.Type == unix.IP_PKTINFO && len(data) >= unix.SizeofInet4Pktinfo:
+			pktinfo := (*unix.Inet4Pktinfo)(unsafe.Pointer(&data[0]))
+			m.PktinfoCmsg = cmsg[:msgSpace]
+			m.PktinfoAddr = netip.AddrFrom4(pktinfo.Spec_dst)
+			m.PktinfoIfindex = uint32(pktinfo.Ifindex)
+
+		case cmsghdr.Level == unix.IPPROTO_IPV6 && cmsghdr.Type == unix.IPV6_PKTINFO && len(data) >= unix.SizeofInet6Pktinfo:
+			pktinfo := (*unix.Inet6Pktinfo)(unsafe.Pointer(&data[0]))
+			m.PktinfoCmsg = cmsg[:msgSpace]
+			m.PktinfoAddr = netip.AddrFrom16(pktinfo.Addr)
+			m.PktinfoIfindex = pktinfo.Ifindex
+
+		case cmsghdr.Level == unix.SOL_SOCKET && cmsghdr.Type == unix.SCM_TIMESTAMP && len(data) >= sizeofTimeval:
+			tv := (*unix.Timeval)(unsafe.Pointer(&data[0]))
+			m.Timestamp = time.Unix(tv.Unix())
+
+		case cmsghdr.Level == unix.SOL_SOCKET && cmsghdr.Type == unix.SCM_TIMESTAMPNS && len(data) >= sizeofTimespec:
+			ts := (*unix.Timespec)(unsafe.Pointer(&data[0]))
+			m.Timestamp = time.Unix(ts.Unix())
+
+		case cmsghdr.Level == unix.SOL_SOCKET && cmsghdr.Type == unix.SCM_TIMESTAMPING && len(data) >= 3*sizeofTimespec:
+			// The software timestamp is at index 0, and the raw hardware timestamp is at index 2.
+			tss := (*[3]unix.Timespec)(unsafe.Pointer(&data[0]))
+			for _, i := range [...]int{2, 0} {
+				if tss[i].Sec != 0 || tss[i].Nsec != 0 {
+					m.Timestamp = time.Unix(tss[i].Unix())
+					break
+				}
+			}
+
+		case cmsghdr.Level == unix.IPPROTO_UDP && cmsghdr.Type == UDP_GRO && len(data) >= 4:
+			m.SegmentSize = int(*(*int32)(unsafe.Pointer(&data[0])))
+		}
+
+		cmsg = cmsg[msgSpace:]
+	}
+	return
+}
+
 func ParseOrigDstAddrCmsg(cmsg []byte) (netip.AddrPort, error) {
 	if len(cmsg) < unix.SizeofCmsghdr {
 		return netip.AddrPort{}, fmt.Errorf("control message length %d is shorter than cmsghdr length", len(cmsg))
@@ -439,34 +557,104 @@ func Sendmmsg(conn *net.UDPConn, msgvec []Mmsghdr) (n int, err error) {
 	return
 }
 
+const (
+	// writeMsgvecENOBUFSRetries is the maximum number of times WriteMsgvec backs off and retries
+	// after sendmmsg(2) fails with ENOBUFS, before dropping the messages that fail.
+	writeMsgvecENOBUFSRetries = 2
+
+	// writeMsgvecENOBUFSBackoff is the initial backoff before retrying after ENOBUFS.
+	// It is doubled on each retry.
+	writeMsgvecENOBUFSBackoff = 100 * time.Microsecond
+)
+
+// DroppedMessagesError is returned by WriteMsgvec when messages were dropped
+// because sendmmsg(2) kept failing with ENOBUFS after retries.
+type DroppedMessagesError struct {
+	// Count is the number of dropped messages.
+	Count int
+}
+
+func (e *DroppedMessagesError) Error() string {
+	return fmt.Sprintf("sendmmsg: dropped %d messages after retrying: %s", e.Count, unix.ENOBUFS)
+}
+
+func (e *DroppedMessagesError) Unwrap() error {
+	return unix.ENOBUFS
+}
+
 // WriteMsgvec repeatedly calls sendmmsg(2) until all messages in msgvec are written to the socket.
 //
-// If the syscall returns an error, this function drops the message that caused the error,
+// ENOBUFS indicates transient send buffer pressure. When it occurs, this function backs off
+// briefly and retries the unsent messages, up to writeMsgvecENOBUFSRetries times per call.
+// Once the retries are exhausted, messages that fail with ENOBUFS are dropped, and if no other
+// error is encountered, a *DroppedMessagesError is returned.
+//
+// If the syscall returns any other error, this function drops the message that caused the error,
 // and continues sending. Only the last encountered error is returned.
-func WriteMsgvec(conn *net.UDPConn, msgvec []Mmsghdr) error {
+//
+// sendmmsg(2) may write fewer messages than requested. The unsent messages are retried
+// once the socket is writable again, so they are never silently lost.
+// The returned n is the number of messages written to the socket. Callers should treat
+// the remaining len(msgvec) - n messages as dropped.
+func WriteMsgvec(conn *net.UDPConn, msgvec []Mmsghdr) (n int, err error) {
 	rawConn, err := conn.SyscallConn()
 	if err != nil {
-		return fmt.Errorf("failed to get syscall.RawConn: %w", err)
+		return 0, fmt.Errorf("failed to get syscall.RawConn: %w", err)
 	}
 
-	var processed int
+	var (
+		processed int
+		dropped   int
+		failed    int
+		retries   int
+		backoff   = writeMsgvecENOBUFSBackoff
+	)
+
+	for {
+		var retry bool
+
+		perr := rawConn.Write(func(fd uintptr) (done bool) {
+			r0, _, e1 := unix.Syscall6(unix.SYS_SENDMMSG, fd, uintptr(unsafe.Pointer(&msgvec[processed])), uintptr(len(msgvec)-processed), 0, 0, 0)
+			switch e1 {
+			case 0:
+			case unix.EAGAIN: // EWOULDBLOCK has the same value on Linux.
+				return false
+			case unix.ENOBUFS:
+				if retries < writeMsgvecENOBUFSRetries {
+					retry = true
+					return true
+				}
+				dropped++
+				failed++
+				r0 = 1
+			default:
+				err = os.NewSyscallError("sendmmsg", e1)
+				failed++
+				r0 = 1
+			}
+			processed += int(r0)
+			return processed >= len(msgvec)
+		})
 
-	perr := rawConn.Write(func(fd uintptr) (done bool) {
-		r0, _, e1 := unix.Syscall6(unix.SYS_SENDMMSG, fd, uintptr(unsafe.Pointer(&msgvec[processed])), uintptr(len(msgvec)-processed), 0, 0, 0)
-		if e1 == unix.EAGAIN || e1 == unix.EWOULDBLOCK {
-			return false
+		if perr != nil {
+			if err == nil {
+				err = perr
+			}
+			return processed - failed, err
 		}
-		if e1 != 0 {
-			err = os.NewSyscallError("sendmmsg", e1)
-			r0 = 1
+
+		if !retry {
+			break
 		}
-		processed += int(r0)
-		return processed >= len(msgvec)
-	})
 
-	if err == nil {
-		err = perr
+		retries++
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	if err == nil && dropped > 0 {
+		err = &DroppedMessagesError{Count: dropped}
 	}
 
-	return err
+	return processed - failed, err
 }
@@ -0,0 +1,37 @@
+package conn
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestListenUDPReuseAddr(t *testing.T) {
+	for _, reuseAddr := range []bool{false, true} {
+		c, err := ListenUDP("udp", "127.0.0.1:0", false, reuseAddr, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rawConn, err := c.SyscallConn()
+		if err != nil {
+			c.Close()
+			t.Fatal(err)
+		}
+
+		var value int
+		if cerr := rawConn.Control(func(fd uintptr) {
+			value, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR)
+		}); cerr != nil {
+			c.Close()
+			t.Fatal(cerr)
+		}
+		c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := value != 0; got != reuseAddr {
+			t.Errorf("ListenUDP(reuseAddr: %v): SO_REUSEADDR is %d", reuseAddr, value)
+		}
+	}
+}
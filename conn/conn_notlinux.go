@@ -2,11 +2,17 @@
 
 package conn
 
-import "github.com/database64128/tfo-go/v2"
+import (
+	"time"
+
+	"github.com/database64128/tfo-go/v2"
+)
 
 // NewDialer returns a tfo.Dialer with the specified options applied.
-func NewDialer(dialerTFO bool, dialerFwmark int) (dialer tfo.Dialer) {
+// If dialerTimeout is positive, it bounds the time spent establishing a connection.
+func NewDialer(dialerTFO bool, dialerFwmark int, dialerTimeout time.Duration) (dialer tfo.Dialer) {
 	dialer.DisableTFO = !dialerTFO
+	dialer.Timeout = dialerTimeout
 	return
 }
 
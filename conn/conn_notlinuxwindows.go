@@ -15,3 +15,19 @@ const SocketControlMessageBufferSize = 0
 func ParsePktinfoCmsg(cmsg []byte) (netip.Addr, uint32, error) {
 	return netip.Addr{}, 0, nil
 }
+
+// ParseSocketControlMessage parses all socket control messages in cmsg.
+//
+// This function is only implemented for Linux and Windows. On other platforms, this is a no-op.
+func ParseSocketControlMessage(cmsg []byte) (SocketControlMessage, error) {
+	return SocketControlMessage{}, nil
+}
+
+// BuildPktinfoCmsg builds a socket control message that specifies addr as the source address
+// and ifindex as the outgoing interface. If addr is an IPv4 address, the message is of type IP_PKTINFO.
+// Otherwise, including for IPv4-mapped IPv6 addresses, the message is of type IPV6_PKTINFO.
+//
+// This function is only implemented for Linux and Windows. On other platforms, it returns nil.
+func BuildPktinfoCmsg(addr netip.Addr, ifindex uint32) []byte {
+	return nil
+}
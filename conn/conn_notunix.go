@@ -2,6 +2,9 @@
 
 package conn
 
+// ReportsMessageTruncation is true if [ParseFlagsForError] detects truncated packets on this platform.
+const ReportsMessageTruncation = false
+
 // ParseFlagsForError parses the message flags returned by
 // the ReadMsgUDPAddrPort method and returns an error if MSG_TRUNC
 // is set, indicating that the returned packet was truncated.
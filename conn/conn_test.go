@@ -0,0 +1,288 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// staticResolver answers lookups from a fixed map.
+type staticResolver map[string][]netip.Addr
+
+func (r staticResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	ips, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+func setDefaultResolver(t *testing.T, r Resolver) {
+	t.Helper()
+	oldResolver := DefaultResolver
+	DefaultResolver = r
+	t.Cleanup(func() { DefaultResolver = oldResolver })
+}
+
+func TestResolveAddrWithResolver(t *testing.T) {
+	first := netip.MustParseAddr("2001:db8::1")
+	second := netip.MustParseAddr("192.0.2.1")
+
+	setDefaultResolver(t, staticResolver{
+		"example.com": {first, second},
+		"empty.test":  {},
+		"mapped.test": {netip.AddrFrom16(second.As16())},
+	})
+
+	ip, err := ResolveAddr("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != first {
+		t.Errorf("ResolveAddr() returned %s, expected %s", ip, first)
+	}
+
+	ipPort, err := addrDomain.ResolveIPPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := netip.AddrPortFrom(first, addrDomainPort); ipPort != expected {
+		t.Errorf("addrDomain.ResolveIPPort() returned %s, expected %s", ipPort, expected)
+	}
+
+	ip, err = ResolveAddr("mapped.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != second {
+		t.Errorf("ResolveAddr() on IPv4-mapped IPv6 answer returned %s, expected %s", ip, second)
+	}
+
+	var dnsErr *net.DNSError
+
+	if _, err = ResolveAddr("empty.test"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("ResolveAddr() on empty answer returned %v, expected not found error", err)
+	}
+
+	if _, err = ResolveAddr("missing.test"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("ResolveAddr() on missing host returned %v, expected not found error", err)
+	}
+}
+
+func addrsEqual(a, b []netip.Addr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestResolveAddrFamily(t *testing.T) {
+	ip4 := netip.MustParseAddr("192.0.2.1")
+	ip6 := netip.MustParseAddr("2001:db8::1")
+
+	setDefaultResolver(t, staticResolver{
+		"dual.test": {ip6, netip.AddrFrom16(ip4.As16())},
+		"ipv4.test": {ip4},
+		"ipv6.test": {ip6},
+	})
+
+	for _, c := range []struct {
+		host     string
+		family   AddrFamily
+		expected netip.Addr
+	}{
+		{"dual.test", AddrFamilyAny, ip6},
+		{"dual.test", AddrFamilyIPv4, ip4},
+		{"dual.test", AddrFamilyIPv6, ip6},
+		{"ipv4.test", AddrFamilyIPv6, ip4},
+		{"ipv6.test", AddrFamilyIPv4, ip6},
+	} {
+		ip, err := ResolveAddrFamilyContext(context.Background(), c.host, c.family)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip != c.expected {
+			t.Errorf("ResolveAddrFamilyContext(%q, %s) returned %s, expected %s", c.host, c.family, ip, c.expected)
+		}
+	}
+
+	for _, c := range []struct {
+		host     string
+		family   AddrFamily
+		expected []netip.Addr
+	}{
+		{"dual.test", AddrFamilyAny, []netip.Addr{ip6, ip4}},
+		{"dual.test", AddrFamilyIPv4, []netip.Addr{ip4, ip6}},
+		{"dual.test", AddrFamilyIPv6, []netip.Addr{ip6, ip4}},
+		{"ipv4.test", AddrFamilyIPv6, []netip.Addr{ip4}},
+	} {
+		ips, err := ResolveAddrsFamilyContext(context.Background(), c.host, c.family)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !addrsEqual(ips, c.expected) {
+			t.Errorf("ResolveAddrsFamilyContext(%q, %s) returned %v, expected %v", c.host, c.family, ips, c.expected)
+		}
+	}
+
+	for _, c := range []struct {
+		addr     netip.Addr
+		expected AddrFamily
+	}{
+		{netip.Addr{}, AddrFamilyAny},
+		{ip4, AddrFamilyIPv4},
+		{netip.AddrFrom16(ip4.As16()), AddrFamilyIPv4},
+		{ip6, AddrFamilyIPv6},
+	} {
+		if family := AddrFamilyOf(c.addr); family != c.expected {
+			t.Errorf("AddrFamilyOf(%s) returned %s, expected %s", c.addr, family, c.expected)
+		}
+	}
+}
+
+// blockingResolver blocks until the context is done.
+type blockingResolver struct{}
+
+func (blockingResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestResolveAddrContextTimeout(t *testing.T) {
+	setDefaultResolver(t, blockingResolver{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := addrDomain.ResolveIPContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("addrDomain.ResolveIPContext() returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+
+	ip, err := addrIP.ResolveIPContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != addrIP.IP() {
+		t.Errorf("addrIP.ResolveIPContext() returned %s, expected %s", ip, addrIP.IP())
+	}
+}
+
+func TestBuildParsePktinfoCmsg(t *testing.T) {
+	for _, addr := range []netip.Addr{
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("2001:db8::1"),
+		netip.MustParseAddr("::ffff:192.0.2.1"),
+	} {
+		const ifindex = 42
+
+		cmsg := BuildPktinfoCmsg(addr, ifindex)
+		if SocketControlMessageBufferSize == 0 {
+			// No-op fallback.
+			if cmsg != nil {
+				t.Errorf("BuildPktinfoCmsg(%s, %d) returned %v, expected nil", addr, ifindex, cmsg)
+			}
+			continue
+		}
+		if len(cmsg) > int(SocketControlMessageBufferSize) {
+			t.Errorf("BuildPktinfoCmsg(%s, %d) returned %d bytes, more than the receive buffer size %d", addr, ifindex, len(cmsg), SocketControlMessageBufferSize)
+		}
+
+		parsedAddr, parsedIfindex, err := ParsePktinfoCmsg(cmsg)
+		if err != nil {
+			t.Errorf("ParsePktinfoCmsg(BuildPktinfoCmsg(%s, %d)) failed: %v", addr, ifindex, err)
+			continue
+		}
+		if parsedAddr != addr {
+			t.Errorf("ParsePktinfoCmsg(BuildPktinfoCmsg(%s, %d)) returned address %s", addr, ifindex, parsedAddr)
+		}
+		if parsedIfindex != ifindex {
+			t.Errorf("ParsePktinfoCmsg(BuildPktinfoCmsg(%s, %d)) returned ifindex %d", addr, ifindex, parsedIfindex)
+		}
+	}
+}
+
+func TestListenUDPAddrPort(t *testing.T) {
+	c, addrPort, err := ListenUDPAddrPort("udp", "127.0.0.1:0", false, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if expected := c.LocalAddr().(*net.UDPAddr).AddrPort(); addrPort != expected {
+		t.Errorf("ListenUDPAddrPort() returned %s, expected %s", addrPort, expected)
+	}
+
+	wc, addrPort, err := ListenUDPAddrPort("udp", "", false, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wc.Close()
+
+	if port := wc.LocalAddr().(*net.UDPAddr).AddrPort().Port(); addrPort.Port() != port {
+		t.Errorf("ListenUDPAddrPort() returned port %d, expected %d", addrPort.Port(), port)
+	}
+
+	// If a route is available, the unspecified address is replaced with the preferred source address.
+	_, err6 := SourceAddrFor(sourceProbeAddrPort6.Addr())
+	_, err4 := SourceAddrFor(sourceProbeAddrPort4.Addr())
+	if (err6 == nil || err4 == nil) && addrPort.Addr().IsUnspecified() {
+		t.Errorf("ListenUDPAddrPort() returned unspecified address %s despite a route", addrPort)
+	}
+}
+
+func TestSourceAddrFor(t *testing.T) {
+	for _, c := range []struct {
+		dst      netip.Addr
+		expected netip.Addr
+	}{
+		{netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("127.0.0.1")},
+		{netip.MustParseAddr("::ffff:127.0.0.1"), netip.MustParseAddr("127.0.0.1")},
+		{netip.MustParseAddr("127.0.0.2"), netip.MustParseAddr("127.0.0.1")},
+	} {
+		src, err := SourceAddrFor(c.dst)
+		if err != nil {
+			t.Fatalf("SourceAddrFor(%s) failed: %v", c.dst, err)
+		}
+		if src != c.expected {
+			t.Errorf("SourceAddrFor(%s) = %s, expected %s", c.dst, src, c.expected)
+		}
+	}
+
+	if _, err := SourceAddrFor(netip.Addr{}); err == nil {
+		t.Error("SourceAddrFor() succeeded with an invalid address")
+	}
+}
+
+func TestNewDialerTimeout(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	dialer := NewDialer(false, 0, time.Nanosecond)
+	c, err := dialer.Dial("tcp", ln.Addr().String(), nil)
+	if err == nil {
+		c.Close()
+		t.Fatal("Dial succeeded with an expired timeout")
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Dial returned %v, expected a timeout error", err)
+	}
+
+	dialer = NewDialer(false, 0, time.Minute)
+	c, err = dialer.Dial("tcp", ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
@@ -3,15 +3,13 @@
 package conn
 
 import (
-	"errors"
+	"fmt"
 
 	"golang.org/x/sys/unix"
 )
 
-var (
-	ErrMessageTruncated        = errors.New("the packet is larger than the supplied buffer")
-	ErrControlMessageTruncated = errors.New("the control message is larger than the supplied buffer")
-)
+// ReportsMessageTruncation is true if [ParseFlagsForError] detects truncated packets on this platform.
+const ReportsMessageTruncation = true
 
 // ParseFlagsForError parses the message flags returned by
 // the ReadMsgUDPAddrPort method and returns an error if MSG_TRUNC
@@ -30,3 +28,10 @@ func ParseFlagsForError(flags int) error {
 
 	return nil
 }
+
+func setReuseAddr(fd int) error {
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+		return fmt.Errorf("failed to set socket option SO_REUSEADDR: %w", err)
+	}
+	return nil
+}
@@ -55,6 +55,9 @@ func setPktinfo(fd windows.Handle, network string) error {
 	return nil
 }
 
+// ReuseAddrSupported is true if [ListenUDP] supports setting SO_REUSEADDR on this platform.
+const ReuseAddrSupported = false
+
 // ListenUDP wraps [net.ListenConfig.ListenPacket] and sets socket options on supported platforms.
 //
 // On Linux and Windows, IP_MTU_DISCOVER and IPV6_MTU_DISCOVER are set to IP_PMTUDISC_DO to disable IP fragmentation
@@ -63,7 +66,11 @@ func setPktinfo(fd windows.Handle, network string) error {
 // On Linux, SO_MARK is set to user-specified value.
 //
 // On macOS and FreeBSD, IP_DONTFRAG, IPV6_DONTFRAG are set to 1 (Don't Fragment).
-func ListenUDP(network string, laddr string, pktinfo bool, fwmark int) (*net.UDPConn, error) {
+//
+// On Linux, macOS, and FreeBSD, if reuseAddr is true, SO_REUSEADDR is set to 1,
+// so that the address can be bound again right after a restart. It is ignored on other platforms,
+// because SO_REUSEADDR on Windows allows other sockets to take over the bound address.
+func ListenUDP(network string, laddr string, pktinfo, reuseAddr bool, fwmark int) (*net.UDPConn, error) {
 	lc := net.ListenConfig{
 		Control: func(network, address string, c syscall.RawConn) (err error) {
 			if cerr := c.Control(func(fd uintptr) {
@@ -143,3 +150,79 @@ func ParsePktinfoCmsg(cmsg []byte) (netip.Addr, uint32, error) {
 		return netip.Addr{}, 0, fmt.Errorf("unknown control message level %d type %d", cmsghdr.Level, cmsghdr.Type)
 	}
 }
+
+// ParseSocketControlMessage parses all socket control messages in cmsg.
+// It recognizes IP_PKTINFO and IPV6_PKTINFO. Other control messages are skipped.
+//
+// This function is only implemented for Linux and Windows. On other platforms, this is a no-op.
+func ParseSocketControlMessage(cmsg []byte) (m SocketControlMessage, err error) {
+	for len(cmsg) > 0 {
+		if len(cmsg) < int(SizeofCmsghdr) {
+			return m, fmt.Errorf("control message length %d is shorter than cmsghdr length", len(cmsg))
+		}
+
+		cmsghdr := (*Cmsghdr)(unsafe.Pointer(&cmsg[0]))
+		msgLen := int(cmsghdr.Len)
+		if msgLen < int(SizeofCmsghdr) || msgLen > len(cmsg) {
+			return m, fmt.Errorf("invalid control message length %d for buffer length %d", msgLen, len(cmsg))
+		}
+
+		// The last message may not be padded to alignment.
+		msgSpace := int(SizeofCmsghdr + cmsgAlign(uintptr(msgLen)-SizeofCmsghdr))
+		if msgSpace > len(cmsg) {
+			msgSpace = len(cmsg)
+		}
+		data := cmsg[SizeofCmsghdr:msgLen]
+
+		switch {
+		case cmsghdr.Level == windows.IPPROTO_IP && cmsghdr.Type == windows.IP_PKTINFO && len(data) >= int(SizeofInet4Pktinfo):
+			pktinfo := (*Inet4Pktinfo)(unsafe.Pointer(&data[0]))
+			m.PktinfoCmsg = cmsg[:msgSpace]
+			m.PktinfoAddr = netip.AddrFrom4(pktinfo.Addr)
+			m.PktinfoIfindex = pktinfo.Ifindex
+
+		case cmsghdr.Level == windows.IPPROTO_IPV6 && cmsghdr.Type == windows.IPV6_PKTINFO && len(data) >= int(SizeofInet6Pktinfo):
+			pktinfo := (*Inet6Pktinfo)(unsafe.Pointer(&data[0]))
+			m.PktinfoCmsg = cmsg[:msgSpace]
+			m.PktinfoAddr = netip.AddrFrom16(pktinfo.Addr)
+			m.PktinfoIfindex = pktinfo.Ifindex
+		}
+
+		cmsg = cmsg[msgSpace:]
+	}
+	return
+}
+
+// BuildPktinfoCmsg builds a socket control message that specifies addr as the source address
+// and ifindex as the outgoing interface. If addr is an IPv4 address, the message is of type IP_PKTINFO.
+// Otherwise, including for IPv4-mapped IPv6 addresses, the message is of type IPV6_PKTINFO.
+//
+// This function is only implemented for Linux and Windows. On other platforms, it returns nil.
+func BuildPktinfoCmsg(addr netip.Addr, ifindex uint32) []byte {
+	if addr.Is4() {
+		cmsg := make([]byte, SizeofCmsghdr+cmsgAlign(SizeofInet4Pktinfo))
+		cmsghdr := (*Cmsghdr)(unsafe.Pointer(&cmsg[0]))
+		cmsghdr.Len = uint(SizeofCmsghdr + SizeofInet4Pktinfo)
+		cmsghdr.Level = windows.IPPROTO_IP
+		cmsghdr.Type = windows.IP_PKTINFO
+		pktinfo := (*Inet4Pktinfo)(unsafe.Pointer(&cmsg[SizeofCmsghdr]))
+		pktinfo.Addr = addr.As4()
+		pktinfo.Ifindex = ifindex
+		return cmsg
+	}
+
+	cmsg := make([]byte, SizeofCmsghdr+cmsgAlign(SizeofInet6Pktinfo))
+	cmsghdr := (*Cmsghdr)(unsafe.Pointer(&cmsg[0]))
+	cmsghdr.Len = uint(SizeofCmsghdr + SizeofInet6Pktinfo)
+	cmsghdr.Level = windows.IPPROTO_IPV6
+	cmsghdr.Type = windows.IPV6_PKTINFO
+	pktinfo := (*Inet6Pktinfo)(unsafe.Pointer(&cmsg[SizeofCmsghdr]))
+	pktinfo.Addr = addr.As16()
+	pktinfo.Ifindex = ifindex
+	return cmsg
+}
+
+// cmsgAlign rounds n up to the alignment of control message data.
+func cmsgAlign(n uintptr) uintptr {
+	return (n + SizeofPtr - 1) & ^(SizeofPtr - 1)
+}
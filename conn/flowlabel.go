@@ -0,0 +1,33 @@
+package conn
+
+// maxFlowLabel is the largest IPv6 flow label that can be registered with the kernel.
+//
+// The high bit of the 20-bit flow label is reserved for stateless flow labels on Linux
+// when net.ipv6.flowlabel_state_ranges is enabled.
+const maxFlowLabel = 1<<19 - 1
+
+// FlowLabelFromID derives a stable, non-zero IPv6 flow label from id and salt.
+//
+// Use it to pin all datagrams of a session to the same ECMP path.
+// salt is mixed into id before hashing, so that labels cannot be predicted from IDs,
+// and the same ID maps to unrelated labels under different salts.
+//
+// Labels are spread uniformly over the 2^19-1 valid values, so distinct IDs may share a label.
+// Among n IDs, the probability that any two share a label is about 1-exp(-n²/2^20):
+// roughly 1% for 100 IDs, 61% for 1000 IDs.
+func FlowLabelFromID(id, salt uint64) uint32 {
+	id ^= salt
+
+	// splitmix64 finalizer
+	id ^= id >> 30
+	id *= 0xbf58476d1ce4e5b9
+	id ^= id >> 27
+	id *= 0x94d049bb133111eb
+	id ^= id >> 31
+
+	label := uint32(id) & maxFlowLabel
+	if label == 0 {
+		label = 1
+	}
+	return label
+}
@@ -0,0 +1,92 @@
+package conn
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Source: include/uapi/linux/in6.h
+const (
+	ipv6FlowlabelMgr = 32
+	ipv6FlowinfoSend = 33
+
+	ipv6FlActionGet  = 0
+	ipv6FlFlagCreate = 1
+	ipv6FlFlagExcl   = 2
+	ipv6FlShareExcl  = 1
+
+	sizeofIn6FlowlabelReq = 32
+)
+
+// in6FlowlabelReq is struct in6_flowlabel_req.
+type in6FlowlabelReq struct {
+	Dst     [16]byte
+	Label   [4]byte // big endian
+	Action  uint8
+	Share   uint8
+	Flags   uint16
+	Expires uint16
+	Linger  uint16
+	_       uint32
+}
+
+// SetFlowLabel registers label as an exclusive IPv6 flow label on the socket,
+// and enables IPV6_FLOWINFO_SEND, so that the flow label in the destination
+// sockaddr of each sendmsg(2) and sendmmsg(2) call is applied to outgoing IPv6 packets.
+//
+// Use [SetSockaddrFlowLabel] to put the flow label in the destination sockaddr.
+// The label must be in the range [1, 0x7ffff].
+//
+// The kernel requires a specified destination address when creating a flow label.
+// Once registered, the label can be used with any destination.
+func SetFlowLabel(c *net.UDPConn, dst netip.Addr, label uint32) error {
+	if label == 0 || label > maxFlowLabel {
+		return fmt.Errorf("flow label out of range: %#x", label)
+	}
+	if !dst.Is6() || dst.IsUnspecified() {
+		return fmt.Errorf("invalid flow label destination: %s", dst)
+	}
+
+	rawConn, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	req := in6FlowlabelReq{
+		Dst:    dst.As16(),
+		Label:  [4]byte{byte(label >> 24), byte(label >> 16), byte(label >> 8), byte(label)},
+		Action: ipv6FlActionGet,
+		Share:  ipv6FlShareExcl,
+		Flags:  ipv6FlFlagCreate | ipv6FlFlagExcl,
+	}
+
+	var serr error
+
+	if err = rawConn.Control(func(fd uintptr) {
+		b := (*[sizeofIn6FlowlabelReq]byte)(unsafe.Pointer(&req))
+		if serr = unix.SetsockoptString(int(fd), unix.IPPROTO_IPV6, ipv6FlowlabelMgr, string(b[:])); serr != nil {
+			serr = fmt.Errorf("failed to set socket option IPV6_FLOWLABEL_MGR: %w", serr)
+			return
+		}
+		if serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, ipv6FlowinfoSend, 1); serr != nil {
+			serr = fmt.Errorf("failed to set socket option IPV6_FLOWINFO_SEND: %w", serr)
+		}
+	}); err != nil {
+		return err
+	}
+
+	return serr
+}
+
+// SetSockaddrFlowLabel sets the flow label in the sin6_flowinfo field of rsa6.
+func SetSockaddrFlowLabel(rsa6 *unix.RawSockaddrInet6, label uint32) {
+	p := (*[4]byte)(unsafe.Pointer(&rsa6.Flowinfo))
+	p[0] = byte(label >> 24)
+	p[1] = byte(label >> 16)
+	p[2] = byte(label >> 8)
+	p[3] = byte(label)
+}
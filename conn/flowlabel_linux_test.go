@@ -0,0 +1,41 @@
+package conn
+
+import (
+	"errors"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSetFlowLabel(t *testing.T) {
+	c, err := ListenUDP("udp6", "[::1]:0", false, false, 0)
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	defer c.Close()
+
+	// Flow labels linger in the kernel after the socket is closed,
+	// so salt the label with the current time to avoid collisions between test runs.
+	dst := netip.IPv6Loopback()
+	label := FlowLabelFromID(0xdeadbeef, uint64(time.Now().UnixNano()))
+
+	if err = SetFlowLabel(c, dst, label); err != nil {
+		t.Fatal(err)
+	}
+
+	c1, err := ListenUDP("udp6", "[::1]:0", false, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+
+	// Exclusive flow labels cannot be registered twice.
+	if err = SetFlowLabel(c1, dst, label); !errors.Is(err, syscall.EEXIST) {
+		t.Errorf("Expected EEXIST when registering an exclusive flow label twice, got %v", err)
+	}
+
+	if err = SetFlowLabel(c1, netip.IPv6Unspecified(), label+1); err == nil {
+		t.Error("Expected error when registering a flow label with an unspecified destination")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package conn
+
+import (
+	"net"
+	"net/netip"
+)
+
+// SetFlowLabel is a no-op on platforms other than Linux.
+func SetFlowLabel(c *net.UDPConn, dst netip.Addr, label uint32) error {
+	return nil
+}
@@ -0,0 +1,33 @@
+package conn
+
+import "testing"
+
+func TestFlowLabelFromID(t *testing.T) {
+	for id := uint64(0); id < 1<<16; id++ {
+		label := FlowLabelFromID(id, 0)
+		if label == 0 || label > maxFlowLabel {
+			t.Fatalf("FlowLabelFromID(%d, 0) returned out-of-range label %#x", id, label)
+		}
+		if again := FlowLabelFromID(id, 0); again != label {
+			t.Fatalf("FlowLabelFromID(%d, 0) is not stable: %#x != %#x", id, label, again)
+		}
+	}
+}
+
+func TestFlowLabelFromIDSalt(t *testing.T) {
+	const (
+		n    = 1 << 16
+		salt = 0x9e3779b97f4a7c15
+	)
+
+	// Under different salts, an ID keeps its label only by chance, with a probability of about 2^-19.
+	var same int
+	for id := uint64(0); id < n; id++ {
+		if FlowLabelFromID(id, 0) == FlowLabelFromID(id, salt) {
+			same++
+		}
+	}
+	if same > 8 {
+		t.Errorf("%d of %d IDs map to the same label under different salts", same, n)
+	}
+}
@@ -0,0 +1,13 @@
+package conn
+
+import "errors"
+
+var ErrHandoffUnsupported = errors.New("handing off file descriptors is not supported on this platform")
+
+const (
+	// MaxHandoffFiles is the maximum number of file descriptors in a single SCM_RIGHTS message (SCM_MAX_FD).
+	MaxHandoffFiles = 253
+
+	// MaxHandoffDataSize is the maximum size of the data sent along with handed off files.
+	MaxHandoffDataSize = 65536
+)
@@ -0,0 +1,99 @@
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// HandoffSupported is true if [SendFiles] and [ReceiveFiles] are supported on this platform.
+const HandoffSupported = true
+
+// SendFiles sends data and files over c in a single message, with their file descriptors in an SCM_RIGHTS control message.
+// data describes the files to the receiver, and must not be empty.
+//
+// The files remain open in the sending process. The receiver gets duplicates that refer to the same open file descriptions,
+// so sockets handed off this way keep their bound addresses, socket options, and queued packets.
+func SendFiles(c *net.UnixConn, data []byte, files []*os.File) error {
+	if len(data) == 0 || len(data) > MaxHandoffDataSize {
+		return fmt.Errorf("handoff data size out of range [1, %d]: %d", MaxHandoffDataSize, len(data))
+	}
+	if len(files) > MaxHandoffFiles {
+		return fmt.Errorf("too many files to hand off: %d > %d", len(files), MaxHandoffFiles)
+	}
+
+	// Get file descriptors without calling Fd, which would put them in blocking mode.
+	// The mode is shared with the sockets that are still being served in this process.
+	fds := make([]int, len(files))
+	for i, f := range files {
+		rawConn, err := f.SyscallConn()
+		if err != nil {
+			return err
+		}
+		if err = rawConn.Control(func(fd uintptr) {
+			fds[i] = int(fd)
+		}); err != nil {
+			return err
+		}
+	}
+
+	var oob []byte
+	if len(fds) > 0 {
+		oob = unix.UnixRights(fds...)
+	}
+	_, _, err := c.WriteMsgUnix(data, oob, nil)
+	runtime.KeepAlive(files)
+	return err
+}
+
+// ReceiveFiles receives data and files sent by [SendFiles] over c.
+// The files are returned in the order they were sent.
+// The caller is responsible for closing the returned files.
+func ReceiveFiles(c *net.UnixConn) ([]byte, []*os.File, error) {
+	b := make([]byte, MaxHandoffDataSize)
+	oob := make([]byte, unix.CmsgSpace(MaxHandoffFiles*4))
+
+	n, oobn, flags, _, err := c.ReadMsgUnix(b, oob)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Parse file descriptors first, so that they are not leaked on error.
+	var fds []int
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse control messages: %w", err)
+	}
+	for i := range msgs {
+		rights, err := unix.ParseUnixRights(&msgs[i])
+		if err != nil {
+			continue
+		}
+		fds = append(fds, rights...)
+	}
+
+	closeFds := func() {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+	}
+
+	if err = ParseFlagsForError(flags); err != nil {
+		closeFds()
+		return nil, nil, err
+	}
+	if n == 0 {
+		closeFds()
+		return nil, nil, errors.New("received empty handoff message")
+	}
+
+	files := make([]*os.File, len(fds))
+	for i, fd := range fds {
+		files[i] = os.NewFile(uintptr(fd), "handoff")
+	}
+	return b[:n], files, nil
+}
@@ -0,0 +1,115 @@
+package conn
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// unixConnPair returns a connected pair of SOCK_SEQPACKET Unix sockets.
+func unixConnPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		conns[i] = c.(*net.UnixConn)
+	}
+	return conns[0], conns[1]
+}
+
+func TestSendReceiveFiles(t *testing.T) {
+	sender, receiver := unixConnPair(t)
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	udpAddr := udpConn.LocalAddr().String()
+
+	udpFile, err := udpConn.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpFile.Close()
+
+	if err = SendFiles(sender, []byte("udp"), []*os.File{udpFile}); err != nil {
+		t.Fatalf("SendFiles failed: %v", err)
+	}
+
+	data, files, err := ReceiveFiles(receiver)
+	if err != nil {
+		t.Fatalf("ReceiveFiles failed: %v", err)
+	}
+	for _, f := range files {
+		defer f.Close()
+	}
+	if string(data) != "udp" || len(files) != 1 {
+		t.Fatalf("ReceiveFiles returned %q and %d files, expected %q and 1 file", data, len(files), "udp")
+	}
+
+	pc, err := net.FilePacketConn(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	if addr := pc.LocalAddr().String(); addr != udpAddr {
+		t.Errorf("Received socket is bound to %s, expected %s", addr, udpAddr)
+	}
+
+	// The original socket must still be non-blocking, so that deadlines keep working.
+	rawConn, err := udpConn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		flags    int
+		fcntlErr error
+	)
+	if err = rawConn.Control(func(fd uintptr) {
+		flags, fcntlErr = unix.FcntlInt(fd, unix.F_GETFL, 0)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if fcntlErr != nil {
+		t.Fatal(fcntlErr)
+	}
+	if flags&unix.O_NONBLOCK == 0 {
+		t.Error("SendFiles put the socket in blocking mode")
+	}
+}
+
+func TestSendReceiveFilesDataOnly(t *testing.T) {
+	sender, receiver := unixConnPair(t)
+
+	if err := SendFiles(sender, []byte("done"), nil); err != nil {
+		t.Fatalf("SendFiles failed: %v", err)
+	}
+	data, files, err := ReceiveFiles(receiver)
+	if err != nil {
+		t.Fatalf("ReceiveFiles failed: %v", err)
+	}
+	if string(data) != "done" || len(files) != 0 {
+		t.Errorf("ReceiveFiles returned %q and %d files, expected %q and no files", data, len(files), "done")
+	}
+}
+
+func TestSendFilesEmptyData(t *testing.T) {
+	sender, _ := unixConnPair(t)
+	if err := SendFiles(sender, nil, []*os.File{os.Stdin}); err == nil {
+		t.Error("SendFiles succeeded with empty data")
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package conn
+
+import (
+	"net"
+	"os"
+)
+
+// HandoffSupported is true if [SendFiles] and [ReceiveFiles] are supported on this platform.
+const HandoffSupported = false
+
+// SendFiles returns ErrHandoffUnsupported.
+func SendFiles(c *net.UnixConn, data []byte, files []*os.File) error {
+	return ErrHandoffUnsupported
+}
+
+// ReceiveFiles returns ErrHandoffUnsupported.
+func ReceiveFiles(c *net.UnixConn) ([]byte, []*os.File, error) {
+	return nil, nil, ErrHandoffUnsupported
+}
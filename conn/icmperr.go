@@ -0,0 +1,100 @@
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"syscall"
+)
+
+var ErrRecvErrUnsupported = errors.New("receiving ICMP errors is not supported on this platform")
+
+// ICMPErrorReason is the class of an ICMP or ICMPv6 error.
+type ICMPErrorReason uint8
+
+const (
+	// ICMPErrorOther is any ICMP error not covered by other reasons.
+	ICMPErrorOther ICMPErrorReason = iota
+
+	// ICMPErrorPortUnreachable is ICMP port unreachable or ICMPv6 port unreachable.
+	ICMPErrorPortUnreachable
+
+	// ICMPErrorHostUnreachable is ICMP host unreachable or ICMPv6 address unreachable.
+	ICMPErrorHostUnreachable
+
+	// ICMPErrorNetUnreachable is ICMP network unreachable or ICMPv6 no route to destination.
+	ICMPErrorNetUnreachable
+
+	// ICMPErrorProhibited is ICMP or ICMPv6 communication administratively prohibited.
+	ICMPErrorProhibited
+
+	// ICMPErrorPacketTooBig is ICMP fragmentation needed or ICMPv6 packet too big.
+	ICMPErrorPacketTooBig
+
+	// NumICMPErrorReasons is the number of ICMP error reasons.
+	NumICMPErrorReasons
+)
+
+var icmpErrorReasonNames = [NumICMPErrorReasons]string{
+	ICMPErrorOther:           "other",
+	ICMPErrorPortUnreachable: "port_unreachable",
+	ICMPErrorHostUnreachable: "host_unreachable",
+	ICMPErrorNetUnreachable:  "net_unreachable",
+	ICMPErrorProhibited:      "prohibited",
+	ICMPErrorPacketTooBig:    "packet_too_big",
+}
+
+// String returns the name of the reason.
+func (r ICMPErrorReason) String() string {
+	if r < NumICMPErrorReasons {
+		return icmpErrorReasonNames[r]
+	}
+	return "unknown"
+}
+
+// ICMPError is an ICMP or ICMPv6 error received on a socket's error queue.
+type ICMPError struct {
+	// Dest is the destination address of the datagram that triggered the error.
+	Dest netip.AddrPort
+
+	// Offender is the address of the node that sent the error.
+	// It is the zero value if unknown.
+	Offender netip.Addr
+
+	// Errno is the error the kernel translated the ICMP error into.
+	Errno syscall.Errno
+
+	// ICMPv6 is true if the error is an ICMPv6 error.
+	ICMPv6 bool
+
+	// Type and Code are the ICMP or ICMPv6 type and code.
+	Type uint8
+	Code uint8
+}
+
+// Reason classifies the error.
+func (e ICMPError) Reason() ICMPErrorReason {
+	switch e.Errno {
+	case syscall.ECONNREFUSED:
+		return ICMPErrorPortUnreachable
+	case syscall.EHOSTUNREACH:
+		return ICMPErrorHostUnreachable
+	case syscall.ENETUNREACH:
+		return ICMPErrorNetUnreachable
+	case syscall.EACCES:
+		return ICMPErrorProhibited
+	case syscall.EMSGSIZE:
+		return ICMPErrorPacketTooBig
+	default:
+		return ICMPErrorOther
+	}
+}
+
+// Error implements the error Error method.
+func (e ICMPError) Error() string {
+	proto := "ICMP"
+	if e.ICMPv6 {
+		proto = "ICMPv6"
+	}
+	return fmt.Sprintf("%s type %d code %d from %s for %s: %s", proto, e.Type, e.Code, e.Offender, e.Dest, e.Errno)
+}
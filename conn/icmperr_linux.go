@@ -0,0 +1,148 @@
+package conn
+
+import (
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// RecvErrSupported is true if [SetRecvErr] and [ReadICMPErrors] are supported on this platform.
+const RecvErrSupported = true
+
+const sizeofSockExtendedErr = int(unsafe.Sizeof(unix.SockExtendedErr{}))
+
+// SetRecvErr enables IP_RECVERR and IPV6_RECVERR on c,
+// so ICMP errors triggered by datagrams sent on c are queued on its error queue.
+//
+// While the error queue is not empty, reads and writes on c may fail with the error
+// of the most recent ICMP error. Callers should then drain the queue with [ReadICMPErrors].
+func SetRecvErr(c *net.UDPConn) error {
+	rawConn, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	if err = rawConn.Control(func(fd uintptr) {
+		// IP_RECVERR covers IPv4 traffic on dual-stack sockets.
+		if serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_RECVERR, 1); serr != nil {
+			serr = &net.OpError{Op: "setsockopt", Net: "udp", Source: c.LocalAddr(), Err: serr}
+			return
+		}
+		if serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_RECVERR, 1); serr != nil && serr != unix.ENOPROTOOPT {
+			serr = &net.OpError{Op: "setsockopt", Net: "udp", Source: c.LocalAddr(), Err: serr}
+			return
+		}
+		serr = nil
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// ReadICMPErrors drains the error queue of c without blocking, and returns the ICMP errors read.
+// Errors from origins other than ICMP and ICMPv6, such as local errors, are discarded.
+func ReadICMPErrors(c *net.UDPConn) ([]ICMPError, error) {
+	rawConn, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		icmpErrors []ICMPError
+		rerr       error
+		b          [1]byte // The original datagram is not needed.
+		oob        [unix.SizeofCmsghdr + sizeofSockExtendedErr + unix.SizeofSockaddrInet6 + 8]byte
+	)
+
+	if err = rawConn.Control(func(fd uintptr) {
+		for {
+			_, oobn, _, from, err := unix.Recvmsg(int(fd), b[:], oob[:], unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+			if err != nil {
+				if err != unix.EAGAIN {
+					rerr = &net.OpError{Op: "recvmsg", Net: "udp", Source: c.LocalAddr(), Err: err}
+				}
+				return
+			}
+
+			cmsgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+			if err != nil {
+				rerr = &net.OpError{Op: "recvmsg", Net: "udp", Source: c.LocalAddr(), Err: err}
+				return
+			}
+
+			for _, cmsg := range cmsgs {
+				if icmpErr, ok := parseRecvErrCmsg(cmsg); ok {
+					icmpErr.Dest = sockaddrToAddrPort(from)
+					icmpErrors = append(icmpErrors, icmpErr)
+				}
+			}
+		}
+	}); err != nil {
+		return nil, err
+	}
+	return icmpErrors, rerr
+}
+
+// parseRecvErrCmsg parses an IP_RECVERR or IPV6_RECVERR control message.
+// It returns false if cmsg is not one, or if the error did not originate from ICMP or ICMPv6.
+func parseRecvErrCmsg(cmsg unix.SocketControlMessage) (ICMPError, bool) {
+	switch {
+	case cmsg.Header.Level == unix.IPPROTO_IP && cmsg.Header.Type == unix.IP_RECVERR:
+	case cmsg.Header.Level == unix.IPPROTO_IPV6 && cmsg.Header.Type == unix.IPV6_RECVERR:
+	default:
+		return ICMPError{}, false
+	}
+
+	if len(cmsg.Data) < sizeofSockExtendedErr {
+		return ICMPError{}, false
+	}
+	ee := (*unix.SockExtendedErr)(unsafe.Pointer(&cmsg.Data[0]))
+
+	icmpErr := ICMPError{
+		Errno: syscall.Errno(ee.Errno),
+		Type:  ee.Type,
+		Code:  ee.Code,
+	}
+
+	switch ee.Origin {
+	case unix.SO_EE_ORIGIN_ICMP:
+	case unix.SO_EE_ORIGIN_ICMP6:
+		icmpErr.ICMPv6 = true
+	default:
+		return ICMPError{}, false
+	}
+
+	// The offender's address immediately follows the extended error.
+	offender := cmsg.Data[sizeofSockExtendedErr:]
+	if len(offender) >= 2 {
+		switch *(*uint16)(unsafe.Pointer(&offender[0])) {
+		case unix.AF_INET:
+			if len(offender) >= unix.SizeofSockaddrInet4 {
+				icmpErr.Offender = netip.AddrFrom4((*unix.RawSockaddrInet4)(unsafe.Pointer(&offender[0])).Addr)
+			}
+		case unix.AF_INET6:
+			if len(offender) >= unix.SizeofSockaddrInet6 {
+				icmpErr.Offender = netip.AddrFrom16((*unix.RawSockaddrInet6)(unsafe.Pointer(&offender[0])).Addr)
+			}
+		}
+	}
+
+	return icmpErr, true
+}
+
+// sockaddrToAddrPort converts an IPv4 or IPv6 sockaddr to a netip.AddrPort.
+// It returns the zero value for other address families.
+func sockaddrToAddrPort(sa unix.Sockaddr) netip.AddrPort {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return netip.AddrPortFrom(netip.AddrFrom4(sa.Addr), uint16(sa.Port))
+	case *unix.SockaddrInet6:
+		return netip.AddrPortFrom(netip.AddrFrom16(sa.Addr), uint16(sa.Port))
+	default:
+		return netip.AddrPort{}
+	}
+}
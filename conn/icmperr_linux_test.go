@@ -0,0 +1,69 @@
+package conn
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReadICMPErrors(t *testing.T) {
+	// Grab a free port and close it, so packets sent to it trigger ICMP port unreachable.
+	closedConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddrPort := closedConn.LocalAddr().(*net.UDPAddr).AddrPort()
+	closedConn.Close()
+
+	c, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = SetRecvErr(c); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = c.WriteToUDPAddrPort([]byte("hello"), closedAddrPort); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pending error is reported by the next read.
+	if err = c.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.ReadFromUDPAddrPort(make([]byte, 1)); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("Expected read to fail with ECONNREFUSED, got %v", err)
+	}
+
+	icmpErrors, err := ReadICMPErrors(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(icmpErrors) != 1 {
+		t.Fatalf("Read %d ICMP errors, expected 1: %v", len(icmpErrors), icmpErrors)
+	}
+
+	icmpErr := icmpErrors[0]
+	if icmpErr.Reason() != ICMPErrorPortUnreachable {
+		t.Errorf("Reason is %s, expected %s", icmpErr.Reason(), ICMPErrorPortUnreachable)
+	}
+	if icmpErr.ICMPv6 || icmpErr.Type != 3 || icmpErr.Code != 3 {
+		t.Errorf("Unexpected ICMP error %v", icmpErr)
+	}
+	if dest := netip.AddrPortFrom(icmpErr.Dest.Addr().Unmap(), icmpErr.Dest.Port()); dest != closedAddrPort {
+		t.Errorf("Dest is %s, expected %s", icmpErr.Dest, closedAddrPort)
+	}
+	if icmpErr.Offender.Unmap() != closedAddrPort.Addr() {
+		t.Errorf("Offender is %s, expected %s", icmpErr.Offender, closedAddrPort.Addr())
+	}
+
+	// The queue is now empty.
+	if icmpErrors, err = ReadICMPErrors(c); err != nil || len(icmpErrors) != 0 {
+		t.Errorf("ReadICMPErrors() returned %v, %v on an empty queue", icmpErrors, err)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package conn
+
+import "net"
+
+// RecvErrSupported is true if [SetRecvErr] and [ReadICMPErrors] are supported on this platform.
+const RecvErrSupported = false
+
+// SetRecvErr returns ErrRecvErrUnsupported.
+func SetRecvErr(c *net.UDPConn) error {
+	return ErrRecvErrUnsupported
+}
+
+// ReadICMPErrors returns ErrRecvErrUnsupported.
+func ReadICMPErrors(c *net.UDPConn) ([]ICMPError, error) {
+	return nil, ErrRecvErrUnsupported
+}
@@ -0,0 +1,28 @@
+package conn
+
+import (
+	"errors"
+	"net"
+)
+
+// ErrNetnsUnsupported is returned when a network namespace is requested on a platform without network namespaces.
+var ErrNetnsUnsupported = errors.New("network namespaces are not supported on this platform")
+
+// ListenUDPInNetns is like ListenUDPInPortRange, but creates the socket inside the named network namespace.
+// The socket stays in the namespace for its lifetime.
+//
+// If netns is empty, the socket is created in the current network namespace.
+func ListenUDPInNetns(network, netns string, portRange PortRange, pktinfo bool, fwmark int) (c *net.UDPConn, err error) {
+	if netns == "" {
+		return ListenUDPInPortRange(network, portRange, pktinfo, fwmark)
+	}
+	err = RunInNetns(netns, func() error {
+		c, err = ListenUDPInPortRange(network, portRange, pktinfo, fwmark)
+		return err
+	})
+	if err != nil && c != nil {
+		c.Close()
+		c = nil
+	}
+	return
+}
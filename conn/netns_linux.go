@@ -0,0 +1,77 @@
+package conn
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// NetnsSupported is true if [RunInNetns] supports named network namespaces on this platform.
+const NetnsSupported = true
+
+// netnsDir is where ip-netns(8) bind-mounts named network namespaces.
+const netnsDir = "/var/run/netns"
+
+// RunInNetns runs fn inside the named network namespace and returns its error.
+// If netns is empty, fn is run directly.
+//
+// fn is run on a dedicated goroutine locked to its OS thread. Sockets created by fn stay in the namespace,
+// but fn must not create sockets on other goroutines, because they would run on other threads.
+// Resolve host names before calling RunInNetns, since the resolver may dial from other goroutines.
+//
+// If the thread cannot be switched back to its original namespace, it is left locked,
+// so that the runtime terminates it instead of reusing it for other goroutines.
+func RunInNetns(netns string, fn func() error) error {
+	if netns == "" {
+		return fn()
+	}
+	if netns == "." || netns == ".." || strings.ContainsRune(netns, '/') {
+		return fmt.Errorf("invalid network namespace name: %q", netns)
+	}
+
+	target, err := os.Open(filepath.Join(netnsDir, netns))
+	if err != nil {
+		return fmt.Errorf("failed to open network namespace: %w", err)
+	}
+	defer target.Close()
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		runtime.LockOSThread()
+
+		orig, err := os.Open("/proc/thread-self/ns/net")
+		if err != nil {
+			runtime.UnlockOSThread()
+			errCh <- fmt.Errorf("failed to open current network namespace: %w", err)
+			return
+		}
+		defer orig.Close()
+
+		if err = unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			errCh <- fmt.Errorf("failed to enter network namespace %s: %w", netns, err)
+			return
+		}
+
+		fnErr := fn()
+
+		if err = unix.Setns(int(orig.Fd()), unix.CLONE_NEWNET); err != nil {
+			// Leave the thread locked. It is terminated when this goroutine exits.
+			if fnErr == nil {
+				fnErr = fmt.Errorf("failed to restore network namespace: %w", err)
+			}
+			errCh <- fnErr
+			return
+		}
+
+		runtime.UnlockOSThread()
+		errCh <- fnErr
+	}()
+
+	return <-errCh
+}
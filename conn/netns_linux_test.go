@@ -0,0 +1,27 @@
+package conn
+
+import "testing"
+
+func TestRunInNetnsEmpty(t *testing.T) {
+	var ran bool
+	if err := RunInNetns("", func() error {
+		ran = true
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !ran {
+		t.Error("fn was not run")
+	}
+}
+
+func TestRunInNetnsInvalidName(t *testing.T) {
+	for _, name := range []string{".", "..", "a/b", "../../proc/1/ns/net", "shadowsocks-go-test-nonexistent"} {
+		if err := RunInNetns(name, func() error {
+			t.Errorf("fn was run for %q", name)
+			return nil
+		}); err == nil {
+			t.Errorf("RunInNetns(%q) succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package conn
+
+// NetnsSupported is true if [RunInNetns] supports named network namespaces on this platform.
+const NetnsSupported = false
+
+// RunInNetns runs fn directly if netns is empty.
+// Otherwise, it returns ErrNetnsUnsupported, since network namespaces are Linux-specific.
+func RunInNetns(netns string, fn func() error) error {
+	if netns != "" {
+		return ErrNetnsUnsupported
+	}
+	return fn()
+}
@@ -0,0 +1,134 @@
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+const (
+	// maxPortRangeAttempts is the maximum number of ports tried by ListenUDPInPortRange.
+	maxPortRangeAttempts = 64
+
+	// maxRandomPortAttempts is the maximum number of random ports tried by ListenUDPInPortRange
+	// in the ephemeral port range, before letting the kernel pick a port.
+	maxRandomPortAttempts = 16
+)
+
+// defaultEphemeralPortRange is the IANA dynamic port range.
+var defaultEphemeralPortRange = PortRange{From: 49152, To: 65535}
+
+var (
+	ErrBadPortRange       = errors.New("port range start is greater than end")
+	ErrPortRangeExhausted = errors.New("no available port in port range")
+)
+
+// PortRange is an inclusive range of local ports.
+//
+// The zero value means any port, and lets the kernel pick an ephemeral port.
+type PortRange struct {
+	From uint16 `json:"from"`
+	To   uint16 `json:"to"`
+
+	// Randomize makes each bind attempt pick a random port in the range,
+	// so that the ports of consecutive sockets are not predictable.
+	// If From and To are both zero, ports are picked from the system's ephemeral port range.
+	Randomize bool `json:"randomize"`
+}
+
+// IsZero returns whether the port range is the zero value.
+func (r PortRange) IsZero() bool {
+	return r == PortRange{}
+}
+
+// Validate returns an error if the port range is invalid.
+func (r PortRange) Validate() error {
+	if r.From > r.To {
+		return fmt.Errorf("%w: %s", ErrBadPortRange, r)
+	}
+	return nil
+}
+
+// String returns the string representation of the port range in the form of "from-to",
+// followed by " random" if ports are randomized.
+func (r PortRange) String() string {
+	s := strconv.Itoa(int(r.From)) + "-" + strconv.Itoa(int(r.To))
+	if r.Randomize {
+		s += " random"
+	}
+	return s
+}
+
+// ListenUDPInPortRange is like ListenUDP with an unspecified local address,
+// but binds the socket to a port in portRange.
+//
+// Ports are tried in order from a random offset in the range. If a port is in use, the next one is tried,
+// up to the size of the range or 64 attempts, whichever is smaller.
+// If no port could be bound, the returned error wraps ErrPortRangeExhausted.
+//
+// If portRange.Randomize is true, each attempt picks a random port in the range instead.
+// If the range is also unspecified, ports are picked from [EphemeralPortRange], and after
+// 16 ports in use, the kernel picks the port, as if portRange were the zero value.
+//
+// If portRange is the zero value, any port may be used.
+func ListenUDPInPortRange(network string, portRange PortRange, pktinfo bool, fwmark int) (*net.UDPConn, error) {
+	if portRange.IsZero() {
+		return ListenUDP(network, "", pktinfo, false, fwmark)
+	}
+
+	if err := portRange.Validate(); err != nil {
+		return nil, err
+	}
+
+	if portRange.Randomize {
+		if portRange.From == 0 && portRange.To == 0 {
+			return listenUDPRandomPort(network, EphemeralPortRange(), maxRandomPortAttempts, true, pktinfo, fwmark)
+		}
+		return listenUDPRandomPort(network, portRange, maxPortRangeAttempts, false, pktinfo, fwmark)
+	}
+
+	size := int(portRange.To) - int(portRange.From) + 1
+	attempts := size
+	if attempts > maxPortRangeAttempts {
+		attempts = maxPortRangeAttempts
+	}
+	offset := rand.Intn(size)
+
+	for i := 0; i < attempts; i++ {
+		port := int(portRange.From) + (offset+i)%size
+		c, err := ListenUDP(network, ":"+strconv.Itoa(port), pktinfo, false, fwmark)
+		if err == nil {
+			return c, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s after %d attempts", ErrPortRangeExhausted, portRange, attempts)
+}
+
+// listenUDPRandomPort binds the socket to a random port in portRange, trying up to attempts ports.
+// If all attempted ports are in use, and fallback is true, the kernel picks the port.
+func listenUDPRandomPort(network string, portRange PortRange, attempts int, fallback, pktinfo bool, fwmark int) (*net.UDPConn, error) {
+	size := int(portRange.To) - int(portRange.From) + 1
+
+	for i := 0; i < attempts; i++ {
+		port := int(portRange.From) + rand.Intn(size)
+		c, err := ListenUDP(network, ":"+strconv.Itoa(port), pktinfo, false, fwmark)
+		if err == nil {
+			return c, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+	}
+
+	if fallback {
+		return ListenUDP(network, "", pktinfo, false, fwmark)
+	}
+	return nil, fmt.Errorf("%w: %s after %d attempts", ErrPortRangeExhausted, portRange, attempts)
+}
@@ -0,0 +1,31 @@
+package conn
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+var (
+	ephemeralPortRangeOnce sync.Once
+	ephemeralPortRange     = defaultEphemeralPortRange
+)
+
+// EphemeralPortRange returns the range of local ports the kernel picks ephemeral ports from.
+//
+// On Linux, it is read once from /proc/sys/net/ipv4/ip_local_port_range, which also applies to IPv6.
+// If the file cannot be read, the IANA dynamic port range 49152-65535 is returned.
+func EphemeralPortRange() PortRange {
+	ephemeralPortRangeOnce.Do(func() {
+		b, err := os.ReadFile("/proc/sys/net/ipv4/ip_local_port_range")
+		if err != nil {
+			return
+		}
+		var r PortRange
+		if _, err = fmt.Sscan(string(b), &r.From, &r.To); err != nil || r.From == 0 || r.Validate() != nil {
+			return
+		}
+		ephemeralPortRange = r
+	})
+	return ephemeralPortRange
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package conn
+
+// EphemeralPortRange returns the range of local ports the kernel picks ephemeral ports from.
+//
+// On platforms other than Linux, it returns the IANA dynamic port range 49152-65535.
+func EphemeralPortRange() PortRange {
+	return defaultEphemeralPortRange
+}
@@ -0,0 +1,78 @@
+package conn
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestListenUDPInPortRange(t *testing.T) {
+	c, err := ListenUDP("udp", "", false, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	port := uint16(c.LocalAddr().(*net.UDPAddr).Port)
+	portRange := PortRange{From: port, To: port}
+
+	if _, err = ListenUDPInPortRange("udp", portRange, false, 0); !errors.Is(err, ErrPortRangeExhausted) {
+		t.Errorf("Expected ErrPortRangeExhausted, got %v", err)
+	}
+
+	c.Close()
+
+	c, err = ListenUDPInPortRange("udp", portRange, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if p := uint16(c.LocalAddr().(*net.UDPAddr).Port); p != port {
+		t.Errorf("Expected port %d, got %d", port, p)
+	}
+}
+
+func TestListenUDPInPortRangeRandomize(t *testing.T) {
+	ephemeral := EphemeralPortRange()
+	if err := ephemeral.Validate(); err != nil || ephemeral.From == 0 {
+		t.Fatalf("EphemeralPortRange() returned invalid range %s", ephemeral)
+	}
+
+	c, err := ListenUDPInPortRange("udp", PortRange{Randomize: true}, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	port := uint16(c.LocalAddr().(*net.UDPAddr).Port)
+	if port < ephemeral.From || port > ephemeral.To {
+		t.Errorf("Port %d is outside the ephemeral port range %s", port, ephemeral)
+	}
+
+	// The only port in the range is in use.
+	portRange := PortRange{From: port, To: port, Randomize: true}
+	if _, err = ListenUDPInPortRange("udp", portRange, false, 0); !errors.Is(err, ErrPortRangeExhausted) {
+		t.Errorf("Expected ErrPortRangeExhausted, got %v", err)
+	}
+
+	// With fallback, the kernel picks another port.
+	fc, err := listenUDPRandomPort("udp", portRange, 4, true, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fc.Close()
+
+	if p := uint16(fc.LocalAddr().(*net.UDPAddr).Port); p == port {
+		t.Errorf("Fallback bound port %d, which is in use", p)
+	}
+}
+
+func TestPortRangeValidate(t *testing.T) {
+	if err := (PortRange{From: 20000, To: 20999}).Validate(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := (PortRange{From: 20999, To: 20000}).Validate(); !errors.Is(err, ErrBadPortRange) {
+		t.Errorf("Expected ErrBadPortRange, got %v", err)
+	}
+}
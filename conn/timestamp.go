@@ -0,0 +1,5 @@
+package conn
+
+import "errors"
+
+var ErrRecvTimestampUnsupported = errors.New("receive timestamps are not supported on this platform")
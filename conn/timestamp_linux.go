@@ -0,0 +1,32 @@
+package conn
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// RecvTimestampSupported is true if [SetRecvTimestamp] is supported on this platform.
+const RecvTimestampSupported = true
+
+// SetRecvTimestamp enables SO_TIMESTAMPNS on c, so each received packet carries
+// the kernel receive timestamp in an SCM_TIMESTAMPNS control message.
+// The timestamp is parsed by [ParseSocketControlMessage].
+//
+// The timestamp is taken from the realtime clock, so it may jump along with the system clock.
+func SetRecvTimestamp(c *net.UDPConn) error {
+	rawConn, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	if err = rawConn.Control(func(fd uintptr) {
+		if serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_TIMESTAMPNS, 1); serr != nil {
+			serr = &net.OpError{Op: "setsockopt", Net: "udp", Source: c.LocalAddr(), Err: serr}
+		}
+	}); err != nil {
+		return err
+	}
+	return serr
+}
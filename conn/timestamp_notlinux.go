@@ -0,0 +1,13 @@
+//go:build !linux
+
+package conn
+
+import "net"
+
+// RecvTimestampSupported is true if [SetRecvTimestamp] is supported on this platform.
+const RecvTimestampSupported = false
+
+// SetRecvTimestamp returns ErrRecvTimestampUnsupported.
+func SetRecvTimestamp(c *net.UDPConn) error {
+	return ErrRecvTimestampUnsupported
+}
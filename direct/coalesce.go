@@ -0,0 +1,153 @@
+package direct
+
+import (
+	"sync"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+// tlsMaxRecordPayloadSize is the maximum plaintext size of a TLS record.
+const tlsMaxRecordPayloadSize = 16384
+
+// coalescingConn buffers small writes to the underlying connection and writes them out together,
+// so that a TLS connection sends fewer, larger records for chatty protocols.
+//
+// Buffered data is written out when the buffer is full, when delay has passed since the first
+// buffered write, and before each read, so request/response protocols never wait on buffered data.
+//
+// Reads never wait for writes to the underlying connection. A write may block until the peer reads,
+// and the peer may be waiting for us to read first. If a write is in progress when a read starts,
+// the read does not flush, since the buffered data is either being written out, or will be written
+// out by the timer.
+type coalescingConn struct {
+	zerocopy.DirectReadWriteCloser
+	delay time.Duration
+
+	// mu protects the fields below, and serializes writes to the underlying connection.
+	mu    sync.Mutex
+	buf   []byte
+	timer *time.Timer
+	armed bool
+
+	// err is the error of a flush triggered by the timer.
+	// It is returned by the next write.
+	err error
+}
+
+// newCoalescingConn returns a coalescingConn that buffers up to size bytes for up to delay.
+func newCoalescingConn(rwc zerocopy.DirectReadWriteCloser, size int, delay time.Duration) *coalescingConn {
+	c := &coalescingConn{
+		DirectReadWriteCloser: rwc,
+		delay:                 delay,
+		buf:                   make([]byte, 0, size),
+	}
+	c.timer = time.AfterFunc(time.Hour, c.timerFlush)
+	c.timer.Stop()
+	return c
+}
+
+// Write implements the io.Writer Write method.
+func (c *coalescingConn) Write(b []byte) (n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	if len(c.buf)+len(b) > cap(c.buf) {
+		if err = c.flushLocked(); err != nil {
+			return 0, err
+		}
+		if len(b) >= cap(c.buf) {
+			return c.DirectReadWriteCloser.Write(b)
+		}
+	}
+
+	c.buf = append(c.buf, b...)
+
+	if len(c.buf) == cap(c.buf) {
+		if err = c.flushLocked(); err != nil {
+			return 0, err
+		}
+	} else if !c.armed {
+		c.armed = true
+		c.timer.Reset(c.delay)
+	}
+
+	return len(b), nil
+}
+
+// Read implements the io.Reader Read method.
+// Buffered data is written out before reading, unless a write is in progress.
+func (c *coalescingConn) Read(b []byte) (n int, err error) {
+	if err = c.tryFlush(); err != nil {
+		return 0, err
+	}
+	return c.DirectReadWriteCloser.Read(b)
+}
+
+// CloseWrite implements the zerocopy.CloseWrite CloseWrite method.
+// Buffered data is written out before closing the write side.
+func (c *coalescingConn) CloseWrite() error {
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	return c.DirectReadWriteCloser.CloseWrite()
+}
+
+// Close implements the io.Closer Close method.
+// Buffered data is written out on a best-effort basis before closing.
+func (c *coalescingConn) Close() error {
+	c.Flush()
+	c.timer.Stop()
+	return c.DirectReadWriteCloser.Close()
+}
+
+// Flush writes out buffered data.
+func (c *coalescingConn) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return c.flushLocked()
+}
+
+// tryFlush writes out buffered data, unless c.mu is held by a write in progress.
+func (c *coalescingConn) tryFlush() error {
+	if !c.mu.TryLock() {
+		return nil
+	}
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return c.flushLocked()
+}
+
+// timerFlush is called by the timer to write out buffered data.
+func (c *coalescingConn) timerFlush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = c.flushLocked()
+	}
+}
+
+// flushLocked writes out buffered data and disarms the timer.
+//
+// c.mu must be held.
+func (c *coalescingConn) flushLocked() error {
+	if c.armed {
+		c.armed = false
+		c.timer.Stop()
+	}
+	if len(c.buf) == 0 {
+		return nil
+	}
+	_, err := c.DirectReadWriteCloser.Write(c.buf)
+	c.buf = c.buf[:0]
+	return err
+}
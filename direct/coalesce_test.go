@@ -0,0 +1,165 @@
+package direct
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingConn records the writes made to it. Reads return io.EOF.
+type recordingConn struct {
+	mu     sync.Mutex
+	writes [][]byte
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.writes = append(c.writes, append([]byte(nil), b...))
+	c.mu.Unlock()
+	return len(b), nil
+}
+
+func (c *recordingConn) Writes() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([][]byte(nil), c.writes...)
+}
+
+func (c *recordingConn) CloseRead() error  { return nil }
+func (c *recordingConn) CloseWrite() error { return nil }
+func (c *recordingConn) Close() error      { return nil }
+
+func TestCoalescingConnFlushOnRead(t *testing.T) {
+	rc := &recordingConn{}
+	c := newCoalescingConn(rc, 16, time.Hour)
+	defer c.Close()
+
+	for _, s := range []string{"a", "bc", "def"} {
+		if _, err := c.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if writes := rc.Writes(); len(writes) != 0 {
+		t.Fatalf("Expected no writes before flush, got %q", writes)
+	}
+
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected io.EOF, got %v", err)
+	}
+	writes := rc.Writes()
+	if len(writes) != 1 || string(writes[0]) != "abcdef" {
+		t.Errorf("Expected one write of %q, got %q", "abcdef", writes)
+	}
+}
+
+func TestCoalescingConnFlushOnFull(t *testing.T) {
+	rc := &recordingConn{}
+	c := newCoalescingConn(rc, 4, time.Hour)
+	defer c.Close()
+
+	large := bytes.Repeat([]byte{'x'}, 8)
+
+	for _, b := range [][]byte{[]byte("ab"), []byte("cd"), []byte("e"), large, []byte("fghi")} {
+		if _, err := c.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writes := rc.Writes()
+	expected := [][]byte{[]byte("abcd"), []byte("e"), large, []byte("fghi")}
+	if len(writes) != len(expected) {
+		t.Fatalf("Expected writes %q, got %q", expected, writes)
+	}
+	for i := range expected {
+		if !bytes.Equal(writes[i], expected[i]) {
+			t.Errorf("Write %d: expected %q, got %q", i, expected[i], writes[i])
+		}
+	}
+}
+
+func TestCoalescingConnFlushOnTimer(t *testing.T) {
+	rc := &recordingConn{}
+	c := newCoalescingConn(rc, 16, time.Millisecond)
+	defer c.Close()
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(rc.Writes()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for timer flush")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	writes := rc.Writes()
+	if len(writes) != 1 || string(writes[0]) != "hello" {
+		t.Errorf("Expected one write of %q, got %q", "hello", writes)
+	}
+}
+
+// pipeConn adds no-op half-close methods to a net.Pipe end.
+type pipeConn struct {
+	net.Conn
+}
+
+func (pipeConn) CloseRead() error  { return nil }
+func (pipeConn) CloseWrite() error { return nil }
+
+func TestCoalescingConnReadDuringBlockedWrite(t *testing.T) {
+	local, peer := net.Pipe()
+	c := newCoalescingConn(pipeConn{local}, 4, time.Hour)
+	defer c.Close()
+	defer peer.Close() // unblocks the write on failure
+
+	// The write blocks on the pipe until the peer reads.
+	large := bytes.Repeat([]byte{'x'}, 8)
+	writeErrCh := make(chan error, 1)
+	go func() {
+		_, err := c.Write(large)
+		writeErrCh <- err
+	}()
+
+	// The peer only reads after we have read its request.
+	peerErrCh := make(chan error, 1)
+	go func() {
+		if _, err := peer.Write([]byte("ping")); err != nil {
+			peerErrCh <- err
+			return
+		}
+		_, err := io.ReadFull(peer, make([]byte, len(large)))
+		peerErrCh <- err
+	}()
+
+	// Wait for the write to take the lock and block.
+	for c.mu.TryLock() {
+		c.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	readErrCh := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(c, make([]byte, 4))
+		readErrCh <- err
+	}()
+
+	for _, ch := range []chan error{readErrCh, writeErrCh, peerErrCh} {
+		select {
+		case err := <-ch:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Read deadlocked on a blocked write")
+		}
+	}
+}
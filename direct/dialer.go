@@ -0,0 +1,229 @@
+package direct
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"github.com/database64128/tfo-go/v2"
+)
+
+// StreamConn is a stream connection established by a [StreamDialer].
+type StreamConn interface {
+	net.Conn
+	zerocopy.CloseRead
+	zerocopy.CloseWrite
+}
+
+// StreamDialer establishes egress stream connections for a direct TCP client.
+//
+// Implementations allow direct clients to relay over transports other than TCP,
+// such as SCTP, DCCP, or a tunnel.
+type StreamDialer interface {
+	zerocopy.InitialPayloader
+
+	// DialStream connects to address and sends payload.
+	DialStream(address string, payload []byte) (StreamConn, error)
+}
+
+// StreamDialerFactory creates a StreamDialer from a client's dialer options.
+type StreamDialerFactory func(dialerTFO bool, dialerFwmark int, dialerTimeout time.Duration) (StreamDialer, error)
+
+// streamDialerFactories maps transport names to stream dialer factories.
+var streamDialerFactories = map[string]StreamDialerFactory{
+	"tcp": NewTCPStreamDialer,
+}
+
+// RegisterStreamDialer registers factory for transport, replacing any existing factory.
+//
+// RegisterStreamDialer is not safe for concurrent use. It is intended to be called from init functions.
+func RegisterStreamDialer(transport string, factory StreamDialerFactory) {
+	streamDialerFactories[transport] = factory
+}
+
+// NewStreamDialer creates a StreamDialer for transport.
+// An empty transport selects TCP.
+func NewStreamDialer(transport string, dialerTFO bool, dialerFwmark int, dialerTimeout time.Duration) (StreamDialer, error) {
+	if transport == "" {
+		transport = "tcp"
+	}
+	factory, ok := streamDialerFactories[transport]
+	if !ok {
+		return nil, fmt.Errorf("unknown transport: %s", transport)
+	}
+	return factory(dialerTFO, dialerFwmark, dialerTimeout)
+}
+
+// TCPStreamDialer dials TCP connections, optionally with TCP Fast Open.
+//
+// TCPStreamDialer implements the StreamDialer interface.
+type TCPStreamDialer struct {
+	dialer tfo.Dialer
+}
+
+// NewTCPStreamDialer returns a new TCP stream dialer.
+func NewTCPStreamDialer(dialerTFO bool, dialerFwmark int, dialerTimeout time.Duration) (StreamDialer, error) {
+	return &TCPStreamDialer{
+		dialer: conn.NewDialer(dialerTFO, dialerFwmark, dialerTimeout),
+	}, nil
+}
+
+// NewTCPStreamDialerOnInterface returns a new TCP stream dialer that binds its connections to the named network interface.
+func NewTCPStreamDialerOnInterface(dialerTFO bool, dialerFwmark int, dialerTimeout time.Duration, ifname string) StreamDialer {
+	return &TCPStreamDialer{
+		dialer: conn.NewDialerOnInterface(dialerTFO, dialerFwmark, dialerTimeout, ifname),
+	}
+}
+
+// NativeInitialPayload implements the StreamDialer NativeInitialPayload method.
+func (d *TCPStreamDialer) NativeInitialPayload() bool {
+	return !d.dialer.DisableTFO
+}
+
+// DialStream implements the StreamDialer DialStream method.
+func (d *TCPStreamDialer) DialStream(address string, payload []byte) (StreamConn, error) {
+	nc, err := d.dialer.Dial("tcp", address, payload)
+	if err != nil {
+		return nil, err
+	}
+	return nc.(*net.TCPConn), nil
+}
+
+// netnsStreamDialer creates connections of a StreamDialer inside a network namespace.
+type netnsStreamDialer struct {
+	StreamDialer
+	netns string
+}
+
+// NewNetnsStreamDialer wraps d so that its connections are created inside the named network namespace.
+// Domain names are resolved in the current network namespace before dialing.
+//
+// If netns is empty, d is returned as is.
+func NewNetnsStreamDialer(d StreamDialer, netns string) StreamDialer {
+	if netns == "" {
+		return d
+	}
+	return &netnsStreamDialer{
+		StreamDialer: d,
+		netns:        netns,
+	}
+}
+
+// DialStream implements the StreamDialer DialStream method.
+func (d *netnsStreamDialer) DialStream(address string, payload []byte) (sc StreamConn, err error) {
+	addr, err := conn.ParseAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	addrPort, err := addr.ResolveIPPort()
+	if err != nil {
+		return nil, err
+	}
+	address = addrPort.String()
+
+	err = conn.RunInNetns(d.netns, func() error {
+		sc, err = d.StreamDialer.DialStream(address, payload)
+		return err
+	})
+	if err != nil && sc != nil {
+		sc.Close()
+		sc = nil
+	}
+	return
+}
+
+// SequentialDialError is returned by a sequential stream dialer when dialing every resolved address failed.
+type SequentialDialError struct {
+	// Host is the domain name that was resolved.
+	Host string
+
+	// Errs are the errors of dial attempts, in the order of attempts.
+	Errs []error
+}
+
+// Error implements the error Error method.
+func (e *SequentialDialError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "failed to dial any of %d addresses of %s", len(e.Errs), e.Host)
+	for _, err := range e.Errs {
+		b.WriteString("; ")
+		b.WriteString(err.Error())
+	}
+	return b.String()
+}
+
+// Is reports whether any error of the dial attempts matches target.
+// It allows [errors.Is] to look into every attempt, which it does not do
+// on its own for multiple wrapped errors before Go 1.20.
+func (e *SequentialDialError) Is(target error) bool {
+	for _, err := range e.Errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first error of the dial attempts that matches target, and if so,
+// sets target to that error value and returns true. See [SequentialDialError.Is].
+func (e *SequentialDialError) As(target any) bool {
+	for _, err := range e.Errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// sequentialStreamDialer tries every resolved address of a domain target in turn.
+type sequentialStreamDialer struct {
+	StreamDialer
+	family conn.AddrFamily
+}
+
+// NewSequentialStreamDialer wraps d so that domain targets are resolved to all of their addresses,
+// which are dialed one after another until one succeeds. Addresses of family are tried first.
+// Unlike happy eyeballs, attempts are never raced.
+//
+// If all attempts fail, a [*SequentialDialError] is returned.
+func NewSequentialStreamDialer(d StreamDialer, family conn.AddrFamily) StreamDialer {
+	return &sequentialStreamDialer{
+		StreamDialer: d,
+		family:       family,
+	}
+}
+
+// DialStream implements the StreamDialer DialStream method.
+func (d *sequentialStreamDialer) DialStream(address string, payload []byte) (StreamConn, error) {
+	addr, err := conn.ParseAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	if addr.IsIP() {
+		return d.StreamDialer.DialStream(address, payload)
+	}
+
+	ips, err := conn.ResolveAddrsFamilyContext(context.Background(), addr.Domain(), d.family)
+	if err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, 0, len(ips))
+	for _, ip := range ips {
+		sc, err := d.StreamDialer.DialStream(netip.AddrPortFrom(ip, addr.Port()).String(), payload)
+		if err == nil {
+			return sc, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, &SequentialDialError{
+		Host: addr.Domain(),
+		Errs: errs,
+	}
+}
@@ -0,0 +1,211 @@
+package direct
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+)
+
+// recordingStreamDialer dials TCP and records the dialed addresses.
+type recordingStreamDialer struct {
+	TCPStreamDialer
+	addresses []string
+}
+
+func (d *recordingStreamDialer) DialStream(address string, payload []byte) (StreamConn, error) {
+	d.addresses = append(d.addresses, address)
+	return d.TCPStreamDialer.DialStream(address, payload)
+}
+
+func TestNewStreamDialer(t *testing.T) {
+	for _, transport := range []string{"", "tcp"} {
+		d, err := NewStreamDialer(transport, false, 0, 0)
+		if err != nil {
+			t.Fatalf("NewStreamDialer(%q) failed: %v", transport, err)
+		}
+		if _, ok := d.(*TCPStreamDialer); !ok {
+			t.Errorf("NewStreamDialer(%q) returned %T, expected *TCPStreamDialer", transport, d)
+		}
+	}
+
+	if _, err := NewStreamDialer("sctp", false, 0, 0); err == nil {
+		t.Error("NewStreamDialer() with unregistered transport succeeded")
+	}
+
+	rd := &recordingStreamDialer{}
+	RegisterStreamDialer("recording", func(dialerTFO bool, dialerFwmark int, dialerTimeout time.Duration) (StreamDialer, error) {
+		return rd, nil
+	})
+	t.Cleanup(func() { delete(streamDialerFactories, "recording") })
+
+	d, err := NewStreamDialer("recording", false, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	payload := []byte("hello")
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, io.LimitReader(c, int64(len(payload))))
+	}()
+
+	targetAddr := conn.AddrFromIPPort(ln.Addr().(*net.TCPAddr).AddrPort())
+	rawConn, _, err := NewTCPClientWithDialer("recording", d).Dial(targetAddr, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rawConn.Close()
+
+	echo := make([]byte, len(payload))
+	if _, err = io.ReadFull(rawConn, echo); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echo, payload) {
+		t.Errorf("Got echo %q, expected %q", echo, payload)
+	}
+
+	if len(rd.addresses) != 1 || rd.addresses[0] != targetAddr.String() {
+		t.Errorf("Dialer dialed %v, expected [%s]", rd.addresses, targetAddr)
+	}
+}
+
+// staticResolver answers lookups from a fixed map.
+type staticResolver map[string][]netip.Addr
+
+func (r staticResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	ips, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+// refusingStreamDialer records the dialed addresses and refuses to dial those in refused.
+type refusingStreamDialer struct {
+	recordingStreamDialer
+	refused map[string]bool
+}
+
+var errRefused = errors.New("refused")
+
+func (d *refusingStreamDialer) DialStream(address string, payload []byte) (StreamConn, error) {
+	if d.refused[address] {
+		d.addresses = append(d.addresses, address)
+		return nil, errRefused
+	}
+	return d.recordingStreamDialer.DialStream(address, payload)
+}
+
+func TestSequentialStreamDialer(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+	ip4 := netip.MustParseAddr("127.0.0.1")
+	ip6a := netip.MustParseAddr("2001:db8::1")
+	ip6b := netip.MustParseAddr("2001:db8::2")
+	addrPort4 := netip.AddrPortFrom(ip4, port).String()
+	addrPort6a := netip.AddrPortFrom(ip6a, port).String()
+	addrPort6b := netip.AddrPortFrom(ip6b, port).String()
+
+	saved := conn.DefaultResolver
+	conn.DefaultResolver = staticResolver{
+		"multi.test": {ip6a, ip4, ip6b},
+		"dead.test":  {ip6a, ip6b},
+	}
+	t.Cleanup(func() { conn.DefaultResolver = saved })
+
+	refused := map[string]bool{
+		addrPort6a: true,
+		addrPort6b: true,
+	}
+
+	for _, c := range []struct {
+		family   conn.AddrFamily
+		expected []string
+	}{
+		{conn.AddrFamilyAny, []string{addrPort6a, addrPort4}},
+		{conn.AddrFamilyIPv4, []string{addrPort4}},
+		{conn.AddrFamilyIPv6, []string{addrPort6a, addrPort6b, addrPort4}},
+	} {
+		rd := &refusingStreamDialer{refused: refused}
+		d := NewSequentialStreamDialer(rd, c.family)
+
+		sc, err := d.DialStream(net.JoinHostPort("multi.test", strconv.Itoa(int(port))), nil)
+		if err != nil {
+			t.Fatalf("DialStream with family %s failed: %v", c.family, err)
+		}
+		sc.Close()
+
+		if !reflect.DeepEqual(rd.addresses, c.expected) {
+			t.Errorf("Dialer with family %s dialed %v, expected %v", c.family, rd.addresses, c.expected)
+		}
+	}
+
+	rd := &refusingStreamDialer{refused: refused}
+	d := NewSequentialStreamDialer(rd, conn.AddrFamilyAny)
+	_, err = d.DialStream(net.JoinHostPort("dead.test", strconv.Itoa(int(port))), nil)
+	var sde *SequentialDialError
+	if !errors.As(err, &sde) {
+		t.Fatalf("DialStream returned %v, expected *SequentialDialError", err)
+	}
+	if sde.Host != "dead.test" || len(sde.Errs) != 2 {
+		t.Errorf("SequentialDialError = %+v, expected 2 errors for dead.test", sde)
+	}
+	if !errors.Is(err, errRefused) {
+		t.Errorf("errors.Is(%v, errRefused) = false, expected true", err)
+	}
+}
+
+func TestSequentialDialErrorIsAs(t *testing.T) {
+	opErr := &net.OpError{Op: "dial", Net: "tcp", Err: errRefused}
+	err := fmt.Errorf("wrapped: %w", &SequentialDialError{
+		Host: "dead.test",
+		Errs: []error{errors.New("first"), opErr},
+	})
+
+	if !errors.Is(err, errRefused) {
+		t.Errorf("errors.Is(%v, errRefused) = false, expected true", err)
+	}
+	if errors.Is(err, net.ErrClosed) {
+		t.Errorf("errors.Is(%v, net.ErrClosed) = true, expected false", err)
+	}
+
+	var target *net.OpError
+	if !errors.As(err, &target) || target != opErr {
+		t.Errorf("errors.As(%v) = %v, expected %v", err, target, opErr)
+	}
+}
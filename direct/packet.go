@@ -1,8 +1,10 @@
 package direct
 
 import (
+	"context"
 	"fmt"
 	"net/netip"
+	"time"
 
 	"github.com/database64128/shadowsocks-go/conn"
 	"github.com/database64128/shadowsocks-go/socks5"
@@ -23,18 +25,31 @@ type DirectPacketClientPackUnpacker struct {
 
 	// mtu is used in the PackInPlace method to determine whether the payload is too big.
 	mtu int
+
+	// resolveTimeout bounds the time spent resolving a domain target. Zero means no timeout.
+	resolveTimeout time.Duration
 }
 
 // NewDirectPacketClientPackUnpacker creates a zerocopy.ClientPackUnpacker for direct connection.
-func NewDirectPacketClientPackUnpacker(mtu int) *DirectPacketClientPackUnpacker {
+//
+// If resolveTimeout is positive, resolving a domain target fails after resolveTimeout.
+func NewDirectPacketClientPackUnpacker(mtu int, resolveTimeout time.Duration) *DirectPacketClientPackUnpacker {
 	return &DirectPacketClientPackUnpacker{
-		mtu: mtu,
+		mtu:            mtu,
+		resolveTimeout: resolveTimeout,
 	}
 }
 
 func (p *DirectPacketClientPackUnpacker) updateDomainIPCache(targetAddr conn.Addr) error {
 	if p.cachedDomain != targetAddr.Domain() {
-		ip, err := targetAddr.ResolveIP()
+		ctx := context.Background()
+		if p.resolveTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, p.resolveTimeout)
+			defer cancel()
+		}
+
+		ip, err := targetAddr.ResolveIPContext(ctx)
 		if err != nil {
 			return err
 		}
@@ -169,8 +184,9 @@ func (p *ShadowsocksNonePacketClientPacker) PackInPlace(b []byte, targetAddr con
 	packetLen = payloadLen + targetAddrLen
 	if packetLen > p.maxPacketSize {
 		err = zerocopy.ErrPayloadTooBig
+		return
 	}
-	socks5.WriteAddrFromConnAddr(b[packetStart:], targetAddr)
+	_, err = socks5.WriteAddrFromConnAddr(b[packetStart:], targetAddr)
 	return
 }
 
@@ -214,8 +230,9 @@ func (ShadowsocksNonePacketServerPacker) PackInPlace(b []byte, sourceAddrPort ne
 	packetLen = payloadLen + targetAddrLen
 	if packetLen > maxPacketLen {
 		err = zerocopy.ErrPayloadTooBig
+		return
 	}
-	socks5.WriteAddrFromAddrPort(b[packetStart:], sourceAddrPort)
+	_, err = socks5.WriteAddrFromAddrPort(b[packetStart:], sourceAddrPort)
 	return
 }
 
@@ -294,9 +311,12 @@ func (p *Socks5PacketClientPacker) PackInPlace(b []byte, targetAddr conn.Addr, p
 	packetLen = payloadLen + targetAddrLen + 3
 	if packetLen > p.maxPacketSize {
 		err = zerocopy.ErrPayloadTooBig
+		return
+	}
+	if err = socks5.WritePacketHeader(b[packetStart:]); err != nil {
+		return
 	}
-	socks5.WritePacketHeader(b[packetStart:])
-	socks5.WriteAddrFromConnAddr(b[packetStart+3:], targetAddr)
+	_, err = socks5.WriteAddrFromConnAddr(b[packetStart+3:], targetAddr)
 	return
 }
 
@@ -352,9 +372,12 @@ func (Socks5PacketServerPacker) PackInPlace(b []byte, sourceAddrPort netip.AddrP
 	packetLen = payloadLen + targetAddrLen + 3
 	if packetLen > maxPacketLen {
 		err = zerocopy.ErrPayloadTooBig
+		return
+	}
+	if err = socks5.WritePacketHeader(b[packetStart:]); err != nil {
+		return
 	}
-	socks5.WritePacketHeader(b[packetStart:])
-	socks5.WriteAddrFromAddrPort(b[packetStart+3:], sourceAddrPort)
+	_, err = socks5.WriteAddrFromAddrPort(b[packetStart+3:], sourceAddrPort)
 	return
 }
 
@@ -3,6 +3,7 @@ package direct
 import (
 	"io"
 	"net"
+	"time"
 
 	"github.com/database64128/shadowsocks-go/conn"
 	"github.com/database64128/shadowsocks-go/socks5"
@@ -18,7 +19,13 @@ var (
 // directly from/to the wrapped io.ReadWriter.
 type DirectStreamReadWriter struct {
 	zerocopy.ZeroHeadroom
-	rw zerocopy.DirectReadWriteCloser
+	rw       zerocopy.DirectReadWriteCloser
+	username string
+}
+
+// Username implements the zerocopy.UserIdentifier Username method.
+func (rw *DirectStreamReadWriter) Username() string {
+	return rw.username
 }
 
 // MaxPayloadSizePerWrite implements the Writer MaxPayloadSizePerWrite method.
@@ -79,7 +86,9 @@ func NewDirectStreamReadWriter(rw zerocopy.DirectReadWriteCloser) *DirectStreamR
 func NewShadowsocksNoneStreamClientReadWriter(rwo zerocopy.DirectReadWriteCloserOpener, targetAddr conn.Addr, payload []byte) (*DirectStreamReadWriter, zerocopy.DirectReadWriteCloser, error) {
 	targetAddrLen := socks5.LengthOfAddrFromConnAddr(targetAddr)
 	writeBuf := make([]byte, targetAddrLen+len(payload))
-	socks5.WriteAddrFromConnAddr(writeBuf, targetAddr)
+	if _, err := socks5.WriteAddrFromConnAddr(writeBuf, targetAddr); err != nil {
+		return nil, nil, err
+	}
 	copy(writeBuf[targetAddrLen:], payload)
 	rawRW, err := rwo.Open(writeBuf)
 	if err != nil {
@@ -105,13 +114,48 @@ func NewSocks5StreamClientReadWriter(rw zerocopy.DirectReadWriteCloser, targetAd
 	return &DirectStreamReadWriter{rw: rw}, nil
 }
 
-// NewSocks5StreamServerReadWriter handles a SOCKS5 request from rw and wraps rw into a ReadWriter ready for use.
-// conn must be provided when UDP is enabled.
-func NewSocks5StreamServerReadWriter(rw zerocopy.DirectReadWriteCloser, enableTCP, enableUDP bool, tc *net.TCPConn) (dsrw *DirectStreamReadWriter, addr conn.Addr, err error) {
-	addr, err = socks5.ServerAccept(rw, enableTCP, enableUDP, tc)
+// Socks5ServerConfig is the configuration of a SOCKS5 server handshake.
+type Socks5ServerConfig struct {
+	// EnableTCP and EnableUDP allow CONNECT and UDP ASSOCIATE requests respectively.
+	EnableTCP bool
+	EnableUDP bool
+
+	// If IPv6Reply is not socks5.Succeeded, CONNECT requests to IPv6 addresses are rejected with IPv6Reply.
+	IPv6Reply byte
+
+	// If UDPAssociateMaxHold is positive, UDP ASSOCIATE control connections are closed after UDPAssociateMaxHold,
+	// even if the client keeps them open.
+	UDPAssociateMaxHold time.Duration
+
+	// If Authenticator is not nil, clients must authenticate with username and password.
+	Authenticator socks5.Authenticator
+
+	// If PrivateMethod is not nil, clients must authenticate with the private method,
+	// or with username and password if Authenticator is also not nil.
+	PrivateMethod *socks5.PrivateMethod
+
+	// If AuthorizeTarget is not nil, authenticated users' CONNECT requests to targets it does not authorize
+	// are rejected with socks5.ErrConnectionNotAllowed before any connection is made.
+	AuthorizeTarget socks5.TargetAuthorizer
+}
+
+// NewSocks5StreamServerReadWriter handles a SOCKS5 request from rw as configured by config,
+// and wraps rw into a ReadWriter ready for use.
+// If tc is nil, UDP ASSOCIATE requests are rejected.
+func NewSocks5StreamServerReadWriter(rw zerocopy.DirectReadWriteCloser, config Socks5ServerConfig, tc *net.TCPConn) (dsrw *DirectStreamReadWriter, addr conn.Addr, err error) {
+	var username string
+	switch {
+	case config.PrivateMethod != nil:
+		addr, username, err = socks5.ServerAcceptPrivateMethod(rw, *config.PrivateMethod, config.Authenticator, config.AuthorizeTarget, config.EnableTCP, config.EnableUDP, config.IPv6Reply, config.UDPAssociateMaxHold, tc)
+	case config.Authenticator != nil:
+		addr, username, err = socks5.ServerAcceptUsernamePassword(rw, config.Authenticator, config.AuthorizeTarget, config.EnableTCP, config.EnableUDP, config.IPv6Reply, config.UDPAssociateMaxHold, tc)
+	default:
+		addr, err = socks5.ServerAccept(rw, config.EnableTCP, config.EnableUDP, config.IPv6Reply, config.UDPAssociateMaxHold, tc)
+	}
 	if err == nil {
 		dsrw = &DirectStreamReadWriter{
-			rw: rw,
+			rw:       rw,
+			username: username,
 		}
 	}
 	return
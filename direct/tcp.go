@@ -1,7 +1,10 @@
 package direct
 
 import (
+	"context"
+	"crypto/tls"
 	"net"
+	"time"
 
 	"github.com/database64128/shadowsocks-go/conn"
 	"github.com/database64128/shadowsocks-go/socks5"
@@ -9,16 +12,30 @@ import (
 	"github.com/database64128/tfo-go/v2"
 )
 
+// preferredFamilyResolveTimeout is the timeout of resolving a domain target with a preferred address family.
+const preferredFamilyResolveTimeout = 5 * time.Second
+
 // TCPClient implements the zerocopy TCPClient interface.
 type TCPClient struct {
 	name   string
-	dialer tfo.Dialer
+	dialer StreamDialer
+}
+
+// NewTCPClient returns a new direct TCP client that dials TCP connections.
+func NewTCPClient(name string, dialerTFO bool, dialerFwmark int, dialerTimeout time.Duration) *TCPClient {
+	return &TCPClient{
+		name: name,
+		dialer: &TCPStreamDialer{
+			dialer: conn.NewDialer(dialerTFO, dialerFwmark, dialerTimeout),
+		},
+	}
 }
 
-func NewTCPClient(name string, dialerTFO bool, dialerFwmark int) *TCPClient {
+// NewTCPClientWithDialer returns a new direct TCP client that dials connections with dialer.
+func NewTCPClientWithDialer(name string, dialer StreamDialer) *TCPClient {
 	return &TCPClient{
 		name:   name,
-		dialer: conn.NewDialer(dialerTFO, dialerFwmark),
+		dialer: dialer,
 	}
 }
 
@@ -28,19 +45,33 @@ func (c *TCPClient) String() string {
 }
 
 // Dial implements the zerocopy.TCPClient Dial method.
-func (c *TCPClient) Dial(targetAddr conn.Addr, payload []byte) (tc *net.TCPConn, rw zerocopy.ReadWriter, err error) {
-	nc, err := c.dialer.Dial("tcp", targetAddr.String(), payload)
+func (c *TCPClient) Dial(targetAddr conn.Addr, payload []byte) (rawConn net.Conn, rw zerocopy.ReadWriter, err error) {
+	sc, err := c.dialer.DialStream(targetAddr.String(), payload)
 	if err != nil {
 		return
 	}
-	tc = nc.(*net.TCPConn)
-	rw = &DirectStreamReadWriter{rw: tc}
+	rawConn = sc
+	rw = &DirectStreamReadWriter{rw: sc}
 	return
 }
 
+// DialFamily implements the zerocopy.FamilyDialer DialFamily method.
+// If the domain target cannot be resolved with the preferred family, it is dialed as usual.
+func (c *TCPClient) DialFamily(targetAddr conn.Addr, family conn.AddrFamily, payload []byte) (rawConn net.Conn, rw zerocopy.ReadWriter, err error) {
+	if family != conn.AddrFamilyAny && !targetAddr.IsIP() {
+		ctx, cancel := context.WithTimeout(context.Background(), preferredFamilyResolveTimeout)
+		addrPort, err := targetAddr.ResolveIPPortFamilyContext(ctx, family)
+		cancel()
+		if err == nil {
+			targetAddr = conn.AddrFromIPPort(addrPort)
+		}
+	}
+	return c.Dial(targetAddr, payload)
+}
+
 // NativeInitialPayload implements the zerocopy.TCPClient NativeInitialPayload method.
 func (c *TCPClient) NativeInitialPayload() bool {
-	return !c.dialer.DisableTFO
+	return c.dialer.NativeInitialPayload()
 }
 
 // TCPServer is the client-side tunnel server.
@@ -79,10 +110,10 @@ type ShadowsocksNoneTCPClient struct {
 	tco  *zerocopy.TCPConnOpener
 }
 
-func NewShadowsocksNoneTCPClient(name, address string, dialerTFO bool, dialerFwmark int) *ShadowsocksNoneTCPClient {
+func NewShadowsocksNoneTCPClient(name, address string, dialerTFO bool, dialerFwmark int, dialerTimeout time.Duration) *ShadowsocksNoneTCPClient {
 	return &ShadowsocksNoneTCPClient{
 		name: name,
-		tco:  zerocopy.NewTCPConnOpener(conn.NewDialer(dialerTFO, dialerFwmark), "tcp", address),
+		tco:  zerocopy.NewTCPConnOpener(conn.NewDialer(dialerTFO, dialerFwmark, dialerTimeout), "tcp", address),
 	}
 }
 
@@ -92,10 +123,10 @@ func (c *ShadowsocksNoneTCPClient) String() string {
 }
 
 // Dial implements the zerocopy.TCPClient Dial method.
-func (c *ShadowsocksNoneTCPClient) Dial(targetAddr conn.Addr, payload []byte) (tc *net.TCPConn, rw zerocopy.ReadWriter, err error) {
+func (c *ShadowsocksNoneTCPClient) Dial(targetAddr conn.Addr, payload []byte) (rawConn net.Conn, rw zerocopy.ReadWriter, err error) {
 	rw, rawRW, err := NewShadowsocksNoneStreamClientReadWriter(c.tco, targetAddr, payload)
 	if err == nil {
-		tc = rawRW.(*net.TCPConn)
+		rawConn = rawRW.(*net.TCPConn)
 	}
 	return
 }
@@ -130,16 +161,27 @@ func (s *ShadowsocksNoneTCPServer) DefaultTCPConnCloser() zerocopy.TCPConnCloser
 
 // Socks5TCPClient implements the zerocopy TCPClient interface.
 type Socks5TCPClient struct {
-	name    string
-	address string
-	dialer  tfo.Dialer
+	name        string
+	address     string
+	dialer      tfo.Dialer
+	tlsConfig   *tls.Config
+	tlsCoalesce time.Duration
 }
 
-func NewSocks5TCPClient(name, address string, dialerTFO bool, dialerFwmark int) *Socks5TCPClient {
+// NewSocks5TCPClient returns a new SOCKS5 TCP client that connects to the SOCKS5 server at address.
+//
+// If tlsConfig is not nil, connections to the server are wrapped in TLS before the SOCKS5 handshake.
+//
+// If tlsWriteCoalesceDelay is positive, small writes to TLS connections are buffered for up to
+// tlsWriteCoalesceDelay and sent together, up to one full TLS record at a time.
+// Buffered data is always sent before reading from the server.
+func NewSocks5TCPClient(name, address string, dialerTFO bool, dialerFwmark int, dialerTimeout time.Duration, tlsConfig *tls.Config, tlsWriteCoalesceDelay time.Duration) *Socks5TCPClient {
 	return &Socks5TCPClient{
-		name:    name,
-		address: address,
-		dialer:  conn.NewDialer(dialerTFO, dialerFwmark),
+		name:        name,
+		address:     address,
+		dialer:      conn.NewDialer(dialerTFO, dialerFwmark, dialerTimeout),
+		tlsConfig:   tlsConfig,
+		tlsCoalesce: tlsWriteCoalesceDelay,
 	}
 }
 
@@ -149,14 +191,23 @@ func (c *Socks5TCPClient) String() string {
 }
 
 // Dial implements the zerocopy.TCPClient Dial method.
-func (c *Socks5TCPClient) Dial(targetAddr conn.Addr, payload []byte) (tc *net.TCPConn, rw zerocopy.ReadWriter, err error) {
+func (c *Socks5TCPClient) Dial(targetAddr conn.Addr, payload []byte) (rawConn net.Conn, rw zerocopy.ReadWriter, err error) {
 	nc, err := c.dialer.Dial("tcp", c.address, nil)
 	if err != nil {
 		return
 	}
-	tc = nc.(*net.TCPConn)
+	tc := nc.(*net.TCPConn)
+	rawConn = tc
+
+	var rwc zerocopy.DirectReadWriteCloser = tc
+	if c.tlsConfig != nil {
+		rwc = newTLSClientConn(tc, c.tlsConfig)
+		if c.tlsCoalesce > 0 {
+			rwc = newCoalescingConn(rwc, tlsMaxRecordPayloadSize, c.tlsCoalesce)
+		}
+	}
 
-	rw, err = NewSocks5StreamClientReadWriter(tc, targetAddr)
+	rw, err = NewSocks5StreamClientReadWriter(rwc, targetAddr)
 	if err != nil {
 		tc.Close()
 		return
@@ -175,23 +226,45 @@ func (c *Socks5TCPClient) NativeInitialPayload() bool {
 	return false
 }
 
+// Socks5TCPServerConfig is the configuration of a [Socks5TCPServer].
+type Socks5TCPServerConfig struct {
+	Socks5ServerConfig
+
+	// If TLSConfig is not nil, accepted connections are wrapped in TLS before the SOCKS5 handshake.
+	// UDP ASSOCIATE still works over TLS: the bound address is taken from the underlying TCP connection,
+	// and the UDP relay itself is not encrypted.
+	TLSConfig *tls.Config
+
+	// If TLSWriteCoalesceDelay is positive, small writes to TLS connections are buffered for up to
+	// TLSWriteCoalesceDelay and sent together, up to one full TLS record at a time.
+	// Buffered data is always sent before reading from the client.
+	TLSWriteCoalesceDelay time.Duration
+}
+
 // Socks5TCPServer implements the zerocopy TCPServer interface.
 type Socks5TCPServer struct {
-	enableTCP bool
-	enableUDP bool
+	config Socks5TCPServerConfig
 }
 
-func NewSocks5TCPServer(enableTCP, enableUDP bool) *Socks5TCPServer {
+// NewSocks5TCPServer returns a new SOCKS5 TCP server.
+func NewSocks5TCPServer(config Socks5TCPServerConfig) *Socks5TCPServer {
 	return &Socks5TCPServer{
-		enableTCP: enableTCP,
-		enableUDP: enableUDP,
+		config: config,
 	}
 }
 
 // Accept implements the zerocopy.TCPServer Accept method.
 func (s *Socks5TCPServer) Accept(tc *net.TCPConn) (rw zerocopy.ReadWriter, targetAddr conn.Addr, payload []byte, err error) {
-	rw, targetAddr, err = NewSocks5StreamServerReadWriter(tc, s.enableTCP, s.enableUDP, tc)
-	if err == socks5.ErrUDPAssociateDone {
+	var rwc zerocopy.DirectReadWriteCloser = tc
+	if s.config.TLSConfig != nil {
+		rwc = newTLSServerConn(tc, s.config.TLSConfig)
+		if s.config.TLSWriteCoalesceDelay > 0 {
+			rwc = newCoalescingConn(rwc, tlsMaxRecordPayloadSize, s.config.TLSWriteCoalesceDelay)
+		}
+	}
+
+	rw, targetAddr, err = NewSocks5StreamServerReadWriter(rwc, s.config.Socks5ServerConfig, tc)
+	if err == socks5.ErrUDPAssociateDone || err == socks5.ErrUDPAssociateMaxHoldExceeded {
 		err = zerocopy.ErrAcceptDoneNoRelay
 	}
 	return
@@ -0,0 +1,234 @@
+package direct
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/socks5"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+// selfSignedTLSConfig returns a server TLS config with a self-signed certificate for localhost.
+func selfSignedTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{der},
+			PrivateKey:  key,
+		}},
+	}
+}
+
+// acceptOne accepts a single connection on a loopback listener and passes it to server.Accept.
+func acceptOne(t *testing.T, server zerocopy.TCPServer) (addr string, resultCh <-chan error) {
+	t.Helper()
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	ch := make(chan error, 1)
+	go func() {
+		tc, err := ln.AcceptTCP()
+		if err != nil {
+			ch <- err
+			return
+		}
+		defer tc.Close()
+		_, _, _, err = server.Accept(tc)
+		ch <- err
+	}()
+
+	return ln.Addr().String(), ch
+}
+
+func TestSocks5TCPServerTLS(t *testing.T) {
+	server := NewSocks5TCPServer(Socks5TCPServerConfig{
+		Socks5ServerConfig: Socks5ServerConfig{EnableTCP: true, EnableUDP: true},
+		TLSConfig:          selfSignedTLSConfig(t),
+	})
+	targetAddr := conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Unspecified(), 53))
+	clientConfig := &tls.Config{InsecureSkipVerify: true}
+
+	// CONNECT
+	addr, resultCh := acceptOne(t, server)
+	c, err := tls.Dial("tcp", addr, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = socks5.ClientConnect(c, targetAddr); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-resultCh; err != nil {
+		t.Errorf("server.Accept() on CONNECT returned %v", err)
+	}
+
+	// UDP ASSOCIATE
+	addr, resultCh = acceptOne(t, server)
+	c, err = tls.Dial("tcp", addr, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	boundAddr, err := socks5.ClientUDPAssociate(c, targetAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := c.RemoteAddr().(*net.TCPAddr).AddrPort(); boundAddr.IP() != expected.Addr() || boundAddr.Port() != expected.Port() {
+		t.Errorf("Bound address mismatch: got %s, expected %s", boundAddr, expected)
+	}
+
+	c.Close()
+	if err = <-resultCh; err != zerocopy.ErrAcceptDoneNoRelay {
+		t.Errorf("server.Accept() on UDP ASSOCIATE returned %v, expected %v", err, zerocopy.ErrAcceptDoneNoRelay)
+	}
+}
+
+func TestSocks5TCPClientTLS(t *testing.T) {
+	const coalesceDelay = time.Hour
+	server := NewSocks5TCPServer(Socks5TCPServerConfig{
+		Socks5ServerConfig:    Socks5ServerConfig{EnableTCP: true},
+		TLSConfig:             selfSignedTLSConfig(t),
+		TLSWriteCoalesceDelay: coalesceDelay,
+	})
+	targetAddr := conn.MustAddrFromDomainPort("example.com", 443)
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// Echo one message back to the client.
+	serverErrCh := make(chan error, 1)
+	go func() {
+		tc, err := ln.AcceptTCP()
+		if err != nil {
+			serverErrCh <- err
+			return
+		}
+		defer tc.Close()
+
+		rw, addr, _, err := server.Accept(tc)
+		if err != nil {
+			serverErrCh <- err
+			return
+		}
+		if addr != targetAddr {
+			serverErrCh <- fmt.Errorf("target address %s, expected %s", addr, targetAddr)
+			return
+		}
+
+		b := make([]byte, 5)
+		if _, err = io.ReadFull(rw.(*DirectStreamReadWriter).DirectReadCloser(), b); err != nil {
+			serverErrCh <- err
+			return
+		}
+		if _, err = rw.WriteZeroCopy(b, 0, len(b)); err != nil {
+			serverErrCh <- err
+			return
+		}
+
+		// The reply is flushed before reading, and the read ends when the client closes.
+		_, err = rw.(*DirectStreamReadWriter).DirectReadCloser().Read(b)
+		if err == io.EOF {
+			err = nil
+		}
+		serverErrCh <- err
+	}()
+
+	client := NewSocks5TCPClient("socks5", ln.Addr().String(), false, 0, 0, &tls.Config{InsecureSkipVerify: true}, coalesceDelay)
+	rawConn, rw, err := client.Dial(targetAddr, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rawConn.Close()
+
+	// Both sides hold their writes for coalesceDelay, so the exchange only completes
+	// if buffered data is flushed before each read.
+	b := make([]byte, 5)
+	if _, err = io.ReadFull(rw.(*DirectStreamReadWriter).DirectReadCloser(), b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("Got %q, expected %q", b, "hello")
+	}
+
+	if err = rw.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-serverErrCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTCPClientDialFamily(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan netip.AddrPort, 1)
+	go func() {
+		c, err := ln.AcceptTCP()
+		if err != nil {
+			return
+		}
+		accepted <- c.LocalAddr().(*net.TCPAddr).AddrPort()
+		c.Close()
+	}()
+
+	port := ln.Addr().(*net.TCPAddr).AddrPort().Port()
+	c := NewTCPClient("direct", false, 0, 0)
+	rawConn, _, err := c.DialFamily(conn.MustAddrFromDomainPort("localhost", port), conn.AddrFamilyIPv4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rawConn.Close()
+
+	if got := rawConn.RemoteAddr().(*net.TCPAddr).AddrPort(); !got.Addr().Is4() {
+		t.Errorf("Connected to %s, expected an IPv4 address", got)
+	}
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for connection")
+	}
+}
@@ -0,0 +1,36 @@
+package direct
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// tlsConn wraps a TLS connection over TCP to implement [zerocopy.DirectReadWriteCloser].
+type tlsConn struct {
+	*tls.Conn
+	tc *net.TCPConn
+}
+
+// newTLSServerConn returns a TLS server connection over tc.
+// The handshake is performed on the first read or write.
+func newTLSServerConn(tc *net.TCPConn, config *tls.Config) tlsConn {
+	return tlsConn{
+		Conn: tls.Server(tc, config),
+		tc:   tc,
+	}
+}
+
+// newTLSClientConn returns a TLS client connection over tc.
+// The handshake is performed on the first read or write.
+func newTLSClientConn(tc *net.TCPConn, config *tls.Config) tlsConn {
+	return tlsConn{
+		Conn: tls.Client(tc, config),
+		tc:   tc,
+	}
+}
+
+// CloseRead implements the zerocopy.CloseRead CloseRead method.
+// It shuts down the reading side of the underlying TCP connection.
+func (c tlsConn) CloseRead() error {
+	return c.tc.CloseRead()
+}
@@ -1,14 +1,21 @@
 package direct
 
 import (
+	"net"
 	"net/netip"
+	"time"
 
 	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/socks5"
 	"github.com/database64128/shadowsocks-go/zerocopy"
+	"github.com/database64128/tfo-go/v2"
 )
 
-func NewUDPClient(name string, mtu, fwmark int) *zerocopy.SimpleUDPClient {
-	p := NewDirectPacketClientPackUnpacker(mtu)
+// NewUDPClient creates a direct UDP client.
+//
+// If resolveTimeout is positive, resolving a domain target fails after resolveTimeout.
+func NewUDPClient(name string, mtu, fwmark int, resolveTimeout time.Duration) *zerocopy.SimpleUDPClient {
+	p := NewDirectPacketClientPackUnpacker(mtu, resolveTimeout)
 	maxPacketSize := zerocopy.MaxPacketSizeForAddr(mtu, netip.IPv4Unspecified())
 	return zerocopy.NewSimpleUDPClient(zerocopy.ZeroHeadroom{}, p, p, name, maxPacketSize, fwmark)
 }
@@ -32,6 +39,73 @@ func NewSocks5UDPClient(addrPort netip.AddrPort, name string, mtu, fwmark int) *
 	return zerocopy.NewSimpleUDPClient(Socks5PacketClientMessageHeadroom{}, packer, unpacker, name, maxPacketSize, fwmark)
 }
 
+// Socks5AssociateUDPClient is a SOCKS5 UDP client that performs the UDP ASSOCIATE ritual.
+//
+// Each session dials a TCP connection to the SOCKS5 server, sends a UDP ASSOCIATE request,
+// and sends its packets to the relay address in the reply. The TCP connection is returned
+// as the session's closer, and kept open for the lifetime of the session.
+//
+// Socks5AssociateUDPClient implements the zerocopy UDPClient interface.
+type Socks5AssociateUDPClient struct {
+	Socks5PacketClientMessageHeadroom
+	name    string
+	address string
+	mtu     int
+	fwmark  int
+	dialer  tfo.Dialer
+}
+
+// NewSocks5AssociateUDPClient creates a SOCKS5 UDP client that associates with the SOCKS5 server at address.
+func NewSocks5AssociateUDPClient(name, address string, mtu int, dialerTFO bool, dialerFwmark int, dialerTimeout time.Duration) *Socks5AssociateUDPClient {
+	return &Socks5AssociateUDPClient{
+		name:    name,
+		address: address,
+		mtu:     mtu,
+		fwmark:  dialerFwmark,
+		dialer:  conn.NewDialer(dialerTFO, dialerFwmark, dialerTimeout),
+	}
+}
+
+// String implements the zerocopy.UDPClient String method.
+func (c *Socks5AssociateUDPClient) String() string {
+	return c.name
+}
+
+// NewSession implements the zerocopy.UDPClient NewSession method.
+func (c *Socks5AssociateUDPClient) NewSession() (zerocopy.ClientInfo, zerocopy.ClientPacker, zerocopy.ClientUnpacker, error) {
+	nc, err := c.dialer.Dial("tcp", c.address, nil)
+	if err != nil {
+		return zerocopy.ClientInfo{}, nil, nil, err
+	}
+
+	relayAddr, err := socks5.ClientUDPAssociate(nc, conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv4Unspecified(), 0)))
+	if err != nil {
+		nc.Close()
+		return zerocopy.ClientInfo{}, nil, nil, err
+	}
+
+	relayAddrPort, err := relayAddr.ResolveIPPort()
+	if err != nil {
+		nc.Close()
+		return zerocopy.ClientInfo{}, nil, nil, err
+	}
+
+	// An unspecified relay address means the relay is on the same host as the SOCKS5 server.
+	if relayAddrPort.Addr().IsUnspecified() {
+		serverAddrPort := nc.RemoteAddr().(*net.TCPAddr).AddrPort()
+		relayAddrPort = netip.AddrPortFrom(serverAddrPort.Addr(), relayAddrPort.Port())
+	}
+
+	maxPacketSize := zerocopy.MaxPacketSizeForAddr(c.mtu, relayAddrPort.Addr())
+	info := zerocopy.ClientInfo{
+		Name:          c.name,
+		MaxPacketSize: maxPacketSize,
+		Fwmark:        c.fwmark,
+		Closer:        nc,
+	}
+	return info, NewSocks5PacketClientPacker(relayAddrPort, maxPacketSize), NewSocks5PacketClientUnpacker(relayAddrPort), nil
+}
+
 // DirectUDPNATServer implements the zerocopy UDPNATServer interface.
 type DirectUDPNATServer struct {
 	zerocopy.ZeroHeadroom
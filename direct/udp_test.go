@@ -0,0 +1,69 @@
+package direct
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/socks5"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+func TestSocks5AssociateUDPClient(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	serverAddrPort := ln.Addr().(*net.TCPAddr).AddrPort()
+
+	serverErrCh := make(chan error, 1)
+
+	go func() {
+		tc, err := ln.AcceptTCP()
+		if err != nil {
+			serverErrCh <- err
+			return
+		}
+		defer tc.Close()
+
+		if _, err = socks5.ServerAccept(tc, false, true, socks5.Succeeded, 0, tc); err != socks5.ErrUDPAssociateDone {
+			serverErrCh <- err
+			return
+		}
+
+		// The association lasts until the client closes the control connection.
+		_, err = io.Copy(io.Discard, tc)
+		serverErrCh <- err
+	}()
+
+	c := NewSocks5AssociateUDPClient("socks5", serverAddrPort.String(), 1500, false, 0, 0)
+	clientInfo, packer, unpacker, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clientInfo.Closer == nil {
+		t.Fatal("Expected session to have a closer")
+	}
+
+	b := make([]byte, packer.FrontHeadroom()+1+packer.RearHeadroom())
+	targetAddr := conn.AddrFromIPPort(netip.MustParseAddrPort("192.0.2.1:53"))
+	destAddrPort, _, _, err := packer.PackInPlace(b, targetAddr, packer.FrontHeadroom(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if destAddrPort != serverAddrPort {
+		t.Errorf("Packet destination is %s, expected relay address %s", destAddrPort, serverAddrPort)
+	}
+
+	zerocopy.ClientServerPackerUnpackerTestFunc(t, packer, unpacker, Socks5PacketServerPacker{}, &Socks5PacketServerUnpacker{})
+
+	if err = clientInfo.Closer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-serverErrCh; err != nil {
+		t.Errorf("Server failed: %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package direct
+
+import (
+	"net"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+// unixTCPClient wraps a TCP client and connects to Unix domain sockets
+// for domain targets that start with a prefix.
+type unixTCPClient struct {
+	zerocopy.TCPClient
+	prefix string
+	netns  string
+	dialer net.Dialer
+}
+
+// NewUnixTCPClient wraps c so that a domain target starting with prefix, like "unix:/run/app.sock",
+// is connected to as the Unix domain socket at the path after the prefix. The port number is ignored.
+// Paths starting with '@' are abstract sockets. Other targets are dialed by c.
+//
+// Unix domain sockets are connected to with dialerTimeout, like c's dials.
+// If netns is not empty, they are connected to from that network namespace,
+// which is where abstract sockets are looked up.
+//
+// This exposes local services to anyone who can use the client, so enable it with care.
+// If prefix is empty, c is returned as is.
+func NewUnixTCPClient(c zerocopy.TCPClient, prefix string, dialerTimeout time.Duration, netns string) zerocopy.TCPClient {
+	if prefix == "" {
+		return c
+	}
+	return &unixTCPClient{
+		TCPClient: c,
+		prefix:    prefix,
+		netns:     netns,
+		dialer: net.Dialer{
+			Timeout: dialerTimeout,
+		},
+	}
+}
+
+// Dial implements the zerocopy.TCPClient Dial method.
+func (c *unixTCPClient) Dial(targetAddr conn.Addr, payload []byte) (rawConn net.Conn, rw zerocopy.ReadWriter, err error) {
+	path, ok := targetAddr.UnixPath(c.prefix)
+	if !ok {
+		return c.TCPClient.Dial(targetAddr, payload)
+	}
+	return c.dialUnix(path, payload)
+}
+
+// DialFamily implements the zerocopy.FamilyDialer DialFamily method.
+// Unix domain socket targets are not resolved.
+func (c *unixTCPClient) DialFamily(targetAddr conn.Addr, family conn.AddrFamily, payload []byte) (rawConn net.Conn, rw zerocopy.ReadWriter, err error) {
+	path, ok := targetAddr.UnixPath(c.prefix)
+	if !ok {
+		if fd, ok := c.TCPClient.(zerocopy.FamilyDialer); ok {
+			return fd.DialFamily(targetAddr, family, payload)
+		}
+		return c.TCPClient.Dial(targetAddr, payload)
+	}
+	return c.dialUnix(path, payload)
+}
+
+// dialUnix connects to the Unix domain socket at path and sends payload.
+func (c *unixTCPClient) dialUnix(path string, payload []byte) (rawConn net.Conn, rw zerocopy.ReadWriter, err error) {
+	var nc net.Conn
+	err = conn.RunInNetns(c.netns, func() error {
+		nc, err = c.dialer.Dial("unix", path)
+		return err
+	})
+	if err != nil {
+		if nc != nil {
+			nc.Close()
+		}
+		return
+	}
+	uc := nc.(*net.UnixConn)
+
+	if len(payload) > 0 {
+		if _, err = uc.Write(payload); err != nil {
+			uc.Close()
+			return
+		}
+	}
+
+	rawConn = uc
+	rw = &DirectStreamReadWriter{rw: uc}
+	return
+}
@@ -0,0 +1,91 @@
+package direct
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+var errRecordingDial = errors.New("recorded dial")
+
+// recordingTCPClient records the targets it is asked to dial, and fails every dial.
+type recordingTCPClient struct {
+	zerocopy.TCPClient
+	targets []conn.Addr
+}
+
+func (c *recordingTCPClient) Dial(targetAddr conn.Addr, payload []byte) (net.Conn, zerocopy.ReadWriter, error) {
+	c.targets = append(c.targets, targetAddr)
+	return nil, nil, errRecordingDial
+}
+
+func TestUnixTCPClient(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "echo.sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	payload := []byte("hello")
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, io.LimitReader(c, int64(len(payload))))
+	}()
+
+	wrapped := &recordingTCPClient{TCPClient: NewTCPClient("direct", false, 0, 0)}
+	c := NewUnixTCPClient(wrapped, "unix:", time.Second, "")
+
+	if timeout := c.(*unixTCPClient).dialer.Timeout; timeout != time.Second {
+		t.Errorf("Unix dialer timeout is %s, expected %s", timeout, time.Second)
+	}
+
+	rawConn, rw, err := c.Dial(conn.MustAddrFromDomainPort("unix:"+path, 0), payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rawConn.Close()
+
+	if _, ok := rawConn.(*net.UnixConn); !ok {
+		t.Errorf("Dial returned %T, expected *net.UnixConn", rawConn)
+	}
+
+	echo := make([]byte, len(payload))
+	if _, err = io.ReadFull(rawConn, echo); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echo, payload) {
+		t.Errorf("Got echo %q, expected %q", echo, payload)
+	}
+	if err = rw.CloseWrite(); err != nil {
+		t.Errorf("CloseWrite failed: %v", err)
+	}
+
+	if len(wrapped.targets) != 0 {
+		t.Errorf("Unix socket target was dialed by the wrapped client: %v", wrapped.targets)
+	}
+
+	// Without the prefix, the target is dialed by the wrapped client.
+	targetAddr := conn.MustAddrFromDomainPort("nounix:"+path, 0)
+	if _, _, err = c.Dial(targetAddr, nil); err != errRecordingDial {
+		t.Errorf("Dial returned error %v, expected %v", err, errRecordingDial)
+	}
+	if len(wrapped.targets) != 1 || wrapped.targets[0] != targetAddr {
+		t.Errorf("Wrapped client dialed %v, expected [%s]", wrapped.targets, targetAddr)
+	}
+
+	if NewUnixTCPClient(c, "", 0, "") != c {
+		t.Error("NewUnixTCPClient with empty prefix did not return the client as is")
+	}
+}
@@ -270,11 +270,8 @@ func (r *Resolver) sendQueries(nameString string) (result Result, err error) {
 //
 // It's the caller's responsibility to examine the minTTL and decide whether to cache the result.
 func (r *Resolver) sendQueriesUDP(nameString string, q4Pkt, q6Pkt []byte) (result Result, minTTL uint32, handled bool) {
-	// Get client link info.
-	maxPacketSize, fwmark := r.udpClient.LinkInfo()
-
 	// Create client session.
-	packer, unpacker, err := r.udpClient.NewSession()
+	clientInfo, packer, unpacker, err := r.udpClient.NewSession()
 	if err != nil {
 		r.logger.Warn("Failed to create new UDP client session",
 			zap.String("resolver", r.name),
@@ -287,11 +284,12 @@ func (r *Resolver) sendQueriesUDP(nameString string, q4Pkt, q6Pkt []byte) (resul
 	packerRearHeadroom := packer.RearHeadroom()
 
 	// Prepare UDP socket.
-	udpConn, err := conn.ListenUDP("udp", "", false, fwmark)
+	udpConn, err := conn.ListenUDPOnInterface("udp", clientInfo.Netns, clientInfo.Interface, clientInfo.LocalPortRange, false, clientInfo.Fwmark)
 	if err != nil {
 		r.logger.Warn("Failed to create UDP socket for DNS lookup",
 			zap.String("resolver", r.name),
-			zap.Int("fwmark", fwmark),
+			zap.Int("fwmark", clientInfo.Fwmark),
+			zap.Stringer("localPortRange", clientInfo.LocalPortRange),
 			zap.Error(err),
 		)
 		return
@@ -371,7 +369,7 @@ func (r *Resolver) sendQueriesUDP(nameString string, q4Pkt, q6Pkt []byte) (resul
 
 	// Receive replies.
 	minTTL = math.MaxUint32
-	recvBuf := make([]byte, maxPacketSize)
+	recvBuf := make([]byte, clientInfo.MaxPacketSize)
 
 	var (
 		v4done, v6done bool
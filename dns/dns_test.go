@@ -43,8 +43,8 @@ func TestResolver(t *testing.T) {
 	defer logger.Sync()
 
 	serverAddrPort := netip.AddrPortFrom(netip.AddrFrom4([4]byte{1, 1, 1, 1}), 53)
-	tcpClient := direct.NewTCPClient("direct", true, 0)
-	udpClient := direct.NewUDPClient("direct", 1500, 0)
+	tcpClient := direct.NewTCPClient("direct", true, 0, 0)
+	udpClient := direct.NewUDPClient("direct", 1500, 0, 0)
 
 	t.Run("UDP", func(t *testing.T) {
 		testResolver(t, "UDP", serverAddrPort, nil, udpClient, logger)
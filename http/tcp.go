@@ -2,6 +2,7 @@ package http
 
 import (
 	"net"
+	"time"
 
 	"github.com/database64128/shadowsocks-go/conn"
 	"github.com/database64128/shadowsocks-go/zerocopy"
@@ -16,11 +17,11 @@ type ProxyClient struct {
 	dialer  tfo.Dialer
 }
 
-func NewProxyClient(name, address string, dialerTFO bool, dialerFwmark int) *ProxyClient {
+func NewProxyClient(name, address string, dialerTFO bool, dialerFwmark int, dialerTimeout time.Duration) *ProxyClient {
 	return &ProxyClient{
 		name:    name,
 		address: address,
-		dialer:  conn.NewDialer(dialerTFO, dialerFwmark),
+		dialer:  conn.NewDialer(dialerTFO, dialerFwmark, dialerTimeout),
 	}
 }
 
@@ -30,12 +31,13 @@ func (c *ProxyClient) String() string {
 }
 
 // Dial implements the zerocopy.TCPClient Dial method.
-func (c *ProxyClient) Dial(targetAddr conn.Addr, payload []byte) (tc *net.TCPConn, rw zerocopy.ReadWriter, err error) {
+func (c *ProxyClient) Dial(targetAddr conn.Addr, payload []byte) (rawConn net.Conn, rw zerocopy.ReadWriter, err error) {
 	nc, err := c.dialer.Dial("tcp", c.address, nil)
 	if err != nil {
 		return
 	}
-	tc = nc.(*net.TCPConn)
+	tc := nc.(*net.TCPConn)
+	rawConn = tc
 
 	rw, err = NewHttpStreamClientReadWriter(tc, targetAddr)
 	if err != nil {
@@ -0,0 +1,49 @@
+package logging
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// DefaultWarnSamplingTick is the sampling interval of [NewWarnSampledLogger] used by relay services.
+const DefaultWarnSamplingTick = time.Second
+
+// warnSamplerCore samples entries of WarnLevel, and passes entries of other levels through unsampled.
+type warnSamplerCore struct {
+	zapcore.Core
+	sampled zapcore.Core
+}
+
+// With implements the zapcore.Core With method.
+func (c *warnSamplerCore) With(fields []zapcore.Field) zapcore.Core {
+	return &warnSamplerCore{
+		Core:    c.Core.With(fields),
+		sampled: c.sampled.With(fields),
+	}
+}
+
+// Check implements the zapcore.Core Check method.
+func (c *warnSamplerCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if ent.Level == zapcore.WarnLevel {
+		return c.sampled.Check(ent, ce)
+	}
+	return c.Core.Check(ent, ce)
+}
+
+// NewWarnSampledLogger wraps logger so that warnings are sampled.
+// Within each tick, the first initial warnings with the same message are logged,
+// and then only every thereafter-th. If thereafter is zero, the rest are dropped.
+// Counters are kept per message, so a flood of one warning does not suppress others.
+//
+// Entries of other levels are never sampled, so that errors and lifecycle logs are always kept.
+// Use it to protect logs from hot-path warnings like "Failed to unpack packet" under attack or persistent failure.
+func NewWarnSampledLogger(logger *zap.Logger, tick time.Duration, initial, thereafter int) *zap.Logger {
+	return logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &warnSamplerCore{
+			Core:    core,
+			sampled: zapcore.NewSamplerWithOptions(core, tick, initial, thereafter),
+		}
+	}))
+}
@@ -54,3 +54,54 @@ func NewProductionConsoleEncoderConfig(suppressTimestamps bool) zapcore.EncoderC
 		ConsoleSeparator: " ",
 	}
 }
+
+// Keys of the top-level fields in JSON logs produced by NewProductionJSONConfig.
+// These are part of the log schema consumed by external log pipelines, and must not change.
+const (
+	JSONTimeKey       = "ts"
+	JSONLevelKey      = "level"
+	JSONNameKey       = "logger"
+	JSONCallerKey     = "caller"
+	JSONMessageKey    = "msg"
+	JSONStacktraceKey = "stacktrace"
+)
+
+// NewProductionJSONConfig is a production logging configuration for external log pipelines.
+// Logging is enabled at InfoLevel and above.
+//
+// It uses a JSON encoder with stable top-level keys, writes to standard error, and enables sampling.
+// Stacktraces are automatically included on logs of ErrorLevel and above.
+func NewProductionJSONConfig() zap.Config {
+	return zap.Config{
+		Level:       zap.NewAtomicLevelAt(zap.InfoLevel),
+		Development: false,
+		Sampling: &zap.SamplingConfig{
+			Initial:    100,
+			Thereafter: 100,
+		},
+		Encoding:         "json",
+		EncoderConfig:    NewProductionJSONEncoderConfig(),
+		OutputPaths:      []string{"stderr"},
+		ErrorOutputPaths: []string{"stderr"},
+	}
+}
+
+// NewProductionJSONEncoderConfig returns an EncoderConfig for JSON logs with stable top-level keys.
+// Timestamps are encoded in RFC 3339 format with nanoseconds, levels in lowercase,
+// and durations as strings like "1.5s".
+func NewProductionJSONEncoderConfig() zapcore.EncoderConfig {
+	return zapcore.EncoderConfig{
+		TimeKey:        JSONTimeKey,
+		LevelKey:       JSONLevelKey,
+		NameKey:        JSONNameKey,
+		CallerKey:      JSONCallerKey,
+		FunctionKey:    zapcore.OmitKey,
+		MessageKey:     JSONMessageKey,
+		StacktraceKey:  JSONStacktraceKey,
+		LineEnding:     zapcore.DefaultLineEnding,
+		EncodeLevel:    zapcore.LowercaseLevelEncoder,
+		EncodeTime:     zapcore.RFC3339NanoTimeEncoder,
+		EncodeDuration: zapcore.StringDurationEncoder,
+		EncodeCaller:   zapcore.ShortCallerEncoder,
+	}
+}
@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestProductionJSONEncoderSchema(t *testing.T) {
+	enc := zapcore.NewJSONEncoder(NewProductionJSONEncoderConfig())
+	entry := zapcore.Entry{
+		Level:      zapcore.ErrorLevel,
+		Time:       time.Date(2022, 1, 2, 3, 4, 5, 6, time.UTC),
+		LoggerName: "relay",
+		Message:    "Failed to relay packet",
+		Caller:     zapcore.NewEntryCaller(0, "service/udp.go", 42, true),
+		Stack:      "stack",
+	}
+	buf, err := enc.EncodeEntry(entry, []zapcore.Field{
+		zap.Uint64("clientSessionID", 42),
+		zap.Duration("natTimeout", 1500*time.Millisecond),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m map[string]any
+	if err = json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatalf("Failed to decode %q: %v", buf.Bytes(), err)
+	}
+
+	expected := map[string]any{
+		"ts":              "2022-01-02T03:04:05.000000006Z",
+		"level":           "error",
+		"logger":          "relay",
+		"caller":          "service/udp.go:42",
+		"msg":             "Failed to relay packet",
+		"stacktrace":      "stack",
+		"clientSessionID": float64(42),
+		"natTimeout":      "1.5s",
+	}
+	if len(m) != len(expected) {
+		t.Errorf("Encoded %d keys, expected %d: %s", len(m), len(expected), buf.Bytes())
+	}
+	for k, v := range expected {
+		if m[k] != v {
+			t.Errorf("Key %q is %v, expected %v", k, m[k], v)
+		}
+	}
+}
+
+func TestNewWarnSampledLogger(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	logger := NewWarnSampledLogger(zap.New(core), time.Hour, 2, 3).With(zap.String("server", "test"))
+
+	for i := 0; i < 10; i++ {
+		logger.Warn("Failed to unpack packet")
+		logger.Warn("Failed to write packet")
+		logger.Info("Relay session started")
+		logger.Error("Failed to start")
+	}
+
+	for _, c := range []struct {
+		msg      string
+		expected int
+	}{
+		// The first 2, then the 5th and the 8th.
+		{"Failed to unpack packet", 4},
+		{"Failed to write packet", 4},
+		{"Relay session started", 10},
+		{"Failed to start", 10},
+	} {
+		if n := logs.FilterMessage(c.msg).Len(); n != c.expected {
+			t.Errorf("Logged %q %d times, expected %d", c.msg, n, c.expected)
+		}
+	}
+
+	for _, entry := range logs.All() {
+		if entry.ContextMap()["server"] != "test" {
+			t.Errorf("Entry %q is missing the server field", entry.Message)
+		}
+	}
+}
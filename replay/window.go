@@ -0,0 +1,132 @@
+// Package replay implements sliding window replay protection for sequence numbers.
+package replay
+
+const (
+	blockBitLog = 6                // 1<<6 == 64 bits
+	blockBits   = 1 << blockBitLog // must be power of 2
+	bitMask     = blockBits - 1
+)
+
+// DefaultSize is the default window size.
+// It fits in a ring of 128 blocks, or 1 KiB.
+const DefaultSize = (128 - 1) * blockBits
+
+// Window is a bitmap-based sliding window of uint64 sequence numbers.
+//
+// A sequence number is accepted once if it is ahead of the highest accepted sequence number,
+// or if it is no more than the window size behind it and has not been seen before.
+//
+// A Window is not safe for concurrent use.
+type Window struct {
+	last      uint64
+	size      uint64
+	blockMask uint64
+	ring      []uint64
+}
+
+// NewWindow returns a new window that tracks the last size sequence numbers.
+// If size is 0, DefaultSize is used.
+func NewWindow(size uint64) *Window {
+	if size == 0 {
+		size = DefaultSize
+	}
+
+	// Reserve one extra block for the block containing the highest sequence number.
+	blocks := uint64(2)
+	for (blocks-1)*blockBits < size {
+		blocks <<= 1
+	}
+
+	return &Window{
+		size:      size,
+		blockMask: blocks - 1,
+		ring:      make([]uint64, blocks),
+	}
+}
+
+// Size returns the window size.
+func (w *Window) Size() uint64 {
+	return w.size
+}
+
+// Reset resets the window to its initial state.
+func (w *Window) Reset() {
+	w.last = 0
+	w.ring[0] = 0
+}
+
+// Last returns the highest sequence number added to the window.
+func (w *Window) Last() uint64 {
+	return w.last
+}
+
+// IsBehind returns whether seq is too old to be tracked by the window.
+func (w *Window) IsBehind(seq uint64) bool {
+	return seq < w.last && w.last-seq > w.size
+}
+
+// IsOk returns whether seq can be accepted by the window, without updating the window.
+func (w *Window) IsOk(seq uint64) bool {
+	switch {
+	case seq > w.last: // ahead of window
+		return true
+	case w.last-seq > w.size: // behind window
+		return false
+	}
+
+	// In window. Check bit.
+	blockIndex := seq >> blockBitLog & w.blockMask
+	bitIndex := seq & bitMask
+	return w.ring[blockIndex]>>bitIndex&1 == 0
+}
+
+// MustAdd adds seq to the window without checking if the sequence number is valid.
+// Call IsOk beforehand to make sure the sequence number is valid.
+//
+// This is useful when the sequence number must only be recorded after
+// the packet carrying it has been authenticated.
+func (w *Window) MustAdd(seq uint64) {
+	if seq > w.last {
+		w.advance(seq)
+	}
+	w.set(seq)
+}
+
+// Check returns whether seq is accepted by the window.
+// Accepted sequence numbers are added to the window.
+// Replayed sequence numbers and those behind the window are rejected.
+func (w *Window) Check(seq uint64) bool {
+	switch {
+	case seq > w.last: // ahead of window
+		w.advance(seq)
+	case w.last-seq > w.size: // behind window
+		return false
+	case w.ring[seq>>blockBitLog&w.blockMask]>>(seq&bitMask)&1 == 1: // already seen by window
+		return false
+	}
+
+	w.set(seq)
+	return true
+}
+
+// advance moves the window forward so that seq becomes the highest sequence number,
+// clearing blocks that slide into the window.
+func (w *Window) advance(seq uint64) {
+	lastBlockIndex := w.last >> blockBitLog
+	diff := seq>>blockBitLog - lastBlockIndex
+	if ringBlocks := uint64(len(w.ring)); diff > ringBlocks {
+		diff = ringBlocks
+	}
+
+	for i := uint64(0); i < diff; i++ {
+		lastBlockIndex = (lastBlockIndex + 1) & w.blockMask
+		w.ring[lastBlockIndex] = 0
+	}
+
+	w.last = seq
+}
+
+// set marks seq as seen.
+func (w *Window) set(seq uint64) {
+	w.ring[seq>>blockBitLog&w.blockMask] |= 1 << (seq & bitMask)
+}
@@ -0,0 +1,219 @@
+package replay
+
+import "testing"
+
+func TestIsOkMustAdd(t *testing.T) {
+	var (
+		window = NewWindow(DefaultSize)
+		n      = uint64(len(window.ring)+1) * blockBits
+	)
+
+	// Add 1, 3, 5, ..., n-1.
+	for i := uint64(1); i < n; i += 2 {
+		if !window.IsOk(i) {
+			t.Error(i, "should be ok.")
+		}
+		window.MustAdd(i)
+	}
+
+	// Check 0, 2, 4, ..., 126.
+	for i := uint64(1); i < n-DefaultSize; i += 2 {
+		if window.IsOk(i) {
+			t.Error(i, "should not be ok.")
+		}
+	}
+
+	// Check 128, 130, 132, ..., n-2.
+	for i := uint64(n - DefaultSize); i < n; i += 2 {
+		if !window.IsOk(i) {
+			t.Error(i, "should be ok.")
+		}
+	}
+
+	// Check 1, 3, 5, ..., n-1.
+	for i := uint64(1); i < n; i += 2 {
+		if window.IsOk(i) {
+			t.Error(i, "should not be ok.")
+		}
+	}
+
+	// Roll over the window.
+	n *= 2
+	if !window.IsOk(n) {
+		t.Error(n, "should be ok.")
+	}
+	window.MustAdd(n)
+
+	// Check behind window.
+	for i := uint64(0); i < n-DefaultSize; i++ {
+		if window.IsOk(i) {
+			t.Error(i, "should not be ok.")
+		}
+	}
+
+	// Check within window.
+	for i := n - DefaultSize; i < n; i++ {
+		if !window.IsOk(i) {
+			t.Error(i, "should be ok.")
+		}
+	}
+
+	// Check after window.
+	for i := n + 1; i < n+DefaultSize; i++ {
+		if !window.IsOk(i) {
+			t.Error(i, "should be ok.")
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	var (
+		window = NewWindow(DefaultSize)
+		n      = uint64(len(window.ring)+1) * blockBits
+	)
+
+	// Add 1, 3, 5, ..., n-1.
+	for i := uint64(1); i < n; i += 2 {
+		if !window.Check(i) {
+			t.Error(i, "should succeed.")
+		}
+	}
+
+	// Check 0, 2, 4, ..., 126.
+	for i := uint64(1); i < n-DefaultSize; i += 2 {
+		if window.Check(i) {
+			t.Error(i, "should fail.")
+		}
+	}
+
+	// Check 128, 130, 132, ..., n-2.
+	for i := uint64(n - DefaultSize); i < n; i += 2 {
+		if !window.Check(i) {
+			t.Error(i, "should succeed.")
+		}
+	}
+
+	// Check 1, 3, 5, ..., n-1.
+	for i := uint64(1); i < n; i += 2 {
+		if window.Check(i) {
+			t.Error(i, "should fail.")
+		}
+	}
+
+	// Roll over the window.
+	n *= 2
+	if !window.Check(n) {
+		t.Error(n, "should succeed.")
+	}
+
+	// Check behind window.
+	for i := uint64(0); i < n-DefaultSize; i++ {
+		if window.Check(i) {
+			t.Error(i, "should fail.")
+		}
+	}
+
+	// Check within window.
+	for i := n - DefaultSize; i < n; i++ {
+		if !window.Check(i) {
+			t.Error(i, "should succeed.")
+		}
+	}
+
+	// Check after window.
+	for i := n + 1; i < n+DefaultSize; i++ {
+		if !window.Check(i) {
+			t.Error(i, "should succeed.")
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	window := NewWindow(DefaultSize)
+
+	for i := uint64(0); i < DefaultSize*2; i++ {
+		window.MustAdd(i)
+	}
+
+	window.Reset()
+
+	for i := uint64(0); i < DefaultSize*2; i++ {
+		if !window.IsOk(i) {
+			t.Error(i, "should be ok.")
+		}
+	}
+}
+
+func TestNewWindowSize(t *testing.T) {
+	for _, c := range []struct {
+		size           uint64
+		expectedSize   uint64
+		expectedBlocks int
+	}{
+		{0, DefaultSize, 128},
+		{1, 1, 2},
+		{blockBits, blockBits, 2},
+		{blockBits + 1, blockBits + 1, 4},
+		{1000, 1000, 32},
+		{DefaultSize, DefaultSize, 128},
+		{DefaultSize + 1, DefaultSize + 1, 256},
+	} {
+		window := NewWindow(c.size)
+		if size := window.Size(); size != c.expectedSize {
+			t.Errorf("NewWindow(%d).Size() = %d, expected %d", c.size, size, c.expectedSize)
+		}
+		if blocks := len(window.ring); blocks != c.expectedBlocks {
+			t.Errorf("NewWindow(%d) has %d blocks, expected %d", c.size, blocks, c.expectedBlocks)
+		}
+	}
+}
+
+func TestCheckCustomSize(t *testing.T) {
+	for _, size := range []uint64{1, 7, blockBits, blockBits + 1, 1000} {
+		window := NewWindow(size)
+		n := size * 4
+
+		// Add 0, 1, 2, ..., n-1.
+		for i := uint64(0); i < n; i++ {
+			if !window.Check(i) {
+				t.Errorf("size %d: %d should succeed.", size, i)
+			}
+		}
+
+		// Everything up to n-1 has been seen.
+		for i := uint64(0); i < n; i++ {
+			if window.Check(i) {
+				t.Errorf("size %d: %d should fail.", size, i)
+			}
+		}
+
+		// Jump ahead by exactly the window size.
+		last := n - 1 + size
+		if !window.Check(last) {
+			t.Errorf("size %d: %d should succeed.", size, last)
+		}
+
+		// Sequence numbers more than size behind are rejected and reported as behind.
+		for i := uint64(0); i < last-size; i++ {
+			if !window.IsBehind(i) {
+				t.Errorf("size %d: %d should be behind.", size, i)
+			}
+			if window.Check(i) {
+				t.Errorf("size %d: %d should fail.", size, i)
+			}
+		}
+
+		// Sequence numbers within size behind that were not seen are accepted once.
+		for i := n; i < last; i++ {
+			if window.IsBehind(i) {
+				t.Errorf("size %d: %d should not be behind.", size, i)
+			}
+			if !window.Check(i) {
+				t.Errorf("size %d: %d should succeed.", size, i)
+			}
+			if window.Check(i) {
+				t.Errorf("size %d: %d should fail on replay.", size, i)
+			}
+		}
+	}
+}
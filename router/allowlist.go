@@ -0,0 +1,125 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/database64128/shadowsocks-go/conn"
+)
+
+// ErrTargetNotAllowed indicates that the request's target is not in the user's target allowlist.
+var ErrTargetNotAllowed = errors.New("target not allowed for user")
+
+// targetAllowlist matches request targets against a user's allowed targets.
+type targetAllowlist struct {
+	addrs    map[conn.Addr]struct{}
+	prefixes []netip.Prefix
+	domains  map[string]struct{}
+	suffixes []string
+}
+
+// newTargetAllowlist parses the allowed targets of a user. Each entry is one of:
+//
+//   - An address with a port, such as "example.com:443", "192.0.2.1:443", or "[2001:db8::1]:443".
+//   - An IP address or prefix, such as "192.0.2.1" or "2001:db8::/32", which allows any port.
+//   - A domain name, such as "example.com", which allows any port.
+//   - A wildcard domain name, such as "*.example.com", which allows any subdomain of example.com on any port,
+//     but not example.com itself.
+func newTargetAllowlist(entries []string) (*targetAllowlist, error) {
+	l := targetAllowlist{
+		addrs:   make(map[conn.Addr]struct{}),
+		domains: make(map[string]struct{}),
+	}
+
+	for _, entry := range entries {
+		domain := strings.ToLower(strings.TrimSuffix(entry, "."))
+		wildcard := strings.HasPrefix(domain, "*.")
+		if wildcard {
+			domain = domain[len("*."):]
+			if domain == "" || strings.ContainsAny(domain, "*/:[] ") {
+				return nil, fmt.Errorf("invalid allowed target: %q", entry)
+			}
+			l.suffixes = append(l.suffixes, "."+domain)
+			continue
+		}
+
+		if addr, err := conn.ParseAddr(entry); err == nil {
+			l.addrs[addr.Normalize()] = struct{}{}
+			continue
+		}
+
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			l.prefixes = append(l.prefixes, prefix.Masked())
+			continue
+		}
+
+		if ip, err := netip.ParseAddr(entry); err == nil {
+			ip = ip.Unmap()
+			l.prefixes = append(l.prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+
+		if domain == "" || strings.ContainsAny(domain, "*/:[] ") {
+			return nil, fmt.Errorf("invalid allowed target: %q", entry)
+		}
+		l.domains[domain] = struct{}{}
+	}
+
+	return &l, nil
+}
+
+// Allows returns whether the target is allowed.
+// IP targets only match addresses and prefixes, and domain targets only match domain names.
+// Sniffed names are not considered, since they come from the client's payload.
+func (l *targetAllowlist) Allows(target conn.Addr) bool {
+	target = target.Normalize()
+
+	if _, ok := l.addrs[target]; ok {
+		return true
+	}
+
+	if target.IsIP() {
+		ip := target.IP()
+		for _, prefix := range l.prefixes {
+			if prefix.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	domain := target.Domain()
+	if _, ok := l.domains[domain]; ok {
+		return true
+	}
+	for _, suffix := range l.suffixes {
+		if strings.HasSuffix(domain, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// TargetAllowlist returns a function that reports whether the user may send requests to a target,
+// or nil if the user is not restricted by a target allowlist.
+//
+// Relays that carry requests to more than one target over a single session,
+// such as UDP session relays, use it to check targets after the session is routed.
+func (r *Router) TargetAllowlist(username string) func(target conn.Addr) bool {
+	l, ok := r.userAllowlists[username]
+	if !ok {
+		return nil
+	}
+	return l.Allows
+}
+
+// AllowsTarget returns whether the user may send requests to the target.
+// Users without a target allowlist may send requests to any target.
+//
+// Proxy servers use it to reject disallowed targets in their protocol's own way before the request is routed.
+func (r *Router) AllowsTarget(username string, target conn.Addr) bool {
+	l, ok := r.userAllowlists[username]
+	return !ok || l.Allows(target)
+}
@@ -0,0 +1,150 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+// ErrClientDraining indicates that the request matched the default route or the user's default route,
+// but the route's client is draining.
+var ErrClientDraining = errors.New("client is draining")
+
+// ClientStatus is the drain status of a client.
+type ClientStatus struct {
+	Client         string `json:"client"`
+	Draining       bool   `json:"draining"`
+	ActiveSessions int64  `json:"activeSessions"`
+}
+
+// clientState tracks the drain status and the number of active sessions of a client.
+type clientState struct {
+	draining       atomic.Bool
+	activeSessions atomic.Int64
+}
+
+// newClientStates returns a map of client names to client states for all TCP and UDP clients.
+// TCP and UDP clients with the same name share the same state.
+//
+// The returned map is not modified once the router is in use, so it is safe for concurrent reads.
+func newClientStates(tcpClientMap map[string]zerocopy.TCPClient, udpClientMap map[string]zerocopy.UDPClient) map[string]*clientState {
+	clients := make(map[string]*clientState, len(tcpClientMap)+len(udpClientMap))
+	for name := range tcpClientMap {
+		clients[name] = &clientState{}
+	}
+	for name := range udpClientMap {
+		if clients[name] == nil {
+			clients[name] = &clientState{}
+		}
+	}
+	return clients
+}
+
+// InheritClientStates makes r share the client states of old for the clients known to both routers,
+// so that drain states are carried over, and sessions opened with old are counted by r until they close.
+//
+// InheritClientStates must be called before r is used.
+func (r *Router) InheritClientStates(old *Router) {
+	for client := range r.clients {
+		if cs := old.clients[client]; cs != nil {
+			r.clients[client] = cs
+		}
+	}
+}
+
+// SetClientDraining marks the named client as draining or not.
+//
+// New requests are not routed to a draining client. Requests that would otherwise
+// match a route to the client fall through to the next matching route.
+// If the default route's client is draining, such requests fail with ErrClientDraining.
+// Existing connections and sessions are not affected.
+func (r *Router) SetClientDraining(client string, draining bool) error {
+	cs := r.clients[client]
+	if cs == nil {
+		return fmt.Errorf("client not found: %s", client)
+	}
+	cs.draining.Store(draining)
+	return nil
+}
+
+// ClientStatus returns the drain status of the named client.
+func (r *Router) ClientStatus(client string) (ClientStatus, error) {
+	cs := r.clients[client]
+	if cs == nil {
+		return ClientStatus{}, fmt.Errorf("client not found: %s", client)
+	}
+	return ClientStatus{
+		Client:         client,
+		Draining:       cs.draining.Load(),
+		ActiveSessions: cs.activeSessions.Load(),
+	}, nil
+}
+
+// ClientStatuses returns the drain status of all clients, sorted by client name.
+func (r *Router) ClientStatuses() []ClientStatus {
+	statuses := make([]ClientStatus, 0, len(r.clients))
+	for client, cs := range r.clients {
+		statuses = append(statuses, ClientStatus{
+			Client:         client,
+			Draining:       cs.draining.Load(),
+			ActiveSessions: cs.activeSessions.Load(),
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Client < statuses[j].Client
+	})
+	return statuses
+}
+
+// SessionOpened records a new TCP connection or UDP session relayed by the named client.
+// Unknown client names are ignored.
+func (r *Router) SessionOpened(client string) {
+	if cs := r.clients[client]; cs != nil {
+		cs.activeSessions.Add(1)
+	}
+}
+
+// SessionClosed records the end of a TCP connection or UDP session relayed by the named client.
+// Unknown client names are ignored.
+func (r *Router) SessionClosed(client string) {
+	if cs := r.clients[client]; cs != nil {
+		cs.activeSessions.Add(-1)
+	}
+}
+
+// ClientAvailable returns whether new requests may be routed to the named client:
+// the client is known, not draining, and not marked down by a health checker.
+func (r *Router) ClientAvailable(client string) bool {
+	cs := r.clients[client]
+	if cs == nil || cs.draining.Load() {
+		return false
+	}
+	for _, h := range r.healthCheckers {
+		if h.Client() == client && !h.Up() {
+			return false
+		}
+	}
+	return true
+}
+
+// draining returns whether the route's client for the network is draining.
+func (r *Router) draining(network protocol, route *Route) bool {
+	var client string
+	switch network {
+	case protocolTCP:
+		if route.tcpClient == nil {
+			return false
+		}
+		client = route.tcpClient.String()
+	case protocolUDP:
+		if route.udpClient == nil {
+			return false
+		}
+		client = route.udpClient.String()
+	}
+	cs := r.clients[client]
+	return cs != nil && cs.draining.Load()
+}
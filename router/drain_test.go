@@ -0,0 +1,111 @@
+package router
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/database64128/shadowsocks-go/direct"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+func TestRouterClientDraining(t *testing.T) {
+	primary := direct.NewTCPClientWithDialer("primary", nil)
+	fallback := direct.NewTCPClientWithDialer("fallback", nil)
+	tcpClientMap := map[string]zerocopy.TCPClient{
+		"primary":  primary,
+		"fallback": fallback,
+	}
+
+	r := Router{
+		logger: zap.NewNop(),
+		routes: []Route{
+			{name: "primary", tcpClient: primary},
+			{name: "default", tcpClient: fallback},
+		},
+		clients: newClientStates(tcpClientMap, nil),
+	}
+
+	c, _, err := r.GetTCPClient(RequestInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != primary {
+		t.Errorf("Got client %s, expected primary", c)
+	}
+
+	r.SessionOpened("primary")
+
+	if err = r.SetClientDraining("primary", true); err != nil {
+		t.Fatal(err)
+	}
+	c, _, err = r.GetTCPClient(RequestInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != fallback {
+		t.Errorf("Got client %s, expected fallback while primary is draining", c)
+	}
+
+	status, err := r.ClientStatus("primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Draining || status.ActiveSessions != 1 {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+
+	r.SessionClosed("primary")
+	if status, _ = r.ClientStatus("primary"); status.ActiveSessions != 0 {
+		t.Errorf("Unexpected status after closing session: %+v", status)
+	}
+
+	if err = r.SetClientDraining("fallback", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = r.GetTCPClient(RequestInfo{}); !errors.Is(err, ErrClientDraining) {
+		t.Errorf("Expected ErrClientDraining, got %v", err)
+	}
+
+	if err = r.SetClientDraining("unknown", true); err == nil {
+		t.Error("Expected error for unknown client")
+	}
+
+	statuses := r.ClientStatuses()
+	if len(statuses) != 2 || statuses[0].Client != "fallback" || statuses[1].Client != "primary" {
+		t.Errorf("Unexpected statuses: %+v", statuses)
+	}
+}
+
+func TestRouterClientAvailable(t *testing.T) {
+	tcpClientMap := map[string]zerocopy.TCPClient{
+		"primary":  direct.NewTCPClientWithDialer("primary", nil),
+		"fallback": direct.NewTCPClientWithDialer("fallback", nil),
+	}
+	health := NewHealthChecker("fallback", nil, 0, 0, 1, zap.NewNop())
+
+	r := Router{
+		logger:         zap.NewNop(),
+		healthCheckers: []*HealthChecker{health},
+		clients:        newClientStates(tcpClientMap, nil),
+	}
+
+	if !r.ClientAvailable("primary") || !r.ClientAvailable("fallback") {
+		t.Error("Clients are unavailable before draining or failing health checks")
+	}
+	if r.ClientAvailable("missing") {
+		t.Error("Unknown client is available")
+	}
+
+	if err := r.SetClientDraining("primary", true); err != nil {
+		t.Fatal(err)
+	}
+	if r.ClientAvailable("primary") {
+		t.Error("Draining client is available")
+	}
+
+	health.down.Store(true)
+	if r.ClientAvailable("fallback") {
+		t.Error("Unhealthy client is available")
+	}
+}
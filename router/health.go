@@ -0,0 +1,374 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultHealthCheckInterval = 30 * time.Second
+	defaultHealthCheckTimeout  = 5 * time.Second
+)
+
+var errHealthCheckTimeout = errors.New("health check probe timed out")
+
+// HealthCheckConfig configures active health checking for a client.
+type HealthCheckConfig struct {
+	// Client is the name of the client to check. Must not be empty.
+	Client string `json:"client"`
+
+	// Probe is the type of probe to run.
+	//
+	//   - "tcp": Connect to Address with a plain TCP dialer. Use the client's endpoint as Address.
+	//   - "dial": Dial Address through the client. This exercises the client's protocol handshake.
+	//   - "udp": Send a DNS query to Address through the client's UDP session, and wait for any reply.
+	//     Address must be a DNS server. Use this probe for clients only used by UDP routes.
+	//
+	// The "tcp" and "dial" probes only affect the client's TCP routes,
+	// and the "udp" probe only affects the client's UDP routes.
+	Probe string `json:"probe"`
+
+	// Address is the probe target. Must not be empty.
+	Address conn.Addr `json:"address"`
+
+	// IntervalSec is the time between two consecutive probes in seconds.
+	// If zero, the default interval of 30 seconds is used.
+	IntervalSec int `json:"intervalSec"`
+
+	// TimeoutSec is the probe timeout in seconds.
+	// If zero, the default timeout of 5 seconds is used.
+	TimeoutSec int `json:"timeoutSec"`
+
+	// FailureThreshold is the number of consecutive failed probes required to mark the client as down.
+	// If zero, a single failed probe marks the client as down.
+	FailureThreshold int `json:"failureThreshold"`
+}
+
+// HealthChecker creates a health checker from the HealthCheckConfig.
+func (hc *HealthCheckConfig) HealthChecker(tcpClientMap map[string]zerocopy.TCPClient, udpClientMap map[string]zerocopy.UDPClient, logger *zap.Logger) (*HealthChecker, error) {
+	if hc.Client == "" {
+		return nil, errors.New("health check client name cannot be empty")
+	}
+	if hc.Address == (conn.Addr{}) {
+		return nil, fmt.Errorf("health check address cannot be empty: %s", hc.Client)
+	}
+
+	var (
+		probe   func(timeout time.Duration) error
+		network = protocolTCP
+	)
+
+	switch hc.Probe {
+	case "tcp":
+		address := hc.Address.String()
+		probe = func(timeout time.Duration) error {
+			c, err := net.DialTimeout("tcp", address, timeout)
+			if err != nil {
+				return err
+			}
+			return c.Close()
+		}
+
+	case "dial":
+		tcpClient, ok := tcpClientMap[hc.Client]
+		if !ok {
+			return nil, fmt.Errorf("TCP client not found: %s", hc.Client)
+		}
+		dp := dialProber{tcpClient: tcpClient, targetAddr: hc.Address}
+		probe = dp.probe
+
+	case "udp":
+		udpClient, ok := udpClientMap[hc.Client]
+		if !ok {
+			return nil, fmt.Errorf("UDP client not found: %s", hc.Client)
+		}
+		targetAddr := hc.Address
+		probe = func(timeout time.Duration) error {
+			return udpProbe(udpClient, targetAddr, timeout)
+		}
+		network = protocolUDP
+
+	default:
+		return nil, fmt.Errorf("invalid health check probe: %s", hc.Probe)
+	}
+
+	interval := defaultHealthCheckInterval
+	if hc.IntervalSec > 0 {
+		interval = time.Duration(hc.IntervalSec) * time.Second
+	}
+
+	timeout := defaultHealthCheckTimeout
+	if hc.TimeoutSec > 0 {
+		timeout = time.Duration(hc.TimeoutSec) * time.Second
+	}
+
+	failureThreshold := hc.FailureThreshold
+	if failureThreshold <= 0 {
+		failureThreshold = 1
+	}
+
+	h := NewHealthChecker(hc.Client, probe, interval, timeout, failureThreshold, logger)
+	h.network = network
+	return h, nil
+}
+
+// dialProber dials targetAddr through tcpClient and closes the connection.
+//
+// TCPClient.Dial does not take a timeout, so the dial is run in a separate goroutine.
+// If the dial does not finish in time, the connection is closed when it eventually returns.
+// At most one dial is in flight: if the previous dial timed out and has not returned,
+// the next probe waits for it instead of starting a new one.
+type dialProber struct {
+	tcpClient  zerocopy.TCPClient
+	targetAddr conn.Addr
+
+	// pending receives the result of the in-flight dial, or is nil if there is none.
+	// It is only accessed by the probe loop.
+	pending chan error
+}
+
+func (p *dialProber) probe(timeout time.Duration) error {
+	if p.pending == nil {
+		errCh := make(chan error, 1)
+		p.pending = errCh
+
+		go func() {
+			tc, _, err := p.tcpClient.Dial(p.targetAddr, nil)
+			if err == nil {
+				err = tc.Close()
+			}
+			errCh <- err
+		}()
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-p.pending:
+		p.pending = nil
+		return err
+	case <-timer.C:
+		return errHealthCheckTimeout
+	}
+}
+
+// udpProbe sends a DNS query to targetAddr through a new session of udpClient,
+// and returns nil when a packet is received and unpacked by the session within timeout.
+// The reply is not parsed.
+func udpProbe(udpClient zerocopy.UDPClient, targetAddr conn.Addr, timeout time.Duration) error {
+	clientInfo, packer, unpacker, err := udpClient.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create UDP client session: %w", err)
+	}
+	if clientInfo.Closer != nil {
+		defer clientInfo.Closer.Close()
+	}
+
+	udpConn, err := conn.ListenUDPOnInterface("udp", clientInfo.Netns, clientInfo.Interface, clientInfo.LocalPortRange, false, clientInfo.Fwmark)
+	if err != nil {
+		return err
+	}
+	defer udpConn.Close()
+
+	if err = udpConn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	frontHeadroom := packer.FrontHeadroom()
+	b := make([]byte, frontHeadroom, clientInfo.MaxPacketSize)
+	q := dnsmessage.NewBuilder(b, dnsmessage.Header{RecursionDesired: true})
+	if err = q.StartQuestions(); err != nil {
+		return err
+	}
+	if err = q.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName("."),
+		Type:  dnsmessage.TypeNS,
+		Class: dnsmessage.ClassINET,
+	}); err != nil {
+		return err
+	}
+	b, err = q.Finish()
+	if err != nil {
+		return err
+	}
+	payloadLen := len(b) - frontHeadroom
+	b = b[:cap(b)]
+
+	destAddrPort, packetStart, packetLen, err := packer.PackInPlace(b, targetAddr, frontHeadroom, payloadLen)
+	if err != nil {
+		return fmt.Errorf("failed to pack probe packet: %w", err)
+	}
+	if _, err = udpConn.WriteToUDPAddrPort(b[packetStart:packetStart+packetLen], destAddrPort); err != nil {
+		return err
+	}
+
+	for {
+		n, _, flags, packetSourceAddrPort, err := udpConn.ReadMsgUDPAddrPort(b, nil)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return errHealthCheckTimeout
+			}
+			return err
+		}
+		if err = conn.ParseFlagsForError(flags); err != nil {
+			return err
+		}
+
+		// Ignore packets that fail to unpack, such as stray packets from other sources.
+		if _, _, _, err = unpacker.UnpackInPlace(b, packetSourceAddrPort, 0, n); err == nil {
+			return nil
+		}
+	}
+}
+
+// HealthStatus is a snapshot of a client's health check results.
+type HealthStatus struct {
+	Client              string    `json:"client"`
+	Up                  bool      `json:"up"`
+	LastChecked         time.Time `json:"lastChecked"`
+	LastError           string    `json:"lastError,omitempty"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+}
+
+// HealthChecker periodically probes a client and marks it up or down.
+//
+// A client is considered up until proven otherwise.
+type HealthChecker struct {
+	client           string
+	network          protocol
+	probe            func(timeout time.Duration) error
+	interval         time.Duration
+	timeout          time.Duration
+	failureThreshold int
+	logger           *zap.Logger
+
+	// down is read by the router on every route match.
+	down atomic.Bool
+
+	// mu protects status.
+	mu     sync.Mutex
+	status HealthStatus
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewHealthChecker returns a new health checker for the named client's TCP routes.
+//
+// probe is called on every interval with the probe timeout, and returns nil if the client is healthy.
+func NewHealthChecker(client string, probe func(timeout time.Duration) error, interval, timeout time.Duration, failureThreshold int, logger *zap.Logger) *HealthChecker {
+	return &HealthChecker{
+		client:           client,
+		probe:            probe,
+		interval:         interval,
+		timeout:          timeout,
+		failureThreshold: failureThreshold,
+		logger:           logger,
+		status: HealthStatus{
+			Client: client,
+			Up:     true,
+		},
+	}
+}
+
+// Client returns the name of the checked client.
+func (h *HealthChecker) Client() string {
+	return h.client
+}
+
+// Up returns whether the client is considered healthy.
+func (h *HealthChecker) Up() bool {
+	return !h.down.Load()
+}
+
+// Status returns a snapshot of the health check results.
+func (h *HealthChecker) Status() HealthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.status
+}
+
+// Start starts the probe loop. The first probe is run immediately.
+func (h *HealthChecker) Start() {
+	h.done = make(chan struct{})
+	h.wg.Add(1)
+
+	go func() {
+		defer h.wg.Done()
+
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+
+		for {
+			h.Check()
+
+			select {
+			case <-ticker.C:
+			case <-h.done:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the probe loop and waits for it to exit.
+func (h *HealthChecker) Stop() {
+	if h.done == nil {
+		return
+	}
+	close(h.done)
+	h.wg.Wait()
+	h.done = nil
+}
+
+// Check runs the probe once and updates the health status.
+func (h *HealthChecker) Check() {
+	err := h.probe(h.timeout)
+	now := time.Now()
+
+	h.mu.Lock()
+	wasUp := h.status.Up
+	h.status.LastChecked = now
+	if err != nil {
+		h.status.LastError = err.Error()
+		h.status.ConsecutiveFailures++
+		if h.status.ConsecutiveFailures >= h.failureThreshold {
+			h.status.Up = false
+		}
+	} else {
+		h.status.LastError = ""
+		h.status.ConsecutiveFailures = 0
+		h.status.Up = true
+	}
+	isUp := h.status.Up
+	h.down.Store(!isUp)
+	h.mu.Unlock()
+
+	switch {
+	case wasUp && !isUp:
+		h.logger.Warn("Health check marked client as down",
+			zap.String("client", h.client),
+			zap.Error(err),
+		)
+	case !wasUp && isUp:
+		h.logger.Info("Health check marked client as up", zap.String("client", h.client))
+	case err != nil:
+		if ce := h.logger.Check(zap.DebugLevel, "Health check probe failed"); ce != nil {
+			ce.Write(
+				zap.String("client", h.client),
+				zap.Error(err),
+			)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package router
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/direct"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+func TestHealthCheckerFailureThreshold(t *testing.T) {
+	var probeErr error
+	h := NewHealthChecker("test", func(time.Duration) error { return probeErr }, time.Second, time.Second, 2, zap.NewNop())
+
+	if !h.Up() {
+		t.Fatal("Expected client to be up before the first probe")
+	}
+
+	probeErr = errors.New("probe failed")
+	h.Check()
+	if !h.Up() {
+		t.Error("Expected client to stay up below the failure threshold")
+	}
+
+	h.Check()
+	if h.Up() {
+		t.Error("Expected client to be down after reaching the failure threshold")
+	}
+	if status := h.Status(); status.Up || status.ConsecutiveFailures != 2 || status.LastError == "" {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+
+	probeErr = nil
+	h.Check()
+	if !h.Up() {
+		t.Error("Expected client to be up after a successful probe")
+	}
+	if status := h.Status(); !status.Up || status.ConsecutiveFailures != 0 || status.LastError != "" {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+}
+
+func TestHealthCheckConfigValidation(t *testing.T) {
+	tcpClientMap := map[string]zerocopy.TCPClient{
+		"tcp": direct.NewTCPClientWithDialer("tcp", nil),
+	}
+	udpClientMap := map[string]zerocopy.UDPClient{
+		"udp": direct.NewUDPClient("udp", 1500, 0, 0),
+	}
+	addr := conn.MustAddrFromDomainPort("example.com", 53)
+
+	for _, c := range []struct {
+		name   string
+		config HealthCheckConfig
+		ok     bool
+	}{
+		{"EmptyClient", HealthCheckConfig{Probe: "tcp", Address: addr}, false},
+		{"EmptyAddress", HealthCheckConfig{Client: "tcp", Probe: "tcp"}, false},
+		{"InvalidProbe", HealthCheckConfig{Client: "tcp", Probe: "icmp", Address: addr}, false},
+		{"DialMissingTCPClient", HealthCheckConfig{Client: "udp", Probe: "dial", Address: addr}, false},
+		{"UDPMissingUDPClient", HealthCheckConfig{Client: "tcp", Probe: "udp", Address: addr}, false},
+		{"TCP", HealthCheckConfig{Client: "tcp", Probe: "tcp", Address: addr}, true},
+		{"Dial", HealthCheckConfig{Client: "tcp", Probe: "dial", Address: addr}, true},
+		{"UDP", HealthCheckConfig{Client: "udp", Probe: "udp", Address: addr}, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := c.config.HealthChecker(tcpClientMap, udpClientMap, zap.NewNop())
+			if ok := err == nil; ok != c.ok {
+				t.Errorf("HealthChecker() returned error %v, expected ok %v", err, c.ok)
+			}
+		})
+	}
+}
+
+// blockingTCPClient is a TCP client whose Dial blocks until release is closed.
+type blockingTCPClient struct {
+	zerocopy.TCPClient
+	dials   atomic.Int32
+	release chan struct{}
+}
+
+var errBlockingDial = errors.New("blocking dial released")
+
+func (c *blockingTCPClient) Dial(targetAddr conn.Addr, payload []byte) (net.Conn, zerocopy.ReadWriter, error) {
+	c.dials.Add(1)
+	<-c.release
+	return nil, nil, errBlockingDial
+}
+
+func TestDialProbeSingleInFlightDial(t *testing.T) {
+	c := &blockingTCPClient{
+		TCPClient: direct.NewTCPClientWithDialer("blocking", nil),
+		release:   make(chan struct{}),
+	}
+	p := dialProber{tcpClient: c, targetAddr: conn.MustAddrFromDomainPort("example.com", 443)}
+
+	for i := 0; i < 3; i++ {
+		if err := p.probe(10 * time.Millisecond); err != errHealthCheckTimeout {
+			t.Fatalf("Probe %d returned %v, expected %v", i, err, errHealthCheckTimeout)
+		}
+	}
+	if dials := c.dials.Load(); dials != 1 {
+		t.Errorf("Got %d dials, expected 1 while the first dial is in flight", dials)
+	}
+
+	close(c.release)
+	if err := p.probe(5 * time.Second); err != errBlockingDial {
+		t.Errorf("Probe returned %v, expected the result of the in-flight dial %v", err, errBlockingDial)
+	}
+	if err := p.probe(5 * time.Second); err != errBlockingDial {
+		t.Errorf("Probe returned %v, expected %v", err, errBlockingDial)
+	}
+	if dials := c.dials.Load(); dials != 2 {
+		t.Errorf("Got %d dials, expected 2 after the first dial returned", dials)
+	}
+}
+
+func TestUDPProbe(t *testing.T) {
+	echoConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoConn.Close()
+
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addrPort, err := echoConn.ReadFromUDPAddrPort(b)
+			if err != nil {
+				return
+			}
+			if _, err = echoConn.WriteToUDPAddrPort(b[:n], addrPort); err != nil {
+				return
+			}
+		}
+	}()
+
+	silentConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silentConn.Close()
+
+	udpClient := direct.NewUDPClient("direct", 1500, 0, 0)
+
+	echoAddr := conn.AddrFromIPPort(echoConn.LocalAddr().(*net.UDPAddr).AddrPort())
+	if err = udpProbe(udpClient, echoAddr, 5*time.Second); err != nil {
+		t.Errorf("Probe to echo server failed: %v", err)
+	}
+
+	silentAddr := conn.AddrFromIPPort(silentConn.LocalAddr().(*net.UDPAddr).AddrPort())
+	if err = udpProbe(udpClient, silentAddr, 100*time.Millisecond); err != errHealthCheckTimeout {
+		t.Errorf("Probe to silent server returned %v, expected %v", err, errHealthCheckTimeout)
+	}
+}
+
+func TestRouterSkipsUnhealthyRoute(t *testing.T) {
+	tcpClientMap := map[string]zerocopy.TCPClient{
+		"primary":  direct.NewTCPClientWithDialer("primary", nil),
+		"fallback": direct.NewTCPClientWithDialer("fallback", nil),
+	}
+	udpClientMap := map[string]zerocopy.UDPClient{
+		"primary":  direct.NewUDPClient("primary", 1500, 0, 0),
+		"fallback": direct.NewUDPClient("fallback", 1500, 0, 0),
+	}
+	addr := conn.MustAddrFromDomainPort("example.com", 53)
+
+	rc := Config{
+		DefaultTCPClientName: "fallback",
+		DefaultUDPClientName: "fallback",
+		Routes: []RouteConfig{
+			{Name: "primary", Client: "primary"},
+		},
+		HealthChecks: []HealthCheckConfig{
+			{Client: "primary", Probe: "dial", Address: addr},
+			{Client: "primary", Probe: "udp", Address: addr},
+		},
+	}
+	r, err := rc.Router(zap.NewNop(), nil, nil, tcpClientMap, udpClientMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpHealth, udpHealth := r.healthCheckers[0], r.healthCheckers[1]
+
+	check := func(expectedTCP, expectedUDP string) {
+		t.Helper()
+		tc, _, err := r.GetTCPClient(RequestInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.String() != expectedTCP {
+			t.Errorf("Got TCP client %s, expected %s", tc, expectedTCP)
+		}
+		uc, _, err := r.GetUDPClient(RequestInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uc.String() != expectedUDP {
+			t.Errorf("Got UDP client %s, expected %s", uc, expectedUDP)
+		}
+	}
+
+	check("primary", "primary")
+
+	tcpHealth.down.Store(true)
+	check("fallback", "primary")
+
+	udpHealth.down.Store(true)
+	check("fallback", "fallback")
+
+	tcpHealth.down.Store(false)
+	check("primary", "fallback")
+}
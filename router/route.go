@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/netip"
+	"time"
 
 	"github.com/database64128/shadowsocks-go/conn"
 	"github.com/database64128/shadowsocks-go/dns"
@@ -107,6 +108,11 @@ type RouteConfig struct {
 
 	// Invert destination port matching logic. Match requests to all ports except those in ToPorts.
 	InvertToPorts bool `json:"invertToPorts"`
+
+	// Disable TCP_NODELAY on both legs of each matched TCP connection after the handshake,
+	// so that small writes are coalesced by Nagle's algorithm.
+	// TCP_NODELAY is enabled by default, which favors latency over efficiency.
+	DisableTCPNoDelay bool `json:"disableTCPNoDelay"`
 }
 
 // Route creates a route from the RouteConfig.
@@ -148,7 +154,12 @@ func (rc *RouteConfig) Route(geoip *geoip2.Reader, logger *zap.Logger, resolvers
 		resolvers = []*dns.Resolver{resolver}
 	}
 
-	route := Route{name: rc.Name}
+	route := Route{
+		name: rc.Name,
+		tcpConnPolicy: TCPConnPolicy{
+			DisableNoDelay: rc.DisableTCPNoDelay,
+		},
+	}
 
 	switch rc.Network {
 	case "":
@@ -347,12 +358,43 @@ func (rc *RouteConfig) Route(geoip *geoip2.Reader, logger *zap.Logger, resolvers
 	return route, nil
 }
 
+// TCPConnPolicy controls how a TCP connection is relayed.
+type TCPConnPolicy struct {
+	// DisableNoDelay disables TCP_NODELAY on both the client and the remote connection.
+	DisableNoDelay bool
+}
+
+// UDPSessionPolicy controls how a UDP session is relayed.
+type UDPSessionPolicy struct {
+	// Route is the name of the route that selected the session's client.
+	Route string
+
+	// BandwidthLimit is the maximum number of payload bytes per second in each direction.
+	// Zero means unlimited.
+	BandwidthLimit uint64
+
+	// MaxLifetime is the maximum duration a session may exist, regardless of activity.
+	// Zero means unlimited.
+	MaxLifetime time.Duration
+
+	// Fwmark overrides the client's fwmark on the session's outbound socket.
+	// Zero means the client's fwmark is used.
+	Fwmark int
+}
+
 // Route controls which client a request is routed to.
 type Route struct {
-	name      string
-	criteria  []Criterion
-	tcpClient zerocopy.TCPClient
-	udpClient zerocopy.UDPClient
+	name          string
+	criteria      []Criterion
+	tcpClient     zerocopy.TCPClient
+	udpClient     zerocopy.UDPClient
+	tcpConnPolicy TCPConnPolicy
+	tcpHealth     *HealthChecker
+	udpHealth     *HealthChecker
+
+	// final is true for user default routes. Like the global default route,
+	// a final route ends matching, even when its client is unavailable.
+	final bool
 }
 
 // String returns the name of the route.
@@ -360,6 +402,28 @@ func (r *Route) String() string {
 	return r.name
 }
 
+// setHealthChecker attaches h to the route for the network checked by h.
+func (r *Route) setHealthChecker(h *HealthChecker) {
+	switch h.network {
+	case protocolTCP:
+		r.tcpHealth = h
+	case protocolUDP:
+		r.udpHealth = h
+	}
+}
+
+// unhealthy returns whether the route's client for the network has been marked down by a health checker.
+func (r *Route) unhealthy(network protocol) bool {
+	var h *HealthChecker
+	switch network {
+	case protocolTCP:
+		h = r.tcpHealth
+	case protocolUDP:
+		h = r.udpHealth
+	}
+	return h != nil && !h.Up()
+}
+
 // AddCriterion adds a criterion to the route.
 func (r *Route) AddCriterion(criterion Criterion, invert bool) {
 	if invert {
@@ -369,9 +433,9 @@ func (r *Route) AddCriterion(criterion Criterion, invert bool) {
 }
 
 // Match returns whether the request matches the route.
-func (r *Route) Match(network protocol, server string, sourceAddrPort netip.AddrPort, targetAddr conn.Addr) (bool, error) {
+func (r *Route) Match(network protocol, requestInfo RequestInfo) (bool, error) {
 	for _, criterion := range r.criteria {
-		met, err := criterion.Meet(network, server, sourceAddrPort, targetAddr)
+		met, err := criterion.Meet(network, requestInfo)
 		if !met {
 			return false, err
 		}
@@ -395,10 +459,56 @@ func (r *Route) UDPClient() (zerocopy.UDPClient, error) {
 	return r.udpClient, nil
 }
 
+// TCPConnPolicy returns the policy for TCP connections matched by the route.
+func (r *Route) TCPConnPolicy() TCPConnPolicy {
+	return r.tcpConnPolicy
+}
+
+// RequestInfo contains information about a TCP request or the first packet of a UDP session.
+type RequestInfo struct {
+	// Server is the name of the server that received the request.
+	Server string
+
+	// SourceAddrPort is the address of the client.
+	SourceAddrPort netip.AddrPort
+
+	// TargetAddr is the address requested by the client.
+	TargetAddr conn.Addr
+
+	// SniffedName is the domain name sniffed from the initial payload,
+	// such as the TLS ClientHello SNI or the HTTP Host header.
+	// It is empty if sniffing is disabled or no name was found.
+	SniffedName string
+
+	// Username is the name of the user the client authenticated as.
+	// It is empty for anonymous clients.
+	Username string
+
+	// PreferredFamily is the address family to prefer when resolving a domain target.
+	// Servers that honor the client's connection family set it to the family of SourceAddrPort.
+	// It is conn.AddrFamilyAny if the server has no preference.
+	PreferredFamily conn.AddrFamily
+}
+
+// TargetDomain returns the domain name of the target address.
+// If the target address is an IP address, the sniffed name is returned instead.
+func (ri RequestInfo) TargetDomain() string {
+	if ri.TargetAddr.IsIP() {
+		return ri.SniffedName
+	}
+	return ri.TargetAddr.Domain()
+}
+
+// SourceAddr returns the address of the client as a normalized [conn.Addr],
+// so IPv4 clients received on dual-stack sockets match rules written with IPv4 addresses.
+func (ri RequestInfo) SourceAddr() conn.Addr {
+	return conn.AddrFromIPPort(ri.SourceAddrPort).Normalize()
+}
+
 // Criterion is used by [Route] to determine whether a request matches the route.
 type Criterion interface {
 	// Meet returns whether the request meets the criterion.
-	Meet(network protocol, server string, sourceAddrPort netip.AddrPort, targetAddr conn.Addr) (bool, error)
+	Meet(network protocol, requestInfo RequestInfo) (bool, error)
 }
 
 // InvertedCriterion is like the inner criterion, but inverted.
@@ -407,8 +517,8 @@ type InvertedCriterion struct {
 }
 
 // Meet implements the Criterion Meet method.
-func (c InvertedCriterion) Meet(network protocol, server string, sourceAddrPort netip.AddrPort, targetAddr conn.Addr) (bool, error) {
-	met, err := c.Inner.Meet(network, server, sourceAddrPort, targetAddr)
+func (c InvertedCriterion) Meet(network protocol, requestInfo RequestInfo) (bool, error) {
+	met, err := c.Inner.Meet(network, requestInfo)
 	if err != nil {
 		return false, err
 	}
@@ -429,9 +539,9 @@ func (g *CriterionGroupOR) AddCriterion(criterion Criterion, invert bool) {
 }
 
 // Meet returns whether the request meets any of the criteria.
-func (g *CriterionGroupOR) Meet(network protocol, server string, sourceAddrPort netip.AddrPort, targetAddr conn.Addr) (bool, error) {
+func (g *CriterionGroupOR) Meet(network protocol, requestInfo RequestInfo) (bool, error) {
 	for _, criterion := range g.Criteria {
-		met, err := criterion.Meet(network, server, sourceAddrPort, targetAddr)
+		met, err := criterion.Meet(network, requestInfo)
 		if err != nil {
 			return false, err
 		}
@@ -480,7 +590,7 @@ const (
 type NetworkTCPCriterion struct{}
 
 // Meet implements the Criterion Meet method.
-func (NetworkTCPCriterion) Meet(network protocol, server string, sourceAddrPort netip.AddrPort, targetAddr conn.Addr) (bool, error) {
+func (NetworkTCPCriterion) Meet(network protocol, requestInfo RequestInfo) (bool, error) {
 	return network == protocolTCP, nil
 }
 
@@ -488,7 +598,7 @@ func (NetworkTCPCriterion) Meet(network protocol, server string, sourceAddrPort
 type NetworkUDPCriterion struct{}
 
 // Meet implements the Criterion Meet method.
-func (NetworkUDPCriterion) Meet(network protocol, server string, sourceAddrPort netip.AddrPort, targetAddr conn.Addr) (bool, error) {
+func (NetworkUDPCriterion) Meet(network protocol, requestInfo RequestInfo) (bool, error) {
 	return network == protocolUDP, nil
 }
 
@@ -496,16 +606,16 @@ func (NetworkUDPCriterion) Meet(network protocol, server string, sourceAddrPort
 type SourceServerCriterion []string
 
 // Meet implements the Criterion Meet method.
-func (c SourceServerCriterion) Meet(network protocol, server string, sourceAddrPort netip.AddrPort, targetAddr conn.Addr) (bool, error) {
-	return slices.Contains(c, server), nil
+func (c SourceServerCriterion) Meet(network protocol, requestInfo RequestInfo) (bool, error) {
+	return slices.Contains(c, requestInfo.Server), nil
 }
 
 // SourceIPCriterion restricts the source IP address.
 type SourceIPCriterion netipx.IPSet
 
 // Meet implements the Criterion Meet method.
-func (c *SourceIPCriterion) Meet(network protocol, server string, sourceAddrPort netip.AddrPort, targetAddr conn.Addr) (bool, error) {
-	return (*netipx.IPSet)(c).Contains(sourceAddrPort.Addr().Unmap()), nil
+func (c *SourceIPCriterion) Meet(network protocol, requestInfo RequestInfo) (bool, error) {
+	return (*netipx.IPSet)(c).Contains(requestInfo.SourceAddr().IP()), nil
 }
 
 // SourceGeoIPCountryCriterion restricts the source IP address by GeoIP country.
@@ -516,27 +626,28 @@ type SourceGeoIPCountryCriterion struct {
 }
 
 // Meet implements the Criterion Meet method.
-func (c SourceGeoIPCountryCriterion) Meet(network protocol, server string, sourceAddrPort netip.AddrPort, targetAddr conn.Addr) (bool, error) {
-	return matchAddrToGeoIPCountries(c.countries, sourceAddrPort.Addr(), c.geoip, c.logger)
+func (c SourceGeoIPCountryCriterion) Meet(network protocol, requestInfo RequestInfo) (bool, error) {
+	return matchAddrToGeoIPCountries(c.countries, requestInfo.SourceAddr().IP(), c.geoip, c.logger)
 }
 
 // SourcePortCriterion restricts the source port.
 type SourcePortCriterion []uint16
 
 // Meet implements the Criterion Meet method.
-func (c SourcePortCriterion) Meet(network protocol, server string, sourceAddrPort netip.AddrPort, targetAddr conn.Addr) (bool, error) {
-	return slices.Contains(c, sourceAddrPort.Port()), nil
+func (c SourcePortCriterion) Meet(network protocol, requestInfo RequestInfo) (bool, error) {
+	return slices.Contains(c, requestInfo.SourceAddr().Port()), nil
 }
 
 // DestDomainCriterion restricts the destination domain.
 type DestDomainCriterion []domainset.DomainSet
 
 // Meet implements the Criterion Meet method.
-func (c DestDomainCriterion) Meet(network protocol, server string, sourceAddrPort netip.AddrPort, targetAddr conn.Addr) (bool, error) {
-	if targetAddr.IsIP() {
+func (c DestDomainCriterion) Meet(network protocol, requestInfo RequestInfo) (bool, error) {
+	domain := requestInfo.TargetDomain()
+	if domain == "" {
 		return false, nil
 	}
-	return matchDomainToDomainSets(c, targetAddr.Domain()), nil
+	return matchDomainToDomainSets(c, domain), nil
 }
 
 // DestDomainExpectedIPCriterion restricts the destination domain and its resolved IP address.
@@ -546,23 +657,23 @@ type DestDomainExpectedIPCriterion struct {
 }
 
 // Meet implements the Criterion Meet method.
-func (c *DestDomainExpectedIPCriterion) Meet(network protocol, server string, sourceAddrPort netip.AddrPort, targetAddr conn.Addr) (bool, error) {
-	met, err := c.destDomainCriterion.Meet(network, server, sourceAddrPort, targetAddr)
+func (c *DestDomainExpectedIPCriterion) Meet(network protocol, requestInfo RequestInfo) (bool, error) {
+	met, err := c.destDomainCriterion.Meet(network, requestInfo)
 	if !met {
 		return false, err
 	}
-	return c.expectedIPCriterion.Meet(network, server, sourceAddrPort, targetAddr)
+	return c.expectedIPCriterion.Meet(network, requestInfo)
 }
 
 // DestIPCriterion restricts the destination IP address.
 type DestIPCriterion netipx.IPSet
 
 // Meet implements the Criterion Meet method.
-func (c *DestIPCriterion) Meet(network protocol, server string, sourceAddrPort netip.AddrPort, targetAddr conn.Addr) (bool, error) {
-	if !targetAddr.IsIP() {
+func (c *DestIPCriterion) Meet(network protocol, requestInfo RequestInfo) (bool, error) {
+	if !requestInfo.TargetAddr.IsIP() {
 		return false, nil
 	}
-	return (*netipx.IPSet)(c).Contains(targetAddr.IP().Unmap()), nil
+	return (*netipx.IPSet)(c).Contains(requestInfo.TargetAddr.IP().Unmap()), nil
 }
 
 // DestResolvedIPCriterion restricts the destination IP address or the destination domain's resolved IP address.
@@ -572,11 +683,11 @@ type DestResolvedIPCriterion struct {
 }
 
 // Meet implements the Criterion Meet method.
-func (c *DestResolvedIPCriterion) Meet(network protocol, server string, sourceAddrPort netip.AddrPort, targetAddr conn.Addr) (bool, error) {
-	if targetAddr.IsIP() {
-		return c.ipSet.Contains(targetAddr.IP().Unmap()), nil
+func (c *DestResolvedIPCriterion) Meet(network protocol, requestInfo RequestInfo) (bool, error) {
+	if requestInfo.TargetAddr.IsIP() {
+		return c.ipSet.Contains(requestInfo.TargetAddr.IP().Unmap()), nil
 	}
-	return matchDomainToIPSet(c.resolvers, targetAddr.Domain(), c.ipSet)
+	return matchDomainToIPSet(c.resolvers, requestInfo.TargetAddr.Domain(), c.ipSet)
 }
 
 // DestGeoIPCountryCriterion restricts the destination IP address by GeoIP country.
@@ -587,11 +698,11 @@ type DestGeoIPCountryCriterion struct {
 }
 
 // Meet implements the Criterion Meet method.
-func (c *DestGeoIPCountryCriterion) Meet(network protocol, server string, sourceAddrPort netip.AddrPort, targetAddr conn.Addr) (bool, error) {
-	if !targetAddr.IsIP() {
+func (c *DestGeoIPCountryCriterion) Meet(network protocol, requestInfo RequestInfo) (bool, error) {
+	if !requestInfo.TargetAddr.IsIP() {
 		return false, nil
 	}
-	return matchAddrToGeoIPCountries(c.countries, targetAddr.IP(), c.geoip, c.logger)
+	return matchAddrToGeoIPCountries(c.countries, requestInfo.TargetAddr.IP(), c.geoip, c.logger)
 }
 
 // DestResolvedGeoIPCountryCriterion restricts the destination IP address or the destination domain's resolved IP address by GeoIP country.
@@ -603,19 +714,19 @@ type DestResolvedGeoIPCountryCriterion struct {
 }
 
 // Meet implements the Criterion Meet method.
-func (c *DestResolvedGeoIPCountryCriterion) Meet(network protocol, server string, sourceAddrPort netip.AddrPort, targetAddr conn.Addr) (bool, error) {
-	if targetAddr.IsIP() {
-		return matchAddrToGeoIPCountries(c.countries, targetAddr.IP(), c.geoip, c.logger)
+func (c *DestResolvedGeoIPCountryCriterion) Meet(network protocol, requestInfo RequestInfo) (bool, error) {
+	if requestInfo.TargetAddr.IsIP() {
+		return matchAddrToGeoIPCountries(c.countries, requestInfo.TargetAddr.IP(), c.geoip, c.logger)
 	}
-	return matchDomainToGeoIPCountries(c.resolvers, targetAddr.Domain(), c.countries, c.geoip, c.logger)
+	return matchDomainToGeoIPCountries(c.resolvers, requestInfo.TargetAddr.Domain(), c.countries, c.geoip, c.logger)
 }
 
 // DestPortCriterion restricts the destination port.
 type DestPortCriterion []uint16
 
 // Meet implements the Criterion Meet method.
-func (c DestPortCriterion) Meet(network protocol, server string, sourceAddrPort netip.AddrPort, targetAddr conn.Addr) (bool, error) {
-	return slices.Contains(c, targetAddr.Port()), nil
+func (c DestPortCriterion) Meet(network protocol, requestInfo RequestInfo) (bool, error) {
+	return slices.Contains(c, requestInfo.TargetAddr.Port()), nil
 }
 
 func matchAddrToGeoIPCountries(countries []string, addr netip.Addr, geoip *geoip2.Reader, logger *zap.Logger) (bool, error) {
@@ -0,0 +1,71 @@
+package router
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"go4.org/netipx"
+)
+
+func TestRequestInfoTargetDomain(t *testing.T) {
+	ipTarget := conn.AddrFromIPPort(netip.AddrPortFrom(netip.AddrFrom4([4]byte{192, 0, 2, 1}), 443))
+	domainTarget := conn.MustAddrFromDomainPort("example.com", 443)
+
+	for _, c := range []struct {
+		requestInfo RequestInfo
+		domain      string
+	}{
+		{RequestInfo{TargetAddr: domainTarget}, "example.com"},
+		{RequestInfo{TargetAddr: domainTarget, SniffedName: "example.org"}, "example.com"},
+		{RequestInfo{TargetAddr: ipTarget, SniffedName: "example.org"}, "example.org"},
+		{RequestInfo{TargetAddr: ipTarget}, ""},
+	} {
+		if domain := c.requestInfo.TargetDomain(); domain != c.domain {
+			t.Errorf("%+v.TargetDomain() returned %q, expected %q", c.requestInfo, domain, c.domain)
+		}
+	}
+}
+
+func TestRequestInfoSourceAddr(t *testing.T) {
+	for _, c := range []struct {
+		sourceAddrPort netip.AddrPort
+		expected       netip.AddrPort
+	}{
+		{netip.MustParseAddrPort("192.0.2.1:1080"), netip.MustParseAddrPort("192.0.2.1:1080")},
+		{netip.MustParseAddrPort("[::ffff:192.0.2.1]:1080"), netip.MustParseAddrPort("192.0.2.1:1080")},
+		{netip.MustParseAddrPort("[2001:db8::1]:1080"), netip.MustParseAddrPort("[2001:db8::1]:1080")},
+	} {
+		addr := RequestInfo{SourceAddrPort: c.sourceAddrPort}.SourceAddr()
+		if !addr.IsIP() || addr.IPPort() != c.expected {
+			t.Errorf("SourceAddr() of %s returned %s, expected %s", c.sourceAddrPort, addr, c.expected)
+		}
+	}
+}
+
+func TestSourceCriteriaMatchMappedAddr(t *testing.T) {
+	var sb netipx.IPSetBuilder
+	sb.Add(netip.MustParseAddr("192.0.2.1"))
+	ipSet, err := sb.IPSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requestInfo := RequestInfo{SourceAddrPort: netip.MustParseAddrPort("[::ffff:192.0.2.1]:1080")}
+
+	for _, c := range []struct {
+		name      string
+		criterion Criterion
+	}{
+		{"SourceIPCriterion", (*SourceIPCriterion)(ipSet)},
+		{"SourcePortCriterion", SourcePortCriterion{1080}},
+	} {
+		met, err := c.criterion.Meet(protocolUDP, requestInfo)
+		if err != nil {
+			t.Fatalf("%s.Meet() returned error: %v", c.name, err)
+		}
+		if !met {
+			t.Errorf("%s did not match %s", c.name, requestInfo.SourceAddrPort)
+		}
+	}
+}
@@ -1,10 +1,11 @@
 package router
 
 import (
+	"errors"
 	"fmt"
-	"net/netip"
+	"sync/atomic"
+	"time"
 
-	"github.com/database64128/shadowsocks-go/conn"
 	"github.com/database64128/shadowsocks-go/dns"
 	"github.com/database64128/shadowsocks-go/domainset"
 	"github.com/database64128/shadowsocks-go/prefixset"
@@ -16,12 +17,102 @@ import (
 
 // Config is the configuration for a Router.
 type Config struct {
-	DefaultTCPClientName  string             `json:"defaultTCPClientName"`
-	DefaultUDPClientName  string             `json:"defaultUDPClientName"`
-	GeoLite2CountryDbPath string             `json:"geoLite2CountryDbPath"`
-	DomainSets            []domainset.Config `json:"domainSets"`
-	PrefixSets            []prefixset.Config `json:"prefixSets"`
-	Routes                []RouteConfig      `json:"routes"`
+	DefaultTCPClientName  string              `json:"defaultTCPClientName"`
+	DefaultUDPClientName  string              `json:"defaultUDPClientName"`
+	GeoLite2CountryDbPath string              `json:"geoLite2CountryDbPath"`
+	DomainSets            []domainset.Config  `json:"domainSets"`
+	PrefixSets            []prefixset.Config  `json:"prefixSets"`
+	Routes                []RouteConfig       `json:"routes"`
+	HealthChecks          []HealthCheckConfig `json:"healthChecks"`
+	Users                 []UserPolicyConfig  `json:"users"`
+}
+
+// UserPolicyConfig configures policies for requests from an authenticated user.
+type UserPolicyConfig struct {
+	// Username is the name of the user.
+	Username string `json:"username"`
+
+	// UDPFwmark is set on the outbound sockets of the user's UDP sessions,
+	// in place of the fwmark of the routed client. If zero, the client's fwmark is used.
+	UDPFwmark int `json:"udpFwmark"`
+
+	// UDPBandwidthLimit limits each of the user's UDP sessions to this many payload bytes per second in each direction.
+	// Packets over the limit are delayed, not dropped. If zero, the bandwidth is not limited.
+	//
+	// Currently only applies to Shadowsocks 2022 UDP sessions.
+	UDPBandwidthLimit uint64 `json:"udpBandwidthLimit"`
+
+	// UDPSessionMaxLifetimeSec tears down each of the user's UDP sessions after it has existed
+	// for this many seconds, regardless of activity. The client re-establishes the session
+	// with its next packet. If zero, sessions live until idle.
+	//
+	// Currently only applies to Shadowsocks 2022 UDP sessions.
+	UDPSessionMaxLifetimeSec int `json:"udpSessionMaxLifetimeSec"`
+
+	// Routes are matched against the user's requests before global routes.
+	// Requests that match none of them are matched against global routes.
+	Routes []RouteConfig `json:"routes"`
+
+	// DefaultTCPClientName and DefaultUDPClientName, if set, route the user's requests
+	// that match none of the user's routes to the named client, without consulting global routes.
+	// Like the global default, the user's default client is used even when a health checker marks it down,
+	// and requests fail with ErrClientDraining when it is draining.
+	// Use "reject" to reject such requests. If empty, global routes and the global default apply.
+	DefaultTCPClientName string `json:"defaultTCPClientName"`
+	DefaultUDPClientName string `json:"defaultUDPClientName"`
+
+	// AllowedTargets, if not empty, restricts the user's requests to the listed targets.
+	// Requests to other targets fail with ErrTargetNotAllowed before routes are matched.
+	// Each entry is an address with a port ("example.com:443", "192.0.2.1:443"),
+	// an IP address or prefix ("192.0.2.1", "2001:db8::/32"), a domain name ("example.com"),
+	// or a wildcard domain name matching subdomains ("*.example.com").
+	// IP targets are never resolved to match domain names, nor are domain targets resolved to match IP prefixes.
+	AllowedTargets []string `json:"allowedTargets"`
+}
+
+// userRoutes returns the routes to match the user's requests against,
+// or nil if the user has no routes of their own.
+// globalRoutes must end with the global default route, which also ends the returned routes.
+func (uc *UserPolicyConfig) userRoutes(globalRoutes []Route, routeFunc func(*RouteConfig) (Route, error), tcpClientMap map[string]zerocopy.TCPClient, udpClientMap map[string]zerocopy.UDPClient) ([]Route, error) {
+	if len(uc.Routes) == 0 && uc.DefaultTCPClientName == "" && uc.DefaultUDPClientName == "" {
+		return nil, nil
+	}
+
+	routes := make([]Route, 0, len(uc.Routes)+2+len(globalRoutes))
+
+	for i := range uc.Routes {
+		route, err := routeFunc(&uc.Routes[i])
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %w", uc.Username, err)
+		}
+		routes = append(routes, route)
+	}
+
+	if uc.DefaultTCPClientName != "" {
+		route := Route{name: "user default", final: true}
+		route.AddCriterion(NetworkTCPCriterion{}, false)
+		if uc.DefaultTCPClientName != "reject" {
+			route.tcpClient = tcpClientMap[uc.DefaultTCPClientName]
+			if route.tcpClient == nil {
+				return nil, fmt.Errorf("user %s: default TCP client not found: %s", uc.Username, uc.DefaultTCPClientName)
+			}
+		}
+		routes = append(routes, route)
+	}
+
+	if uc.DefaultUDPClientName != "" {
+		route := Route{name: "user default", final: true}
+		route.AddCriterion(NetworkUDPCriterion{}, false)
+		if uc.DefaultUDPClientName != "reject" {
+			route.udpClient = udpClientMap[uc.DefaultUDPClientName]
+			if route.udpClient == nil {
+				return nil, fmt.Errorf("user %s: default UDP client not found: %s", uc.Username, uc.DefaultUDPClientName)
+			}
+		}
+		routes = append(routes, route)
+	}
+
+	return append(routes, globalRoutes...), nil
 }
 
 // Router creates a router from the RouterConfig.
@@ -90,10 +181,14 @@ func (rc *Config) Router(logger *zap.Logger, resolvers []*dns.Resolver, resolver
 		prefixSetMap[rc.PrefixSets[i].Name] = s
 	}
 
+	routeFunc := func(rc *RouteConfig) (Route, error) {
+		return rc.Route(geoip, logger, resolvers, resolverMap, tcpClientMap, udpClientMap, domainSetMap, prefixSetMap)
+	}
+
 	routes := make([]Route, len(rc.Routes)+1)
 
 	for i := range rc.Routes {
-		route, err := rc.Routes[i].Route(geoip, logger, resolvers, resolverMap, tcpClientMap, udpClientMap, domainSetMap, prefixSetMap)
+		route, err := routeFunc(&rc.Routes[i])
 		if err != nil {
 			return nil, err
 		}
@@ -102,77 +197,305 @@ func (rc *Config) Router(logger *zap.Logger, resolvers []*dns.Resolver, resolver
 
 	routes[len(rc.Routes)] = defaultRoute
 
-	return &Router{
-		geoip:  geoip,
-		logger: logger,
-		routes: routes,
-	}, nil
+	userUDPSessionPolicies := make(map[string]UDPSessionPolicy, len(rc.Users))
+	userAllowlists := make(map[string]*targetAllowlist)
+
+	for _, u := range rc.Users {
+		if u.Username == "" {
+			return nil, errors.New("user policy username cannot be empty")
+		}
+		if _, ok := userUDPSessionPolicies[u.Username]; ok {
+			return nil, fmt.Errorf("duplicate user policy: %s", u.Username)
+		}
+		if u.UDPSessionMaxLifetimeSec < 0 {
+			return nil, fmt.Errorf("user %s: negative udpSessionMaxLifetimeSec: %d", u.Username, u.UDPSessionMaxLifetimeSec)
+		}
+		userUDPSessionPolicies[u.Username] = UDPSessionPolicy{
+			BandwidthLimit: u.UDPBandwidthLimit,
+			MaxLifetime:    time.Duration(u.UDPSessionMaxLifetimeSec) * time.Second,
+			Fwmark:         u.UDPFwmark,
+		}
+
+		if len(u.AllowedTargets) > 0 {
+			l, err := newTargetAllowlist(u.AllowedTargets)
+			if err != nil {
+				return nil, fmt.Errorf("user %s: %w", u.Username, err)
+			}
+			userAllowlists[u.Username] = l
+		}
+	}
+
+	healthCheckers := make([]*HealthChecker, len(rc.HealthChecks))
+
+	for i := range rc.HealthChecks {
+		healthChecker, err := rc.HealthChecks[i].HealthChecker(tcpClientMap, udpClientMap, logger)
+		if err != nil {
+			return nil, err
+		}
+		healthCheckers[i] = healthChecker
+
+		for j := range rc.Routes {
+			if rc.Routes[j].Client == healthChecker.Client() {
+				routes[j].setHealthChecker(healthChecker)
+			}
+		}
+	}
+
+	// User routes are built after health checkers are attached to global routes,
+	// so the copied global routes share them.
+	userRoutes := make(map[string][]Route)
+
+	for i := range rc.Users {
+		u := &rc.Users[i]
+		ur, err := u.userRoutes(routes, routeFunc, tcpClientMap, udpClientMap)
+		if err != nil {
+			return nil, err
+		}
+		if ur == nil {
+			continue
+		}
+
+		for j := range u.Routes {
+			for _, healthChecker := range healthCheckers {
+				if u.Routes[j].Client == healthChecker.Client() {
+					ur[j].setHealthChecker(healthChecker)
+				}
+			}
+		}
+
+		userRoutes[u.Username] = ur
+	}
+
+	r := &Router{
+		geoip:                  geoip,
+		logger:                 logger,
+		routes:                 routes,
+		healthCheckers:         healthCheckers,
+		clients:                newClientStates(tcpClientMap, udpClientMap),
+		userUDPSessionPolicies: userUDPSessionPolicies,
+		userRoutes:             userRoutes,
+		userAllowlists:         userAllowlists,
+	}
+	r.refs.Store(1)
+	return r, nil
 }
 
 // Router looks up the destination client for requests received by servers.
 type Router struct {
-	geoip  *geoip2.Reader
-	logger *zap.Logger
-	routes []Route
+	geoip                  *geoip2.Reader
+	logger                 *zap.Logger
+	routes                 []Route
+	healthCheckers         []*HealthChecker
+	clients                map[string]*clientState
+	userUDPSessionPolicies map[string]UDPSessionPolicy
+	userRoutes             map[string][]Route
+	userAllowlists         map[string]*targetAllowlist
+
+	// refs is the number of references to the router.
+	// The router is created with one reference held by its owner.
+	refs atomic.Int64
+}
+
+// Start starts the router's health checkers.
+func (r *Router) Start() {
+	for _, h := range r.healthCheckers {
+		h.Start()
+	}
+}
+
+// Stop stops the router's health checkers. The router keeps routing requests
+// with the last known health status of its clients.
+//
+// Use Stop to retire a router that may still be used by requests in flight,
+// and [Router.Release] the owner's reference to close it once they have finished.
+func (r *Router) Stop() {
+	for _, h := range r.healthCheckers {
+		h.Stop()
+	}
 }
 
-// Close closes the router.
+// Close stops the router's health checkers and closes the router.
 func (r *Router) Close() error {
+	r.Stop()
 	if r.geoip != nil {
 		return r.geoip.Close()
 	}
 	return nil
 }
 
-// GetTCPClient returns the zerocopy.TCPClient for a TCP request received by server
-// from sourceAddrPort to targetAddr.
-func (r *Router) GetTCPClient(server string, sourceAddrPort netip.AddrPort, targetAddr conn.Addr) (zerocopy.TCPClient, error) {
-	route, err := r.match(protocolTCP, server, sourceAddrPort, targetAddr)
+// Acquire adds a reference to the router for a request or session that routes with it,
+// and returns true. If the last reference has already been released, the router is closed,
+// and Acquire returns false.
+func (r *Router) Acquire() bool {
+	for {
+		n := r.refs.Load()
+		if n <= 0 {
+			return false
+		}
+		if r.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// Release drops a reference to the router. Dropping the last reference closes the router.
+//
+// The owner of a router releases its reference when it replaces or no longer needs the router,
+// and the router is closed as soon as all requests and sessions routed with it have finished.
+func (r *Router) Release() {
+	if r.refs.Add(-1) != 0 {
+		return
+	}
+	if err := r.Close(); err != nil {
+		r.logger.Warn("Failed to close router", zap.Error(err))
+	}
+}
+
+// HealthStatus returns the health check results of all checked clients.
+func (r *Router) HealthStatus() []HealthStatus {
+	statuses := make([]HealthStatus, len(r.healthCheckers))
+	for i, h := range r.healthCheckers {
+		statuses[i] = h.Status()
+	}
+	return statuses
+}
+
+// GetTCPClient returns the zerocopy.TCPClient and the connection policy for a TCP request.
+func (r *Router) GetTCPClient(requestInfo RequestInfo) (zerocopy.TCPClient, TCPConnPolicy, error) {
+	route, err := r.match(protocolTCP, requestInfo)
 	if err != nil {
-		return nil, err
+		return nil, TCPConnPolicy{}, err
 	}
 
 	if ce := r.logger.Check(zap.DebugLevel, "Matched route for TCP connection"); ce != nil {
 		ce.Write(
-			zap.String("server", server),
-			zap.Stringer("sourceAddrPort", sourceAddrPort),
-			zap.Stringer("targetAddress", targetAddr),
+			zap.String("server", requestInfo.Server),
+			zap.Stringer("sourceAddrPort", requestInfo.SourceAddrPort),
+			zap.Stringer("targetAddress", requestInfo.TargetAddr),
+			zap.String("sniffedName", requestInfo.SniffedName),
 			zap.Stringer("route", route),
 		)
 	}
 
-	return route.TCPClient()
+	c, err := route.TCPClient()
+	return c, route.TCPConnPolicy(), err
 }
 
-// GetUDPClient returns the zerocopy.UDPClient for a UDP session received by server.
-// The first received packet of the session is from sourceAddrPort to targetAddr.
-func (r *Router) GetUDPClient(server string, sourceAddrPort netip.AddrPort, targetAddr conn.Addr) (zerocopy.UDPClient, error) {
-	route, err := r.match(protocolUDP, server, sourceAddrPort, targetAddr)
+// GetUDPClient returns the zerocopy.UDPClient and the session policy for a UDP session.
+// requestInfo describes the first received packet of the session.
+//
+// If requestInfo has a username with a user policy, the user's fwmark and limits are set in the returned policy.
+func (r *Router) GetUDPClient(requestInfo RequestInfo) (zerocopy.UDPClient, UDPSessionPolicy, error) {
+	route, err := r.match(protocolUDP, requestInfo)
 	if err != nil {
-		return nil, err
+		return nil, UDPSessionPolicy{}, err
 	}
 
 	if ce := r.logger.Check(zap.DebugLevel, "Matched route for UDP session"); ce != nil {
 		ce.Write(
-			zap.String("server", server),
-			zap.Stringer("sourceAddrPort", sourceAddrPort),
-			zap.Stringer("targetAddress", targetAddr),
+			zap.String("server", requestInfo.Server),
+			zap.Stringer("sourceAddrPort", requestInfo.SourceAddrPort),
+			zap.Stringer("targetAddress", requestInfo.TargetAddr),
 			zap.Stringer("route", route),
 		)
 	}
 
-	return route.UDPClient()
+	var policy UDPSessionPolicy
+	if requestInfo.Username != "" {
+		policy = r.userUDPSessionPolicies[requestInfo.Username]
+	}
+	policy.Route = route.name
+
+	c, err := route.UDPClient()
+	return c, policy, err
+}
+
+// UDPRouteMatches returns whether the named route matches the UDP session described by requestInfo,
+// regardless of whether the route's client is available. The default route matches
+// only if no other route does, so a selection made by the default route is not reused
+// for a session that another route is configured to handle.
+func (r *Router) UDPRouteMatches(requestInfo RequestInfo, name string) (bool, error) {
+	routes := r.routesFor(requestInfo.Username)
+	last := len(routes) - 1
+
+	for i := range routes[:last] {
+		route := &routes[i]
+		matched, err := route.Match(protocolUDP, requestInfo)
+		if err != nil {
+			return false, err
+		}
+		if matched && route.name == name {
+			return true, nil
+		}
+		if matched && routes[last].name == name {
+			return false, nil
+		}
+	}
+	return routes[last].name == name, nil
+}
+
+// routesFor returns the routes to match the requests of username against.
+func (r *Router) routesFor(username string) []Route {
+	if ur, ok := r.userRoutes[username]; ok {
+		return ur
+	}
+	return r.routes
 }
 
 // match returns the matched route for the new TCP request or UDP session.
-func (r *Router) match(network protocol, server string, sourceAddrPort netip.AddrPort, targetAddr conn.Addr) (*Route, error) {
-	for i := range r.routes {
-		matched, err := r.routes[i].Match(network, server, sourceAddrPort, targetAddr)
+//
+// Routes whose client for the network has been marked down by a health checker
+// are skipped, except for the default route and the user's default route.
+//
+// Routes whose client is draining are skipped. If the default route's or the user's
+// default route's client is draining, ErrClientDraining is returned.
+//
+// If requestInfo has a username with routes of their own, the user's routes are matched first.
+//
+// If requestInfo has a username with a target allowlist, and the target is not allowed,
+// ErrTargetNotAllowed is returned.
+func (r *Router) match(network protocol, requestInfo RequestInfo) (*Route, error) {
+	if requestInfo.Username != "" {
+		if l, ok := r.userAllowlists[requestInfo.Username]; ok && !l.Allows(requestInfo.TargetAddr) {
+			return nil, ErrTargetNotAllowed
+		}
+	}
+	routes := r.routesFor(requestInfo.Username)
+
+	for i := range routes {
+		route := &routes[i]
+		matched, err := route.Match(network, requestInfo)
 		if err != nil {
 			return nil, err
 		}
 		if matched {
-			return &r.routes[i], nil
+			final := route.final || i == len(routes)-1
+			if r.draining(network, route) {
+				if final {
+					return nil, ErrClientDraining
+				}
+				if ce := r.logger.Check(zap.DebugLevel, "Skipping matched route with draining client"); ce != nil {
+					ce.Write(
+						zap.String("server", requestInfo.Server),
+						zap.Stringer("sourceAddrPort", requestInfo.SourceAddrPort),
+						zap.Stringer("targetAddress", requestInfo.TargetAddr),
+						zap.Stringer("route", route),
+					)
+				}
+				continue
+			}
+			if !final && route.unhealthy(network) {
+				if ce := r.logger.Check(zap.DebugLevel, "Skipping matched route with unhealthy client"); ce != nil {
+					ce.Write(
+						zap.String("server", requestInfo.Server),
+						zap.Stringer("sourceAddrPort", requestInfo.SourceAddrPort),
+						zap.Stringer("targetAddress", requestInfo.TargetAddr),
+						zap.Stringer("route", route),
+					)
+				}
+				continue
+			}
+			return route, nil
 		}
 	}
 	panic("did not match default route")
@@ -0,0 +1,323 @@
+package router
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/direct"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+func TestRouterUserUDPSessionPolicy(t *testing.T) {
+	udpClientMap := map[string]zerocopy.UDPClient{
+		"direct": direct.NewUDPClient("direct", 1500, 0, 0),
+	}
+
+	rc := Config{
+		Users: []UserPolicyConfig{
+			{Username: "alice", UDPFwmark: 1001, UDPBandwidthLimit: 1 << 20, UDPSessionMaxLifetimeSec: 3600},
+			{Username: "bob"},
+		},
+	}
+	r, err := rc.Router(zap.NewNop(), nil, nil, nil, udpClientMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		username       string
+		expectedPolicy UDPSessionPolicy
+	}{
+		{"alice", UDPSessionPolicy{Route: "default", BandwidthLimit: 1 << 20, MaxLifetime: time.Hour, Fwmark: 1001}},
+		{"bob", UDPSessionPolicy{Route: "default"}},
+		{"carol", UDPSessionPolicy{Route: "default"}},
+		{"", UDPSessionPolicy{Route: "default"}},
+	} {
+		_, policy, err := r.GetUDPClient(RequestInfo{Username: c.username})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if policy != c.expectedPolicy {
+			t.Errorf("User %q got policy %+v, expected %+v", c.username, policy, c.expectedPolicy)
+		}
+	}
+}
+
+func TestRouterUserPolicyValidation(t *testing.T) {
+	for _, users := range [][]UserPolicyConfig{
+		{{Username: ""}},
+		{{Username: "alice"}, {Username: "alice"}},
+		{{Username: "alice", UDPSessionMaxLifetimeSec: -1}},
+	} {
+		rc := Config{Users: users}
+		if _, err := rc.Router(zap.NewNop(), nil, nil, nil, nil); err == nil {
+			t.Errorf("Expected error for user policies %+v", users)
+		}
+	}
+}
+
+func TestRouterUserRoutes(t *testing.T) {
+	tcpClientMap := map[string]zerocopy.TCPClient{
+		"direct": direct.NewTCPClient("direct", false, 0, 0),
+		"proxy":  direct.NewTCPClient("proxy", false, 0, 0),
+	}
+	udpClientMap := map[string]zerocopy.UDPClient{
+		"direct": direct.NewUDPClient("direct", 1500, 0, 0),
+		"proxy":  direct.NewUDPClient("proxy", 1500, 0, 0),
+	}
+
+	rc := Config{
+		DefaultTCPClientName: "direct",
+		DefaultUDPClientName: "direct",
+		Routes: []RouteConfig{
+			{Name: "block-dns", Client: "reject", ToPorts: []uint16{53}},
+		},
+		Users: []UserPolicyConfig{
+			{
+				Username: "alice",
+				Routes: []RouteConfig{
+					{Name: "alice-dns", Client: "proxy", ToPorts: []uint16{53}},
+				},
+			},
+			{
+				Username:             "bob",
+				DefaultTCPClientName: "proxy",
+				DefaultUDPClientName: "reject",
+			},
+			{Username: "carol", UDPFwmark: 1001},
+		},
+	}
+	r, err := rc.Router(zap.NewNop(), nil, nil, tcpClientMap, udpClientMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dnsTarget := conn.AddrFromIPPort(netip.MustParseAddrPort("192.0.2.1:53"))
+	webTarget := conn.AddrFromIPPort(netip.MustParseAddrPort("192.0.2.1:80"))
+
+	for _, c := range []struct {
+		username    string
+		targetAddr  conn.Addr
+		expectedTCP string
+		expectedUDP string
+	}{
+		{"", dnsTarget, "", ""},
+		{"", webTarget, "direct", "direct"},
+		{"alice", dnsTarget, "proxy", "proxy"},
+		{"alice", webTarget, "direct", "direct"},
+		{"bob", dnsTarget, "proxy", ""},
+		{"bob", webTarget, "proxy", ""},
+		{"carol", dnsTarget, "", ""},
+		{"dave", webTarget, "direct", "direct"},
+	} {
+		requestInfo := RequestInfo{Username: c.username, TargetAddr: c.targetAddr}
+
+		tc, _, err := r.GetTCPClient(requestInfo)
+		switch {
+		case c.expectedTCP == "" && err != ErrRejected:
+			t.Errorf("User %q to %s: expected TCP request to be rejected, got client %v, error %v", c.username, c.targetAddr, tc, err)
+		case c.expectedTCP != "" && (err != nil || tc.String() != c.expectedTCP):
+			t.Errorf("User %q to %s: expected TCP client %q, got client %v, error %v", c.username, c.targetAddr, c.expectedTCP, tc, err)
+		}
+
+		uc, _, err := r.GetUDPClient(requestInfo)
+		switch {
+		case c.expectedUDP == "" && err != ErrRejected:
+			t.Errorf("User %q to %s: expected UDP session to be rejected, got client %v, error %v", c.username, c.targetAddr, uc, err)
+		case c.expectedUDP != "" && (err != nil || uc.String() != c.expectedUDP):
+			t.Errorf("User %q to %s: expected UDP client %q, got client %v, error %v", c.username, c.targetAddr, c.expectedUDP, uc, err)
+		}
+	}
+}
+
+func TestRouterUserDefaultRouteIsFinal(t *testing.T) {
+	tcpClientMap := map[string]zerocopy.TCPClient{
+		"direct": direct.NewTCPClientWithDialer("direct", nil),
+		"proxy":  direct.NewTCPClientWithDialer("proxy", nil),
+	}
+
+	rc := Config{
+		DefaultTCPClientName: "direct",
+		Users: []UserPolicyConfig{
+			{Username: "bob", DefaultTCPClientName: "proxy"},
+		},
+		HealthChecks: []HealthCheckConfig{
+			{Client: "proxy", Probe: "dial", Address: conn.MustAddrFromDomainPort("example.com", 443)},
+		},
+	}
+	r, err := rc.Router(zap.NewNop(), nil, nil, tcpClientMap, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestInfo := RequestInfo{Username: "bob", TargetAddr: conn.MustAddrFromDomainPort("example.com", 443)}
+
+	// An unhealthy user default client is still used, like the global default.
+	r.healthCheckers[0].down.Store(true)
+	tc, _, err := r.GetTCPClient(requestInfo)
+	if err != nil || tc.String() != "proxy" {
+		t.Errorf("Expected TCP client proxy while it is down, got client %v, error %v", tc, err)
+	}
+
+	// A draining user default client fails the request instead of falling through to global routes.
+	if err = r.SetClientDraining("proxy", true); err != nil {
+		t.Fatal(err)
+	}
+	if tc, _, err = r.GetTCPClient(requestInfo); err != ErrClientDraining {
+		t.Errorf("Expected ErrClientDraining while proxy is draining, got client %v, error %v", tc, err)
+	}
+}
+
+func TestRouterUserRoutesValidation(t *testing.T) {
+	tcpClientMap := map[string]zerocopy.TCPClient{
+		"direct": direct.NewTCPClient("direct", false, 0, 0),
+	}
+
+	for _, u := range []UserPolicyConfig{
+		{Username: "alice", DefaultTCPClientName: "missing"},
+		{Username: "alice", DefaultUDPClientName: "missing"},
+		{Username: "alice", Routes: []RouteConfig{{Name: "default", Client: "direct"}}},
+		{Username: "alice", Routes: []RouteConfig{{Name: "missing", Client: "missing", Network: "tcp"}}},
+	} {
+		rc := Config{Users: []UserPolicyConfig{u}}
+		if _, err := rc.Router(zap.NewNop(), nil, nil, tcpClientMap, nil); err == nil {
+			t.Errorf("Expected error for user policy %+v", u)
+		}
+	}
+}
+
+func TestRouterUserAllowedTargets(t *testing.T) {
+	tcpClientMap := map[string]zerocopy.TCPClient{
+		"direct": direct.NewTCPClient("direct", false, 0, 0),
+	}
+	udpClientMap := map[string]zerocopy.UDPClient{
+		"direct": direct.NewUDPClient("direct", 1500, 0, 0),
+	}
+
+	rc := Config{
+		Users: []UserPolicyConfig{
+			{
+				Username: "alice",
+				AllowedTargets: []string{
+					"api.example.com:443",
+					"*.example.net",
+					"example.org",
+					"192.0.2.0/24",
+					"2001:db8::1",
+					"[2001:db8::2]:53",
+				},
+			},
+			{Username: "bob"},
+		},
+	}
+	r, err := rc.Router(zap.NewNop(), nil, nil, tcpClientMap, udpClientMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		username string
+		target   conn.Addr
+		allowed  bool
+	}{
+		{"alice", conn.MustAddrFromDomainPort("api.example.com", 443), true},
+		{"alice", conn.MustAddrFromDomainPort("API.Example.com.", 443), true},
+		{"alice", conn.MustAddrFromDomainPort("api.example.com", 80), false},
+		{"alice", conn.MustAddrFromDomainPort("www.example.com", 443), false},
+		{"alice", conn.MustAddrFromDomainPort("a.b.example.net", 8080), true},
+		{"alice", conn.MustAddrFromDomainPort("example.net", 443), false},
+		{"alice", conn.MustAddrFromDomainPort("badexample.net", 443), false},
+		{"alice", conn.MustAddrFromDomainPort("example.org", 25), true},
+		{"alice", conn.MustAddrFromDomainPort("www.example.org", 443), false},
+		{"alice", conn.AddrFromIPPort(netip.MustParseAddrPort("192.0.2.100:443")), true},
+		{"alice", conn.AddrFromIPPort(netip.MustParseAddrPort("[::ffff:192.0.2.100]:443")), true},
+		{"alice", conn.AddrFromIPPort(netip.MustParseAddrPort("198.51.100.1:443")), false},
+		{"alice", conn.AddrFromIPPort(netip.MustParseAddrPort("[2001:db8::1]:443")), true},
+		{"alice", conn.AddrFromIPPort(netip.MustParseAddrPort("[2001:db8::2]:53")), true},
+		{"alice", conn.AddrFromIPPort(netip.MustParseAddrPort("[2001:db8::2]:443")), false},
+		{"bob", conn.AddrFromIPPort(netip.MustParseAddrPort("198.51.100.1:443")), true},
+		{"", conn.AddrFromIPPort(netip.MustParseAddrPort("198.51.100.1:443")), true},
+	} {
+		requestInfo := RequestInfo{Username: c.username, TargetAddr: c.target}
+
+		_, _, err := r.GetTCPClient(requestInfo)
+		if c.allowed && err != nil || !c.allowed && err != ErrTargetNotAllowed {
+			t.Errorf("User %q to %s: TCP error %v, expected allowed %v", c.username, c.target, err, c.allowed)
+		}
+
+		_, _, err = r.GetUDPClient(requestInfo)
+		if c.allowed && err != nil || !c.allowed && err != ErrTargetNotAllowed {
+			t.Errorf("User %q to %s: UDP error %v, expected allowed %v", c.username, c.target, err, c.allowed)
+		}
+
+		if allows := r.TargetAllowlist(c.username); allows != nil && allows(c.target) != c.allowed {
+			t.Errorf("User %q to %s: TargetAllowlist allowed %v, expected %v", c.username, c.target, !c.allowed, c.allowed)
+		}
+
+		if allowed := r.AllowsTarget(c.username, c.target); allowed != c.allowed {
+			t.Errorf("User %q to %s: AllowsTarget returned %v, expected %v", c.username, c.target, allowed, c.allowed)
+		}
+	}
+
+	if r.TargetAllowlist("bob") != nil || r.TargetAllowlist("") != nil {
+		t.Error("TargetAllowlist returned an allowlist for unrestricted users")
+	}
+}
+
+func TestRouterUserAllowedTargetsValidation(t *testing.T) {
+	for _, target := range []string{"", "*.", "*.*.example.com", "example.com/24", "foo bar"} {
+		rc := Config{Users: []UserPolicyConfig{{Username: "alice", AllowedTargets: []string{target}}}}
+		if _, err := rc.Router(zap.NewNop(), nil, nil, nil, nil); err == nil {
+			t.Errorf("Expected error for allowed target %q", target)
+		}
+	}
+}
+
+func TestRouterUDPRouteMatches(t *testing.T) {
+	udpClientMap := map[string]zerocopy.UDPClient{
+		"a": direct.NewUDPClient("a", 1500, 0, 0),
+		"b": direct.NewUDPClient("b", 1500, 0, 0),
+	}
+
+	rc := Config{
+		DefaultUDPClientName: "b",
+		Routes: []RouteConfig{
+			{Name: "to-a", Client: "a", Network: "udp", ToDomains: []string{"example.com"}},
+		},
+	}
+	r, err := rc.Router(zap.NewNop(), nil, nil, nil, udpClientMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		target   string
+		route    string
+		expected bool
+	}{
+		{"example.com", "to-a", true},
+		{"example.org", "to-a", false},
+		{"example.org", "default", true},
+		{"example.com", "default", false},
+		{"example.com", "missing", false},
+	} {
+		requestInfo := RequestInfo{TargetAddr: conn.MustAddrFromDomainPort(c.target, 443)}
+		matched, err := r.UDPRouteMatches(requestInfo, c.route)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched != c.expected {
+			t.Errorf("UDPRouteMatches(%s, %q) returned %v, expected %v", c.target, c.route, matched, c.expected)
+		}
+	}
+
+	_, policy, err := r.GetUDPClient(RequestInfo{TargetAddr: conn.MustAddrFromDomainPort("example.com", 443)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Route != "to-a" {
+		t.Errorf("GetUDPClient() returned policy of route %q, expected %q", policy.Route, "to-a")
+	}
+}
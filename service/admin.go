@@ -0,0 +1,417 @@
+package service
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/netip"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/stats"
+	"go.uber.org/zap"
+)
+
+// AdminConfig configures the admin HTTP server.
+type AdminConfig struct {
+	// Listen is the address of the admin listener, such as "127.0.0.1:9090".
+	// If empty, the admin server is disabled.
+	Listen string `json:"listen"`
+
+	// EnablePprof mounts the net/http/pprof handlers under /debug/pprof/.
+	EnablePprof bool `json:"enablePprof"`
+
+	// BearerToken, if not empty, is required in the "Authorization: Bearer" header of every request.
+	// If empty, requests are not authenticated, Listen must be a loopback IP address,
+	// and requests are rejected unless their Host header names a loopback IP address or the listen host.
+	BearerToken string `json:"bearerToken"`
+}
+
+// errAdminListenNotLoopback is returned when the admin server is configured to listen on
+// a non-loopback address without a bearer token.
+var errAdminListenNotLoopback = errors.New("admin server without a bearer token must listen on a loopback IP address")
+
+// Validate checks the admin config for unauthenticated listeners reachable from other hosts.
+func (ac *AdminConfig) Validate() error {
+	if ac.Listen == "" || ac.BearerToken != "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(ac.Listen)
+	if err != nil {
+		return fmt.Errorf("invalid admin listen address %q: %w", ac.Listen, err)
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && addr.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("%w: %q", errAdminListenNotLoopback, ac.Listen)
+}
+
+// AdminRequestHeader must be present with a non-empty value in requests to the mutating endpoints
+// of the admin server. Browsers do not send custom headers in cross-origin requests without a CORS
+// preflight, which the admin server never approves, so a web page cannot forge these requests.
+const AdminRequestHeader = "X-Shadowsocks-Go-Admin"
+
+// RuntimeStats is a snapshot of Go runtime metrics.
+type RuntimeStats struct {
+	Goroutines   int           `json:"goroutines"`
+	NumGC        uint32        `json:"numGC"`
+	GCPauseTotal time.Duration `json:"gcPauseTotal"`
+	LastGC       time.Time     `json:"lastGC"`
+	HeapAlloc    uint64        `json:"heapAlloc"`
+	HeapSys      uint64        `json:"heapSys"`
+	HeapObjects  uint64        `json:"heapObjects"`
+
+	// OpenFDs is the number of open file descriptors of the process.
+	// It is -1 if not supported on the platform.
+	OpenFDs int `json:"openFDs"`
+}
+
+// ReadRuntimeStats returns a snapshot of Go runtime metrics.
+// It briefly stops the world to read memory statistics.
+func ReadRuntimeStats() RuntimeStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	var lastGC time.Time
+	if ms.LastGC != 0 {
+		lastGC = time.Unix(0, int64(ms.LastGC))
+	}
+
+	return RuntimeStats{
+		Goroutines:   runtime.NumGoroutine(),
+		NumGC:        ms.NumGC,
+		GCPauseTotal: time.Duration(ms.PauseTotalNs),
+		LastGC:       lastGC,
+		HeapAlloc:    ms.HeapAlloc,
+		HeapSys:      ms.HeapSys,
+		HeapObjects:  ms.HeapObjects,
+		OpenFDs:      openFDCount(),
+	}
+}
+
+// AdminStats is the statistics exposition of the admin server.
+type AdminStats struct {
+	Users                      []stats.UserSnapshot     `json:"users"`
+	SessionSetupFailures       map[string]uint64        `json:"sessionSetupFailures"`
+	NATConnErrors              map[string]uint64        `json:"natConnErrors"`
+	PacketDrops                map[string]uint64        `json:"packetDrops"`
+	UplinkSendmmsgBatchSizes   stats.BatchSizeHistogram `json:"uplinkSendmmsgBatchSizes"`
+	DownlinkSendmmsgBatchSizes stats.BatchSizeHistogram `json:"downlinkSendmmsgBatchSizes"`
+	SessionSetupLatency        stats.LatencyHistogram   `json:"sessionSetupLatency"`
+	RelayDelay                 stats.LatencyHistogram   `json:"relayDelay"`
+}
+
+// AdminClients is the client status exposition of the admin server.
+type AdminClients struct {
+	Clients []router.ClientStatus `json:"clients"`
+	Health  []router.HealthStatus `json:"health"`
+}
+
+// BearerTokenAuth returns an auth middleware for [NewAdminServer] that requires
+// token in the "Authorization: Bearer" header of every request.
+func BearerTokenAuth(token string) func(http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// LoopbackHostAuth returns an auth middleware for [NewAdminServer] that rejects requests
+// whose Host header is neither a loopback IP address nor the host of listenAddress.
+//
+// Without it, a web page could use DNS rebinding to point its own domain at the loopback
+// address and read the responses of an unauthenticated admin server.
+func LoopbackHostAuth(listenAddress string) func(http.Handler) http.Handler {
+	listenHost, _, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		listenHost = listenAddress
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isLoopbackHost(r.Host, listenHost) {
+				http.Error(w, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isLoopbackHost returns whether the host part of hostport is a loopback IP address or listenHost.
+func isLoopbackHost(hostport, listenHost string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]")
+	}
+	if host == listenHost {
+		return true
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.IsLoopback()
+}
+
+// AdminServer is an HTTP server for managing the services of a [Manager].
+//
+// It serves the following endpoints. Responses are JSON unless otherwise noted.
+// POST requests must carry the [AdminRequestHeader] header.
+//
+//   - GET /debug/runtime: Go runtime metrics. See [RuntimeStats].
+//   - GET /debug/pprof/: net/http/pprof profiles, if enabled.
+//   - GET /stats: per-user traffic and relay statistics. See [AdminStats].
+//   - POST /stats/reset?username=: returns and zeroes the byte counters of a user. See [stats.Collector.ResetUser].
+//   - GET /sessions[?server=]: UDP sessions of session relays keyed by server name.
+//   - POST /sessions/close?server=&id=: tears down a UDP session by client session ID.
+//   - GET /clients: drain and health status of clients. See [AdminClients].
+//   - POST /clients/drain?client=&draining=: marks a client as draining or not. See [router.Router.SetClientDraining].
+type AdminServer struct {
+	listenAddress string
+	handler       http.Handler
+	manager       *Manager
+	logger        *zap.Logger
+	server        *http.Server
+	wg            sync.WaitGroup
+}
+
+// NewAdminServer returns a new admin server for the services of manager that listens on listenAddress.
+//
+// If enablePprof is true, net/http/pprof handlers are mounted under /debug/pprof/.
+// If auth is not nil, all requests are passed through the auth middleware,
+// which is responsible for rejecting unauthenticated requests. See [BearerTokenAuth].
+func NewAdminServer(listenAddress string, enablePprof bool, auth func(http.Handler) http.Handler, manager *Manager, logger *zap.Logger) *AdminServer {
+	s := AdminServer{
+		listenAddress: listenAddress,
+		manager:       manager,
+		logger:        logger,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/runtime", s.handleRuntime)
+	mux.HandleFunc("/stats", s.handleStats)
+	mux.HandleFunc("/stats/reset", s.handleStatsReset)
+	mux.HandleFunc("/sessions", s.handleSessions)
+	mux.HandleFunc("/sessions/close", s.handleSessionsClose)
+	mux.HandleFunc("/clients", s.handleClients)
+	mux.HandleFunc("/clients/drain", s.handleClientsDrain)
+
+	if enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	s.handler = mux
+	if auth != nil {
+		s.handler = auth(mux)
+	}
+	return &s
+}
+
+// String implements the Relay String method.
+func (s *AdminServer) String() string {
+	return fmt.Sprintf("admin server on %s", s.listenAddress)
+}
+
+// Handler returns the HTTP handler of the admin server, including the auth middleware.
+func (s *AdminServer) Handler() http.Handler {
+	return s.handler
+}
+
+// Start implements the Relay Start method.
+func (s *AdminServer) Start() error {
+	l, err := net.Listen("tcp", s.listenAddress)
+	if err != nil {
+		return err
+	}
+
+	s.server = &http.Server{
+		Handler:           s.handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	s.wg.Add(1)
+
+	go func() {
+		if err := s.server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Warn("Failed to serve admin HTTP requests",
+				zap.String("listenAddress", s.listenAddress),
+				zap.Error(err),
+			)
+		}
+		s.wg.Done()
+	}()
+
+	s.logger.Info("Started admin server", zap.String("listenAddress", s.listenAddress))
+	return nil
+}
+
+// Stop implements the Relay Stop method.
+func (s *AdminServer) Stop() error {
+	if s.server == nil {
+		return nil
+	}
+	err := s.server.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *AdminServer) handleRuntime(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	s.writeJSON(w, ReadRuntimeStats())
+}
+
+func (s *AdminServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	collector := s.manager.Stats()
+	uplink, downlink := collector.SendmmsgBatchSizes()
+	s.writeJSON(w, AdminStats{
+		Users:                      collector.Users(),
+		SessionSetupFailures:       collector.SessionSetupFailures(),
+		NATConnErrors:              collector.NATConnErrors(),
+		PacketDrops:                collector.PacketDrops(),
+		UplinkSendmmsgBatchSizes:   uplink,
+		DownlinkSendmmsgBatchSizes: downlink,
+		SessionSetupLatency:        collector.SessionSetupLatency(),
+		RelayDelay:                 collector.RelayDelay(),
+	})
+}
+
+func (s *AdminServer) handleStatsReset(w http.ResponseWriter, r *http.Request) {
+	if !allowMutation(w, r) {
+		return
+	}
+	username := r.URL.Query().Get("username")
+	u, ok := s.manager.Stats().ResetUser(username)
+	if !ok {
+		http.Error(w, fmt.Sprintf("user not found: %s", username), http.StatusNotFound)
+		return
+	}
+	s.writeJSON(w, u)
+}
+
+func (s *AdminServer) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	server := r.URL.Query().Get("server")
+	sessions := make(map[string][]UDPSessionInfo)
+	for _, relay := range s.manager.UDPSessionRelays() {
+		if server == "" || relay.serverName == server {
+			sessions[relay.serverName] = relay.Snapshot()
+		}
+	}
+	s.writeJSON(w, sessions)
+}
+
+func (s *AdminServer) handleSessionsClose(w http.ResponseWriter, r *http.Request) {
+	if !allowMutation(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	server := query.Get("server")
+	csid, err := strconv.ParseUint(query.Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid client session ID: %v", err), http.StatusBadRequest)
+		return
+	}
+	for _, relay := range s.manager.UDPSessionRelays() {
+		if relay.serverName == server && relay.CloseSession(csid) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	http.Error(w, fmt.Sprintf("session not found: %d", csid), http.StatusNotFound)
+}
+
+func (s *AdminServer) handleClients(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	router := s.manager.Router()
+	s.writeJSON(w, AdminClients{
+		Clients: router.ClientStatuses(),
+		Health:  router.HealthStatus(),
+	})
+}
+
+func (s *AdminServer) handleClientsDrain(w http.ResponseWriter, r *http.Request) {
+	if !allowMutation(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	client := query.Get("client")
+	draining, err := strconv.ParseBool(query.Get("draining"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid draining value: %v", err), http.StatusBadRequest)
+		return
+	}
+	router := s.manager.Router()
+	if err = router.SetClientDraining(client, draining); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	status, err := router.ClientStatus(client)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	s.logger.Info("Set client draining status",
+		zap.String("client", client),
+		zap.Bool("draining", draining),
+	)
+
+	s.writeJSON(w, status)
+}
+
+// writeJSON writes v as the JSON response body.
+func (s *AdminServer) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.logger.Warn("Failed to write admin HTTP response", zap.Error(err))
+	}
+}
+
+// allowMethod returns whether the request uses method.
+// Otherwise, it responds with 405 Method Not Allowed.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	return false
+}
+
+// allowMutation returns whether the request is a POST request with the [AdminRequestHeader] header.
+// Otherwise, it responds with 405 Method Not Allowed or 403 Forbidden.
+func allowMutation(w http.ResponseWriter, r *http.Request) bool {
+	if !allowMethod(w, r, http.MethodPost) {
+		return false
+	}
+	if r.Header.Get(AdminRequestHeader) == "" {
+		http.Error(w, fmt.Sprintf("missing %s header", AdminRequestHeader), http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package service
+
+// openFDCount returns -1, as counting open file descriptors is not supported on the platform.
+func openFDCount() int {
+	return -1
+}
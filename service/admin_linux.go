@@ -0,0 +1,13 @@
+package service
+
+import "os"
+
+// openFDCount returns the number of open file descriptors of the process.
+func openFDCount() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	// Exclude the file descriptor used to read the directory.
+	return len(entries) - 1
+}
@@ -0,0 +1,260 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/direct"
+	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/stats"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+func newTestAdminServer(t *testing.T, enablePprof bool, auth func(http.Handler) http.Handler) (*AdminServer, *Manager) {
+	t.Helper()
+	logger := zap.NewNop()
+	r, err := (&router.Config{DefaultUDPClientName: "direct"}).Router(logger, nil, nil, nil, map[string]zerocopy.UDPClient{
+		"direct": direct.NewUDPClient("direct", 1500, 0, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Manager{
+		collector: stats.NewCollector(0),
+		logger:    logger,
+	}
+	m.router.Store(r)
+	return NewAdminServer("127.0.0.1:0", enablePprof, auth, m, logger), m
+}
+
+// adminPostHeader is the header of POST requests to mutating endpoints.
+var adminPostHeader = http.Header{AdminRequestHeader: {"1"}}
+
+func serveAdmin(s *AdminServer, method, target string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminServerAuth(t *testing.T) {
+	s, _ := newTestAdminServer(t, false, BearerTokenAuth("secret"))
+
+	for _, c := range []struct {
+		name          string
+		authorization string
+		wantStatus    int
+	}{
+		{"Missing", "", http.StatusUnauthorized},
+		{"Wrong", "Bearer wrong", http.StatusUnauthorized},
+		{"Valid", "Bearer secret", http.StatusOK},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			w := serveAdmin(s, http.MethodGet, "/debug/runtime", http.Header{"Authorization": {c.authorization}})
+			if w.Code != c.wantStatus {
+				t.Errorf("Status = %d, want %d", w.Code, c.wantStatus)
+			}
+		})
+	}
+}
+
+func TestAdminServerLoopbackHostAuth(t *testing.T) {
+	s, _ := newTestAdminServer(t, false, LoopbackHostAuth("127.0.0.2:9090"))
+
+	for _, c := range []struct {
+		host       string
+		wantStatus int
+	}{
+		{"127.0.0.1:9090", http.StatusOK},
+		{"127.0.0.2", http.StatusOK},
+		{"[::1]:9090", http.StatusOK},
+		{"localhost:9090", http.StatusMisdirectedRequest},
+		{"evil.example:9090", http.StatusMisdirectedRequest},
+		{"192.0.2.1:9090", http.StatusMisdirectedRequest},
+		{"", http.StatusMisdirectedRequest},
+	} {
+		t.Run(c.host, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/debug/runtime", nil)
+			req.Host = c.host
+			w := httptest.NewRecorder()
+			s.Handler().ServeHTTP(w, req)
+			if w.Code != c.wantStatus {
+				t.Errorf("Status = %d, want %d", w.Code, c.wantStatus)
+			}
+		})
+	}
+}
+
+func TestAdminServerRuntime(t *testing.T) {
+	s, _ := newTestAdminServer(t, false, nil)
+
+	w := serveAdmin(s, http.MethodGet, "/debug/runtime", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var rs RuntimeStats
+	if err := json.Unmarshal(w.Body.Bytes(), &rs); err != nil {
+		t.Fatal(err)
+	}
+	if rs.Goroutines <= 0 {
+		t.Errorf("Goroutines = %d, want positive", rs.Goroutines)
+	}
+	if rs.OpenFDs == 0 {
+		t.Error("OpenFDs = 0, want positive or -1")
+	}
+
+	if w = serveAdmin(s, http.MethodPost, "/debug/runtime", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestAdminServerPprof(t *testing.T) {
+	for _, enablePprof := range []bool{false, true} {
+		s, _ := newTestAdminServer(t, enablePprof, nil)
+		w := serveAdmin(s, http.MethodGet, "/debug/pprof/", nil)
+		if got := w.Code == http.StatusOK; got != enablePprof {
+			t.Errorf("enablePprof: %v, status = %d", enablePprof, w.Code)
+		}
+	}
+}
+
+func TestAdminServerStats(t *testing.T) {
+	s, m := newTestAdminServer(t, false, nil)
+	m.collector.TCPConnOpened("alice")
+	m.collector.TCPConnClosed("alice", 100, 200)
+	m.collector.ObserveSessionSetupLatency(3 * time.Millisecond)
+	m.collector.ObserveRelayDelay(30 * time.Microsecond)
+	m.collector.CollectPacketDrops(stats.PacketDropSendBufferFull, 2)
+
+	w := serveAdmin(s, http.MethodGet, "/stats", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var as AdminStats
+	if err := json.Unmarshal(w.Body.Bytes(), &as); err != nil {
+		t.Fatal(err)
+	}
+	if len(as.Users) != 1 || as.Users[0].Username != "alice" || as.Users[0].UplinkBytes != 100 {
+		t.Errorf("Users = %+v, want alice with 100 uplink bytes", as.Users)
+	}
+	if as.SessionSetupLatency.Count != 1 || as.SessionSetupLatency.Sum != 3*time.Millisecond {
+		t.Errorf("SessionSetupLatency = %+v, want one observation of 3ms", as.SessionSetupLatency)
+	}
+	if as.RelayDelay.Count != 1 || as.RelayDelay.Sum != 30*time.Microsecond {
+		t.Errorf("RelayDelay = %+v, want one observation of 30µs", as.RelayDelay)
+	}
+	if n := as.PacketDrops["send_buffer_full"]; n != 2 {
+		t.Errorf("PacketDrops[send_buffer_full] = %d, want 2", n)
+	}
+
+	w = serveAdmin(s, http.MethodPost, "/stats/reset?username=alice", adminPostHeader)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Reset status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if u, _ := m.collector.UserSnapshot("alice"); u.UplinkBytes != 0 {
+		t.Errorf("UplinkBytes after reset = %d, want 0", u.UplinkBytes)
+	}
+
+	if w = serveAdmin(s, http.MethodPost, "/stats/reset?username=bob", adminPostHeader); w.Code != http.StatusNotFound {
+		t.Errorf("Reset unknown user status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestAdminServerSessions(t *testing.T) {
+	s, _ := newTestAdminServer(t, false, nil)
+
+	w := serveAdmin(s, http.MethodGet, "/sessions", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	for _, c := range []struct {
+		target     string
+		wantStatus int
+	}{
+		{"/sessions/close?server=fake&id=1", http.StatusNotFound},
+		{"/sessions/close?server=fake&id=bad", http.StatusBadRequest},
+	} {
+		if w = serveAdmin(s, http.MethodPost, c.target, adminPostHeader); w.Code != c.wantStatus {
+			t.Errorf("POST %s status = %d, want %d", c.target, w.Code, c.wantStatus)
+		}
+	}
+}
+
+func TestAdminServerClientsDrain(t *testing.T) {
+	s, m := newTestAdminServer(t, false, nil)
+
+	w := serveAdmin(s, http.MethodPost, "/clients/drain?client=direct&draining=true", adminPostHeader)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Drain status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if m.Router().ClientAvailable("direct") {
+		t.Error("Client is available after draining")
+	}
+
+	w = serveAdmin(s, http.MethodGet, "/clients", nil)
+	var ac AdminClients
+	if err := json.Unmarshal(w.Body.Bytes(), &ac); err != nil {
+		t.Fatal(err)
+	}
+	if len(ac.Clients) != 1 || !ac.Clients[0].Draining {
+		t.Errorf("Clients = %+v, want draining direct", ac.Clients)
+	}
+
+	for _, c := range []struct {
+		target     string
+		wantStatus int
+	}{
+		{"/clients/drain?client=missing&draining=true", http.StatusNotFound},
+		{"/clients/drain?client=direct&draining=maybe", http.StatusBadRequest},
+	} {
+		if w = serveAdmin(s, http.MethodPost, c.target, adminPostHeader); w.Code != c.wantStatus {
+			t.Errorf("POST %s status = %d, want %d", c.target, w.Code, c.wantStatus)
+		}
+	}
+}
+
+func TestAdminServerMutationHeader(t *testing.T) {
+	s, m := newTestAdminServer(t, false, nil)
+
+	for _, target := range []string{
+		"/stats/reset?username=alice",
+		"/sessions/close?server=fake&id=1",
+		"/clients/drain?client=direct&draining=true",
+	} {
+		if w := serveAdmin(s, http.MethodPost, target, nil); w.Code != http.StatusForbidden {
+			t.Errorf("POST %s without %s status = %d, want %d", target, AdminRequestHeader, w.Code, http.StatusForbidden)
+		}
+	}
+	if !m.Router().ClientAvailable("direct") {
+		t.Error("Client was drained by a request without the admin request header")
+	}
+}
+
+func TestAdminConfigValidate(t *testing.T) {
+	for _, c := range []struct {
+		config  AdminConfig
+		wantErr bool
+	}{
+		{AdminConfig{}, false},
+		{AdminConfig{Listen: "127.0.0.1:9090"}, false},
+		{AdminConfig{Listen: "[::1]:9090"}, false},
+		{AdminConfig{Listen: "localhost:9090"}, true},
+		{AdminConfig{Listen: ":9090"}, true},
+		{AdminConfig{Listen: "0.0.0.0:9090"}, true},
+		{AdminConfig{Listen: "192.0.2.1:9090"}, true},
+		{AdminConfig{Listen: "9090"}, true},
+		{AdminConfig{Listen: ":9090", BearerToken: "secret"}, false},
+	} {
+		if err := c.config.Validate(); (err != nil) != c.wantErr {
+			t.Errorf("%+v.Validate() = %v, want error: %v", c.config, err, c.wantErr)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package service
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/netip"
+	"time"
 
 	"github.com/database64128/shadowsocks-go/conn"
 	"github.com/database64128/shadowsocks-go/direct"
@@ -12,6 +15,11 @@ import (
 	"go.uber.org/zap"
 )
 
+const (
+	// defaultUDPResolveTimeout is the default timeout for resolving domain targets of direct UDP sessions.
+	defaultUDPResolveTimeout = 5 * time.Second
+)
+
 // ClientConfig stores a client configuration.
 // It may be marshaled as or unmarshaled from JSON.
 type ClientConfig struct {
@@ -20,14 +28,77 @@ type ClientConfig struct {
 	Protocol     string    `json:"protocol"`
 	DialerFwmark int       `json:"dialerFwmark"`
 
+	// Netns is the name of the network namespace, as created by ip-netns(8), to create outbound sockets in.
+	// If empty, outbound sockets are created in the current network namespace.
+	// Only supported on Linux. For TCP, only supported by direct clients.
+	Netns string `json:"netns"`
+
+	// DialerInterface is the name of the network interface to bind outbound sockets to with SO_BINDTODEVICE.
+	// Routes select it by selecting the client. If empty, sockets are not bound to an interface.
+	// Only supported on Linux, and requires CAP_NET_RAW. For TCP, only supported by direct clients with the tcp transport.
+	DialerInterface string `json:"dialerInterface"`
+
 	// TCP
 	EnableTCP bool `json:"enableTCP"`
 	DialerTFO bool `json:"dialerTFO"`
 
+	// DialerTimeoutSec bounds the time in seconds spent establishing a TCP connection to the upstream,
+	// so that an unresponsive upstream fails quickly, while a distant one can be given more time.
+	// It also applies to the TCP control connections of socks5 UDP associations.
+	// If zero, the operating system's connect timeout applies.
+	DialerTimeoutSec int `json:"dialerTimeoutSec"`
+
+	// Transport selects the egress stream transport of a direct client.
+	// Transports other than the default "tcp" can be registered with direct.RegisterStreamDialer.
+	Transport string `json:"transport"`
+
+	// DialAllAddresses makes a direct client resolve domain targets to all of their addresses,
+	// and try them one after another until one connects. If false, only the first address is dialed.
+	DialAllAddresses bool `json:"dialAllAddresses"`
+
+	// DialerPreferredFamily is the address family tried first when DialAllAddresses is enabled.
+	// Valid values are "", "IPv4", and "IPv6". An empty string keeps the resolver's order.
+	DialerPreferredFamily string `json:"dialerPreferredFamily"`
+
+	// UnixSocketPrefix makes a direct client connect to Unix domain sockets for domain targets that start with it.
+	// For example, with "unix:", the target "unix:/run/app.sock" connects to the socket at /run/app.sock,
+	// and "unix:@app" to the abstract socket app. The port number of such targets is ignored.
+	// This exposes local services to anyone who can use the client. If empty, domain targets are handled normally.
+	UnixSocketPrefix string `json:"unixSocketPrefix"`
+
+	// Socks5TLS makes a socks5 client connect to the server over TLS (SOCKS5 over TLS).
+	// The server certificate is verified against the system roots for Socks5TLSServerName,
+	// or the endpoint's host if empty. UDP sessions are not encrypted.
+	Socks5TLS           bool   `json:"socks5TLS"`
+	Socks5TLSServerName string `json:"socks5TLSServerName"`
+
+	// TLSWriteCoalesceUsec is the maximum time in microseconds small writes to a TLS server connection
+	// are held back to be sent together in fewer TLS records. Buffered data is also sent when a TLS record
+	// fills up, and before each read from the server, so request/response exchanges are not delayed.
+	// Valid range is [0, 10000]. If zero, writes are not coalesced.
+	TLSWriteCoalesceUsec int `json:"tlsWriteCoalesceUsec"`
+
 	// UDP
 	EnableUDP bool `json:"enableUDP"`
 	MTU       int  `json:"mtu"`
 
+	// UDPLocalPortRange restricts the local ports of outbound UDP sockets to this range.
+	// If unspecified, the kernel picks any ephemeral port.
+	//
+	// With "randomize" set, each socket binds a random port in the range, instead of the next free port.
+	// If the range is unspecified, a random port in the system's ephemeral port range is used,
+	// and the kernel picks the port after several ports in use, so sessions are never refused.
+	UDPLocalPortRange conn.PortRange `json:"udpLocalPortRange"`
+
+	// UDPResolveTimeoutSec bounds the time in seconds spent resolving a domain target of a direct UDP session.
+	// If zero, the default timeout of 5 seconds is used.
+	UDPResolveTimeoutSec int `json:"udpResolveTimeoutSec"`
+
+	// Socks5UDPAssociate makes a socks5 client send a UDP ASSOCIATE request over a new TCP connection for each UDP session,
+	// and send the session's packets to the relay address in the reply. The TCP connection is kept open until the session ends.
+	// If false, packets are sent to the endpoint without an association, which is accepted by most censorship circumvention programs.
+	Socks5UDPAssociate bool `json:"socks5UDPAssociate"`
+
 	// Shadowsocks
 	PSK           []byte   `json:"psk"`
 	IPSKs         [][]byte `json:"iPSKs"`
@@ -46,15 +117,86 @@ func (cc *ClientConfig) TCPClient(logger *zap.Logger) (zerocopy.TCPClient, error
 		return nil, errNetworkDisabled
 	}
 
+	if cc.Netns != "" {
+		if !conn.NetnsSupported {
+			return nil, conn.ErrNetnsUnsupported
+		}
+		if cc.Protocol != "direct" {
+			return nil, fmt.Errorf("netns is not supported by %s TCP clients", cc.Protocol)
+		}
+	}
+
+	if cc.DialerTimeoutSec < 0 {
+		return nil, fmt.Errorf("negative dialerTimeoutSec: %d", cc.DialerTimeoutSec)
+	}
+	dialerTimeout := time.Duration(cc.DialerTimeoutSec) * time.Second
+
+	if cc.UnixSocketPrefix != "" && cc.Protocol != "direct" {
+		return nil, fmt.Errorf("unixSocketPrefix is not supported by %s TCP clients", cc.Protocol)
+	}
+
+	if cc.Socks5TLS && cc.Protocol != "socks5" {
+		return nil, fmt.Errorf("socks5TLS is not supported by %s TCP clients", cc.Protocol)
+	}
+	if cc.TLSWriteCoalesceUsec < 0 || cc.TLSWriteCoalesceUsec > maxTLSWriteCoalesceUsec {
+		return nil, fmt.Errorf("TLS write coalescing delay out of range [0, %d]: %d", maxTLSWriteCoalesceUsec, cc.TLSWriteCoalesceUsec)
+	}
+	if cc.TLSWriteCoalesceUsec > 0 && !cc.Socks5TLS {
+		return nil, errors.New("tlsWriteCoalesceUsec requires socks5TLS")
+	}
+	tlsWriteCoalesceDelay := time.Duration(cc.TLSWriteCoalesceUsec) * time.Microsecond
+
+	if cc.DialerInterface != "" {
+		if !conn.BindToDeviceSupported {
+			return nil, conn.ErrBindToDeviceUnsupported
+		}
+		if cc.Protocol != "direct" {
+			return nil, fmt.Errorf("dialerInterface is not supported by %s TCP clients", cc.Protocol)
+		}
+		if cc.Transport != "" && cc.Transport != "tcp" {
+			return nil, fmt.Errorf("dialerInterface is not supported by transport %s", cc.Transport)
+		}
+	}
+
 	switch cc.Protocol {
 	case "direct":
-		return direct.NewTCPClient(cc.Name, cc.DialerTFO, cc.DialerFwmark), nil
+		var (
+			dialer direct.StreamDialer
+			err    error
+		)
+		if cc.DialerInterface != "" {
+			dialer = direct.NewTCPStreamDialerOnInterface(cc.DialerTFO, cc.DialerFwmark, dialerTimeout, cc.DialerInterface)
+		} else {
+			dialer, err = direct.NewStreamDialer(cc.Transport, cc.DialerTFO, cc.DialerFwmark, dialerTimeout)
+			if err != nil {
+				return nil, err
+			}
+		}
+		dialer = direct.NewNetnsStreamDialer(dialer, cc.Netns)
+		if cc.DialAllAddresses {
+			family, err := parseAddrFamily(cc.DialerPreferredFamily)
+			if err != nil {
+				return nil, err
+			}
+			dialer = direct.NewSequentialStreamDialer(dialer, family)
+		}
+		return direct.NewUnixTCPClient(direct.NewTCPClientWithDialer(cc.Name, dialer), cc.UnixSocketPrefix, dialerTimeout, cc.Netns), nil
 	case "none", "plain":
-		return direct.NewShadowsocksNoneTCPClient(cc.Name, cc.Endpoint.String(), cc.DialerTFO, cc.DialerFwmark), nil
+		return direct.NewShadowsocksNoneTCPClient(cc.Name, cc.Endpoint.String(), cc.DialerTFO, cc.DialerFwmark, dialerTimeout), nil
 	case "socks5":
-		return direct.NewSocks5TCPClient(cc.Name, cc.Endpoint.String(), cc.DialerTFO, cc.DialerFwmark), nil
+		var tlsConfig *tls.Config
+		if cc.Socks5TLS {
+			serverName := cc.Socks5TLSServerName
+			if serverName == "" {
+				serverName = cc.Endpoint.Host()
+			}
+			tlsConfig = &tls.Config{
+				ServerName: serverName,
+			}
+		}
+		return direct.NewSocks5TCPClient(cc.Name, cc.Endpoint.String(), cc.DialerTFO, cc.DialerFwmark, dialerTimeout, tlsConfig, tlsWriteCoalesceDelay), nil
 	case "http":
-		return http.NewProxyClient(cc.Name, cc.Endpoint.String(), cc.DialerTFO, cc.DialerFwmark), nil
+		return http.NewProxyClient(cc.Name, cc.Endpoint.String(), cc.DialerTFO, cc.DialerFwmark, dialerTimeout), nil
 	case "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
 		if cc.cipherConfig == nil {
 			var err error
@@ -67,7 +209,7 @@ func (cc *ClientConfig) TCPClient(logger *zap.Logger) (zerocopy.TCPClient, error
 		if len(cc.UnsafeRequestStreamPrefix) != 0 || len(cc.UnsafeResponseStreamPrefix) != 0 {
 			logger.Warn("Unsafe stream prefix taints the client", zap.String("name", cc.Name))
 		}
-		return ss2022.NewTCPClient(cc.Name, cc.Endpoint.String(), cc.DialerTFO, cc.DialerFwmark, cc.cipherConfig, cc.eihPSKHashes, cc.UnsafeRequestStreamPrefix, cc.UnsafeResponseStreamPrefix), nil
+		return ss2022.NewTCPClient(cc.Name, cc.Endpoint.String(), cc.DialerTFO, cc.DialerFwmark, dialerTimeout, cc.cipherConfig, cc.eihPSKHashes, cc.UnsafeRequestStreamPrefix, cc.UnsafeResponseStreamPrefix), nil
 	default:
 		return nil, fmt.Errorf("unknown protocol: %s", cc.Protocol)
 	}
@@ -82,6 +224,39 @@ func (cc *ClientConfig) UDPClient(logger *zap.Logger) (zerocopy.UDPClient, error
 		return nil, ErrMTUTooSmall
 	}
 
+	if err := cc.UDPLocalPortRange.Validate(); err != nil {
+		return nil, err
+	}
+
+	if cc.Netns != "" && !conn.NetnsSupported {
+		return nil, conn.ErrNetnsUnsupported
+	}
+
+	if cc.DialerInterface != "" && !conn.BindToDeviceSupported {
+		return nil, conn.ErrBindToDeviceUnsupported
+	}
+
+	udpClient, err := cc.udpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	if !cc.UDPLocalPortRange.IsZero() {
+		udpClient = &portRangeUDPClient{udpClient, cc.UDPLocalPortRange}
+	}
+
+	if cc.Netns != "" {
+		udpClient = &netnsUDPClient{udpClient, cc.Netns}
+	}
+
+	if cc.DialerInterface != "" {
+		udpClient = &interfaceUDPClient{udpClient, cc.DialerInterface}
+	}
+
+	return udpClient, nil
+}
+
+func (cc *ClientConfig) udpClient() (zerocopy.UDPClient, error) {
 	var (
 		endpointAddrPort netip.AddrPort
 		err              error
@@ -96,12 +271,24 @@ func (cc *ClientConfig) UDPClient(logger *zap.Logger) (zerocopy.UDPClient, error
 		}
 	}
 
+	if cc.DialerTimeoutSec < 0 {
+		return nil, fmt.Errorf("negative dialerTimeoutSec: %d", cc.DialerTimeoutSec)
+	}
+	dialerTimeout := time.Duration(cc.DialerTimeoutSec) * time.Second
+
 	switch cc.Protocol {
 	case "direct":
-		return direct.NewUDPClient(cc.Name, cc.MTU, cc.DialerFwmark), nil
+		resolveTimeout := defaultUDPResolveTimeout
+		if cc.UDPResolveTimeoutSec > 0 {
+			resolveTimeout = time.Duration(cc.UDPResolveTimeoutSec) * time.Second
+		}
+		return direct.NewUDPClient(cc.Name, cc.MTU, cc.DialerFwmark, resolveTimeout), nil
 	case "none", "plain":
 		return direct.NewShadowsocksNoneUDPClient(endpointAddrPort, cc.Name, cc.MTU, cc.DialerFwmark), nil
 	case "socks5":
+		if cc.Socks5UDPAssociate {
+			return direct.NewSocks5AssociateUDPClient(cc.Name, cc.Endpoint.String(), cc.MTU, cc.DialerTFO, cc.DialerFwmark, dialerTimeout), nil
+		}
 		return direct.NewSocks5UDPClient(endpointAddrPort, cc.Name, cc.MTU, cc.DialerFwmark), nil
 	case "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
 		if cc.cipherConfig == nil {
@@ -122,3 +309,57 @@ func (cc *ClientConfig) UDPClient(logger *zap.Logger) (zerocopy.UDPClient, error
 		return nil, fmt.Errorf("unknown protocol: %s", cc.Protocol)
 	}
 }
+
+// portRangeUDPClient wraps a UDP client and sets the local port range of its sessions.
+type portRangeUDPClient struct {
+	zerocopy.UDPClient
+	portRange conn.PortRange
+}
+
+// NewSession implements the zerocopy.UDPClient NewSession method.
+func (c *portRangeUDPClient) NewSession() (zerocopy.ClientInfo, zerocopy.ClientPacker, zerocopy.ClientUnpacker, error) {
+	clientInfo, packer, unpacker, err := c.UDPClient.NewSession()
+	clientInfo.LocalPortRange = c.portRange
+	return clientInfo, packer, unpacker, err
+}
+
+// netnsUDPClient wraps a UDP client and sets the network namespace of its sessions.
+type netnsUDPClient struct {
+	zerocopy.UDPClient
+	netns string
+}
+
+// NewSession implements the zerocopy.UDPClient NewSession method.
+func (c *netnsUDPClient) NewSession() (zerocopy.ClientInfo, zerocopy.ClientPacker, zerocopy.ClientUnpacker, error) {
+	clientInfo, packer, unpacker, err := c.UDPClient.NewSession()
+	clientInfo.Netns = c.netns
+	return clientInfo, packer, unpacker, err
+}
+
+// interfaceUDPClient wraps a UDP client and sets the network interface of its sessions.
+type interfaceUDPClient struct {
+	zerocopy.UDPClient
+	ifname string
+}
+
+// NewSession implements the zerocopy.UDPClient NewSession method.
+func (c *interfaceUDPClient) NewSession() (zerocopy.ClientInfo, zerocopy.ClientPacker, zerocopy.ClientUnpacker, error) {
+	clientInfo, packer, unpacker, err := c.UDPClient.NewSession()
+	clientInfo.Interface = c.ifname
+	return clientInfo, packer, unpacker, err
+}
+
+// parseAddrFamily parses an address family preference.
+// An empty string returns conn.AddrFamilyAny.
+func parseAddrFamily(family string) (conn.AddrFamily, error) {
+	switch family {
+	case "":
+		return conn.AddrFamilyAny, nil
+	case "IPv4":
+		return conn.AddrFamilyIPv4, nil
+	case "IPv6":
+		return conn.AddrFamilyIPv6, nil
+	default:
+		return 0, fmt.Errorf("invalid dialerPreferredFamily: %s", family)
+	}
+}
@@ -0,0 +1,282 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"go.uber.org/zap"
+)
+
+var errRelayNotStarted = errors.New("relay service is not started")
+
+// handoffBatchFiles is the maximum number of files in a single handoff message.
+// It is kept well below [conn.MaxHandoffFiles], so that the session state of a batch
+// fits in [conn.MaxHandoffDataSize].
+const handoffBatchFiles = 128
+
+// handoffRelay is a relay service whose sockets can be handed off to a new process,
+// so that a binary upgrade does not drop packets sent to the relay, or break established sessions.
+//
+// The listening socket and the NAT sockets of established sessions are handed off, along with
+// the state needed to match a NAT socket to the session the client resumes in the new process.
+// Crypto state is not handed off. The new process sets up each session again from the client's
+// next packet, and reuses the session's NAT socket, so the upstream sees the same source address.
+type handoffRelay interface {
+	Relay
+
+	// ServerConnFile returns a duplicate of the listening socket.
+	// It must be called after Start and before Stop.
+	ServerConnFile() (*os.File, error)
+
+	// AdoptServerConn makes the next Start use the socket of f instead of opening a new one.
+	// f is duplicated, so it may be closed after AdoptServerConn returns.
+	// It must be called before Start.
+	AdoptServerConn(f *os.File) error
+
+	// HandOffSessions returns the state of established sessions, and duplicates of their NAT sockets.
+	// It must be called after Start and before Stop.
+	HandOffSessions() ([]udpSessionHandoff, []*os.File, error)
+
+	// AdoptSessions makes sessions set up after the next Start reuse the NAT sockets of sessions
+	// handed off by the old process. files[i] is the NAT socket of sessions[i].
+	// The files are duplicated, so they may be closed after AdoptSessions returns.
+	// It must be called before Start.
+	AdoptSessions(sessions []udpSessionHandoff, files []*os.File) error
+}
+
+// udpSessionHandoff is the state of a UDP session handed off to a new process.
+type udpSessionHandoff struct {
+	ClientSessionID uint64         `json:"csid"`
+	Client          string         `json:"client"`
+	Username        string         `json:"username"`
+	ClientAddress   netip.AddrPort `json:"clientAddress"`
+}
+
+// handoffMessage is the data of a handoff message.
+//
+// Files[i] names the i-th file in the message. Listening sockets are named after their services.
+// The NAT socket of a session is named by [natConnHandoffName].
+type handoffMessage struct {
+	Files    []string                       `json:"files"`
+	Sessions map[string][]udpSessionHandoff `json:"sessions,omitempty"`
+
+	// Done is true in the last message.
+	Done bool `json:"done"`
+}
+
+// natConnHandoffName returns the handoff name of the NAT socket of a session of service.
+func natConnHandoffName(service string, csid uint64) string {
+	return service + "/natConn/" + strconv.FormatUint(csid, 10)
+}
+
+// adoptUDPConn returns a UDP connection that uses a duplicate of the socket of f.
+func adoptUDPConn(f *os.File) (*net.UDPConn, error) {
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		return nil, fmt.Errorf("adopted socket %s is not a UDP socket", f.Name())
+	}
+	return udpConn, nil
+}
+
+// handoffSender sends files in batches of handoff messages.
+type handoffSender struct {
+	c     *net.UnixConn
+	msg   handoffMessage
+	files []*os.File
+}
+
+// add queues f with name for sending, and sends the batch if it is full.
+// f is closed after it has been sent.
+func (hs *handoffSender) add(name string, f *os.File) error {
+	hs.msg.Files = append(hs.msg.Files, name)
+	hs.files = append(hs.files, f)
+	if len(hs.files) < handoffBatchFiles {
+		return nil
+	}
+	return hs.flush()
+}
+
+// addSession records the state of a session of service in the current batch.
+// It must be called before adding the session's NAT socket.
+func (hs *handoffSender) addSession(service string, session udpSessionHandoff) {
+	if hs.msg.Sessions == nil {
+		hs.msg.Sessions = make(map[string][]udpSessionHandoff)
+	}
+	hs.msg.Sessions[service] = append(hs.msg.Sessions[service], session)
+}
+
+// flush sends the current batch.
+func (hs *handoffSender) flush() error {
+	defer hs.closeFiles()
+
+	b, err := json.Marshal(hs.msg)
+	if err != nil {
+		return err
+	}
+	if err = conn.SendFiles(hs.c, b, hs.files); err != nil {
+		return err
+	}
+	hs.msg = handoffMessage{}
+	return nil
+}
+
+// closeFiles closes the files of the current batch.
+func (hs *handoffSender) closeFiles() {
+	for _, f := range hs.files {
+		f.Close()
+	}
+	hs.files = hs.files[:0]
+}
+
+// HandOff sends the listening sockets and established sessions of running relay services
+// that support handoff over c. The new process calls [Manager.Adopt] on the other end
+// before starting its services.
+//
+// The services keep running. Stop them once the new process has started.
+func (m *Manager) HandOff(c *net.UnixConn) error {
+	if !conn.HandoffSupported {
+		return conn.ErrHandoffUnsupported
+	}
+
+	hs := handoffSender{c: c}
+	defer hs.closeFiles()
+
+	var sessionCount int
+
+	for _, s := range m.services {
+		hr, ok := s.(handoffRelay)
+		if !ok {
+			continue
+		}
+		name := s.String()
+
+		f, err := hr.ServerConnFile()
+		if err != nil {
+			return fmt.Errorf("failed to get listening socket of %s: %w", name, err)
+		}
+		if err = hs.add(name, f); err != nil {
+			return err
+		}
+
+		sessions, natConnFiles, err := hr.HandOffSessions()
+		if err != nil {
+			return fmt.Errorf("failed to get sessions of %s: %w", name, err)
+		}
+		for i, session := range sessions {
+			hs.addSession(name, session)
+			if err = hs.add(natConnHandoffName(name, session.ClientSessionID), natConnFiles[i]); err != nil {
+				// Close the files that were not queued.
+				for _, f := range natConnFiles[i+1:] {
+					f.Close()
+				}
+				return err
+			}
+		}
+		sessionCount += len(sessions)
+	}
+
+	hs.msg.Done = true
+	if err := hs.flush(); err != nil {
+		return err
+	}
+
+	m.logger.Info("Handed off relay sockets", zap.Int("sessions", sessionCount))
+	return nil
+}
+
+// Adopt receives sockets and sessions sent by [Manager.HandOff] of the old process over c,
+// and makes the matching relay services use them when started.
+// Services without a matching socket open new ones, and sockets without a matching service are closed.
+func (m *Manager) Adopt(c *net.UnixConn) error {
+	if !conn.HandoffSupported {
+		return conn.ErrHandoffUnsupported
+	}
+
+	files := make(map[string]*os.File)
+	sessions := make(map[string][]udpSessionHandoff)
+
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for {
+		data, batch, err := conn.ReceiveFiles(c)
+		if err != nil {
+			return err
+		}
+
+		var msg handoffMessage
+		if err = json.Unmarshal(data, &msg); err != nil || len(msg.Files) != len(batch) {
+			for _, f := range batch {
+				f.Close()
+			}
+			if err == nil {
+				err = fmt.Errorf("got %d names for %d files", len(msg.Files), len(batch))
+			}
+			return fmt.Errorf("failed to decode handoff message: %w", err)
+		}
+
+		for i, f := range batch {
+			if _, ok := files[msg.Files[i]]; ok {
+				f.Close()
+				continue
+			}
+			files[msg.Files[i]] = f
+		}
+		for name, ss := range msg.Sessions {
+			sessions[name] = append(sessions[name], ss...)
+		}
+
+		if msg.Done {
+			break
+		}
+	}
+
+	for _, s := range m.services {
+		hr, ok := s.(handoffRelay)
+		if !ok {
+			continue
+		}
+		name := s.String()
+
+		if f, ok := files[name]; ok {
+			if err := hr.AdoptServerConn(f); err != nil {
+				return fmt.Errorf("failed to adopt listening socket of %s: %w", name, err)
+			}
+		}
+
+		var (
+			adoptedSessions []udpSessionHandoff
+			natConnFiles    []*os.File
+		)
+		for _, session := range sessions[name] {
+			if f, ok := files[natConnHandoffName(name, session.ClientSessionID)]; ok {
+				adoptedSessions = append(adoptedSessions, session)
+				natConnFiles = append(natConnFiles, f)
+			}
+		}
+		if err := hr.AdoptSessions(adoptedSessions, natConnFiles); err != nil {
+			return fmt.Errorf("failed to adopt sessions of %s: %w", name, err)
+		}
+
+		m.logger.Info("Adopted relay sockets",
+			zap.String("service", name),
+			zap.Int("sessions", len(adoptedSessions)),
+		)
+	}
+
+	return nil
+}
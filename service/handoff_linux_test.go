@@ -0,0 +1,146 @@
+package service
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/direct"
+	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+func TestManagerHandOffUDPSessionRelay(t *testing.T) {
+	const mtu = 1500
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unixConns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		unixConns[i] = c.(*net.UnixConn)
+	}
+
+	echoConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoConn.Close()
+	echoAddrPort := echoConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	logger := zap.NewNop()
+	udpClientMap := map[string]zerocopy.UDPClient{
+		"direct": direct.NewUDPClient("direct", mtu, 0, 0),
+	}
+	r, err := (&router.Config{}).Router(logger, nil, nil, nil, udpClientMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	makeRelay := func() *UDPSessionRelay {
+		s, err := NewUDPSessionRelay(UDPSessionRelayConfig{
+			BatchMode:     "no",
+			ServerName:    "fake",
+			ListenAddress: "127.0.0.1:0",
+			BatchSize:     8,
+			MTU:           mtu,
+			NATTimeout:    time.Minute,
+		}, &zerocopy.FakeSessionServer{}, nil, r, nil, logger, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	oldRelay := makeRelay()
+	if err = oldRelay.Start(); err != nil {
+		t.Fatal(err)
+	}
+	relayAddrPort := oldRelay.serverConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	clientConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	c := zerocopy.NewFakeSessionClientPackUnpacker(1, 0, relayAddrPort)
+	b := make([]byte, mtu)
+
+	// sendAndEcho sends payload through the relay, and returns the source address
+	// the echo server received it from.
+	sendAndEcho := func(payload string) netip.AddrPort {
+		t.Helper()
+		destAddrPort, packet, err := zerocopy.ClientPackDatagram(c, conn.AddrFromIPPort(echoAddrPort), []byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = clientConn.WriteToUDPAddrPort(packet, destAddrPort); err != nil {
+			t.Fatal(err)
+		}
+		if err = echoConn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		n, addrPort, err := echoConn.ReadFromUDPAddrPort(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b[:n]) != payload {
+			t.Errorf("Echo server received %q, expected %q", b[:n], payload)
+		}
+		return addrPort
+	}
+
+	// Establish a session on the old relay.
+	oldNATAddrPort := sendAndEcho("before handoff")
+	oldSessions := oldRelay.Snapshot()
+	if len(oldSessions) != 1 || oldSessions[0].NATLocalAddress.Port() != oldNATAddrPort.Port() {
+		t.Fatalf("Old relay sessions = %+v, expected 1 session on port %d", oldSessions, oldNATAddrPort.Port())
+	}
+
+	oldManager := &Manager{services: []Relay{oldRelay}, logger: logger}
+	if err = oldManager.HandOff(unixConns[0]); err != nil {
+		t.Fatalf("HandOff failed: %v", err)
+	}
+
+	newRelay := makeRelay()
+	newManager := &Manager{services: []Relay{newRelay}, logger: logger}
+	if err = newManager.Adopt(unixConns[1]); err != nil {
+		t.Fatalf("Adopt failed: %v", err)
+	}
+	if err = newRelay.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer newRelay.Stop()
+
+	if addrPort := newRelay.serverConn.LocalAddr().(*net.UDPAddr).AddrPort(); addrPort != relayAddrPort {
+		t.Fatalf("New relay listens on %s, expected %s", addrPort, relayAddrPort)
+	}
+
+	// After the old relay stops, packets are relayed by the new relay,
+	// and the session keeps its NAT socket.
+	if err = oldRelay.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if natAddrPort := sendAndEcho("after handoff"); natAddrPort != oldNATAddrPort {
+		t.Errorf("Echo server received from %s after handoff, expected %s", natAddrPort, oldNATAddrPort)
+	}
+	newSessions := newRelay.Snapshot()
+	if len(newSessions) != 1 || newSessions[0].NATLocalAddress != oldSessions[0].NATLocalAddress {
+		t.Errorf("New relay sessions = %+v, expected 1 session on %s", newSessions, oldSessions[0].NATLocalAddress)
+	}
+}
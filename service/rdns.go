@@ -0,0 +1,176 @@
+package service
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// reverseLookupQueueSize is the maximum number of addresses waiting to be looked up.
+	// Addresses are dropped when the queue is full, and retried the next time they are requested.
+	reverseLookupQueueSize = 64
+
+	// reverseLookupInterval is the minimum time between two reverse lookups.
+	reverseLookupInterval = 100 * time.Millisecond
+
+	// reverseLookupTimeout is the timeout of a single reverse lookup.
+	reverseLookupTimeout = 5 * time.Second
+
+	// reverseLookupTTL is how long a lookup result, including a failed one, is cached.
+	reverseLookupTTL = time.Hour
+
+	// reverseLookupMaxEntries is the maximum number of cached results.
+	// When the cache is full, expired results are evicted. If none are expired, the cache is cleared.
+	reverseLookupMaxEntries = 4096
+)
+
+// reverseLookupResult is a cached reverse lookup result.
+type reverseLookupResult struct {
+	// name is the first PTR name of the address, without the trailing dot.
+	// It is empty if the lookup failed or is still pending.
+	name string
+
+	// expiry is when the result expires. It is the zero value if the lookup is still pending.
+	expiry time.Time
+}
+
+// reverseLookupCache looks up PTR names of IP addresses in the background and caches the results.
+//
+// Name never blocks. Lookups are rate-limited to one every reverseLookupInterval.
+type reverseLookupCache struct {
+	lookupAddr func(ctx context.Context, addr string) ([]string, error)
+	logger     *zap.Logger
+
+	// mu protects cache.
+	mu    sync.Mutex
+	cache map[netip.Addr]reverseLookupResult
+
+	queue chan netip.Addr
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// newReverseLookupCache returns a new reverse lookup cache that uses lookupAddr for lookups.
+func newReverseLookupCache(lookupAddr func(ctx context.Context, addr string) ([]string, error), logger *zap.Logger) *reverseLookupCache {
+	return &reverseLookupCache{
+		lookupAddr: lookupAddr,
+		logger:     logger,
+		cache:      make(map[netip.Addr]reverseLookupResult),
+		queue:      make(chan netip.Addr, reverseLookupQueueSize),
+	}
+}
+
+// newSystemReverseLookupCache returns a new reverse lookup cache that uses the system resolver.
+func newSystemReverseLookupCache(logger *zap.Logger) *reverseLookupCache {
+	return newReverseLookupCache(net.DefaultResolver.LookupAddr, logger)
+}
+
+// Start starts the lookup goroutine.
+func (c *reverseLookupCache) Start() {
+	c.done = make(chan struct{})
+	c.wg.Add(1)
+
+	go func() {
+		defer c.wg.Done()
+
+		ticker := time.NewTicker(reverseLookupInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case addr := <-c.queue:
+				c.lookup(addr)
+			case <-c.done:
+				return
+			}
+
+			select {
+			case <-ticker.C:
+			case <-c.done:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the lookup goroutine and waits for it to exit.
+func (c *reverseLookupCache) Stop() {
+	if c.done == nil {
+		return
+	}
+	close(c.done)
+	c.wg.Wait()
+	c.done = nil
+}
+
+// Name returns the cached PTR name of addr, and whether one was found.
+// If addr is not cached, or its cached result has expired, a lookup is queued.
+func (c *reverseLookupCache) Name(addr netip.Addr) (string, bool) {
+	addr = addr.Unmap()
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result, ok := c.cache[addr]
+	switch {
+	case ok && result.expiry.IsZero(): // pending
+		return "", false
+	case ok && result.expiry.After(now):
+		return result.name, result.name != ""
+	}
+
+	select {
+	case c.queue <- addr:
+		c.cache[addr] = reverseLookupResult{}
+	default:
+	}
+
+	return "", false
+}
+
+// lookup looks up addr and caches the result.
+func (c *reverseLookupCache) lookup(addr netip.Addr) {
+	ctx, cancel := context.WithTimeout(context.Background(), reverseLookupTimeout)
+	names, err := c.lookupAddr(ctx, addr.String())
+	cancel()
+
+	var name string
+	if err != nil {
+		if ce := c.logger.Check(zap.DebugLevel, "Failed to look up PTR name"); ce != nil {
+			ce.Write(
+				zap.Stringer("addr", addr),
+				zap.Error(err),
+			)
+		}
+	} else if len(names) > 0 {
+		name = strings.TrimSuffix(names[0], ".")
+	}
+
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.cache) >= reverseLookupMaxEntries {
+		for a, r := range c.cache {
+			if !r.expiry.IsZero() && !r.expiry.After(now) {
+				delete(c.cache, a)
+			}
+		}
+		if len(c.cache) >= reverseLookupMaxEntries {
+			c.cache = make(map[netip.Addr]reverseLookupResult)
+		}
+	}
+
+	c.cache[addr] = reverseLookupResult{
+		name:   name,
+		expiry: now.Add(reverseLookupTTL),
+	}
+}
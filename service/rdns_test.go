@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestReverseLookupCache(t *testing.T) {
+	var lookups atomic.Int32
+	c := newReverseLookupCache(func(ctx context.Context, addr string) ([]string, error) {
+		lookups.Add(1)
+		switch addr {
+		case "192.0.2.1":
+			return []string{"one.example.com.", "uno.example.com."}, nil
+		default:
+			return nil, errors.New("no such host")
+		}
+	}, zap.NewNop())
+
+	found := netip.MustParseAddr("192.0.2.1")
+	notFound := netip.MustParseAddr("192.0.2.2")
+
+	// Nothing is cached before the lookup goroutine starts, and repeated requests are only queued once.
+	for i := 0; i < 2; i++ {
+		if name, ok := c.Name(found); ok {
+			t.Fatalf("Name(%s) returned %q before lookup", found, name)
+		}
+	}
+	if _, ok := c.Name(notFound); ok {
+		t.Fatalf("Name(%s) returned true before lookup", notFound)
+	}
+
+	c.Start()
+	defer c.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		done := !c.cache[found].expiry.IsZero() && !c.cache[notFound].expiry.IsZero()
+		c.mu.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for lookups")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if name, ok := c.Name(found); !ok || name != "one.example.com" {
+		t.Errorf("Name(%s) returned %q, %v, expected %q, true", found, name, ok, "one.example.com")
+	}
+
+	// IPv4-mapped IPv6 addresses share the cache entry of the IPv4 address.
+	if name, ok := c.Name(netip.AddrFrom16(found.As16())); !ok || name != "one.example.com" {
+		t.Errorf("Name(%s) returned %q, %v, expected %q, true", netip.AddrFrom16(found.As16()), name, ok, "one.example.com")
+	}
+
+	// Failed lookups are cached too.
+	if name, ok := c.Name(notFound); ok {
+		t.Errorf("Name(%s) returned %q, expected not found", notFound, name)
+	}
+
+	if n := lookups.Load(); n != 2 {
+		t.Errorf("Looked up %d times, expected 2", n)
+	}
+}
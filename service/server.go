@@ -1,6 +1,8 @@
 package service
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"time"
 
@@ -8,7 +10,9 @@ import (
 	"github.com/database64128/shadowsocks-go/direct"
 	"github.com/database64128/shadowsocks-go/http"
 	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/socks5"
 	"github.com/database64128/shadowsocks-go/ss2022"
+	"github.com/database64128/shadowsocks-go/stats"
 	"github.com/database64128/shadowsocks-go/zerocopy"
 	"go.uber.org/zap"
 )
@@ -26,11 +30,155 @@ type ServerConfig struct {
 	ListenerTFO               bool `json:"listenerTFO"`
 	DisableInitialPayloadWait bool `json:"disableInitialPayloadWait"`
 
+	// ListenerBacklog sets the accept queue backlog of the TCP listener.
+	// If zero, the system maximum is used, which is what Go listens with by default.
+	// Larger values are clamped to the system maximum (net.core.somaxconn on Linux).
+	// Only supported on Linux, macOS, and FreeBSD.
+	ListenerBacklog int `json:"listenerBacklog"`
+
+	// SniffDomain enables sniffing the TLS ClientHello SNI or the HTTP Host header
+	// from the initial payload of TCP connections to IP addresses.
+	// The sniffed name is used for domain-based routing. The connection is still made to the requested IP address.
+	SniffDomain bool `json:"sniffDomain"`
+
+	// PreferClientAddressFamily makes direct clients resolve domain targets of TCP connections
+	// preferring addresses of the same family as the client's connection,
+	// so clients connecting over IPv6 are relayed over IPv6 when the target supports it, and likewise for IPv4.
+	// Domain targets routed to proxy clients are passed on unresolved.
+	PreferClientAddressFamily bool `json:"preferClientAddressFamily"`
+
 	// UDP
 	EnableUDP     bool `json:"enableUDP"`
 	MTU           int  `json:"mtu"`
 	NatTimeoutSec int  `json:"natTimeoutSec"`
 
+	// UDPListenerReuseAddr sets SO_REUSEADDR on the UDP listener, so that a restarted server
+	// can bind its listen address right away. Disabled by default, because a listen address
+	// bound twice with SO_REUSEADDR does not fail, which would mask configuration errors.
+	// Only supported on Linux, macOS, and FreeBSD, and not by tproxy servers.
+	UDPListenerReuseAddr bool `json:"udpListenerReuseAddr"`
+
+	// Shadowsocks 2022 UDP
+	//
+	// The following UDP options are only supported by Shadowsocks 2022 servers,
+	// and are rejected for servers of other protocols.
+
+	// DebugPacketTap enables logging of relayed packets at debug level.
+	DebugPacketTap bool `json:"debugPacketTap"`
+
+	// IPv6FlowLabel enables setting a stable IPv6 flow label on each session's outbound datagrams,
+	// so that load balancers keep all packets of a session on the same path.
+	// Only supported in sendmmsg batch mode on Linux.
+	IPv6FlowLabel bool `json:"ipv6FlowLabel"`
+
+	// AdaptiveRecvBuffer makes each session start with small natConn receive buffers
+	// that grow toward the maximum packet size when truncated packets are received.
+	// This lowers memory usage for sessions that only carry small packets,
+	// at the cost of dropping one truncated packet per growth step.
+	// Growth relies on MSG_TRUNC, so it is not supported on platforms that do not report it, such as Windows.
+	AdaptiveRecvBuffer bool `json:"adaptiveRecvBuffer"`
+
+	// ValidateNATSource drops packets received on a session's outbound socket before unpacking,
+	// unless they come from an address the session has sent packets to.
+	// This saves the cost of unpacking spoofed packets.
+	ValidateNATSource bool `json:"validateNATSource"`
+
+	// LogSessionUpstream logs the upstream address of each UDP session at Info level
+	// after the first successful write to the upstream.
+	LogSessionUpstream bool `json:"logSessionUpstream"`
+
+	// ReverseLookupTargets includes PTR names of IP targets in UDP session logs.
+	// Lookups are done in the background with the system resolver, rate-limited and cached,
+	// so a name only shows up once its lookup has completed.
+	// Lookups leak target addresses to the system resolver, so this is disabled by default.
+	ReverseLookupTargets bool `json:"reverseLookupTargets"`
+
+	// RecvICMPErrors enables receiving ICMP errors triggered by packets sent to UDP session upstreams.
+	// Errors are counted and logged at Debug level, and a session is torn down when its upstream returns port unreachable.
+	// Only supported on Linux.
+	RecvICMPErrors bool `json:"recvICMPErrors"`
+
+	// RecvTimestamps enables kernel receive timestamps on the UDP listener, to measure how long
+	// packets from clients spend in the relay before being sent upstream.
+	// Only supported on Linux.
+	RecvTimestamps bool `json:"recvTimestamps"`
+
+	// UnpackFailureThreshold is the number of consecutive packets from an established session's client
+	// that may fail authentication before the session is torn down and its session ID temporarily blocked.
+	// Packets rejected by the replay window are dropped without counting towards the threshold,
+	// since network duplication and reordering also produce them.
+	// If zero, sessions are never torn down for unpack failures.
+	UnpackFailureThreshold int `json:"unpackFailureThreshold"`
+
+	// SessionSweepIntervalSec enables a background sweeper that scans the session table every this many seconds,
+	// and removes sessions that have been without an outbound socket for longer than the NAT timeout.
+	// This is a safety net for sessions that failed to clean up after a setup failure.
+	// If zero, the sweeper is disabled.
+	SessionSweepIntervalSec int `json:"sessionSweepIntervalSec"`
+
+	// SessionAffinityWindowSec is how many seconds the upstream selection of a closed UDP session is remembered.
+	// A session recreated with the same session ID within the window reuses the same upstream client,
+	// unless the router has been replaced or the client is draining or down.
+	// If zero, each session is routed anew.
+	SessionAffinityWindowSec int `json:"sessionAffinityWindowSec"`
+
+	// MaxSessionQueuedBytes limits the total payload length of packets queued for sending to each UDP session's upstream.
+	// Packets that would exceed the limit are dropped, as are packets that arrive when the queue is full.
+	// If zero, only the number of queued packets is limited.
+	MaxSessionQueuedBytes int `json:"maxSessionQueuedBytes"`
+
+	// MaxConcurrentSessionSetups limits the number of UDP sessions being set up at the same time,
+	// so a burst of new sessions does not overwhelm the resolver with concurrent lookups and dials.
+	// Excess setups wait briefly for a slot, and fail if none becomes available.
+	// If zero, session setups are not limited.
+	MaxConcurrentSessionSetups int `json:"maxConcurrentSessionSetups"`
+
+	// UDPSourcePacketRateLimit limits the number of packets per second accepted from each client IP address,
+	// and UDPSourceByteRateLimit the number of bytes per second. Both are applied before packets are authenticated,
+	// so that spoofed sources cannot use the relay for reflection or amplification. Packets over the limits are dropped.
+	// If zero, the corresponding rate is not limited.
+	UDPSourcePacketRateLimit uint64 `json:"udpSourcePacketRateLimit"`
+	UDPSourceByteRateLimit   uint64 `json:"udpSourceByteRateLimit"`
+
+	// UDPMirrorClient is the name of a UDP client that receives a copy of every packet
+	// each UDP session sends upstream, for validating a new upstream under real traffic.
+	// The routed upstream remains authoritative: replies from the mirror are discarded,
+	// and copies are dropped when the mirror falls behind.
+	// If empty, traffic is not mirrored.
+	UDPMirrorClient string `json:"udpMirrorClient"`
+
+	// SOCKS5
+
+	// TLSCertPath and TLSKeyPath are paths to the PEM-encoded certificate chain and private key.
+	// If set, the SOCKS5 server accepts connections over TLS (SOCKS5 over TLS).
+	// UDP ASSOCIATE is still supported, but the UDP relay is not encrypted.
+	TLSCertPath string `json:"tlsCertPath"`
+	TLSKeyPath  string `json:"tlsKeyPath"`
+
+	// TLSWriteCoalesceUsec is the maximum time in microseconds small writes to a TLS client connection
+	// are held back to be sent together in fewer TLS records. Buffered data is also sent when a TLS record
+	// fills up, and before each read from the client, so request/response exchanges are not delayed.
+	// Valid range is [0, 10000]. If zero, writes are not coalesced.
+	TLSWriteCoalesceUsec int `json:"tlsWriteCoalesceUsec"`
+
+	// Users enables username/password authentication for the SOCKS5 server.
+	// If empty, no authentication is required.
+	Users []socks5.UserInfo `json:"users"`
+
+	// NoIPv6EgressReply enables rejecting CONNECT requests to IPv6 addresses when the host has no IPv6 egress,
+	// so clients fail fast instead of waiting for a dial to fail.
+	// IPv6 egress is detected once at startup by looking up the route to a global IPv6 address.
+	//
+	// Valid values are "AddressNotSupported" and "NetworkUnreachable", which select the reply sent to the client.
+	// If empty, IPv6 targets are always accepted.
+	NoIPv6EgressReply string `json:"noIPv6EgressReply"`
+
+	// UDPAssociateMaxHoldSec is the maximum time in seconds a UDP ASSOCIATE control connection is held open.
+	// When it is exceeded, the control connection is closed even if the client keeps it open,
+	// which ends the association. Dead clients are detected separately by TCP keep-alive.
+	// If zero, associations are held open until the client closes the control connection.
+	UDPAssociateMaxHoldSec int `json:"udpAssociateMaxHoldSec"`
+
 	// Simple tunnel
 	TunnelRemoteAddress conn.Addr `json:"tunnelRemoteAddress"`
 	TunnelUDPTargetOnly bool      `json:"tunnelUDPTargetOnly"`
@@ -50,16 +198,22 @@ type ServerConfig struct {
 }
 
 // TCPRelay creates a TCP relay service from the ServerConfig.
-func (sc *ServerConfig) TCPRelay(router *router.Router, logger *zap.Logger) (*TCPRelay, error) {
+// If hook is not nil, it is installed on the relay. See [TCPConnHook].
+func (sc *ServerConfig) TCPRelay(router *router.Router, collector *stats.Collector, logger *zap.Logger, hook TCPConnHook) (*TCPRelay, error) {
 	if !sc.EnableTCP && sc.Protocol != "socks5" {
 		return nil, errNetworkDisabled
 	}
 
+	if sc.ListenerBacklog < 0 {
+		return nil, fmt.Errorf("negative listenerBacklog: %d", sc.ListenerBacklog)
+	}
+
 	var (
 		server              zerocopy.TCPServer
 		connCloser          zerocopy.TCPConnCloser
 		err                 error
 		listenerTransparent bool
+		relay               *TCPRelay
 	)
 
 	switch sc.Protocol {
@@ -77,7 +231,61 @@ func (sc *ServerConfig) TCPRelay(router *router.Router, logger *zap.Logger) (*TC
 		server = direct.NewShadowsocksNoneTCPServer()
 
 	case "socks5":
-		server = direct.NewSocks5TCPServer(sc.EnableTCP, sc.EnableUDP)
+		var tlsConfig *tls.Config
+		if sc.TLSCertPath != "" || sc.TLSKeyPath != "" {
+			cert, err := tls.LoadX509KeyPair(sc.TLSCertPath, sc.TLSKeyPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+			}
+			tlsConfig = &tls.Config{
+				Certificates: []tls.Certificate{cert},
+			}
+		}
+		if sc.TLSWriteCoalesceUsec < 0 || sc.TLSWriteCoalesceUsec > maxTLSWriteCoalesceUsec {
+			return nil, fmt.Errorf("TLS write coalescing delay out of range [0, %d]: %d", maxTLSWriteCoalesceUsec, sc.TLSWriteCoalesceUsec)
+		}
+		tlsWriteCoalesceDelay := time.Duration(sc.TLSWriteCoalesceUsec) * time.Microsecond
+		var (
+			authenticator   socks5.Authenticator
+			authorizeTarget socks5.TargetAuthorizer
+		)
+		for _, u := range sc.Users {
+			if err := u.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid user %q: %w", u.Username, err)
+			}
+		}
+		if len(sc.Users) > 0 {
+			authenticator = socks5.NewMapAuthenticator(sc.Users)
+			// Reply "connection not allowed by ruleset" to disallowed targets,
+			// instead of closing the connection after a successful reply.
+			// Load the relay's current router, so that allowlists follow router swaps.
+			authorizeTarget = func(username string, targetAddr conn.Addr) bool {
+				return relay.router.Load().AllowsTarget(username, targetAddr)
+			}
+		}
+		ipv6Reply, err := parseNoIPv6EgressReply(sc.NoIPv6EgressReply)
+		if err != nil {
+			return nil, err
+		}
+		if ipv6Reply != socks5.Succeeded && conn.HasIPv6Egress() {
+			ipv6Reply = socks5.Succeeded
+		}
+		if sc.UDPAssociateMaxHoldSec < 0 {
+			return nil, fmt.Errorf("negative udpAssociateMaxHoldSec: %d", sc.UDPAssociateMaxHoldSec)
+		}
+		udpAssociateMaxHold := time.Duration(sc.UDPAssociateMaxHoldSec) * time.Second
+		server = direct.NewSocks5TCPServer(direct.Socks5TCPServerConfig{
+			Socks5ServerConfig: direct.Socks5ServerConfig{
+				EnableTCP:           sc.EnableTCP,
+				EnableUDP:           sc.EnableUDP,
+				IPv6Reply:           ipv6Reply,
+				UDPAssociateMaxHold: udpAssociateMaxHold,
+				Authenticator:       authenticator,
+				AuthorizeTarget:     authorizeTarget,
+			},
+			TLSConfig:             tlsConfig,
+			TLSWriteCoalesceDelay: tlsWriteCoalesceDelay,
+		})
 
 	case "http":
 		server = http.NewProxyServer(logger)
@@ -115,11 +323,27 @@ func (sc *ServerConfig) TCPRelay(router *router.Router, logger *zap.Logger) (*TC
 
 	waitForInitialPayload := !server.NativeInitialPayload() && !sc.DisableInitialPayloadWait
 
-	return NewTCPRelay(sc.Name, sc.Listen, sc.ListenerFwmark, sc.ListenerTFO, listenerTransparent, waitForInitialPayload, server, connCloser, sc.UnsafeFallbackAddress, router, logger), nil
+	relay = NewTCPRelay(TCPRelayConfig{
+		ServerName:            sc.Name,
+		ListenAddress:         sc.Listen,
+		ListenerFwmark:        sc.ListenerFwmark,
+		ListenerTFO:           sc.ListenerTFO,
+		ListenerTransparent:   listenerTransparent,
+		ListenBacklog:         sc.ListenerBacklog,
+		WaitForInitialPayload: waitForInitialPayload,
+		SniffDomain:           sc.SniffDomain,
+		PreferClientFamily:    sc.PreferClientAddressFamily,
+		FallbackAddress:       sc.UnsafeFallbackAddress,
+	}, server, connCloser, router, collector, logger, hook)
+	return relay, nil
 }
 
 // UDPRelay creates a UDP relay service from the ServerConfig.
-func (sc *ServerConfig) UDPRelay(router *router.Router, logger *zap.Logger, batchMode string, batchSize, maxClientFrontHeadroom, maxClientRearHeadroom int) (Relay, error) {
+//
+// batchLinger only applies to the session relay in sendmmsg batch mode.
+// prewarmPackets is the number of queued packets to pre-allocate when the relay starts.
+// udpClientMap is used to look up the mirror client.
+func (sc *ServerConfig) UDPRelay(router *router.Router, collector *stats.Collector, logger *zap.Logger, batchMode string, batchSize, prewarmPackets int, batchLinger time.Duration, maxClientHeadroom zerocopy.Headroom, udpClientMap map[string]zerocopy.UDPClient) (Relay, error) {
 	if !sc.EnableUDP {
 		return nil, errNetworkDisabled
 	}
@@ -128,6 +352,14 @@ func (sc *ServerConfig) UDPRelay(router *router.Router, logger *zap.Logger, batc
 		return nil, ErrMTUTooSmall
 	}
 
+	if err := sc.checkUDPSessionRelayOptions(); err != nil {
+		return nil, err
+	}
+
+	if sc.AdaptiveRecvBuffer && !conn.ReportsMessageTruncation {
+		return nil, errors.New("adaptiveRecvBuffer is not supported on this platform")
+	}
+
 	var (
 		natTimeout time.Duration
 		natServer  zerocopy.UDPNATServer
@@ -144,6 +376,48 @@ func (sc *ServerConfig) UDPRelay(router *router.Router, logger *zap.Logger, batc
 		natTimeout = time.Duration(sc.NatTimeoutSec) * time.Second
 	}
 
+	if sc.SessionSweepIntervalSec < 0 {
+		return nil, fmt.Errorf("negative sessionSweepIntervalSec: %d", sc.SessionSweepIntervalSec)
+	}
+
+	if sc.SessionAffinityWindowSec < 0 {
+		return nil, fmt.Errorf("negative sessionAffinityWindowSec: %d", sc.SessionAffinityWindowSec)
+	}
+
+	if sc.MaxSessionQueuedBytes < 0 {
+		return nil, fmt.Errorf("negative maxSessionQueuedBytes: %d", sc.MaxSessionQueuedBytes)
+	}
+
+	if sc.MaxConcurrentSessionSetups < 0 {
+		return nil, fmt.Errorf("negative maxConcurrentSessionSetups: %d", sc.MaxConcurrentSessionSetups)
+	}
+
+	if sc.RecvICMPErrors && !conn.RecvErrSupported {
+		return nil, conn.ErrRecvErrUnsupported
+	}
+
+	if sc.RecvTimestamps && !conn.RecvTimestampSupported {
+		return nil, conn.ErrRecvTimestampUnsupported
+	}
+
+	if sc.UDPListenerReuseAddr {
+		if !conn.ReuseAddrSupported {
+			return nil, errors.New("udpListenerReuseAddr is not supported on this platform")
+		}
+		if sc.Protocol == "tproxy" {
+			return nil, errors.New("udpListenerReuseAddr is not supported by tproxy servers")
+		}
+	}
+
+	var mirror zerocopy.UDPClient
+	if sc.UDPMirrorClient != "" {
+		var ok bool
+		mirror, ok = udpClientMap[sc.UDPMirrorClient]
+		if !ok {
+			return nil, fmt.Errorf("mirror client not found: %s", sc.UDPMirrorClient)
+		}
+	}
+
 	switch sc.Protocol {
 	case "direct":
 		natServer = direct.NewDirectUDPNATServer(sc.TunnelRemoteAddress, sc.TunnelUDPTargetOnly)
@@ -178,12 +452,112 @@ func (sc *ServerConfig) UDPRelay(router *router.Router, logger *zap.Logger, batc
 
 	switch sc.Protocol {
 	case "direct", "none", "plain", "socks5":
-		return NewUDPNATRelay(batchMode, sc.Name, sc.Listen, batchSize, sc.ListenerFwmark, sc.MTU, maxClientFrontHeadroom, maxClientRearHeadroom, natTimeout, natServer, router, logger), nil
+		relay, err := NewUDPNATRelay(UDPNATRelayConfig{
+			BatchMode:         batchMode,
+			ServerName:        sc.Name,
+			ListenAddress:     sc.Listen,
+			BatchSize:         batchSize,
+			PrewarmPackets:    prewarmPackets,
+			ListenerFwmark:    sc.ListenerFwmark,
+			MTU:               sc.MTU,
+			MaxClientHeadroom: maxClientHeadroom,
+			NATTimeout:        natTimeout,
+			ListenerReuseAddr: sc.UDPListenerReuseAddr,
+		}, natServer, router, logger)
+		if err != nil {
+			return nil, err
+		}
+		return relay, nil
 	case "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
-		return NewUDPSessionRelay(batchMode, sc.Name, sc.Listen, batchSize, sc.ListenerFwmark, sc.MTU, maxClientFrontHeadroom, maxClientRearHeadroom, natTimeout, server, router, logger), nil
+		var tap PacketTap
+		if sc.DebugPacketTap {
+			tap = NewLoggerPacketTap(sc.Name, logger)
+		}
+		relay, err := NewUDPSessionRelay(UDPSessionRelayConfig{
+			BatchMode:              batchMode,
+			ServerName:             sc.Name,
+			ListenAddress:          sc.Listen,
+			BatchSize:              batchSize,
+			PrewarmPackets:         prewarmPackets,
+			ListenerFwmark:         sc.ListenerFwmark,
+			MTU:                    sc.MTU,
+			MaxClientHeadroom:      maxClientHeadroom,
+			BatchLinger:            batchLinger,
+			NATTimeout:             natTimeout,
+			SweepInterval:          time.Duration(sc.SessionSweepIntervalSec) * time.Second,
+			AffinityWindow:         time.Duration(sc.SessionAffinityWindowSec) * time.Second,
+			ListenerReuseAddr:      sc.UDPListenerReuseAddr,
+			IPv6FlowLabel:          sc.IPv6FlowLabel,
+			AdaptiveRecvBuf:        sc.AdaptiveRecvBuffer,
+			ValidateNATSource:      sc.ValidateNATSource,
+			LogSessionUpstream:     sc.LogSessionUpstream,
+			ReverseLookupTargets:   sc.ReverseLookupTargets,
+			RecvICMPErrors:         sc.RecvICMPErrors,
+			RecvTimestamps:         sc.RecvTimestamps,
+			UnpackFailureThreshold: sc.UnpackFailureThreshold,
+			MaxQueuedBytes:         sc.MaxSessionQueuedBytes,
+			MaxConcurrentSetups:    sc.MaxConcurrentSessionSetups,
+			SourcePacketRateLimit:  sc.UDPSourcePacketRateLimit,
+			SourceByteRateLimit:    sc.UDPSourceByteRateLimit,
+		}, server, mirror, router, collector, logger, tap)
+		if err != nil {
+			return nil, err
+		}
+		return relay, nil
 	case "tproxy":
-		return NewUDPTransparentRelay(sc.Name, sc.Listen, batchSize, sc.ListenerFwmark, sc.MTU, maxClientFrontHeadroom, maxClientRearHeadroom, natTimeout, router, logger)
+		return NewUDPTransparentRelay(sc.Name, sc.Listen, batchSize, prewarmPackets, sc.ListenerFwmark, sc.MTU, maxClientHeadroom, natTimeout, router, logger)
 	default:
 		return nil, fmt.Errorf("invalid protocol: %s", sc.Protocol)
 	}
 }
+
+// checkUDPSessionRelayOptions returns an error if any option only supported by
+// Shadowsocks 2022 UDP relays is set for a server of another protocol.
+func (sc *ServerConfig) checkUDPSessionRelayOptions() error {
+	switch sc.Protocol {
+	case "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
+		return nil
+	}
+
+	for _, o := range []struct {
+		name string
+		set  bool
+	}{
+		{"debugPacketTap", sc.DebugPacketTap},
+		{"ipv6FlowLabel", sc.IPv6FlowLabel},
+		{"adaptiveRecvBuffer", sc.AdaptiveRecvBuffer},
+		{"validateNATSource", sc.ValidateNATSource},
+		{"logSessionUpstream", sc.LogSessionUpstream},
+		{"reverseLookupTargets", sc.ReverseLookupTargets},
+		{"recvICMPErrors", sc.RecvICMPErrors},
+		{"recvTimestamps", sc.RecvTimestamps},
+		{"unpackFailureThreshold", sc.UnpackFailureThreshold != 0},
+		{"sessionSweepIntervalSec", sc.SessionSweepIntervalSec != 0},
+		{"sessionAffinityWindowSec", sc.SessionAffinityWindowSec != 0},
+		{"maxSessionQueuedBytes", sc.MaxSessionQueuedBytes != 0},
+		{"maxConcurrentSessionSetups", sc.MaxConcurrentSessionSetups != 0},
+		{"udpSourcePacketRateLimit", sc.UDPSourcePacketRateLimit != 0},
+		{"udpSourceByteRateLimit", sc.UDPSourceByteRateLimit != 0},
+		{"udpMirrorClient", sc.UDPMirrorClient != ""},
+	} {
+		if o.set {
+			return fmt.Errorf("%s is not supported by %s UDP relays", o.name, sc.Protocol)
+		}
+	}
+	return nil
+}
+
+// parseNoIPv6EgressReply parses the SOCKS5 reply to send for IPv6 targets when the host has no IPv6 egress.
+// An empty string returns socks5.Succeeded, which disables rejecting IPv6 targets.
+func parseNoIPv6EgressReply(reply string) (byte, error) {
+	switch reply {
+	case "":
+		return socks5.Succeeded, nil
+	case "AddressNotSupported":
+		return socks5.ErrAddressNotSupported, nil
+	case "NetworkUnreachable":
+		return socks5.ErrNetworkUnreachable, nil
+	default:
+		return 0, fmt.Errorf("invalid noIPv6EgressReply: %s", reply)
+	}
+}
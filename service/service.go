@@ -3,9 +3,14 @@ package service
 import (
 	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/database64128/shadowsocks-go/dns"
+	"github.com/database64128/shadowsocks-go/logging"
 	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/stats"
 	"github.com/database64128/shadowsocks-go/zerocopy"
 	"go.uber.org/zap"
 )
@@ -34,6 +39,42 @@ type Config struct {
 	Router       router.Config        `json:"router"`
 	UDPBatchMode string               `json:"udpBatchMode"`
 	UDPBatchSize int                  `json:"udpBatchSize"`
+
+	// UDPBatchLingerUsec is the maximum time in microseconds the sendmmsg(2) batcher waits
+	// for more packets after dequeuing the first packet of a batch.
+	//
+	// A small linger raises batch sizes and cuts syscalls on medium-rate flows,
+	// at the cost of up to this much added latency per batch.
+	// If zero, batches are sent as soon as the send channel is drained.
+	UDPBatchLingerUsec int `json:"udpBatchLingerUsec"`
+
+	// UDPPrewarmPackets is the number of queued packet buffers each UDP relay pre-allocates at start,
+	// so that an immediate burst of traffic does not cause an allocation and GC spike.
+	// If zero, buffers are allocated on demand.
+	UDPPrewarmPackets int `json:"udpPrewarmPackets"`
+
+	// WarnSamplingInitial is the number of warnings with the same message each relay service logs per second
+	// before sampling kicks in. Errors and logs of other levels are never sampled.
+	// If zero, warnings are not sampled.
+	WarnSamplingInitial int `json:"warnSamplingInitial"`
+
+	// WarnSamplingThereafter makes relay services log every WarnSamplingThereafter-th warning with the same message
+	// after the first WarnSamplingInitial in a second. If zero, the rest are dropped.
+	WarnSamplingThereafter int `json:"warnSamplingThereafter"`
+
+	// StatsUserIdleTimeoutSec is how many seconds a user without active connections or sessions
+	// is kept in the statistics collector after last being seen.
+	// Idle users are pruned periodically, so that the statistics of departed users do not linger.
+	// If zero, idle users are only evicted when the number of tracked users reaches the limit.
+	StatsUserIdleTimeoutSec int `json:"statsUserIdleTimeoutSec"`
+
+	// Admin configures the admin HTTP server, which exposes runtime metrics, statistics,
+	// UDP sessions, and client drain controls. See [AdminServer].
+	Admin AdminConfig `json:"admin"`
+
+	// TCPConnHook, if not nil, is installed on all TCP relays created by [Config.Manager].
+	// It cannot be configured in JSON. Programs embedding the service set it before calling Manager.
+	TCPConnHook TCPConnHook `json:"-"`
 }
 
 // Manager initializes the service manager.
@@ -64,16 +105,45 @@ func (sc *Config) Manager(logger *zap.Logger) (*Manager, error) {
 	}
 
 	switch {
-	case sc.UDPBatchSize > 0 && sc.UDPBatchSize <= 1024:
+	case sc.UDPBatchSize > 0 && sc.UDPBatchSize <= maxBatchSize:
 	case sc.UDPBatchSize == 0:
 		sc.UDPBatchSize = defaultRecvmmsgMsgvecSize
 	default:
-		return nil, fmt.Errorf("UDP batch size out of range [0, 1024]: %d", sc.UDPBatchSize)
+		return nil, fmt.Errorf("UDP batch size out of range [0, %d]: %d", maxBatchSize, sc.UDPBatchSize)
+	}
+
+	if sc.UDPBatchLingerUsec < 0 || sc.UDPBatchLingerUsec > maxBatchLingerUsec {
+		return nil, fmt.Errorf("UDP batch linger out of range [0, %d]: %d", maxBatchLingerUsec, sc.UDPBatchLingerUsec)
+	}
+	batchLinger := time.Duration(sc.UDPBatchLingerUsec) * time.Microsecond
+
+	if sc.StatsUserIdleTimeoutSec < 0 {
+		return nil, fmt.Errorf("negative statsUserIdleTimeoutSec: %d", sc.StatsUserIdleTimeoutSec)
+	}
+
+	if err := sc.Admin.Validate(); err != nil {
+		return nil, err
+	}
+
+	if sc.UDPPrewarmPackets < 0 || sc.UDPPrewarmPackets > maxPrewarmPackets {
+		return nil, fmt.Errorf("UDP prewarm packets out of range [0, %d]: %d", maxPrewarmPackets, sc.UDPPrewarmPackets)
+	}
+
+	if sc.WarnSamplingInitial < 0 {
+		return nil, fmt.Errorf("negative warnSamplingInitial: %d", sc.WarnSamplingInitial)
+	}
+	if sc.WarnSamplingThereafter < 0 {
+		return nil, fmt.Errorf("negative warnSamplingThereafter: %d", sc.WarnSamplingThereafter)
+	}
+
+	relayLogger := logger
+	if sc.WarnSamplingInitial > 0 {
+		relayLogger = logging.NewWarnSampledLogger(logger, logging.DefaultWarnSamplingTick, sc.WarnSamplingInitial, sc.WarnSamplingThereafter)
 	}
 
 	tcpClientMap := make(map[string]zerocopy.TCPClient, len(sc.Clients))
 	udpClientMap := make(map[string]zerocopy.UDPClient, len(sc.Clients))
-	var maxClientFrontHeadroom, maxClientRearHeadroom int
+	var maxClientHeadroom zerocopy.FixedHeadroom
 
 	for i := range sc.Clients {
 		clientConfig := &sc.Clients[i]
@@ -93,14 +163,7 @@ func (sc *Config) Manager(logger *zap.Logger) (*Manager, error) {
 		case errNetworkDisabled:
 		case nil:
 			udpClientMap[clientName] = udpClient
-			frontHeadroom := udpClient.FrontHeadroom()
-			if frontHeadroom > maxClientFrontHeadroom {
-				maxClientFrontHeadroom = frontHeadroom
-			}
-			rearHeadroom := udpClient.RearHeadroom()
-			if rearHeadroom > maxClientRearHeadroom {
-				maxClientRearHeadroom = rearHeadroom
-			}
+			maxClientHeadroom = zerocopy.MaxHeadroom(maxClientHeadroom, udpClient)
 		default:
 			return nil, fmt.Errorf("failed to create UDP client for %s: %w", clientName, err)
 		}
@@ -125,9 +188,10 @@ func (sc *Config) Manager(logger *zap.Logger) (*Manager, error) {
 	}
 
 	services := make([]Relay, 0, 2*len(sc.Servers))
+	collector := stats.NewCollector(stats.DefaultMaxUsers)
 
 	for i := range sc.Servers {
-		tcpRelay, err := sc.Servers[i].TCPRelay(router, logger)
+		tcpRelay, err := sc.Servers[i].TCPRelay(router, collector, relayLogger, sc.TCPConnHook)
 		switch err {
 		case errNetworkDisabled:
 		case nil:
@@ -136,7 +200,7 @@ func (sc *Config) Manager(logger *zap.Logger) (*Manager, error) {
 			return nil, fmt.Errorf("failed to create TCP relay service for %s: %w", sc.Servers[i].Name, err)
 		}
 
-		udpRelay, err := sc.Servers[i].UDPRelay(router, logger, sc.UDPBatchMode, sc.UDPBatchSize, maxClientFrontHeadroom, maxClientRearHeadroom)
+		udpRelay, err := sc.Servers[i].UDPRelay(router, collector, relayLogger, sc.UDPBatchMode, sc.UDPBatchSize, sc.UDPPrewarmPackets, batchLinger, maxClientHeadroom, udpClientMap)
 		switch err {
 		case errNetworkDisabled:
 		case nil:
@@ -146,28 +210,193 @@ func (sc *Config) Manager(logger *zap.Logger) (*Manager, error) {
 		}
 	}
 
-	return &Manager{services, router, logger}, nil
+	m := &Manager{
+		services:             services,
+		collector:            collector,
+		statsUserIdleTimeout: time.Duration(sc.StatsUserIdleTimeoutSec) * time.Second,
+		logger:               logger,
+		resolvers:            resolvers,
+		resolverMap:          resolverMap,
+		tcpClientMap:         tcpClientMap,
+		udpClientMap:         udpClientMap,
+	}
+	m.router.Store(router)
+
+	if sc.Admin.Listen != "" {
+		auth := LoopbackHostAuth(sc.Admin.Listen)
+		if sc.Admin.BearerToken != "" {
+			auth = BearerTokenAuth(sc.Admin.BearerToken)
+		}
+		m.admin = NewAdminServer(sc.Admin.Listen, sc.Admin.EnablePprof, auth, m, logger)
+	}
+
+	return m, nil
 }
 
 // Manager manages the services.
 type Manager struct {
-	services []Relay
-	router   *router.Router
-	logger   *zap.Logger
+	services             []Relay
+	router               atomic.Pointer[router.Router]
+	collector            *stats.Collector
+	statsUserIdleTimeout time.Duration
+	statsPrunerDone      chan struct{}
+	statsPrunerWg        sync.WaitGroup
+	admin                *AdminServer
+	logger               *zap.Logger
+
+	// The following fields are used to create routers on reload.
+	resolvers    []*dns.Resolver
+	resolverMap  map[string]*dns.Resolver
+	tcpClientMap map[string]zerocopy.TCPClient
+	udpClientMap map[string]zerocopy.UDPClient
+
+	// routerMu serializes router reloads.
+	routerMu sync.Mutex
 }
 
-// Start starts all configured services.
+// routerSetter is a relay service whose router can be replaced while it is running.
+type routerSetter interface {
+	SetRouter(r *router.Router)
+}
+
+// acquireRouter acquires the router stored in p, retrying if it is closed after being swapped out.
+// The caller must release the returned router when it no longer routes with it.
+//
+// acquireRouter returns nil if the router in p has been closed without being replaced,
+// which only happens when the manager is closing.
+func acquireRouter(p *atomic.Pointer[router.Router]) *router.Router {
+	for {
+		r := p.Load()
+		if r.Acquire() {
+			return r
+		}
+		if p.Load() == r {
+			return nil
+		}
+	}
+}
+
+// maxStatsPruneInterval is the maximum interval between two scans for idle users in the statistics collector.
+const maxStatsPruneInterval = time.Minute
+
+// pruneIdleUsers removes idle users from the statistics collector periodically until done is closed.
+func (m *Manager) pruneIdleUsers(done <-chan struct{}) {
+	interval := m.statsUserIdleTimeout
+	if interval > maxStatsPruneInterval {
+		interval = maxStatsPruneInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if n := m.collector.PruneIdle(m.statsUserIdleTimeout); n > 0 {
+				m.logger.Debug("Pruned idle users from statistics", zap.Int("count", n))
+			}
+		}
+	}
+}
+
+// Stats returns the per-user statistics collector shared by all services.
+func (m *Manager) Stats() *stats.Collector {
+	return m.collector
+}
+
+// Router returns the router shared by all services.
+// Use it to drain clients and query their status.
+//
+// The returned router is replaced by [Manager.ReloadRouter].
+func (m *Manager) Router() *router.Router {
+	return m.router.Load()
+}
+
+// ReloadRouter creates a router from rc with the manager's clients and DNS resolvers,
+// starts its health checkers, and makes all services route new connections and sessions with it.
+// Established connections and sessions keep the clients selected by the old router.
+//
+// The new router shares the client states of the old router, so drain states are carried over,
+// and sessions still relayed by clients selected by the old router are counted by the new router.
+// The old router's health checkers are stopped, and the old router is closed once the last
+// connection or session routed with it has finished.
+//
+// ReloadRouter must be called after Start. If rc is invalid, an error is returned and the current router is kept.
+func (m *Manager) ReloadRouter(rc *router.Config) error {
+	r, err := rc.Router(m.logger, m.resolvers, m.resolverMap, m.tcpClientMap, m.udpClientMap)
+	if err != nil {
+		return fmt.Errorf("failed to create router: %w", err)
+	}
+
+	m.routerMu.Lock()
+	defer m.routerMu.Unlock()
+
+	r.InheritClientStates(m.router.Load())
+	r.Start()
+	for _, s := range m.services {
+		if rs, ok := s.(routerSetter); ok {
+			rs.SetRouter(r)
+		}
+	}
+	old := m.router.Swap(r)
+	old.Stop()
+	old.Release()
+
+	m.logger.Info("Reloaded router")
+	return nil
+}
+
+// UDPSessionRelays returns the UDP session relay services.
+func (m *Manager) UDPSessionRelays() []*UDPSessionRelay {
+	var relays []*UDPSessionRelay
+	for _, s := range m.services {
+		if relay, ok := s.(*UDPSessionRelay); ok {
+			relays = append(relays, relay)
+		}
+	}
+	return relays
+}
+
+// Start starts the router, all configured services, the idle user pruner, and the admin server if configured.
 func (m *Manager) Start() error {
+	m.router.Load().Start()
 	for _, s := range m.services {
 		if err := s.Start(); err != nil {
 			return fmt.Errorf("failed to start %s: %w", s.String(), err)
 		}
 	}
+	if m.statsUserIdleTimeout > 0 {
+		done := make(chan struct{})
+		m.statsPrunerDone = done
+		m.statsPrunerWg.Add(1)
+
+		go func() {
+			m.pruneIdleUsers(done)
+			m.statsPrunerWg.Done()
+		}()
+	}
+	if m.admin != nil {
+		if err := m.admin.Start(); err != nil {
+			return fmt.Errorf("failed to start %s: %w", m.admin.String(), err)
+		}
+	}
 	return nil
 }
 
-// Stop stops all running services.
+// Stop stops the admin server, the idle user pruner, and all running services.
 func (m *Manager) Stop() {
+	if m.admin != nil {
+		if err := m.admin.Stop(); err != nil {
+			m.logger.Warn("Failed to stop admin server", zap.Error(err))
+		}
+	}
+	if m.statsPrunerDone != nil {
+		close(m.statsPrunerDone)
+		m.statsPrunerWg.Wait()
+		m.statsPrunerDone = nil
+	}
 	for _, s := range m.services {
 		if err := s.Stop(); err != nil {
 			m.logger.Warn("Failed to stop service",
@@ -181,7 +410,5 @@ func (m *Manager) Stop() {
 
 // Close closes the manager.
 func (m *Manager) Close() {
-	if err := m.router.Close(); err != nil {
-		m.logger.Warn("Failed to close router", zap.Error(err))
-	}
+	m.router.Load().Release()
 }
@@ -0,0 +1,190 @@
+package service
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/direct"
+	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/stats"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+func TestManagerPrunesIdleUsers(t *testing.T) {
+	logger := zap.NewNop()
+	r, err := (&router.Config{}).Router(logger, nil, nil, nil, map[string]zerocopy.UDPClient{
+		"direct": direct.NewUDPClient("direct", 1500, 0, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := stats.NewCollector(0)
+	m := &Manager{
+		collector:            collector,
+		statsUserIdleTimeout: 10 * time.Millisecond,
+		logger:               logger,
+	}
+	m.router.Store(r)
+
+	collector.TCPConnOpened("alice")
+	collector.TCPConnClosed("alice", 1, 1)
+	collector.TCPConnOpened("bob")
+
+	if err = m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	defer m.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := collector.UserSnapshot("alice"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Idle user alice was not pruned")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, ok := collector.UserSnapshot("bob"); !ok {
+		t.Error("Active user bob was pruned")
+	}
+}
+
+func TestManagerReloadRouter(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	targetAddr := conn.AddrFromIPPort(ln.Addr().(*net.TCPAddr).AddrPort())
+
+	logger := zap.NewNop()
+	tcpClientMap := map[string]zerocopy.TCPClient{
+		"a": direct.NewTCPClient("a", false, 0, 0),
+		"b": direct.NewTCPClient("b", false, 0, 0),
+	}
+	r, err := (&router.Config{DefaultTCPClientName: "a"}).Router(logger, nil, nil, tcpClientMap, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hook := make(chanTCPConnHook, 2)
+	tcpRelay := NewTCPRelay(TCPRelayConfig{ServerName: "fake", ListenAddress: "127.0.0.1:0"}, direct.NewTCPServer(targetAddr), zerocopy.JustClose, r, nil, logger, hook)
+	natRelay, err := NewUDPNATRelay(UDPNATRelayConfig{
+		ServerName:    "fake",
+		ListenAddress: "127.0.0.1:0",
+		BatchSize:     8,
+		MTU:           1500,
+		NATTimeout:    time.Minute,
+	}, direct.NewDirectUDPNATServer(targetAddr, false), r, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Manager{
+		services:     []Relay{tcpRelay, natRelay},
+		collector:    stats.NewCollector(0),
+		logger:       logger,
+		tcpClientMap: tcpClientMap,
+	}
+	m.router.Store(r)
+
+	if err = m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	defer m.Stop()
+
+	// connClient returns the client that routes a new connection to the TCP relay.
+	connClient := func() string {
+		c, err := net.Dial("tcp", tcpRelay.listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		for i := 0; i < 2; i++ {
+			select {
+			case e := <-hook:
+				if !e.closed {
+					return e.info.Client
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Timed out waiting for connection")
+			}
+		}
+		t.Fatal("Got no connect event")
+		return ""
+	}
+
+	if client := connClient(); client != "a" {
+		t.Errorf("Connection routed to %q before reload, expected %q", client, "a")
+	}
+	<-hook
+
+	if err = m.ReloadRouter(&router.Config{DefaultTCPClientName: "missing"}); err == nil {
+		t.Error("ReloadRouter succeeded with an invalid config")
+	}
+	if m.Router() != r {
+		t.Error("Failed reload replaced the router")
+	}
+
+	// Hold the old router and a session of client a across the reload, like a relay in flight.
+	if !r.Acquire() {
+		t.Fatal("Failed to acquire the current router")
+	}
+	r.SessionOpened("a")
+
+	if err = m.ReloadRouter(&router.Config{DefaultTCPClientName: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	newRouter := m.Router()
+	if newRouter == r {
+		t.Fatal("ReloadRouter did not replace the router")
+	}
+	if tcpRelay.router.Load() != newRouter || natRelay.router.Load() != newRouter {
+		t.Error("ReloadRouter did not update all relays")
+	}
+
+	status, err := newRouter.ClientStatus("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.ActiveSessions != 1 {
+		t.Errorf("ActiveSessions = %d after reload, expected 1", status.ActiveSessions)
+	}
+	r.SessionClosed("a")
+	if status, _ = newRouter.ClientStatus("a"); status.ActiveSessions != 0 {
+		t.Errorf("ActiveSessions = %d after the old session closed, expected 0", status.ActiveSessions)
+	}
+
+	// The connection routed before the reload may not have released the old router yet.
+	r.Release()
+	for deadline := time.Now().Add(5 * time.Second); r.Acquire(); {
+		r.Release()
+		if time.Now().After(deadline) {
+			t.Error("Retired router was not closed after its last user released it")
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if client := connClient(); client != "b" {
+		t.Errorf("Connection routed to %q after reload, expected %q", client, "b")
+	}
+}
@@ -0,0 +1,57 @@
+package service
+
+import "time"
+
+// minShaperBurst is the minimum burst size of a shaper.
+// It allows a single maximum-sized UDP payload to pass without debt.
+const minShaperBurst = 65535
+
+// shaper paces payload bytes to a configured rate using a token bucket.
+//
+// A shaper is not safe for concurrent use. Each relay direction of a session owns its own shaper.
+type shaper struct {
+	// rate is the refill rate in bytes per second.
+	rate float64
+
+	// burst is the bucket capacity in bytes.
+	burst float64
+
+	// tokens may go negative when a write exceeds the available budget.
+	// The debt is paid off by sleeping.
+	tokens float64
+
+	last time.Time
+}
+
+// newShaper returns a new shaper that allows bytesPerSecond payload bytes per second.
+// The bucket starts full and holds one second worth of bytes.
+func newShaper(bytesPerSecond uint64) *shaper {
+	burst := float64(bytesPerSecond)
+	if burst < minShaperBurst {
+		burst = minShaperBurst
+	}
+	return &shaper{
+		rate:   float64(bytesPerSecond),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Wait takes n bytes from the bucket, and sleeps until the bucket is no longer in debt.
+//
+// Only the calling goroutine is blocked. Packets arriving in the meantime queue up
+// in the session's send channel or socket receive buffer, and are dropped there when full.
+func (s *shaper) Wait(n int) {
+	now := time.Now()
+	s.tokens += now.Sub(s.last).Seconds() * s.rate
+	if s.tokens > s.burst {
+		s.tokens = s.burst
+	}
+	s.last = now
+
+	s.tokens -= float64(n)
+	if s.tokens < 0 {
+		time.Sleep(time.Duration(-s.tokens / s.rate * float64(time.Second)))
+	}
+}
@@ -7,11 +7,14 @@ import (
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/database64128/shadowsocks-go/conn"
 	"github.com/database64128/shadowsocks-go/direct"
 	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/sniff"
+	"github.com/database64128/shadowsocks-go/stats"
 	"github.com/database64128/shadowsocks-go/zerocopy"
 	"github.com/database64128/tfo-go/v2"
 	"go.uber.org/zap"
@@ -20,6 +23,13 @@ import (
 const (
 	initialPayloadWaitBufferSize = 1280
 	initialPayloadWaitTimeout    = 250 * time.Millisecond
+
+	// maxTLSWriteCoalesceUsec is the maximum allowed TLS write coalescing delay in microseconds.
+	maxTLSWriteCoalesceUsec = 10000
+
+	// tcpConnStatsReportInterval is the interval at which the traffic of active TCP connections
+	// of identified users is reported to the statistics collector.
+	tcpConnStatsReportInterval = 30 * time.Second
 )
 
 // TCPRelay is a relay service for TCP traffic.
@@ -33,27 +43,71 @@ type TCPRelay struct {
 	listenAddress         string
 	wg                    sync.WaitGroup
 	listenConfig          tfo.ListenConfig
+	listenBacklog         int
 	waitForInitialPayload bool
+	sniffDomain           bool
+	preferClientFamily    bool
 	server                zerocopy.TCPServer
 	connCloser            zerocopy.TCPConnCloser
 	fallbackAddress       *conn.Addr
-	router                *router.Router
+	router                atomic.Pointer[router.Router]
+	collector             *stats.Collector
+	statsReportInterval   time.Duration
 	logger                *zap.Logger
+	hook                  TCPConnHook
 	listener              *net.TCPListener
 }
 
-func NewTCPRelay(serverName, listenAddress string, listenerFwmark int, listenerTFO, listenerTransparent, waitForInitialPayload bool, server zerocopy.TCPServer, connCloser zerocopy.TCPConnCloser, fallbackAddress *conn.Addr, router *router.Router, logger *zap.Logger) *TCPRelay {
-	return &TCPRelay{
-		serverName:            serverName,
-		listenAddress:         listenAddress,
-		listenConfig:          conn.NewListenConfig(listenerTFO, listenerTransparent, listenerFwmark),
-		waitForInitialPayload: waitForInitialPayload,
+// TCPRelayConfig is the configuration of a [TCPRelay].
+type TCPRelayConfig struct {
+	ServerName          string
+	ListenAddress       string
+	ListenerFwmark      int
+	ListenerTFO         bool
+	ListenerTransparent bool
+
+	// If ListenBacklog is positive, the accept queue backlog of the listener is set to ListenBacklog after listening.
+	ListenBacklog int
+
+	// If WaitForInitialPayload is true, the relay waits briefly for the initial payload from the client
+	// before dialing a client that can send it along with its handshake.
+	WaitForInitialPayload bool
+
+	// If SniffDomain is true, the domain name in the initial payload of connections to IP addresses
+	// is sniffed for routing.
+	SniffDomain bool
+
+	// If PreferClientFamily is true, clients that resolve domain targets themselves prefer addresses
+	// of the same family as the client's connection. See [zerocopy.FamilyDialer].
+	PreferClientFamily bool
+
+	// If FallbackAddress is not nil, connections that fail the server handshake with an initial payload
+	// are relayed to FallbackAddress instead of being rejected.
+	FallbackAddress *conn.Addr
+}
+
+// NewTCPRelay creates a new TCP relay service.
+//
+// If hook is not nil, it is notified when each relayed connection starts and ends.
+func NewTCPRelay(config TCPRelayConfig, server zerocopy.TCPServer, connCloser zerocopy.TCPConnCloser, router *router.Router, collector *stats.Collector, logger *zap.Logger, hook TCPConnHook) *TCPRelay {
+	s := TCPRelay{
+		serverName:            config.ServerName,
+		listenAddress:         config.ListenAddress,
+		listenConfig:          conn.NewListenConfig(config.ListenerTFO, config.ListenerTransparent, config.ListenerFwmark),
+		listenBacklog:         config.ListenBacklog,
+		waitForInitialPayload: config.WaitForInitialPayload,
+		sniffDomain:           config.SniffDomain,
+		preferClientFamily:    config.PreferClientFamily,
 		server:                server,
 		connCloser:            connCloser,
-		fallbackAddress:       fallbackAddress,
-		router:                router,
+		fallbackAddress:       config.FallbackAddress,
+		collector:             collector,
+		statsReportInterval:   tcpConnStatsReportInterval,
 		logger:                logger,
+		hook:                  hook,
 	}
+	s.router.Store(router)
+	return &s
 }
 
 // String implements the Service String method.
@@ -61,6 +115,14 @@ func (s *TCPRelay) String() string {
 	return fmt.Sprintf("TCP relay service for %s", s.serverName)
 }
 
+// SetRouter replaces the router used to select clients for new connections.
+// Established connections keep the client selected by the router that routed them.
+//
+// SetRouter is safe to call while the relay is running.
+func (s *TCPRelay) SetRouter(r *router.Router) {
+	s.router.Store(r)
+}
+
 // Start implements the Service Start method.
 func (s *TCPRelay) Start() error {
 	l, err := s.listenConfig.Listen(context.Background(), "tcp", s.listenAddress)
@@ -69,6 +131,13 @@ func (s *TCPRelay) Start() error {
 	}
 	s.listener = l.(*net.TCPListener)
 
+	if s.listenBacklog > 0 {
+		if err = conn.SetListenBacklog(s.listener, s.listenBacklog); err != nil {
+			s.listener.Close()
+			return err
+		}
+	}
+
 	s.wg.Add(1)
 
 	go func() {
@@ -139,8 +208,61 @@ func (s *TCPRelay) handleConn(clientConn *net.TCPConn) {
 	// Convert target address to string once for log messages.
 	targetAddress := targetAddr.String()
 
-	// Route.
-	c, err := s.router.GetTCPClient(s.serverName, clientAddrPort, targetAddr)
+	requestInfo := router.RequestInfo{
+		Server:         s.serverName,
+		SourceAddrPort: clientAddrPort,
+		TargetAddr:     targetAddr,
+	}
+
+	if s.preferClientFamily {
+		requestInfo.PreferredFamily = conn.AddrFamilyOf(clientAddrPort.Addr())
+	}
+
+	if ui, ok := clientRW.(zerocopy.UserIdentifier); ok {
+		requestInfo.Username = ui.Username()
+	}
+
+	// Sniff the initial payload for a domain name if the client requested an IP address.
+	// The read is bounded by the initial payload wait buffer size and timeout.
+	var initialPayloadRead bool
+
+	if s.sniffDomain && targetAddr.IsIP() {
+		if len(payload) == 0 {
+			payload, err = readInitialPayload(clientConn, clientRW)
+			if err != nil {
+				s.logger.Warn("Failed to read initial payload for sniffing",
+					zap.String("server", s.serverName),
+					zap.String("listenAddress", s.listenAddress),
+					zap.String("clientAddress", clientAddress),
+					zap.String("targetAddress", targetAddress),
+					zap.Error(err),
+				)
+				return
+			}
+			initialPayloadRead = true
+		}
+
+		requestInfo.SniffedName = sniff.Name(payload)
+
+		if ce := s.logger.Check(zap.DebugLevel, "Sniffed initial payload"); ce != nil {
+			ce.Write(
+				zap.String("server", s.serverName),
+				zap.String("listenAddress", s.listenAddress),
+				zap.String("clientAddress", clientAddress),
+				zap.String("targetAddress", targetAddress),
+				zap.Int("payloadLength", len(payload)),
+				zap.String("sniffedName", requestInfo.SniffedName),
+			)
+		}
+	}
+
+	// Route. Use the same router for the whole connection, even if it is swapped out by SetRouter.
+	connRouter := acquireRouter(&s.router)
+	if connRouter == nil {
+		return
+	}
+	defer connRouter.Release()
+	c, policy, err := connRouter.GetTCPClient(requestInfo)
 	if err != nil {
 		s.logger.Warn("Failed to get TCP client for client connection",
 			zap.String("server", s.serverName),
@@ -159,19 +281,12 @@ func (s *TCPRelay) handleConn(clientConn *net.TCPConn) {
 	// 1. not disabled
 	// 2. server does not have native support
 	// 3. client has native support
-	if s.waitForInitialPayload && c.NativeInitialPayload() {
-		frontHeadroom := clientRW.FrontHeadroom()
-		rearHeadroom := clientRW.RearHeadroom()
-		payloadBufSize := clientRW.MinPayloadBufferSizePerRead()
-		if payloadBufSize == 0 {
-			payloadBufSize = initialPayloadWaitBufferSize
-		}
-
-		payload = make([]byte, frontHeadroom+payloadBufSize+rearHeadroom)
-
-		err = clientConn.SetReadDeadline(time.Now().Add(initialPayloadWaitTimeout))
-		if err != nil {
-			s.logger.Warn("Failed to set read deadline to initial payload wait timeout",
+	// 4. not already read for sniffing
+	if s.waitForInitialPayload && c.NativeInitialPayload() && !initialPayloadRead {
+		payload, err = readInitialPayload(clientConn, clientRW)
+		switch {
+		case err != nil:
+			s.logger.Warn("Failed to read initial payload",
 				zap.String("server", s.serverName),
 				zap.String("client", clientName),
 				zap.String("listenAddress", s.listenAddress),
@@ -180,22 +295,8 @@ func (s *TCPRelay) handleConn(clientConn *net.TCPConn) {
 				zap.Error(err),
 			)
 			return
-		}
-
-		payloadLength, err := clientRW.ReadZeroCopy(payload, frontHeadroom, payloadBufSize)
-		switch {
-		case err == nil:
-			payload = payload[frontHeadroom : frontHeadroom+payloadLength]
-			s.logger.Debug("Got initial payload",
-				zap.String("server", s.serverName),
-				zap.String("client", clientName),
-				zap.String("listenAddress", s.listenAddress),
-				zap.String("clientAddress", clientAddress),
-				zap.String("targetAddress", targetAddress),
-				zap.Int("payloadLength", payloadLength),
-			)
 
-		case errors.Is(err, os.ErrDeadlineExceeded):
+		case len(payload) == 0:
 			s.logger.Debug("Initial payload wait timed out",
 				zap.String("server", s.serverName),
 				zap.String("client", clientName),
@@ -205,33 +306,29 @@ func (s *TCPRelay) handleConn(clientConn *net.TCPConn) {
 			)
 
 		default:
-			s.logger.Warn("Failed to read initial payload",
-				zap.String("server", s.serverName),
-				zap.String("client", clientName),
-				zap.String("listenAddress", s.listenAddress),
-				zap.String("clientAddress", clientAddress),
-				zap.String("targetAddress", targetAddress),
-				zap.Error(err),
-			)
-			return
-		}
-
-		err = clientConn.SetReadDeadline(time.Time{})
-		if err != nil {
-			s.logger.Warn("Failed to reset read deadline",
+			s.logger.Debug("Got initial payload",
 				zap.String("server", s.serverName),
 				zap.String("client", clientName),
 				zap.String("listenAddress", s.listenAddress),
 				zap.String("clientAddress", clientAddress),
 				zap.String("targetAddress", targetAddress),
-				zap.Error(err),
+				zap.Int("payloadLength", len(payload)),
 			)
-			return
 		}
 	}
 
 	// Create remote connection.
-	remoteConn, remoteRW, err := c.Dial(targetAddr, payload)
+	// Only clients that resolve domain targets themselves are asked to prefer an address family,
+	// so domain targets routed to proxy clients are never resolved locally.
+	var (
+		remoteConn net.Conn
+		remoteRW   zerocopy.ReadWriter
+	)
+	if fd, ok := c.(zerocopy.FamilyDialer); ok && requestInfo.PreferredFamily != conn.AddrFamilyAny {
+		remoteConn, remoteRW, err = fd.DialFamily(targetAddr, requestInfo.PreferredFamily, payload)
+	} else {
+		remoteConn, remoteRW, err = c.Dial(targetAddr, payload)
+	}
 	if err != nil {
 		s.logger.Warn("Failed to create remote connection",
 			zap.String("server", s.serverName),
@@ -246,6 +343,33 @@ func (s *TCPRelay) handleConn(clientConn *net.TCPConn) {
 	}
 	defer remoteConn.Close()
 
+	if policy.DisableNoDelay {
+		if err = clientConn.SetNoDelay(false); err != nil {
+			s.logger.Warn("Failed to disable TCP_NODELAY on client connection",
+				zap.String("server", s.serverName),
+				zap.String("client", clientName),
+				zap.String("listenAddress", s.listenAddress),
+				zap.String("clientAddress", clientAddress),
+				zap.String("targetAddress", targetAddress),
+				zap.Error(err),
+			)
+		}
+
+		// Non-TCP egress transports are left as is.
+		if tc, ok := remoteConn.(*net.TCPConn); ok {
+			if err = tc.SetNoDelay(false); err != nil {
+				s.logger.Warn("Failed to disable TCP_NODELAY on remote connection",
+					zap.String("server", s.serverName),
+					zap.String("client", clientName),
+					zap.String("listenAddress", s.listenAddress),
+					zap.String("clientAddress", clientAddress),
+					zap.String("targetAddress", targetAddress),
+					zap.Error(err),
+				)
+			}
+		}
+	}
+
 	s.logger.Info("Two-way relay started",
 		zap.String("server", s.serverName),
 		zap.String("client", clientName),
@@ -255,9 +379,48 @@ func (s *TCPRelay) handleConn(clientConn *net.TCPConn) {
 		zap.Int("initialPayloadLength", len(payload)),
 	)
 
+	s.collector.TCPConnOpened(requestInfo.Username)
+	connRouter.SessionOpened(clientName)
+
+	var connInfo TCPConnInfo
+	if s.hook != nil {
+		connInfo = TCPConnInfo{
+			Server:         s.serverName,
+			Client:         clientName,
+			Username:       requestInfo.Username,
+			ClientAddrPort: clientAddrPort,
+			TargetAddr:     targetAddr,
+			StartTime:      time.Now(),
+		}
+		s.hook.OnConnect(connInfo)
+	}
+
+	// Report the traffic of identified users periodically, so that long-lived connections
+	// show up in the statistics before they are closed.
+	relayRW := clientRW
+	var stopReporting func()
+	if s.collector != nil && requestInfo.Username != "" {
+		var counter zerocopy.ByteCounter
+		relayRW, counter = zerocopy.NewCountingReadWriter(clientRW)
+		stopReporting = counter.StartReporting(s.statsReportInterval, func(bytesRead, bytesWritten uint64) {
+			s.collector.TCPConnTransferred(requestInfo.Username, bytesRead, bytesWritten)
+		})
+	}
+
 	// Two-way relay.
-	nl2r, nr2l, err := zerocopy.TwoWayRelay(clientRW, remoteRW)
+	nl2r, nr2l, err := zerocopy.TwoWayRelay(relayRW, remoteRW)
 	nl2r += int64(len(payload))
+	if stopReporting != nil {
+		// Everything but the initial payload was read through the counter, and has been reported.
+		stopReporting()
+		s.collector.TCPConnClosed(requestInfo.Username, uint64(len(payload)), 0)
+	} else {
+		s.collector.TCPConnClosed(requestInfo.Username, uint64(nl2r), uint64(nr2l))
+	}
+	connRouter.SessionClosed(clientName)
+	if s.hook != nil {
+		s.hook.OnClose(connInfo, uint64(nl2r), uint64(nr2l), time.Since(connInfo.StartTime))
+	}
 	if err != nil {
 		s.logger.Warn("Two-way relay failed",
 			zap.String("server", s.serverName),
@@ -283,6 +446,39 @@ func (s *TCPRelay) handleConn(clientConn *net.TCPConn) {
 	)
 }
 
+// readInitialPayload reads the initial payload from clientRW, waiting for up to initialPayloadWaitTimeout.
+// If the wait times out, an empty payload and a nil error are returned.
+func readInitialPayload(clientConn *net.TCPConn, clientRW zerocopy.ReadWriter) ([]byte, error) {
+	frontHeadroom := clientRW.FrontHeadroom()
+	rearHeadroom := clientRW.RearHeadroom()
+	payloadBufSize := clientRW.MinPayloadBufferSizePerRead()
+	if payloadBufSize == 0 {
+		payloadBufSize = initialPayloadWaitBufferSize
+	}
+
+	payload := make([]byte, frontHeadroom+payloadBufSize+rearHeadroom)
+
+	if err := clientConn.SetReadDeadline(time.Now().Add(initialPayloadWaitTimeout)); err != nil {
+		return nil, fmt.Errorf("failed to set read deadline to initial payload wait timeout: %w", err)
+	}
+
+	payloadLength, err := clientRW.ReadZeroCopy(payload, frontHeadroom, payloadBufSize)
+	switch {
+	case err == nil:
+		payload = payload[frontHeadroom : frontHeadroom+payloadLength]
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		payload = nil
+	default:
+		return nil, err
+	}
+
+	if err := clientConn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, fmt.Errorf("failed to reset read deadline: %w", err)
+	}
+
+	return payload, nil
+}
+
 // Stop implements the Service Stop method.
 func (s *TCPRelay) Stop() error {
 	if s.listener == nil {
@@ -0,0 +1,44 @@
+package service
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+)
+
+// TCPConnInfo describes a connection relayed by a TCP relay.
+// It carries the same metadata as the stats collector and the relay logs.
+type TCPConnInfo struct {
+	// Server is the name of the server that accepted the connection.
+	Server string
+
+	// Client is the name of the client selected by the router.
+	Client string
+
+	// Username is the username of the authenticated user, or empty if the server does not identify users.
+	Username string
+
+	// ClientAddrPort is the address of the connecting client.
+	ClientAddrPort netip.AddrPort
+
+	// TargetAddr is the target address requested by the client.
+	TargetAddr conn.Addr
+
+	// StartTime is the time the remote connection was established.
+	StartTime time.Time
+}
+
+// TCPConnHook observes the lifecycle of connections relayed by a TCP relay,
+// for pushing events to external systems like firewalls and accounting.
+//
+// Hooks are called synchronously from the goroutine of each connection,
+// so implementations must be safe for concurrent use and should return quickly.
+type TCPConnHook interface {
+	// OnConnect is called after the remote connection has been established, before relaying starts.
+	OnConnect(info TCPConnInfo)
+
+	// OnClose is called when relaying ends, with the number of bytes relayed from the client (up)
+	// and from the remote (down), and the duration since OnConnect.
+	OnClose(info TCPConnInfo, bytesUp, bytesDown uint64, duration time.Duration)
+}
@@ -0,0 +1,309 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/direct"
+	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/stats"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+// tcpConnEvent is a call to a TCPConnHook method.
+type tcpConnEvent struct {
+	info      TCPConnInfo
+	closed    bool
+	bytesUp   uint64
+	bytesDown uint64
+	duration  time.Duration
+}
+
+// chanTCPConnHook sends hook calls to a channel.
+type chanTCPConnHook chan tcpConnEvent
+
+func (h chanTCPConnHook) OnConnect(info TCPConnInfo) {
+	h <- tcpConnEvent{info: info}
+}
+
+func (h chanTCPConnHook) OnClose(info TCPConnInfo, bytesUp, bytesDown uint64, duration time.Duration) {
+	h <- tcpConnEvent{info: info, closed: true, bytesUp: bytesUp, bytesDown: bytesDown, duration: duration}
+}
+
+func TestTCPRelayConnHook(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// Echo the request, then send a reply and close.
+	reply := []byte(" world")
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b := make([]byte, 5)
+		if _, err = io.ReadFull(c, b); err != nil {
+			return
+		}
+		c.Write(append(b, reply...))
+	}()
+	targetAddr := conn.AddrFromIPPort(ln.Addr().(*net.TCPAddr).AddrPort())
+
+	logger := zap.NewNop()
+	tcpClientMap := map[string]zerocopy.TCPClient{
+		"direct": direct.NewTCPClient("direct", false, 0, 0),
+	}
+	r, err := (&router.Config{}).Router(logger, nil, nil, tcpClientMap, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hook := make(chanTCPConnHook, 2)
+	s := NewTCPRelay(TCPRelayConfig{ServerName: "fake", ListenAddress: "127.0.0.1:0"}, direct.NewTCPServer(targetAddr), zerocopy.JustClose, r, nil, logger, hook)
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	c, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	clientAddrPort := c.LocalAddr().(*net.TCPAddr).AddrPort()
+
+	if _, err = c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello world" {
+		t.Errorf("Got %q, expected %q", b, "hello world")
+	}
+	c.Close()
+
+	for _, closed := range []bool{false, true} {
+		select {
+		case e := <-hook:
+			if e.closed != closed {
+				t.Fatalf("Got event with closed = %t, expected %t", e.closed, closed)
+			}
+			if e.info.Server != "fake" || e.info.Client != "direct" {
+				t.Errorf("Got server %q and client %q, expected fake and direct", e.info.Server, e.info.Client)
+			}
+			if e.info.ClientAddrPort != clientAddrPort {
+				t.Errorf("Got client address %s, expected %s", e.info.ClientAddrPort, clientAddrPort)
+			}
+			if e.info.TargetAddr != targetAddr {
+				t.Errorf("Got target address %s, expected %s", e.info.TargetAddr, targetAddr)
+			}
+			if e.info.StartTime.IsZero() {
+				t.Error("Got zero start time")
+			}
+			if closed {
+				if e.bytesUp != 5 || e.bytesDown != uint64(len(b)) {
+					t.Errorf("Got %d bytes up and %d bytes down, expected 5 and %d", e.bytesUp, e.bytesDown, len(b))
+				}
+				if e.duration <= 0 {
+					t.Errorf("Got duration %s, expected positive", e.duration)
+				}
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for event with closed = %t", closed)
+		}
+	}
+}
+
+func TestServerConfigTCPRelayConnHook(t *testing.T) {
+	sc := ServerConfig{
+		Name:                "fake",
+		Protocol:            "direct",
+		Listen:              "127.0.0.1:0",
+		EnableTCP:           true,
+		TunnelRemoteAddress: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv4Unspecified(), 443)),
+	}
+	hook := make(chanTCPConnHook)
+	s, err := sc.TCPRelay(nil, nil, zap.NewNop(), hook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.hook != TCPConnHook(hook) {
+		t.Error("Hook was not installed on the relay")
+	}
+}
+
+// userTCPServer wraps a TCPServer to identify every client as username.
+// The returned ReadWriter does not provide direct access, so the relay uses zero-copy reads and writes.
+type userTCPServer struct {
+	zerocopy.TCPServer
+	username string
+}
+
+type userReadWriter struct {
+	zerocopy.ReadWriter
+	username string
+}
+
+func (rw userReadWriter) Username() string {
+	return rw.username
+}
+
+func (s userTCPServer) Accept(tc *net.TCPConn) (zerocopy.ReadWriter, conn.Addr, []byte, error) {
+	rw, targetAddr, payload, err := s.TCPServer.Accept(tc)
+	if err != nil {
+		return nil, targetAddr, payload, err
+	}
+	return userReadWriter{rw, s.username}, targetAddr, payload, nil
+}
+
+func TestTCPRelayInterimStats(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		c, err := ln.AcceptTCP()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+		c.CloseWrite()
+	}()
+	targetAddr := conn.AddrFromIPPort(ln.Addr().(*net.TCPAddr).AddrPort())
+
+	logger := zap.NewNop()
+	tcpClientMap := map[string]zerocopy.TCPClient{
+		"direct": direct.NewTCPClient("direct", true, 0, 0),
+	}
+	r, err := (&router.Config{}).Router(logger, nil, nil, tcpClientMap, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collector := stats.NewCollector(0)
+	server := userTCPServer{direct.NewTCPServer(targetAddr), "alice"}
+	s := NewTCPRelay(TCPRelayConfig{ServerName: "fake", ListenAddress: "127.0.0.1:0"}, server, zerocopy.JustClose, r, collector, logger, nil)
+	s.statsReportInterval = time.Millisecond
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	c, err := net.DialTCP("tcp", nil, s.listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err = c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	if _, err = io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+
+	// waitForUser waits until the statistics of alice match want.
+	waitForUser := func(want stats.UserSnapshot) {
+		t.Helper()
+		var u stats.UserSnapshot
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			u, _ = collector.UserSnapshot("alice")
+			if u.ActiveTCPConns == want.ActiveTCPConns && u.UplinkBytes == want.UplinkBytes && u.DownlinkBytes == want.DownlinkBytes {
+				return
+			}
+		}
+		t.Fatalf("UserSnapshot(alice) = %+v, expected %+v", u, want)
+	}
+
+	// The traffic shows up while the connection is still open.
+	waitForUser(stats.UserSnapshot{ActiveTCPConns: 1, UplinkBytes: 5, DownlinkBytes: 5})
+
+	// Resetting during the connection neither loses nor double-counts traffic.
+	if u, _ := collector.ResetUser("alice"); u.UplinkBytes != 5 || u.DownlinkBytes != 5 {
+		t.Errorf("ResetUser(alice) = %+v, expected 5 uplink bytes, 5 downlink bytes", u)
+	}
+	if _, err = c.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	waitForUser(stats.UserSnapshot{ActiveTCPConns: 1, UplinkBytes: 5, DownlinkBytes: 5})
+
+	// Closing the connection does not count the traffic again.
+	if err = c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadAll(c); err != nil {
+		t.Fatal(err)
+	}
+	waitForUser(stats.UserSnapshot{UplinkBytes: 5, DownlinkBytes: 5})
+}
+
+// recordingTCPClient is a proxy client that records the target of every dial and fails it.
+type recordingTCPClient struct {
+	targets chan conn.Addr
+}
+
+func (c recordingTCPClient) String() string {
+	return "proxy"
+}
+
+func (c recordingTCPClient) Dial(targetAddr conn.Addr, payload []byte) (net.Conn, zerocopy.ReadWriter, error) {
+	c.targets <- targetAddr
+	return nil, nil, errors.New("recordingTCPClient does not dial")
+}
+
+func (c recordingTCPClient) NativeInitialPayload() bool {
+	return false
+}
+
+func TestTCPRelayPreferClientFamilyProxyClient(t *testing.T) {
+	targetAddr := conn.MustAddrFromDomainPort("localhost", 443)
+	client := recordingTCPClient{make(chan conn.Addr, 1)}
+
+	logger := zap.NewNop()
+	r, err := (&router.Config{DefaultTCPClientName: "proxy"}).Router(logger, nil, nil, map[string]zerocopy.TCPClient{
+		"proxy": client,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewTCPRelay(TCPRelayConfig{ServerName: "fake", ListenAddress: "127.0.0.1:0", PreferClientFamily: true}, direct.NewTCPServer(targetAddr), zerocopy.JustClose, r, nil, logger, nil)
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	c, err := net.DialTCP("tcp", nil, s.listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	select {
+	case got := <-client.targets:
+		if !got.Equal(targetAddr) {
+			t.Errorf("Proxy client got target %s, expected the unresolved %s", got, targetAddr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the proxy client to dial")
+	}
+}
@@ -2,7 +2,10 @@ package service
 
 import (
 	"errors"
+	"sync"
 	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
 )
 
 const (
@@ -12,6 +15,10 @@ const (
 	// sendChannelCapacity defines NAT entry's send channel capacity.
 	sendChannelCapacity = 1024
 
+	// sessionSetupQueueTimeout is the maximum time a new session waits for a setup slot
+	// when the number of concurrent session setups is limited.
+	sessionSetupQueueTimeout = 2 * time.Second
+
 	// minNatTimeoutSec is the minimum allowed NAT timeout in seconds.
 	minNatTimeoutSec = 60
 
@@ -27,6 +34,39 @@ const (
 	// Note that the mainline iperf3 does not use sendmmsg(2) or io_uring for batch sending at the
 	// time of writing. So this value is still subject to change in the future.
 	defaultRecvmmsgMsgvecSize = 256
+
+	// maxBatchSize is the maximum allowed batch size.
+	maxBatchSize = 1024
+
+	// maxBatchLingerUsec is the maximum allowed batch linger in microseconds.
+	maxBatchLingerUsec = 10000
+
+	// adaptiveRecvBufInitialSize is the initial natConn receive buffer size in adaptive mode.
+	adaptiveRecvBufInitialSize = 512
+
+	// maxPrewarmPackets is the maximum number of queued packets that can be pre-allocated at start.
+	maxPrewarmPackets = 4 * sendChannelCapacity
 )
 
 var ErrMTUTooSmall = errors.New("MTU must be at least 1280")
+
+// prewarmPool puts n newly allocated entries into pool, so that the first burst of
+// packets after start reuses warm buffers instead of allocating.
+//
+// Pooled entries that stay unused are dropped after two garbage collection cycles,
+// so pre-warming only smooths the cold start.
+func prewarmPool(pool *sync.Pool, n int) {
+	for i := 0; i < n; i++ {
+		pool.Put(pool.New())
+	}
+}
+
+// flagsErrorMessage returns the log message for err returned by conn.ParseFlagsForError.
+// Truncated packets get a dedicated message, so that a receive buffer too small for the traffic,
+// usually caused by a misconfigured MTU, is not mistaken for a decryption failure.
+func flagsErrorMessage(err error, msg string) string {
+	if err == conn.ErrMessageTruncated {
+		return "Packet truncated, receive buffer too small"
+	}
+	return msg
+}
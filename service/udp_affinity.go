@@ -0,0 +1,132 @@
+package service
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+// maxSessionAffinityEntries is the maximum number of recently closed sessions remembered by a sessionAffinity.
+const maxSessionAffinityEntries = 65536
+
+// sessionAffinityEntry is the upstream selection of a recently closed session.
+type sessionAffinityEntry struct {
+	// router is the router that made the selection.
+	// The selection is only reused by sessions routed by the same router.
+	router *router.Router
+
+	client zerocopy.UDPClient
+	policy router.UDPSessionPolicy
+	until  time.Time
+	csid   uint64
+}
+
+// sessionAffinity remembers the upstream selection of recently closed sessions by client session ID,
+// so that a client that keeps sending after its session timed out lands on the same upstream.
+//
+// Entries expire after the grace window. All entries share the window, so the list of entries
+// in the order they were added is also ordered by expiry. The number of entries is bounded:
+// when full, the entry closest to expiry is forgotten. Adding and taking entries take constant time.
+//
+// It is not safe for concurrent use. The owning relay protects it with its table mutex.
+// A nil *sessionAffinity remembers nothing.
+type sessionAffinity struct {
+	window     time.Duration
+	maxEntries int
+	entries    map[uint64]*list.Element
+	byExpiry   list.List
+}
+
+// newSessionAffinity returns a new sessionAffinity with the given grace window.
+// If window is not positive, nil is returned.
+func newSessionAffinity(window time.Duration, maxEntries int) *sessionAffinity {
+	if window <= 0 {
+		return nil
+	}
+	return &sessionAffinity{
+		window:     window,
+		maxEntries: maxEntries,
+		entries:    make(map[uint64]*list.Element),
+	}
+}
+
+// add remembers the upstream selection of the session csid that ended at now.
+func (a *sessionAffinity) add(csid uint64, e sessionAffinityEntry, now time.Time) {
+	if a == nil {
+		return
+	}
+	if elem, ok := a.entries[csid]; ok {
+		a.remove(elem)
+	}
+
+	// Sweep expired entries from the front, and forget the entry closest to expiry if still full.
+	for front := a.byExpiry.Front(); front != nil; front = a.byExpiry.Front() {
+		if now.Before(front.Value.(*sessionAffinityEntry).until) && len(a.entries) < a.maxEntries {
+			break
+		}
+		a.remove(front)
+	}
+
+	e.until = now.Add(a.window)
+	e.csid = csid
+	a.entries[csid] = a.byExpiry.PushBack(&e)
+}
+
+// take removes and returns the upstream selection of the recently closed session csid.
+// It returns false if there is none within the grace window at now.
+func (a *sessionAffinity) take(csid uint64, now time.Time) (sessionAffinityEntry, bool) {
+	if a == nil {
+		return sessionAffinityEntry{}, false
+	}
+	elem, ok := a.entries[csid]
+	if !ok {
+		return sessionAffinityEntry{}, false
+	}
+	a.remove(elem)
+	e := elem.Value.(*sessionAffinityEntry)
+	if !now.Before(e.until) {
+		return sessionAffinityEntry{}, false
+	}
+	return *e, true
+}
+
+// remove forgets the entry of elem.
+func (a *sessionAffinity) remove(elem *list.Element) {
+	delete(a.entries, elem.Value.(*sessionAffinityEntry).csid)
+	a.byExpiry.Remove(elem)
+}
+
+// preferAffinity returns the upstream selection of the recently closed session affinity
+// in place of the routed selection c and policy, if it was made by sessionRouter,
+// its route also matches the new session described by requestInfo, and its client is still available.
+func (s *UDPSessionRelay) preferAffinity(csid uint64, affinity sessionAffinityEntry, sessionRouter *router.Router, requestInfo router.RequestInfo, c zerocopy.UDPClient, policy router.UDPSessionPolicy) (zerocopy.UDPClient, router.UDPSessionPolicy) {
+	if affinity.client == nil || affinity.client == c || affinity.router != sessionRouter {
+		return c, policy
+	}
+
+	affinityClientName := affinity.client.String()
+	if !sessionRouter.ClientAvailable(affinityClientName) {
+		return c, policy
+	}
+
+	// The new session's first target may be routed elsewhere than the old session's.
+	matched, err := sessionRouter.UDPRouteMatches(requestInfo, affinity.policy.Route)
+	if err != nil || !matched {
+		return c, policy
+	}
+
+	if ce := s.logger.Check(zap.DebugLevel, "Reusing upstream of recently closed session"); ce != nil {
+		ce.Write(
+			zap.String("server", s.serverName),
+			zap.String("listenAddress", s.listenAddress),
+			zap.Uint64("clientSessionID", csid),
+			zap.String("client", affinityClientName),
+			zap.String("route", affinity.policy.Route),
+			zap.String("routedClient", c.String()),
+		)
+	}
+	return affinity.client, affinity.policy
+}
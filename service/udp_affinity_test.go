@@ -0,0 +1,167 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/direct"
+	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+func TestSessionAffinityTake(t *testing.T) {
+	a := newSessionAffinity(time.Minute, maxSessionAffinityEntries)
+	client := direct.NewUDPClient("direct", 1500, 0, 0)
+	now := time.Unix(0, 0)
+
+	if _, ok := a.take(1, now); ok {
+		t.Error("Unknown session has affinity")
+	}
+
+	a.add(1, sessionAffinityEntry{client: client}, now)
+	e, ok := a.take(1, now.Add(time.Minute-time.Second))
+	if !ok || e.client != client {
+		t.Errorf("take(1) = %v, %v, want %v, true", e.client, ok, client)
+	}
+
+	// Entries are taken at most once.
+	if _, ok = a.take(1, now); ok {
+		t.Error("Taken session still has affinity")
+	}
+
+	// Entries expire after the window.
+	a.add(2, sessionAffinityEntry{client: client}, now)
+	if _, ok = a.take(2, now.Add(time.Minute)); ok {
+		t.Error("Expired session has affinity")
+	}
+	if len(a.entries) != 0 {
+		t.Errorf("len(a.entries) = %d, want 0", len(a.entries))
+	}
+}
+
+func TestSessionAffinityDisabled(t *testing.T) {
+	a := newSessionAffinity(0, maxSessionAffinityEntries)
+	if a != nil {
+		t.Fatal("Zero window did not disable session affinity")
+	}
+	a.add(1, sessionAffinityEntry{client: direct.NewUDPClient("direct", 1500, 0, 0)}, time.Unix(0, 0))
+	if _, ok := a.take(1, time.Unix(0, 0)); ok {
+		t.Error("Disabled session affinity remembered a session")
+	}
+}
+
+func TestSessionAffinityBound(t *testing.T) {
+	const maxEntries = 4
+	a := newSessionAffinity(time.Minute, maxEntries)
+	client := direct.NewUDPClient("direct", 1500, 0, 0)
+	now := time.Unix(0, 0)
+
+	for csid := uint64(0); csid < 2*maxEntries; csid++ {
+		a.add(csid, sessionAffinityEntry{client: client}, now)
+		if len(a.entries) > maxEntries {
+			t.Fatalf("len(a.entries) = %d, want at most %d", len(a.entries), maxEntries)
+		}
+	}
+
+	// When full of live entries, the entry closest to expiry is forgotten.
+	for csid := uint64(0); csid < maxEntries; csid++ {
+		if _, ok := a.entries[csid]; ok {
+			t.Errorf("Oldest session %d was not forgotten", csid)
+		}
+	}
+	for csid := uint64(maxEntries); csid < 2*maxEntries; csid++ {
+		if _, ok := a.entries[csid]; !ok {
+			t.Errorf("Newest session %d was forgotten", csid)
+		}
+	}
+
+	// Expired entries are swept before live ones are forgotten.
+	later := now.Add(time.Minute)
+	a.add(100, sessionAffinityEntry{client: client}, later)
+	a.add(101, sessionAffinityEntry{client: client}, later)
+	if len(a.entries) != 2 || a.byExpiry.Len() != 2 {
+		t.Errorf("len(a.entries) = %d, a.byExpiry.Len() = %d, want 2", len(a.entries), a.byExpiry.Len())
+	}
+	for _, csid := range []uint64{100, 101} {
+		if _, ok := a.take(csid, later); !ok {
+			t.Errorf("Session %d has no affinity", csid)
+		}
+	}
+	if a.byExpiry.Len() != 0 {
+		t.Errorf("a.byExpiry.Len() = %d, want 0", a.byExpiry.Len())
+	}
+}
+
+func BenchmarkSessionAffinityAddFull(b *testing.B) {
+	a := newSessionAffinity(time.Minute, maxSessionAffinityEntries)
+	client := direct.NewUDPClient("direct", 1500, 0, 0)
+	now := time.Unix(0, 0)
+
+	for csid := uint64(0); csid < maxSessionAffinityEntries; csid++ {
+		a.add(csid, sessionAffinityEntry{client: client}, now)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		a.add(maxSessionAffinityEntries+uint64(i), sessionAffinityEntry{client: client}, now)
+	}
+}
+
+func TestUDPSessionRelayPreferAffinity(t *testing.T) {
+	logger := zap.NewNop()
+	clientA := direct.NewUDPClient("a", 1500, 0, 0)
+	clientB := direct.NewUDPClient("b", 1500, 0, 0)
+	udpClientMap := map[string]zerocopy.UDPClient{
+		"a": clientA,
+		"b": clientB,
+	}
+	rc := router.Config{
+		DefaultUDPClientName: "b",
+		Routes: []router.RouteConfig{
+			{Name: "to-a", Client: "a", Network: "udp", ToDomains: []string{"example.com"}},
+		},
+	}
+	r, err := rc.Router(logger, nil, nil, nil, udpClientMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRouter, err := rc.Router(logger, nil, nil, nil, udpClientMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := UDPSessionRelay{logger: logger}
+
+	toA := router.UDPSessionPolicy{Route: "to-a"}
+	toDefault := router.UDPSessionPolicy{Route: "default"}
+	requestA := router.RequestInfo{TargetAddr: conn.MustAddrFromDomainPort("example.com", 443)}
+	requestB := router.RequestInfo{TargetAddr: conn.MustAddrFromDomainPort("example.org", 443)}
+
+	for _, c := range []struct {
+		name         string
+		affinity     sessionAffinityEntry
+		draining     bool
+		requestInfo  router.RequestInfo
+		routedClient zerocopy.UDPClient
+		routedPolicy router.UDPSessionPolicy
+		wantClient   zerocopy.UDPClient
+	}{
+		{"None", sessionAffinityEntry{}, false, requestA, clientB, toDefault, clientB},
+		{"Reused", sessionAffinityEntry{router: r, client: clientA, policy: toA}, false, requestA, clientB, toDefault, clientA},
+		{"RouterReplaced", sessionAffinityEntry{router: otherRouter, client: clientA, policy: toA}, false, requestA, clientB, toDefault, clientB},
+		{"Draining", sessionAffinityEntry{router: r, client: clientA, policy: toA}, true, requestA, clientB, toDefault, clientB},
+		{"RouteNotMatched", sessionAffinityEntry{router: r, client: clientA, policy: toA}, false, requestB, clientB, toDefault, clientB},
+		{"DefaultRouteOverridden", sessionAffinityEntry{router: r, client: clientB, policy: toDefault}, false, requestA, clientA, toA, clientA},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if err := r.SetClientDraining("a", c.draining); err != nil {
+				t.Fatal(err)
+			}
+			got, _ := s.preferAffinity(1, c.affinity, r, c.requestInfo, c.routedClient, c.routedPolicy)
+			if got != c.wantClient {
+				t.Errorf("preferAffinity() = %s, want %s", got, c.wantClient)
+			}
+		})
+	}
+}
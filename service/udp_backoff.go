@@ -0,0 +1,95 @@
+package service
+
+import (
+	"errors"
+	"syscall"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/stats"
+)
+
+const (
+	// natConnRetryBackoff is how long a session has to wait before retrying
+	// after a transient failure to set up its outbound socket.
+	natConnRetryBackoff = time.Second
+
+	// unpackFailureBlockDuration is how long a session ID is blocked after the session
+	// is torn down for reaching the consecutive unpack failure threshold.
+	unpackFailureBlockDuration = time.Minute
+
+	// natConnBackoffSweepThreshold is the number of backoff entries above which
+	// expired entries are swept on insertion.
+	natConnBackoffSweepThreshold = 4096
+)
+
+// NATConnError is returned when the outbound side of a NAT session cannot be set up.
+type NATConnError struct {
+	// Op is the operation that failed, e.g. "create client session" or "listen".
+	Op string
+
+	// Err is the underlying error.
+	Err error
+}
+
+// Error implements the error Error method.
+func (e *NATConnError) Error() string {
+	return "failed to " + e.Op + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *NATConnError) Unwrap() error {
+	return e.Err
+}
+
+// Transient returns whether the failure is caused by a temporary resource shortage,
+// such as ephemeral port or file descriptor exhaustion, and may succeed on retry.
+// Other failures, such as bad configuration, are considered permanent.
+func (e *NATConnError) Transient() bool {
+	return errors.Is(e.Err, syscall.EMFILE) ||
+		errors.Is(e.Err, syscall.ENFILE) ||
+		errors.Is(e.Err, syscall.ENOBUFS) ||
+		errors.Is(e.Err, syscall.ENOMEM) ||
+		errors.Is(e.Err, syscall.EADDRINUSE) ||
+		errors.Is(e.Err, syscall.EADDRNOTAVAIL) ||
+		errors.Is(e.Err, conn.ErrPortRangeExhausted)
+}
+
+// Kind returns the stats classification of the failure.
+func (e *NATConnError) Kind() stats.NATConnErrorKind {
+	if e.Transient() {
+		return stats.NATConnErrorTransient
+	}
+	return stats.NATConnErrorPermanent
+}
+
+// natConnBackoff tracks session IDs whose packets are dropped until a deadline,
+// either to back off from a failed outbound socket setup, or to block a junk stream.
+//
+// It is not safe for concurrent use. The owning relay protects it with its table mutex.
+type natConnBackoff map[uint64]time.Time
+
+// active returns whether csid is backing off at now. Expired entries are removed.
+func (b natConnBackoff) active(csid uint64, now time.Time) bool {
+	until, ok := b[csid]
+	if !ok {
+		return false
+	}
+	if now.Before(until) {
+		return true
+	}
+	delete(b, csid)
+	return false
+}
+
+// add makes csid back off for d from now.
+func (b natConnBackoff) add(csid uint64, now time.Time, d time.Duration) {
+	if len(b) >= natConnBackoffSweepThreshold {
+		for k, until := range b {
+			if !now.Before(until) {
+				delete(b, k)
+			}
+		}
+	}
+	b[csid] = now.Add(d)
+}
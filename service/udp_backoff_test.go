@@ -0,0 +1,64 @@
+package service
+
+import (
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/stats"
+)
+
+func TestNATConnErrorTransient(t *testing.T) {
+	for _, c := range []struct {
+		err       error
+		transient bool
+	}{
+		{syscall.EMFILE, true},
+		{fmt.Errorf("listen udp: %w", syscall.EADDRINUSE), true},
+		{conn.ErrPortRangeExhausted, true},
+		{conn.ErrBadPortRange, false},
+		{syscall.EINVAL, false},
+	} {
+		e := &NATConnError{Op: "listen", Err: c.err}
+		if transient := e.Transient(); transient != c.transient {
+			t.Errorf("%v.Transient() returned %v, expected %v", e, transient, c.transient)
+		}
+		kind := stats.NATConnErrorPermanent
+		if c.transient {
+			kind = stats.NATConnErrorTransient
+		}
+		if k := e.Kind(); k != kind {
+			t.Errorf("%v.Kind() returned %v, expected %v", e, k, kind)
+		}
+	}
+}
+
+func TestNATConnBackoff(t *testing.T) {
+	b := make(natConnBackoff)
+	now := time.Now()
+
+	if b.active(1, now) {
+		t.Error("Expected no backoff for unknown session")
+	}
+
+	b.add(1, now, natConnRetryBackoff)
+	if !b.active(1, now.Add(natConnRetryBackoff/2)) {
+		t.Error("Expected backoff to be active before the deadline")
+	}
+	if b.active(1, now.Add(natConnRetryBackoff)) {
+		t.Error("Expected backoff to expire at the deadline")
+	}
+	if len(b) != 0 {
+		t.Errorf("Expected expired entry to be removed, got %d entries", len(b))
+	}
+
+	for i := uint64(0); i < natConnBackoffSweepThreshold; i++ {
+		b.add(i, now, natConnRetryBackoff)
+	}
+	b.add(natConnBackoffSweepThreshold, now.Add(natConnRetryBackoff), natConnRetryBackoff)
+	if len(b) != 1 {
+		t.Errorf("Expected expired entries to be swept, got %d entries", len(b))
+	}
+}
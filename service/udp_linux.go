@@ -0,0 +1,17 @@
+package service
+
+import (
+	"errors"
+
+	"github.com/database64128/shadowsocks-go/conn"
+)
+
+// droppedAfterRetry returns the number of packets conn.WriteMsgvec dropped
+// after retrying on transient send buffer pressure, or 0 if err is not caused by it.
+func droppedAfterRetry(err error) int {
+	var dme *conn.DroppedMessagesError
+	if errors.As(err, &dme) {
+		return dme.Count
+	}
+	return 0
+}
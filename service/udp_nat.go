@@ -56,14 +56,16 @@ type UDPNATRelay struct {
 	serverName             string
 	listenAddress          string
 	listenerFwmark         int
+	listenerReuseAddr      bool
 	mtu                    int
 	packetBufFrontHeadroom int
 	packetBufRecvSize      int
 	batchSize              int
+	prewarmPackets         int
 	natTimeout             time.Duration
 	server                 zerocopy.UDPNATServer
 	serverConn             *net.UDPConn
-	router                 *router.Router
+	router                 atomic.Pointer[router.Router]
 	logger                 *zap.Logger
 	queuedPacketPool       sync.Pool
 	mu                     sync.Mutex
@@ -73,35 +75,58 @@ type UDPNATRelay struct {
 	recvFromServerConn     func()
 }
 
+// UDPNATRelayConfig is the configuration of a [UDPNATRelay].
+type UDPNATRelayConfig struct {
+	// BatchMode selects the relay loops. On Linux, "sendmmsg" or the empty string selects
+	// the recvmmsg(2) and sendmmsg(2) loops. Any other value selects the generic loops.
+	BatchMode string
+
+	ServerName     string
+	ListenAddress  string
+	BatchSize      int
+	PrewarmPackets int
+	ListenerFwmark int
+	MTU            int
+
+	// MaxClientHeadroom is the maximum headroom required by any client the router may select.
+	// If nil, no headroom is required.
+	MaxClientHeadroom zerocopy.Headroom
+
+	NATTimeout time.Duration
+
+	// If ListenerReuseAddr is true, SO_REUSEADDR is set on the serverConn. See [conn.ListenUDP].
+	ListenerReuseAddr bool
+}
+
 func NewUDPNATRelay(
-	batchMode, serverName, listenAddress string,
-	batchSize, listenerFwmark, mtu, maxClientFrontHeadroom, maxClientRearHeadroom int,
-	natTimeout time.Duration,
+	config UDPNATRelayConfig,
 	server zerocopy.UDPNATServer,
 	router *router.Router,
 	logger *zap.Logger,
-) *UDPNATRelay {
-	packetBufFrontHeadroom := maxClientFrontHeadroom - server.FrontHeadroom()
-	if packetBufFrontHeadroom < 0 {
-		packetBufFrontHeadroom = 0
+) (*UDPNATRelay, error) {
+	maxClientHeadroom := config.MaxClientHeadroom
+	if maxClientHeadroom == nil {
+		maxClientHeadroom = zerocopy.ZeroHeadroom{}
 	}
-	packetBufRearHeadroom := maxClientRearHeadroom - server.RearHeadroom()
-	if packetBufRearHeadroom < 0 {
-		packetBufRearHeadroom = 0
+	packetBufRecvSize := config.MTU - zerocopy.IPv4HeaderLength - zerocopy.UDPHeaderLength
+	if err := zerocopy.CheckHeadroom(maxClientHeadroom, packetBufRecvSize); err != nil {
+		return nil, err
 	}
-	packetBufRecvSize := mtu - zerocopy.IPv4HeaderLength - zerocopy.UDPHeaderLength
-	packetBufSize := packetBufFrontHeadroom + packetBufRecvSize + packetBufRearHeadroom
+	packetBufHeadroom := zerocopy.ExcessHeadroom(maxClientHeadroom, server)
+	packetBufFrontHeadroom := packetBufHeadroom.Front
+	packetBufSize := packetBufFrontHeadroom + packetBufRecvSize + packetBufHeadroom.Rear
 	s := UDPNATRelay{
-		serverName:             serverName,
-		listenAddress:          listenAddress,
-		listenerFwmark:         listenerFwmark,
-		mtu:                    mtu,
+		serverName:             config.ServerName,
+		listenAddress:          config.ListenAddress,
+		listenerFwmark:         config.ListenerFwmark,
+		listenerReuseAddr:      config.ListenerReuseAddr,
+		mtu:                    config.MTU,
 		packetBufFrontHeadroom: packetBufFrontHeadroom,
 		packetBufRecvSize:      packetBufRecvSize,
-		batchSize:              batchSize,
-		natTimeout:             natTimeout,
+		batchSize:              config.BatchSize,
+		prewarmPackets:         config.PrewarmPackets,
+		natTimeout:             config.NATTimeout,
 		server:                 server,
-		router:                 router,
 		logger:                 logger,
 		queuedPacketPool: sync.Pool{
 			New: func() any {
@@ -112,8 +137,9 @@ func NewUDPNATRelay(
 		},
 		table: make(map[netip.AddrPort]*natEntry),
 	}
-	s.setRelayFunc(batchMode)
-	return &s
+	s.router.Store(router)
+	s.setRelayFunc(config.BatchMode)
+	return &s, nil
 }
 
 // String implements the Service String method.
@@ -121,14 +147,24 @@ func (s *UDPNATRelay) String() string {
 	return fmt.Sprintf("UDP NAT relay service for %s", s.serverName)
 }
 
+// SetRouter replaces the router used to select clients for new sessions.
+// Established sessions keep the client selected by the router that created them.
+//
+// SetRouter is safe to call while the relay is running.
+func (s *UDPNATRelay) SetRouter(r *router.Router) {
+	s.router.Store(r)
+}
+
 // Start implements the Service Start method.
 func (s *UDPNATRelay) Start() error {
-	serverConn, err := conn.ListenUDP("udp", s.listenAddress, true, s.listenerFwmark)
+	serverConn, err := conn.ListenUDP("udp", s.listenAddress, true, s.listenerReuseAddr, s.listenerFwmark)
 	if err != nil {
 		return err
 	}
 	s.serverConn = serverConn
 
+	prewarmPool(&s.queuedPacketPool, s.prewarmPackets)
+
 	s.mwg.Add(1)
 
 	go func() {
@@ -177,11 +213,12 @@ func (s *UDPNATRelay) recvFromServerConnGeneric() {
 		}
 		err = conn.ParseFlagsForError(flags)
 		if err != nil {
-			s.logger.Warn("Failed to read packet from serverConn",
+			s.logger.Warn(flagsErrorMessage(err, "Failed to read packet from serverConn"),
 				zap.String("server", s.serverName),
 				zap.String("listenAddress", s.listenAddress),
 				zap.Stringer("clientAddress", clientAddrPort),
 				zap.Int("packetLength", n),
+				zap.Int("recvBufSize", s.packetBufRecvSize),
 				zap.Error(err),
 			)
 
@@ -229,26 +266,24 @@ func (s *UDPNATRelay) recvFromServerConnGeneric() {
 		payloadBytesReceived += uint64(queuedPacket.length)
 
 		var clientPktinfop *[]byte
-		cmsg := cmsgBuf[:cmsgn]
-
-		if !bytes.Equal(entry.clientPktinfoCache, cmsg) {
-			clientPktinfoAddr, clientPktinfoIfindex, err := conn.ParsePktinfoCmsg(cmsg)
-			if err != nil {
-				s.logger.Warn("Failed to parse pktinfo control message from serverConn",
-					zap.String("server", s.serverName),
-					zap.String("listenAddress", s.listenAddress),
-					zap.Stringer("clientAddress", clientAddrPort),
-					zap.Stringer("targetAddress", &queuedPacket.targetAddr),
-					zap.Error(err),
-				)
+		cm, err := conn.ParseSocketControlMessage(cmsgBuf[:cmsgn])
+		if err != nil {
+			s.logger.Warn("Failed to parse control messages from serverConn",
+				zap.String("server", s.serverName),
+				zap.String("listenAddress", s.listenAddress),
+				zap.Stringer("clientAddress", clientAddrPort),
+				zap.Stringer("targetAddress", &queuedPacket.targetAddr),
+				zap.Error(err),
+			)
 
-				s.putQueuedPacket(queuedPacket)
-				s.mu.Unlock()
-				continue
-			}
+			s.putQueuedPacket(queuedPacket)
+			s.mu.Unlock()
+			continue
+		}
 
-			clientPktinfoCache := make([]byte, len(cmsg))
-			copy(clientPktinfoCache, cmsg)
+		if !bytes.Equal(entry.clientPktinfoCache, cm.PktinfoCmsg) {
+			clientPktinfoCache := make([]byte, len(cm.PktinfoCmsg))
+			copy(clientPktinfoCache, cm.PktinfoCmsg)
 			clientPktinfop = &clientPktinfoCache
 			entry.clientPktinfo.Store(clientPktinfop)
 			entry.clientPktinfoCache = clientPktinfoCache
@@ -259,8 +294,8 @@ func (s *UDPNATRelay) recvFromServerConnGeneric() {
 					zap.String("listenAddress", s.listenAddress),
 					zap.Stringer("clientAddress", clientAddrPort),
 					zap.Stringer("targetAddress", &queuedPacket.targetAddr),
-					zap.Stringer("clientPktinfoAddr", clientPktinfoAddr),
-					zap.Uint32("clientPktinfoIfindex", clientPktinfoIfindex),
+					zap.Stringer("clientPktinfoAddr", cm.PktinfoAddr),
+					zap.Uint32("clientPktinfoIfindex", cm.PktinfoIfindex),
 				)
 			}
 		}
@@ -285,7 +320,17 @@ func (s *UDPNATRelay) recvFromServerConnGeneric() {
 					}
 				}()
 
-				c, err := s.router.GetUDPClient(s.serverName, clientAddrPort, queuedPacket.targetAddr)
+				// Use the same router for the whole session, even if it is swapped out by SetRouter.
+				sessionRouter := acquireRouter(&s.router)
+				if sessionRouter == nil {
+					return
+				}
+				defer sessionRouter.Release()
+				c, policy, err := sessionRouter.GetUDPClient(router.RequestInfo{
+					Server:         s.serverName,
+					SourceAddrPort: clientAddrPort,
+					TargetAddr:     queuedPacket.targetAddr,
+				})
 				if err != nil {
 					s.logger.Warn("Failed to get UDP client for new NAT session",
 						zap.String("server", s.serverName),
@@ -303,8 +348,7 @@ func (s *UDPNATRelay) recvFromServerConnGeneric() {
 				s.wg.Add(1)
 				defer s.wg.Done()
 
-				natConnMaxPacketSize, natConnFwmark := c.LinkInfo()
-				natConnPacker, natConnUnpacker, err := c.NewSession()
+				clientInfo, natConnPacker, natConnUnpacker, err := c.NewSession()
 				if err != nil {
 					s.logger.Warn("Failed to create new UDP client session",
 						zap.String("server", s.serverName),
@@ -317,7 +361,15 @@ func (s *UDPNATRelay) recvFromServerConnGeneric() {
 					return
 				}
 
-				natConn, err := conn.ListenUDP("udp", "", false, natConnFwmark)
+				if clientInfo.Closer != nil {
+					defer clientInfo.Closer.Close()
+				}
+
+				if policy.Fwmark != 0 {
+					clientInfo.Fwmark = policy.Fwmark
+				}
+
+				natConn, err := conn.ListenUDPOnInterface("udp", clientInfo.Netns, clientInfo.Interface, clientInfo.LocalPortRange, false, clientInfo.Fwmark)
 				if err != nil {
 					s.logger.Warn("Failed to create UDP socket for new NAT session",
 						zap.String("server", s.serverName),
@@ -325,7 +377,8 @@ func (s *UDPNATRelay) recvFromServerConnGeneric() {
 						zap.String("listenAddress", s.listenAddress),
 						zap.Stringer("clientAddress", clientAddrPort),
 						zap.Stringer("targetAddress", &queuedPacket.targetAddr),
-						zap.Int("natConnFwmark", natConnFwmark),
+						zap.Int("natConnFwmark", clientInfo.Fwmark),
+						zap.Stringer("natConnLocalPortRange", clientInfo.LocalPortRange),
 						zap.Error(err),
 					)
 					return
@@ -356,7 +409,7 @@ func (s *UDPNATRelay) recvFromServerConnGeneric() {
 				sendChClean = true
 
 				entry.natConn = natConn
-				entry.natConnRecvBufSize = natConnMaxPacketSize
+				entry.natConnRecvBufSize = clientInfo.MaxPacketSize
 				entry.natConnPacker = natConnPacker
 				entry.natConnUnpacker = natConnUnpacker
 
@@ -368,6 +421,9 @@ func (s *UDPNATRelay) recvFromServerConnGeneric() {
 					zap.Stringer("targetAddress", &queuedPacket.targetAddr),
 				)
 
+				sessionRouter.SessionOpened(clientName)
+				defer sessionRouter.SessionClosed(clientName)
+
 				s.wg.Add(1)
 
 				go func() {
@@ -482,14 +538,8 @@ func (s *UDPNATRelay) relayServerConnToNatConnGeneric(clientAddrPort netip.AddrP
 func (s *UDPNATRelay) relayNatConnToServerConnGeneric(clientAddrPort netip.AddrPort, entry *natEntry, clientPktinfop *[]byte) {
 	maxClientPacketSize := zerocopy.MaxPacketSizeForAddr(s.mtu, clientAddrPort.Addr())
 
-	frontHeadroom := entry.serverConnPacker.FrontHeadroom() - entry.natConnUnpacker.FrontHeadroom()
-	if frontHeadroom < 0 {
-		frontHeadroom = 0
-	}
-	rearHeadroom := entry.serverConnPacker.RearHeadroom() - entry.natConnUnpacker.RearHeadroom()
-	if rearHeadroom < 0 {
-		rearHeadroom = 0
-	}
+	headroom := zerocopy.ExcessHeadroom(entry.serverConnPacker, entry.natConnUnpacker)
+	frontHeadroom, rearHeadroom := headroom.Front, headroom.Rear
 
 	var (
 		clientPktinfo    []byte
@@ -523,12 +573,13 @@ func (s *UDPNATRelay) relayNatConnToServerConnGeneric(clientAddrPort netip.AddrP
 		}
 		err = conn.ParseFlagsForError(flags)
 		if err != nil {
-			s.logger.Warn("Failed to read packet from natConn",
+			s.logger.Warn(flagsErrorMessage(err, "Failed to read packet from natConn"),
 				zap.String("server", s.serverName),
 				zap.String("listenAddress", s.listenAddress),
 				zap.Stringer("clientAddress", clientAddrPort),
 				zap.Stringer("packetSourceAddress", packetSourceAddrPort),
 				zap.Int("packetLength", n),
+				zap.Int("recvBufSize", entry.natConnRecvBufSize),
 				zap.Error(err),
 			)
 			continue
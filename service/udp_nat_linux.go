@@ -9,6 +9,7 @@ import (
 	"unsafe"
 
 	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/router"
 	"github.com/database64128/shadowsocks-go/zerocopy"
 	"go.uber.org/zap"
 	"golang.org/x/sys/unix"
@@ -110,11 +111,12 @@ func (s *UDPNATRelay) recvFromServerConnRecvmmsg() {
 
 			err = conn.ParseFlagsForError(int(msg.Msghdr.Flags))
 			if err != nil {
-				s.logger.Warn("Packet from serverConn discarded",
+				s.logger.Warn(flagsErrorMessage(err, "Packet from serverConn discarded"),
 					zap.String("server", s.serverName),
 					zap.String("listenAddress", s.listenAddress),
 					zap.Stringer("clientAddress", clientAddrPort),
 					zap.Uint32("packetLength", msg.Msglen),
+					zap.Int("recvBufSize", s.packetBufRecvSize),
 					zap.Error(err),
 				)
 
@@ -157,25 +159,23 @@ func (s *UDPNATRelay) recvFromServerConnRecvmmsg() {
 			payloadBytesReceived += uint64(queuedPacket.length)
 
 			var clientPktinfop *[]byte
-			cmsg := cmsgvec[i][:msg.Msghdr.Controllen]
-
-			if !bytes.Equal(entry.clientPktinfoCache, cmsg) {
-				clientPktinfoAddr, clientPktinfoIfindex, err := conn.ParsePktinfoCmsg(cmsg)
-				if err != nil {
-					s.logger.Warn("Failed to parse pktinfo control message from serverConn",
-						zap.String("server", s.serverName),
-						zap.String("listenAddress", s.listenAddress),
-						zap.Stringer("clientAddress", clientAddrPort),
-						zap.Stringer("targetAddress", &queuedPacket.targetAddr),
-						zap.Error(err),
-					)
+			cm, err := conn.ParseSocketControlMessage(cmsgvec[i][:msg.Msghdr.Controllen])
+			if err != nil {
+				s.logger.Warn("Failed to parse control messages from serverConn",
+					zap.String("server", s.serverName),
+					zap.String("listenAddress", s.listenAddress),
+					zap.Stringer("clientAddress", clientAddrPort),
+					zap.Stringer("targetAddress", &queuedPacket.targetAddr),
+					zap.Error(err),
+				)
 
-					s.putQueuedPacket(queuedPacket)
-					continue
-				}
+				s.putQueuedPacket(queuedPacket)
+				continue
+			}
 
-				clientPktinfoCache := make([]byte, len(cmsg))
-				copy(clientPktinfoCache, cmsg)
+			if !bytes.Equal(entry.clientPktinfoCache, cm.PktinfoCmsg) {
+				clientPktinfoCache := make([]byte, len(cm.PktinfoCmsg))
+				copy(clientPktinfoCache, cm.PktinfoCmsg)
 				clientPktinfop = &clientPktinfoCache
 				entry.clientPktinfo.Store(clientPktinfop)
 				entry.clientPktinfoCache = clientPktinfoCache
@@ -186,8 +186,8 @@ func (s *UDPNATRelay) recvFromServerConnRecvmmsg() {
 						zap.String("listenAddress", s.listenAddress),
 						zap.Stringer("clientAddress", clientAddrPort),
 						zap.Stringer("targetAddress", &queuedPacket.targetAddr),
-						zap.Stringer("clientPktinfoAddr", clientPktinfoAddr),
-						zap.Uint32("clientPktinfoIfindex", clientPktinfoIfindex),
+						zap.Stringer("clientPktinfoAddr", cm.PktinfoAddr),
+						zap.Uint32("clientPktinfoIfindex", cm.PktinfoIfindex),
 					)
 				}
 			}
@@ -212,7 +212,17 @@ func (s *UDPNATRelay) recvFromServerConnRecvmmsg() {
 						}
 					}()
 
-					c, err := s.router.GetUDPClient(s.serverName, clientAddrPort, queuedPacket.targetAddr)
+					// Use the same router for the whole session, even if it is swapped out by SetRouter.
+					sessionRouter := acquireRouter(&s.router)
+					if sessionRouter == nil {
+						return
+					}
+					defer sessionRouter.Release()
+					c, policy, err := sessionRouter.GetUDPClient(router.RequestInfo{
+						Server:         s.serverName,
+						SourceAddrPort: clientAddrPort,
+						TargetAddr:     queuedPacket.targetAddr,
+					})
 					if err != nil {
 						s.logger.Warn("Failed to get UDP client for new NAT session",
 							zap.String("server", s.serverName),
@@ -230,8 +240,7 @@ func (s *UDPNATRelay) recvFromServerConnRecvmmsg() {
 					s.wg.Add(1)
 					defer s.wg.Done()
 
-					natConnMaxPacketSize, natConnFwmark := c.LinkInfo()
-					natConnPacker, natConnUnpacker, err := c.NewSession()
+					clientInfo, natConnPacker, natConnUnpacker, err := c.NewSession()
 					if err != nil {
 						s.logger.Warn("Failed to create new UDP client session",
 							zap.String("server", s.serverName),
@@ -244,7 +253,15 @@ func (s *UDPNATRelay) recvFromServerConnRecvmmsg() {
 						return
 					}
 
-					natConn, err := conn.ListenUDP("udp", "", false, natConnFwmark)
+					if clientInfo.Closer != nil {
+						defer clientInfo.Closer.Close()
+					}
+
+					if policy.Fwmark != 0 {
+						clientInfo.Fwmark = policy.Fwmark
+					}
+
+					natConn, err := conn.ListenUDPOnInterface("udp", clientInfo.Netns, clientInfo.Interface, clientInfo.LocalPortRange, false, clientInfo.Fwmark)
 					if err != nil {
 						s.logger.Warn("Failed to create UDP socket for new NAT session",
 							zap.String("server", s.serverName),
@@ -252,7 +269,8 @@ func (s *UDPNATRelay) recvFromServerConnRecvmmsg() {
 							zap.String("listenAddress", s.listenAddress),
 							zap.Stringer("clientAddress", clientAddrPort),
 							zap.Stringer("targetAddress", &queuedPacket.targetAddr),
-							zap.Int("natConnFwmark", natConnFwmark),
+							zap.Int("natConnFwmark", clientInfo.Fwmark),
+							zap.Stringer("natConnLocalPortRange", clientInfo.LocalPortRange),
 							zap.Error(err),
 						)
 						return
@@ -283,7 +301,7 @@ func (s *UDPNATRelay) recvFromServerConnRecvmmsg() {
 					sendChClean = true
 
 					entry.natConn = natConn
-					entry.natConnRecvBufSize = natConnMaxPacketSize
+					entry.natConnRecvBufSize = clientInfo.MaxPacketSize
 					entry.natConnPacker = natConnPacker
 					entry.natConnUnpacker = natConnUnpacker
 
@@ -295,6 +313,9 @@ func (s *UDPNATRelay) recvFromServerConnRecvmmsg() {
 						zap.Stringer("targetAddress", &queuedPacket.targetAddr),
 					)
 
+					sessionRouter.SessionOpened(clientName)
+					defer sessionRouter.SessionClosed(clientName)
+
 					s.wg.Add(1)
 
 					go func() {
@@ -350,13 +371,14 @@ func (s *UDPNATRelay) recvFromServerConnRecvmmsg() {
 
 func (s *UDPNATRelay) relayServerConnToNatConnSendmmsg(clientAddrPort netip.AddrPort, entry *natEntry) {
 	var (
-		destAddrPort     netip.AddrPort
-		packetStart      int
-		packetLength     int
-		err              error
-		sendmmsgCount    uint64
-		packetsSent      uint64
-		payloadBytesSent uint64
+		destAddrPort             netip.AddrPort
+		packetStart              int
+		packetLength             int
+		err                      error
+		sendmmsgCount            uint64
+		packetsSent              uint64
+		packetsDroppedAfterRetry uint64
+		payloadBytesSent         uint64
 	)
 
 	qpvec := make([]*natQueuedPacket, s.batchSize)
@@ -424,15 +446,21 @@ main:
 			}
 		}
 
-		if err := conn.WriteMsgvec(entry.natConn, msgvec[:count]); err != nil {
-			s.logger.Warn("Failed to batch write packets to natConn",
-				zap.String("server", s.serverName),
-				zap.String("listenAddress", s.listenAddress),
-				zap.Stringer("clientAddress", clientAddrPort),
-				zap.Stringer("lastTargetAddress", &qpvec[count-1].targetAddr),
-				zap.Stringer("lastWriteDestAddress", destAddrPort),
-				zap.Error(err),
-			)
+		sent, err := conn.WriteMsgvec(entry.natConn, msgvec[:count])
+		if err != nil {
+			if n := droppedAfterRetry(err); n > 0 {
+				packetsDroppedAfterRetry += uint64(n)
+			} else {
+				s.logger.Warn("Failed to batch write packets to natConn",
+					zap.String("server", s.serverName),
+					zap.String("listenAddress", s.listenAddress),
+					zap.Stringer("clientAddress", clientAddrPort),
+					zap.Stringer("lastTargetAddress", &qpvec[count-1].targetAddr),
+					zap.Stringer("lastWriteDestAddress", destAddrPort),
+					zap.Int("packetsDropped", count-sent),
+					zap.Error(err),
+				)
+			}
 		}
 
 		if err := entry.natConn.SetReadDeadline(time.Now().Add(s.natTimeout)); err != nil {
@@ -446,7 +474,7 @@ main:
 		}
 
 		sendmmsgCount++
-		packetsSent += uint64(count)
+		packetsSent += uint64(sent)
 
 		qpvecn := qpvec[:count]
 
@@ -466,6 +494,7 @@ main:
 		zap.Stringer("lastWriteDestAddress", destAddrPort),
 		zap.Uint64("sendmmsgCount", sendmmsgCount),
 		zap.Uint64("packetsSent", packetsSent),
+		zap.Uint64("packetsDroppedAfterRetry", packetsDroppedAfterRetry),
 		zap.Uint64("payloadBytesSent", payloadBytesSent),
 	)
 }
@@ -474,19 +503,14 @@ func (s *UDPNATRelay) relayNatConnToServerConnSendmmsg(clientAddrPort netip.Addr
 	clientPktinfo := *clientPktinfop
 	maxClientPacketSize := zerocopy.MaxPacketSizeForAddr(s.mtu, clientAddrPort.Addr())
 
-	frontHeadroom := entry.serverConnPacker.FrontHeadroom() - entry.natConnUnpacker.FrontHeadroom()
-	if frontHeadroom < 0 {
-		frontHeadroom = 0
-	}
-	rearHeadroom := entry.serverConnPacker.RearHeadroom() - entry.natConnUnpacker.RearHeadroom()
-	if rearHeadroom < 0 {
-		rearHeadroom = 0
-	}
+	headroom := zerocopy.ExcessHeadroom(entry.serverConnPacker, entry.natConnUnpacker)
+	frontHeadroom, rearHeadroom := headroom.Front, headroom.Rear
 
 	var (
-		sendmmsgCount    uint64
-		packetsSent      uint64
-		payloadBytesSent uint64
+		sendmmsgCount            uint64
+		packetsSent              uint64
+		packetsDroppedAfterRetry uint64
+		payloadBytesSent         uint64
 	)
 
 	name, namelen := conn.AddrPortToSockaddr(clientAddrPort)
@@ -552,12 +576,13 @@ func (s *UDPNATRelay) relayNatConnToServerConnSendmmsg(clientAddrPort netip.Addr
 
 			err = conn.ParseFlagsForError(int(msg.Msghdr.Flags))
 			if err != nil {
-				s.logger.Warn("Packet from natConn discarded",
+				s.logger.Warn(flagsErrorMessage(err, "Packet from natConn discarded"),
 					zap.String("server", s.serverName),
 					zap.String("listenAddress", s.listenAddress),
 					zap.Stringer("clientAddress", clientAddrPort),
 					zap.Stringer("packetSourceAddress", packetSourceAddrPort),
 					zap.Uint32("packetLength", msg.Msglen),
+					zap.Int("recvBufSize", entry.natConnRecvBufSize),
 					zap.Error(err),
 				)
 				continue
@@ -613,18 +638,23 @@ func (s *UDPNATRelay) relayNatConnToServerConnSendmmsg(clientAddrPort netip.Addr
 			}
 		}
 
-		err = conn.WriteMsgvec(s.serverConn, smsgvec[:ns])
+		sent, err := conn.WriteMsgvec(s.serverConn, smsgvec[:ns])
 		if err != nil {
-			s.logger.Warn("Failed to batch write packets to serverConn",
-				zap.String("server", s.serverName),
-				zap.String("listenAddress", s.listenAddress),
-				zap.Stringer("clientAddress", clientAddrPort),
-				zap.Error(err),
-			)
+			if n := droppedAfterRetry(err); n > 0 {
+				packetsDroppedAfterRetry += uint64(n)
+			} else {
+				s.logger.Warn("Failed to batch write packets to serverConn",
+					zap.String("server", s.serverName),
+					zap.String("listenAddress", s.listenAddress),
+					zap.Stringer("clientAddress", clientAddrPort),
+					zap.Int("packetsDropped", ns-sent),
+					zap.Error(err),
+				)
+			}
 		}
 
 		sendmmsgCount++
-		packetsSent += uint64(ns)
+		packetsSent += uint64(sent)
 	}
 
 	s.logger.Info("Finished relay serverConn <- natConn",
@@ -633,6 +663,7 @@ func (s *UDPNATRelay) relayNatConnToServerConnSendmmsg(clientAddrPort netip.Addr
 		zap.Stringer("clientAddress", clientAddrPort),
 		zap.Uint64("sendmmsgCount", sendmmsgCount),
 		zap.Uint64("packetsSent", packetsSent),
+		zap.Uint64("packetsDroppedAfterRetry", packetsDroppedAfterRetry),
 		zap.Uint64("payloadBytesSent", payloadBytesSent),
 	)
 }
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"container/list"
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxRateLimitedSources is the maximum number of source addresses tracked by a sourceRateLimiter.
+	// When exceeded, the least recently seen source is forgotten.
+	maxRateLimitedSources = 65536
+
+	// minSourcePacketBurst is the minimum packet burst size of a sourceRateLimiter.
+	minSourcePacketBurst = 16
+)
+
+// sourceBucket holds the token buckets of a source address.
+type sourceBucket struct {
+	addr    netip.Addr
+	packets float64
+	bytes   float64
+	last    time.Time
+}
+
+// sourceRateLimiter caps the packet rate and byte rate of each source address with token buckets.
+// Each bucket starts full and holds one second worth of tokens.
+//
+// Buckets are kept in a bounded LRU, so a flood of distinct spoofed source addresses
+// cannot exhaust memory. A forgotten source starts over with full buckets.
+//
+// A sourceRateLimiter is not safe for concurrent use. It is owned by the relay's receive goroutine.
+// A nil *sourceRateLimiter allows all packets.
+type sourceRateLimiter struct {
+	// packetRate and byteRate are the refill rates per second. Zero means unlimited.
+	packetRate float64
+	byteRate   float64
+
+	packetBurst float64
+	byteBurst   float64
+
+	maxSources int
+	buckets    map[netip.Addr]*list.Element
+	lru        list.List
+
+	// dropped is the number of packets dropped for exceeding the rate limits.
+	dropped atomic.Uint64
+}
+
+// newSourceRateLimiter returns a new rate limiter that allows each source address
+// packetsPerSecond packets and bytesPerSecond bytes per second.
+// A zero rate is not limited. If both rates are zero, nil is returned.
+func newSourceRateLimiter(packetsPerSecond, bytesPerSecond uint64, maxSources int) *sourceRateLimiter {
+	if packetsPerSecond == 0 && bytesPerSecond == 0 {
+		return nil
+	}
+	packetBurst := float64(packetsPerSecond)
+	if packetBurst < minSourcePacketBurst {
+		packetBurst = minSourcePacketBurst
+	}
+	byteBurst := float64(bytesPerSecond)
+	if byteBurst < minShaperBurst {
+		byteBurst = minShaperBurst
+	}
+	l := &sourceRateLimiter{
+		packetRate:  float64(packetsPerSecond),
+		byteRate:    float64(bytesPerSecond),
+		packetBurst: packetBurst,
+		byteBurst:   byteBurst,
+		maxSources:  maxSources,
+		buckets:     make(map[netip.Addr]*list.Element),
+	}
+	l.lru.Init()
+	return l
+}
+
+// Allow takes one packet of n bytes from the buckets of addr,
+// and returns whether the packet is within the rate limits.
+// Dropped packets do not take tokens.
+func (l *sourceRateLimiter) Allow(addr netip.Addr, n int, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	addr = addr.Unmap()
+
+	var b *sourceBucket
+	if e, ok := l.buckets[addr]; ok {
+		l.lru.MoveToFront(e)
+		b = e.Value.(*sourceBucket)
+		elapsed := now.Sub(b.last).Seconds()
+		b.packets += elapsed * l.packetRate
+		if b.packets > l.packetBurst {
+			b.packets = l.packetBurst
+		}
+		b.bytes += elapsed * l.byteRate
+		if b.bytes > l.byteBurst {
+			b.bytes = l.byteBurst
+		}
+		b.last = now
+	} else {
+		if l.lru.Len() >= l.maxSources {
+			oldest := l.lru.Back()
+			delete(l.buckets, oldest.Value.(*sourceBucket).addr)
+			l.lru.Remove(oldest)
+		}
+		b = &sourceBucket{
+			addr:    addr,
+			packets: l.packetBurst,
+			bytes:   l.byteBurst,
+			last:    now,
+		}
+		l.buckets[addr] = l.lru.PushFront(b)
+	}
+
+	if l.packetRate > 0 && b.packets < 1 || l.byteRate > 0 && b.bytes < float64(n) {
+		l.dropped.Add(1)
+		return false
+	}
+	b.packets--
+	b.bytes -= float64(n)
+	return true
+}
+
+// Dropped returns the number of packets dropped for exceeding the rate limits.
+func (l *sourceRateLimiter) Dropped() uint64 {
+	if l == nil {
+		return 0
+	}
+	return l.dropped.Load()
+}
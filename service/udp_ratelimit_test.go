@@ -0,0 +1,107 @@
+package service
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSourceRateLimiterPacketRate(t *testing.T) {
+	l := newSourceRateLimiter(minSourcePacketBurst, 0, maxRateLimitedSources)
+	addr := netip.MustParseAddr("192.0.2.1")
+	now := time.Unix(0, 0)
+
+	for i := 0; i < minSourcePacketBurst; i++ {
+		if !l.Allow(addr, 1500, now) {
+			t.Fatalf("Packet %d within burst was dropped", i)
+		}
+	}
+	if l.Allow(addr, 1500, now) {
+		t.Error("Packet over burst was allowed")
+	}
+
+	// The IPv4-mapped form of the address shares the bucket.
+	if l.Allow(netip.AddrFrom16(addr.As16()), 1500, now) {
+		t.Error("Packet from IPv4-mapped address over burst was allowed")
+	}
+
+	// Other sources are not affected.
+	if !l.Allow(netip.MustParseAddr("192.0.2.2"), 1500, now) {
+		t.Error("Packet from another source was dropped")
+	}
+
+	// Tokens are refilled over time.
+	now = now.Add(time.Second / minSourcePacketBurst)
+	if !l.Allow(addr, 1500, now) {
+		t.Error("Packet after refill was dropped")
+	}
+	if l.Allow(addr, 1500, now) {
+		t.Error("Packet over refilled tokens was allowed")
+	}
+
+	if dropped := l.Dropped(); dropped != 3 {
+		t.Errorf("Dropped() = %d, expected 3", dropped)
+	}
+}
+
+func TestSourceRateLimiterByteRate(t *testing.T) {
+	l := newSourceRateLimiter(0, minShaperBurst, maxRateLimitedSources)
+	addr := netip.MustParseAddr("2001:db8::1")
+	now := time.Unix(0, 0)
+
+	for i := 0; i < minShaperBurst/1000; i++ {
+		if !l.Allow(addr, 1000, now) {
+			t.Fatalf("Packet %d within burst was dropped", i)
+		}
+	}
+	if l.Allow(addr, 1000, now) {
+		t.Error("Packet over byte burst was allowed")
+	}
+
+	// Dropped packets do not take tokens, so a smaller packet still fits.
+	if !l.Allow(addr, minShaperBurst%1000, now) {
+		t.Error("Packet fitting in the remaining tokens was dropped")
+	}
+}
+
+func TestSourceRateLimiterBounded(t *testing.T) {
+	const maxSources = 4
+	l := newSourceRateLimiter(1, 0, maxSources)
+	now := time.Unix(0, 0)
+
+	for i := 0; i < 2*maxSources; i++ {
+		addr := netip.AddrFrom4([4]byte{192, 0, 2, byte(i)})
+		for j := 0; j < minSourcePacketBurst; j++ {
+			l.Allow(addr, 1, now)
+		}
+	}
+
+	if n := len(l.buckets); n != maxSources {
+		t.Errorf("Tracked %d sources, expected %d", n, maxSources)
+	}
+	if n := l.lru.Len(); n != maxSources {
+		t.Errorf("LRU has %d entries, expected %d", n, maxSources)
+	}
+
+	// The least recently seen source was forgotten, and starts over with full buckets.
+	if !l.Allow(netip.AddrFrom4([4]byte{192, 0, 2, 0}), 1, now) {
+		t.Error("Packet from forgotten source was dropped")
+	}
+	// The most recently seen source is still limited.
+	if l.Allow(netip.AddrFrom4([4]byte{192, 0, 2, 2*maxSources - 1}), 1, now) {
+		t.Error("Packet from tracked source over burst was allowed")
+	}
+}
+
+func TestSourceRateLimiterDisabled(t *testing.T) {
+	l := newSourceRateLimiter(0, 0, maxRateLimitedSources)
+	if l != nil {
+		t.Fatal("newSourceRateLimiter() returned non-nil limiter without limits")
+	}
+	if !l.Allow(netip.MustParseAddr("192.0.2.1"), 1500, time.Now()) {
+		t.Error("Nil limiter dropped a packet")
+	}
+	if dropped := l.Dropped(); dropped != 0 {
+		t.Errorf("Dropped() = %d, expected 0", dropped)
+	}
+}
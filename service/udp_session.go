@@ -2,6 +2,8 @@ package service
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
@@ -9,10 +11,12 @@ import (
 	"os"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/database64128/shadowsocks-go/conn"
 	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/stats"
 	"github.com/database64128/shadowsocks-go/zerocopy"
 	"go.uber.org/zap"
 )
@@ -24,6 +28,10 @@ type sessionQueuedPacket struct {
 	length         int
 	targetAddr     conn.Addr
 	clientAddrPort netip.AddrPort
+
+	// recvTime is the kernel receive timestamp of the packet.
+	// It is the zero value if receive timestamps are disabled.
+	recvTime time.Time
 }
 
 // sessionClientAddrInfo stores a session's client address information.
@@ -48,69 +56,281 @@ type session struct {
 	clientAddrInfo      atomic.Pointer[sessionClientAddrInfo]
 	clientAddrPortCache netip.AddrPort
 	clientPktinfoCache  []byte
+	createdAt           time.Time
 	natConn             *net.UDPConn
 	natConnRecvBufSize  int
-	natConnSendCh       chan *sessionQueuedPacket
-	natConnPacker       zerocopy.ClientPacker
-	natConnUnpacker     zerocopy.ClientUnpacker
-	serverConnPacker    zerocopy.ServerPacker
-	serverConnUnpacker  zerocopy.ServerUnpacker
+
+	// allowsTarget reports whether the session's user may send packets to a target.
+	// It is nil if the user is not restricted by a target allowlist.
+	allowsTarget func(target conn.Addr) bool
+
+	natConnSendCh      chan *sessionQueuedPacket
+	natConnPacker      zerocopy.ClientPacker
+	natConnUnpacker    zerocopy.ClientUnpacker
+	serverConnPacker   zerocopy.ServerPacker
+	serverConnUnpacker zerocopy.ServerUnpacker
+
+	// unpackMu protects serverConnUnpacker once the session is in the table.
+	// Established sessions are unpacked without holding the relay's table mutex,
+	// so that decrypting packets does not serialize with other users of the table.
+	unpackMu sync.Mutex
+
+	// clientName, natConnLocalAddrPort, and natConnUnpacker are set before the natConn is swapped into state.
+	clientName           string
+	natConnLocalAddrPort netip.AddrPort
+
+	// serverConnUnpackFailures is the number of consecutive packets from the client that failed to unpack.
+	// It is protected by the relay's table mutex.
+	serverConnUnpackFailures int
+
+	// natConnShaper and serverConnShaper pace writes to natConn and serverConn.
+	// They are nil if the session's bandwidth is not limited.
+	natConnShaper    *shaper
+	serverConnShaper *shaper
+
+	// natConnSources is the set of sources accepted on the natConn.
+	// It is nil if source validation is disabled.
+	natConnSources *natSourceSet
+
+	// natConnSendChBytes is the total payload length of packets queued in natConnSendCh.
+	// It is only maintained if the relay limits queued bytes.
+	natConnSendChBytes atomic.Int64
+
+	// mirrorSendCh queues copies of packets from the client for the mirror upstream.
+	// It is nil if mirroring is disabled.
+	mirrorSendCh chan *sessionQueuedPacket
+}
+
+// UDPSessionInfo is a snapshot of a UDP session's information.
+type UDPSessionInfo struct {
+	ClientSessionID uint64         `json:"clientSessionID"`
+	ClientAddress   netip.AddrPort `json:"clientAddress"`
+	Client          string         `json:"client"`
+
+	// NATLocalAddress is the local address of the session's outbound socket.
+	// It is the zero value if the session is still being set up.
+	NATLocalAddress netip.AddrPort `json:"natLocalAddress"`
+
+	// Reorder is the packet ordering statistics of packets from the client.
+	// It is nil if the session's unpacker does not track packet sequence numbers.
+	Reorder *zerocopy.ReorderStats `json:"reorder,omitempty"`
+
+	// UplinkGaps is the number of sequence gaps in packets from the client.
+	// DownlinkGaps is the number of sequence gaps in packets from the upstream.
+	// Gaps on only one side localize packet loss to the client's access network
+	// or to the path between the relay and the upstream.
+	// Each is zero if the corresponding unpacker does not count sequence gaps.
+	UplinkGaps   uint64 `json:"uplinkGaps"`
+	DownlinkGaps uint64 `json:"downlinkGaps"`
 }
 
 // UDPSessionRelay is a session-based UDP relay service.
 //
 // Incoming UDP packets are dispatched to NAT sessions based on the client session ID.
 type UDPSessionRelay struct {
-	serverName             string
-	listenAddress          string
-	listenerFwmark         int
-	mtu                    int
-	packetBufFrontHeadroom int
-	packetBufRecvSize      int
-	batchSize              int
-	natTimeout             time.Duration
-	server                 zerocopy.UDPSessionServer
-	serverConn             *net.UDPConn
-	router                 *router.Router
-	logger                 *zap.Logger
-	queuedPacketPool       sync.Pool
-	mu                     sync.Mutex
-	wg                     sync.WaitGroup
-	mwg                    sync.WaitGroup
-	table                  map[uint64]*session
-	recvFromServerConn     func()
+	serverName              string
+	listenAddress           string
+	listenerFwmark          int
+	listenerReuseAddr       bool
+	mtu                     int
+	packetBufFrontHeadroom  int
+	packetBufRecvSize       int
+	packetBufRearHeadroom   int
+	batchSize               atomic.Int64
+	prewarmPackets          int
+	batchLinger             time.Duration
+	natTimeout              time.Duration
+	sweepInterval           time.Duration
+	ipv6FlowLabel           bool
+	flowLabelSalt           uint64
+	adaptiveRecvBuf         bool
+	validateNATSource       bool
+	logSessionUpstream      bool
+	recvICMPErrors          bool
+	recvTimestamps          bool
+	unpackFailureThreshold  int
+	maxQueuedBytes          int
+	setupSem                chan struct{}
+	sourceRateLimiter       *sourceRateLimiter
+	reverseLookup           *reverseLookupCache
+	server                  zerocopy.UDPSessionServer
+	mirror                  zerocopy.UDPClient
+	serverConn              *net.UDPConn
+	adoptedServerConn       *net.UDPConn
+	adoptedMu               sync.Mutex
+	adoptedNATConns         map[uint64]adoptedNATConn
+	adoptedNATConnsTimer    *time.Timer
+	router                  atomic.Pointer[router.Router]
+	collector               *stats.Collector
+	logger                  *zap.Logger
+	tap                     PacketTap
+	queuedPacketPool        sync.Pool
+	downlinkBufPool         sync.Pool
+	uplinkVecsPool          sync.Pool
+	mu                      sync.Mutex
+	wg                      sync.WaitGroup
+	mwg                     sync.WaitGroup
+	table                   map[uint64]*session
+	natConnBackoff          natConnBackoff
+	affinity                *sessionAffinity
+	sweptSessions           atomic.Uint64
+	targetNotAllowedPackets atomic.Uint64
+	mirrorPacketsDropped    atomic.Uint64
+	icmpErrors              [conn.NumICMPErrorReasons]atomic.Uint64
+	sweeperDone             chan struct{}
+	recvFromServerConn      func()
 }
 
+// UDPSessionRelayConfig is the configuration of a [UDPSessionRelay].
+type UDPSessionRelayConfig struct {
+	// BatchMode selects the relay loops. On Linux, "sendmmsg" or the empty string selects
+	// the recvmmsg(2) and sendmmsg(2) loops. Any other value selects the generic loops.
+	BatchMode string
+
+	ServerName     string
+	ListenAddress  string
+	BatchSize      int
+	PrewarmPackets int
+	ListenerFwmark int
+	MTU            int
+
+	// MaxClientHeadroom is the maximum headroom required by any client the router may select.
+	// If nil, no headroom is required.
+	MaxClientHeadroom zerocopy.Headroom
+
+	// In sendmmsg batch mode, a non-zero BatchLinger makes the serverConn -> natConn relay wait
+	// up to BatchLinger for more packets before sending a partial batch.
+	BatchLinger time.Duration
+
+	NATTimeout time.Duration
+
+	// If SweepInterval is positive, the session table is scanned on every interval for sessions
+	// that have been without a natConn for longer than NATTimeout, and such sessions are removed.
+	// This is a safety net for sessions whose setup goroutine failed to clean up after itself.
+	SweepInterval time.Duration
+
+	// If AffinityWindow is positive, the upstream selection of each closed session is remembered
+	// for AffinityWindow. A session recreated with the same client session ID within the window
+	// reuses the remembered client, as long as the router is unchanged, the remembered route matches
+	// the recreated session's first target, and the client is still available.
+	AffinityWindow time.Duration
+
+	// If ListenerReuseAddr is true, SO_REUSEADDR is set on the serverConn. See [conn.ListenUDP].
+	ListenerReuseAddr bool
+
+	// If IPv6FlowLabel is true, the sendmmsg serverConn -> natConn relay labels IPv6 datagrams
+	// with a flow label derived from the client session ID and a random per-relay salt.
+	// See [conn.FlowLabelFromID] for the rate of label collisions between sessions.
+	// Flow labels are registered exclusively, so a session whose label is already in use
+	// sends unlabeled datagrams.
+	IPv6FlowLabel bool
+
+	// If AdaptiveRecvBuf is true, natConn receive buffers start small and grow toward the maximum packet size
+	// each time a truncated packet is received. Each growth step drops the truncated packet.
+	AdaptiveRecvBuf bool
+
+	// If ValidateNATSource is true, packets received on a session's natConn are dropped before unpacking,
+	// unless they come from an address the session has sent packets to.
+	ValidateNATSource bool
+
+	// If LogSessionUpstream is true, each session logs its upstream address at Info level
+	// after the first successful write to its natConn.
+	LogSessionUpstream bool
+
+	// If ReverseLookupTargets is true, PTR names of IP targets are looked up in the background,
+	// and included in session logs once cached. Lookups never block the relay.
+	ReverseLookupTargets bool
+
+	// If RecvICMPErrors is true, ICMP errors triggered by packets sent to upstreams are received on natConns,
+	// counted and logged. A session is torn down when its upstream returns port unreachable.
+	// Only supported on Linux.
+	RecvICMPErrors bool
+
+	// If RecvTimestamps is true, kernel receive timestamps are enabled on the serverConn, and the time from
+	// the kernel receiving a packet from the client to the relay sending it to the upstream is observed
+	// in the collector. See [stats.Collector.ObserveRelayDelay]. Only supported on Linux.
+	RecvTimestamps bool
+
+	// If UnpackFailureThreshold is positive, a session is torn down and its client session ID
+	// blocked for a while after that many consecutive packets from the client fail authentication.
+	UnpackFailureThreshold int
+
+	// If MaxQueuedBytes is positive, packets from the client are dropped when queueing them would bring
+	// the total payload length of the session's send channel over MaxQueuedBytes.
+	MaxQueuedBytes int
+
+	// If MaxConcurrentSetups is positive, at most MaxConcurrentSetups sessions are set up at the same time.
+	// Session setup includes routing, creating the client session, and creating the outbound socket,
+	// which may involve DNS resolution and dialing. Excess setups wait for a slot for a short while,
+	// and fail if none becomes available. This is independent of the total number of sessions.
+	MaxConcurrentSetups int
+
+	// If SourcePacketRateLimit or SourceByteRateLimit is positive, packets from each client address are limited
+	// to that many packets or bytes per second, before the packets are authenticated. Packets over the limits
+	// are dropped and counted. This keeps spoofed sources from using the relay for reflection or amplification.
+	SourcePacketRateLimit uint64
+	SourceByteRateLimit   uint64
+}
+
+// NewUDPSessionRelay creates a new UDP session relay service.
+//
+// Sessions that fail to set up are counted in collector by failure reason,
+// and the setup latency of each successful session is observed in collector.
+// In sendmmsg batch mode, the number of packets sent by each sendmmsg(2) call is also recorded in collector.
+//
+// If tap is not nil, packets relayed by the service are reported to the tap.
+// Taps are installed on a per-session basis, so an unset tap adds no cost to the relay loops.
+//
+// If mirror is not nil, each session also sends a copy of every packet from the client to the upstream
+// of a mirror session created with it. Replies from the mirror upstream are never read.
+// Copies are dropped when the mirror falls behind, so mirroring never blocks the primary upstream.
 func NewUDPSessionRelay(
-	batchMode, serverName, listenAddress string,
-	batchSize, listenerFwmark, mtu, maxClientFrontHeadroom, maxClientRearHeadroom int,
-	natTimeout time.Duration,
+	config UDPSessionRelayConfig,
 	server zerocopy.UDPSessionServer,
+	mirror zerocopy.UDPClient,
 	router *router.Router,
+	collector *stats.Collector,
 	logger *zap.Logger,
-) *UDPSessionRelay {
-	packetBufFrontHeadroom := maxClientFrontHeadroom - server.FrontHeadroom()
-	if packetBufFrontHeadroom < 0 {
-		packetBufFrontHeadroom = 0
+	tap PacketTap,
+) (*UDPSessionRelay, error) {
+	maxClientHeadroom := config.MaxClientHeadroom
+	if maxClientHeadroom == nil {
+		maxClientHeadroom = zerocopy.ZeroHeadroom{}
 	}
-	packetBufRearHeadroom := maxClientRearHeadroom - server.RearHeadroom()
-	if packetBufRearHeadroom < 0 {
-		packetBufRearHeadroom = 0
+	packetBufRecvSize := config.MTU - zerocopy.IPv4HeaderLength - zerocopy.UDPHeaderLength
+	if err := zerocopy.CheckHeadroom(maxClientHeadroom, packetBufRecvSize); err != nil {
+		return nil, err
 	}
-	packetBufRecvSize := mtu - zerocopy.IPv4HeaderLength - zerocopy.UDPHeaderLength
-	packetBufSize := packetBufFrontHeadroom + packetBufRecvSize + packetBufRearHeadroom
+	packetBufHeadroom := zerocopy.ExcessHeadroom(maxClientHeadroom, server)
+	packetBufFrontHeadroom := packetBufHeadroom.Front
+	packetBufSize := packetBufFrontHeadroom + packetBufRecvSize + packetBufHeadroom.Rear
 	s := UDPSessionRelay{
-		serverName:             serverName,
-		listenAddress:          listenAddress,
-		listenerFwmark:         listenerFwmark,
-		mtu:                    mtu,
+		serverName:             config.ServerName,
+		listenAddress:          config.ListenAddress,
+		listenerFwmark:         config.ListenerFwmark,
+		listenerReuseAddr:      config.ListenerReuseAddr,
+		mtu:                    config.MTU,
 		packetBufFrontHeadroom: packetBufFrontHeadroom,
 		packetBufRecvSize:      packetBufRecvSize,
-		batchSize:              batchSize,
-		natTimeout:             natTimeout,
+		packetBufRearHeadroom:  packetBufHeadroom.Rear,
+		prewarmPackets:         config.PrewarmPackets,
+		batchLinger:            config.BatchLinger,
+		natTimeout:             config.NATTimeout,
+		sweepInterval:          config.SweepInterval,
+		ipv6FlowLabel:          config.IPv6FlowLabel,
+		adaptiveRecvBuf:        config.AdaptiveRecvBuf,
+		validateNATSource:      config.ValidateNATSource,
+		logSessionUpstream:     config.LogSessionUpstream,
+		recvICMPErrors:         config.RecvICMPErrors,
+		recvTimestamps:         config.RecvTimestamps,
+		unpackFailureThreshold: config.UnpackFailureThreshold,
+		maxQueuedBytes:         config.MaxQueuedBytes,
+		sourceRateLimiter:      newSourceRateLimiter(config.SourcePacketRateLimit, config.SourceByteRateLimit, maxRateLimitedSources),
 		server:                 server,
-		router:                 router,
+		mirror:                 mirror,
+		collector:              collector,
 		logger:                 logger,
+		tap:                    tap,
 		queuedPacketPool: sync.Pool{
 			New: func() any {
 				return &sessionQueuedPacket{
@@ -118,10 +338,27 @@ func NewUDPSessionRelay(
 				}
 			},
 		},
-		table: make(map[uint64]*session),
+		table:          make(map[uint64]*session),
+		natConnBackoff: make(natConnBackoff),
+		affinity:       newSessionAffinity(config.AffinityWindow, maxSessionAffinityEntries),
+	}
+	s.router.Store(router)
+	if config.IPv6FlowLabel {
+		var b [8]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, fmt.Errorf("failed to generate flow label salt: %w", err)
+		}
+		s.flowLabelSalt = binary.LittleEndian.Uint64(b[:])
+	}
+	if config.ReverseLookupTargets {
+		s.reverseLookup = newSystemReverseLookupCache(logger)
 	}
-	s.setRelayFunc(batchMode)
-	return &s
+	if config.MaxConcurrentSetups > 0 {
+		s.setupSem = make(chan struct{}, config.MaxConcurrentSetups)
+	}
+	s.batchSize.Store(int64(config.BatchSize))
+	s.setRelayFunc(config.BatchMode)
+	return &s, nil
 }
 
 // String implements the Service String method.
@@ -131,12 +368,36 @@ func (s *UDPSessionRelay) String() string {
 
 // Start implements the Service Start method.
 func (s *UDPSessionRelay) Start() error {
-	serverConn, err := conn.ListenUDP("udp", s.listenAddress, true, s.listenerFwmark)
-	if err != nil {
-		return err
+	serverConn := s.adoptedServerConn
+	s.adoptedServerConn = nil
+	if serverConn == nil {
+		var err error
+		serverConn, err = conn.ListenUDP("udp", s.listenAddress, true, s.listenerReuseAddr, s.listenerFwmark)
+		if err != nil {
+			return err
+		}
 	}
 	s.serverConn = serverConn
 
+	if s.recvTimestamps {
+		if err := conn.SetRecvTimestamp(serverConn); err != nil {
+			serverConn.Close()
+			return err
+		}
+	}
+
+	prewarmPool(&s.queuedPacketPool, s.prewarmPackets)
+
+	s.adoptedMu.Lock()
+	if len(s.adoptedNATConns) > 0 {
+		s.adoptedNATConnsTimer = time.AfterFunc(s.natTimeout, s.closeAdoptedNATConns)
+	}
+	s.adoptedMu.Unlock()
+
+	if s.reverseLookup != nil {
+		s.reverseLookup.Start()
+	}
+
 	s.mwg.Add(1)
 
 	go func() {
@@ -144,6 +405,17 @@ func (s *UDPSessionRelay) Start() error {
 		s.mwg.Done()
 	}()
 
+	if s.sweepInterval > 0 {
+		done := make(chan struct{})
+		s.sweeperDone = done
+		s.mwg.Add(1)
+
+		go func() {
+			s.sweepStaleSessionsLoop(done)
+			s.mwg.Done()
+		}()
+	}
+
 	s.logger.Info("Started UDP session relay service",
 		zap.String("server", s.serverName),
 		zap.String("listenAddress", s.listenAddress),
@@ -188,11 +460,12 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric() {
 		}
 		err = conn.ParseFlagsForError(flags)
 		if err != nil {
-			s.logger.Warn("Failed to read packet from serverConn",
+			s.logger.Warn(flagsErrorMessage(err, "Failed to read packet from serverConn"),
 				zap.String("server", s.serverName),
 				zap.String("listenAddress", s.listenAddress),
 				zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
 				zap.Int("packetLength", n),
+				zap.Int("recvBufSize", s.packetBufRecvSize),
 				zap.Error(err),
 			)
 
@@ -200,6 +473,20 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric() {
 			continue
 		}
 
+		if s.sourceRateLimiter != nil && !s.sourceRateLimiter.Allow(queuedPacket.clientAddrPort.Addr(), n, time.Now()) {
+			if ce := s.logger.Check(zap.DebugLevel, "Dropping packet from source over rate limit"); ce != nil {
+				ce.Write(
+					zap.String("server", s.serverName),
+					zap.String("listenAddress", s.listenAddress),
+					zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+					zap.Int("packetLength", n),
+				)
+			}
+
+			s.putQueuedPacket(queuedPacket)
+			continue
+		}
+
 		packet := recvBuf[:n]
 
 		csid, err := s.server.SessionInfo(packet)
@@ -218,6 +505,22 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric() {
 
 		s.mu.Lock()
 
+		if len(s.natConnBackoff) > 0 && s.natConnBackoff.active(csid, time.Now()) {
+			if ce := s.logger.Check(zap.DebugLevel, "Dropping packet for session in backoff"); ce != nil {
+				ce.Write(
+					zap.String("server", s.serverName),
+					zap.String("listenAddress", s.listenAddress),
+					zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+					zap.Uint64("clientSessionID", csid),
+					zap.Int("packetLength", n),
+				)
+			}
+
+			s.putQueuedPacket(queuedPacket)
+			s.mu.Unlock()
+			continue
+		}
+
 		entry, ok := s.table[csid]
 		if !ok {
 			entry = &session{}
@@ -237,9 +540,41 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric() {
 				s.mu.Unlock()
 				continue
 			}
+
+			if s.tap != nil {
+				entry.serverConnUnpacker = &tapServerUnpacker{entry.serverConnUnpacker, s.tap, csid}
+			}
+		}
+
+		if ok {
+			s.mu.Unlock()
+			entry.unpackMu.Lock()
 		}
 
 		queuedPacket.targetAddr, queuedPacket.start, queuedPacket.length, err = entry.serverConnUnpacker.UnpackInPlace(queuedPacket.buf, queuedPacket.clientAddrPort, s.packetBufFrontHeadroom, n)
+
+		if ok {
+			entry.unpackMu.Unlock()
+			s.mu.Lock()
+
+			// The session may have ended while the packet was being unpacked.
+			if s.table[csid] != entry {
+				if ce := s.logger.Check(zap.DebugLevel, "Dropping packet for session that ended during unpacking"); ce != nil {
+					ce.Write(
+						zap.String("server", s.serverName),
+						zap.String("listenAddress", s.listenAddress),
+						zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+						zap.Uint64("clientSessionID", csid),
+						zap.Int("packetLength", n),
+					)
+				}
+
+				s.putQueuedPacket(queuedPacket)
+				s.mu.Unlock()
+				continue
+			}
+		}
+
 		if err != nil {
 			s.logger.Warn("Failed to unpack packet",
 				zap.String("server", s.serverName),
@@ -250,46 +585,51 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric() {
 				zap.Error(err),
 			)
 
+			if ok {
+				s.recordUnpackFailure(csid, entry, queuedPacket.clientAddrPort, err)
+			}
+
 			s.putQueuedPacket(queuedPacket)
 			s.mu.Unlock()
 			continue
 		}
 
+		entry.serverConnUnpackFailures = 0
 		packetsReceived++
 		payloadBytesReceived += uint64(queuedPacket.length)
 
 		var clientAddrInfop *sessionClientAddrInfo
-		cmsg := cmsgBuf[:cmsgn]
+		cm, err := conn.ParseSocketControlMessage(cmsgBuf[:cmsgn])
+		if err != nil {
+			s.logger.Warn("Failed to parse control messages from serverConn",
+				zap.String("server", s.serverName),
+				zap.String("listenAddress", s.listenAddress),
+				zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+				zap.Stringer("targetAddress", &queuedPacket.targetAddr),
+				zap.Uint64("clientSessionID", csid),
+				zap.Error(err),
+			)
+
+			s.putQueuedPacket(queuedPacket)
+			s.mu.Unlock()
+			continue
+		}
+
+		queuedPacket.recvTime = cm.Timestamp
 
 		updateClientAddrPort := entry.clientAddrPortCache != queuedPacket.clientAddrPort
-		updateClientPktinfo := !bytes.Equal(entry.clientPktinfoCache, cmsg)
+		updateClientPktinfo := !bytes.Equal(entry.clientPktinfoCache, cm.PktinfoCmsg)
 
 		if updateClientAddrPort {
 			entry.clientAddrPortCache = queuedPacket.clientAddrPort
 		}
 
 		if updateClientPktinfo {
-			entry.clientPktinfoCache = make([]byte, len(cmsg))
-			copy(entry.clientPktinfoCache, cmsg)
+			entry.clientPktinfoCache = make([]byte, len(cm.PktinfoCmsg))
+			copy(entry.clientPktinfoCache, cm.PktinfoCmsg)
 		}
 
 		if updateClientAddrPort || updateClientPktinfo {
-			clientPktinfoAddr, clientPktinfoIfindex, err := conn.ParsePktinfoCmsg(cmsg)
-			if err != nil {
-				s.logger.Warn("Failed to parse pktinfo control message from serverConn",
-					zap.String("server", s.serverName),
-					zap.String("listenAddress", s.listenAddress),
-					zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
-					zap.Stringer("targetAddress", &queuedPacket.targetAddr),
-					zap.Uint64("clientSessionID", csid),
-					zap.Error(err),
-				)
-
-				s.putQueuedPacket(queuedPacket)
-				s.mu.Unlock()
-				continue
-			}
-
 			clientAddrInfop = &sessionClientAddrInfo{entry.clientAddrPortCache, entry.clientPktinfoCache}
 			entry.clientAddrInfo.Store(clientAddrInfop)
 
@@ -299,8 +639,8 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric() {
 					zap.String("listenAddress", s.listenAddress),
 					zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
 					zap.Stringer("targetAddress", &queuedPacket.targetAddr),
-					zap.Stringer("clientPktinfoAddr", clientPktinfoAddr),
-					zap.Uint32("clientPktinfoIfindex", clientPktinfoIfindex),
+					zap.Stringer("clientPktinfoAddr", cm.PktinfoAddr),
+					zap.Uint32("clientPktinfoIfindex", cm.PktinfoIfindex),
 					zap.Uint64("clientSessionID", csid),
 				)
 			}
@@ -308,25 +648,88 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric() {
 
 		if !ok {
 			entry.natConnSendCh = make(chan *sessionQueuedPacket, sendChannelCapacity)
+			if s.mirror != nil {
+				entry.mirrorSendCh = make(chan *sessionQueuedPacket, sendChannelCapacity)
+			}
+			entry.createdAt = time.Now()
+			affinity, _ := s.affinity.take(csid, entry.createdAt)
 			s.table[csid] = entry
 
 			go func() {
-				var sendChClean bool
+				setupStart := time.Now()
+
+				var (
+					sendChClean    bool
+					backoff        bool
+					affinityRecord sessionAffinityEntry
+				)
 
 				defer func() {
 					s.mu.Lock()
 					close(entry.natConnSendCh)
-					delete(s.table, csid)
+					if entry.mirrorSendCh != nil {
+						close(entry.mirrorSendCh)
+					}
+					// The entry may have been removed by the stale session sweeper,
+					// and a new session with the same ID may have taken its place.
+					if s.table[csid] == entry {
+						delete(s.table, csid)
+					}
+					if backoff {
+						s.natConnBackoff.add(csid, time.Now(), natConnRetryBackoff)
+					}
+					if affinityRecord.client != nil {
+						s.affinity.add(csid, affinityRecord, time.Now())
+					}
 					s.mu.Unlock()
 
 					if !sendChClean {
 						for queuedPacket := range entry.natConnSendCh {
 							s.putQueuedPacket(queuedPacket)
 						}
+						if entry.mirrorSendCh != nil {
+							for queuedPacket := range entry.mirrorSendCh {
+								s.putQueuedPacket(queuedPacket)
+							}
+						}
 					}
 				}()
 
-				c, err := s.router.GetUDPClient(s.serverName, queuedPacket.clientAddrPort, queuedPacket.targetAddr)
+				if !s.acquireSetupSlot() {
+					s.logger.Warn("Timed out waiting for a session setup slot",
+						zap.String("server", s.serverName),
+						zap.String("listenAddress", s.listenAddress),
+						zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+						zap.Stringer("targetAddress", &queuedPacket.targetAddr),
+						zap.Uint64("clientSessionID", csid),
+						zap.Int("maxConcurrentSetups", cap(s.setupSem)),
+					)
+					s.collector.CollectSessionSetupFailure(stats.SessionSetupFailureQueue)
+					return
+				}
+
+				setupSlotHeld := true
+				defer func() {
+					if setupSlotHeld {
+						s.releaseSetupSlot()
+					}
+				}()
+
+				// Use the same router for the whole session, even if it is swapped out by SetRouter.
+				sessionRouter := acquireRouter(&s.router)
+				if sessionRouter == nil {
+					return
+				}
+				defer sessionRouter.Release()
+				username := sessionUsername(entry.serverConnUnpacker)
+
+				requestInfo := router.RequestInfo{
+					Server:         s.serverName,
+					Username:       username,
+					SourceAddrPort: queuedPacket.clientAddrPort,
+					TargetAddr:     queuedPacket.targetAddr,
+				}
+				c, policy, err := sessionRouter.GetUDPClient(requestInfo)
 				if err != nil {
 					s.logger.Warn("Failed to get UDP client for new NAT session",
 						zap.String("server", s.serverName),
@@ -336,18 +739,29 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric() {
 						zap.Uint64("clientSessionID", csid),
 						zap.Error(err),
 					)
+					reason := stats.SessionSetupFailureRoute
+					if errors.Is(err, router.ErrTargetNotAllowed) {
+						reason = stats.SessionSetupFailureTargetNotAllowed
+					}
+					s.collector.CollectSessionSetupFailure(reason)
 					return
 				}
 
+				// Later packets of the session may be sent to other targets, so they are checked against the allowlist too.
+				entry.allowsTarget = sessionRouter.TargetAllowlist(username)
+
+				c, policy = s.preferAffinity(csid, affinity, sessionRouter, requestInfo, c, policy)
 				clientName := c.String()
 
 				// Only add for the current goroutine here, since we don't want the router to block exiting.
 				s.wg.Add(1)
 				defer s.wg.Done()
 
-				natConnMaxPacketSize, natConnFwmark := c.LinkInfo()
-				natConnPacker, natConnUnpacker, err := c.NewSession()
+				clientInfo, natConnPacker, natConnUnpacker, err := c.NewSession()
 				if err != nil {
+					natConnErr := &NATConnError{Op: "create client session", Err: err}
+					backoff = natConnErr.Transient()
+					s.collector.CollectNATConnError(natConnErr.Kind())
 					s.logger.Warn("Failed to create new UDP client session",
 						zap.String("server", s.serverName),
 						zap.String("client", clientName),
@@ -355,11 +769,17 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric() {
 						zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
 						zap.Stringer("targetAddress", &queuedPacket.targetAddr),
 						zap.Uint64("clientSessionID", csid),
+						zap.Bool("transient", backoff),
 						zap.Error(err),
 					)
+					s.collector.CollectSessionSetupFailure(stats.SessionSetupFailureClientSession)
 					return
 				}
 
+				if clientInfo.Closer != nil {
+					defer clientInfo.Closer.Close()
+				}
+
 				serverConnPacker, err := s.server.NewPacker(csid)
 				if err != nil {
 					s.logger.Warn("Failed to create packer for client session",
@@ -370,11 +790,19 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric() {
 						zap.Uint64("clientSessionID", csid),
 						zap.Error(err),
 					)
+					s.collector.CollectSessionSetupFailure(stats.SessionSetupFailureServerPacker)
 					return
 				}
 
-				natConn, err := conn.ListenUDP("udp", "", false, natConnFwmark)
+				if policy.Fwmark != 0 {
+					clientInfo.Fwmark = policy.Fwmark
+				}
+
+				natConn, err := s.listenNATConn(csid, clientName, username, clientInfo)
 				if err != nil {
+					natConnErr := &NATConnError{Op: "listen", Err: err}
+					backoff = natConnErr.Transient()
+					s.collector.CollectNATConnError(natConnErr.Kind())
 					s.logger.Warn("Failed to create UDP socket for new NAT session",
 						zap.String("server", s.serverName),
 						zap.String("client", clientName),
@@ -382,9 +810,12 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric() {
 						zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
 						zap.Stringer("targetAddress", &queuedPacket.targetAddr),
 						zap.Uint64("clientSessionID", csid),
-						zap.Int("natConnFwmark", natConnFwmark),
+						zap.Int("natConnFwmark", clientInfo.Fwmark),
+						zap.Stringer("natConnLocalPortRange", clientInfo.LocalPortRange),
+						zap.Bool("transient", backoff),
 						zap.Error(err),
 					)
+					s.collector.CollectSessionSetupFailure(stats.SessionSetupFailureSocket)
 					return
 				}
 
@@ -400,43 +831,115 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric() {
 						zap.Uint64("clientSessionID", csid),
 						zap.Error(err),
 					)
+					s.collector.CollectSessionSetupFailure(stats.SessionSetupFailureDeadline)
 					natConn.Close()
 					return
 				}
 
+				if s.recvICMPErrors {
+					if err = conn.SetRecvErr(natConn); err != nil {
+						s.logger.Warn("Failed to enable ICMP error reception on natConn",
+							zap.String("server", s.serverName),
+							zap.String("client", clientName),
+							zap.String("listenAddress", s.listenAddress),
+							zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+							zap.Uint64("clientSessionID", csid),
+							zap.Error(err),
+						)
+					}
+				}
+
+				if s.tap != nil {
+					natConnUnpacker = &tapClientUnpacker{natConnUnpacker, s.tap, csid}
+				}
+
+				entry.clientName = clientName
+				entry.natConnLocalAddrPort = natConnLocalAddrPort(natConn, clientInfo)
+				entry.natConnUnpacker = natConnUnpacker
+
 				oldState := entry.state.Swap(natConn)
 				if oldState != nil {
 					natConn.Close()
 					return
 				}
 
+				if s.tap != nil {
+					natConnPacker = &tapClientPacker{natConnPacker, s.tap, csid}
+					serverConnPacker = &tapServerPacker{serverConnPacker, s.tap, csid}
+				}
+
 				// No more early returns!
 				sendChClean = true
+				affinityRecord = sessionAffinityEntry{router: sessionRouter, client: c, policy: policy}
+
+				// Setup is done. Let the next session set up.
+				s.releaseSetupSlot()
+				setupSlotHeld = false
+
+				setupDuration := time.Since(setupStart)
+				s.collector.ObserveSessionSetupLatency(setupDuration)
 
 				entry.natConn = natConn
-				entry.natConnRecvBufSize = natConnMaxPacketSize
+				entry.natConnRecvBufSize = clientInfo.MaxPacketSize
 				entry.natConnPacker = natConnPacker
-				entry.natConnUnpacker = natConnUnpacker
 				entry.serverConnPacker = serverConnPacker
 
+				if s.validateNATSource {
+					entry.natConnSources = newNATSourceSet()
+				}
+
+				if policy.BandwidthLimit > 0 {
+					entry.natConnShaper = newShaper(policy.BandwidthLimit)
+					entry.serverConnShaper = newShaper(policy.BandwidthLimit)
+				}
+
 				s.logger.Info("UDP session relay started",
 					zap.String("server", s.serverName),
 					zap.String("client", clientName),
 					zap.String("listenAddress", s.listenAddress),
 					zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+					zap.Stringer("natConnLocalAddress", entry.natConnLocalAddrPort),
 					zap.Stringer("targetAddress", &queuedPacket.targetAddr),
+					s.targetNameField("targetName", queuedPacket.targetAddr),
 					zap.Uint64("clientSessionID", csid),
+					zap.Duration("setupDuration", setupDuration),
 				)
 
+				sessionRouter.SessionOpened(clientName)
+				defer sessionRouter.SessionClosed(clientName)
+
+				if policy.MaxLifetime > 0 {
+					lifetimeTimer := time.AfterFunc(policy.MaxLifetime-setupDuration, func() {
+						s.expireSession(csid, entry, policy.MaxLifetime)
+					})
+					defer lifetimeTimer.Stop()
+				}
+
+				s.collector.UDPSessionOpened(username)
+
+				var downlinkBytes uint64
+
 				s.wg.Add(1)
 
 				go func() {
-					s.relayServerConnToNatConnGeneric(csid, entry)
+					uplinkBytes := s.relayServerConnToNatConnGeneric(csid, entry)
 					entry.natConn.Close()
+					// natConnSendCh is only closed after the natConn -> serverConn relay returns,
+					// so downlinkBytes is final by now.
+					s.collector.UDPSessionClosed(username, uplinkBytes, downlinkBytes)
 					s.wg.Done()
 				}()
 
-				s.relayNatConnToServerConnGeneric(csid, entry, clientAddrInfop)
+				if entry.mirrorSendCh != nil {
+					s.wg.Add(1)
+
+					go func() {
+						s.relayServerConnToMirror(csid, entry)
+						s.wg.Done()
+					}()
+				}
+
+				downlinkBytes = s.relayNatConnToServerConnGeneric(csid, entry, clientAddrInfop)
 			}()
 
 			if ce := s.logger.Check(zap.DebugLevel, "New UDP session"); ce != nil {
@@ -450,20 +953,39 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric() {
 			}
 		}
 
-		select {
-		case entry.natConnSendCh <- queuedPacket:
-		default:
-			if ce := s.logger.Check(zap.DebugLevel, "Dropping packet due to full send channel"); ce != nil {
+		s.mirrorQueuedPacket(entry, queuedPacket)
+
+		if !s.reserveQueuedBytes(entry, queuedPacket.length) {
+			if ce := s.logger.Check(zap.DebugLevel, "Dropping packet due to queued bytes limit"); ce != nil {
 				ce.Write(
 					zap.String("server", s.serverName),
 					zap.String("listenAddress", s.listenAddress),
 					zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
 					zap.Stringer("targetAddress", &queuedPacket.targetAddr),
 					zap.Uint64("clientSessionID", csid),
+					zap.Int("payloadLength", queuedPacket.length),
 				)
 			}
 
 			s.putQueuedPacket(queuedPacket)
+		} else {
+			select {
+			case entry.natConnSendCh <- queuedPacket:
+			default:
+				s.releaseQueuedBytes(entry, queuedPacket.length)
+
+				if ce := s.logger.Check(zap.DebugLevel, "Dropping packet due to full send channel"); ce != nil {
+					ce.Write(
+						zap.String("server", s.serverName),
+						zap.String("listenAddress", s.listenAddress),
+						zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+						zap.Stringer("targetAddress", &queuedPacket.targetAddr),
+						zap.Uint64("clientSessionID", csid),
+					)
+				}
+
+				s.putQueuedPacket(queuedPacket)
+			}
 		}
 
 		s.mu.Unlock()
@@ -477,7 +999,8 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric() {
 	)
 }
 
-func (s *UDPSessionRelay) relayServerConnToNatConnGeneric(csid uint64, entry *session) {
+// relayServerConnToNatConnGeneric returns the number of payload bytes sent.
+func (s *UDPSessionRelay) relayServerConnToNatConnGeneric(csid uint64, entry *session) uint64 {
 	var (
 		destAddrPort     netip.AddrPort
 		packetStart      int
@@ -487,7 +1010,16 @@ func (s *UDPSessionRelay) relayServerConnToNatConnGeneric(csid uint64, entry *se
 		payloadBytesSent uint64
 	)
 
+	upstreamLogged := !s.logSessionUpstream
+
 	for queuedPacket := range entry.natConnSendCh {
+		s.releaseQueuedBytes(entry, queuedPacket.length)
+
+		if !s.targetAllowed(csid, entry, queuedPacket) {
+			s.putQueuedPacket(queuedPacket)
+			continue
+		}
+
 		destAddrPort, packetStart, packetLength, err = entry.natConnPacker.PackInPlace(queuedPacket.buf, queuedPacket.targetAddr, queuedPacket.start, queuedPacket.length)
 		if err != nil {
 			s.logger.Warn("Failed to pack packet",
@@ -504,67 +1036,90 @@ func (s *UDPSessionRelay) relayServerConnToNatConnGeneric(csid uint64, entry *se
 			continue
 		}
 
+		entry.natConnSources.Add(destAddrPort)
+
+		if entry.natConnShaper != nil {
+			entry.natConnShaper.Wait(queuedPacket.length)
+		}
+
 		_, err = entry.natConn.WriteToUDPAddrPort(queuedPacket.buf[packetStart:packetStart+packetLength], destAddrPort)
 		if err != nil {
-			s.logger.Warn("Failed to write packet to natConn",
-				zap.String("server", s.serverName),
-				zap.String("listenAddress", s.listenAddress),
-				zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
-				zap.Stringer("targetAddress", &queuedPacket.targetAddr),
-				zap.Stringer("writeDestAddress", destAddrPort),
-				zap.Uint64("clientSessionID", csid),
-				zap.Error(err),
-			)
+			if s.handleNatConnICMPErrors(csid, entry) == 0 {
+				s.logger.Warn("Failed to write packet to natConn",
+					zap.String("server", s.serverName),
+					zap.String("listenAddress", s.listenAddress),
+					zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+					zap.Stringer("targetAddress", &queuedPacket.targetAddr),
+					zap.Stringer("writeDestAddress", destAddrPort),
+					zap.Uint64("clientSessionID", csid),
+					zap.Error(err),
+				)
+			}
+		} else {
+			if s.recvTimestamps {
+				s.observeRelayDelay(queuedPacket, time.Now())
+			}
+
+			if !upstreamLogged {
+				upstreamLogged = true
+				s.logSessionUpstreamAddress(csid, entry, queuedPacket.clientAddrPort, destAddrPort)
+			}
 		}
 
-		err = entry.natConn.SetReadDeadline(time.Now().Add(s.natTimeout))
-		if err != nil {
-			s.logger.Warn("Failed to set read deadline on natConn",
-				zap.String("server", s.serverName),
-				zap.String("listenAddress", s.listenAddress),
-				zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
-				zap.Duration("natTimeout", s.natTimeout),
-				zap.Uint64("clientSessionID", csid),
-				zap.Error(err),
-			)
+		// Do not extend the read deadline once shutdown has been signaled.
+		if entry.state.Load() != s.serverConn {
+			if err = entry.natConn.SetReadDeadline(time.Now().Add(s.natTimeout)); err != nil {
+				s.logger.Warn("Failed to set read deadline on natConn",
+					zap.String("server", s.serverName),
+					zap.String("listenAddress", s.listenAddress),
+					zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+					zap.Duration("natTimeout", s.natTimeout),
+					zap.Uint64("clientSessionID", csid),
+					zap.Error(err),
+				)
+			}
 		}
 
-		s.putQueuedPacket(queuedPacket)
 		packetsSent++
 		payloadBytesSent += uint64(queuedPacket.length)
+		s.putQueuedPacket(queuedPacket)
 	}
 
 	s.logger.Info("Finished relay serverConn -> natConn",
 		zap.String("server", s.serverName),
 		zap.String("listenAddress", s.listenAddress),
 		zap.Stringer("lastWriteDestAddress", destAddrPort),
+		s.targetNameField("lastWriteDestName", conn.AddrFromIPPort(destAddrPort)),
 		zap.Uint64("clientSessionID", csid),
 		zap.Uint64("packetsSent", packetsSent),
 		zap.Uint64("payloadBytesSent", payloadBytesSent),
 	)
+
+	return payloadBytesSent
 }
 
-func (s *UDPSessionRelay) relayNatConnToServerConnGeneric(csid uint64, entry *session, clientAddrInfop *sessionClientAddrInfo) {
+// relayNatConnToServerConnGeneric returns the number of payload bytes sent.
+func (s *UDPSessionRelay) relayNatConnToServerConnGeneric(csid uint64, entry *session, clientAddrInfop *sessionClientAddrInfo) uint64 {
 	clientAddrPort := clientAddrInfop.addrPort
 	clientPktinfo := clientAddrInfop.pktinfo
 	maxClientPacketSize := zerocopy.MaxPacketSizeForAddr(s.mtu, clientAddrPort.Addr())
 
-	frontHeadroom := entry.serverConnPacker.FrontHeadroom() - entry.natConnUnpacker.FrontHeadroom()
-	if frontHeadroom < 0 {
-		frontHeadroom = 0
-	}
-	rearHeadroom := entry.serverConnPacker.RearHeadroom() - entry.natConnUnpacker.RearHeadroom()
-	if rearHeadroom < 0 {
-		rearHeadroom = 0
-	}
+	headroom := zerocopy.ExcessHeadroom(entry.serverConnPacker, entry.natConnUnpacker)
+	frontHeadroom, rearHeadroom := headroom.Front, headroom.Rear
 
 	var (
-		packetsSent      uint64
-		payloadBytesSent uint64
+		packetsSent           uint64
+		payloadBytesSent      uint64
+		packetsSourceRejected uint64
 	)
 
-	packetBuf := make([]byte, frontHeadroom+entry.natConnRecvBufSize+rearHeadroom)
-	recvBuf := packetBuf[frontHeadroom : frontHeadroom+entry.natConnRecvBufSize]
+	recvBufSize := s.initialNatConnRecvBufSize(entry)
+	packetBufp := s.getDownlinkPacketBuf(frontHeadroom + recvBufSize + rearHeadroom)
+	defer func() {
+		s.downlinkBufPool.Put(packetBufp)
+	}()
+	packetBuf := *packetBufp
+	recvBuf := packetBuf[frontHeadroom : frontHeadroom+recvBufSize]
 
 	for {
 		n, _, flags, packetSourceAddrPort, err := entry.natConn.ReadMsgUDPAddrPort(recvBuf, nil)
@@ -573,6 +1128,10 @@ func (s *UDPSessionRelay) relayNatConnToServerConnGeneric(csid uint64, entry *se
 				break
 			}
 
+			if s.handleNatConnICMPErrors(csid, entry) > 0 {
+				continue
+			}
+
 			s.logger.Warn("Failed to read packet from natConn",
 				zap.String("server", s.serverName),
 				zap.String("listenAddress", s.listenAddress),
@@ -586,18 +1145,55 @@ func (s *UDPSessionRelay) relayNatConnToServerConnGeneric(csid uint64, entry *se
 		}
 		err = conn.ParseFlagsForError(flags)
 		if err != nil {
-			s.logger.Warn("Failed to read packet from natConn",
+			if canGrowNatConnRecvBuf(err, recvBufSize, entry) {
+				recvBufSize = nextNatConnRecvBufSize(recvBufSize, entry)
+				s.downlinkBufPool.Put(packetBufp)
+				packetBufp = s.getDownlinkPacketBuf(frontHeadroom + recvBufSize + rearHeadroom)
+				packetBuf = *packetBufp
+				recvBuf = packetBuf[frontHeadroom : frontHeadroom+recvBufSize]
+
+				if ce := s.logger.Check(zap.DebugLevel, "Dropped truncated packet from natConn and grew receive buffer"); ce != nil {
+					ce.Write(
+						zap.String("server", s.serverName),
+						zap.String("listenAddress", s.listenAddress),
+						zap.Stringer("clientAddress", clientAddrPort),
+						zap.Stringer("packetSourceAddress", packetSourceAddrPort),
+						zap.Uint64("clientSessionID", csid),
+						zap.Int("recvBufSize", recvBufSize),
+					)
+				}
+				continue
+			}
+
+			s.logger.Warn(flagsErrorMessage(err, "Failed to read packet from natConn"),
 				zap.String("server", s.serverName),
 				zap.String("listenAddress", s.listenAddress),
 				zap.Stringer("clientAddress", clientAddrPort),
 				zap.Stringer("packetSourceAddress", packetSourceAddrPort),
 				zap.Uint64("clientSessionID", csid),
 				zap.Int("packetLength", n),
+				zap.Int("recvBufSize", recvBufSize),
 				zap.Error(err),
 			)
 			continue
 		}
 
+		if !entry.natConnSources.Contains(packetSourceAddrPort) {
+			packetsSourceRejected++
+
+			if ce := s.logger.Check(zap.DebugLevel, "Dropped packet from unexpected source on natConn"); ce != nil {
+				ce.Write(
+					zap.String("server", s.serverName),
+					zap.String("listenAddress", s.listenAddress),
+					zap.Stringer("clientAddress", clientAddrPort),
+					zap.Stringer("packetSourceAddress", packetSourceAddrPort),
+					zap.Uint64("clientSessionID", csid),
+					zap.Int("packetLength", n),
+				)
+			}
+			continue
+		}
+
 		payloadSourceAddrPort, payloadStart, payloadLength, err := entry.natConnUnpacker.UnpackInPlace(packetBuf, packetSourceAddrPort, frontHeadroom, n)
 		if err != nil {
 			s.logger.Warn("Failed to unpack packet",
@@ -635,7 +1231,22 @@ func (s *UDPSessionRelay) relayNatConnToServerConnGeneric(csid uint64, entry *se
 			continue
 		}
 
+		if entry.serverConnShaper != nil {
+			entry.serverConnShaper.Wait(payloadLength)
+		}
+
 		_, _, err = s.serverConn.WriteMsgUDPAddrPort(packetBuf[packetStart:packetStart+packetLength], clientPktinfo, clientAddrPort)
+		if err != nil && clientPktinfo != nil && isStalePktinfoError(err) {
+			s.logger.Warn("Failed to write packet to serverConn with cached pktinfo, falling back to no pktinfo",
+				zap.String("server", s.serverName),
+				zap.String("listenAddress", s.listenAddress),
+				zap.Stringer("clientAddress", clientAddrPort),
+				zap.Uint64("clientSessionID", csid),
+				zap.Error(err),
+			)
+			clientPktinfo = nil
+			_, _, err = s.serverConn.WriteMsgUDPAddrPort(packetBuf[packetStart:packetStart+packetLength], nil, clientAddrPort)
+		}
 		if err != nil {
 			s.logger.Warn("Failed to write packet to serverConn",
 				zap.String("server", s.serverName),
@@ -659,7 +1270,287 @@ func (s *UDPSessionRelay) relayNatConnToServerConnGeneric(csid uint64, entry *se
 		zap.Uint64("clientSessionID", csid),
 		zap.Uint64("packetsSent", packetsSent),
 		zap.Uint64("payloadBytesSent", payloadBytesSent),
+		zap.Uint64("packetsSourceRejected", packetsSourceRejected),
+		zap.Uint64("uplinkGaps", sessionUplinkGaps(entry)),
+		zap.Uint64("downlinkGaps", sessionDownlinkGaps(entry)),
 	)
+
+	return payloadBytesSent
+}
+
+// logSessionUpstreamAddress logs the upstream address of the session
+// after the first successful write to its natConn.
+func (s *UDPSessionRelay) logSessionUpstreamAddress(csid uint64, entry *session, clientAddrPort, upstreamAddrPort netip.AddrPort) {
+	s.logger.Info("UDP session upstream selected",
+		zap.String("server", s.serverName),
+		zap.String("client", entry.clientName),
+		zap.String("listenAddress", s.listenAddress),
+		zap.Stringer("clientAddress", clientAddrPort),
+		zap.Stringer("natConnLocalAddress", entry.natConnLocalAddrPort),
+		zap.Stringer("upstreamAddress", upstreamAddrPort),
+		zap.Uint64("clientSessionID", csid),
+	)
+}
+
+// targetNameField returns a log field with the cached PTR name of targetAddr.
+// The field is skipped if reverse lookups are disabled, targetAddr is a domain,
+// or the name is not cached yet.
+func (s *UDPSessionRelay) targetNameField(key string, targetAddr conn.Addr) zap.Field {
+	if s.reverseLookup == nil || !targetAddr.IsIP() {
+		return zap.Skip()
+	}
+	name, ok := s.reverseLookup.Name(targetAddr.IP())
+	if !ok {
+		return zap.Skip()
+	}
+	return zap.String(key, name)
+}
+
+// isStalePktinfoError returns whether err indicates that the cached pktinfo
+// no longer works, e.g. because the outgoing interface went down.
+//
+// The session stops using the cached pktinfo and lets the kernel pick the source address,
+// until the client address or pktinfo changes.
+func isStalePktinfoError(err error) bool {
+	return errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENETDOWN)
+}
+
+// SetRouter replaces the router used to select clients for new sessions.
+// Established sessions keep the client selected by the router that created them.
+//
+// SetRouter is safe to call while the relay is running.
+func (s *UDPSessionRelay) SetRouter(r *router.Router) {
+	s.router.Store(r)
+}
+
+// BufferLayout returns the layout of the relay's packet buffers.
+//
+// Each packet buffer has front bytes of headroom, followed by recv bytes for the received packet,
+// and rear bytes of headroom. The total buffer size is front + recv + rear.
+// Buffers sized and offset the same way can be handed to and from the relay without copying.
+func (s *UDPSessionRelay) BufferLayout() (front, recv, rear int) {
+	return s.packetBufFrontHeadroom, s.packetBufRecvSize, s.packetBufRearHeadroom
+}
+
+// BatchSize returns the current batch size of the relay.
+func (s *UDPSessionRelay) BatchSize() int {
+	return int(s.batchSize.Load())
+}
+
+// SetBatchSize changes the batch size of the relay at runtime.
+//
+// Running sendmmsg relay goroutines pick up the new batch size at their next batch boundary,
+// and reallocate their message vectors accordingly. Batches in flight are not affected.
+func (s *UDPSessionRelay) SetBatchSize(n int) error {
+	if n <= 0 || n > maxBatchSize {
+		return fmt.Errorf("batch size out of range [1, %d]: %d", maxBatchSize, n)
+	}
+	s.batchSize.Store(int64(n))
+	return nil
+}
+
+// observeRelayDelay records the relay delay of a packet sent at now in the collector.
+// It does nothing if the packet has no receive timestamp.
+func (s *UDPSessionRelay) observeRelayDelay(queuedPacket *sessionQueuedPacket, now time.Time) {
+	if queuedPacket.recvTime.IsZero() {
+		return
+	}
+	// Both times are read from the realtime clock, which may step backwards.
+	d := now.Sub(queuedPacket.recvTime)
+	if d < 0 {
+		d = 0
+	}
+	s.collector.ObserveRelayDelay(d)
+}
+
+// SweptSessions returns the number of stale sessions removed by the sweeper.
+func (s *UDPSessionRelay) SweptSessions() uint64 {
+	return s.sweptSessions.Load()
+}
+
+// TargetNotAllowedPackets returns the number of packets from clients dropped
+// for targets outside their users' target allowlists.
+func (s *UDPSessionRelay) TargetNotAllowedPackets() uint64 {
+	return s.targetNotAllowedPackets.Load()
+}
+
+// targetAllowed returns whether the queued packet may be sent to its target.
+// Packets to targets outside the session user's target allowlist are counted and should be dropped.
+func (s *UDPSessionRelay) targetAllowed(csid uint64, entry *session, queuedPacket *sessionQueuedPacket) bool {
+	if entry.allowsTarget == nil || entry.allowsTarget(queuedPacket.targetAddr) {
+		return true
+	}
+
+	s.targetNotAllowedPackets.Add(1)
+
+	if ce := s.logger.Check(zap.DebugLevel, "Dropping packet to target not allowed for user"); ce != nil {
+		ce.Write(
+			zap.String("server", s.serverName),
+			zap.String("listenAddress", s.listenAddress),
+			zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+			zap.Stringer("targetAddress", &queuedPacket.targetAddr),
+			zap.Uint64("clientSessionID", csid),
+		)
+	}
+	return false
+}
+
+// sessionUsername returns the username the session's client authenticated as,
+// or an empty string if the server unpacker does not identify users.
+func sessionUsername(u zerocopy.ServerUnpacker) string {
+	if ui, ok := unwrapServerUnpacker(u).(zerocopy.UserIdentifier); ok {
+		return ui.Username()
+	}
+	return ""
+}
+
+// RateLimitedPackets returns the number of packets from clients dropped for exceeding the per-source rate limits.
+func (s *UDPSessionRelay) RateLimitedPackets() uint64 {
+	return s.sourceRateLimiter.Dropped()
+}
+
+// Snapshot returns information about the relay's current sessions.
+func (s *UDPSessionRelay) Snapshot() []UDPSessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions := make([]UDPSessionInfo, 0, len(s.table))
+
+	for csid, entry := range s.table {
+		info := UDPSessionInfo{
+			ClientSessionID: csid,
+			ClientAddress:   entry.clientAddrPortCache,
+		}
+
+		// The natConn being swapped in guarantees that the other fields are visible.
+		if state := entry.state.Load(); state != nil && state != s.serverConn {
+			info.Client = entry.clientName
+			info.NATLocalAddress = entry.natConnLocalAddrPort
+			info.DownlinkGaps = sessionDownlinkGaps(entry)
+		}
+
+		if reporter, ok := unwrapServerUnpacker(entry.serverConnUnpacker).(zerocopy.ReorderStatsReporter); ok {
+			entry.unpackMu.Lock()
+			stats := reporter.ReorderStats()
+			entry.unpackMu.Unlock()
+			info.Reorder = &stats
+		}
+		info.UplinkGaps = sessionUplinkGaps(entry)
+
+		sessions = append(sessions, info)
+	}
+
+	return sessions
+}
+
+// CloseSession tears down the session with the given client session ID.
+// It returns false if there is no such session.
+//
+// The client may recreate the session by sending more packets.
+func (s *UDPSessionRelay) CloseSession(csid uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.table[csid]
+	if !ok {
+		return false
+	}
+
+	s.logger.Info("Tearing down UDP session on request",
+		zap.String("server", s.serverName),
+		zap.String("listenAddress", s.listenAddress),
+		zap.Uint64("clientSessionID", csid),
+	)
+
+	s.shutdownSession(csid, entry, time.Now())
+	return true
+}
+
+// acquireSetupSlot acquires a session setup slot, waiting up to sessionSetupQueueTimeout.
+// It returns false if no slot became available in time.
+// It always succeeds if the number of concurrent session setups is not limited.
+func (s *UDPSessionRelay) acquireSetupSlot() bool {
+	if s.setupSem == nil {
+		return true
+	}
+
+	select {
+	case s.setupSem <- struct{}{}:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(sessionSetupQueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case s.setupSem <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// releaseSetupSlot releases a session setup slot acquired by acquireSetupSlot.
+func (s *UDPSessionRelay) releaseSetupSlot() {
+	if s.setupSem != nil {
+		<-s.setupSem
+	}
+}
+
+// sessionUplinkGaps returns the number of sequence gaps counted by the session's server unpacker,
+// or 0 if the unpacker does not count sequence gaps.
+func sessionUplinkGaps(entry *session) uint64 {
+	if counter, ok := unwrapServerUnpacker(entry.serverConnUnpacker).(zerocopy.SequenceGapCounter); ok {
+		return counter.SequenceGaps()
+	}
+	return 0
+}
+
+// sessionDownlinkGaps returns the number of sequence gaps counted by the session's natConn unpacker,
+// or 0 if the unpacker does not count sequence gaps.
+//
+// The natConn unpacker must have been set up.
+func sessionDownlinkGaps(entry *session) uint64 {
+	if counter, ok := unwrapClientUnpacker(entry.natConnUnpacker).(zerocopy.SequenceGapCounter); ok {
+		return counter.SequenceGaps()
+	}
+	return 0
+}
+
+// getDownlinkPacketBuf retrieves a packet buffer of the given size for the generic
+// natConn -> serverConn relay from the pool, or allocates a new one if none fits.
+//
+// Return the buffer to s.downlinkBufPool on session teardown.
+func (s *UDPSessionRelay) getDownlinkPacketBuf(size int) *[]byte {
+	if bufp, ok := s.downlinkBufPool.Get().(*[]byte); ok && cap(*bufp) >= size {
+		*bufp = (*bufp)[:size]
+		return bufp
+	}
+	b := make([]byte, size)
+	return &b
+}
+
+// initialNatConnRecvBufSize returns the size of the first natConn receive buffer for the session.
+func (s *UDPSessionRelay) initialNatConnRecvBufSize(entry *session) int {
+	if s.adaptiveRecvBuf && entry.natConnRecvBufSize > adaptiveRecvBufInitialSize {
+		return adaptiveRecvBufInitialSize
+	}
+	return entry.natConnRecvBufSize
+}
+
+// canGrowNatConnRecvBuf returns whether a natConn receive buffer of size recvBufSize
+// should grow after err was returned for a received packet.
+func canGrowNatConnRecvBuf(err error, recvBufSize int, entry *session) bool {
+	return err == conn.ErrMessageTruncated && recvBufSize < entry.natConnRecvBufSize
+}
+
+// nextNatConnRecvBufSize returns the natConn receive buffer size to grow to from recvBufSize.
+func nextNatConnRecvBufSize(recvBufSize int, entry *session) int {
+	if recvBufSize *= 2; recvBufSize > entry.natConnRecvBufSize {
+		return entry.natConnRecvBufSize
+	}
+	return recvBufSize
 }
 
 // getQueuedPacket retrieves a queued packet from the pool.
@@ -672,6 +1563,369 @@ func (s *UDPSessionRelay) putQueuedPacket(queuedPacket *sessionQueuedPacket) {
 	s.queuedPacketPool.Put(queuedPacket)
 }
 
+// sweepStaleSessionsLoop calls sweepStaleSessions on every sweep interval until done is closed.
+func (s *UDPSessionRelay) sweepStaleSessionsLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(s.sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.sweepStaleSessions(now)
+		case <-done:
+			return
+		}
+	}
+}
+
+// sweepStaleSessions removes sessions that have been without a natConn for longer than natTimeout.
+// Such sessions are normally removed by their setup goroutines when setup fails.
+func (s *UDPSessionRelay) sweepStaleSessions(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for csid, entry := range s.table {
+		if now.Sub(entry.createdAt) < s.natTimeout {
+			continue
+		}
+
+		// Swap in the serverConn, so the setup goroutine gives up if it ever gets to finish.
+		if !entry.state.CompareAndSwap(nil, s.serverConn) {
+			continue
+		}
+
+		delete(s.table, csid)
+		s.sweptSessions.Add(1)
+
+		s.logger.Warn("Removed stale UDP session without natConn",
+			zap.String("server", s.serverName),
+			zap.String("listenAddress", s.listenAddress),
+			zap.Stringer("clientAddress", entry.clientAddrPortCache),
+			zap.Uint64("clientSessionID", csid),
+			zap.Duration("age", now.Sub(entry.createdAt)),
+		)
+	}
+}
+
+// reserveQueuedBytes reserves room for a packet with the given payload length in the session's send channel.
+// It returns false if the reservation would exceed the relay's queued bytes limit.
+//
+// s.mu must be held.
+func (s *UDPSessionRelay) reserveQueuedBytes(entry *session, length int) bool {
+	if s.maxQueuedBytes <= 0 {
+		return true
+	}
+	if entry.natConnSendChBytes.Add(int64(length)) > int64(s.maxQueuedBytes) {
+		entry.natConnSendChBytes.Add(-int64(length))
+		return false
+	}
+	return true
+}
+
+// releaseQueuedBytes releases the room reserved for a packet with the given payload length
+// after it is dequeued from the session's send channel, or fails to be queued.
+func (s *UDPSessionRelay) releaseQueuedBytes(entry *session, length int) {
+	if s.maxQueuedBytes > 0 {
+		entry.natConnSendChBytes.Add(-int64(length))
+	}
+}
+
+// recordUnpackFailure records a packet from the client of an established session that failed to unpack.
+// Only authentication failures are counted. Other errors, such as replay window rejections,
+// which also result from duplication and reordering on the network, are ignored without resetting the count.
+// When the number of consecutive failures reaches the threshold, the session is torn down,
+// and packets with the same client session ID are dropped for unpackFailureBlockDuration.
+//
+// s.mu must be held.
+func (s *UDPSessionRelay) recordUnpackFailure(csid uint64, entry *session, clientAddrPort netip.AddrPort, err error) {
+	if s.unpackFailureThreshold <= 0 || !errors.Is(err, zerocopy.ErrPacketAuthenticationFailed) {
+		return
+	}
+
+	entry.serverConnUnpackFailures++
+	if entry.serverConnUnpackFailures < s.unpackFailureThreshold {
+		return
+	}
+
+	now := time.Now()
+	s.natConnBackoff.add(csid, now, unpackFailureBlockDuration)
+
+	s.logger.Warn("Tearing down UDP session after consecutive unpack failures",
+		zap.String("server", s.serverName),
+		zap.String("listenAddress", s.listenAddress),
+		zap.Stringer("clientAddress", clientAddrPort),
+		zap.Uint64("clientSessionID", csid),
+		zap.Int("unpackFailures", entry.serverConnUnpackFailures),
+		zap.Duration("blockDuration", unpackFailureBlockDuration),
+	)
+
+	s.shutdownSession(csid, entry, now)
+}
+
+// expireSession tears down the session after it has reached its maximum lifetime.
+// It is called by the session's lifetime timer.
+func (s *UDPSessionRelay) expireSession(csid uint64, entry *session, maxLifetime time.Duration) {
+	s.logger.Info("Tearing down UDP session after reaching maximum lifetime",
+		zap.String("server", s.serverName),
+		zap.String("client", entry.clientName),
+		zap.String("listenAddress", s.listenAddress),
+		zap.Uint64("clientSessionID", csid),
+		zap.Duration("maxLifetime", maxLifetime),
+	)
+
+	s.shutdownSession(csid, entry, time.Now())
+}
+
+// handleNatConnICMPErrors drains the ICMP errors queued on the session's natConn, counts and logs them,
+// and tears down the session if its upstream returned port unreachable.
+// It returns the number of ICMP errors handled, which is zero if ICMP error reception is disabled.
+func (s *UDPSessionRelay) handleNatConnICMPErrors(csid uint64, entry *session) int {
+	if !s.recvICMPErrors {
+		return 0
+	}
+
+	icmpErrors, err := conn.ReadICMPErrors(entry.natConn)
+	if err != nil {
+		s.logger.Warn("Failed to read ICMP errors from natConn",
+			zap.String("server", s.serverName),
+			zap.String("client", entry.clientName),
+			zap.String("listenAddress", s.listenAddress),
+			zap.Uint64("clientSessionID", csid),
+			zap.Error(err),
+		)
+	}
+
+	var portUnreachable *conn.ICMPError
+
+	for i := range icmpErrors {
+		icmpErr := &icmpErrors[i]
+		reason := icmpErr.Reason()
+		s.icmpErrors[reason].Add(1)
+
+		if ce := s.logger.Check(zap.DebugLevel, "Received ICMP error on natConn"); ce != nil {
+			ce.Write(
+				zap.String("server", s.serverName),
+				zap.String("client", entry.clientName),
+				zap.String("listenAddress", s.listenAddress),
+				zap.Uint64("clientSessionID", csid),
+				zap.Stringer("writeDestAddress", icmpErr.Dest),
+				zap.Stringer("offenderAddress", icmpErr.Offender),
+				zap.Stringer("reason", reason),
+				zap.Uint8("icmpType", icmpErr.Type),
+				zap.Uint8("icmpCode", icmpErr.Code),
+			)
+		}
+
+		if reason == conn.ICMPErrorPortUnreachable {
+			portUnreachable = icmpErr
+		}
+	}
+
+	if portUnreachable != nil {
+		s.logger.Info("Tearing down UDP session after ICMP port unreachable",
+			zap.String("server", s.serverName),
+			zap.String("client", entry.clientName),
+			zap.String("listenAddress", s.listenAddress),
+			zap.Uint64("clientSessionID", csid),
+			zap.Stringer("writeDestAddress", portUnreachable.Dest),
+			zap.Stringer("offenderAddress", portUnreachable.Offender),
+		)
+		s.shutdownSession(csid, entry, time.Now())
+	}
+
+	return len(icmpErrors)
+}
+
+// ICMPErrors returns the number of ICMP errors received on natConns keyed by reason.
+// All counters are zero if ICMP error reception is disabled.
+func (s *UDPSessionRelay) ICMPErrors() map[string]uint64 {
+	m := make(map[string]uint64, conn.NumICMPErrorReasons)
+	for r := conn.ICMPErrorReason(0); r < conn.NumICMPErrorReasons; r++ {
+		m[r.String()] = s.icmpErrors[r].Load()
+	}
+	return m
+}
+
+// shutdownSession signals the session to shut down. If the session is still being set up,
+// initialization sees the swapped-in serverConn and gives up. Otherwise, the relay goroutines
+// exit on the read deadline.
+func (s *UDPSessionRelay) shutdownSession(csid uint64, entry *session, now time.Time) {
+	natConn := entry.state.Swap(s.serverConn)
+	if natConn == nil || natConn == s.serverConn {
+		return
+	}
+
+	if err := natConn.SetReadDeadline(now); err != nil {
+		s.logger.Warn("Failed to set read deadline on natConn",
+			zap.String("server", s.serverName),
+			zap.String("listenAddress", s.listenAddress),
+			zap.Uint64("clientSessionID", csid),
+			zap.Error(err),
+		)
+	}
+}
+
+// ServerConnFile implements the handoffRelay ServerConnFile method.
+func (s *UDPSessionRelay) ServerConnFile() (*os.File, error) {
+	if s.serverConn == nil {
+		return nil, errRelayNotStarted
+	}
+	return s.serverConn.File()
+}
+
+// AdoptServerConn implements the handoffRelay AdoptServerConn method.
+func (s *UDPSessionRelay) AdoptServerConn(f *os.File) error {
+	serverConn, err := adoptUDPConn(f)
+	if err != nil {
+		return err
+	}
+	if s.adoptedServerConn != nil {
+		s.adoptedServerConn.Close()
+	}
+	s.adoptedServerConn = serverConn
+	return nil
+}
+
+// adoptedNATConn is the NAT socket of a session handed off by the old process.
+type adoptedNATConn struct {
+	natConn    *net.UDPConn
+	clientName string
+	username   string
+}
+
+// HandOffSessions implements the handoffRelay HandOffSessions method.
+func (s *UDPSessionRelay) HandOffSessions() ([]udpSessionHandoff, []*os.File, error) {
+	if s.serverConn == nil {
+		return nil, nil, errRelayNotStarted
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		sessions []udpSessionHandoff
+		files    []*os.File
+	)
+
+	for csid, entry := range s.table {
+		// The natConn being swapped in guarantees that the other fields are visible.
+		natConn := entry.state.Load()
+		if natConn == nil || natConn == s.serverConn {
+			continue
+		}
+
+		f, err := natConn.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, nil, fmt.Errorf("failed to get natConn of session %d: %w", csid, err)
+		}
+
+		sessions = append(sessions, udpSessionHandoff{
+			ClientSessionID: csid,
+			Client:          entry.clientName,
+			Username:        sessionUsername(entry.serverConnUnpacker),
+			ClientAddress:   entry.clientAddrPortCache,
+		})
+		files = append(files, f)
+	}
+
+	return sessions, files, nil
+}
+
+// AdoptSessions implements the handoffRelay AdoptSessions method.
+//
+// An adopted natConn is reused by the first session set up with its client session ID,
+// if the session is routed to the same client for the same user. Otherwise, it is closed.
+// Adopted natConns not reused within natTimeout after Start are closed.
+func (s *UDPSessionRelay) AdoptSessions(sessions []udpSessionHandoff, files []*os.File) error {
+	if len(sessions) != len(files) {
+		return fmt.Errorf("got %d files for %d sessions", len(files), len(sessions))
+	}
+
+	adopted := make(map[uint64]adoptedNATConn, len(sessions))
+
+	for i, session := range sessions {
+		natConn, err := adoptUDPConn(files[i])
+		if err != nil {
+			for _, a := range adopted {
+				a.natConn.Close()
+			}
+			return fmt.Errorf("failed to adopt natConn of session %d: %w", session.ClientSessionID, err)
+		}
+		if a, ok := adopted[session.ClientSessionID]; ok {
+			a.natConn.Close()
+		}
+		adopted[session.ClientSessionID] = adoptedNATConn{
+			natConn:    natConn,
+			clientName: session.Client,
+			username:   session.Username,
+		}
+	}
+
+	s.closeAdoptedNATConns()
+	s.adoptedMu.Lock()
+	s.adoptedNATConns = adopted
+	s.adoptedMu.Unlock()
+	return nil
+}
+
+// takeAdoptedNATConn removes and returns the adopted natConn of the session,
+// if it was handed off for the same client and user. Otherwise, it returns nil.
+func (s *UDPSessionRelay) takeAdoptedNATConn(csid uint64, clientName, username string) *net.UDPConn {
+	s.adoptedMu.Lock()
+	a, ok := s.adoptedNATConns[csid]
+	if ok {
+		delete(s.adoptedNATConns, csid)
+	}
+	s.adoptedMu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	if a.clientName != clientName || a.username != username {
+		a.natConn.Close()
+		return nil
+	}
+	return a.natConn
+}
+
+// closeAdoptedNATConns closes adopted natConns that have not been reused.
+func (s *UDPSessionRelay) closeAdoptedNATConns() {
+	s.adoptedMu.Lock()
+	adopted := s.adoptedNATConns
+	s.adoptedNATConns = nil
+	s.adoptedMu.Unlock()
+
+	for _, a := range adopted {
+		a.natConn.Close()
+	}
+}
+
+// listenNATConn returns the natConn of a new session.
+// The natConn handed off for the session is reused if possible,
+// so that the upstream keeps seeing the same source address across a handoff.
+func (s *UDPSessionRelay) listenNATConn(csid uint64, clientName, username string, clientInfo zerocopy.ClientInfo) (*net.UDPConn, error) {
+	if natConn := s.takeAdoptedNATConn(csid, clientName, username); natConn != nil {
+		return natConn, nil
+	}
+	return conn.ListenUDPOnInterface("udp", clientInfo.Netns, clientInfo.Interface, clientInfo.LocalPortRange, false, clientInfo.Fwmark)
+}
+
+// natConnLocalAddrPort returns the usable local address of natConn, looked up in the client's network namespace.
+// See [conn.LocalAddrPort].
+func natConnLocalAddrPort(natConn *net.UDPConn, clientInfo zerocopy.ClientInfo) netip.AddrPort {
+	var addrPort netip.AddrPort
+	if err := conn.RunInNetns(clientInfo.Netns, func() error {
+		addrPort = conn.LocalAddrPort(natConn, clientInfo.Fwmark)
+		return nil
+	}); err != nil {
+		return natConn.LocalAddr().(*net.UDPAddr).AddrPort()
+	}
+	return addrPort
+}
+
 // Stop implements the Service Stop method.
 func (s *UDPSessionRelay) Stop() error {
 	if s.serverConn == nil {
@@ -684,14 +1938,18 @@ func (s *UDPSessionRelay) Stop() error {
 		return err
 	}
 
-	// Wait for serverConn receive goroutines to exit,
+	if s.sweeperDone != nil {
+		close(s.sweeperDone)
+	}
+
+	// Wait for serverConn receive goroutines and the sweeper to exit,
 	// so there won't be any new sessions added to the table.
 	s.mwg.Wait()
 
 	s.mu.Lock()
 	for csid, entry := range s.table {
 		natConn := entry.state.Swap(s.serverConn)
-		if natConn == nil {
+		if natConn == nil || natConn == s.serverConn {
 			continue
 		}
 
@@ -710,5 +1968,14 @@ func (s *UDPSessionRelay) Stop() error {
 	// so in-flight packets can be written out.
 	s.wg.Wait()
 
+	if s.reverseLookup != nil {
+		s.reverseLookup.Stop()
+	}
+
+	if s.adoptedNATConnsTimer != nil {
+		s.adoptedNATConnsTimer.Stop()
+	}
+	s.closeAdoptedNATConns()
+
 	return s.serverConn.Close()
 }
@@ -9,6 +9,8 @@ import (
 	"unsafe"
 
 	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/stats"
 	"github.com/database64128/shadowsocks-go/zerocopy"
 	"go.uber.org/zap"
 	"golang.org/x/sys/unix"
@@ -23,6 +25,143 @@ func (s *UDPSessionRelay) setRelayFunc(batchMode string) {
 	}
 }
 
+// sessionDownlinkVecs holds the packet buffers and message vectors used by
+// relayNatConnToServerConnSendmmsg. They are pooled to reduce allocations on high session churn.
+type sessionDownlinkVecs struct {
+	rsa6    unix.RawSockaddrInet6
+	savec   []unix.RawSockaddrInet6
+	bufvec  [][]byte
+	riovec  []unix.Iovec
+	siovec  []unix.Iovec
+	rmsgvec []conn.Mmsghdr
+	smsgvec []conn.Mmsghdr
+}
+
+// getDownlinkVecs retrieves message vectors from the pool, or allocates new ones.
+// Each packet buffer in the returned vectors is resized to bufSize, and reallocated if too small.
+//
+// Return the vectors to s.downlinkBufPool on session teardown.
+//
+// Pooled vectors allocated for a different batch size are discarded.
+func (s *UDPSessionRelay) getDownlinkVecs(bufSize int) *sessionDownlinkVecs {
+	batchSize := s.BatchSize()
+	vecs, ok := s.downlinkBufPool.Get().(*sessionDownlinkVecs)
+	if !ok || len(vecs.bufvec) != batchSize {
+		vecs = &sessionDownlinkVecs{
+			savec:   make([]unix.RawSockaddrInet6, batchSize),
+			bufvec:  make([][]byte, batchSize),
+			riovec:  make([]unix.Iovec, batchSize),
+			siovec:  make([]unix.Iovec, batchSize),
+			rmsgvec: make([]conn.Mmsghdr, batchSize),
+			smsgvec: make([]conn.Mmsghdr, batchSize),
+		}
+	}
+
+	vecs.resizeBufs(bufSize)
+	return vecs
+}
+
+// resizeBufs resizes each packet buffer to bufSize, and reallocates it if too small.
+func (v *sessionDownlinkVecs) resizeBufs(bufSize int) {
+	for i := range v.bufvec {
+		if cap(v.bufvec[i]) < bufSize {
+			v.bufvec[i] = make([]byte, bufSize)
+		} else {
+			v.bufvec[i] = v.bufvec[i][:bufSize]
+		}
+	}
+}
+
+// setup points the message vectors at the packet buffers and the client address.
+// Each receive iovec covers recvBufSize bytes after frontHeadroom.
+func (v *sessionDownlinkVecs) setup(frontHeadroom, recvBufSize int, namelen uint32, clientPktinfo []byte) {
+	for i := range v.bufvec {
+		v.riovec[i].Base = &v.bufvec[i][frontHeadroom]
+		v.riovec[i].SetLen(recvBufSize)
+
+		v.rmsgvec[i].Msghdr.Name = (*byte)(unsafe.Pointer(&v.savec[i]))
+		v.rmsgvec[i].Msghdr.Namelen = unix.SizeofSockaddrInet6
+		v.rmsgvec[i].Msghdr.Iov = &v.riovec[i]
+		v.rmsgvec[i].Msghdr.SetIovlen(1)
+
+		v.smsgvec[i].Msghdr.Name = (*byte)(unsafe.Pointer(&v.rsa6))
+		v.smsgvec[i].Msghdr.Namelen = namelen
+		v.smsgvec[i].Msghdr.Iov = &v.siovec[i]
+		v.smsgvec[i].Msghdr.SetIovlen(1)
+	}
+	v.setControl(clientPktinfo)
+}
+
+// setControl points the control message of each send message at clientPktinfo.
+// If clientPktinfo is empty, send messages carry no control message.
+func (v *sessionDownlinkVecs) setControl(clientPktinfo []byte) {
+	for i := range v.smsgvec {
+		if len(clientPktinfo) == 0 {
+			v.smsgvec[i].Msghdr.Control = nil
+		} else {
+			v.smsgvec[i].Msghdr.Control = &clientPktinfo[0]
+		}
+		v.smsgvec[i].Msghdr.SetControllen(len(clientPktinfo))
+	}
+}
+
+// replaceDownlinkVecs returns vecs to the pool, and retrieves and sets up new vectors
+// for the current batch size, keeping the client address of vecs.
+func (s *UDPSessionRelay) replaceDownlinkVecs(vecs *sessionDownlinkVecs, frontHeadroom, recvBufSize, rearHeadroom int, namelen uint32, clientPktinfo []byte) *sessionDownlinkVecs {
+	rsa6 := vecs.rsa6
+	s.downlinkBufPool.Put(vecs)
+	vecs = s.getDownlinkVecs(frontHeadroom + recvBufSize + rearHeadroom)
+	vecs.rsa6 = rsa6
+	vecs.setup(frontHeadroom, recvBufSize, namelen, clientPktinfo)
+	return vecs
+}
+
+// sessionUplinkVecs holds the message vectors used by relayServerConnToNatConnSendmmsg.
+type sessionUplinkVecs struct {
+	qpvec   []*sessionQueuedPacket
+	namevec []unix.RawSockaddrInet6
+	iovec   []unix.Iovec
+	msgvec  []conn.Mmsghdr
+}
+
+// getUplinkVecs retrieves message vectors for batches of up to batchSize packets from the pool,
+// or allocates new ones.
+//
+// Return the vectors with putUplinkVecs on session teardown.
+//
+// Pooled vectors allocated for a different batch size are discarded.
+func (s *UDPSessionRelay) getUplinkVecs(batchSize int) *sessionUplinkVecs {
+	if v, ok := s.uplinkVecsPool.Get().(*sessionUplinkVecs); ok && len(v.msgvec) == batchSize {
+		return v
+	}
+
+	v := &sessionUplinkVecs{
+		qpvec:   make([]*sessionQueuedPacket, batchSize),
+		namevec: make([]unix.RawSockaddrInet6, batchSize),
+		iovec:   make([]unix.Iovec, batchSize),
+		msgvec:  make([]conn.Mmsghdr, batchSize),
+	}
+
+	for i := range v.msgvec {
+		v.msgvec[i].Msghdr.Name = (*byte)(unsafe.Pointer(&v.namevec[i]))
+		v.msgvec[i].Msghdr.Namelen = unix.SizeofSockaddrInet6
+		v.msgvec[i].Msghdr.Iov = &v.iovec[i]
+		v.msgvec[i].Msghdr.SetIovlen(1)
+	}
+
+	return v
+}
+
+// putUplinkVecs returns the message vectors to the pool.
+// References to queued packets are cleared, since the packets have been returned to their own pool.
+func (s *UDPSessionRelay) putUplinkVecs(v *sessionUplinkVecs) {
+	for i := range v.qpvec {
+		v.qpvec[i] = nil
+		v.iovec[i].Base = nil
+	}
+	s.uplinkVecsPool.Put(v)
+}
+
 func (s *UDPSessionRelay) recvFromServerConnRecvmmsg() {
 	qpvec := make([]*sessionQueuedPacket, conn.UIO_MAXIOV)
 	namevec := make([]unix.RawSockaddrInet6, conn.UIO_MAXIOV)
@@ -78,6 +217,11 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg() {
 		recvmmsgCount++
 		packetsReceived += uint64(n)
 
+		var recvTime time.Time
+		if s.sourceRateLimiter != nil {
+			recvTime = time.Now()
+		}
+
 		s.mu.Lock()
 
 		msgvecn := msgvec[:n]
@@ -110,11 +254,12 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg() {
 
 			err = conn.ParseFlagsForError(int(msg.Msghdr.Flags))
 			if err != nil {
-				s.logger.Warn("Packet from serverConn discarded",
+				s.logger.Warn(flagsErrorMessage(err, "Packet from serverConn discarded"),
 					zap.String("server", s.serverName),
 					zap.String("listenAddress", s.listenAddress),
 					zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
 					zap.Uint32("packetLength", msg.Msglen),
+					zap.Int("recvBufSize", s.packetBufRecvSize),
 					zap.Error(err),
 				)
 
@@ -122,6 +267,20 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg() {
 				continue
 			}
 
+			if s.sourceRateLimiter != nil && !s.sourceRateLimiter.Allow(queuedPacket.clientAddrPort.Addr(), int(msg.Msglen), recvTime) {
+				if ce := s.logger.Check(zap.DebugLevel, "Dropping packet from source over rate limit"); ce != nil {
+					ce.Write(
+						zap.String("server", s.serverName),
+						zap.String("listenAddress", s.listenAddress),
+						zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+						zap.Uint32("packetLength", msg.Msglen),
+					)
+				}
+
+				s.putQueuedPacket(queuedPacket)
+				continue
+			}
+
 			packet := queuedPacket.buf[s.packetBufFrontHeadroom : s.packetBufFrontHeadroom+int(msg.Msglen)]
 
 			csid, err := s.server.SessionInfo(packet)
@@ -138,6 +297,21 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg() {
 				continue
 			}
 
+			if len(s.natConnBackoff) > 0 && s.natConnBackoff.active(csid, time.Now()) {
+				if ce := s.logger.Check(zap.DebugLevel, "Dropping packet for session in backoff"); ce != nil {
+					ce.Write(
+						zap.String("server", s.serverName),
+						zap.String("listenAddress", s.listenAddress),
+						zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+						zap.Uint64("clientSessionID", csid),
+						zap.Uint32("packetLength", msg.Msglen),
+					)
+				}
+
+				s.putQueuedPacket(queuedPacket)
+				continue
+			}
+
 			entry, ok := s.table[csid]
 			if !ok {
 				entry = &session{}
@@ -156,9 +330,40 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg() {
 					s.putQueuedPacket(queuedPacket)
 					continue
 				}
+
+				if s.tap != nil {
+					entry.serverConnUnpacker = &tapServerUnpacker{entry.serverConnUnpacker, s.tap, csid}
+				}
+			}
+
+			if ok {
+				s.mu.Unlock()
+				entry.unpackMu.Lock()
 			}
 
 			queuedPacket.targetAddr, queuedPacket.start, queuedPacket.length, err = entry.serverConnUnpacker.UnpackInPlace(queuedPacket.buf, queuedPacket.clientAddrPort, s.packetBufFrontHeadroom, int(msg.Msglen))
+
+			if ok {
+				entry.unpackMu.Unlock()
+				s.mu.Lock()
+
+				// The session may have ended while the packet was being unpacked.
+				if s.table[csid] != entry {
+					if ce := s.logger.Check(zap.DebugLevel, "Dropping packet for session that ended during unpacking"); ce != nil {
+						ce.Write(
+							zap.String("server", s.serverName),
+							zap.String("listenAddress", s.listenAddress),
+							zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+							zap.Uint64("clientSessionID", csid),
+							zap.Uint32("packetLength", msg.Msglen),
+						)
+					}
+
+					s.putQueuedPacket(queuedPacket)
+					continue
+				}
+			}
+
 			if err != nil {
 				s.logger.Warn("Failed to unpack packet from serverConn",
 					zap.String("server", s.serverName),
@@ -169,43 +374,48 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg() {
 					zap.Error(err),
 				)
 
+				if ok {
+					s.recordUnpackFailure(csid, entry, queuedPacket.clientAddrPort, err)
+				}
+
 				s.putQueuedPacket(queuedPacket)
 				continue
 			}
 
+			entry.serverConnUnpackFailures = 0
 			payloadBytesReceived += uint64(queuedPacket.length)
 
 			var clientAddrInfop *sessionClientAddrInfo
-			cmsg := cmsgvec[i][:msg.Msghdr.Controllen]
+			cm, err := conn.ParseSocketControlMessage(cmsgvec[i][:msg.Msghdr.Controllen])
+			if err != nil {
+				s.logger.Warn("Failed to parse control messages from serverConn",
+					zap.String("server", s.serverName),
+					zap.String("listenAddress", s.listenAddress),
+					zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+					zap.Stringer("targetAddress", &queuedPacket.targetAddr),
+					zap.Uint64("clientSessionID", csid),
+					zap.Error(err),
+				)
+
+				s.putQueuedPacket(queuedPacket)
+				continue
+			}
+
+			queuedPacket.recvTime = cm.Timestamp
 
 			updateClientAddrPort := entry.clientAddrPortCache != queuedPacket.clientAddrPort
-			updateClientPktinfo := !bytes.Equal(entry.clientPktinfoCache, cmsg)
+			updateClientPktinfo := !bytes.Equal(entry.clientPktinfoCache, cm.PktinfoCmsg)
 
 			if updateClientAddrPort {
 				entry.clientAddrPortCache = queuedPacket.clientAddrPort
 			}
 
 			if updateClientPktinfo {
-				entry.clientPktinfoCache = make([]byte, len(cmsg))
-				copy(entry.clientPktinfoCache, cmsg)
+				entry.clientPktinfoCache = make([]byte, len(cm.PktinfoCmsg))
+				copy(entry.clientPktinfoCache, cm.PktinfoCmsg)
 			}
 
 			if updateClientAddrPort || updateClientPktinfo {
-				clientPktinfoAddr, clientPktinfoIfindex, err := conn.ParsePktinfoCmsg(cmsg)
-				if err != nil {
-					s.logger.Warn("Failed to parse pktinfo control message from serverConn",
-						zap.String("server", s.serverName),
-						zap.String("listenAddress", s.listenAddress),
-						zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
-						zap.Stringer("targetAddress", &queuedPacket.targetAddr),
-						zap.Uint64("clientSessionID", csid),
-						zap.Error(err),
-					)
-
-					s.putQueuedPacket(queuedPacket)
-					continue
-				}
-
 				clientAddrInfop = &sessionClientAddrInfo{entry.clientAddrPortCache, entry.clientPktinfoCache}
 				entry.clientAddrInfo.Store(clientAddrInfop)
 
@@ -215,8 +425,8 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg() {
 						zap.String("listenAddress", s.listenAddress),
 						zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
 						zap.Stringer("targetAddress", &queuedPacket.targetAddr),
-						zap.Stringer("clientPktinfoAddr", clientPktinfoAddr),
-						zap.Uint32("clientPktinfoIfindex", clientPktinfoIfindex),
+						zap.Stringer("clientPktinfoAddr", cm.PktinfoAddr),
+						zap.Uint32("clientPktinfoIfindex", cm.PktinfoIfindex),
 						zap.Uint64("clientSessionID", csid),
 					)
 				}
@@ -224,25 +434,88 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg() {
 
 			if !ok {
 				entry.natConnSendCh = make(chan *sessionQueuedPacket, sendChannelCapacity)
+				if s.mirror != nil {
+					entry.mirrorSendCh = make(chan *sessionQueuedPacket, sendChannelCapacity)
+				}
+				entry.createdAt = time.Now()
+				affinity, _ := s.affinity.take(csid, entry.createdAt)
 				s.table[csid] = entry
 
 				go func() {
-					var sendChClean bool
+					setupStart := time.Now()
+
+					var (
+						sendChClean    bool
+						backoff        bool
+						affinityRecord sessionAffinityEntry
+					)
 
 					defer func() {
 						s.mu.Lock()
 						close(entry.natConnSendCh)
-						delete(s.table, csid)
+						if entry.mirrorSendCh != nil {
+							close(entry.mirrorSendCh)
+						}
+						// The entry may have been removed by the stale session sweeper,
+						// and a new session with the same ID may have taken its place.
+						if s.table[csid] == entry {
+							delete(s.table, csid)
+						}
+						if backoff {
+							s.natConnBackoff.add(csid, time.Now(), natConnRetryBackoff)
+						}
+						if affinityRecord.client != nil {
+							s.affinity.add(csid, affinityRecord, time.Now())
+						}
 						s.mu.Unlock()
 
 						if !sendChClean {
 							for queuedPacket := range entry.natConnSendCh {
 								s.putQueuedPacket(queuedPacket)
 							}
+							if entry.mirrorSendCh != nil {
+								for queuedPacket := range entry.mirrorSendCh {
+									s.putQueuedPacket(queuedPacket)
+								}
+							}
 						}
 					}()
 
-					c, err := s.router.GetUDPClient(s.serverName, queuedPacket.clientAddrPort, queuedPacket.targetAddr)
+					if !s.acquireSetupSlot() {
+						s.logger.Warn("Timed out waiting for a session setup slot",
+							zap.String("server", s.serverName),
+							zap.String("listenAddress", s.listenAddress),
+							zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+							zap.Stringer("targetAddress", &queuedPacket.targetAddr),
+							zap.Uint64("clientSessionID", csid),
+							zap.Int("maxConcurrentSetups", cap(s.setupSem)),
+						)
+						s.collector.CollectSessionSetupFailure(stats.SessionSetupFailureQueue)
+						return
+					}
+
+					setupSlotHeld := true
+					defer func() {
+						if setupSlotHeld {
+							s.releaseSetupSlot()
+						}
+					}()
+
+					// Use the same router for the whole session, even if it is swapped out by SetRouter.
+					sessionRouter := acquireRouter(&s.router)
+					if sessionRouter == nil {
+						return
+					}
+					defer sessionRouter.Release()
+					username := sessionUsername(entry.serverConnUnpacker)
+
+					requestInfo := router.RequestInfo{
+						Server:         s.serverName,
+						Username:       username,
+						SourceAddrPort: queuedPacket.clientAddrPort,
+						TargetAddr:     queuedPacket.targetAddr,
+					}
+					c, policy, err := sessionRouter.GetUDPClient(requestInfo)
 					if err != nil {
 						s.logger.Warn("Failed to get UDP client for new NAT session",
 							zap.String("server", s.serverName),
@@ -252,18 +525,29 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg() {
 							zap.Uint64("clientSessionID", csid),
 							zap.Error(err),
 						)
+						reason := stats.SessionSetupFailureRoute
+						if errors.Is(err, router.ErrTargetNotAllowed) {
+							reason = stats.SessionSetupFailureTargetNotAllowed
+						}
+						s.collector.CollectSessionSetupFailure(reason)
 						return
 					}
 
+					// Later packets of the session may be sent to other targets, so they are checked against the allowlist too.
+					entry.allowsTarget = sessionRouter.TargetAllowlist(username)
+
+					c, policy = s.preferAffinity(csid, affinity, sessionRouter, requestInfo, c, policy)
 					clientName := c.String()
 
 					// Only add for the current goroutine here, since we don't want the router to block exiting.
 					s.wg.Add(1)
 					defer s.wg.Done()
 
-					natConnMaxPacketSize, natConnFwmark := c.LinkInfo()
-					natConnPacker, natConnUnpacker, err := c.NewSession()
+					clientInfo, natConnPacker, natConnUnpacker, err := c.NewSession()
 					if err != nil {
+						natConnErr := &NATConnError{Op: "create client session", Err: err}
+						backoff = natConnErr.Transient()
+						s.collector.CollectNATConnError(natConnErr.Kind())
 						s.logger.Warn("Failed to create new UDP client session",
 							zap.String("server", s.serverName),
 							zap.String("client", clientName),
@@ -271,11 +555,17 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg() {
 							zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
 							zap.Stringer("targetAddress", &queuedPacket.targetAddr),
 							zap.Uint64("clientSessionID", csid),
+							zap.Bool("transient", backoff),
 							zap.Error(err),
 						)
+						s.collector.CollectSessionSetupFailure(stats.SessionSetupFailureClientSession)
 						return
 					}
 
+					if clientInfo.Closer != nil {
+						defer clientInfo.Closer.Close()
+					}
+
 					serverConnPacker, err := s.server.NewPacker(csid)
 					if err != nil {
 						s.logger.Warn("Failed to create packer for client session",
@@ -286,11 +576,19 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg() {
 							zap.Uint64("clientSessionID", csid),
 							zap.Error(err),
 						)
+						s.collector.CollectSessionSetupFailure(stats.SessionSetupFailureServerPacker)
 						return
 					}
 
-					natConn, err := conn.ListenUDP("udp", "", false, natConnFwmark)
+					if policy.Fwmark != 0 {
+						clientInfo.Fwmark = policy.Fwmark
+					}
+
+					natConn, err := s.listenNATConn(csid, clientName, username, clientInfo)
 					if err != nil {
+						natConnErr := &NATConnError{Op: "listen", Err: err}
+						backoff = natConnErr.Transient()
+						s.collector.CollectNATConnError(natConnErr.Kind())
 						s.logger.Warn("Failed to create UDP socket for new NAT session",
 							zap.String("server", s.serverName),
 							zap.String("client", clientName),
@@ -298,9 +596,12 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg() {
 							zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
 							zap.Stringer("targetAddress", &queuedPacket.targetAddr),
 							zap.Uint64("clientSessionID", csid),
-							zap.Int("natConnFwmark", natConnFwmark),
+							zap.Int("natConnFwmark", clientInfo.Fwmark),
+							zap.Stringer("natConnLocalPortRange", clientInfo.LocalPortRange),
+							zap.Bool("transient", backoff),
 							zap.Error(err),
 						)
+						s.collector.CollectSessionSetupFailure(stats.SessionSetupFailureSocket)
 						return
 					}
 
@@ -316,43 +617,115 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg() {
 							zap.Uint64("clientSessionID", csid),
 							zap.Error(err),
 						)
+						s.collector.CollectSessionSetupFailure(stats.SessionSetupFailureDeadline)
 						natConn.Close()
 						return
 					}
 
+					if s.recvICMPErrors {
+						if err = conn.SetRecvErr(natConn); err != nil {
+							s.logger.Warn("Failed to enable ICMP error reception on natConn",
+								zap.String("server", s.serverName),
+								zap.String("client", clientName),
+								zap.String("listenAddress", s.listenAddress),
+								zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+								zap.Uint64("clientSessionID", csid),
+								zap.Error(err),
+							)
+						}
+					}
+
+					if s.tap != nil {
+						natConnUnpacker = &tapClientUnpacker{natConnUnpacker, s.tap, csid}
+					}
+
+					entry.clientName = clientName
+					entry.natConnLocalAddrPort = natConnLocalAddrPort(natConn, clientInfo)
+					entry.natConnUnpacker = natConnUnpacker
+
 					oldState := entry.state.Swap(natConn)
 					if oldState != nil {
 						natConn.Close()
 						return
 					}
 
+					if s.tap != nil {
+						natConnPacker = &tapClientPacker{natConnPacker, s.tap, csid}
+						serverConnPacker = &tapServerPacker{serverConnPacker, s.tap, csid}
+					}
+
 					// No more early returns!
 					sendChClean = true
+					affinityRecord = sessionAffinityEntry{router: sessionRouter, client: c, policy: policy}
+
+					// Setup is done. Let the next session set up.
+					s.releaseSetupSlot()
+					setupSlotHeld = false
+
+					setupDuration := time.Since(setupStart)
+					s.collector.ObserveSessionSetupLatency(setupDuration)
 
 					entry.natConn = natConn
-					entry.natConnRecvBufSize = natConnMaxPacketSize
+					entry.natConnRecvBufSize = clientInfo.MaxPacketSize
 					entry.natConnPacker = natConnPacker
-					entry.natConnUnpacker = natConnUnpacker
 					entry.serverConnPacker = serverConnPacker
 
+					if s.validateNATSource {
+						entry.natConnSources = newNATSourceSet()
+					}
+
+					if policy.BandwidthLimit > 0 {
+						entry.natConnShaper = newShaper(policy.BandwidthLimit)
+						entry.serverConnShaper = newShaper(policy.BandwidthLimit)
+					}
+
 					s.logger.Info("UDP session relay started",
 						zap.String("server", s.serverName),
 						zap.String("client", clientName),
 						zap.String("listenAddress", s.listenAddress),
 						zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+						zap.Stringer("natConnLocalAddress", entry.natConnLocalAddrPort),
 						zap.Stringer("targetAddress", &queuedPacket.targetAddr),
+						s.targetNameField("targetName", queuedPacket.targetAddr),
 						zap.Uint64("clientSessionID", csid),
+						zap.Duration("setupDuration", setupDuration),
 					)
 
+					sessionRouter.SessionOpened(clientName)
+					defer sessionRouter.SessionClosed(clientName)
+
+					if policy.MaxLifetime > 0 {
+						lifetimeTimer := time.AfterFunc(policy.MaxLifetime-setupDuration, func() {
+							s.expireSession(csid, entry, policy.MaxLifetime)
+						})
+						defer lifetimeTimer.Stop()
+					}
+
+					s.collector.UDPSessionOpened(username)
+
+					var downlinkBytes uint64
+
 					s.wg.Add(1)
 
 					go func() {
-						s.relayServerConnToNatConnSendmmsg(csid, entry)
+						uplinkBytes := s.relayServerConnToNatConnSendmmsg(csid, entry)
 						entry.natConn.Close()
+						// natConnSendCh is only closed after the natConn -> serverConn relay returns,
+						// so downlinkBytes is final by now.
+						s.collector.UDPSessionClosed(username, uplinkBytes, downlinkBytes)
 						s.wg.Done()
 					}()
 
-					s.relayNatConnToServerConnSendmmsg(csid, entry, clientAddrInfop)
+					if entry.mirrorSendCh != nil {
+						s.wg.Add(1)
+
+						go func() {
+							s.relayServerConnToMirror(csid, entry)
+							s.wg.Done()
+						}()
+					}
+
+					downlinkBytes = s.relayNatConnToServerConnSendmmsg(csid, entry, clientAddrInfop)
 				}()
 
 				if ce := s.logger.Check(zap.DebugLevel, "New UDP session"); ce != nil {
@@ -366,20 +739,39 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg() {
 				}
 			}
 
-			select {
-			case entry.natConnSendCh <- queuedPacket:
-			default:
-				if ce := s.logger.Check(zap.DebugLevel, "Dropping packet due to full send channel"); ce != nil {
+			s.mirrorQueuedPacket(entry, queuedPacket)
+
+			if !s.reserveQueuedBytes(entry, queuedPacket.length) {
+				if ce := s.logger.Check(zap.DebugLevel, "Dropping packet due to queued bytes limit"); ce != nil {
 					ce.Write(
 						zap.String("server", s.serverName),
 						zap.String("listenAddress", s.listenAddress),
 						zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
 						zap.Stringer("targetAddress", &queuedPacket.targetAddr),
 						zap.Uint64("clientSessionID", csid),
+						zap.Int("payloadLength", queuedPacket.length),
 					)
 				}
 
 				s.putQueuedPacket(queuedPacket)
+			} else {
+				select {
+				case entry.natConnSendCh <- queuedPacket:
+				default:
+					s.releaseQueuedBytes(entry, queuedPacket.length)
+
+					if ce := s.logger.Check(zap.DebugLevel, "Dropping packet due to full send channel"); ce != nil {
+						ce.Write(
+							zap.String("server", s.serverName),
+							zap.String("listenAddress", s.listenAddress),
+							zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+							zap.Stringer("targetAddress", &queuedPacket.targetAddr),
+							zap.Uint64("clientSessionID", csid),
+						)
+					}
+
+					s.putQueuedPacket(queuedPacket)
+				}
 			}
 		}
 
@@ -399,32 +791,70 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg() {
 	)
 }
 
-func (s *UDPSessionRelay) relayServerConnToNatConnSendmmsg(csid uint64, entry *session) {
+// relayServerConnToNatConnSendmmsg returns the number of payload bytes sent.
+func (s *UDPSessionRelay) relayServerConnToNatConnSendmmsg(csid uint64, entry *session) uint64 {
 	var (
-		destAddrPort     netip.AddrPort
-		packetStart      int
-		packetLength     int
-		err              error
-		sendmmsgCount    uint64
-		packetsSent      uint64
-		payloadBytesSent uint64
+		destAddrPort             netip.AddrPort
+		packetStart              int
+		packetLength             int
+		err                      error
+		sendmmsgCount            uint64
+		packetsSent              uint64
+		packetsDroppedAfterRetry uint64
+		payloadBytesSent         uint64
 	)
 
-	qpvec := make([]*sessionQueuedPacket, s.batchSize)
-	namevec := make([]unix.RawSockaddrInet6, s.batchSize)
-	iovec := make([]unix.Iovec, s.batchSize)
-	msgvec := make([]conn.Mmsghdr, s.batchSize)
+	batchSize := s.BatchSize()
+	vecs := s.getUplinkVecs(batchSize)
+	defer func() {
+		s.putUplinkVecs(vecs)
+	}()
+	qpvec, namevec, iovec, msgvec := vecs.qpvec, vecs.namevec, vecs.iovec, vecs.msgvec
 
-	for i := range msgvec {
-		msgvec[i].Msghdr.Name = (*byte)(unsafe.Pointer(&namevec[i]))
-		msgvec[i].Msghdr.Namelen = unix.SizeofSockaddrInet6
-		msgvec[i].Msghdr.Iov = &iovec[i]
-		msgvec[i].Msghdr.SetIovlen(1)
+	// lingerTimer is reused across batches. It is armed on the first empty dequeue of a batch,
+	// so a batch is held back for at most batchLinger after its first packet.
+	var (
+		lingerTimer *time.Timer
+		lingering   bool
+	)
+
+	if s.batchLinger > 0 {
+		lingerTimer = time.NewTimer(s.batchLinger)
+		if !lingerTimer.Stop() {
+			<-lingerTimer.C
+		}
 	}
 
+	// flowLabel is registered on the first IPv6 destination, since the kernel
+	// requires a destination address when creating a flow label.
+	var (
+		flowLabel          uint32
+		flowLabelAttempted = !s.ipv6FlowLabel
+	)
+
+	upstreamLogged := !s.logSessionUpstream
+
 main:
 	for {
-		var count int
+		var (
+			count        int
+			payloadBytes int
+		)
+
+		if lingering {
+			if !lingerTimer.Stop() {
+				<-lingerTimer.C
+			}
+			lingering = false
+		}
+
+		// Pick up batch size changes between batches.
+		if n := s.BatchSize(); n != batchSize {
+			batchSize = n
+			s.putUplinkVecs(vecs)
+			vecs = s.getUplinkVecs(batchSize)
+			qpvec, namevec, iovec, msgvec = vecs.qpvec, vecs.namevec, vecs.iovec, vecs.msgvec
+		}
 
 		// Block on first dequeue op.
 		queuedPacket, ok := <-entry.natConnSendCh
@@ -434,6 +864,17 @@ main:
 
 	dequeue:
 		for {
+			s.releaseQueuedBytes(entry, queuedPacket.length)
+
+			if !s.targetAllowed(csid, entry, queuedPacket) {
+				s.putQueuedPacket(queuedPacket)
+
+				if count == 0 {
+					continue main
+				}
+				goto next
+			}
+
 			destAddrPort, packetStart, packetLength, err = entry.natConnPacker.PackInPlace(queuedPacket.buf, queuedPacket.targetAddr, queuedPacket.start, queuedPacket.length)
 			if err != nil {
 				s.logger.Warn("Failed to pack packet for natConn",
@@ -454,14 +895,41 @@ main:
 				goto next
 			}
 
+			entry.natConnSources.Add(destAddrPort)
+
 			qpvec[count] = queuedPacket
+			if !flowLabelAttempted && destAddrPort.Addr().Is6() && !destAddrPort.Addr().Is4In6() {
+				flowLabelAttempted = true
+				label := conn.FlowLabelFromID(csid, s.flowLabelSalt)
+				if err = conn.SetFlowLabel(entry.natConn, destAddrPort.Addr(), label); err != nil {
+					// Labels are registered exclusively, so collisions between sessions are expected
+					// at a steady rate, and the session just sends unlabeled datagrams.
+					if ce := s.logger.Check(zap.DebugLevel, "Failed to set IPv6 flow label on natConn"); ce != nil {
+						ce.Write(
+							zap.String("server", s.serverName),
+							zap.String("listenAddress", s.listenAddress),
+							zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+							zap.Stringer("writeDestAddress", destAddrPort),
+							zap.Uint64("clientSessionID", csid),
+							zap.Uint32("flowLabel", label),
+							zap.Error(err),
+						)
+					}
+				} else {
+					flowLabel = label
+				}
+			}
+
 			namevec[count] = conn.AddrPortToSockaddrInet6(destAddrPort)
+			if flowLabel != 0 {
+				conn.SetSockaddrFlowLabel(&namevec[count], flowLabel)
+			}
 			iovec[count].Base = &queuedPacket.buf[packetStart]
 			iovec[count].SetLen(packetLength)
 			count++
-			payloadBytesSent += uint64(queuedPacket.length)
+			payloadBytes += queuedPacket.length
 
-			if count == s.batchSize {
+			if count == batchSize {
 				break
 			}
 
@@ -472,35 +940,84 @@ main:
 					break dequeue
 				}
 			default:
-				break dequeue
+				if lingerTimer == nil {
+					break dequeue
+				}
+
+				if !lingering {
+					lingerTimer.Reset(s.batchLinger)
+					lingering = true
+				}
+
+				select {
+				case queuedPacket, ok = <-entry.natConnSendCh:
+					if !ok {
+						break dequeue
+					}
+				case <-lingerTimer.C:
+					lingering = false
+					break dequeue
+				}
 			}
 		}
 
-		if err := conn.WriteMsgvec(entry.natConn, msgvec[:count]); err != nil {
-			s.logger.Warn("Failed to batch write packets to natConn",
-				zap.String("server", s.serverName),
-				zap.String("listenAddress", s.listenAddress),
-				zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
-				zap.Stringer("lastTargetAddress", &qpvec[count-1].targetAddr),
-				zap.Stringer("lastWriteDestAddress", destAddrPort),
-				zap.Uint64("clientSessionID", csid),
-				zap.Error(err),
-			)
+		if entry.natConnShaper != nil {
+			entry.natConnShaper.Wait(payloadBytes)
 		}
 
-		if err := entry.natConn.SetReadDeadline(time.Now().Add(s.natTimeout)); err != nil {
-			s.logger.Warn("Failed to set read deadline on natConn",
-				zap.String("server", s.serverName),
-				zap.String("listenAddress", s.listenAddress),
-				zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
-				zap.Duration("natTimeout", s.natTimeout),
-				zap.Uint64("clientSessionID", csid),
-				zap.Error(err),
-			)
+		s.collector.CollectUplinkSendmmsgBatch(count)
+
+		sent, err := conn.WriteMsgvec(entry.natConn, msgvec[:count])
+		if err != nil {
+			if n := droppedAfterRetry(err); n > 0 {
+				packetsDroppedAfterRetry += uint64(n)
+				s.collector.CollectPacketDrops(stats.PacketDropSendBufferFull, uint64(n))
+			} else {
+				s.collector.CollectPacketDrops(stats.PacketDropSendError, uint64(count-sent))
+				if s.handleNatConnICMPErrors(csid, entry) == 0 {
+					s.logger.Warn("Failed to batch write packets to natConn",
+						zap.String("server", s.serverName),
+						zap.String("listenAddress", s.listenAddress),
+						zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+						zap.Stringer("lastTargetAddress", &qpvec[count-1].targetAddr),
+						zap.Stringer("lastWriteDestAddress", destAddrPort),
+						zap.Int("packetsDropped", count-sent),
+						zap.Uint64("clientSessionID", csid),
+						zap.Error(err),
+					)
+				}
+			}
+		} else if !upstreamLogged {
+			upstreamLogged = true
+			firstDestAddrPort := conn.SockaddrInet6ToAddrPort(&namevec[0])
+			firstDestAddrPort = netip.AddrPortFrom(firstDestAddrPort.Addr().Unmap(), firstDestAddrPort.Port())
+			s.logSessionUpstreamAddress(csid, entry, qpvec[0].clientAddrPort, firstDestAddrPort)
+		}
+
+		// Do not extend the read deadline once shutdown has been signaled.
+		if entry.state.Load() != s.serverConn {
+			if err := entry.natConn.SetReadDeadline(time.Now().Add(s.natTimeout)); err != nil {
+				s.logger.Warn("Failed to set read deadline on natConn",
+					zap.String("server", s.serverName),
+					zap.String("listenAddress", s.listenAddress),
+					zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+					zap.Duration("natTimeout", s.natTimeout),
+					zap.Uint64("clientSessionID", csid),
+					zap.Error(err),
+				)
+			}
+		}
+
+		if s.recvTimestamps {
+			now := time.Now()
+			for _, queuedPacket := range qpvec[:sent] {
+				s.observeRelayDelay(queuedPacket, now)
+			}
 		}
 
 		sendmmsgCount++
-		packetsSent += uint64(count)
+		packetsSent += uint64(sent)
+		payloadBytesSent += uint64(payloadBytes)
 
 		qpvecn := qpvec[:count]
 
@@ -517,68 +1034,93 @@ main:
 		zap.String("server", s.serverName),
 		zap.String("listenAddress", s.listenAddress),
 		zap.Stringer("lastWriteDestAddress", destAddrPort),
+		s.targetNameField("lastWriteDestName", conn.AddrFromIPPort(destAddrPort)),
 		zap.Uint64("clientSessionID", csid),
 		zap.Uint64("sendmmsgCount", sendmmsgCount),
 		zap.Uint64("packetsSent", packetsSent),
+		zap.Uint64("packetsDroppedAfterRetry", packetsDroppedAfterRetry),
 		zap.Uint64("payloadBytesSent", payloadBytesSent),
+		zap.Duration("batchLinger", s.batchLinger),
 	)
+
+	return payloadBytesSent
 }
 
-func (s *UDPSessionRelay) relayNatConnToServerConnSendmmsg(csid uint64, entry *session, clientAddrInfop *sessionClientAddrInfo) {
+// relayNatConnToServerConnSendmmsg returns the number of payload bytes sent.
+func (s *UDPSessionRelay) relayNatConnToServerConnSendmmsg(csid uint64, entry *session, clientAddrInfop *sessionClientAddrInfo) uint64 {
 	clientAddrPort := clientAddrInfop.addrPort
 	clientPktinfo := clientAddrInfop.pktinfo
 	maxClientPacketSize := zerocopy.MaxPacketSizeForAddr(s.mtu, clientAddrPort.Addr())
 
-	frontHeadroom := entry.serverConnPacker.FrontHeadroom() - entry.natConnUnpacker.FrontHeadroom()
-	if frontHeadroom < 0 {
-		frontHeadroom = 0
-	}
-	rearHeadroom := entry.serverConnPacker.RearHeadroom() - entry.natConnUnpacker.RearHeadroom()
-	if rearHeadroom < 0 {
-		rearHeadroom = 0
-	}
+	headroom := zerocopy.ExcessHeadroom(entry.serverConnPacker, entry.natConnUnpacker)
+	frontHeadroom, rearHeadroom := headroom.Front, headroom.Rear
 
 	var (
-		sendmmsgCount    uint64
-		packetsSent      uint64
-		payloadBytesSent uint64
+		sendmmsgCount            uint64
+		packetsSent              uint64
+		packetsDroppedAfterRetry uint64
+		packetsSourceRejected    uint64
+		payloadBytesSent         uint64
 	)
 
-	rsa6, namelen := conn.AddrPortToSockaddrValue(clientAddrPort)
-	savec := make([]unix.RawSockaddrInet6, s.batchSize)
-	bufvec := make([][]byte, s.batchSize)
-	riovec := make([]unix.Iovec, s.batchSize)
-	siovec := make([]unix.Iovec, s.batchSize)
-	rmsgvec := make([]conn.Mmsghdr, s.batchSize)
-	smsgvec := make([]conn.Mmsghdr, s.batchSize)
-
-	for i := 0; i < s.batchSize; i++ {
-		packetBuf := make([]byte, frontHeadroom+entry.natConnRecvBufSize+rearHeadroom)
-		bufvec[i] = packetBuf
-
-		riovec[i].Base = &packetBuf[frontHeadroom]
-		riovec[i].SetLen(entry.natConnRecvBufSize)
-
-		rmsgvec[i].Msghdr.Name = (*byte)(unsafe.Pointer(&savec[i]))
-		rmsgvec[i].Msghdr.Namelen = unix.SizeofSockaddrInet6
-		rmsgvec[i].Msghdr.Iov = &riovec[i]
-		rmsgvec[i].Msghdr.SetIovlen(1)
-
-		smsgvec[i].Msghdr.Name = (*byte)(unsafe.Pointer(&rsa6))
-		smsgvec[i].Msghdr.Namelen = namelen
-		smsgvec[i].Msghdr.Iov = &siovec[i]
-		smsgvec[i].Msghdr.SetIovlen(1)
-		smsgvec[i].Msghdr.Control = &clientPktinfo[0]
-		smsgvec[i].Msghdr.SetControllen(len(clientPktinfo))
-	}
+	recvBufSize := s.initialNatConnRecvBufSize(entry)
+	growRecvBuf := false
+	vecs := s.getDownlinkVecs(frontHeadroom + recvBufSize + rearHeadroom)
+	defer func() {
+		s.downlinkBufPool.Put(vecs)
+	}()
+
+	var namelen uint32
+	vecs.rsa6, namelen = conn.AddrPortToSockaddrValue(clientAddrPort)
+	vecs.setup(frontHeadroom, recvBufSize, namelen, clientPktinfo)
+	bufvec := vecs.bufvec
+	riovec := vecs.riovec
+	siovec := vecs.siovec
+	rmsgvec := vecs.rmsgvec
+	smsgvec := vecs.smsgvec
 
 	for {
+		// Pick up batch size changes between batches.
+		if s.BatchSize() != len(bufvec) {
+			vecs = s.replaceDownlinkVecs(vecs, frontHeadroom, recvBufSize, rearHeadroom, namelen, clientPktinfo)
+			bufvec = vecs.bufvec
+			riovec = vecs.riovec
+			siovec = vecs.siovec
+			rmsgvec = vecs.rmsgvec
+			smsgvec = vecs.smsgvec
+		}
+
+		if growRecvBuf {
+			growRecvBuf = false
+			recvBufSize = nextNatConnRecvBufSize(recvBufSize, entry)
+			vecs.resizeBufs(frontHeadroom + recvBufSize + rearHeadroom)
+
+			for i := range riovec {
+				riovec[i].Base = &bufvec[i][frontHeadroom]
+				riovec[i].SetLen(recvBufSize)
+			}
+
+			if ce := s.logger.Check(zap.DebugLevel, "Grew natConn receive buffers after truncated packets"); ce != nil {
+				ce.Write(
+					zap.String("server", s.serverName),
+					zap.String("listenAddress", s.listenAddress),
+					zap.Stringer("clientAddress", clientAddrPort),
+					zap.Uint64("clientSessionID", csid),
+					zap.Int("recvBufSize", recvBufSize),
+				)
+			}
+		}
+
 		nr, err := conn.Recvmmsg(entry.natConn, rmsgvec)
 		if err != nil {
 			if errors.Is(err, os.ErrDeadlineExceeded) {
 				break
 			}
 
+			if s.handleNatConnICMPErrors(csid, entry) > 0 {
+				continue
+			}
+
 			s.logger.Warn("Failed to batch read packets from natConn",
 				zap.String("server", s.serverName),
 				zap.String("listenAddress", s.listenAddress),
@@ -594,15 +1136,14 @@ func (s *UDPSessionRelay) relayNatConnToServerConnSendmmsg(csid uint64, entry *s
 			clientAddrPort = caip.addrPort
 			clientPktinfo = caip.pktinfo
 			maxClientPacketSize = zerocopy.MaxPacketSizeForAddr(s.mtu, clientAddrPort.Addr())
-			rsa6, _ = conn.AddrPortToSockaddrValue(clientAddrPort) // namelen won't change
-
-			for i := range smsgvec {
-				smsgvec[i].Msghdr.Control = &clientPktinfo[0]
-				smsgvec[i].Msghdr.SetControllen(len(clientPktinfo))
-			}
+			vecs.rsa6, _ = conn.AddrPortToSockaddrValue(clientAddrPort) // namelen won't change
+			vecs.setControl(clientPktinfo)
 		}
 
-		var ns int
+		var (
+			ns           int
+			payloadBytes int
+		)
 		rmsgvecn := rmsgvec[:nr]
 
 		for i := range rmsgvecn {
@@ -622,18 +1163,41 @@ func (s *UDPSessionRelay) relayNatConnToServerConnSendmmsg(csid uint64, entry *s
 
 			err = conn.ParseFlagsForError(int(msg.Msghdr.Flags))
 			if err != nil {
-				s.logger.Warn("Failed to read packet from natConn",
+				// The truncated packet is dropped. Receive buffers are grown before the next batch.
+				if canGrowNatConnRecvBuf(err, recvBufSize, entry) {
+					growRecvBuf = true
+					continue
+				}
+
+				s.logger.Warn(flagsErrorMessage(err, "Failed to read packet from natConn"),
 					zap.String("server", s.serverName),
 					zap.String("listenAddress", s.listenAddress),
 					zap.Stringer("clientAddress", clientAddrPort),
 					zap.Stringer("packetSourceAddress", packetSourceAddrPort),
 					zap.Uint64("clientSessionID", csid),
 					zap.Uint32("packetLength", msg.Msglen),
+					zap.Int("recvBufSize", recvBufSize),
 					zap.Error(err),
 				)
 				continue
 			}
 
+			if !entry.natConnSources.Contains(packetSourceAddrPort) {
+				packetsSourceRejected++
+
+				if ce := s.logger.Check(zap.DebugLevel, "Dropped packet from unexpected source on natConn"); ce != nil {
+					ce.Write(
+						zap.String("server", s.serverName),
+						zap.String("listenAddress", s.listenAddress),
+						zap.Stringer("clientAddress", clientAddrPort),
+						zap.Stringer("packetSourceAddress", packetSourceAddrPort),
+						zap.Uint64("clientSessionID", csid),
+						zap.Uint32("packetLength", msg.Msglen),
+					)
+				}
+				continue
+			}
+
 			packetBuf := bufvec[i]
 
 			payloadSourceAddrPort, payloadStart, payloadLength, err := entry.natConnUnpacker.UnpackInPlace(packetBuf, packetSourceAddrPort, frontHeadroom, int(msg.Msglen))
@@ -669,26 +1233,55 @@ func (s *UDPSessionRelay) relayNatConnToServerConnSendmmsg(csid uint64, entry *s
 			siovec[ns].Base = &packetBuf[packetStart]
 			siovec[ns].SetLen(packetLength)
 			ns++
-			payloadBytesSent += uint64(payloadLength)
+			payloadBytes += payloadLength
 		}
 
 		if ns == 0 {
 			continue
 		}
 
-		err = conn.WriteMsgvec(s.serverConn, smsgvec[:ns])
-		if err != nil {
-			s.logger.Warn("Failed to batch write packets to serverConn",
+		if entry.serverConnShaper != nil {
+			entry.serverConnShaper.Wait(payloadBytes)
+		}
+
+		s.collector.CollectDownlinkSendmmsgBatch(ns)
+
+		sent, err := conn.WriteMsgvec(s.serverConn, smsgvec[:ns])
+		// Only fall back when no packet was sent, so that sent packets are not sent again.
+		if err != nil && sent == 0 && clientPktinfo != nil && isStalePktinfoError(err) {
+			s.logger.Warn("Failed to batch write packets to serverConn with cached pktinfo, falling back to no pktinfo",
 				zap.String("server", s.serverName),
 				zap.String("listenAddress", s.listenAddress),
 				zap.Stringer("clientAddress", clientAddrPort),
 				zap.Uint64("clientSessionID", csid),
 				zap.Error(err),
 			)
+
+			clientPktinfo = nil
+			vecs.setControl(nil)
+
+			sent, err = conn.WriteMsgvec(s.serverConn, smsgvec[:ns])
+		}
+		if err != nil {
+			if n := droppedAfterRetry(err); n > 0 {
+				packetsDroppedAfterRetry += uint64(n)
+				s.collector.CollectPacketDrops(stats.PacketDropSendBufferFull, uint64(n))
+			} else {
+				s.collector.CollectPacketDrops(stats.PacketDropSendError, uint64(ns-sent))
+				s.logger.Warn("Failed to batch write packets to serverConn",
+					zap.String("server", s.serverName),
+					zap.String("listenAddress", s.listenAddress),
+					zap.Stringer("clientAddress", clientAddrPort),
+					zap.Uint64("clientSessionID", csid),
+					zap.Int("packetsDropped", ns-sent),
+					zap.Error(err),
+				)
+			}
 		}
 
 		sendmmsgCount++
-		packetsSent += uint64(ns)
+		packetsSent += uint64(sent)
+		payloadBytesSent += uint64(payloadBytes)
 	}
 
 	s.logger.Info("Finished relay serverConn <- natConn",
@@ -698,6 +1291,12 @@ func (s *UDPSessionRelay) relayNatConnToServerConnSendmmsg(csid uint64, entry *s
 		zap.Uint64("clientSessionID", csid),
 		zap.Uint64("sendmmsgCount", sendmmsgCount),
 		zap.Uint64("packetsSent", packetsSent),
+		zap.Uint64("packetsDroppedAfterRetry", packetsDroppedAfterRetry),
+		zap.Uint64("packetsSourceRejected", packetsSourceRejected),
 		zap.Uint64("payloadBytesSent", payloadBytesSent),
+		zap.Uint64("uplinkGaps", sessionUplinkGaps(entry)),
+		zap.Uint64("downlinkGaps", sessionDownlinkGaps(entry)),
 	)
+
+	return payloadBytesSent
 }
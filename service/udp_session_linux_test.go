@@ -0,0 +1,225 @@
+package service
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/direct"
+	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/stats"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+func benchmarkDownlinkVecs(b *testing.B, pooled bool) {
+	var s UDPSessionRelay
+	s.batchSize.Store(defaultRecvmmsgMsgvecSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		vecs := s.getDownlinkVecs(benchmarkDownlinkBufSize)
+		if pooled {
+			s.downlinkBufPool.Put(vecs)
+		}
+	}
+}
+
+func BenchmarkDownlinkVecsPooled(b *testing.B) {
+	benchmarkDownlinkVecs(b, true)
+}
+
+func BenchmarkDownlinkVecsUnpooled(b *testing.B) {
+	benchmarkDownlinkVecs(b, false)
+}
+
+func TestUDPSessionRelayUplinkVecsPool(t *testing.T) {
+	var s UDPSessionRelay
+
+	vecs := s.getUplinkVecs(8)
+	if len(vecs.msgvec) != 8 {
+		t.Fatalf("len(msgvec) = %d, expected 8", len(vecs.msgvec))
+	}
+	vecs.qpvec[0] = &sessionQueuedPacket{}
+	b := make([]byte, 1)
+	vecs.iovec[0].Base = &b[0]
+	s.putUplinkVecs(vecs)
+	if vecs.qpvec[0] != nil || vecs.iovec[0].Base != nil {
+		t.Error("putUplinkVecs kept references to queued packets")
+	}
+
+	// Vectors for a different batch size are not reused.
+	vecs = s.getUplinkVecs(16)
+	if len(vecs.msgvec) != 16 {
+		t.Fatalf("len(msgvec) = %d, expected 16", len(vecs.msgvec))
+	}
+	for i := range vecs.msgvec {
+		if vecs.msgvec[i].Msghdr.Iov != &vecs.iovec[i] {
+			t.Fatalf("msgvec[%d] does not point to iovec[%d]", i, i)
+		}
+	}
+}
+
+func TestUDPSessionRelayGetDownlinkVecsBatchSize(t *testing.T) {
+	var s UDPSessionRelay
+	s.batchSize.Store(8)
+
+	vecs := s.getDownlinkVecs(benchmarkDownlinkBufSize)
+	if len(vecs.bufvec) != 8 {
+		t.Fatalf("len(bufvec) = %d, expected 8", len(vecs.bufvec))
+	}
+	s.downlinkBufPool.Put(vecs)
+
+	if err := s.SetBatchSize(16); err != nil {
+		t.Fatal(err)
+	}
+	vecs = s.getDownlinkVecs(benchmarkDownlinkBufSize)
+	if len(vecs.bufvec) != 16 {
+		t.Errorf("len(bufvec) = %d, expected 16 after SetBatchSize", len(vecs.bufvec))
+	}
+
+	if err := s.SetBatchSize(0); err == nil {
+		t.Error("SetBatchSize(0) succeeded")
+	}
+	if err := s.SetBatchSize(maxBatchSize + 1); err == nil {
+		t.Errorf("SetBatchSize(%d) succeeded", maxBatchSize+1)
+	}
+	if n := s.BatchSize(); n != 16 {
+		t.Errorf("BatchSize() = %d, expected 16", n)
+	}
+}
+
+func TestUDPSessionRelayReplaceDownlinkVecsAfterPktinfoFallback(t *testing.T) {
+	const (
+		frontHeadroom = 16
+		recvBufSize   = 1452
+		rearHeadroom  = 16
+	)
+
+	var s UDPSessionRelay
+	s.batchSize.Store(8)
+
+	clientPktinfo := conn.BuildPktinfoCmsg(netip.MustParseAddr("127.0.0.1"), 1)
+	vecs := s.getDownlinkVecs(frontHeadroom + recvBufSize + rearHeadroom)
+	rsa6, namelen := conn.AddrPortToSockaddrValue(netip.MustParseAddrPort("127.0.0.1:20220"))
+	vecs.rsa6 = rsa6
+	vecs.setup(frontHeadroom, recvBufSize, namelen, clientPktinfo)
+	if vecs.smsgvec[0].Msghdr.Control == nil {
+		t.Fatal("Send messages have no pktinfo")
+	}
+
+	// Fall back to no pktinfo, as the relay does when the cached pktinfo goes stale.
+	clientPktinfo = nil
+	vecs.setControl(clientPktinfo)
+
+	if err := s.SetBatchSize(16); err != nil {
+		t.Fatal(err)
+	}
+	vecs = s.replaceDownlinkVecs(vecs, frontHeadroom, recvBufSize, rearHeadroom, namelen, clientPktinfo)
+	if len(vecs.smsgvec) != 16 {
+		t.Fatalf("len(smsgvec) = %d, expected 16", len(vecs.smsgvec))
+	}
+	if vecs.rsa6 != rsa6 {
+		t.Error("Client address was not kept")
+	}
+	for i := range vecs.smsgvec {
+		if vecs.smsgvec[i].Msghdr.Control != nil || vecs.smsgvec[i].Msghdr.Controllen != 0 {
+			t.Fatalf("smsgvec[%d] has a control message after falling back to no pktinfo", i)
+		}
+	}
+}
+
+func TestUDPSessionRelayCountSendErrorDrops(t *testing.T) {
+	const (
+		csid = 42
+		mtu  = 1500
+	)
+
+	echoConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoConn.Close()
+	echoAddr := conn.AddrFromIPPort(echoConn.LocalAddr().(*net.UDPAddr).AddrPort())
+
+	go func() {
+		b := make([]byte, mtu)
+		for {
+			n, addrPort, err := echoConn.ReadFromUDPAddrPort(b)
+			if err != nil {
+				return
+			}
+			if _, err = echoConn.WriteToUDPAddrPort(b[:n], addrPort); err != nil {
+				return
+			}
+		}
+	}()
+
+	logger := zap.NewNop()
+	udpClientMap := map[string]zerocopy.UDPClient{
+		"direct": direct.NewUDPClient("direct", mtu, 0, 0),
+	}
+	r, err := (&router.Config{}).Router(logger, nil, nil, nil, udpClientMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collector := stats.NewCollector(0)
+	server := &zerocopy.FakeSessionServer{Key: fakeSessionKey}
+	// With a batch size of 1, each packet is written by its own sendmmsg(2) call,
+	// in the order received, so the drop is counted before the echoed packet is sent.
+	s, err := NewUDPSessionRelay(UDPSessionRelayConfig{
+		BatchMode:     "sendmmsg",
+		ServerName:    "fake",
+		ListenAddress: "127.0.0.1:0",
+		BatchSize:     1,
+		MTU:           mtu,
+		NATTimeout:    time.Minute,
+	}, server, nil, r, collector, logger, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	relayAddrPort := s.serverConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	clientConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	if err = clientConn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	c := zerocopy.NewFakeSessionClientPackUnpacker(csid, fakeSessionKey, relayAddrPort)
+
+	// Sending to port 0 fails with EINVAL.
+	portZeroAddr := conn.AddrFromIPPort(netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), 0))
+	for _, targetAddr := range []conn.Addr{portZeroAddr, echoAddr} {
+		destAddrPort, packet, err := zerocopy.ClientPackDatagram(c, targetAddr, []byte("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = clientConn.WriteToUDPAddrPort(packet, destAddrPort); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := make([]byte, mtu)
+	if _, _, err = clientConn.ReadFromUDPAddrPort(b); err != nil {
+		t.Fatal(err)
+	}
+
+	drops := collector.PacketDrops()
+	if n := drops[stats.PacketDropSendError.String()]; n != 1 {
+		t.Errorf("Got %d packets dropped on send errors, expected 1", n)
+	}
+	if n := drops[stats.PacketDropSendBufferFull.String()]; n != 0 {
+		t.Errorf("Got %d packets dropped on full send buffers, expected 0", n)
+	}
+}
@@ -0,0 +1,169 @@
+package service
+
+import (
+	"net/netip"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+// mirrorQueuedPacket queues a copy of the packet for the session's mirror upstream.
+// The copy is dropped if the mirror's send channel is full.
+// It does nothing if mirroring is disabled.
+//
+// The copy must be made before the packet is queued to the session's send channel,
+// because the packet is packed in-place after dequeuing.
+//
+// s.mu must be held.
+func (s *UDPSessionRelay) mirrorQueuedPacket(entry *session, queuedPacket *sessionQueuedPacket) {
+	if entry.mirrorSendCh == nil {
+		return
+	}
+
+	mirrorPacket := s.getQueuedPacket()
+	mirrorPacket.start = queuedPacket.start
+	mirrorPacket.length = queuedPacket.length
+	mirrorPacket.targetAddr = queuedPacket.targetAddr
+	mirrorPacket.clientAddrPort = queuedPacket.clientAddrPort
+	copy(mirrorPacket.buf[mirrorPacket.start:mirrorPacket.start+mirrorPacket.length], queuedPacket.buf[queuedPacket.start:queuedPacket.start+queuedPacket.length])
+
+	select {
+	case entry.mirrorSendCh <- mirrorPacket:
+	default:
+		s.mirrorPacketsDropped.Add(1)
+		s.putQueuedPacket(mirrorPacket)
+	}
+}
+
+// relayServerConnToMirror creates a mirror session and sends packets from the session's mirror send channel
+// to the mirror upstream in batches, until the channel is closed. If the mirror session cannot be created,
+// queued packets are discarded. The primary session is not affected either way.
+func (s *UDPSessionRelay) relayServerConnToMirror(csid uint64, entry *session) {
+	defer func() {
+		for queuedPacket := range entry.mirrorSendCh {
+			s.putQueuedPacket(queuedPacket)
+		}
+	}()
+
+	mirrorName := s.mirror.String()
+
+	clientInfo, mirrorPacker, _, err := s.mirror.NewSession()
+	if err != nil {
+		s.logger.Warn("Failed to create mirror client session",
+			zap.String("server", s.serverName),
+			zap.String("mirror", mirrorName),
+			zap.String("listenAddress", s.listenAddress),
+			zap.Uint64("clientSessionID", csid),
+			zap.Error(err),
+		)
+		return
+	}
+
+	if clientInfo.Closer != nil {
+		defer clientInfo.Closer.Close()
+	}
+
+	mirrorConn, err := conn.ListenUDPOnInterface("udp", clientInfo.Netns, clientInfo.Interface, clientInfo.LocalPortRange, false, clientInfo.Fwmark)
+	if err != nil {
+		s.logger.Warn("Failed to create UDP socket for mirror session",
+			zap.String("server", s.serverName),
+			zap.String("mirror", mirrorName),
+			zap.String("listenAddress", s.listenAddress),
+			zap.Uint64("clientSessionID", csid),
+			zap.Error(err),
+		)
+		return
+	}
+	defer mirrorConn.Close()
+
+	batchSize := int(s.batchSize.Load())
+	w := zerocopy.NewPacketBatchWriter(mirrorConn, batchSize)
+
+	var (
+		destAddrPort       netip.AddrPort
+		packetStart        int
+		packetLength       int
+		packetsSent        uint64
+		packetsWriteFailed uint64
+		queuedPackets      = make([]*sessionQueuedPacket, 0, batchSize)
+		packets            = make([]zerocopy.Packet, 0, batchSize)
+	)
+
+	for queuedPacket := range entry.mirrorSendCh {
+		// Dequeue whatever else is queued, so that the batch is written with as few syscalls as possible.
+		queuedPackets = append(queuedPackets[:0], queuedPacket)
+	dequeue:
+		for len(queuedPackets) < batchSize {
+			select {
+			case queuedPacket, ok := <-entry.mirrorSendCh:
+				if !ok {
+					break dequeue
+				}
+				queuedPackets = append(queuedPackets, queuedPacket)
+			default:
+				break dequeue
+			}
+		}
+
+		packets = packets[:0]
+
+		for _, queuedPacket := range queuedPackets {
+			destAddrPort, packetStart, packetLength, err = mirrorPacker.PackInPlace(queuedPacket.buf, queuedPacket.targetAddr, queuedPacket.start, queuedPacket.length)
+			if err != nil {
+				if ce := s.logger.Check(zap.DebugLevel, "Failed to pack packet for mirror"); ce != nil {
+					ce.Write(
+						zap.String("server", s.serverName),
+						zap.String("mirror", mirrorName),
+						zap.Stringer("targetAddress", &queuedPacket.targetAddr),
+						zap.Uint64("clientSessionID", csid),
+						zap.Int("payloadLength", queuedPacket.length),
+						zap.Error(err),
+					)
+				}
+				continue
+			}
+
+			packets = append(packets, zerocopy.Packet{
+				Buf:  queuedPacket.buf[packetStart : packetStart+packetLength],
+				Addr: destAddrPort,
+			})
+		}
+
+		n, err := w.WriteBatch(packets)
+		if err != nil {
+			if ce := s.logger.Check(zap.DebugLevel, "Failed to write packets to mirror"); ce != nil {
+				ce.Write(
+					zap.String("server", s.serverName),
+					zap.String("mirror", mirrorName),
+					zap.Stringer("lastWriteDestAddress", destAddrPort),
+					zap.Uint64("clientSessionID", csid),
+					zap.Int("packetsWritten", n),
+					zap.Int("packetsInBatch", len(packets)),
+					zap.Error(err),
+				)
+			}
+		}
+		packetsSent += uint64(n)
+		packetsWriteFailed += uint64(len(packets) - n)
+
+		for _, queuedPacket := range queuedPackets {
+			s.putQueuedPacket(queuedPacket)
+		}
+	}
+
+	s.logger.Info("Finished relay serverConn -> mirror",
+		zap.String("server", s.serverName),
+		zap.String("mirror", mirrorName),
+		zap.String("listenAddress", s.listenAddress),
+		zap.Stringer("lastWriteDestAddress", destAddrPort),
+		zap.Uint64("clientSessionID", csid),
+		zap.Uint64("packetsSent", packetsSent),
+		zap.Uint64("packetsWriteFailed", packetsWriteFailed),
+	)
+}
+
+// MirrorPacketsDropped returns the number of packet copies dropped because a session's mirror fell behind.
+func (s *UDPSessionRelay) MirrorPacketsDropped() uint64 {
+	return s.mirrorPacketsDropped.Load()
+}
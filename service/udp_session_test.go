@@ -0,0 +1,1777 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/direct"
+	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/ss2022"
+	"github.com/database64128/shadowsocks-go/stats"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+const benchmarkDownlinkBufSize = 1452
+
+func BenchmarkDownlinkPacketBufPooled(b *testing.B) {
+	var s UDPSessionRelay
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		bufp := s.getDownlinkPacketBuf(benchmarkDownlinkBufSize)
+		s.downlinkBufPool.Put(bufp)
+	}
+}
+
+func BenchmarkDownlinkPacketBufUnpooled(b *testing.B) {
+	var s UDPSessionRelay
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = s.getDownlinkPacketBuf(benchmarkDownlinkBufSize)
+	}
+}
+
+func TestUDPSessionRelayRecordUnpackFailure(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+
+	natConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer natConn.Close()
+
+	s := UDPSessionRelay{
+		serverConn:             serverConn,
+		logger:                 zap.NewNop(),
+		unpackFailureThreshold: 3,
+		natConnBackoff:         make(natConnBackoff),
+	}
+
+	const csid = 42
+	var entry session
+	entry.state.Store(natConn)
+	clientAddrPort := netip.MustParseAddrPort("127.0.0.1:1080")
+
+	authErr := fmt.Errorf("%w: bad tag", zerocopy.ErrPacketAuthenticationFailed)
+	replayErr := fmt.Errorf("%w: replayed packet", ss2022.ErrReplay)
+
+	for i := 0; i < s.unpackFailureThreshold-1; i++ {
+		s.recordUnpackFailure(csid, &entry, clientAddrPort, authErr)
+	}
+
+	// Replay window rejections do not count.
+	for i := 0; i < s.unpackFailureThreshold; i++ {
+		s.recordUnpackFailure(csid, &entry, clientAddrPort, replayErr)
+	}
+	if s.natConnBackoff.active(csid, time.Now()) {
+		t.Fatal("Expected session not to be blocked below the threshold")
+	}
+	if entry.state.Load() != natConn {
+		t.Fatal("Expected session not to be torn down below the threshold")
+	}
+
+	s.recordUnpackFailure(csid, &entry, clientAddrPort, authErr)
+	if !s.natConnBackoff.active(csid, time.Now()) {
+		t.Error("Expected session to be blocked after reaching the threshold")
+	}
+	if entry.state.Load() != serverConn {
+		t.Error("Expected session shutdown to be signaled after reaching the threshold")
+	}
+
+	// The read deadline is set to now, so reads fail immediately.
+	if _, _, err = natConn.ReadFromUDPAddrPort(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected natConn read to time out, got %v", err)
+	}
+}
+
+func TestUDPSessionRelayExpireSession(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+
+	natConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer natConn.Close()
+
+	s := UDPSessionRelay{
+		serverConn: serverConn,
+		logger:     zap.NewNop(),
+	}
+
+	const csid = 42
+	var entry session
+	entry.state.Store(natConn)
+
+	timer := time.AfterFunc(10*time.Millisecond, func() {
+		s.expireSession(csid, &entry, 10*time.Millisecond)
+	})
+	defer timer.Stop()
+
+	// The read deadline is set when the session expires, so the read fails once the timer fires.
+	if err = natConn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = natConn.ReadFromUDPAddrPort(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected natConn read to time out, got %v", err)
+	}
+	if entry.state.Load() != serverConn {
+		t.Error("Expected session shutdown to be signaled after reaching the maximum lifetime")
+	}
+
+	// Expiring an already shut down session is a no-op.
+	s.expireSession(csid, &entry, 10*time.Millisecond)
+	if entry.state.Load() != serverConn {
+		t.Error("Expected session to remain shut down")
+	}
+}
+
+func TestUDPSessionRelaySweepStaleSessions(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+
+	natConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer natConn.Close()
+
+	now := time.Now()
+	s := UDPSessionRelay{
+		serverConn: serverConn,
+		natTimeout: time.Minute,
+		logger:     zap.NewNop(),
+		table: map[uint64]*session{
+			1: {createdAt: now.Add(-2 * time.Minute)},
+			2: {createdAt: now.Add(-time.Second)},
+			3: {createdAt: now.Add(-2 * time.Minute)},
+		},
+	}
+	stale := s.table[1]
+	s.table[3].state.Store(natConn)
+
+	s.sweepStaleSessions(now)
+
+	if _, ok := s.table[1]; ok {
+		t.Error("Expected stale session without natConn to be removed")
+	}
+	if stale.state.Load() != serverConn {
+		t.Error("Expected stale session shutdown to be signaled")
+	}
+	if _, ok := s.table[2]; !ok {
+		t.Error("Expected recently created session without natConn to be kept")
+	}
+	if _, ok := s.table[3]; !ok {
+		t.Error("Expected old session with natConn to be kept")
+	}
+	if swept := s.SweptSessions(); swept != 1 {
+		t.Errorf("SweptSessions() returned %d, expected 1", swept)
+	}
+}
+
+func TestUDPSessionRelayStartStopWithSweeper(t *testing.T) {
+	logger := zap.NewNop()
+	r, err := (&router.Config{}).Router(logger, nil, nil, nil, map[string]zerocopy.UDPClient{
+		"direct": direct.NewUDPClient("direct", 1500, 0, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 8; i++ {
+		s, err := NewUDPSessionRelay(UDPSessionRelayConfig{
+			ServerName:    "fake",
+			ListenAddress: "127.0.0.1:0",
+			BatchSize:     8,
+			MTU:           1500,
+			NATTimeout:    time.Minute,
+			SweepInterval: time.Millisecond,
+		}, &zerocopy.FakeSessionServer{}, nil, r, nil, logger, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Duration(i) * time.Millisecond)
+
+		stopped := make(chan error, 1)
+		go func() {
+			stopped <- s.Stop()
+		}()
+		select {
+		case err = <-stopped:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Stop() did not return")
+		}
+	}
+}
+
+func TestUDPSessionRelayQueuedBytesLimit(t *testing.T) {
+	var entry session
+
+	s := UDPSessionRelay{}
+	if !s.reserveQueuedBytes(&entry, 1<<20) {
+		t.Error("Expected reservation to succeed without a limit")
+	}
+	s.releaseQueuedBytes(&entry, 1<<20)
+	if n := entry.natConnSendChBytes.Load(); n != 0 {
+		t.Errorf("Queued bytes is %d without a limit, expected 0", n)
+	}
+
+	s.maxQueuedBytes = 3000
+	for i := 0; i < 2; i++ {
+		if !s.reserveQueuedBytes(&entry, 1400) {
+			t.Fatalf("Expected reservation %d to succeed below the limit", i)
+		}
+	}
+	if s.reserveQueuedBytes(&entry, 1400) {
+		t.Error("Expected reservation to fail over the limit")
+	}
+	if n := entry.natConnSendChBytes.Load(); n != 2800 {
+		t.Errorf("Queued bytes is %d after failed reservation, expected 2800", n)
+	}
+	if !s.reserveQueuedBytes(&entry, 200) {
+		t.Error("Expected reservation up to the limit to succeed")
+	}
+
+	s.releaseQueuedBytes(&entry, 1400)
+	if !s.reserveQueuedBytes(&entry, 1400) {
+		t.Error("Expected reservation to succeed after release")
+	}
+}
+
+func TestUDPSessionRelayAdaptiveNatConnRecvBuf(t *testing.T) {
+	entry := &session{natConnRecvBufSize: 1452}
+
+	s := UDPSessionRelay{}
+	if size := s.initialNatConnRecvBufSize(entry); size != 1452 {
+		t.Errorf("Non-adaptive initial size is %d, expected %d", size, 1452)
+	}
+
+	s.adaptiveRecvBuf = true
+	size := s.initialNatConnRecvBufSize(entry)
+	if size != adaptiveRecvBufInitialSize {
+		t.Errorf("Adaptive initial size is %d, expected %d", size, adaptiveRecvBufInitialSize)
+	}
+
+	if canGrowNatConnRecvBuf(errors.New("other error"), size, entry) {
+		t.Error("canGrowNatConnRecvBuf() returned true for non-truncation error")
+	}
+
+	var sizes []int
+	for canGrowNatConnRecvBuf(conn.ErrMessageTruncated, size, entry) {
+		size = nextNatConnRecvBufSize(size, entry)
+		sizes = append(sizes, size)
+	}
+	if expected := []int{1024, 1452}; len(sizes) != len(expected) || sizes[0] != expected[0] || sizes[1] != expected[1] {
+		t.Errorf("Grew through sizes %v, expected %v", sizes, expected)
+	}
+}
+
+func TestUDPSessionRelayBufferLayout(t *testing.T) {
+	const mtu = 1500
+	server := &zerocopy.FakeSessionServer{}
+	maxClientHeadroom := zerocopy.FixedHeadroom{
+		Front: server.FrontHeadroom() + 64,
+		Rear:  server.RearHeadroom() + 16,
+	}
+
+	s, err := NewUDPSessionRelay(UDPSessionRelayConfig{
+		ServerName:        "fake",
+		ListenAddress:     "127.0.0.1:0",
+		BatchSize:         8,
+		MTU:               mtu,
+		MaxClientHeadroom: maxClientHeadroom,
+		NATTimeout:        time.Minute,
+	}, server, nil, nil, nil, zap.NewNop(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	front, recv, rear := s.BufferLayout()
+	if front != 64 || rear != 16 {
+		t.Errorf("BufferLayout() returned headroom %d, %d, expected 64, 16", front, rear)
+	}
+	if expected := mtu - zerocopy.IPv4HeaderLength - zerocopy.UDPHeaderLength; recv != expected {
+		t.Errorf("BufferLayout() returned recv size %d, expected %d", recv, expected)
+	}
+
+	queuedPacket := s.getQueuedPacket()
+	defer s.putQueuedPacket(queuedPacket)
+	if size := len(queuedPacket.buf); size != front+recv+rear {
+		t.Errorf("Packet buffer size is %d, expected %d", size, front+recv+rear)
+	}
+}
+
+func TestUDPSessionRelayFakeServer(t *testing.T) {
+	for _, batchMode := range []string{"no", "sendmmsg"} {
+		t.Run(batchMode, func(t *testing.T) {
+			testUDPSessionRelayFakeServer(t, batchMode)
+		})
+	}
+}
+
+func testUDPSessionRelayFakeServer(t *testing.T, batchMode string) {
+	const (
+		csid = 42
+		key  = 0x5a
+		mtu  = 1500
+	)
+
+	echoConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoConn.Close()
+	echoAddrPort := echoConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	go func() {
+		b := make([]byte, mtu)
+		for {
+			n, addrPort, err := echoConn.ReadFromUDPAddrPort(b)
+			if err != nil {
+				return
+			}
+			if _, err = echoConn.WriteToUDPAddrPort(b[:n], addrPort); err != nil {
+				return
+			}
+		}
+	}()
+
+	core, logs := observer.New(zap.DebugLevel)
+	logger := zap.New(core)
+	udpClientMap := map[string]zerocopy.UDPClient{
+		"direct": direct.NewUDPClient("direct", mtu, 0, 0),
+	}
+	r, err := (&router.Config{}).Router(logger, nil, nil, nil, udpClientMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &zerocopy.FakeSessionServer{Key: key}
+	s, err := NewUDPSessionRelay(UDPSessionRelayConfig{
+		BatchMode:          batchMode,
+		ServerName:         "fake",
+		ListenAddress:      "127.0.0.1:0",
+		BatchSize:          8,
+		MTU:                mtu,
+		NATTimeout:         time.Minute,
+		ValidateNATSource:  true,
+		LogSessionUpstream: true,
+	}, server, nil, r, nil, logger, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	relayAddrPort := s.serverConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	clientConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	if err = clientConn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	c := zerocopy.NewFakeSessionClientPackUnpacker(csid, key, relayAddrPort)
+	payload := []byte("fake session payload")
+	b := make([]byte, mtu)
+
+	for i := 0; i < 3; i++ {
+		// Resize batches mid-session.
+		if i == 1 {
+			if err = s.SetBatchSize(1); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		destAddrPort, packet, err := zerocopy.ClientPackDatagram(c, conn.AddrFromIPPort(echoAddrPort), payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = clientConn.WriteToUDPAddrPort(packet, destAddrPort); err != nil {
+			t.Fatal(err)
+		}
+
+		n, packetSourceAddrPort, err := clientConn.ReadFromUDPAddrPort(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payloadSourceAddrPort, p, err := zerocopy.ClientUnpackDatagram(c, packetSourceAddrPort, b[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if payloadSourceAddrPort != echoAddrPort {
+			t.Errorf("Payload source address is %s, expected %s", payloadSourceAddrPort, echoAddrPort)
+		}
+		if !bytes.Equal(p, payload) {
+			t.Errorf("Payload is %q, expected %q", p, payload)
+		}
+	}
+
+	sessions := s.Snapshot()
+	if len(sessions) != 1 {
+		t.Fatalf("Relay has %d sessions, expected 1", len(sessions))
+	}
+	if sessions[0].ClientSessionID != csid {
+		t.Errorf("Session ID is %d, expected %d", sessions[0].ClientSessionID, csid)
+	}
+	if sessions[0].Client != "direct" {
+		t.Errorf("Session client is %q, expected %q", sessions[0].Client, "direct")
+	}
+
+	if err = s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if sessions = s.Snapshot(); len(sessions) != 0 {
+		t.Errorf("Relay has %d sessions after stopping, expected 0", len(sessions))
+	}
+
+	// Field keys of session logs are part of the log schema, and must not change.
+	for _, c := range []struct {
+		message string
+		keys    []string
+	}{
+		{"New UDP session", []string{"server", "listenAddress", "clientAddress", "targetAddress", "clientSessionID"}},
+		{"UDP session upstream selected", []string{"server", "client", "listenAddress", "clientAddress", "natConnLocalAddress", "upstreamAddress", "clientSessionID"}},
+		{"Finished receiving from serverConn", []string{"server", "listenAddress", "packetsReceived", "payloadBytesReceived"}},
+	} {
+		entries := logs.FilterMessage(c.message).All()
+		if len(entries) == 0 {
+			t.Errorf("No %q log entry", c.message)
+			continue
+		}
+		fields := entries[0].ContextMap()
+		for _, key := range c.keys {
+			if _, ok := fields[key]; !ok {
+				t.Errorf("%q log entry has no %q field: %v", c.message, key, fields)
+			}
+		}
+	}
+}
+
+func TestUDPSessionRelayICMPPortUnreachable(t *testing.T) {
+	if !conn.RecvErrSupported {
+		t.Skip("Receiving ICMP errors is not supported on this platform")
+	}
+
+	for _, batchMode := range []string{"no", "sendmmsg"} {
+		t.Run(batchMode, func(t *testing.T) {
+			testUDPSessionRelayICMPPortUnreachable(t, batchMode)
+		})
+	}
+}
+
+func testUDPSessionRelayICMPPortUnreachable(t *testing.T, batchMode string) {
+	const (
+		csid = 42
+		key  = 0x5a
+		mtu  = 1500
+	)
+
+	// Grab a free port and close it, so packets sent to it trigger ICMP port unreachable.
+	closedConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddrPort := closedConn.LocalAddr().(*net.UDPAddr).AddrPort()
+	closedConn.Close()
+
+	logger := zap.NewNop()
+	udpClientMap := map[string]zerocopy.UDPClient{
+		"direct": direct.NewUDPClient("direct", mtu, 0, 0),
+	}
+	r, err := (&router.Config{}).Router(logger, nil, nil, nil, udpClientMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &zerocopy.FakeSessionServer{Key: key}
+	s, err := NewUDPSessionRelay(UDPSessionRelayConfig{
+		BatchMode:      batchMode,
+		ServerName:     "fake",
+		ListenAddress:  "127.0.0.1:0",
+		BatchSize:      8,
+		MTU:            mtu,
+		NATTimeout:     time.Minute,
+		RecvICMPErrors: true,
+	}, server, nil, r, nil, logger, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	relayAddrPort := s.serverConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	clientConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	c := zerocopy.NewFakeSessionClientPackUnpacker(csid, key, relayAddrPort)
+	destAddrPort, packet, err := zerocopy.ClientPackDatagram(c, conn.AddrFromIPPort(closedAddrPort), []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = clientConn.WriteToUDPAddrPort(packet, destAddrPort); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if s.ICMPErrors()["port_unreachable"] > 0 && len(s.Snapshot()) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for session teardown, ICMP errors: %v, sessions: %d", s.ICMPErrors(), len(s.Snapshot()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUDPSessionRelayRecvTimestamps(t *testing.T) {
+	if !conn.RecvTimestampSupported {
+		t.Skip("Receive timestamps are not supported on this platform")
+	}
+
+	for _, batchMode := range []string{"no", "sendmmsg"} {
+		t.Run(batchMode, func(t *testing.T) {
+			testUDPSessionRelayRecvTimestamps(t, batchMode)
+		})
+	}
+}
+
+func testUDPSessionRelayRecvTimestamps(t *testing.T, batchMode string) {
+	const (
+		csid    = 42
+		key     = 0x5a
+		mtu     = 1500
+		packets = 3
+	)
+
+	echoConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoConn.Close()
+	echoAddrPort := echoConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	logger := zap.NewNop()
+	udpClientMap := map[string]zerocopy.UDPClient{
+		"direct": direct.NewUDPClient("direct", mtu, 0, 0),
+	}
+	r, err := (&router.Config{}).Router(logger, nil, nil, nil, udpClientMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collector := stats.NewCollector(0)
+	server := &zerocopy.FakeSessionServer{Key: key}
+	s, err := NewUDPSessionRelay(UDPSessionRelayConfig{
+		BatchMode:      batchMode,
+		ServerName:     "fake",
+		ListenAddress:  "127.0.0.1:0",
+		BatchSize:      8,
+		MTU:            mtu,
+		NATTimeout:     time.Minute,
+		RecvTimestamps: true,
+	}, server, nil, r, collector, logger, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	relayAddrPort := s.serverConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	clientConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	if err = echoConn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	c := zerocopy.NewFakeSessionClientPackUnpacker(csid, key, relayAddrPort)
+	b := make([]byte, mtu)
+
+	for i := 0; i < packets; i++ {
+		destAddrPort, packet, err := zerocopy.ClientPackDatagram(c, conn.AddrFromIPPort(echoAddrPort), []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = clientConn.WriteToUDPAddrPort(packet, destAddrPort); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err = echoConn.ReadFromUDPAddrPort(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The delay is observed after the write returns, which may be after the upstream has read the packet.
+	deadline := time.Now().Add(5 * time.Second)
+	h := collector.RelayDelay()
+	for h.Count < packets && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		h = collector.RelayDelay()
+	}
+	if h.Count != packets {
+		t.Errorf("Expected %d relay delay observations, got %d", packets, h.Count)
+	}
+	if h.Sum > packets*5*time.Second {
+		t.Errorf("Relay delay sum %s is implausibly large", h.Sum)
+	}
+	if expected := 10 * time.Microsecond; h.Buckets[0].UpperBound != expected {
+		t.Errorf("Expected first bucket upper bound %s, got %s", expected, h.Buckets[0].UpperBound)
+	}
+}
+
+func TestUDPSessionRelaySessionIDCollision(t *testing.T) {
+	const (
+		csid = 7
+		mtu  = 1500
+	)
+
+	echoConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoConn.Close()
+	echoAddrPort := echoConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	logger := zap.NewNop()
+	udpClientMap := map[string]zerocopy.UDPClient{
+		"direct": direct.NewUDPClient("direct", mtu, 0, 0),
+	}
+	r, err := (&router.Config{}).Router(logger, nil, nil, nil, udpClientMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Map every client session ID to the same session.
+	server := &zerocopy.FakeSessionServer{
+		SessionID: func(uint64) uint64 { return csid },
+	}
+	s, err := NewUDPSessionRelay(UDPSessionRelayConfig{
+		BatchMode:     "no",
+		ServerName:    "fake",
+		ListenAddress: "127.0.0.1:0",
+		BatchSize:     8,
+		MTU:           mtu,
+		NATTimeout:    time.Minute,
+	}, server, nil, r, nil, logger, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	relayAddrPort := s.serverConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	if err = echoConn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, mtu)
+
+	for wireID := uint64(1); wireID <= 2; wireID++ {
+		clientConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer clientConn.Close()
+
+		c := zerocopy.NewFakeSessionClientPackUnpacker(wireID, 0, relayAddrPort)
+		destAddrPort, packet, err := zerocopy.ClientPackDatagram(c, conn.AddrFromIPPort(echoAddrPort), []byte("collide"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = clientConn.WriteToUDPAddrPort(packet, destAddrPort); err != nil {
+			t.Fatal(err)
+		}
+
+		// Both clients' packets are relayed by the same session.
+		if _, _, err = echoConn.ReadFromUDPAddrPort(b); err != nil {
+			t.Fatal(err)
+		}
+
+		sessions := s.Snapshot()
+		if len(sessions) != 1 {
+			t.Fatalf("Relay has %d sessions after client %d, expected 1", len(sessions), wireID)
+		}
+		if sessions[0].ClientSessionID != csid {
+			t.Errorf("Session ID is %d, expected %d", sessions[0].ClientSessionID, csid)
+		}
+	}
+}
+
+func TestUDPSessionRelayMirror(t *testing.T) {
+	for _, batchMode := range []string{"no", "sendmmsg"} {
+		t.Run(batchMode, func(t *testing.T) {
+			testUDPSessionRelayMirror(t, batchMode)
+		})
+	}
+}
+
+func testUDPSessionRelayMirror(t *testing.T, batchMode string) {
+	const (
+		csid = 9
+		mtu  = 1500
+	)
+
+	targetConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer targetConn.Close()
+	targetAddrPort := targetConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	mirrorConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mirrorConn.Close()
+	mirrorAddrPort := mirrorConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	logger := zap.NewNop()
+	udpClientMap := map[string]zerocopy.UDPClient{
+		"direct": direct.NewUDPClient("direct", mtu, 0, 0),
+	}
+	r, err := (&router.Config{}).Router(logger, nil, nil, nil, udpClientMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mirror := direct.NewShadowsocksNoneUDPClient(mirrorAddrPort, "mirror", mtu, 0)
+	server := &zerocopy.FakeSessionServer{}
+	s, err := NewUDPSessionRelay(UDPSessionRelayConfig{
+		BatchMode:         batchMode,
+		ServerName:        "fake",
+		ListenAddress:     "127.0.0.1:0",
+		BatchSize:         8,
+		MTU:               mtu,
+		MaxClientHeadroom: zerocopy.MaxHeadroom(zerocopy.ZeroHeadroom{}, mirror),
+		NATTimeout:        time.Minute,
+	}, server, mirror, r, nil, logger, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	relayAddrPort := s.serverConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	clientConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	if err = targetConn.SetReadDeadline(deadline); err != nil {
+		t.Fatal(err)
+	}
+	if err = mirrorConn.SetReadDeadline(deadline); err != nil {
+		t.Fatal(err)
+	}
+
+	c := zerocopy.NewFakeSessionClientPackUnpacker(csid, 0, relayAddrPort)
+	b := make([]byte, mtu)
+
+	for i := 0; i < 3; i++ {
+		payload := []byte{'m', 'i', 'r', 'r', 'o', 'r', byte('0' + i)}
+
+		destAddrPort, packet, err := zerocopy.ClientPackDatagram(c, conn.AddrFromIPPort(targetAddrPort), payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = clientConn.WriteToUDPAddrPort(packet, destAddrPort); err != nil {
+			t.Fatal(err)
+		}
+
+		// The primary upstream receives the payload as is.
+		n, _, err := targetConn.ReadFromUDPAddrPort(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b[:n], payload) {
+			t.Errorf("Target received %q, expected %q", b[:n], payload)
+		}
+
+		// The mirror receives the payload packed by the mirror client, after the target address.
+		n, _, err = mirrorConn.ReadFromUDPAddrPort(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasSuffix(b[:n], payload) {
+			t.Errorf("Mirror received %q, expected a packet ending with %q", b[:n], payload)
+		}
+	}
+
+	// A burst larger than the batch size is mirrored in full and in order.
+	const burst = 20
+	for i := 0; i < burst; i++ {
+		destAddrPort, packet, err := zerocopy.ClientPackDatagram(c, conn.AddrFromIPPort(targetAddrPort), []byte{'b', byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = clientConn.WriteToUDPAddrPort(packet, destAddrPort); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < burst; i++ {
+		n, _, err := mirrorConn.ReadFromUDPAddrPort(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if payload := []byte{'b', byte(i)}; !bytes.HasSuffix(b[:n], payload) {
+			t.Errorf("Mirror received %q, expected a packet ending with %q", b[:n], payload)
+		}
+	}
+
+	if dropped := s.MirrorPacketsDropped(); dropped != 0 {
+		t.Errorf("MirrorPacketsDropped() = %d, expected 0", dropped)
+	}
+}
+
+// fakeSessionKey is the key of the fake session server started by startEchoSessionRelay.
+const fakeSessionKey = 0x5a
+
+// startEchoSessionRelay starts a fake session relay that logs at info level to nowhere,
+// with a direct route to a UDP echo server. It returns the relay, the relay's address,
+// a client socket and the echo server's address.
+func startEchoSessionRelay(tb testing.TB, batchMode string, mtu int) (s *UDPSessionRelay, relayAddrPort netip.AddrPort, clientConn *net.UDPConn, echoAddr conn.Addr) {
+	echoConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { echoConn.Close() })
+	echoAddr = conn.AddrFromIPPort(echoConn.LocalAddr().(*net.UDPAddr).AddrPort())
+
+	go func() {
+		b := make([]byte, mtu)
+		for {
+			n, addrPort, err := echoConn.ReadFromUDPAddrPort(b)
+			if err != nil {
+				return
+			}
+			if _, err = echoConn.WriteToUDPAddrPort(b[:n], addrPort); err != nil {
+				return
+			}
+		}
+	}()
+
+	logger := zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(io.Discard), zap.InfoLevel))
+	udpClientMap := map[string]zerocopy.UDPClient{
+		"direct": direct.NewUDPClient("direct", mtu, 0, 0),
+	}
+	r, err := (&router.Config{}).Router(logger, nil, nil, nil, udpClientMap)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	server := &zerocopy.FakeSessionServer{Key: fakeSessionKey}
+	s, err = NewUDPSessionRelay(UDPSessionRelayConfig{
+		BatchMode:     batchMode,
+		ServerName:    "fake",
+		ListenAddress: "127.0.0.1:0",
+		BatchSize:     8,
+		MTU:           mtu,
+		NATTimeout:    time.Minute,
+	}, server, nil, r, nil, logger, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { s.Stop() })
+	relayAddrPort = s.serverConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	clientConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { clientConn.Close() })
+
+	if err = clientConn.SetReadDeadline(time.Now().Add(time.Minute)); err != nil {
+		tb.Fatal(err)
+	}
+
+	return s, relayAddrPort, clientConn, echoAddr
+}
+
+// startSteadyStateSessionRelay starts a relay with startEchoSessionRelay, and returns
+// a function that makes a round trip of a packet through an established session.
+// Debug log arguments must not be constructed on the relay's success path, so a round trip does not allocate.
+func startSteadyStateSessionRelay(tb testing.TB, batchMode string) (roundTrip func()) {
+	const (
+		csid = 42
+		mtu  = 1500
+	)
+
+	_, relayAddrPort, clientConn, echoAddr := startEchoSessionRelay(tb, batchMode, mtu)
+
+	c := zerocopy.NewFakeSessionClientPackUnpacker(csid, fakeSessionKey, relayAddrPort)
+	destAddrPort, packet, err := zerocopy.ClientPackDatagram(c, echoAddr, []byte("fake session payload"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	buf := make([]byte, mtu)
+
+	roundTrip = func() {
+		if _, err := clientConn.WriteToUDPAddrPort(packet, destAddrPort); err != nil {
+			tb.Fatal(err)
+		}
+		if _, _, err := clientConn.ReadFromUDPAddrPort(buf); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	// Set up the session and warm up the pools.
+	for i := 0; i < 64; i++ {
+		roundTrip()
+	}
+
+	return roundTrip
+}
+
+func TestUDPSessionRelaySteadyStateAllocs(t *testing.T) {
+	for _, batchMode := range []string{"no", "sendmmsg"} {
+		roundTrip := startSteadyStateSessionRelay(t, batchMode)
+		if allocs := testing.AllocsPerRun(1000, roundTrip); allocs != 0 {
+			t.Errorf("Round trip in batch mode %s allocated %f times, expected 0", batchMode, allocs)
+		}
+	}
+}
+
+func BenchmarkUDPSessionRelaySteadyState(b *testing.B) {
+	for _, batchMode := range []string{"no", "sendmmsg"} {
+		b.Run(batchMode, func(b *testing.B) {
+			roundTrip := startSteadyStateSessionRelay(b, batchMode)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				roundTrip()
+			}
+		})
+	}
+}
+
+// BenchmarkUDPSessionRelayChurn measures the cost of short-lived sessions:
+// each iteration sets up a new session with a round trip and tears it down.
+func BenchmarkUDPSessionRelayChurn(b *testing.B) {
+	const mtu = 1500
+
+	for _, batchMode := range []string{"no", "sendmmsg"} {
+		b.Run(batchMode, func(b *testing.B) {
+			s, relayAddrPort, clientConn, echoAddr := startEchoSessionRelay(b, batchMode, mtu)
+			payload := []byte("fake session payload")
+			buf := make([]byte, mtu)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				csid := uint64(i + 1)
+				c := zerocopy.NewFakeSessionClientPackUnpacker(csid, fakeSessionKey, relayAddrPort)
+				destAddrPort, packet, err := zerocopy.ClientPackDatagram(c, echoAddr, payload)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err = clientConn.WriteToUDPAddrPort(packet, destAddrPort); err != nil {
+					b.Fatal(err)
+				}
+				if _, _, err = clientConn.ReadFromUDPAddrPort(buf); err != nil {
+					b.Fatal(err)
+				}
+				if !s.CloseSession(csid) {
+					b.Fatalf("Session %d not found", csid)
+				}
+			}
+		})
+	}
+}
+
+func TestUDPSessionRelaySetupSlots(t *testing.T) {
+	var unlimited UDPSessionRelay
+	for i := 0; i < 3; i++ {
+		if !unlimited.acquireSetupSlot() {
+			t.Fatal("acquireSetupSlot() failed without a limit")
+		}
+	}
+
+	s := UDPSessionRelay{setupSem: make(chan struct{}, 2)}
+	for i := 0; i < 2; i++ {
+		if !s.acquireSetupSlot() {
+			t.Fatalf("acquireSetupSlot() #%d failed below the limit", i)
+		}
+	}
+
+	// The next setup waits until a slot is released.
+	const releaseDelay = 20 * time.Millisecond
+	time.AfterFunc(releaseDelay, s.releaseSetupSlot)
+	start := time.Now()
+	if !s.acquireSetupSlot() {
+		t.Fatal("acquireSetupSlot() failed after a slot was released")
+	}
+	if elapsed := time.Since(start); elapsed < releaseDelay {
+		t.Errorf("acquireSetupSlot() returned after %s, expected to wait at least %s", elapsed, releaseDelay)
+	}
+	if n := len(s.setupSem); n != 2 {
+		t.Errorf("%d slots held, expected 2", n)
+	}
+}
+
+// countingTap counts packets received from clients.
+type countingTap struct {
+	serverRecv atomic.Uint64
+}
+
+func (t *countingTap) OnServerRecv(csid uint64, payload []byte, clientAddrPort netip.AddrPort, targetAddr conn.Addr) {
+	t.serverRecv.Add(1)
+}
+
+func (t *countingTap) OnNatSend(csid uint64, packet []byte, destAddrPort netip.AddrPort, targetAddr conn.Addr) {
+}
+
+func (t *countingTap) OnNatRecv(csid uint64, payload []byte, payloadSourceAddrPort netip.AddrPort) {}
+
+func (t *countingTap) OnServerSend(csid uint64, packet []byte, payloadSourceAddrPort netip.AddrPort) {
+}
+
+func TestUDPSessionRelayStopDrainsSendChannel(t *testing.T) {
+	for _, c := range []struct {
+		batchMode   string
+		batchLinger time.Duration
+	}{
+		{"no", 0},
+		{"sendmmsg", 0},
+		{"sendmmsg", 50 * time.Millisecond},
+	} {
+		t.Run(fmt.Sprintf("%s/linger=%s", c.batchMode, c.batchLinger), func(t *testing.T) {
+			testUDPSessionRelayStopDrainsSendChannel(t, c.batchMode, c.batchLinger)
+		})
+	}
+}
+
+func testUDPSessionRelayStopDrainsSendChannel(t *testing.T, batchMode string, batchLinger time.Duration) {
+	const (
+		csid        = 42
+		key         = 0x5a
+		mtu         = 1500
+		payloadLen  = 1000
+		packetCount = 100
+
+		// The shaper lets a burst of minShaperBurst bytes through, then paces the rest,
+		// so packets are still queued in the send channel when the relay is stopped.
+		bandwidthLimit = minShaperBurst
+	)
+
+	sinkConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sinkConn.Close()
+	sinkAddrPort := sinkConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	sinkDone := make(chan uint64, 1)
+
+	go func() {
+		var n uint64
+		b := make([]byte, mtu)
+		for {
+			if _, _, err := sinkConn.ReadFromUDPAddrPort(b); err != nil {
+				break
+			}
+			n++
+		}
+		sinkDone <- n
+	}()
+
+	logger := zap.NewNop()
+	tcpClientMap := map[string]zerocopy.TCPClient{
+		"direct": direct.NewTCPClient("direct", false, 0, 0),
+	}
+	udpClientMap := map[string]zerocopy.UDPClient{
+		"direct": direct.NewUDPClient("direct", mtu, 0, 0),
+	}
+	r, err := (&router.Config{
+		Users: []router.UserPolicyConfig{
+			{Username: "alice", UDPBandwidthLimit: bandwidthLimit},
+		},
+	}).Router(logger, nil, nil, tcpClientMap, udpClientMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tap countingTap
+	server := &zerocopy.FakeSessionServer{Key: key, Username: "alice"}
+	s, err := NewUDPSessionRelay(UDPSessionRelayConfig{
+		BatchMode:     batchMode,
+		ServerName:    "fake",
+		ListenAddress: "127.0.0.1:0",
+		BatchSize:     8,
+		MTU:           mtu,
+		BatchLinger:   batchLinger,
+		NATTimeout:    time.Minute,
+	}, server, nil, r, nil, logger, &tap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	relayAddrPort := s.serverConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	clientConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	c := zerocopy.NewFakeSessionClientPackUnpacker(csid, key, relayAddrPort)
+	payload := make([]byte, payloadLen)
+
+	for i := 0; i < packetCount; i++ {
+		destAddrPort, packet, err := zerocopy.ClientPackDatagram(c, conn.AddrFromIPPort(sinkAddrPort), payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = clientConn.WriteToUDPAddrPort(packet, destAddrPort); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Wait for the relay to receive the packets, so they are queued before stopping.
+	// Some packets may be dropped by the kernel, so wait until the count settles.
+	for last, deadline := uint64(0), time.Now().Add(2*time.Second); time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+		n := tap.serverRecv.Load()
+		if n == packetCount || n > 0 && n == last {
+			break
+		}
+		last = n
+	}
+
+	if err = s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	received := tap.serverRecv.Load()
+
+	// Stop must not return before every queued packet has been written.
+	// Give the sink a moment to read what is still in its receive buffer.
+	if err = sinkConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	if received <= bandwidthLimit/payloadLen {
+		t.Fatalf("Relay received %d packets, expected more than the shaper burst of %d", received, bandwidthLimit/payloadLen)
+	}
+	if sent := <-sinkDone; sent != received {
+		t.Errorf("Sink received %d packets, expected all %d packets received by the relay", sent, received)
+	}
+}
+
+// gatedUnpackServer wraps a fake session server, and blocks unpacking when its gate is armed.
+type gatedUnpackServer struct {
+	*zerocopy.FakeSessionServer
+	armed   atomic.Bool
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *gatedUnpackServer) NewUnpacker(b []byte, csid uint64) (zerocopy.ServerUnpacker, error) {
+	u, err := s.FakeSessionServer.NewUnpacker(b, csid)
+	if err != nil {
+		return nil, err
+	}
+	return &gatedUnpacker{u, s}, nil
+}
+
+type gatedUnpacker struct {
+	zerocopy.ServerUnpacker
+	server *gatedUnpackServer
+}
+
+func (u *gatedUnpacker) UnpackInPlace(b []byte, sourceAddrPort netip.AddrPort, packetStart, packetLen int) (targetAddr conn.Addr, payloadStart, payloadLen int, err error) {
+	if u.server.armed.Load() {
+		u.server.entered <- struct{}{}
+		<-u.server.release
+	}
+	return u.ServerUnpacker.UnpackInPlace(b, sourceAddrPort, packetStart, packetLen)
+}
+
+func TestUDPSessionRelayUnpackWithoutTableLock(t *testing.T) {
+	const (
+		csid = 42
+		key  = 0x5a
+		mtu  = 1500
+	)
+
+	sinkConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sinkConn.Close()
+	sinkAddrPort := sinkConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	logger := zap.NewNop()
+	udpClientMap := map[string]zerocopy.UDPClient{
+		"direct": direct.NewUDPClient("direct", mtu, 0, 0),
+	}
+	r, err := (&router.Config{}).Router(logger, nil, nil, nil, udpClientMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &gatedUnpackServer{
+		FakeSessionServer: &zerocopy.FakeSessionServer{Key: key},
+		entered:           make(chan struct{}),
+		release:           make(chan struct{}),
+	}
+	s, err := NewUDPSessionRelay(UDPSessionRelayConfig{
+		ServerName:    "fake",
+		ListenAddress: "127.0.0.1:0",
+		BatchSize:     8,
+		MTU:           mtu,
+		NATTimeout:    time.Minute,
+	}, server, nil, r, nil, logger, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	relayAddrPort := s.serverConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	clientConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	c := zerocopy.NewFakeSessionClientPackUnpacker(csid, key, relayAddrPort)
+	sendPacket := func() {
+		destAddrPort, packet, err := zerocopy.ClientPackDatagram(c, conn.AddrFromIPPort(sinkAddrPort), []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = clientConn.WriteToUDPAddrPort(packet, destAddrPort); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first packet creates the session.
+	sendPacket()
+	b := make([]byte, mtu)
+	if err = sinkConn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = sinkConn.ReadFromUDPAddrPort(b); err != nil {
+		t.Fatalf("Failed to receive first packet: %v", err)
+	}
+
+	// Block unpacking of the second packet, and check that the session table is still available.
+	server.armed.Store(true)
+	sendPacket()
+	select {
+	case <-server.entered:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for unpacking")
+	}
+	server.armed.Store(false)
+
+	snapshotDone := make(chan []UDPSessionInfo, 1)
+	go func() {
+		snapshotDone <- s.Snapshot()
+	}()
+
+	select {
+	case sessions := <-snapshotDone:
+		if len(sessions) != 1 {
+			t.Errorf("len(sessions) = %d, expected 1", len(sessions))
+		}
+	case <-time.After(time.Second):
+		t.Error("Snapshot blocked while an established session was unpacking a packet")
+	}
+
+	close(server.release)
+
+	if _, _, err = sinkConn.ReadFromUDPAddrPort(b); err != nil {
+		t.Fatalf("Failed to receive second packet: %v", err)
+	}
+}
+
+func TestUDPSessionRelaySetRouter(t *testing.T) {
+	const (
+		key = 0x5a
+		mtu = 1500
+	)
+
+	sinkConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sinkConn.Close()
+	sinkAddrPort := sinkConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	logger := zap.NewNop()
+	newRouter := func(clientName string) *router.Router {
+		r, err := (&router.Config{}).Router(logger, nil, nil, nil, map[string]zerocopy.UDPClient{
+			clientName: direct.NewUDPClient(clientName, mtu, 0, 0),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	server := &zerocopy.FakeSessionServer{Key: key}
+	s, err := NewUDPSessionRelay(UDPSessionRelayConfig{
+		ServerName:    "fake",
+		ListenAddress: "127.0.0.1:0",
+		BatchSize:     8,
+		MTU:           mtu,
+		NATTimeout:    time.Minute,
+	}, server, nil, newRouter("old"), nil, logger, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	relayAddrPort := s.serverConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	clientConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	b := make([]byte, mtu)
+	sendAndReceive := func(c *zerocopy.FakeSessionClientPackUnpacker) {
+		destAddrPort, packet, err := zerocopy.ClientPackDatagram(c, conn.AddrFromIPPort(sinkAddrPort), []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = clientConn.WriteToUDPAddrPort(packet, destAddrPort); err != nil {
+			t.Fatal(err)
+		}
+		if err = sinkConn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = sinkConn.ReadFromUDPAddrPort(b); err != nil {
+			t.Fatalf("Failed to receive packet: %v", err)
+		}
+	}
+
+	oldSession := zerocopy.NewFakeSessionClientPackUnpacker(1, key, relayAddrPort)
+	sendAndReceive(oldSession)
+
+	s.SetRouter(newRouter("new"))
+
+	// The established session keeps its client, and new sessions use the new router.
+	sendAndReceive(oldSession)
+	sendAndReceive(zerocopy.NewFakeSessionClientPackUnpacker(2, key, relayAddrPort))
+
+	clients := make(map[uint64]string)
+	for _, info := range s.Snapshot() {
+		clients[info.ClientSessionID] = info.Client
+	}
+	if clients[1] != "old" || clients[2] != "new" {
+		t.Errorf("Session clients are %v, expected session 1 on old and session 2 on new", clients)
+	}
+}
+
+func TestUDPSessionRelayCloseSession(t *testing.T) {
+	const (
+		key = 0x5a
+		mtu = 1500
+	)
+
+	sinkConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sinkConn.Close()
+	sinkAddrPort := sinkConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	logger := zap.NewNop()
+	r, err := (&router.Config{}).Router(logger, nil, nil, nil, map[string]zerocopy.UDPClient{
+		"direct": direct.NewUDPClient("direct", mtu, 0, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &zerocopy.FakeSessionServer{Key: key}
+	s, err := NewUDPSessionRelay(UDPSessionRelayConfig{
+		ServerName:    "fake",
+		ListenAddress: "127.0.0.1:0",
+		BatchSize:     8,
+		MTU:           mtu,
+		NATTimeout:    time.Minute,
+	}, server, nil, r, nil, logger, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	relayAddrPort := s.serverConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	clientConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	c := zerocopy.NewFakeSessionClientPackUnpacker(1, key, relayAddrPort)
+	destAddrPort, packet, err := zerocopy.ClientPackDatagram(c, conn.AddrFromIPPort(sinkAddrPort), []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = clientConn.WriteToUDPAddrPort(packet, destAddrPort); err != nil {
+		t.Fatal(err)
+	}
+	if err = sinkConn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, mtu)
+	if _, _, err = sinkConn.ReadFromUDPAddrPort(b); err != nil {
+		t.Fatalf("Failed to receive packet: %v", err)
+	}
+
+	if s.CloseSession(2) {
+		t.Error("CloseSession() returned true for unknown session")
+	}
+	if !s.CloseSession(1) {
+		t.Fatal("CloseSession() returned false for established session")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(s.Snapshot()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Closed session is still in the session table")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUDPSessionRelayFailedSetupExits(t *testing.T) {
+	const (
+		key      = 0x5a
+		mtu      = 1500
+		sessions = 16
+	)
+
+	logger := zap.NewNop()
+	r, err := (&router.Config{DefaultUDPClientName: "reject"}).Router(logger, nil, nil, nil, map[string]zerocopy.UDPClient{
+		"direct": direct.NewUDPClient("direct", mtu, 0, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := stats.NewCollector(0)
+
+	server := &zerocopy.FakeSessionServer{Key: key}
+	s, err := NewUDPSessionRelay(UDPSessionRelayConfig{
+		ServerName:    "fake",
+		ListenAddress: "127.0.0.1:0",
+		BatchSize:     8,
+		MTU:           mtu,
+		NATTimeout:    time.Minute,
+	}, server, nil, r, collector, logger, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	relayAddrPort := s.serverConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	clientConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	goroutines := runtime.NumGoroutine()
+
+	for csid := uint64(1); csid <= sessions; csid++ {
+		c := zerocopy.NewFakeSessionClientPackUnpacker(csid, key, relayAddrPort)
+		destAddrPort, packet, err := zerocopy.ClientPackDatagram(c, conn.AddrFromIPPort(netip.MustParseAddrPort("127.0.0.1:9")), []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = clientConn.WriteToUDPAddrPort(packet, destAddrPort); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Setup goroutines of sessions that failed to route must exit.
+	deadline := time.Now().Add(time.Second)
+	for collector.SessionSetupFailures()[stats.SessionSetupFailureRoute.String()] < sessions || runtime.NumGoroutine() > goroutines {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d route failures, %d goroutines, expected %d failures and at most %d goroutines",
+				collector.SessionSetupFailures()[stats.SessionSetupFailureRoute.String()], runtime.NumGoroutine(), sessions, goroutines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUDPSessionRelayUserAllowedTargets(t *testing.T) {
+	for _, batchMode := range []string{"", "no"} {
+		t.Run(fmt.Sprintf("batchMode=%q", batchMode), func(t *testing.T) {
+			testUDPSessionRelayUserAllowedTargets(t, batchMode)
+		})
+	}
+}
+
+func testUDPSessionRelayUserAllowedTargets(t *testing.T, batchMode string) {
+	const (
+		key = 0x5a
+		mtu = 1500
+	)
+
+	allowedConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer allowedConn.Close()
+	allowedAddrPort := allowedConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	deniedConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deniedConn.Close()
+	deniedAddrPort := deniedConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	logger := zap.NewNop()
+	r, err := (&router.Config{
+		Users: []router.UserPolicyConfig{
+			{
+				Username:       "alice",
+				AllowedTargets: []string{allowedAddrPort.String()},
+			},
+		},
+	}).Router(logger, nil, nil, nil, map[string]zerocopy.UDPClient{
+		"direct": direct.NewUDPClient("direct", mtu, 0, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &zerocopy.FakeSessionServer{Key: key, Username: "alice"}
+	s, err := NewUDPSessionRelay(UDPSessionRelayConfig{
+		BatchMode:     batchMode,
+		ServerName:    "fake",
+		ListenAddress: "127.0.0.1:0",
+		BatchSize:     8,
+		MTU:           mtu,
+		NATTimeout:    time.Minute,
+	}, server, nil, r, nil, logger, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	relayAddrPort := s.serverConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	clientConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	c := zerocopy.NewFakeSessionClientPackUnpacker(1, key, relayAddrPort)
+	send := func(targetAddrPort netip.AddrPort, payload string) {
+		destAddrPort, packet, err := zerocopy.ClientPackDatagram(c, conn.AddrFromIPPort(targetAddrPort), []byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = clientConn.WriteToUDPAddrPort(packet, destAddrPort); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := make([]byte, mtu)
+	receive := func(payload string) {
+		if err := allowedConn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		n, _, err := allowedConn.ReadFromUDPAddrPort(b)
+		if err != nil {
+			t.Fatalf("Failed to receive %q: %v", payload, err)
+		}
+		if string(b[:n]) != payload {
+			t.Fatalf("Received %q, expected %q", b[:n], payload)
+		}
+	}
+
+	send(allowedAddrPort, "first")
+	receive("first")
+
+	// The session is open, but packets to other targets are still checked.
+	send(deniedAddrPort, "denied")
+	send(allowedAddrPort, "second")
+	receive("second")
+
+	if n := s.TargetNotAllowedPackets(); n != 1 {
+		t.Errorf("TargetNotAllowedPackets() = %d, expected 1", n)
+	}
+	if err = deniedConn.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = deniedConn.ReadFromUDPAddrPort(b); err == nil {
+		t.Error("Packet to target not allowed for user was relayed")
+	}
+}
+
+func TestUDPSessionRelayUserStats(t *testing.T) {
+	for _, batchMode := range []string{"", "no"} {
+		t.Run(fmt.Sprintf("batchMode=%q", batchMode), func(t *testing.T) {
+			testUDPSessionRelayUserStats(t, batchMode)
+		})
+	}
+}
+
+func testUDPSessionRelayUserStats(t *testing.T, batchMode string) {
+	const (
+		key = 0x5a
+		mtu = 1500
+	)
+
+	targetConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer targetConn.Close()
+	targetAddrPort := targetConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	logger := zap.NewNop()
+	r, err := (&router.Config{}).Router(logger, nil, nil, nil, map[string]zerocopy.UDPClient{
+		"direct": direct.NewUDPClient("direct", mtu, 0, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collector := stats.NewCollector(0)
+	server := &zerocopy.FakeSessionServer{Key: key, Username: "alice"}
+	s, err := NewUDPSessionRelay(UDPSessionRelayConfig{
+		BatchMode:     batchMode,
+		ServerName:    "fake",
+		ListenAddress: "127.0.0.1:0",
+		BatchSize:     8,
+		MTU:           mtu,
+		NATTimeout:    time.Minute,
+	}, server, nil, r, collector, logger, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	relayAddrPort := s.serverConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	clientConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	c := zerocopy.NewFakeSessionClientPackUnpacker(1, key, relayAddrPort)
+	destAddrPort, packet, err := zerocopy.ClientPackDatagram(c, conn.AddrFromIPPort(targetAddrPort), []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = clientConn.WriteToUDPAddrPort(packet, destAddrPort); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, mtu)
+	if err = targetConn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	_, natAddrPort, err := targetConn.ReadFromUDPAddrPort(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u, ok := collector.UserSnapshot("alice"); !ok || u.ActiveUDPSessions != 1 {
+		t.Errorf("UserSnapshot(alice) = %+v, %v, expected 1 active UDP session", u, ok)
+	}
+
+	if _, err = targetConn.WriteToUDPAddrPort([]byte("reply!"), natAddrPort); err != nil {
+		t.Fatal(err)
+	}
+	if err = clientConn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = clientConn.ReadFromUDPAddrPort(b); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stop waits for the session to close.
+	if err = s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	u, ok := collector.UserSnapshot("alice")
+	if !ok {
+		t.Fatal("User alice is not tracked")
+	}
+	if u.ActiveUDPSessions != 0 || u.UplinkBytes != uint64(len("hello")) || u.DownlinkBytes != uint64(len("reply!")) {
+		t.Errorf("UserSnapshot(alice) = %+v, expected no active UDP sessions, 5 uplink bytes, 6 downlink bytes", u)
+	}
+
+	if h := collector.SessionSetupLatency(); h.Count != 1 {
+		t.Errorf("Expected 1 session setup latency observation, got %d", h.Count)
+	}
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"net/netip"
+	"sync"
+)
+
+// maxNATSources is the maximum number of destinations tracked by a natSourceSet.
+// When exceeded, the set is reset, so that sessions talking to many destinations
+// cannot grow it without bound.
+const maxNATSources = 1024
+
+// natSourceSet tracks the destinations a natConn has sent packets to.
+// Packets received on the natConn from any other source are rejected.
+//
+// A nil *natSourceSet accepts all sources.
+type natSourceSet struct {
+	mu      sync.RWMutex
+	sources map[netip.AddrPort]struct{}
+}
+
+func newNATSourceSet() *natSourceSet {
+	return &natSourceSet{
+		sources: make(map[netip.AddrPort]struct{}),
+	}
+}
+
+// Add records addrPort as an expected source.
+func (s *natSourceSet) Add(addrPort netip.AddrPort) {
+	if s == nil {
+		return
+	}
+	addrPort = netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+
+	s.mu.RLock()
+	_, ok := s.sources[addrPort]
+	s.mu.RUnlock()
+	if ok {
+		return
+	}
+
+	s.mu.Lock()
+	if len(s.sources) >= maxNATSources {
+		s.sources = make(map[netip.AddrPort]struct{})
+	}
+	s.sources[addrPort] = struct{}{}
+	s.mu.Unlock()
+}
+
+// Contains returns whether packets from addrPort should be accepted.
+func (s *natSourceSet) Contains(addrPort netip.AddrPort) bool {
+	if s == nil {
+		return true
+	}
+	addrPort = netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+
+	s.mu.RLock()
+	_, ok := s.sources[addrPort]
+	s.mu.RUnlock()
+	return ok
+}
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestNATSourceSet(t *testing.T) {
+	var nilSet *natSourceSet
+	nilSet.Add(netip.MustParseAddrPort("192.0.2.1:53"))
+	if !nilSet.Contains(netip.MustParseAddrPort("192.0.2.2:53")) {
+		t.Error("Nil set rejected source")
+	}
+
+	s := newNATSourceSet()
+	s.Add(netip.MustParseAddrPort("192.0.2.1:53"))
+
+	if !s.Contains(netip.MustParseAddrPort("192.0.2.1:53")) {
+		t.Error("Set rejected added source")
+	}
+	if !s.Contains(netip.MustParseAddrPort("[::ffff:192.0.2.1]:53")) {
+		t.Error("Set rejected IPv4-mapped form of added source")
+	}
+	if s.Contains(netip.MustParseAddrPort("192.0.2.1:54")) {
+		t.Error("Set accepted source with different port")
+	}
+	if s.Contains(netip.MustParseAddrPort("192.0.2.2:53")) {
+		t.Error("Set accepted source with different address")
+	}
+
+	for i := 0; i < maxNATSources; i++ {
+		s.Add(netip.AddrPortFrom(netip.MustParseAddr("2001:db8::1"), uint16(i+1)))
+	}
+	if len(s.sources) > maxNATSources {
+		t.Errorf("Set has %d sources, expected at most %d", len(s.sources), maxNATSources)
+	}
+}
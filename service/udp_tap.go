@@ -0,0 +1,173 @@
+package service
+
+import (
+	"net/netip"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+// PacketTap observes packets relayed by a UDP session relay.
+//
+// Hooks are called synchronously from the relay goroutines.
+// The buffers are only valid for the duration of the call and must not be modified.
+type PacketTap interface {
+	// OnServerRecv is called with the decrypted payload of a packet received from a client.
+	OnServerRecv(csid uint64, payload []byte, clientAddrPort netip.AddrPort, targetAddr conn.Addr)
+
+	// OnNatSend is called with the packed packet about to be sent to destAddrPort.
+	OnNatSend(csid uint64, packet []byte, destAddrPort netip.AddrPort, targetAddr conn.Addr)
+
+	// OnNatRecv is called with the unpacked payload of a packet received from payloadSourceAddrPort.
+	OnNatRecv(csid uint64, payload []byte, payloadSourceAddrPort netip.AddrPort)
+
+	// OnServerSend is called with the encrypted packet about to be sent to the client.
+	OnServerSend(csid uint64, packet []byte, payloadSourceAddrPort netip.AddrPort)
+}
+
+// tapServerUnpacker wraps a server unpacker and reports unpacked payloads to the tap.
+type tapServerUnpacker struct {
+	zerocopy.ServerUnpacker
+	tap  PacketTap
+	csid uint64
+}
+
+// UnpackInPlace implements the zerocopy.ServerUnpacker UnpackInPlace method.
+func (u *tapServerUnpacker) UnpackInPlace(b []byte, sourceAddrPort netip.AddrPort, packetStart, packetLen int) (targetAddr conn.Addr, payloadStart, payloadLen int, err error) {
+	targetAddr, payloadStart, payloadLen, err = u.ServerUnpacker.UnpackInPlace(b, sourceAddrPort, packetStart, packetLen)
+	if err == nil {
+		u.tap.OnServerRecv(u.csid, b[payloadStart:payloadStart+payloadLen], sourceAddrPort, targetAddr)
+	}
+	return
+}
+
+// unwrapServerUnpacker returns the server unpacker wrapped by a tapServerUnpacker,
+// or u itself if it is not wrapped.
+func unwrapServerUnpacker(u zerocopy.ServerUnpacker) zerocopy.ServerUnpacker {
+	if tu, ok := u.(*tapServerUnpacker); ok {
+		return tu.ServerUnpacker
+	}
+	return u
+}
+
+// tapClientPacker wraps a client packer and reports packed packets to the tap.
+type tapClientPacker struct {
+	zerocopy.ClientPacker
+	tap  PacketTap
+	csid uint64
+}
+
+// PackInPlace implements the zerocopy.ClientPacker PackInPlace method.
+func (p *tapClientPacker) PackInPlace(b []byte, targetAddr conn.Addr, payloadStart, payloadLen int) (destAddrPort netip.AddrPort, packetStart, packetLen int, err error) {
+	destAddrPort, packetStart, packetLen, err = p.ClientPacker.PackInPlace(b, targetAddr, payloadStart, payloadLen)
+	if err == nil {
+		p.tap.OnNatSend(p.csid, b[packetStart:packetStart+packetLen], destAddrPort, targetAddr)
+	}
+	return
+}
+
+// tapClientUnpacker wraps a client unpacker and reports unpacked payloads to the tap.
+type tapClientUnpacker struct {
+	zerocopy.ClientUnpacker
+	tap  PacketTap
+	csid uint64
+}
+
+// UnpackInPlace implements the zerocopy.ClientUnpacker UnpackInPlace method.
+func (u *tapClientUnpacker) UnpackInPlace(b []byte, packetSourceAddrPort netip.AddrPort, packetStart, packetLen int) (payloadSourceAddrPort netip.AddrPort, payloadStart, payloadLen int, err error) {
+	payloadSourceAddrPort, payloadStart, payloadLen, err = u.ClientUnpacker.UnpackInPlace(b, packetSourceAddrPort, packetStart, packetLen)
+	if err == nil {
+		u.tap.OnNatRecv(u.csid, b[payloadStart:payloadStart+payloadLen], payloadSourceAddrPort)
+	}
+	return
+}
+
+// unwrapClientUnpacker returns the client unpacker wrapped by a tapClientUnpacker,
+// or u itself if it is not wrapped.
+func unwrapClientUnpacker(u zerocopy.ClientUnpacker) zerocopy.ClientUnpacker {
+	if tu, ok := u.(*tapClientUnpacker); ok {
+		return tu.ClientUnpacker
+	}
+	return u
+}
+
+// tapServerPacker wraps a server packer and reports packed packets to the tap.
+type tapServerPacker struct {
+	zerocopy.ServerPacker
+	tap  PacketTap
+	csid uint64
+}
+
+// PackInPlace implements the zerocopy.ServerPacker PackInPlace method.
+func (p *tapServerPacker) PackInPlace(b []byte, sourceAddrPort netip.AddrPort, payloadStart, payloadLen, maxPacketLen int) (packetStart, packetLen int, err error) {
+	packetStart, packetLen, err = p.ServerPacker.PackInPlace(b, sourceAddrPort, payloadStart, payloadLen, maxPacketLen)
+	if err == nil {
+		p.tap.OnServerSend(p.csid, b[packetStart:packetStart+packetLen], sourceAddrPort)
+	}
+	return
+}
+
+// LoggerPacketTap is a PacketTap that logs packets at debug level.
+type LoggerPacketTap struct {
+	serverName string
+	logger     *zap.Logger
+}
+
+// NewLoggerPacketTap returns a new PacketTap that logs packets relayed by the named server.
+func NewLoggerPacketTap(serverName string, logger *zap.Logger) *LoggerPacketTap {
+	return &LoggerPacketTap{
+		serverName: serverName,
+		logger:     logger,
+	}
+}
+
+// OnServerRecv implements the PacketTap OnServerRecv method.
+func (t *LoggerPacketTap) OnServerRecv(csid uint64, payload []byte, clientAddrPort netip.AddrPort, targetAddr conn.Addr) {
+	if ce := t.logger.Check(zap.DebugLevel, "Tapped payload from client"); ce != nil {
+		ce.Write(
+			zap.String("server", t.serverName),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Stringer("targetAddress", targetAddr),
+			zap.Uint64("clientSessionID", csid),
+			zap.Binary("payload", payload),
+		)
+	}
+}
+
+// OnNatSend implements the PacketTap OnNatSend method.
+func (t *LoggerPacketTap) OnNatSend(csid uint64, packet []byte, destAddrPort netip.AddrPort, targetAddr conn.Addr) {
+	if ce := t.logger.Check(zap.DebugLevel, "Tapped packet to target"); ce != nil {
+		ce.Write(
+			zap.String("server", t.serverName),
+			zap.Stringer("writeDestAddress", destAddrPort),
+			zap.Stringer("targetAddress", targetAddr),
+			zap.Uint64("clientSessionID", csid),
+			zap.Binary("packet", packet),
+		)
+	}
+}
+
+// OnNatRecv implements the PacketTap OnNatRecv method.
+func (t *LoggerPacketTap) OnNatRecv(csid uint64, payload []byte, payloadSourceAddrPort netip.AddrPort) {
+	if ce := t.logger.Check(zap.DebugLevel, "Tapped payload from target"); ce != nil {
+		ce.Write(
+			zap.String("server", t.serverName),
+			zap.Stringer("payloadSourceAddress", payloadSourceAddrPort),
+			zap.Uint64("clientSessionID", csid),
+			zap.Binary("payload", payload),
+		)
+	}
+}
+
+// OnServerSend implements the PacketTap OnServerSend method.
+func (t *LoggerPacketTap) OnServerSend(csid uint64, packet []byte, payloadSourceAddrPort netip.AddrPort) {
+	if ce := t.logger.Check(zap.DebugLevel, "Tapped packet to client"); ce != nil {
+		ce.Write(
+			zap.String("server", t.serverName),
+			zap.Stringer("payloadSourceAddress", payloadSourceAddrPort),
+			zap.Uint64("clientSessionID", csid),
+			zap.Binary("packet", packet),
+		)
+	}
+}
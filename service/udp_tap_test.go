@@ -0,0 +1,190 @@
+package service
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/direct"
+	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+// tapEvent is a call to a PacketTap method.
+type tapEvent struct {
+	hook       string
+	csid       uint64
+	data       []byte
+	addrPort   netip.AddrPort
+	targetAddr conn.Addr
+}
+
+// recordingTap records calls to its methods.
+type recordingTap struct {
+	mu     sync.Mutex
+	events []tapEvent
+}
+
+func (t *recordingTap) record(e tapEvent) {
+	// The buffers are only valid for the duration of the call.
+	e.data = append([]byte(nil), e.data...)
+	t.mu.Lock()
+	t.events = append(t.events, e)
+	t.mu.Unlock()
+}
+
+func (t *recordingTap) OnServerRecv(csid uint64, payload []byte, clientAddrPort netip.AddrPort, targetAddr conn.Addr) {
+	t.record(tapEvent{"OnServerRecv", csid, payload, clientAddrPort, targetAddr})
+}
+
+func (t *recordingTap) OnNatSend(csid uint64, packet []byte, destAddrPort netip.AddrPort, targetAddr conn.Addr) {
+	t.record(tapEvent{"OnNatSend", csid, packet, destAddrPort, targetAddr})
+}
+
+func (t *recordingTap) OnNatRecv(csid uint64, payload []byte, payloadSourceAddrPort netip.AddrPort) {
+	t.record(tapEvent{hook: "OnNatRecv", csid: csid, data: payload, addrPort: payloadSourceAddrPort})
+}
+
+func (t *recordingTap) OnServerSend(csid uint64, packet []byte, payloadSourceAddrPort netip.AddrPort) {
+	t.record(tapEvent{hook: "OnServerSend", csid: csid, data: packet, addrPort: payloadSourceAddrPort})
+}
+
+// Events returns the recorded events.
+func (t *recordingTap) Events() []tapEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]tapEvent(nil), t.events...)
+}
+
+func TestUDPSessionRelayPacketTap(t *testing.T) {
+	for _, batchMode := range []string{"no", "sendmmsg"} {
+		t.Run(batchMode, func(t *testing.T) {
+			testUDPSessionRelayPacketTap(t, batchMode)
+		})
+	}
+}
+
+func testUDPSessionRelayPacketTap(t *testing.T, batchMode string) {
+	const (
+		csid = 42
+		key  = 0x5a
+		mtu  = 1500
+	)
+
+	echoConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoConn.Close()
+	echoAddrPort := echoConn.LocalAddr().(*net.UDPAddr).AddrPort()
+	echoAddr := conn.AddrFromIPPort(echoAddrPort)
+
+	go func() {
+		b := make([]byte, mtu)
+		for {
+			n, addrPort, err := echoConn.ReadFromUDPAddrPort(b)
+			if err != nil {
+				return
+			}
+			if _, err = echoConn.WriteToUDPAddrPort(b[:n], addrPort); err != nil {
+				return
+			}
+		}
+	}()
+
+	logger := zap.NewNop()
+	udpClientMap := map[string]zerocopy.UDPClient{
+		"direct": direct.NewUDPClient("direct", mtu, 0, 0),
+	}
+	r, err := (&router.Config{}).Router(logger, nil, nil, nil, udpClientMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tap recordingTap
+	server := &zerocopy.FakeSessionServer{Key: key}
+	s, err := NewUDPSessionRelay(UDPSessionRelayConfig{
+		BatchMode:     batchMode,
+		ServerName:    "fake",
+		ListenAddress: "127.0.0.1:0",
+		BatchSize:     8,
+		MTU:           mtu,
+		NATTimeout:    time.Minute,
+	}, server, nil, r, nil, logger, &tap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	relayAddrPort := s.serverConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	clientConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+	clientAddrPort := clientConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	if err = clientConn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	c := zerocopy.NewFakeSessionClientPackUnpacker(csid, key, relayAddrPort)
+	payload := []byte("tapped payload")
+
+	destAddrPort, packet, err := zerocopy.ClientPackDatagram(c, echoAddr, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = clientConn.WriteToUDPAddrPort(packet, destAddrPort); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, mtu)
+	n, _, err := clientConn.ReadFromUDPAddrPort(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := b[:n]
+
+	// Hooks are called synchronously before each packet is sent,
+	// so all four have been called once the echo is received.
+	events := tap.Events()
+	expected := []tapEvent{
+		{"OnServerRecv", csid, payload, clientAddrPort, echoAddr},
+		// The direct client sends the payload as is to the target.
+		{"OnNatSend", csid, payload, echoAddrPort, echoAddr},
+		{hook: "OnNatRecv", csid: csid, data: payload, addrPort: echoAddrPort},
+		{hook: "OnServerSend", csid: csid, data: reply, addrPort: echoAddrPort},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("Got %d tap events, expected %d: %+v", len(events), len(expected), events)
+	}
+	for i, e := range expected {
+		got := events[i]
+		if got.hook != e.hook {
+			t.Errorf("Event %d is %s, expected %s", i, got.hook, e.hook)
+			continue
+		}
+		if got.csid != e.csid {
+			t.Errorf("%s got csid %d, expected %d", e.hook, got.csid, e.csid)
+		}
+		if !bytes.Equal(got.data, e.data) {
+			t.Errorf("%s got data %q, expected %q", e.hook, got.data, e.data)
+		}
+		// Packets received on the dual-stack natConn have IPv4-mapped source addresses.
+		if addrPort := netip.AddrPortFrom(got.addrPort.Addr().Unmap(), got.addrPort.Port()); addrPort != e.addrPort {
+			t.Errorf("%s got address %s, expected %s", e.hook, got.addrPort, e.addrPort)
+		}
+		if got.targetAddr != e.targetAddr {
+			t.Errorf("%s got target address %s, expected %s", e.hook, got.targetAddr, e.targetAddr)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/database64128/shadowsocks-go/conn"
+)
+
+func TestPrewarmPool(t *testing.T) {
+	const n = 16
+
+	var allocs int
+	pool := sync.Pool{
+		New: func() any {
+			allocs++
+			return &sessionQueuedPacket{
+				buf: make([]byte, 1452),
+			}
+		},
+	}
+
+	prewarmPool(&pool, n)
+	if allocs != n {
+		t.Fatalf("prewarmPool allocated %d entries, expected %d", allocs, n)
+	}
+
+	// Draining the pool may allocate if entries were dropped, but must never return a wrongly sized entry.
+	for i := 0; i < n; i++ {
+		if qp := pool.Get().(*sessionQueuedPacket); len(qp.buf) != 1452 {
+			t.Fatalf("Got pooled buffer of size %d, expected %d", len(qp.buf), 1452)
+		}
+	}
+}
+
+func TestFlagsErrorMessage(t *testing.T) {
+	const msg = "Failed to read packet from natConn"
+
+	if got := flagsErrorMessage(conn.ErrMessageTruncated, msg); got == msg {
+		t.Errorf("flagsErrorMessage() returned the generic message %q for a truncated packet", got)
+	}
+
+	if got := flagsErrorMessage(conn.ErrControlMessageTruncated, msg); got != msg {
+		t.Errorf("flagsErrorMessage() returned %q, expected %q", got, msg)
+	}
+}
+
+func TestServerConfigCheckUDPSessionRelayOptions(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		config  ServerConfig
+		wantErr bool
+	}{
+		{"Direct", ServerConfig{Protocol: "direct"}, false},
+		{"DirectSourceRateLimit", ServerConfig{Protocol: "direct", UDPSourcePacketRateLimit: 100}, true},
+		{"Socks5MirrorClient", ServerConfig{Protocol: "socks5", UDPMirrorClient: "mirror"}, true},
+		{"TproxyFlowLabel", ServerConfig{Protocol: "tproxy", IPv6FlowLabel: true}, true},
+		{"2022SourceRateLimit", ServerConfig{Protocol: "2022-blake3-aes-128-gcm", UDPSourceByteRateLimit: 1 << 20}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if err := c.config.checkUDPSessionRelayOptions(); (err != nil) != c.wantErr {
+				t.Errorf("checkUDPSessionRelayOptions() = %v, want error: %v", err, c.wantErr)
+			}
+		})
+	}
+}
@@ -7,12 +7,14 @@ import (
 	"time"
 
 	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/zerocopy"
 	"go.uber.org/zap"
 )
 
 func NewUDPTransparentRelay(
 	serverName, listenAddress string,
-	batchSize, listenerFwmark, mtu, maxClientFrontHeadroom, maxClientRearHeadroom int,
+	batchSize, prewarmPackets, listenerFwmark, mtu int,
+	maxClientHeadroom zerocopy.Headroom,
 	natTimeout time.Duration,
 	router *router.Router,
 	logger *zap.Logger,
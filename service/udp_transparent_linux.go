@@ -6,6 +6,7 @@ import (
 	"net/netip"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -41,9 +42,10 @@ type UDPTransparentRelay struct {
 	packetBufFrontHeadroom int
 	packetBufRecvSize      int
 	batchSize              int
+	prewarmPackets         int
 	natTimeout             time.Duration
 	serverConn             *net.UDPConn
-	router                 *router.Router
+	router                 atomic.Pointer[router.Router]
 	logger                 *zap.Logger
 	queuedPacketPool       sync.Pool
 	mu                     sync.Mutex
@@ -54,23 +56,27 @@ type UDPTransparentRelay struct {
 
 func NewUDPTransparentRelay(
 	serverName, listenAddress string,
-	batchSize, listenerFwmark, mtu, maxClientFrontHeadroom, maxClientRearHeadroom int,
+	batchSize, prewarmPackets, listenerFwmark, mtu int,
+	maxClientHeadroom zerocopy.Headroom,
 	natTimeout time.Duration,
 	router *router.Router,
 	logger *zap.Logger,
 ) (Relay, error) {
 	packetBufRecvSize := mtu - zerocopy.IPv4HeaderLength - zerocopy.UDPHeaderLength
-	packetBufSize := maxClientFrontHeadroom + packetBufRecvSize + maxClientRearHeadroom
-	return &UDPTransparentRelay{
+	if err := zerocopy.CheckHeadroom(maxClientHeadroom, packetBufRecvSize); err != nil {
+		return nil, err
+	}
+	packetBufSize := maxClientHeadroom.FrontHeadroom() + packetBufRecvSize + maxClientHeadroom.RearHeadroom()
+	s := UDPTransparentRelay{
 		serverName:             serverName,
 		listenAddress:          listenAddress,
 		listenerFwmark:         listenerFwmark,
 		mtu:                    mtu,
-		packetBufFrontHeadroom: maxClientFrontHeadroom,
+		packetBufFrontHeadroom: maxClientHeadroom.FrontHeadroom(),
 		packetBufRecvSize:      packetBufRecvSize,
 		batchSize:              batchSize,
+		prewarmPackets:         prewarmPackets,
 		natTimeout:             natTimeout,
-		router:                 router,
 		logger:                 logger,
 		queuedPacketPool: sync.Pool{
 			New: func() any {
@@ -80,7 +86,9 @@ func NewUDPTransparentRelay(
 			},
 		},
 		table: make(map[netip.AddrPort]*transparentNATEntry),
-	}, nil
+	}
+	s.router.Store(router)
+	return &s, nil
 }
 
 // String implements the Relay String method.
@@ -88,6 +96,14 @@ func (s *UDPTransparentRelay) String() string {
 	return "UDP transparent relay service for " + s.serverName
 }
 
+// SetRouter replaces the router used to select clients for new sessions.
+// Established sessions keep the client selected by the router that created them.
+//
+// SetRouter is safe to call while the relay is running.
+func (s *UDPTransparentRelay) SetRouter(r *router.Router) {
+	s.router.Store(r)
+}
+
 // Start implements the Relay Start method.
 func (s *UDPTransparentRelay) Start() error {
 	serverConn, err := conn.ListenUDPTransparent("udp", s.listenAddress, true, false, s.listenerFwmark)
@@ -96,6 +112,8 @@ func (s *UDPTransparentRelay) Start() error {
 	}
 	s.serverConn = serverConn
 
+	prewarmPool(&s.queuedPacketPool, s.prewarmPackets)
+
 	s.mwg.Add(1)
 
 	go func() {
@@ -187,11 +205,12 @@ func (s *UDPTransparentRelay) recvFromServerConnRecvmmsg() {
 			}
 
 			if err = conn.ParseFlagsForError(int(msg.Msghdr.Flags)); err != nil {
-				s.logger.Warn("Packet from serverConn discarded",
+				s.logger.Warn(flagsErrorMessage(err, "Packet from serverConn discarded"),
 					zap.String("server", s.serverName),
 					zap.String("listenAddress", s.listenAddress),
 					zap.Stringer("clientAddress", clientAddrPort),
 					zap.Uint32("packetLength", msg.Msglen),
+					zap.Int("recvBufSize", s.packetBufRecvSize),
 					zap.Error(err),
 				)
 
@@ -239,7 +258,17 @@ func (s *UDPTransparentRelay) recvFromServerConnRecvmmsg() {
 						}
 					}()
 
-					c, err := s.router.GetUDPClient(s.serverName, clientAddrPort, conn.AddrFromIPPort(queuedPacket.targetAddrPort))
+					// Use the same router for the whole session, even if it is swapped out by SetRouter.
+					sessionRouter := acquireRouter(&s.router)
+					if sessionRouter == nil {
+						return
+					}
+					defer sessionRouter.Release()
+					c, policy, err := sessionRouter.GetUDPClient(router.RequestInfo{
+						Server:         s.serverName,
+						SourceAddrPort: clientAddrPort,
+						TargetAddr:     conn.AddrFromIPPort(queuedPacket.targetAddrPort),
+					})
 					if err != nil {
 						s.logger.Warn("Failed to get UDP client for new NAT session",
 							zap.String("server", s.serverName),
@@ -257,8 +286,7 @@ func (s *UDPTransparentRelay) recvFromServerConnRecvmmsg() {
 					s.wg.Add(1)
 					defer s.wg.Done()
 
-					natConnMaxPacketSize, natConnFwmark := c.LinkInfo()
-					natConnPacker, natConnUnpacker, err := c.NewSession()
+					clientInfo, natConnPacker, natConnUnpacker, err := c.NewSession()
 					if err != nil {
 						s.logger.Warn("Failed to create new UDP client session",
 							zap.String("server", s.serverName),
@@ -271,7 +299,15 @@ func (s *UDPTransparentRelay) recvFromServerConnRecvmmsg() {
 						return
 					}
 
-					natConn, err := conn.ListenUDP("udp", "", false, natConnFwmark)
+					if clientInfo.Closer != nil {
+						defer clientInfo.Closer.Close()
+					}
+
+					if policy.Fwmark != 0 {
+						clientInfo.Fwmark = policy.Fwmark
+					}
+
+					natConn, err := conn.ListenUDPOnInterface("udp", clientInfo.Netns, clientInfo.Interface, clientInfo.LocalPortRange, false, clientInfo.Fwmark)
 					if err != nil {
 						s.logger.Warn("Failed to create UDP socket for new NAT session",
 							zap.String("server", s.serverName),
@@ -279,7 +315,8 @@ func (s *UDPTransparentRelay) recvFromServerConnRecvmmsg() {
 							zap.String("listenAddress", s.listenAddress),
 							zap.Stringer("clientAddress", clientAddrPort),
 							zap.Stringer("targetAddress", &queuedPacket.targetAddrPort),
-							zap.Int("natConnFwmark", natConnFwmark),
+							zap.Int("natConnFwmark", clientInfo.Fwmark),
+							zap.Stringer("natConnLocalPortRange", clientInfo.LocalPortRange),
 							zap.Error(err),
 						)
 						return
@@ -303,7 +340,7 @@ func (s *UDPTransparentRelay) recvFromServerConnRecvmmsg() {
 					sendChClean = true
 
 					entry.natConn = natConn
-					entry.natConnRecvBufSize = natConnMaxPacketSize
+					entry.natConnRecvBufSize = clientInfo.MaxPacketSize
 					entry.natConnPacker = natConnPacker
 					entry.natConnUnpacker = natConnUnpacker
 
@@ -315,6 +352,9 @@ func (s *UDPTransparentRelay) recvFromServerConnRecvmmsg() {
 						zap.Stringer("targetAddress", &queuedPacket.targetAddrPort),
 					)
 
+					sessionRouter.SessionOpened(clientName)
+					defer sessionRouter.SessionClosed(clientName)
+
 					s.wg.Add(1)
 
 					go func() {
@@ -370,13 +410,14 @@ func (s *UDPTransparentRelay) recvFromServerConnRecvmmsg() {
 
 func (s *UDPTransparentRelay) relayServerConnToNatConnSendmmsg(clientAddrPort netip.AddrPort, entry *transparentNATEntry) {
 	var (
-		destAddrPort     netip.AddrPort
-		packetStart      int
-		packetLength     int
-		err              error
-		sendmmsgCount    uint64
-		packetsSent      uint64
-		payloadBytesSent uint64
+		destAddrPort             netip.AddrPort
+		packetStart              int
+		packetLength             int
+		err                      error
+		sendmmsgCount            uint64
+		packetsSent              uint64
+		packetsDroppedAfterRetry uint64
+		payloadBytesSent         uint64
 	)
 
 	qpvec := make([]*transparentQueuedPacket, s.batchSize)
@@ -444,15 +485,21 @@ main:
 			}
 		}
 
-		if err := conn.WriteMsgvec(entry.natConn, msgvec[:count]); err != nil {
-			s.logger.Warn("Failed to batch write packets to natConn",
-				zap.String("server", s.serverName),
-				zap.String("listenAddress", s.listenAddress),
-				zap.Stringer("clientAddress", clientAddrPort),
-				zap.Stringer("lastTargetAddress", &qpvec[count-1].targetAddrPort),
-				zap.Stringer("lastWriteDestAddress", destAddrPort),
-				zap.Error(err),
-			)
+		sent, err := conn.WriteMsgvec(entry.natConn, msgvec[:count])
+		if err != nil {
+			if n := droppedAfterRetry(err); n > 0 {
+				packetsDroppedAfterRetry += uint64(n)
+			} else {
+				s.logger.Warn("Failed to batch write packets to natConn",
+					zap.String("server", s.serverName),
+					zap.String("listenAddress", s.listenAddress),
+					zap.Stringer("clientAddress", clientAddrPort),
+					zap.Stringer("lastTargetAddress", &qpvec[count-1].targetAddrPort),
+					zap.Stringer("lastWriteDestAddress", destAddrPort),
+					zap.Int("packetsDropped", count-sent),
+					zap.Error(err),
+				)
+			}
 		}
 
 		if err := entry.natConn.SetReadDeadline(time.Now().Add(s.natTimeout)); err != nil {
@@ -466,7 +513,7 @@ main:
 		}
 
 		sendmmsgCount++
-		packetsSent += uint64(count)
+		packetsSent += uint64(sent)
 
 		qpvecn := qpvec[:count]
 
@@ -486,6 +533,7 @@ main:
 		zap.Stringer("lastWriteDestAddress", destAddrPort),
 		zap.Uint64("sendmmsgCount", sendmmsgCount),
 		zap.Uint64("packetsSent", packetsSent),
+		zap.Uint64("packetsDroppedAfterRetry", packetsDroppedAfterRetry),
 		zap.Uint64("payloadBytesSent", payloadBytesSent),
 	)
 }
@@ -536,13 +584,14 @@ func (tc *transparentConn) putMsg(base *byte, length int) {
 	tc.n++
 }
 
-func (tc *transparentConn) writeMsgvec() (sendmmsgCount, packetsSent int, err error) {
+func (tc *transparentConn) writeMsgvec() (sendmmsgCount, packetsSent, packetsDropped int, err error) {
 	if tc.n == 0 {
 		return
 	}
-	packetsSent = tc.n
+	count := tc.n
 	tc.n = 0
-	return 1, packetsSent, conn.WriteMsgvec(tc.uc, tc.msgvec[:packetsSent])
+	packetsSent, err = conn.WriteMsgvec(tc.uc, tc.msgvec[:count])
+	return 1, packetsSent, count - packetsSent, err
 }
 
 func (tc *transparentConn) close() error {
@@ -551,9 +600,10 @@ func (tc *transparentConn) close() error {
 
 func (s *UDPTransparentRelay) relayNatConnToTransparentConnSendmmsg(clientAddrPort netip.AddrPort, entry *transparentNATEntry) {
 	var (
-		sendmmsgCount    uint64
-		packetsSent      uint64
-		payloadBytesSent uint64
+		sendmmsgCount            uint64
+		packetsSent              uint64
+		packetsDroppedAfterRetry uint64
+		payloadBytesSent         uint64
 	)
 
 	maxClientPacketSize := zerocopy.MaxPacketSizeForAddr(s.mtu, clientAddrPort.Addr())
@@ -612,12 +662,13 @@ func (s *UDPTransparentRelay) relayNatConnToTransparentConnSendmmsg(clientAddrPo
 			}
 
 			if err = conn.ParseFlagsForError(int(msg.Msghdr.Flags)); err != nil {
-				s.logger.Warn("Packet from natConn discarded",
+				s.logger.Warn(flagsErrorMessage(err, "Packet from natConn discarded"),
 					zap.String("server", s.serverName),
 					zap.String("listenAddress", s.listenAddress),
 					zap.Stringer("clientAddress", clientAddrPort),
 					zap.Stringer("packetSourceAddress", packetSourceAddrPort),
 					zap.Uint32("packetLength", msg.Msglen),
+					zap.Int("recvBufSize", entry.natConnRecvBufSize),
 					zap.Error(err),
 				)
 				continue
@@ -675,15 +726,20 @@ func (s *UDPTransparentRelay) relayNatConnToTransparentConnSendmmsg(clientAddrPo
 		}
 
 		for payloadSourceAddrPort, tc := range tcMap {
-			sc, ps, err := tc.writeMsgvec()
+			sc, ps, pd, err := tc.writeMsgvec()
 			if err != nil {
-				s.logger.Warn("Failed to batch write packets to transparentConn",
-					zap.String("server", s.serverName),
-					zap.String("listenAddress", s.listenAddress),
-					zap.Stringer("clientAddress", clientAddrPort),
-					zap.Stringer("payloadSourceAddress", payloadSourceAddrPort),
-					zap.Error(err),
-				)
+				if n := droppedAfterRetry(err); n > 0 {
+					packetsDroppedAfterRetry += uint64(n)
+				} else {
+					s.logger.Warn("Failed to batch write packets to transparentConn",
+						zap.String("server", s.serverName),
+						zap.String("listenAddress", s.listenAddress),
+						zap.Stringer("clientAddress", clientAddrPort),
+						zap.Stringer("payloadSourceAddress", payloadSourceAddrPort),
+						zap.Int("packetsDropped", pd),
+						zap.Error(err),
+					)
+				}
 			}
 
 			sendmmsgCount += uint64(sc)
@@ -709,6 +765,7 @@ func (s *UDPTransparentRelay) relayNatConnToTransparentConnSendmmsg(clientAddrPo
 		zap.Stringer("clientAddress", clientAddrPort),
 		zap.Uint64("sendmmsgCount", sendmmsgCount),
 		zap.Uint64("packetsSent", packetsSent),
+		zap.Uint64("packetsDroppedAfterRetry", packetsDroppedAfterRetry),
 		zap.Uint64("payloadBytesSent", payloadBytesSent),
 	)
 }
@@ -0,0 +1,252 @@
+// Package sniff extracts domain names from the initial payload of a stream.
+package sniff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+const (
+	tlsRecordTypeHandshake        = 22
+	tlsHandshakeTypeClientHello   = 1
+	tlsExtensionServerName        = 0
+	tlsExtensionECH               = 0xfe0d
+	tlsServerNameTypeHostName     = 0
+	tlsRecordHeaderLength         = 5
+	tlsHandshakeHeaderLength      = 4
+	tlsClientHelloRandomLength    = 32
+	tlsClientHelloVersionLength   = 2
+	httpMaxRequestLineMethodBytes = 8
+)
+
+// Name returns the domain name found in the initial payload b.
+//
+// It tries the TLS ClientHello SNI first, then the HTTP Host header.
+// The returned name is lowercased and has no trailing dot.
+// If no domain name is found, or the name is an IP address, an empty string is returned.
+//
+// If the ClientHello offers Encrypted Client Hello, its SNI is only the public name of the
+// client-facing server, not the name the client is connecting to. An empty string is returned,
+// so that the connection is routed by its destination IP address.
+//
+// b may be truncated. Only the bytes in b are examined, so callers control
+// how much data is buffered and how long they wait for it.
+func Name(b []byte) string {
+	name, ech, ok := TLSClientHello(b)
+	if ok {
+		if ech {
+			return ""
+		}
+		return normalizeName(name)
+	}
+	name, ok = HTTPHost(b)
+	if !ok {
+		return ""
+	}
+	return normalizeName(name)
+}
+
+// normalizeName lowercases name and removes the trailing dot.
+// It returns an empty string if name is an IP address.
+func normalizeName(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if _, err := netip.ParseAddr(name); err == nil {
+		return ""
+	}
+	return name
+}
+
+// TLSServerName parses the server name indication from the TLS ClientHello at the start of b.
+// The ClientHello must be fully contained in the first record.
+func TLSServerName(b []byte) (string, bool) {
+	serverName, _, ok := TLSClientHello(b)
+	return serverName, ok && serverName != ""
+}
+
+// TLSClientHello parses the TLS ClientHello at the start of b, and returns its server name indication,
+// which is empty if the ClientHello has none, and whether it offers Encrypted Client Hello.
+// The ClientHello must be fully contained in the first record. ok is false if b does not start with
+// a complete and well-formed ClientHello.
+func TLSClientHello(b []byte) (serverName string, ech, ok bool) {
+	// Record header: type (1), legacy version (2), length (2).
+	if len(b) < tlsRecordHeaderLength || b[0] != tlsRecordTypeHandshake {
+		return "", false, false
+	}
+	recordLength := int(binary.BigEndian.Uint16(b[3:]))
+	b = b[tlsRecordHeaderLength:]
+	if len(b) > recordLength {
+		b = b[:recordLength]
+	}
+
+	// Handshake header: type (1), length (3).
+	if len(b) < tlsHandshakeHeaderLength || b[0] != tlsHandshakeTypeClientHello {
+		return "", false, false
+	}
+	helloLength := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+	b = b[tlsHandshakeHeaderLength:]
+	if len(b) < helloLength {
+		return "", false, false
+	}
+	b = b[:helloLength]
+
+	// Legacy version, random.
+	if len(b) < tlsClientHelloVersionLength+tlsClientHelloRandomLength {
+		return "", false, false
+	}
+	b = b[tlsClientHelloVersionLength+tlsClientHelloRandomLength:]
+
+	// Legacy session ID.
+	b, ok = skipVector8(b)
+	if !ok {
+		return "", false, false
+	}
+
+	// Cipher suites.
+	b, ok = skipVector16(b)
+	if !ok {
+		return "", false, false
+	}
+
+	// Legacy compression methods.
+	b, ok = skipVector8(b)
+	if !ok {
+		return "", false, false
+	}
+
+	// Extensions.
+	extensions, _, ok := readVector16(b)
+	if !ok {
+		return "", false, false
+	}
+
+	for len(extensions) >= 4 {
+		extensionType := binary.BigEndian.Uint16(extensions)
+		extensionData, rest, ok := readVector16(extensions[2:])
+		if !ok {
+			return "", false, false
+		}
+		extensions = rest
+
+		switch extensionType {
+		case tlsExtensionServerName:
+			serverName, ok = parseServerNameExtension(extensionData)
+			if !ok {
+				return "", false, false
+			}
+		case tlsExtensionECH:
+			ech = true
+		}
+	}
+
+	return serverName, ech, true
+}
+
+// parseServerNameExtension returns the host name in the server_name extension data b.
+func parseServerNameExtension(b []byte) (string, bool) {
+	serverNameList, _, ok := readVector16(b)
+	if !ok {
+		return "", false
+	}
+
+	for len(serverNameList) >= 3 {
+		nameType := serverNameList[0]
+		name, rest, ok := readVector16(serverNameList[1:])
+		if !ok {
+			return "", false
+		}
+		serverNameList = rest
+
+		if nameType == tlsServerNameTypeHostName && len(name) > 0 {
+			return string(name), true
+		}
+	}
+	return "", true
+}
+
+// readVector16 reads a vector with a 2-byte length prefix from b.
+func readVector16(b []byte) (vector, rest []byte, ok bool) {
+	if len(b) < 2 {
+		return nil, nil, false
+	}
+	length := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if len(b) < length {
+		return nil, nil, false
+	}
+	return b[:length], b[length:], true
+}
+
+// skipVector8 skips a vector with a 1-byte length prefix in b.
+func skipVector8(b []byte) ([]byte, bool) {
+	if len(b) < 1 {
+		return nil, false
+	}
+	length := int(b[0])
+	b = b[1:]
+	if len(b) < length {
+		return nil, false
+	}
+	return b[length:], true
+}
+
+// skipVector16 skips a vector with a 2-byte length prefix in b.
+func skipVector16(b []byte) ([]byte, bool) {
+	_, rest, ok := readVector16(b)
+	return rest, ok
+}
+
+// HTTPHost parses the Host header from the HTTP/1.x request at the start of b.
+// The port, if any, is removed from the returned host.
+func HTTPHost(b []byte) (string, bool) {
+	// Check that the request line starts with a method token followed by a space.
+	sp := bytes.IndexByte(b[:minInt(len(b), httpMaxRequestLineMethodBytes)], ' ')
+	if sp <= 0 {
+		return "", false
+	}
+	for _, c := range b[:sp] {
+		if c < 'A' || c > 'Z' {
+			return "", false
+		}
+	}
+
+	// Skip the request line.
+	i := bytes.Index(b, []byte("\r\n"))
+	if i == -1 {
+		return "", false
+	}
+	b = b[i+2:]
+
+	for {
+		i = bytes.Index(b, []byte("\r\n"))
+		if i <= 0 {
+			// Truncated headers or end of headers.
+			return "", false
+		}
+		line := b[:i]
+		b = b[i+2:]
+
+		colon := bytes.IndexByte(line, ':')
+		if colon == -1 || !strings.EqualFold(string(line[:colon]), "Host") {
+			continue
+		}
+
+		host := strings.TrimSpace(string(line[colon+1:]))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			return "", false
+		}
+		return host, true
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,140 @@
+package sniff
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// clientHello returns the first TLS record written by a client handshaking with serverName.
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	go func() {
+		tlsConn := tls.Client(clientConn, &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: serverName == "",
+		})
+		tlsConn.Handshake()
+		clientConn.Close()
+	}()
+
+	header := make([]byte, tlsRecordHeaderLength)
+	if _, err := io.ReadFull(serverConn, header); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(serverConn, body); err != nil {
+		t.Fatal(err)
+	}
+	return append(header, body...)
+}
+
+// withECH returns a copy of the ClientHello record hello with an encrypted_client_hello extension appended.
+func withECH(hello []byte) []byte {
+	// Dummy outer ECH payload: type, cipher suite, config ID, and empty enc and payload.
+	extension := []byte{0xfe, 0x0d, 0, 10, 0, 0, 1, 0, 1, 0, 0, 0, 0, 0}
+
+	b := append([]byte(nil), hello...)
+	i := tlsRecordHeaderLength + tlsHandshakeHeaderLength + tlsClientHelloVersionLength + tlsClientHelloRandomLength
+	i += 1 + int(b[i])                           // legacy session ID
+	i += 2 + int(binary.BigEndian.Uint16(b[i:])) // cipher suites
+	i += 1 + int(b[i])                           // legacy compression methods
+	extensionsLength := binary.BigEndian.Uint16(b[i:])
+	binary.BigEndian.PutUint16(b[i:], extensionsLength+uint16(len(extension)))
+
+	binary.BigEndian.PutUint16(b[3:], binary.BigEndian.Uint16(b[3:])+uint16(len(extension)))
+	helloLength := int(b[6])<<16 | int(b[7])<<8 | int(b[8]) + len(extension)
+	b[6], b[7], b[8] = byte(helloLength>>16), byte(helloLength>>8), byte(helloLength)
+
+	return append(b, extension...)
+}
+
+func TestTLSServerName(t *testing.T) {
+	hello := clientHello(t, "www.example.com")
+
+	name, ok := TLSServerName(hello)
+	if !ok || name != "www.example.com" {
+		t.Errorf("TLSServerName() returned %q, %v, expected %q, true", name, ok, "www.example.com")
+	}
+
+	for i := 0; i < len(hello); i++ {
+		if name, ok := TLSServerName(hello[:i]); ok {
+			t.Fatalf("TLSServerName() on truncated ClientHello of length %d returned %q", i, name)
+		}
+	}
+
+	if name, ok := TLSServerName(clientHello(t, "")); ok {
+		t.Errorf("TLSServerName() on ClientHello without SNI returned %q", name)
+	}
+}
+
+func TestTLSClientHello(t *testing.T) {
+	hello := clientHello(t, "www.example.com")
+
+	name, ech, ok := TLSClientHello(hello)
+	if !ok || ech || name != "www.example.com" {
+		t.Errorf("TLSClientHello() returned %q, %v, %v, expected %q, false, true", name, ech, ok, "www.example.com")
+	}
+
+	echHello := withECH(hello)
+	name, ech, ok = TLSClientHello(echHello)
+	if !ok || !ech || name != "www.example.com" {
+		t.Errorf("TLSClientHello() on ClientHello with ECH returned %q, %v, %v, expected %q, true, true", name, ech, ok, "www.example.com")
+	}
+
+	for i := 0; i < len(echHello); i++ {
+		if _, ech, ok := TLSClientHello(echHello[:i]); ok || ech {
+			t.Fatalf("TLSClientHello() on truncated ClientHello of length %d returned %v, %v", i, ech, ok)
+		}
+	}
+}
+
+func TestHTTPHost(t *testing.T) {
+	for _, c := range []struct {
+		request string
+		host    string
+		ok      bool
+	}{
+		{"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com", true},
+		{"POST /api HTTP/1.1\r\nUser-Agent: test\r\nhost:Example.com:8080\r\n\r\n", "Example.com", true},
+		{"GET / HTTP/1.1\r\nHost: [2001:db8::1]:80\r\n\r\n", "2001:db8::1", true},
+		{"GET / HTTP/1.1\r\nUser-Agent: test\r\n\r\nHost: example.com\r\n", "", false},
+		{"GET / HTTP/1.1\r\nHost: exam", "", false},
+		{"get / HTTP/1.1\r\nHost: example.com\r\n\r\n", "", false},
+		{"\x16\x03\x01", "", false},
+	} {
+		host, ok := HTTPHost([]byte(c.request))
+		if host != c.host || ok != c.ok {
+			t.Errorf("HTTPHost(%q) returned %q, %v, expected %q, %v", c.request, host, ok, c.host, c.ok)
+		}
+	}
+}
+
+func TestName(t *testing.T) {
+	if name := Name(clientHello(t, "WWW.Example.com")); name != "www.example.com" {
+		t.Errorf("Name() on ClientHello returned %q, expected %q", name, "www.example.com")
+	}
+
+	// The SNI of a ClientHello offering ECH is only the public name, so routing falls back to the destination.
+	if name := Name(withECH(clientHello(t, "public.example.com"))); name != "" {
+		t.Errorf("Name() on ClientHello with ECH returned %q, expected empty string", name)
+	}
+
+	if name := Name([]byte("GET / HTTP/1.1\r\nHost: Example.com.\r\n\r\n")); name != "example.com" {
+		t.Errorf("Name() on HTTP request returned %q, expected %q", name, "example.com")
+	}
+
+	if name := Name([]byte("GET / HTTP/1.1\r\nHost: 192.0.2.1\r\n\r\n")); name != "" {
+		t.Errorf("Name() on HTTP request to IP address returned %q, expected empty string", name)
+	}
+
+	if name := Name([]byte("SSH-2.0-OpenSSH_9.0\r\n")); name != "" {
+		t.Errorf("Name() on non-TLS non-HTTP stream returned %q, expected empty string", name)
+	}
+}
@@ -30,6 +30,10 @@ const (
 	MaxAddrLen = 1 + 1 + 255 + 2
 )
 
+// ErrBufferTooSmall is returned by functions that write into or read from a caller-provided buffer
+// when the buffer is too small for the operation.
+var ErrBufferTooSmall = errors.New("buffer too small")
+
 // AppendAddrFromAddrPort appends the netip.AddrPort to the buffer in the SOCKS address format.
 //
 // If the address is an IPv4-mapped IPv6 address, it is converted to an IPv4 address.
@@ -55,19 +59,24 @@ func AppendAddrFromAddrPort(b []byte, addrPort netip.AddrPort) []byte {
 //
 // If the address is an IPv4-mapped IPv6 address, it is converted to an IPv4 address.
 //
-// This function does not check whether b has sufficient space for the address.
-// The caller may call [LengthOfAddrFromAddrPort] to get the required length.
-func WriteAddrFromAddrPort(b []byte, addrPort netip.AddrPort) (n int) {
+// If b is shorter than [LengthOfAddrFromAddrPort], nothing is written and [ErrBufferTooSmall] is returned.
+func WriteAddrFromAddrPort(b []byte, addrPort netip.AddrPort) (n int, err error) {
 	ip := addrPort.Addr()
 	switch {
 	case ip.Is4() || ip.Is4In6():
+		n = 1 + 4 + 2
+		if len(b) < n {
+			return 0, fmt.Errorf("%w: need %d, got %d", ErrBufferTooSmall, n, len(b))
+		}
 		b[0] = AtypIPv4
 		*(*[4]byte)(b[1:]) = ip.As4()
-		n = 1 + 4 + 2
 	default:
+		n = 1 + 16 + 2
+		if len(b) < n {
+			return 0, fmt.Errorf("%w: need %d, got %d", ErrBufferTooSmall, n, len(b))
+		}
 		b[0] = AtypIPv6
 		*(*[16]byte)(b[1:]) = ip.As16()
-		n = 1 + 16 + 2
 	}
 	binary.BigEndian.PutUint16(b[n-2:], addrPort.Port())
 	return
@@ -106,14 +115,18 @@ func AppendAddrFromConnAddr(b []byte, addr conn.Addr) []byte {
 //
 // If the address is an IPv4-mapped IPv6 address, it is converted to an IPv4 address.
 //
-// This function does not check whether b has sufficient space for the address.
-// The caller may call [LengthOfAddrFromConnAddr] to get the required length.
-func WriteAddrFromConnAddr(b []byte, addr conn.Addr) int {
+// If b is shorter than [LengthOfAddrFromConnAddr], nothing is written and [ErrBufferTooSmall] is returned.
+func WriteAddrFromConnAddr(b []byte, addr conn.Addr) (int, error) {
 	if addr.IsIP() {
 		return WriteAddrFromAddrPort(b, addr.IPPort())
 	}
 
 	domain := addr.Domain()
+	n := 1 + 1 + len(domain) + 2
+	if len(b) < n {
+		return 0, fmt.Errorf("%w: need %d, got %d", ErrBufferTooSmall, n, len(b))
+	}
+
 	b[0] = AtypDomainName
 	b[1] = byte(len(domain))
 	copy(b[2:], domain)
@@ -121,7 +134,7 @@ func WriteAddrFromConnAddr(b []byte, addr conn.Addr) int {
 	port := addr.Port()
 	binary.BigEndian.PutUint16(b[1+1+len(domain):], port)
 
-	return 1 + 1 + len(domain) + 2
+	return n, nil
 }
 
 // LengthOfAddrFromConnAddr returns the length of a SOCKS address converted from the conn.Addr.
@@ -135,6 +148,9 @@ func LengthOfAddrFromConnAddr(addr conn.Addr) int {
 
 // AppendFromReader reads just enough bytes from r to get a valid Addr
 // and appends it to the buffer.
+//
+// If b has at least [MaxAddrLen] bytes of spare capacity, the address is read in place
+// and the returned slice shares b's underlying array. Otherwise, appending may reallocate.
 func AppendFromReader(b []byte, r io.Reader) ([]byte, error) {
 	ret, out := slices.Extend(b, 2)
 
@@ -3,6 +3,7 @@ package socks5
 import (
 	"bytes"
 	"crypto/rand"
+	"errors"
 	"io"
 	"net/netip"
 	"testing"
@@ -79,6 +80,44 @@ func TestAddrFromReader(t *testing.T) {
 	testAddrFromReader(t, addrDomain)
 }
 
+func TestAppendFromReaderInPlace(t *testing.T) {
+	domain := bytes.Repeat([]byte{'a'}, 255)
+	maxDomainAddr := make([]byte, 0, MaxAddrLen)
+	maxDomainAddr = append(maxDomainAddr, AtypDomainName, 255)
+	maxDomainAddr = append(maxDomainAddr, domain...)
+	maxDomainAddr = append(maxDomainAddr, 1, 187)
+	if len(maxDomainAddr) != MaxAddrLen {
+		t.Fatalf("len(maxDomainAddr) = %d, expected %d", len(maxDomainAddr), MaxAddrLen)
+	}
+
+	// Same layout as the buffers in ClientRequest and ServerAccept.
+	b := make([]byte, 3+MaxAddrLen)
+	r := bytes.NewReader(nil)
+
+	for _, addr := range [][]byte{addr4, addr6, addrDomain, maxDomainAddr} {
+		var (
+			sa  []byte
+			err error
+		)
+		allocs := testing.AllocsPerRun(10, func() {
+			r.Reset(addr)
+			sa, err = AppendFromReader(b[3:3], r)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allocs != 0 {
+			t.Errorf("AppendFromReader allocated %f times for %v", allocs, addr)
+		}
+		if &sa[0] != &b[3] {
+			t.Errorf("AppendFromReader reallocated the buffer for %v", addr)
+		}
+		if !bytes.Equal(sa, addr) {
+			t.Errorf("AppendFromReader returned %v, expected %v", sa, addr)
+		}
+	}
+}
+
 func testAddrPortFromSlice(t *testing.T, sa []byte, expectedAddrPort netip.AddrPort, expectedN int, expectedErr error) {
 	b := make([]byte, 512)
 	n := copy(b, sa)
@@ -250,7 +289,10 @@ func testLengthOfAndWriteAddrFromConnAddr(t *testing.T, addr conn.Addr, expected
 	tail := make([]byte, 512-addrLen)
 	copy(tail, b[addrLen:])
 
-	n := WriteAddrFromConnAddr(b, addr)
+	n, err := WriteAddrFromConnAddr(b, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if n != len(expectedSA) {
 		t.Errorf("WriteAddrFromConnAddr(b, addr) returned n=%d, expected n=%d.", n, len(expectedSA))
 	}
@@ -268,3 +310,29 @@ func TestLengthOfAndWriteAddrFromConnAddr(t *testing.T) {
 	testLengthOfAndWriteAddrFromConnAddr(t, addr6connaddr, addr6)
 	testLengthOfAndWriteAddrFromConnAddr(t, addrDomainConnAddr, addrDomain)
 }
+
+func TestWriteAddrFromConnAddrBufferTooSmall(t *testing.T) {
+	for _, addr := range []conn.Addr{addr4connaddr, addr6connaddr, addrDomainConnAddr} {
+		b := make([]byte, LengthOfAddrFromConnAddr(addr)-1)
+		n, err := WriteAddrFromConnAddr(b, addr)
+		if !errors.Is(err, ErrBufferTooSmall) {
+			t.Errorf("WriteAddrFromConnAddr(b, %s) returned error %v, expected %v.", addr, err, ErrBufferTooSmall)
+		}
+		if n != 0 {
+			t.Errorf("WriteAddrFromConnAddr(b, %s) returned n=%d, expected n=0.", addr, n)
+		}
+		if !bytes.Equal(b, make([]byte, len(b))) {
+			t.Errorf("WriteAddrFromConnAddr(b, %s) modified the buffer.", addr)
+		}
+	}
+}
+
+func TestPacketHeaderBufferTooSmall(t *testing.T) {
+	b := make([]byte, 2)
+	if err := WritePacketHeader(b); !errors.Is(err, ErrBufferTooSmall) {
+		t.Errorf("WritePacketHeader(b) returned error %v, expected %v.", err, ErrBufferTooSmall)
+	}
+	if err := ValidatePacketHeader(b); !errors.Is(err, ErrBufferTooSmall) {
+		t.Errorf("ValidatePacketHeader(b) returned error %v, expected %v.", err, ErrBufferTooSmall)
+	}
+}
@@ -0,0 +1,201 @@
+package socks5
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Username/password authentication as defined in RFC 1929.
+const (
+	UsernamePasswordVersion = 1
+
+	UsernamePasswordStatusSuccess = 0
+	UsernamePasswordStatusFailure = 1
+)
+
+// Private authentication methods are in the range reserved by RFC 1928 section 3.
+const (
+	MethodPrivateFirst = 0x80
+	MethodPrivateLast  = 0xFE
+)
+
+var (
+	ErrNotPrivateMethod          = errors.New("method is not in the private range 0x80-0xFE")
+	ErrNilPrivateMethodHandler   = errors.New("private method handler is nil")
+	ErrIncorrectUsernamePassword = errors.New("incorrect username or password")
+	ErrBadUsernameLength         = errors.New("username length must be between 1 and 255 bytes")
+	ErrBadPasswordLength         = errors.New("password length must be between 1 and 255 bytes")
+)
+
+// Authenticator verifies username/password credentials.
+//
+// Implementations may consult external sources, cache results,
+// and lock out clients after repeated failures.
+// Authenticate must be safe for concurrent use.
+type Authenticator interface {
+	// Authenticate reports whether the credentials are valid.
+	// A non-nil error indicates that the credentials could not be verified.
+	Authenticate(username, password string) (ok bool, err error)
+}
+
+// UserInfo stores a user's credentials.
+// It may be marshaled as or unmarshaled from JSON.
+type UserInfo struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Validate checks that the username and password fit in a username/password request.
+func (u UserInfo) Validate() error {
+	if len(u.Username) < 1 || len(u.Username) > 255 {
+		return fmt.Errorf("%w: %d", ErrBadUsernameLength, len(u.Username))
+	}
+	if len(u.Password) < 1 || len(u.Password) > 255 {
+		return fmt.Errorf("%w: %d", ErrBadPasswordLength, len(u.Password))
+	}
+	return nil
+}
+
+// AppendAuthMsg appends the username/password request with the user's credentials to b.
+// It returns an error without appending if the credentials fail [UserInfo.Validate].
+func (u UserInfo) AppendAuthMsg(b []byte) ([]byte, error) {
+	if err := u.Validate(); err != nil {
+		return b, err
+	}
+	b = append(b, UsernamePasswordVersion, byte(len(u.Username)))
+	b = append(b, u.Username...)
+	b = append(b, byte(len(u.Password)))
+	return append(b, u.Password...), nil
+}
+
+// PrivateMethodHandler runs the method-specific sub-negotiation of a private authentication method
+// after the method has been selected, and returns the authenticated username.
+// The username may be empty if the method does not identify users.
+//
+// The handler must read exactly the bytes of the sub-negotiation, and must return a non-nil error
+// if authentication fails. The connection is closed by the caller on error.
+type PrivateMethodHandler func(rw io.ReadWriter) (username string, err error)
+
+// PrivateMethod is a vendor-specific authentication method.
+type PrivateMethod struct {
+	// Method is the method number. It must be between MethodPrivateFirst and MethodPrivateLast.
+	Method byte
+
+	// Handler authenticates the client after Method is selected.
+	Handler PrivateMethodHandler
+}
+
+// Validate checks that the method number is in the private range and the handler is set.
+func (m PrivateMethod) Validate() error {
+	if m.Method < MethodPrivateFirst || m.Method > MethodPrivateLast {
+		return fmt.Errorf("%w: %#x", ErrNotPrivateMethod, m.Method)
+	}
+	if m.Handler == nil {
+		return ErrNilPrivateMethodHandler
+	}
+	return nil
+}
+
+// MapAuthenticator authenticates users from a static map of usernames to user info.
+//
+// MapAuthenticator implements the Authenticator interface.
+type MapAuthenticator map[string]UserInfo
+
+// NewMapAuthenticator returns a MapAuthenticator for the given users.
+// If multiple users share the same username, the last one wins.
+func NewMapAuthenticator(users []UserInfo) MapAuthenticator {
+	m := make(MapAuthenticator, len(users))
+	for _, u := range users {
+		m[u.Username] = u
+	}
+	return m
+}
+
+// Authenticate implements the Authenticator Authenticate method.
+func (m MapAuthenticator) Authenticate(username, password string) (bool, error) {
+	u, ok := m[username]
+	if !ok {
+		return false, nil
+	}
+	return subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) == 1, nil
+}
+
+// serverHandleUsernamePasswordAuth reads the client's username/password request,
+// verifies the credentials with authenticator, and replies with the status.
+// It returns the authenticated username.
+func serverHandleUsernamePasswordAuth(rw io.ReadWriter, authenticator Authenticator) (string, error) {
+	// The buffer must be large enough for VER, ULEN, the largest UNAME, PLEN, and the largest PASSWD.
+	//
+	// 	+----+------+----------+------+----------+
+	// 	|VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+	// 	+----+------+----------+------+----------+
+	// 	| 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+	// 	+----+------+----------+------+----------+
+	b := make([]byte, 1+1+255+1+255)
+
+	// Read VER, ULEN.
+	_, err := io.ReadFull(rw, b[:2])
+	if err != nil {
+		return "", err
+	}
+
+	// Check VER.
+	if b[0] != UsernamePasswordVersion {
+		return "", fmt.Errorf("unsupported username/password authentication version: %d", b[0])
+	}
+
+	// Check ULEN.
+	ulen := int(b[1])
+	if ulen == 0 {
+		return "", fmt.Errorf("ULEN is %d", ulen)
+	}
+
+	// Read UNAME, PLEN.
+	unameEnd := 2 + ulen
+	_, err = io.ReadFull(rw, b[2:unameEnd+1])
+	if err != nil {
+		return "", err
+	}
+	uname := b[2:unameEnd]
+
+	// Check PLEN.
+	plen := int(b[unameEnd])
+	if plen == 0 {
+		return "", fmt.Errorf("PLEN is %d", plen)
+	}
+
+	// Read PASSWD.
+	passwd := b[unameEnd+1 : unameEnd+1+plen]
+	_, err = io.ReadFull(rw, passwd)
+	if err != nil {
+		return "", err
+	}
+
+	ok, authErr := authenticator.Authenticate(string(uname), string(passwd))
+
+	// Write reply.
+	//
+	// 	+----+--------+
+	// 	|VER | STATUS |
+	// 	+----+--------+
+	// 	| 1  |   1    |
+	// 	+----+--------+
+	status := byte(UsernamePasswordStatusSuccess)
+	if authErr != nil || !ok {
+		status = UsernamePasswordStatusFailure
+	}
+	_, err = rw.Write([]byte{UsernamePasswordVersion, status})
+
+	switch {
+	case authErr != nil:
+		return "", fmt.Errorf("failed to authenticate user %q: %w", uname, authErr)
+	case !ok:
+		return "", fmt.Errorf("%w: user %q", ErrIncorrectUsernamePassword, uname)
+	case err != nil:
+		return "", err
+	default:
+		return string(uname), nil
+	}
+}
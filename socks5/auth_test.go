@@ -0,0 +1,42 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestUserInfoAppendAuthMsg(t *testing.T) {
+	prefix := []byte{Version}
+
+	b, err := UserInfo{Username: "alice", Password: "pw"}.AppendAuthMsg(prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{Version, UsernamePasswordVersion, 5, 'a', 'l', 'i', 'c', 'e', 2, 'p', 'w'}
+	if !bytes.Equal(b, expected) {
+		t.Errorf("AppendAuthMsg() returned %v, expected %v", b, expected)
+	}
+
+	for _, c := range []struct {
+		name        string
+		u           UserInfo
+		expectedErr error
+	}{
+		{"EmptyUsername", UserInfo{Password: "pw"}, ErrBadUsernameLength},
+		{"LongUsername", UserInfo{Username: strings.Repeat("u", 256), Password: "pw"}, ErrBadUsernameLength},
+		{"EmptyPassword", UserInfo{Username: "alice"}, ErrBadPasswordLength},
+		{"LongPassword", UserInfo{Username: "alice", Password: strings.Repeat("p", 300)}, ErrBadPasswordLength},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			b, err := c.u.AppendAuthMsg(prefix)
+			if !errors.Is(err, c.expectedErr) {
+				t.Errorf("Expected error %v, got %v", c.expectedErr, err)
+			}
+			if !bytes.Equal(b, prefix) {
+				t.Errorf("AppendAuthMsg() appended %v on error", b[len(prefix):])
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net/netip"
+	"testing"
+
+	"github.com/database64128/shadowsocks-go/conn"
+)
+
+const (
+	// maxRequestLength is the maximum length of a request, or of its reply.
+	maxRequestLength = 3 + MaxAddrLen
+
+	// maxMethodSelectionLength is the maximum length of a version identifier/method selection message.
+	maxMethodSelectionLength = 2 + 255
+
+	// maxHandshakeAllocs is the maximum number of allocations made by a server handshake,
+	// regardless of the input.
+	maxHandshakeAllocs = 8
+)
+
+// fuzzReadWriter reads from a byte slice, discards writes, and counts the bytes read and written.
+type fuzzReadWriter struct {
+	r       bytes.Reader
+	read    int
+	written int
+}
+
+// reset makes rw read from b, and resets the counters.
+func (rw *fuzzReadWriter) reset(b []byte) {
+	rw.r.Reset(b)
+	rw.read = 0
+	rw.written = 0
+}
+
+func (rw *fuzzReadWriter) Read(b []byte) (n int, err error) {
+	n, err = rw.r.Read(b)
+	rw.read += n
+	return
+}
+
+func (rw *fuzzReadWriter) Write(b []byte) (int, error) {
+	rw.written += len(b)
+	return len(b), nil
+}
+
+// checkHandshake runs handshake on a fuzzReadWriter of b, and fails t if the handshake
+// reads or writes more than maxLength bytes, or allocates more than [maxHandshakeAllocs] times.
+func checkHandshake(t *testing.T, b []byte, maxLength int, handshake func(rw io.ReadWriter)) {
+	var rw fuzzReadWriter
+	allocs := testing.AllocsPerRun(1, func() {
+		rw.reset(b)
+		handshake(&rw)
+	})
+	if rw.read > maxLength {
+		t.Fatalf("Handshake read %d bytes, expected at most %d", rw.read, maxLength)
+	}
+	if rw.written > maxLength {
+		t.Fatalf("Handshake wrote %d bytes, expected at most %d", rw.written, maxLength)
+	}
+	if allocs > maxHandshakeAllocs {
+		t.Fatalf("Handshake allocated %v times, expected at most %d", allocs, maxHandshakeAllocs)
+	}
+}
+
+func FuzzServerHandleRequest(f *testing.F) {
+	f.Add([]byte{Version, CmdConnect, 0, AtypIPv4, 127, 0, 0, 1, 0, 80})
+	f.Add([]byte{Version, CmdConnect, 0, AtypDomainName, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 1, 187})
+	f.Add([]byte{Version, CmdUDPAssociate, 0, AtypIPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 53})
+	f.Add([]byte{Version, CmdConnect, 0, AtypDomainName, 0, 0, 80})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		checkHandshake(t, b, maxRequestLength, func(rw io.ReadWriter) {
+			// UDP ASSOCIATE requires a TCP connection, so only CONNECT is enabled here.
+			_, _ = serverHandleRequest(rw, true, false, Succeeded, 0, nil, nil)
+		})
+	})
+}
+
+func FuzzServerAccept(f *testing.F) {
+	f.Add([]byte{Version, 1, MethodNoAuthenticationRequired, Version, CmdConnect, 0, AtypIPv4, 127, 0, 0, 1, 0, 80})
+	f.Add([]byte{Version, 2, MethodUsernamePassword, MethodNoAuthenticationRequired})
+	f.Add([]byte{Version, 0})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		checkHandshake(t, b, maxMethodSelectionLength+maxRequestLength, func(rw io.ReadWriter) {
+			_, _ = ServerAccept(rw, true, false, Succeeded, 0, nil)
+		})
+	})
+}
+
+func FuzzConnAddrFromSlice(f *testing.F) {
+	f.Add([]byte{AtypIPv4, 127, 0, 0, 1, 0, 80})
+	f.Add([]byte{AtypIPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 53})
+	f.Add([]byte{AtypDomainName, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 1, 187})
+	f.Add([]byte{AtypDomainName, 0, 0, 80})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		addr, n, err := ConnAddrFromSlice(b)
+		if err != nil {
+			return
+		}
+		if n > len(b) || n > MaxAddrLen {
+			t.Fatalf("ConnAddrFromSlice consumed %d bytes from a %d-byte slice", n, len(b))
+		}
+
+		// Only a domain name is copied out of b.
+		if allocs := testing.AllocsPerRun(1, func() { _, _, _ = ConnAddrFromSlice(b) }); allocs > 1 {
+			t.Fatalf("ConnAddrFromSlice allocated %v times, expected at most 1", allocs)
+		}
+
+		// The address must survive a round trip.
+		// IPv4-mapped IPv6 addresses are converted to IPv4 addresses when encoded.
+		expectedAddr := addr
+		if addr.IsIP() {
+			expectedAddr = conn.AddrFromIPPort(netip.AddrPortFrom(addr.IP().Unmap(), addr.Port()))
+		}
+		sa := AppendAddrFromConnAddr(nil, addr)
+		addr1, n1, err := ConnAddrFromSlice(sa)
+		if err != nil {
+			t.Fatalf("Failed to parse re-encoded address %v: %v", addr, err)
+		}
+		if addr1 != expectedAddr || n1 != len(sa) {
+			t.Fatalf("Round trip mismatch: %v (%d) != %v (%d)", addr1, n1, expectedAddr, len(sa))
+		}
+
+		_, _, _ = AddrPortFromSlice(b)
+		_, _, _, _ = ConnAddrFromSliceWithDomainCache(b, "")
+	})
+}
@@ -1,20 +1,30 @@
 package socks5
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var ErrFragmentationNotSupported = errors.New("packet fragmentation is not supported")
 
 // WritePacketHeader writes RSV and FRAG to the beginning of b.
-// The length of b must be at least 3 bytes.
-func WritePacketHeader(b []byte) {
+// If b is shorter than 3 bytes, nothing is written and [ErrBufferTooSmall] is returned.
+func WritePacketHeader(b []byte) error {
+	if len(b) < 3 {
+		return fmt.Errorf("%w: need 3, got %d", ErrBufferTooSmall, len(b))
+	}
 	b[0] = 0 // RSV
 	b[1] = 0 // RSV
 	b[2] = 0 // FRAG
+	return nil
 }
 
 // ValidatePacketHeader validates RSV and FRAG at the beginning of b.
-// The length of b must be at least 3 bytes.
+// If b is shorter than 3 bytes, [ErrBufferTooSmall] is returned.
 func ValidatePacketHeader(b []byte) error {
+	if len(b) < 3 {
+		return fmt.Errorf("%w: need 3, got %d", ErrBufferTooSmall, len(b))
+	}
 	if b[2] != 0 {
 		return ErrFragmentationNotSupported
 	}
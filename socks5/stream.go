@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"time"
 
 	"github.com/database64128/shadowsocks-go/conn"
 )
@@ -46,8 +48,17 @@ var (
 	ErrUnsupportedAuthenticationMethod = errors.New("unsupported authentication method")
 	ErrUnsupportedCommand              = errors.New("unsupported command")
 	ErrUDPAssociateDone                = errors.New("UDP ASSOCIATE done")
+	ErrIPv6TargetRejected              = errors.New("IPv6 target rejected")
+	ErrUDPAssociateMaxHoldExceeded     = errors.New("UDP ASSOCIATE max hold time exceeded")
+	ErrTargetNotAuthorized             = errors.New("target not authorized for user")
 )
 
+// UDPAssociateKeepAlivePeriod is the TCP keep-alive period of UDP ASSOCIATE control connections.
+//
+// The control connection is idle for the lifetime of the association.
+// A short keep-alive period allows dead clients to be detected and their associations torn down promptly.
+const UDPAssociateKeepAlivePeriod = 15 * time.Second
+
 // replyWithStatus writes a reply to w with the REP field set to status.
 func replyWithStatus(w io.Writer, status byte) error {
 	_, err := w.Write([]byte{Version, status, 0, 1, 0, 0, 0, 0, 0, 0})
@@ -84,7 +95,10 @@ func ClientRequest(rw io.ReadWriter, command byte, targetAddr conn.Addr) (addr c
 
 	// Write VER, CMD, RSV, SOCKS address.
 	b[1] = command
-	n := WriteAddrFromConnAddr(b[3:], targetAddr)
+	n, err := WriteAddrFromConnAddr(b[3:], targetAddr)
+	if err != nil {
+		return
+	}
 	_, err = rw.Write(b[:3+n])
 	if err != nil {
 		return
@@ -109,6 +123,7 @@ func ClientRequest(rw io.ReadWriter, command byte, targetAddr conn.Addr) (addr c
 	}
 
 	// Read SOCKS address.
+	// b[3:3] has MaxAddrLen bytes of capacity, so the address is read in place without allocating.
 	sa, err := AppendFromReader(b[3:3], rw)
 	if err != nil {
 		return
@@ -131,54 +146,154 @@ func ClientUDPAssociate(rw io.ReadWriter, targetAddr conn.Addr) (conn.Addr, erro
 // ServerAccept processes an incoming request from r.
 // enableTCP enables the CONNECT command.
 // enableUDP enables the UDP ASSOCIATE command.
-// conn must be provided when UDP is enabled.
-func ServerAccept(rw io.ReadWriter, enableTCP, enableUDP bool, tc *net.TCPConn) (addr conn.Addr, err error) {
-	b := make([]byte, 3+MaxAddrLen)
+// tc is the underlying TCP connection, used by UDP ASSOCIATE to configure keep-alive
+// and to return the bound address. If tc is nil, UDP ASSOCIATE is rejected with
+// "command not supported", so CONNECT-only proxying works over other stream transports,
+// such as Unix domain sockets.
+// If ipv6Reply is not Succeeded, CONNECT requests to IPv6 addresses are rejected with ipv6Reply,
+// so clients of a server without IPv6 egress fail fast instead of waiting for a dial to fail.
+// If udpAssociateMaxHold is positive, UDP ASSOCIATE control connections are held open for at most
+// udpAssociateMaxHold, after which ErrUDPAssociateMaxHoldExceeded is returned and the caller should
+// close the connection. Together with keep-alive, this reaps both dead and idle-but-alive clients.
+//
+// ServerAccept reads exactly the bytes of the handshake and does not buffer.
+// Any data pipelined by the client after the request remains unread in rw,
+// so callers can relay directly from the underlying connection without losing early data.
+func ServerAccept(rw io.ReadWriter, enableTCP, enableUDP bool, ipv6Reply byte, udpAssociateMaxHold time.Duration, tc *net.TCPConn) (addr conn.Addr, err error) {
+	if _, err = serverHandleMethodSelection(rw, MethodNoAuthenticationRequired); err != nil {
+		return
+	}
+	return serverHandleRequest(rw, enableTCP, enableUDP, ipv6Reply, udpAssociateMaxHold, tc, nil)
+}
 
-	// Read VER, NMETHODS.
-	_, err = io.ReadFull(rw, b[:2])
+// ServerAcceptUsernamePassword is like [ServerAccept] but requires the client to
+// authenticate with the username/password method defined in RFC 1929.
+// Credentials are verified by authenticator. The authenticated username is returned.
+// If authorizeTarget is not nil, CONNECT requests to targets it does not authorize for the user
+// are rejected with ErrConnectionNotAllowed.
+func ServerAcceptUsernamePassword(rw io.ReadWriter, authenticator Authenticator, authorizeTarget TargetAuthorizer, enableTCP, enableUDP bool, ipv6Reply byte, udpAssociateMaxHold time.Duration, tc *net.TCPConn) (addr conn.Addr, username string, err error) {
+	if _, err = serverHandleMethodSelection(rw, MethodUsernamePassword); err != nil {
+		return
+	}
+	if username, err = serverHandleUsernamePasswordAuth(rw, authenticator); err != nil {
+		return
+	}
+	addr, err = serverHandleRequest(rw, enableTCP, enableUDP, ipv6Reply, udpAssociateMaxHold, tc, authorizeTarget.forUser(username))
+	return
+}
+
+// ServerAcceptPrivateMethod is like [ServerAccept] but requires the client to
+// authenticate with the private method pm.
+// If authenticator is not nil, the client may instead authenticate with the username/password method.
+// The private method is preferred when the client offers both.
+// The username returned by the selected method is returned.
+// If authorizeTarget is not nil, CONNECT requests to targets it does not authorize for the user
+// are rejected with ErrConnectionNotAllowed.
+func ServerAcceptPrivateMethod(rw io.ReadWriter, pm PrivateMethod, authenticator Authenticator, authorizeTarget TargetAuthorizer, enableTCP, enableUDP bool, ipv6Reply byte, udpAssociateMaxHold time.Duration, tc *net.TCPConn) (addr conn.Addr, username string, err error) {
+	if err = pm.Validate(); err != nil {
+		return
+	}
+
+	methods := []byte{pm.Method}
+	if authenticator != nil {
+		methods = append(methods, MethodUsernamePassword)
+	}
+
+	method, err := serverHandleMethodSelection(rw, methods...)
+	if err != nil {
+		return
+	}
+
+	switch method {
+	case MethodUsernamePassword:
+		username, err = serverHandleUsernamePasswordAuth(rw, authenticator)
+	default:
+		username, err = pm.Handler(rw)
+	}
 	if err != nil {
 		return
 	}
 
+	addr, err = serverHandleRequest(rw, enableTCP, enableUDP, ipv6Reply, udpAssociateMaxHold, tc, authorizeTarget.forUser(username))
+	return
+}
+
+// serverHandleMethodSelection reads the client's version identifier/method selection message
+// and selects the first of methods offered by the client. Methods are in order of server preference.
+func serverHandleMethodSelection(rw io.ReadWriter, methods ...byte) (byte, error) {
+	// NMETHODS is a single byte, so the largest METHODS field fits in 255 bytes.
+	b := make([]byte, 255)
+
+	// Read VER, NMETHODS.
+	_, err := io.ReadFull(rw, b[:2])
+	if err != nil {
+		return 0, err
+	}
+
 	// Check VER.
 	if b[0] != Version {
-		err = fmt.Errorf("%w: %d", ErrUnsupportedSocksVersion, b[0])
-		return
+		return 0, fmt.Errorf("%w: %d", ErrUnsupportedSocksVersion, b[0])
 	}
 
 	// Check NMETHODS.
-	if b[1] == 0 {
-		err = fmt.Errorf("NMETHODS is %d", b[1])
-		return
+	nmethods := int(b[1])
+	if nmethods == 0 {
+		return 0, fmt.Errorf("NMETHODS is %d", nmethods)
+	}
+	// Unreachable while b holds 255 bytes, but keeps the slicing below safe if the buffer ever shrinks.
+	if nmethods > len(b) {
+		return 0, fmt.Errorf("NMETHODS %d exceeds method selection buffer size %d", nmethods, len(b))
 	}
 
 	// Read METHODS.
-	_, err = io.ReadFull(rw, b[:b[1]])
+	clientMethods := b[:nmethods]
+	_, err = io.ReadFull(rw, clientMethods)
 	if err != nil {
-		return
+		return 0, err
 	}
 
 	// Check METHODS.
-	if bytes.IndexByte(b[:b[1]], MethodNoAuthenticationRequired) == -1 {
-		_, err = rw.Write([]byte{Version, MethodNoAcceptable})
-		if err == nil {
-			err = ErrUnsupportedAuthenticationMethod
+	for _, method := range methods {
+		if bytes.IndexByte(clientMethods, method) == -1 {
+			continue
 		}
-		return
+
+		// Write method selection message.
+		//
+		// 	+-----+--------+
+		// 	| VER | METHOD |
+		// 	+-----+--------+
+		// 	|  1  |   1    |
+		// 	+-----+--------+
+		_, err = rw.Write([]byte{Version, method})
+		return method, err
 	}
 
-	// Write method selection message.
-	//
-	// 	+-----+--------+
-	// 	| VER | METHOD |
-	// 	+-----+--------+
-	// 	|  1  |   1    |
-	// 	+-----+--------+
-	_, err = rw.Write([]byte{Version, MethodNoAuthenticationRequired})
-	if err != nil {
-		return
+	_, err = rw.Write([]byte{Version, MethodNoAcceptable})
+	if err == nil {
+		err = ErrUnsupportedAuthenticationMethod
 	}
+	return 0, err
+}
+
+// TargetAuthorizer reports whether an authenticated user may CONNECT to a target.
+// It must be safe for concurrent use.
+type TargetAuthorizer func(username string, targetAddr conn.Addr) bool
+
+// forUser returns a function that authorizes targets for username, or nil if a is nil.
+func (a TargetAuthorizer) forUser(username string) func(targetAddr conn.Addr) bool {
+	if a == nil {
+		return nil
+	}
+	return func(targetAddr conn.Addr) bool {
+		return a(username, targetAddr)
+	}
+}
+
+// serverHandleRequest reads the client's request and replies to it.
+// If authorize is not nil, CONNECT requests to targets it does not authorize are rejected.
+func serverHandleRequest(rw io.ReadWriter, enableTCP, enableUDP bool, ipv6Reply byte, udpAssociateMaxHold time.Duration, tc *net.TCPConn, authorize func(targetAddr conn.Addr) bool) (addr conn.Addr, err error) {
+	b := make([]byte, 3+MaxAddrLen)
 
 	// Read VER, CMD, RSV.
 	_, err = io.ReadFull(rw, b[:3])
@@ -193,6 +308,7 @@ func ServerAccept(rw io.ReadWriter, enableTCP, enableUDP bool, tc *net.TCPConn)
 	}
 
 	// Read SOCKS address.
+	// b[3:3] has MaxAddrLen bytes of capacity, so the address is read in place without allocating.
 	sa, err := AppendFromReader(b[3:3], rw)
 	if err != nil {
 		return
@@ -203,10 +319,30 @@ func ServerAccept(rw io.ReadWriter, enableTCP, enableUDP bool, tc *net.TCPConn)
 	}
 
 	switch {
+	case b[1] == CmdConnect && enableTCP && ipv6Reply != Succeeded && addr.IsIP() && !addr.IP().Unmap().Is4():
+		err = replyWithStatus(rw, ipv6Reply)
+		if err == nil {
+			err = fmt.Errorf("%w: %s", ErrIPv6TargetRejected, addr)
+		}
+
+	case b[1] == CmdConnect && enableTCP && authorize != nil && !authorize(addr):
+		err = replyWithStatus(rw, ErrConnectionNotAllowed)
+		if err == nil {
+			err = fmt.Errorf("%w: %s", ErrTargetNotAuthorized, addr)
+		}
+
 	case b[1] == CmdConnect && enableTCP:
 		err = replyWithStatus(rw, Succeeded)
 
-	case b[1] == CmdUDPAssociate && enableUDP:
+	case b[1] == CmdUDPAssociate && enableUDP && tc != nil:
+		// Enable keep-alive on the control connection.
+		if err = tc.SetKeepAlive(true); err != nil {
+			return
+		}
+		if err = tc.SetKeepAlivePeriod(UDPAssociateKeepAlivePeriod); err != nil {
+			return
+		}
+
 		// Use the connection's local address as the returned UDP bound address.
 		localAddrPort := tc.LocalAddr().(*net.TCPAddr).AddrPort()
 
@@ -220,10 +356,18 @@ func ServerAccept(rw io.ReadWriter, enableTCP, enableUDP bool, tc *net.TCPConn)
 			return
 		}
 
-		// Hold the connection open.
+		// Hold the connection open, for at most udpAssociateMaxHold if positive.
+		if udpAssociateMaxHold > 0 {
+			if err = tc.SetReadDeadline(time.Now().Add(udpAssociateMaxHold)); err != nil {
+				return
+			}
+		}
 		_, err = rw.Read(b[:1])
-		if err == nil || err == io.EOF {
+		switch {
+		case err == nil || err == io.EOF:
 			err = ErrUDPAssociateDone
+		case udpAssociateMaxHold > 0 && errors.Is(err, os.ErrDeadlineExceeded):
+			err = ErrUDPAssociateMaxHoldExceeded
 		}
 
 	default:
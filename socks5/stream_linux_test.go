@@ -0,0 +1,85 @@
+package socks5
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"golang.org/x/sys/unix"
+)
+
+func TestServerAcceptUDPAssociateKeepAlive(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	tcCh := make(chan *net.TCPConn, 1)
+	serverErrCh := make(chan error, 1)
+
+	go func() {
+		tc, err := ln.AcceptTCP()
+		if err != nil {
+			serverErrCh <- err
+			return
+		}
+		defer tc.Close()
+		tcCh <- tc
+
+		_, err = ServerAccept(tc, false, true, Succeeded, 0, tc)
+		serverErrCh <- err
+	}()
+
+	c, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err = ClientUDPAssociate(c, conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv4Unspecified(), 0))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep-alive is enabled before the reply is written, so it is in effect now.
+	tc := <-tcCh
+	rawConn, err := tc.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	period := int(UDPAssociateKeepAlivePeriod.Seconds())
+
+	for _, o := range []struct {
+		name     string
+		level    int
+		opt      int
+		expected int
+	}{
+		{"SO_KEEPALIVE", unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1},
+		{"TCP_KEEPIDLE", unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, period},
+		{"TCP_KEEPINTVL", unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, period},
+	} {
+		var (
+			value int
+			serr  error
+		)
+		if err = rawConn.Control(func(fd uintptr) {
+			value, serr = unix.GetsockoptInt(int(fd), o.level, o.opt)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if serr != nil {
+			t.Fatalf("Failed to get %s: %v", o.name, serr)
+		}
+		if value != o.expected {
+			t.Errorf("%s is %d, expected %d", o.name, value, o.expected)
+		}
+	}
+
+	c.Close()
+	if err = <-serverErrCh; err != ErrUDPAssociateDone {
+		t.Errorf("Expected error %v, got %v", ErrUDPAssociateDone, err)
+	}
+}
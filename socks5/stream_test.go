@@ -0,0 +1,414 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+)
+
+type readWriter struct {
+	io.Reader
+	io.Writer
+}
+
+func TestServerAcceptLeavesPipelinedData(t *testing.T) {
+	targetAddr := conn.MustAddrFromDomainPort("example.com", 443)
+	earlyData := []byte("pipelined early data")
+
+	var clientMsgs []byte
+	clientMsgs = append(clientMsgs, Version, 1, MethodNoAuthenticationRequired)
+	clientMsgs = append(clientMsgs, Version, CmdConnect, 0)
+	clientMsgs = AppendAddrFromConnAddr(clientMsgs, targetAddr)
+	clientMsgs = append(clientMsgs, earlyData...)
+
+	r := bytes.NewReader(clientMsgs)
+	var w bytes.Buffer
+
+	addr, err := ServerAccept(readWriter{r, &w}, true, false, Succeeded, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != targetAddr {
+		t.Errorf("Expected target address %s, got %s", targetAddr, addr)
+	}
+
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rest, earlyData) {
+		t.Errorf("Expected unread early data %q, got %q", earlyData, rest)
+	}
+}
+
+func TestServerAcceptUDPAssociateWithoutTCPConn(t *testing.T) {
+	var clientMsgs []byte
+	clientMsgs = append(clientMsgs, Version, 1, MethodNoAuthenticationRequired)
+	clientMsgs = append(clientMsgs, Version, CmdUDPAssociate, 0)
+	clientMsgs = AppendAddrFromConnAddr(clientMsgs, conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv4Unspecified(), 0)))
+
+	var w bytes.Buffer
+
+	_, err := ServerAccept(readWriter{bytes.NewReader(clientMsgs), &w}, true, true, Succeeded, 0, nil)
+	if !errors.Is(err, ErrUnsupportedCommand) {
+		t.Fatalf("Expected error %v, got %v", ErrUnsupportedCommand, err)
+	}
+
+	reply := w.Bytes()
+	if len(reply) < 4 {
+		t.Fatalf("Reply too short: %v", reply)
+	}
+	if reply[2] != Version || reply[3] != ErrCommandNotSupported {
+		t.Errorf("Expected command not supported reply, got %v", reply[2:])
+	}
+}
+
+func TestServerAcceptIPv6Reply(t *testing.T) {
+	for _, c := range []struct {
+		name          string
+		targetAddr    conn.Addr
+		ipv6Reply     byte
+		expectedReply byte
+	}{
+		{"IPv6Accepted", conn.AddrFromIPPort(netip.MustParseAddrPort("[2001:db8::1]:443")), Succeeded, Succeeded},
+		{"IPv6Rejected", conn.AddrFromIPPort(netip.MustParseAddrPort("[2001:db8::1]:443")), ErrAddressNotSupported, ErrAddressNotSupported},
+		{"IPv4", conn.AddrFromIPPort(netip.MustParseAddrPort("192.0.2.1:443")), ErrNetworkUnreachable, Succeeded},
+		{"IPv4MappedIPv6", conn.AddrFromIPPort(netip.MustParseAddrPort("[::ffff:192.0.2.1]:443")), ErrNetworkUnreachable, Succeeded},
+		{"Domain", conn.MustAddrFromDomainPort("example.com", 443), ErrNetworkUnreachable, Succeeded},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var clientMsgs []byte
+			clientMsgs = append(clientMsgs, Version, 1, MethodNoAuthenticationRequired)
+			clientMsgs = append(clientMsgs, Version, CmdConnect, 0)
+			clientMsgs = AppendAddrFromConnAddr(clientMsgs, c.targetAddr)
+
+			var w bytes.Buffer
+
+			_, err := ServerAccept(readWriter{bytes.NewReader(clientMsgs), &w}, true, false, c.ipv6Reply, 0, nil)
+			if c.expectedReply == Succeeded {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if !errors.Is(err, ErrIPv6TargetRejected) {
+				t.Fatalf("Expected error %v, got %v", ErrIPv6TargetRejected, err)
+			}
+
+			reply := w.Bytes()
+			if len(reply) < 4 {
+				t.Fatalf("Reply too short: %v", reply)
+			}
+			if reply[2] != Version || reply[3] != c.expectedReply {
+				t.Errorf("Expected reply %d, got %v", c.expectedReply, reply[2:])
+			}
+		})
+	}
+}
+
+// errAuthenticator fails every authentication attempt with err.
+type errAuthenticator struct {
+	err error
+}
+
+func (a errAuthenticator) Authenticate(username, password string) (bool, error) {
+	return false, a.err
+}
+
+func TestServerAcceptUsernamePassword(t *testing.T) {
+	targetAddr := conn.MustAddrFromDomainPort("example.com", 443)
+	authenticator := NewMapAuthenticator([]UserInfo{
+		{Username: "alice", Password: "correct horse"},
+		{Username: strings.Repeat("u", 255), Password: strings.Repeat("p", 255)},
+	})
+	errBackend := errors.New("backend unavailable")
+
+	for _, c := range []struct {
+		name          string
+		authenticator Authenticator
+		username      string
+		password      string
+		expectedErr   error
+	}{
+		{"Success", authenticator, "alice", "correct horse", nil},
+		{"MaxLength", authenticator, strings.Repeat("u", 255), strings.Repeat("p", 255), nil},
+		{"WrongPassword", authenticator, "alice", "battery staple", ErrIncorrectUsernamePassword},
+		{"UnknownUser", authenticator, "bob", "correct horse", ErrIncorrectUsernamePassword},
+		{"BackendError", errAuthenticator{errBackend}, "alice", "correct horse", errBackend},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var clientMsgs []byte
+			clientMsgs = append(clientMsgs, Version, 2, MethodNoAuthenticationRequired, MethodUsernamePassword)
+			clientMsgs, err := UserInfo{Username: c.username, Password: c.password}.AppendAuthMsg(clientMsgs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientMsgs = append(clientMsgs, Version, CmdConnect, 0)
+			clientMsgs = AppendAddrFromConnAddr(clientMsgs, targetAddr)
+
+			var w bytes.Buffer
+
+			addr, username, err := ServerAcceptUsernamePassword(readWriter{bytes.NewReader(clientMsgs), &w}, c.authenticator, nil, true, false, Succeeded, 0, nil)
+			if !errors.Is(err, c.expectedErr) {
+				t.Fatalf("Expected error %v, got %v", c.expectedErr, err)
+			}
+
+			reply := w.Bytes()
+			if len(reply) < 4 {
+				t.Fatalf("Reply too short: %v", reply)
+			}
+			if reply[0] != Version || reply[1] != MethodUsernamePassword {
+				t.Errorf("Expected username/password method selection, got %v", reply[:2])
+			}
+
+			expectedStatus := byte(UsernamePasswordStatusSuccess)
+			if c.expectedErr != nil {
+				expectedStatus = UsernamePasswordStatusFailure
+			}
+			if reply[2] != UsernamePasswordVersion || reply[3] != expectedStatus {
+				t.Errorf("Expected status %d, got %v", expectedStatus, reply[2:4])
+			}
+
+			if c.expectedErr == nil {
+				if addr != targetAddr {
+					t.Errorf("Expected target address %s, got %s", targetAddr, addr)
+				}
+				if username != c.username {
+					t.Errorf("Expected username %q, got %q", c.username, username)
+				}
+			}
+		})
+	}
+}
+
+func TestServerAcceptUsernamePasswordTargetNotAuthorized(t *testing.T) {
+	allowedAddr := conn.MustAddrFromDomainPort("example.com", 443)
+	deniedAddr := conn.MustAddrFromDomainPort("example.net", 443)
+	authenticator := NewMapAuthenticator([]UserInfo{
+		{Username: "alice", Password: "correct horse"},
+		{Username: "bob", Password: "battery staple"},
+	})
+	authorizeTarget := func(username string, targetAddr conn.Addr) bool {
+		return username != "alice" || targetAddr == allowedAddr
+	}
+
+	for _, c := range []struct {
+		name           string
+		username       string
+		password       string
+		targetAddr     conn.Addr
+		expectedStatus byte
+		expectedErr    error
+	}{
+		{"Allowed", "alice", "correct horse", allowedAddr, Succeeded, nil},
+		{"Denied", "alice", "correct horse", deniedAddr, ErrConnectionNotAllowed, ErrTargetNotAuthorized},
+		{"Unrestricted", "bob", "battery staple", deniedAddr, Succeeded, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			clientMsgs := []byte{Version, 1, MethodUsernamePassword}
+			clientMsgs, err := UserInfo{Username: c.username, Password: c.password}.AppendAuthMsg(clientMsgs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientMsgs = append(clientMsgs, Version, CmdConnect, 0)
+			clientMsgs = AppendAddrFromConnAddr(clientMsgs, c.targetAddr)
+
+			var w bytes.Buffer
+
+			_, username, err := ServerAcceptUsernamePassword(readWriter{bytes.NewReader(clientMsgs), &w}, authenticator, authorizeTarget, true, false, Succeeded, 0, nil)
+			if !errors.Is(err, c.expectedErr) {
+				t.Fatalf("Expected error %v, got %v", c.expectedErr, err)
+			}
+			if username != c.username {
+				t.Errorf("Expected username %q, got %q", c.username, username)
+			}
+
+			// Method selection (2 bytes), username/password status (2 bytes), then the request reply.
+			reply := w.Bytes()
+			if len(reply) < 6 {
+				t.Fatalf("Reply too short: %v", reply)
+			}
+			if reply[4] != Version || reply[5] != c.expectedStatus {
+				t.Errorf("Expected reply status %d, got %v", c.expectedStatus, reply[4:6])
+			}
+		})
+	}
+}
+
+func TestServerAcceptUsernamePasswordNoAcceptableMethod(t *testing.T) {
+	clientMsgs := []byte{Version, 1, MethodNoAuthenticationRequired}
+	var w bytes.Buffer
+
+	_, _, err := ServerAcceptUsernamePassword(readWriter{bytes.NewReader(clientMsgs), &w}, MapAuthenticator{}, nil, true, false, Succeeded, 0, nil)
+	if !errors.Is(err, ErrUnsupportedAuthenticationMethod) {
+		t.Fatalf("Expected error %v, got %v", ErrUnsupportedAuthenticationMethod, err)
+	}
+	if reply := w.Bytes(); !bytes.Equal(reply, []byte{Version, MethodNoAcceptable}) {
+		t.Errorf("Expected no acceptable methods reply, got %v", reply)
+	}
+}
+
+const testPrivateMethod = 0x88
+
+var errBadToken = errors.New("bad token")
+
+// tokenHandler is a private method handler that reads a 1-byte token length and the token,
+// and maps the token to a username.
+func tokenHandler(tokens map[string]string) PrivateMethodHandler {
+	return func(rw io.ReadWriter) (string, error) {
+		b := make([]byte, 255)
+		if _, err := io.ReadFull(rw, b[:1]); err != nil {
+			return "", err
+		}
+		token := b[:b[0]]
+		if _, err := io.ReadFull(rw, token); err != nil {
+			return "", err
+		}
+		username, ok := tokens[string(token)]
+		if !ok {
+			rw.Write([]byte{1})
+			return "", errBadToken
+		}
+		_, err := rw.Write([]byte{0})
+		return username, err
+	}
+}
+
+func TestServerAcceptPrivateMethod(t *testing.T) {
+	targetAddr := conn.MustAddrFromDomainPort("example.com", 443)
+	pm := PrivateMethod{
+		Method:  testPrivateMethod,
+		Handler: tokenHandler(map[string]string{"secret": "alice"}),
+	}
+	authenticator := NewMapAuthenticator([]UserInfo{{Username: "bob", Password: "hunter2"}})
+
+	tokenAuth := func(token string) []byte {
+		return append([]byte{byte(len(token))}, token...)
+	}
+	passwordAuth := func(username, password string) []byte {
+		b, err := UserInfo{Username: username, Password: password}.AppendAuthMsg(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	for _, c := range []struct {
+		name             string
+		authenticator    Authenticator
+		clientMethods    []byte
+		authMsg          []byte
+		expectedMethod   byte
+		expectedUsername string
+		expectedErr      error
+	}{
+		{"Token", nil, []byte{MethodNoAuthenticationRequired, testPrivateMethod}, tokenAuth("secret"), testPrivateMethod, "alice", nil},
+		{"WrongToken", nil, []byte{testPrivateMethod}, tokenAuth("guess"), testPrivateMethod, "", errBadToken},
+		{"PreferPrivate", authenticator, []byte{MethodUsernamePassword, testPrivateMethod}, tokenAuth("secret"), testPrivateMethod, "alice", nil},
+		{"FallbackUsernamePassword", authenticator, []byte{MethodUsernamePassword}, passwordAuth("bob", "hunter2"), MethodUsernamePassword, "bob", nil},
+		{"NoAcceptableMethod", nil, []byte{MethodNoAuthenticationRequired, MethodUsernamePassword}, nil, MethodNoAcceptable, "", ErrUnsupportedAuthenticationMethod},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			clientMsgs := append([]byte{Version, byte(len(c.clientMethods))}, c.clientMethods...)
+			clientMsgs = append(clientMsgs, c.authMsg...)
+			clientMsgs = append(clientMsgs, Version, CmdConnect, 0)
+			clientMsgs = AppendAddrFromConnAddr(clientMsgs, targetAddr)
+
+			var w bytes.Buffer
+
+			addr, username, err := ServerAcceptPrivateMethod(readWriter{bytes.NewReader(clientMsgs), &w}, pm, c.authenticator, nil, true, false, Succeeded, 0, nil)
+			if !errors.Is(err, c.expectedErr) {
+				t.Fatalf("Expected error %v, got %v", c.expectedErr, err)
+			}
+
+			reply := w.Bytes()
+			if len(reply) < 2 || reply[0] != Version || reply[1] != c.expectedMethod {
+				t.Fatalf("Expected method selection %d, got %v", c.expectedMethod, reply)
+			}
+
+			if c.expectedErr == nil {
+				if addr != targetAddr {
+					t.Errorf("Expected target address %s, got %s", targetAddr, addr)
+				}
+				if username != c.expectedUsername {
+					t.Errorf("Expected username %q, got %q", c.expectedUsername, username)
+				}
+			}
+		})
+	}
+}
+
+func TestPrivateMethodValidate(t *testing.T) {
+	handler := tokenHandler(nil)
+
+	for _, c := range []struct {
+		name        string
+		pm          PrivateMethod
+		expectedErr error
+	}{
+		{"First", PrivateMethod{MethodPrivateFirst, handler}, nil},
+		{"Last", PrivateMethod{MethodPrivateLast, handler}, nil},
+		{"UsernamePassword", PrivateMethod{MethodUsernamePassword, handler}, ErrNotPrivateMethod},
+		{"NoAcceptable", PrivateMethod{MethodNoAcceptable, handler}, ErrNotPrivateMethod},
+		{"NilHandler", PrivateMethod{testPrivateMethod, nil}, ErrNilPrivateMethodHandler},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if err := c.pm.Validate(); !errors.Is(err, c.expectedErr) {
+				t.Errorf("Expected error %v, got %v", c.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestServerAcceptUDPAssociateMaxHold(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	const maxHold = 50 * time.Millisecond
+	serverErrCh := make(chan error, 1)
+
+	go func() {
+		tc, err := ln.AcceptTCP()
+		if err != nil {
+			serverErrCh <- err
+			return
+		}
+		defer tc.Close()
+
+		_, err = ServerAccept(tc, false, true, Succeeded, maxHold, tc)
+		serverErrCh <- err
+	}()
+
+	c, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	start := time.Now()
+
+	if _, err = ClientUDPAssociate(c, conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv4Unspecified(), 0))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client keeps the control connection open without sending anything.
+	if err = <-serverErrCh; err != ErrUDPAssociateMaxHoldExceeded {
+		t.Fatalf("Expected error %v, got %v", ErrUDPAssociateMaxHoldExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed < maxHold {
+		t.Errorf("Association closed after %s, expected at least %s", elapsed, maxHold)
+	}
+
+	// The server closed the control connection.
+	if _, err = c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected EOF on control connection, got %v", err)
+	}
+}
@@ -209,10 +209,14 @@ func (c *CipherConfig) ServerPSKHashMap() map[[IdentityHeaderLength]byte]*Cipher
 	uPSKMap := make(map[[IdentityHeaderLength]byte]*CipherConfig, len(c.PSKs))
 
 	for _, psk := range c.PSKs {
-		hash := blake3.Sum512(psk)
-		truncatedHash := *(*[IdentityHeaderLength]byte)(hash[:])
-		uPSKMap[truncatedHash] = &CipherConfig{psk, nil, nil}
+		uPSKMap[uPSKHash(psk)] = &CipherConfig{psk, nil, nil}
 	}
 
 	return uPSKMap
 }
+
+// uPSKHash returns the truncated BLAKE3 hash of a uPSK, as used in identity headers.
+func uPSKHash(psk []byte) [IdentityHeaderLength]byte {
+	hash := blake3.Sum512(psk)
+	return *(*[IdentityHeaderLength]byte)(hash[:])
+}
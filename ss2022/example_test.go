@@ -0,0 +1,79 @@
+package ss2022_test
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/ss2022"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+func ExampleNewUDPClientWithPSK() {
+	const method = "2022-blake3-aes-128-gcm"
+	psk := []byte("0123456789abcdef")
+	serverAddrPort := netip.MustParseAddrPort("[2001:db8::1]:20220")
+	targetAddr := conn.AddrFromIPPort(netip.MustParseAddrPort("[2001:db8::53]:53"))
+
+	c, err := ss2022.NewUDPClientWithPSK(serverAddrPort, method, psk, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	// Each session has its own client session ID and packet counter.
+	clientInfo, packer, unpacker, err := c.NewSession()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(clientInfo.Name)
+
+	// Pack a datagram for the server.
+	destAddrPort, packet, err := zerocopy.ClientPackDatagram(packer, targetAddr, []byte("ping"))
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(destAddrPort)
+
+	// Play the part of the server and echo the payload back.
+	cipherConfig, err := ss2022.NewCipherConfig(method, psk, nil)
+	if err != nil {
+		panic(err)
+	}
+	s := ss2022.NewUDPServer(cipherConfig, ss2022.NoPadding, nil)
+	clientAddrPort := netip.MustParseAddrPort("[2001:db8::2]:40000")
+
+	csid, err := s.SessionInfo(packet)
+	if err != nil {
+		panic(err)
+	}
+	serverUnpacker, err := s.NewUnpacker(packet, csid)
+	if err != nil {
+		panic(err)
+	}
+	_, payloadStart, payloadLen, err := serverUnpacker.UnpackInPlace(packet, clientAddrPort, 0, len(packet))
+	if err != nil {
+		panic(err)
+	}
+	serverPacker, err := s.NewPacker(csid)
+	if err != nil {
+		panic(err)
+	}
+	b := make([]byte, serverPacker.FrontHeadroom()+payloadLen+serverPacker.RearHeadroom())
+	copy(b[serverPacker.FrontHeadroom():], packet[payloadStart:payloadStart+payloadLen])
+	packetStart, packetLen, err := serverPacker.PackInPlace(b, targetAddr.IPPort(), serverPacker.FrontHeadroom(), payloadLen, len(b))
+	if err != nil {
+		panic(err)
+	}
+
+	// Unpack the server's reply.
+	payloadSourceAddrPort, payload, err := zerocopy.ClientUnpackDatagram(unpacker, serverAddrPort, b[packetStart:packetStart+packetLen])
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(payloadSourceAddrPort, string(payload))
+
+	// Output:
+	// [2001:db8::1]:20220
+	// [2001:db8::1]:20220
+	// [2001:db8::53]:53 ping
+}
@@ -206,7 +206,11 @@ func ParseTCPRequestVariableLengthHeader(b []byte) (targetAddr conn.Addr, payloa
 // The excess space in the buffer must not be larger than [MaxPaddingLength] bytes.
 func WriteTCPRequestVariableLengthHeader(b []byte, targetAddr conn.Addr, payload []byte) {
 	// SOCKS address
-	n := socks5.WriteAddrFromConnAddr(b, targetAddr)
+	// The caller sizes b for the address, so a short buffer is a bug.
+	n, err := socks5.WriteAddrFromConnAddr(b, targetAddr)
+	if err != nil {
+		panic(err)
+	}
 
 	// Padding length
 	paddingLen := len(b) - n - 2 - len(payload)
@@ -367,7 +371,9 @@ func WriteUDPClientMessageHeader(b []byte, paddingLen int, targetAddr conn.Addr)
 	binary.BigEndian.PutUint16(b[1+8:], intToUint16(paddingLen))
 
 	// SOCKS address
-	socks5.WriteAddrFromConnAddr(b[1+8+2+paddingLen:], targetAddr)
+	if _, err := socks5.WriteAddrFromConnAddr(b[1+8+2+paddingLen:], targetAddr); err != nil {
+		panic(err)
+	}
 }
 
 // ParseUDPServerMessageHeader parses a UDP server message header and returns the payload source address
@@ -447,5 +453,7 @@ func WriteUDPServerMessageHeader(b []byte, csid uint64, paddingLen int, sourceAd
 	binary.BigEndian.PutUint16(b[1+8+8:], intToUint16(paddingLen))
 
 	// SOCKS address
-	socks5.WriteAddrFromAddrPort(b[1+8+8+2+paddingLen:], sourceAddrPort)
+	if _, err := socks5.WriteAddrFromAddrPort(b[1+8+8+2+paddingLen:], sourceAddrPort); err != nil {
+		panic(err)
+	}
 }
@@ -7,10 +7,12 @@ import (
 	"math"
 	"math/rand"
 	"net/netip"
+	"sync/atomic"
 	"time"
 
 	"github.com/database64128/shadowsocks-go/conn"
 	"github.com/database64128/shadowsocks-go/magic"
+	"github.com/database64128/shadowsocks-go/replay"
 	"github.com/database64128/shadowsocks-go/socks5"
 	"github.com/database64128/shadowsocks-go/zerocopy"
 )
@@ -267,8 +269,8 @@ type ShadowPacketClientUnpacker struct {
 	// Current server session AEAD cipher.
 	currentServerSessionAEAD cipher.AEAD
 
-	// Current server session sliding window filter.
-	currentServerSessionFilter *Filter
+	// Current server session replay window.
+	currentServerSessionFilter *replay.Window
 
 	// Old server session ID.
 	oldServerSessionID uint64
@@ -276,12 +278,15 @@ type ShadowPacketClientUnpacker struct {
 	// Old server session AEAD cipher.
 	oldServerSessionAEAD cipher.AEAD
 
-	// Old server session sliding window filter.
-	oldServerSessionFilter *Filter
+	// Old server session replay window.
+	oldServerSessionFilter *replay.Window
 
 	// Old server session last seen time.
 	oldServerSessionLastSeenTime time.Time
 
+	// gaps is the number of sequence gaps in packets from the server.
+	gaps atomic.Uint64
+
 	// Block cipher for the separate header.
 	block cipher.Block
 
@@ -301,7 +306,7 @@ func (p *ShadowPacketClientUnpacker) UnpackInPlace(b []byte, packetSourceAddrPor
 		ssid          uint64
 		spid          uint64
 		saead         cipher.AEAD
-		sfilter       *Filter
+		sfilter       *replay.Window
 		sessionStatus int
 	)
 
@@ -351,6 +356,7 @@ func (p *ShadowPacketClientUnpacker) UnpackInPlace(b []byte, packetSourceAddrPor
 	// AEAD open.
 	plaintext, err := saead.Open(ciphertext[:0], nonce, ciphertext, nil)
 	if err != nil {
+		err = fmt.Errorf("%w: %v", zerocopy.ErrPacketAuthenticationFailed, err)
 		return
 	}
 
@@ -361,9 +367,12 @@ func (p *ShadowPacketClientUnpacker) UnpackInPlace(b []byte, packetSourceAddrPor
 	}
 	payloadStart += messageHeaderStart
 
-	// Add spid to filter.
-	if sessionStatus == newServerSession {
-		sfilter = &Filter{}
+	// Add spid to replay window.
+	switch {
+	case sessionStatus == newServerSession:
+		sfilter = replay.NewWindow(replay.DefaultSize)
+	case spid > sfilter.Last()+1:
+		p.gaps.Add(1)
 	}
 	sfilter.MustAdd(spid)
 
@@ -384,6 +393,11 @@ func (p *ShadowPacketClientUnpacker) UnpackInPlace(b []byte, packetSourceAddrPor
 	return
 }
 
+// SequenceGaps implements the zerocopy.SequenceGapCounter SequenceGaps method.
+func (p *ShadowPacketClientUnpacker) SequenceGaps() uint64 {
+	return p.gaps.Load()
+}
+
 // ShadowPacketServerUnpacker unpacks Shadowsocks client packets and returns
 // target address and plaintext payload.
 //
@@ -397,14 +411,23 @@ type ShadowPacketServerUnpacker struct {
 	// Body AEAD cipher.
 	aead cipher.AEAD
 
-	// Client session sliding window filter.
+	// Client session replay window.
 	//
-	// This filter instance should be created during the first successful unpack operation.
+	// This window instance should be created during the first successful unpack operation.
 	// We trade 2 extra nil checks during unpacking for better performance when the server is flooded by invalid packets.
-	filter *Filter
+	filter *replay.Window
 
 	// cachedDomain caches the last used domain target to avoid allocating new strings.
 	cachedDomain string
+
+	// firstCpid is the packet ID of the first successfully unpacked packet.
+	firstCpid uint64
+
+	// stats tracks packet ordering. Missing is computed on readout.
+	stats zerocopy.ReorderStats
+
+	// gaps is the number of sequence gaps in packets from the client.
+	gaps atomic.Uint64
 }
 
 // UnpackInPlace unpacks the AEAD encrypted part of a Shadowsocks client packet
@@ -426,6 +449,11 @@ func (p *ShadowPacketServerUnpacker) UnpackInPlace(b []byte, sourceAddr netip.Ad
 	// Check cpid.
 	cpid := binary.BigEndian.Uint64(separateHeader[8:])
 	if p.filter != nil && !p.filter.IsOk(cpid) {
+		if p.filter.IsBehind(cpid) {
+			p.stats.TooOld++
+		} else {
+			p.stats.Replayed++
+		}
 		err = &ShadowPacketReplayError{sourceAddr, p.csid, cpid}
 		return
 	}
@@ -433,6 +461,7 @@ func (p *ShadowPacketServerUnpacker) UnpackInPlace(b []byte, sourceAddr netip.Ad
 	// AEAD open.
 	plaintext, err := p.aead.Open(ciphertext[:0], nonce, ciphertext, nil)
 	if err != nil {
+		err = fmt.Errorf("%w: %v", zerocopy.ErrPacketAuthenticationFailed, err)
 		return
 	}
 
@@ -443,11 +472,40 @@ func (p *ShadowPacketServerUnpacker) UnpackInPlace(b []byte, sourceAddr netip.Ad
 	}
 	payloadStart += messageHeaderStart
 
-	// Add cpid to filter.
-	if p.filter == nil {
-		p.filter = &Filter{}
+	// Add cpid to replay window.
+	switch {
+	case p.filter == nil:
+		p.filter = replay.NewWindow(replay.DefaultSize)
+		p.firstCpid = cpid
+	case cpid < p.filter.Last():
+		p.stats.OutOfOrder++
+		if distance := p.filter.Last() - cpid; distance > p.stats.MaxReorderDistance {
+			p.stats.MaxReorderDistance = distance
+		}
+	case cpid > p.filter.Last()+1:
+		p.gaps.Add(1)
 	}
 	p.filter.MustAdd(cpid)
+	p.stats.Accepted++
 
 	return
 }
+
+// SequenceGaps implements the zerocopy.SequenceGapCounter SequenceGaps method.
+func (p *ShadowPacketServerUnpacker) SequenceGaps() uint64 {
+	return p.gaps.Load()
+}
+
+// ReorderStats implements the zerocopy.ReorderStatsReporter ReorderStats method.
+func (p *ShadowPacketServerUnpacker) ReorderStats() zerocopy.ReorderStats {
+	stats := p.stats
+	if p.filter != nil {
+		// Packets older than the first accepted packet are counted as out-of-order, not missing.
+		if last := p.filter.Last(); last >= p.firstCpid {
+			if span := last - p.firstCpid + 1; span > stats.Accepted {
+				stats.Missing = span - stats.Accepted
+			}
+		}
+	}
+	return stats
+}
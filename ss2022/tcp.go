@@ -2,6 +2,7 @@ package ss2022
 
 import (
 	"net"
+	"time"
 
 	"github.com/database64128/shadowsocks-go/conn"
 	"github.com/database64128/shadowsocks-go/zerocopy"
@@ -17,10 +18,10 @@ type TCPClient struct {
 	unsafeResponseStreamPrefix []byte
 }
 
-func NewTCPClient(name, address string, dialerTFO bool, dialerFwmark int, cipherConfig *CipherConfig, eihPSKHashes [][IdentityHeaderLength]byte, unsafeRequestStreamPrefix, unsafeResponseStreamPrefix []byte) *TCPClient {
+func NewTCPClient(name, address string, dialerTFO bool, dialerFwmark int, dialerTimeout time.Duration, cipherConfig *CipherConfig, eihPSKHashes [][IdentityHeaderLength]byte, unsafeRequestStreamPrefix, unsafeResponseStreamPrefix []byte) *TCPClient {
 	return &TCPClient{
 		name:                       name,
-		tco:                        zerocopy.NewTCPConnOpener(conn.NewDialer(dialerTFO, dialerFwmark), "tcp", address),
+		tco:                        zerocopy.NewTCPConnOpener(conn.NewDialer(dialerTFO, dialerFwmark, dialerTimeout), "tcp", address),
 		cipherConfig:               cipherConfig,
 		eihPSKHashes:               eihPSKHashes,
 		unsafeRequestStreamPrefix:  unsafeRequestStreamPrefix,
@@ -34,10 +35,10 @@ func (c *TCPClient) String() string {
 }
 
 // Dial implements the zerocopy.TCPClient Dial method.
-func (c *TCPClient) Dial(targetAddr conn.Addr, payload []byte) (tc *net.TCPConn, rw zerocopy.ReadWriter, err error) {
+func (c *TCPClient) Dial(targetAddr conn.Addr, payload []byte) (rawConn net.Conn, rw zerocopy.ReadWriter, err error) {
 	rw, rawRW, err := NewShadowStreamClientReadWriter(c.tco, c.cipherConfig, c.eihPSKHashes, targetAddr, payload, c.unsafeRequestStreamPrefix, c.unsafeResponseStreamPrefix)
 	if err == nil {
-		tc = rawRW.(*net.TCPConn)
+		rawConn = rawRW.(*net.TCPConn)
 	}
 	return
 }
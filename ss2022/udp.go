@@ -3,9 +3,12 @@ package ss2022
 import (
 	"crypto/cipher"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net/netip"
+	"sync"
 
 	"github.com/database64128/shadowsocks-go/magic"
 	"github.com/database64128/shadowsocks-go/zerocopy"
@@ -15,9 +18,7 @@ import (
 type UDPClient struct {
 	ShadowPacketClientMessageHeadroom
 	addrPort      netip.AddrPort
-	name          string
-	maxPacketSize int
-	fwmark        int
+	info          zerocopy.ClientInfo
 	packerBlock   cipher.Block
 	unpackerBlock cipher.Block
 	cipherConfig  *CipherConfig
@@ -26,6 +27,7 @@ type UDPClient struct {
 	eihPSKHashes  [][IdentityHeaderLength]byte
 }
 
+// NewUDPClient creates a new shadowsocks-2022 UDP client.
 func NewUDPClient(addrPort netip.AddrPort, name string, mtu, fwmark int, cipherConfig *CipherConfig, shouldPad PaddingPolicy, eihPSKHashes [][IdentityHeaderLength]byte) *UDPClient {
 	eihCiphers := cipherConfig.NewUDPIdentityHeaderClientCiphers()
 	unpackerBlock := cipherConfig.NewBlock()
@@ -40,54 +42,70 @@ func NewUDPClient(addrPort netip.AddrPort, name string, mtu, fwmark int, cipherC
 	return &UDPClient{
 		ShadowPacketClientMessageHeadroom: ShadowPacketClientMessageHeadroom{IdentityHeaderLength * len(eihCiphers)},
 		addrPort:                          addrPort,
-		name:                              name,
-		maxPacketSize:                     zerocopy.MaxPacketSizeForAddr(mtu, addrPort.Addr()),
-		fwmark:                            fwmark,
-		packerBlock:                       packerBlock,
-		unpackerBlock:                     unpackerBlock,
-		cipherConfig:                      cipherConfig,
-		shouldPad:                         shouldPad,
-		eihCiphers:                        eihCiphers,
-		eihPSKHashes:                      eihPSKHashes,
+		info: zerocopy.ClientInfo{
+			Name:          name,
+			MaxPacketSize: zerocopy.MaxPacketSizeForAddr(mtu, addrPort.Addr()),
+			Fwmark:        fwmark,
+		},
+		packerBlock:   packerBlock,
+		unpackerBlock: unpackerBlock,
+		cipherConfig:  cipherConfig,
+		shouldPad:     shouldPad,
+		eihCiphers:    eihCiphers,
+		eihPSKHashes:  eihPSKHashes,
 	}
 }
 
+// NewUDPClientWithPSK creates a new shadowsocks-2022 UDP client for the server at serverAddrPort.
+//
+// psk is the user PSK. iPSKs are the identity PSKs, if any, in the order they appear in the client config.
+// The client is named after the server address, assumes an MTU of 1500 and pads plain DNS packets.
+// Use NewUDPClient for full control over these settings.
+func NewUDPClientWithPSK(serverAddrPort netip.AddrPort, method string, psk []byte, iPSKs [][]byte) (*UDPClient, error) {
+	cipherConfig, err := NewCipherConfig(method, psk, iPSKs)
+	if err != nil {
+		return nil, err
+	}
+	return NewUDPClient(serverAddrPort, serverAddrPort.String(), 1500, 0, cipherConfig, PadPlainDNS, cipherConfig.ClientPSKHashes()), nil
+}
+
 // String implements the zerocopy.UDPClient String method.
 func (c *UDPClient) String() string {
-	return c.name
+	return c.info.Name
 }
 
 // NewSession implements the zerocopy.UDPClient NewSession method.
-func (c *UDPClient) NewSession() (zerocopy.ClientPacker, zerocopy.ClientUnpacker, error) {
+func (c *UDPClient) NewSession() (zerocopy.ClientInfo, zerocopy.ClientPacker, zerocopy.ClientUnpacker, error) {
 	// Random client session ID.
 	salt := make([]byte, 8)
 	_, err := rand.Read(salt)
 	if err != nil {
-		return nil, nil, err
+		return c.info, nil, nil, err
 	}
 	csid := binary.BigEndian.Uint64(salt)
 
-	return &ShadowPacketClientPacker{
-			ShadowPacketClientMessageHeadroom: c.ShadowPacketClientMessageHeadroom,
-			csid:                              csid,
-			aead:                              c.cipherConfig.NewAEAD(salt),
-			block:                             c.packerBlock,
-			shouldPad:                         c.shouldPad,
-			eihCiphers:                        c.eihCiphers,
-			eihPSKHashes:                      c.eihPSKHashes,
-			maxPacketSize:                     c.maxPacketSize,
-			serverAddrPort:                    c.addrPort,
-		}, &ShadowPacketClientUnpacker{
-			csid:         csid,
-			block:        c.unpackerBlock,
-			cipherConfig: c.cipherConfig,
-		}, nil
+	return c.info, &ShadowPacketClientPacker{
+		ShadowPacketClientMessageHeadroom: c.ShadowPacketClientMessageHeadroom,
+		csid:                              csid,
+		aead:                              c.cipherConfig.NewAEAD(salt),
+		block:                             c.packerBlock,
+		shouldPad:                         c.shouldPad,
+		eihCiphers:                        c.eihCiphers,
+		eihPSKHashes:                      c.eihPSKHashes,
+		maxPacketSize:                     c.info.MaxPacketSize,
+		serverAddrPort:                    c.addrPort,
+	}, &ShadowPacketClientUnpacker{
+		csid:         csid,
+		block:        c.unpackerBlock,
+		cipherConfig: c.cipherConfig,
+	}, nil
 }
 
-// LinkInfo implements the UDPClient LinkInfo method.
-func (c *UDPClient) LinkInfo() (int, int) {
-	return c.maxPacketSize, c.fwmark
-}
+var (
+	ErrUserPSKsDisabled = errors.New("server does not use identity headers")
+	ErrUserPSKExists    = errors.New("uPSK already exists")
+	ErrUserPSKNotFound  = errors.New("uPSK not found")
+)
 
 // UDPServer implements the zerocopy UDPSessionServer interface.
 type UDPServer struct {
@@ -95,7 +113,13 @@ type UDPServer struct {
 	block        cipher.Block
 	cipherConfig *CipherConfig
 	shouldPad    PaddingPolicy
-	uPSKMap      map[[IdentityHeaderLength]byte]*CipherConfig
+
+	// mu protects uPSKMap and uPSKSessions, which can be changed at runtime by AddPSK and RemovePSK.
+	mu      sync.Mutex
+	uPSKMap map[[IdentityHeaderLength]byte]*CipherConfig
+
+	// uPSKSessions is the number of sessions created with each uPSK, keyed by uPSK hash.
+	uPSKSessions map[[IdentityHeaderLength]byte]uint64
 
 	// Initialized as the same main cipher config referenced by cipherConfig.
 	// Produced by NewSession as the current session's user cipher config.
@@ -103,21 +127,89 @@ type UDPServer struct {
 	currentUserCipherConfig *CipherConfig
 }
 
+// NewUDPServer returns a new UDP server.
+//
+// If uPSKMap is not empty, identity headers are required, and uPSKs can be added and removed at runtime.
+// The server makes its own copy of uPSKMap, so it can be shared with other servers.
 func NewUDPServer(cipherConfig *CipherConfig, shouldPad PaddingPolicy, uPSKMap map[[IdentityHeaderLength]byte]*CipherConfig) *UDPServer {
 	var identityHeaderLen int
 	if len(uPSKMap) > 0 {
 		identityHeaderLen = IdentityHeaderLength
 	}
+
+	ownUPSKMap := make(map[[IdentityHeaderLength]byte]*CipherConfig, len(uPSKMap))
+	for hash, userCipherConfig := range uPSKMap {
+		ownUPSKMap[hash] = userCipherConfig
+	}
+
 	return &UDPServer{
 		ShadowPacketClientMessageHeadroom: ShadowPacketClientMessageHeadroom{identityHeaderLen},
 		block:                             cipherConfig.NewBlock(),
 		cipherConfig:                      cipherConfig,
 		shouldPad:                         shouldPad,
-		uPSKMap:                           uPSKMap,
+		uPSKMap:                           ownUPSKMap,
+		uPSKSessions:                      make(map[[IdentityHeaderLength]byte]uint64, len(uPSKMap)),
 		currentUserCipherConfig:           cipherConfig,
 	}
 }
 
+// AddPSK adds a uPSK to the server. New sessions can use the uPSK immediately.
+//
+// This is used together with RemovePSK to rotate a uPSK without downtime: add the new uPSK,
+// wait for clients to switch over, then remove the old one. The identity PSK cannot be rotated this way,
+// because it decrypts the unauthenticated separate header before any key can be verified.
+func (s *UDPServer) AddPSK(psk []byte) error {
+	if s.ShadowPacketClientMessageHeadroom.identityHeadersLen == 0 {
+		return ErrUserPSKsDisabled
+	}
+	if len(psk) != len(s.cipherConfig.PSK) {
+		return fmt.Errorf("%w: %s", ErrBadPSKLength, base64.StdEncoding.EncodeToString(psk))
+	}
+
+	hash := uPSKHash(psk)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.uPSKMap[hash]; ok {
+		return ErrUserPSKExists
+	}
+	s.uPSKMap[hash] = &CipherConfig{PSK: append([]byte(nil), psk...)}
+	return nil
+}
+
+// RemovePSK removes a uPSK from the server. New sessions using the uPSK are rejected.
+// Existing sessions are not affected, because they hold their own ciphers.
+func (s *UDPServer) RemovePSK(psk []byte) error {
+	hash := uPSKHash(psk)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.uPSKMap[hash]; !ok {
+		return ErrUserPSKNotFound
+	}
+	delete(s.uPSKMap, hash)
+	delete(s.uPSKSessions, hash)
+	return nil
+}
+
+// PSKSessions returns the number of new sessions whose identity header matched the uPSK
+// since it was added, and whether the uPSK is currently accepted.
+//
+// During a rotation, a growing count for the old uPSK means there are still clients using it.
+func (s *UDPServer) PSKSessions(psk []byte) (uint64, bool) {
+	hash := uPSKHash(psk)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.uPSKMap[hash]; !ok {
+		return 0, false
+	}
+	return s.uPSKSessions[hash], true
+}
+
 // SessionInfo implements the zerocopy.UDPSessionServer SessionInfo method.
 func (s *UDPServer) SessionInfo(b []byte) (csid uint64, err error) {
 	if len(b) < UDPSeparateHeaderLength {
@@ -146,7 +238,12 @@ func (s *UDPServer) NewUnpacker(b []byte, csid uint64) (zerocopy.ServerUnpacker,
 		s.block.Decrypt(identityHeader, identityHeader)
 		magic.XORWords(identityHeader, identityHeader, separateHeader)
 		uPSKHash := *(*[IdentityHeaderLength]byte)(identityHeader)
+		s.mu.Lock()
 		userCipherConfig, ok := s.uPSKMap[uPSKHash]
+		if ok {
+			s.uPSKSessions[uPSKHash]++
+		}
+		s.mu.Unlock()
 		if !ok {
 			return nil, ErrIdentityHeaderUserPSKNotFound
 		}
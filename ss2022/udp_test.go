@@ -9,6 +9,8 @@ import (
 	"time"
 
 	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/replay"
+	"github.com/database64128/shadowsocks-go/zerocopy"
 )
 
 const (
@@ -44,19 +46,21 @@ func testUDPClientServer(t *testing.T, clientCipherConfig, serverCipherConfig *C
 		t.Errorf("Fixed name mismatch: in: %s, out: %s", name, fixedName)
 	}
 
-	fixedMaxPacketSize, fixedFwmark := c.LinkInfo()
-	if fixedFwmark != fwmark {
-		t.Errorf("Fixed fwmark mismatch: in: %d, out: %d", fwmark, fixedFwmark)
-	}
-	if fixedMaxPacketSize != packetSize {
-		t.Errorf("Fixed MTU mismatch: in: %d, out: %d", mtu, fixedFwmark)
-	}
-
-	clientPacker, clientUnpacker, err := c.NewSession()
+	clientInfo, clientPacker, clientUnpacker, err := c.NewSession()
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	if clientInfo.Name != name {
+		t.Errorf("Client info name mismatch: in: %s, out: %s", name, clientInfo.Name)
+	}
+	if clientInfo.Fwmark != fwmark {
+		t.Errorf("Fixed fwmark mismatch: in: %d, out: %d", fwmark, clientInfo.Fwmark)
+	}
+	if clientInfo.MaxPacketSize != packetSize {
+		t.Errorf("Fixed MTU mismatch: in: %d, out: %d", mtu, clientInfo.MaxPacketSize)
+	}
+
 	frontHeadroom := clientPacker.FrontHeadroom() + 8 // Compensate for server message overhead.
 	rearHeadroom := clientPacker.RearHeadroom()
 	b := make([]byte, frontHeadroom+payloadLen+rearHeadroom)
@@ -151,7 +155,7 @@ func testUDPClientServerSessionChangeAndReplay(t *testing.T, clientCipherConfig,
 	c := NewUDPClient(serverAddrPort, name, mtu, fwmark, clientCipherConfig, shouldPad, clientCipherConfig.ClientPSKHashes())
 	s := NewUDPServer(serverCipherConfig, shouldPad, serverCipherConfig.ServerPSKHashMap())
 
-	clientPacker, clientUnpacker, err := c.NewSession()
+	_, clientPacker, clientUnpacker, err := c.NewSession()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -370,3 +374,230 @@ func TestUDPClientServerWithEIH(t *testing.T) {
 		testUDPClientServerWithCipher(t, &clientCipherConfig256, serverCipherConfig256)
 	})
 }
+
+func TestUDPServerUnpackerReorderStats(t *testing.T) {
+	cipherConfig, err := NewRandomCipherConfig("2022-blake3-aes-128-gcm", 16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewUDPClient(serverAddrPort, name, mtu, fwmark, cipherConfig, NoPadding, cipherConfig.ClientPSKHashes())
+	s := NewUDPServer(cipherConfig, NoPadding, cipherConfig.ServerPSKHashMap())
+
+	_, clientPacker, _, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const lastPid = replay.DefaultSize + 10
+
+	// Pack packets with packet IDs 0 to lastPid, and keep the ones we need.
+	packets := make(map[uint64][]byte)
+	frontHeadroom := clientPacker.FrontHeadroom()
+	b := make([]byte, frontHeadroom+clientPacker.RearHeadroom())
+	for pid := uint64(0); pid <= lastPid; pid++ {
+		_, pkts, pktl, err := clientPacker.PackInPlace(b, targetAddr, frontHeadroom, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch pid {
+		case 0, 1, 2, 3, 5, lastPid:
+			packets[pid] = append([]byte(nil), b[pkts:pkts+pktl]...)
+		}
+	}
+
+	// SessionInfo decrypts the separate header in-place, so always work on copies.
+	p := append([]byte(nil), packets[0]...)
+	csid, err := s.SessionInfo(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverUnpacker, err := s.NewUnpacker(p, csid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, step := range []struct {
+		pid        uint64
+		expectedOk bool
+	}{
+		{0, true},
+		{2, true},
+		{1, true},
+		{1, false},
+		{5, true},
+		{lastPid, true},
+		{3, false},
+	} {
+		p = append(p[:0], packets[step.pid]...)
+		if _, err = s.SessionInfo(p); err != nil {
+			t.Fatal(err)
+		}
+		_, _, _, err = serverUnpacker.UnpackInPlace(p, clientAddrPort, 0, len(p))
+		if ok := err == nil; ok != step.expectedOk {
+			t.Errorf("Unpacking packet %d: expected ok %v, got error %v", step.pid, step.expectedOk, err)
+		}
+	}
+
+	expectedStats := zerocopy.ReorderStats{
+		Accepted:           5,
+		OutOfOrder:         1,
+		MaxReorderDistance: 1,
+		Missing:            lastPid + 1 - 5,
+		Replayed:           1,
+		TooOld:             1,
+	}
+	if stats := serverUnpacker.(zerocopy.ReorderStatsReporter).ReorderStats(); stats != expectedStats {
+		t.Errorf("Expected reorder stats %+v, got %+v", expectedStats, stats)
+	}
+
+	// 0 -> 2, 2 -> 5, and 5 -> lastPid skip ahead.
+	const expectedGaps = 3
+	if gaps := serverUnpacker.(zerocopy.SequenceGapCounter).SequenceGaps(); gaps != expectedGaps {
+		t.Errorf("Expected %d sequence gaps, got %d", expectedGaps, gaps)
+	}
+}
+
+func TestUDPServerUnpackerErrors(t *testing.T) {
+	cipherConfig, err := NewRandomCipherConfig("2022-blake3-aes-128-gcm", 16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewUDPClient(serverAddrPort, name, mtu, fwmark, cipherConfig, NoPadding, cipherConfig.ClientPSKHashes())
+	s := NewUDPServer(cipherConfig, NoPadding, cipherConfig.ServerPSKHashMap())
+
+	_, clientPacker, _, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontHeadroom := clientPacker.FrontHeadroom()
+	b := make([]byte, frontHeadroom+clientPacker.RearHeadroom())
+	_, pkts, pktl, err := clientPacker.PackInPlace(b, targetAddr, frontHeadroom, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := b[pkts : pkts+pktl]
+
+	p := append([]byte(nil), packet...)
+	csid, err := s.SessionInfo(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverUnpacker, err := s.NewUnpacker(p, csid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, step := range []struct {
+		name        string
+		tamper      bool
+		expectedErr error
+	}{
+		{"Tampered", true, zerocopy.ErrPacketAuthenticationFailed},
+		{"Valid", false, nil},
+		{"Replayed", false, ErrReplay},
+	} {
+		p = append(p[:0], packet...)
+		if step.tamper {
+			p[len(p)-1] ^= 0xff
+		}
+		if _, err = s.SessionInfo(p); err != nil {
+			t.Fatal(err)
+		}
+		_, _, _, err = serverUnpacker.UnpackInPlace(p, clientAddrPort, 0, len(p))
+		if !errors.Is(err, step.expectedErr) {
+			t.Errorf("%s: expected error %v, got %v", step.name, step.expectedErr, err)
+		}
+		if step.expectedErr == ErrReplay && errors.Is(err, zerocopy.ErrPacketAuthenticationFailed) {
+			t.Errorf("%s: replay reported as authentication failure: %v", step.name, err)
+		}
+	}
+}
+
+func TestUDPServerAddRemovePSK(t *testing.T) {
+	serverCipherConfig, err := NewRandomCipherConfig("2022-blake3-aes-128-gcm", 16, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewUDPServer(serverCipherConfig, NoPadding, serverCipherConfig.ServerPSKHashMap())
+
+	newPSK := make([]byte, 16)
+	if _, err = rand.Read(newPSK); err != nil {
+		t.Fatal(err)
+	}
+	clientCipherConfig := CipherConfig{
+		PSK:  newPSK,
+		PSKs: [][]byte{serverCipherConfig.PSK},
+	}
+
+	// newUnpacker packs a packet with a new client session and creates a server unpacker for it.
+	newUnpacker := func() error {
+		c := NewUDPClient(serverAddrPort, name, mtu, fwmark, &clientCipherConfig, NoPadding, clientCipherConfig.ClientPSKHashes())
+		_, clientPacker, _, err := c.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, p, err := zerocopy.ClientPackDatagram(clientPacker, targetAddr, []byte("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		csid, err := s.SessionInfo(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.NewUnpacker(p, csid)
+		return err
+	}
+
+	if err = newUnpacker(); !errors.Is(err, ErrIdentityHeaderUserPSKNotFound) {
+		t.Errorf("Expected ErrIdentityHeaderUserPSKNotFound before adding the uPSK, got %v", err)
+	}
+	if _, ok := s.PSKSessions(newPSK); ok {
+		t.Error("PSKSessions() returned true before adding the uPSK")
+	}
+
+	if err = s.AddPSK(newPSK); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.AddPSK(newPSK); !errors.Is(err, ErrUserPSKExists) {
+		t.Errorf("Expected ErrUserPSKExists when adding the uPSK again, got %v", err)
+	}
+	if err = s.AddPSK(newPSK[:8]); !errors.Is(err, ErrBadPSKLength) {
+		t.Errorf("Expected ErrBadPSKLength when adding a short uPSK, got %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err = newUnpacker(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, ok := s.PSKSessions(newPSK); !ok || n != 2 {
+		t.Errorf("PSKSessions() returned %d, %v, expected 2, true", n, ok)
+	}
+	if n, ok := s.PSKSessions(serverCipherConfig.PSKs[0]); !ok || n != 0 {
+		t.Errorf("PSKSessions() for the old uPSK returned %d, %v, expected 0, true", n, ok)
+	}
+
+	if err = s.RemovePSK(newPSK); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.RemovePSK(newPSK); !errors.Is(err, ErrUserPSKNotFound) {
+		t.Errorf("Expected ErrUserPSKNotFound when removing the uPSK again, got %v", err)
+	}
+	if err = newUnpacker(); !errors.Is(err, ErrIdentityHeaderUserPSKNotFound) {
+		t.Errorf("Expected ErrIdentityHeaderUserPSKNotFound after removing the uPSK, got %v", err)
+	}
+}
+
+func TestUDPServerAddPSKWithoutIdentityHeaders(t *testing.T) {
+	cipherConfig, err := NewRandomCipherConfig("2022-blake3-aes-128-gcm", 16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewUDPServer(cipherConfig, NoPadding, cipherConfig.ServerPSKHashMap())
+	if err = s.AddPSK(make([]byte, 16)); !errors.Is(err, ErrUserPSKsDisabled) {
+		t.Errorf("Expected ErrUserPSKsDisabled, got %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package stats
+
+import "sync/atomic"
+
+// batchSizeBucketBounds are the inclusive upper bounds of the batch size histogram buckets.
+// Batch sizes above the last bound are counted in an implicit overflow bucket.
+var batchSizeBucketBounds = [...]int{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}
+
+// batchSizeHistogram counts batch size observations in fixed buckets.
+//
+// It is safe for concurrent use.
+type batchSizeHistogram struct {
+	buckets [len(batchSizeBucketBounds) + 1]atomic.Uint64
+	sum     atomic.Uint64
+}
+
+// Observe records a batch of n packets.
+func (h *batchSizeHistogram) Observe(n int) {
+	i := 0
+	for i < len(batchSizeBucketBounds) && n > batchSizeBucketBounds[i] {
+		i++
+	}
+	h.buckets[i].Add(1)
+	h.sum.Add(uint64(n))
+}
+
+// Snapshot returns a snapshot of the histogram.
+func (h *batchSizeHistogram) Snapshot() BatchSizeHistogram {
+	buckets := make([]BatchSizeBucket, len(h.buckets))
+	var count uint64
+	for i := range h.buckets {
+		n := h.buckets[i].Load()
+		count += n
+		buckets[i].Count = n
+		if i < len(batchSizeBucketBounds) {
+			buckets[i].UpperBound = batchSizeBucketBounds[i]
+		}
+	}
+	return BatchSizeHistogram{
+		Buckets: buckets,
+		Count:   count,
+		Sum:     h.sum.Load(),
+	}
+}
+
+// BatchSizeBucket is a bucket of a batch size histogram.
+type BatchSizeBucket struct {
+	// UpperBound is the inclusive upper bound of the bucket, in packets.
+	// The last bucket has a zero upper bound and counts all batches above the previous bucket.
+	UpperBound int `json:"upperBound"`
+
+	// Count is the number of batches in the bucket. Counts are not cumulative.
+	Count uint64 `json:"count"`
+}
+
+// BatchSizeHistogram is a snapshot of batch sizes.
+type BatchSizeHistogram struct {
+	Buckets []BatchSizeBucket `json:"buckets"`
+
+	// Count is the number of batches.
+	Count uint64 `json:"count"`
+
+	// Sum is the total number of packets in all batches.
+	// Sum / Count is the average batch size.
+	Sum uint64 `json:"sum"`
+}
+
+// CollectUplinkSendmmsgBatch records a batch of n packets sent to the upstream in one sendmmsg(2) call.
+func (c *Collector) CollectUplinkSendmmsgBatch(n int) {
+	if c == nil {
+		return
+	}
+	c.uplinkSendmmsgBatchSizes.Observe(n)
+}
+
+// CollectDownlinkSendmmsgBatch records a batch of n packets sent to clients in one sendmmsg(2) call.
+func (c *Collector) CollectDownlinkSendmmsgBatch(n int) {
+	if c == nil {
+		return
+	}
+	c.downlinkSendmmsgBatchSizes.Observe(n)
+}
+
+// SendmmsgBatchSizes returns the distributions of sendmmsg(2) batch sizes in both directions.
+//
+// If most batches have a single packet, batching is providing no benefit,
+// and the batch size and linger configuration needs attention.
+func (c *Collector) SendmmsgBatchSizes() (uplink, downlink BatchSizeHistogram) {
+	if c == nil {
+		var h batchSizeHistogram
+		return h.Snapshot(), h.Snapshot()
+	}
+	return c.uplinkSendmmsgBatchSizes.Snapshot(), c.downlinkSendmmsgBatchSizes.Snapshot()
+}
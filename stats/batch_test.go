@@ -0,0 +1,38 @@
+package stats
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCollectorSendmmsgBatchSizes(t *testing.T) {
+	c := NewCollector(0)
+	for _, n := range []int{1, 1, 1, 2, 3, 64, 2000} {
+		c.CollectUplinkSendmmsgBatch(n)
+	}
+	c.CollectDownlinkSendmmsgBatch(256)
+
+	uplink, downlink := c.SendmmsgBatchSizes()
+
+	expectedUplinkCounts := []uint64{3, 1, 1, 0, 0, 0, 1, 0, 0, 0, 0, 1}
+	uplinkCounts := make([]uint64, len(uplink.Buckets))
+	for i, b := range uplink.Buckets {
+		uplinkCounts[i] = b.Count
+	}
+	if !reflect.DeepEqual(uplinkCounts, expectedUplinkCounts) {
+		t.Errorf("uplink bucket counts = %v, expected %v", uplinkCounts, expectedUplinkCounts)
+	}
+	if uplink.Count != 7 {
+		t.Errorf("uplink.Count = %d, expected 7", uplink.Count)
+	}
+	if uplink.Sum != 2072 {
+		t.Errorf("uplink.Sum = %d, expected 2072", uplink.Sum)
+	}
+	if last := uplink.Buckets[len(uplink.Buckets)-1]; last.UpperBound != 0 {
+		t.Errorf("Overflow bucket upper bound = %d, expected 0", last.UpperBound)
+	}
+
+	if downlink.Count != 1 || downlink.Sum != 256 || downlink.Buckets[8].Count != 1 {
+		t.Errorf("Unexpected downlink histogram: %+v", downlink)
+	}
+}
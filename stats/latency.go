@@ -0,0 +1,150 @@
+package stats
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// latencyBucketBounds are the inclusive upper bounds of the latency histogram buckets.
+// Observations above the last bound are counted in an implicit overflow bucket.
+var latencyBucketBounds = [...]time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+	5 * time.Second,
+}
+
+// relayDelayBucketBounds are the bucket bounds for in-relay processing delays,
+// which are usually well under a millisecond.
+var relayDelayBucketBounds = [len(latencyBucketBounds)]time.Duration{
+	10 * time.Microsecond,
+	20 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	200 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+}
+
+// latencyHistogram counts latency observations in fixed buckets.
+//
+// It is safe for concurrent use.
+type latencyHistogram struct {
+	// bounds are the bucket bounds. If nil, latencyBucketBounds is used.
+	// It must not be changed after the first observation.
+	bounds *[len(latencyBucketBounds)]time.Duration
+
+	buckets [len(latencyBucketBounds) + 1]atomic.Uint64
+	sum     atomic.Int64
+}
+
+func (h *latencyHistogram) bucketBounds() *[len(latencyBucketBounds)]time.Duration {
+	if h.bounds == nil {
+		return &latencyBucketBounds
+	}
+	return h.bounds
+}
+
+// Observe records a latency observation.
+func (h *latencyHistogram) Observe(d time.Duration) {
+	bounds := h.bucketBounds()
+	i := 0
+	for i < len(bounds) && d > bounds[i] {
+		i++
+	}
+	h.buckets[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// Snapshot returns a snapshot of the histogram.
+func (h *latencyHistogram) Snapshot() LatencyHistogram {
+	bounds := h.bucketBounds()
+	buckets := make([]LatencyBucket, len(h.buckets))
+	var count uint64
+	for i := range h.buckets {
+		n := h.buckets[i].Load()
+		count += n
+		buckets[i].Count = n
+		if i < len(bounds) {
+			buckets[i].UpperBound = bounds[i]
+		}
+	}
+	return LatencyHistogram{
+		Buckets: buckets,
+		Count:   count,
+		Sum:     time.Duration(h.sum.Load()),
+	}
+}
+
+// LatencyBucket is a bucket of a latency histogram.
+type LatencyBucket struct {
+	// UpperBound is the inclusive upper bound of the bucket.
+	// The last bucket has a zero upper bound and counts all observations above the previous bucket.
+	UpperBound time.Duration `json:"upperBound"`
+
+	// Count is the number of observations in the bucket. Counts are not cumulative.
+	Count uint64 `json:"count"`
+}
+
+// LatencyHistogram is a snapshot of latency observations.
+type LatencyHistogram struct {
+	Buckets []LatencyBucket `json:"buckets"`
+
+	// Count is the number of observations.
+	Count uint64 `json:"count"`
+
+	// Sum is the total of all observations.
+	// Sum / Count is the average latency.
+	Sum time.Duration `json:"sum"`
+}
+
+// ObserveSessionSetupLatency records the time it took to set up a UDP session,
+// from receiving the first packet to being ready to relay.
+func (c *Collector) ObserveSessionSetupLatency(d time.Duration) {
+	if c == nil {
+		return
+	}
+	c.sessionSetupLatencies.Observe(d)
+}
+
+// ObserveRelayDelay records the time a packet from a client spent in the relay,
+// from the kernel receiving it to the relay sending it to the upstream.
+func (c *Collector) ObserveRelayDelay(d time.Duration) {
+	if c == nil {
+		return
+	}
+	c.relayDelays.Observe(d)
+}
+
+// SessionSetupLatency returns the distribution of UDP session setup latencies.
+// See [Collector.ObserveSessionSetupLatency].
+func (c *Collector) SessionSetupLatency() LatencyHistogram {
+	if c == nil {
+		var h latencyHistogram
+		return h.Snapshot()
+	}
+	return c.sessionSetupLatencies.Snapshot()
+}
+
+// RelayDelay returns the distribution of in-relay delays of packets from clients.
+// See [Collector.ObserveRelayDelay].
+func (c *Collector) RelayDelay() LatencyHistogram {
+	if c == nil {
+		h := latencyHistogram{bounds: &relayDelayBucketBounds}
+		return h.Snapshot()
+	}
+	return c.relayDelays.Snapshot()
+}
@@ -0,0 +1,79 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var h latencyHistogram
+
+	h.Observe(0)
+	h.Observe(time.Millisecond)
+	h.Observe(3 * time.Millisecond)
+	h.Observe(time.Minute)
+
+	snapshot := h.Snapshot()
+
+	if snapshot.Count != 4 {
+		t.Errorf("Expected count 4, got %d", snapshot.Count)
+	}
+	if expected := time.Minute + 4*time.Millisecond; snapshot.Sum != expected {
+		t.Errorf("Expected sum %s, got %s", expected, snapshot.Sum)
+	}
+	if len(snapshot.Buckets) != len(latencyBucketBounds)+1 {
+		t.Fatalf("Expected %d buckets, got %d", len(latencyBucketBounds)+1, len(snapshot.Buckets))
+	}
+
+	for i, expected := range map[int]uint64{
+		0:                        2, // 0 and 1ms, inclusive upper bound
+		2:                        1, // 3ms in (2ms, 5ms]
+		len(latencyBucketBounds): 1, // overflow
+	} {
+		if snapshot.Buckets[i].Count != expected {
+			t.Errorf("Expected bucket %d count %d, got %d", i, expected, snapshot.Buckets[i].Count)
+		}
+	}
+}
+
+func TestLatencyHistogramCustomBounds(t *testing.T) {
+	h := latencyHistogram{bounds: &relayDelayBucketBounds}
+
+	h.Observe(5 * time.Microsecond)
+	h.Observe(30 * time.Microsecond)
+
+	snapshot := h.Snapshot()
+
+	for i, bound := range relayDelayBucketBounds {
+		if snapshot.Buckets[i].UpperBound != bound {
+			t.Errorf("Expected bucket %d upper bound %s, got %s", i, bound, snapshot.Buckets[i].UpperBound)
+		}
+	}
+	if snapshot.Buckets[0].Count != 1 || snapshot.Buckets[2].Count != 1 {
+		t.Errorf("Expected one observation in buckets 0 and 2, got %+v", snapshot.Buckets)
+	}
+}
+
+func TestCollectorLatencies(t *testing.T) {
+	c := NewCollector(0)
+	c.ObserveSessionSetupLatency(3 * time.Millisecond)
+	c.ObserveRelayDelay(30 * time.Microsecond)
+
+	setup := c.SessionSetupLatency()
+	if setup.Count != 1 || setup.Buckets[2].Count != 1 {
+		t.Errorf("Expected one setup latency in bucket 2, got %+v", setup)
+	}
+
+	delay := c.RelayDelay()
+	if delay.Count != 1 || delay.Buckets[2].Count != 1 {
+		t.Errorf("Expected one relay delay in bucket 2, got %+v", delay)
+	}
+	if delay.Buckets[0].UpperBound != relayDelayBucketBounds[0] {
+		t.Errorf("Expected relay delay bucket bounds, got first upper bound %s", delay.Buckets[0].UpperBound)
+	}
+
+	var nilCollector *Collector
+	if bound := nilCollector.RelayDelay().Buckets[0].UpperBound; bound != relayDelayBucketBounds[0] {
+		t.Errorf("Expected relay delay bucket bounds from nil collector, got first upper bound %s", bound)
+	}
+}
@@ -0,0 +1,419 @@
+// Package stats collects per-user traffic and liveness statistics.
+package stats
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxUsers is the default maximum number of users tracked by a [Collector].
+const DefaultMaxUsers = 65536
+
+// UserSnapshot is a point-in-time view of a user's statistics.
+type UserSnapshot struct {
+	// Username is the user's name.
+	Username string `json:"username"`
+
+	// LastSeen is the time of the user's most recent connection or session open or close.
+	LastSeen time.Time `json:"lastSeen"`
+
+	// ActiveTCPConns is the number of currently active TCP connections.
+	ActiveTCPConns int `json:"activeTCPConns"`
+
+	// ActiveUDPSessions is the number of currently active UDP sessions.
+	ActiveUDPSessions int `json:"activeUDPSessions"`
+
+	// UplinkBytes is the number of bytes sent by the user
+	// since the user was first seen or last reset by [Collector.ResetUser].
+	UplinkBytes uint64 `json:"uplinkBytes"`
+
+	// DownlinkBytes is the number of bytes received by the user
+	// since the user was first seen or last reset by [Collector.ResetUser].
+	DownlinkBytes uint64 `json:"downlinkBytes"`
+}
+
+// active returns whether the user has any active connections or sessions.
+func (s *UserSnapshot) active() bool {
+	return s.ActiveTCPConns > 0 || s.ActiveUDPSessions > 0
+}
+
+// SessionSetupFailureReason classifies why a UDP session failed before becoming active.
+// The set of reasons is fixed, so metrics keyed by reason have bounded cardinality.
+type SessionSetupFailureReason uint8
+
+const (
+	// SessionSetupFailureRoute means the router failed to select a client.
+	SessionSetupFailureRoute SessionSetupFailureReason = iota
+
+	// SessionSetupFailureClientSession means the client failed to create a session.
+	SessionSetupFailureClientSession
+
+	// SessionSetupFailureServerPacker means the server failed to create a packer for the session.
+	SessionSetupFailureServerPacker
+
+	// SessionSetupFailureSocket means the session's outbound socket could not be created.
+	// A spike usually indicates file descriptor or port exhaustion.
+	SessionSetupFailureSocket
+
+	// SessionSetupFailureDeadline means the read deadline could not be set on the session's outbound socket.
+	SessionSetupFailureDeadline
+
+	// SessionSetupFailureQueue means the session waited too long for a session setup slot.
+	// A spike indicates a burst of new sessions larger than the relay's setup concurrency limit.
+	SessionSetupFailureQueue
+
+	// SessionSetupFailureTargetNotAllowed means the session's target is not in the user's target allowlist.
+	SessionSetupFailureTargetNotAllowed
+
+	sessionSetupFailureReasonCount
+)
+
+var sessionSetupFailureReasonNames = [sessionSetupFailureReasonCount]string{
+	SessionSetupFailureRoute:            "route",
+	SessionSetupFailureClientSession:    "client_session",
+	SessionSetupFailureServerPacker:     "server_packer",
+	SessionSetupFailureSocket:           "socket",
+	SessionSetupFailureDeadline:         "deadline",
+	SessionSetupFailureQueue:            "queue",
+	SessionSetupFailureTargetNotAllowed: "target_not_allowed",
+}
+
+// String returns the metric label of the reason.
+func (r SessionSetupFailureReason) String() string {
+	if r < sessionSetupFailureReasonCount {
+		return sessionSetupFailureReasonNames[r]
+	}
+	return "unknown"
+}
+
+// NATConnErrorKind classifies a failure to set up the outbound side of a UDP NAT session.
+type NATConnErrorKind uint8
+
+const (
+	// NATConnErrorTransient means the failure was caused by a temporary resource shortage,
+	// such as ephemeral port or file descriptor exhaustion, and may succeed on retry.
+	NATConnErrorTransient NATConnErrorKind = iota
+
+	// NATConnErrorPermanent means the failure is not expected to go away on retry,
+	// e.g. because of bad configuration.
+	NATConnErrorPermanent
+
+	natConnErrorKindCount
+)
+
+var natConnErrorKindNames = [natConnErrorKindCount]string{
+	NATConnErrorTransient: "transient",
+	NATConnErrorPermanent: "permanent",
+}
+
+// String returns the metric label of the kind.
+func (k NATConnErrorKind) String() string {
+	if k < natConnErrorKindCount {
+		return natConnErrorKindNames[k]
+	}
+	return "unknown"
+}
+
+// PacketDropReason classifies why relayed UDP packets were dropped when writing a batch.
+type PacketDropReason uint8
+
+const (
+	// PacketDropSendBufferFull means sendmmsg(2) kept failing with ENOBUFS after retries.
+	// Drops for this reason indicate transient send buffer pressure, not hard failures.
+	PacketDropSendBufferFull PacketDropReason = iota
+
+	// PacketDropSendError means sendmmsg(2) failed to write the packets with any other error,
+	// e.g. because the destination is unreachable.
+	PacketDropSendError
+
+	packetDropReasonCount
+)
+
+var packetDropReasonNames = [packetDropReasonCount]string{
+	PacketDropSendBufferFull: "send_buffer_full",
+	PacketDropSendError:      "send_error",
+}
+
+// String returns the metric label of the reason.
+func (r PacketDropReason) String() string {
+	if r < packetDropReasonCount {
+		return packetDropReasonNames[r]
+	}
+	return "unknown"
+}
+
+// Collector collects per-user statistics.
+//
+// The number of tracked users is bounded. When the limit is reached,
+// the least recently seen user without active connections or sessions is evicted
+// to make room. If all tracked users are active, new users are not tracked.
+//
+// All methods are safe for concurrent use. A nil *Collector discards all notifications.
+type Collector struct {
+	mu       sync.Mutex
+	users    map[string]*UserSnapshot
+	maxUsers int
+	now      func() time.Time
+
+	sessionSetupFailures [sessionSetupFailureReasonCount]atomic.Uint64
+	natConnErrors        [natConnErrorKindCount]atomic.Uint64
+	packetDrops          [packetDropReasonCount]atomic.Uint64
+
+	uplinkSendmmsgBatchSizes   batchSizeHistogram
+	downlinkSendmmsgBatchSizes batchSizeHistogram
+
+	sessionSetupLatencies latencyHistogram
+	relayDelays           latencyHistogram
+}
+
+// NewCollector returns a new collector that tracks up to maxUsers users.
+// If maxUsers is not positive, [DefaultMaxUsers] is used.
+func NewCollector(maxUsers int) *Collector {
+	if maxUsers <= 0 {
+		maxUsers = DefaultMaxUsers
+	}
+	return &Collector{
+		users:       make(map[string]*UserSnapshot),
+		maxUsers:    maxUsers,
+		now:         time.Now,
+		relayDelays: latencyHistogram{bounds: &relayDelayBucketBounds},
+	}
+}
+
+// TCPConnOpened records the start of a TCP connection for username.
+func (c *Collector) TCPConnOpened(username string) {
+	c.opened(username, func(u *UserSnapshot) { u.ActiveTCPConns++ })
+}
+
+// TCPConnClosed records the end of a TCP connection for username
+// and adds the relayed bytes to the user's lifetime counters.
+func (c *Collector) TCPConnClosed(username string, uplinkBytes, downlinkBytes uint64) {
+	c.closed(username, uplinkBytes, downlinkBytes, func(u *UserSnapshot) { u.ActiveTCPConns-- })
+}
+
+// TCPConnTransferred adds interim byte counts of an active TCP connection for username
+// to the user's lifetime counters, so long-lived connections show up before they are closed.
+// Bytes reported here must not be reported again by [Collector.TCPConnClosed].
+func (c *Collector) TCPConnTransferred(username string, uplinkBytes, downlinkBytes uint64) {
+	c.closed(username, uplinkBytes, downlinkBytes, func(u *UserSnapshot) {})
+}
+
+// UDPSessionOpened records the start of a UDP session for username.
+func (c *Collector) UDPSessionOpened(username string) {
+	c.opened(username, func(u *UserSnapshot) { u.ActiveUDPSessions++ })
+}
+
+// UDPSessionClosed records the end of a UDP session for username
+// and adds the relayed bytes to the user's lifetime counters.
+func (c *Collector) UDPSessionClosed(username string, uplinkBytes, downlinkBytes uint64) {
+	c.closed(username, uplinkBytes, downlinkBytes, func(u *UserSnapshot) { u.ActiveUDPSessions-- })
+}
+
+// CollectSessionSetupFailure records a UDP session that failed to set up for reason.
+// Unknown reasons are ignored.
+func (c *Collector) CollectSessionSetupFailure(reason SessionSetupFailureReason) {
+	if c == nil || reason >= sessionSetupFailureReasonCount {
+		return
+	}
+	c.sessionSetupFailures[reason].Add(1)
+}
+
+// SessionSetupFailures returns the number of UDP session setup failures keyed by reason.
+// Every reason is present in the returned map, including those without failures.
+func (c *Collector) SessionSetupFailures() map[string]uint64 {
+	m := make(map[string]uint64, sessionSetupFailureReasonCount)
+	for r := SessionSetupFailureReason(0); r < sessionSetupFailureReasonCount; r++ {
+		var n uint64
+		if c != nil {
+			n = c.sessionSetupFailures[r].Load()
+		}
+		m[r.String()] = n
+	}
+	return m
+}
+
+// CollectNATConnError records a failure of kind to set up the outbound side of a UDP NAT session.
+// Unknown kinds are ignored.
+func (c *Collector) CollectNATConnError(kind NATConnErrorKind) {
+	if c == nil || kind >= natConnErrorKindCount {
+		return
+	}
+	c.natConnErrors[kind].Add(1)
+}
+
+// NATConnErrors returns the number of UDP NAT session setup failures keyed by kind.
+// Every kind is present in the returned map, including those without failures.
+func (c *Collector) NATConnErrors() map[string]uint64 {
+	m := make(map[string]uint64, natConnErrorKindCount)
+	for k := NATConnErrorKind(0); k < natConnErrorKindCount; k++ {
+		var n uint64
+		if c != nil {
+			n = c.natConnErrors[k].Load()
+		}
+		m[k.String()] = n
+	}
+	return m
+}
+
+// CollectPacketDrops records n relayed UDP packets dropped for reason.
+// Unknown reasons are ignored.
+func (c *Collector) CollectPacketDrops(reason PacketDropReason, n uint64) {
+	if c == nil || reason >= packetDropReasonCount {
+		return
+	}
+	c.packetDrops[reason].Add(n)
+}
+
+// PacketDrops returns the number of dropped UDP packets keyed by reason.
+// Every reason is present in the returned map, including those without drops.
+func (c *Collector) PacketDrops() map[string]uint64 {
+	m := make(map[string]uint64, packetDropReasonCount)
+	for r := PacketDropReason(0); r < packetDropReasonCount; r++ {
+		var n uint64
+		if c != nil {
+			n = c.packetDrops[r].Load()
+		}
+		m[r.String()] = n
+	}
+	return m
+}
+
+func (c *Collector) opened(username string, f func(u *UserSnapshot)) {
+	if c == nil || username == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	u, ok := c.users[username]
+	if !ok {
+		if len(c.users) >= c.maxUsers && !c.evictLocked() {
+			return
+		}
+		u = &UserSnapshot{Username: username}
+		c.users[username] = u
+	}
+	f(u)
+	u.LastSeen = c.now()
+}
+
+func (c *Collector) closed(username string, uplinkBytes, downlinkBytes uint64, f func(u *UserSnapshot)) {
+	if c == nil || username == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Active users are never evicted, so a missing user was never tracked.
+	u, ok := c.users[username]
+	if !ok {
+		return
+	}
+	f(u)
+	u.UplinkBytes += uplinkBytes
+	u.DownlinkBytes += downlinkBytes
+	u.LastSeen = c.now()
+}
+
+// evictLocked removes the least recently seen inactive user.
+// It returns false if all users are active.
+func (c *Collector) evictLocked() bool {
+	var oldest *UserSnapshot
+	for _, u := range c.users {
+		if !u.active() && (oldest == nil || u.LastSeen.Before(oldest.LastSeen)) {
+			oldest = u
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	delete(c.users, oldest.Username)
+	return true
+}
+
+// UserSnapshot returns the statistics of username.
+// It returns false if the user is not tracked.
+func (c *Collector) UserSnapshot(username string) (UserSnapshot, bool) {
+	if c == nil {
+		return UserSnapshot{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	u, ok := c.users[username]
+	if !ok {
+		return UserSnapshot{}, false
+	}
+	return *u, true
+}
+
+// Users returns the statistics of all tracked users, sorted by username.
+func (c *Collector) Users() []UserSnapshot {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	users := make([]UserSnapshot, 0, len(c.users))
+	for _, u := range c.users {
+		users = append(users, *u)
+	}
+	c.mu.Unlock()
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users
+}
+
+// ResetUser returns the statistics of username, and zeroes the user's byte counters in the same step,
+// so that polling for billing periods neither loses nor double-counts traffic reported in between.
+// It returns false if the user is not tracked.
+//
+// TCP connections report their traffic periodically while active, by [Collector.TCPConnTransferred],
+// and the rest when they close. UDP sessions report all of their traffic when they close.
+// Traffic not reported at the time of the call is counted in the period in which it is reported.
+func (c *Collector) ResetUser(username string) (UserSnapshot, bool) {
+	if c == nil {
+		return UserSnapshot{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	u, ok := c.users[username]
+	if !ok {
+		return UserSnapshot{}, false
+	}
+	snapshot := *u
+	u.UplinkBytes = 0
+	u.DownlinkBytes = 0
+	return snapshot, true
+}
+
+// PruneIdle removes users that have no active connections or sessions
+// and have not been seen for at least idleTimeout.
+// It returns the number of removed users.
+func (c *Collector) PruneIdle(idleTimeout time.Duration) int {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var n int
+	deadline := c.now().Add(-idleTimeout)
+	for username, u := range c.users {
+		if !u.active() && !u.LastSeen.After(deadline) {
+			delete(c.users, username)
+			n++
+		}
+	}
+	return n
+}
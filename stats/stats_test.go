@@ -0,0 +1,310 @@
+package stats
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestCollector returns a collector whose clock advances by one second on every read.
+func newTestCollector(maxUsers int) *Collector {
+	c := NewCollector(maxUsers)
+	now := time.Unix(0, 0)
+	c.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	return c
+}
+
+func TestCollectorUserSnapshot(t *testing.T) {
+	c := newTestCollector(0)
+
+	c.TCPConnOpened("alice")
+	c.TCPConnOpened("alice")
+	c.UDPSessionOpened("alice")
+	c.TCPConnTransferred("alice", 1000, 2000)
+	c.TCPConnClosed("alice", 100, 200)
+	c.UDPSessionClosed("alice", 10, 20)
+
+	u, ok := c.UserSnapshot("alice")
+	if !ok {
+		t.Fatal("UserSnapshot() returned false for tracked user")
+	}
+	expected := UserSnapshot{
+		Username:       "alice",
+		LastSeen:       time.Unix(6, 0),
+		ActiveTCPConns: 1,
+		UplinkBytes:    1110,
+		DownlinkBytes:  2220,
+	}
+	if u != expected {
+		t.Errorf("UserSnapshot() returned %+v, expected %+v", u, expected)
+	}
+
+	if _, ok = c.UserSnapshot("bob"); ok {
+		t.Error("UserSnapshot() returned true for untracked user")
+	}
+
+	c.TCPConnOpened("")
+	if _, ok = c.UserSnapshot(""); ok {
+		t.Error("Empty username should not be tracked")
+	}
+}
+
+func TestCollectorUsers(t *testing.T) {
+	c := newTestCollector(0)
+
+	c.TCPConnOpened("carol")
+	c.UDPSessionOpened("alice")
+	c.TCPConnClosed("carol", 100, 200)
+	c.TCPConnOpened("bob")
+
+	users := c.Users()
+	if len(users) != 3 {
+		t.Fatalf("Users() returned %d users, expected 3", len(users))
+	}
+	for i, username := range []string{"alice", "bob", "carol"} {
+		if users[i].Username != username {
+			t.Errorf("users[%d].Username = %q, expected %q", i, users[i].Username, username)
+		}
+	}
+	if users[0].ActiveUDPSessions != 1 || users[2].UplinkBytes != 100 {
+		t.Errorf("Users() returned wrong statistics: %+v", users)
+	}
+}
+
+func TestCollectorResetUser(t *testing.T) {
+	c := newTestCollector(0)
+
+	c.TCPConnOpened("alice")
+	c.TCPConnTransferred("alice", 100, 200)
+
+	u, ok := c.ResetUser("alice")
+	if !ok {
+		t.Fatal("ResetUser() returned false for tracked user")
+	}
+	if u.UplinkBytes != 100 || u.DownlinkBytes != 200 || u.ActiveTCPConns != 1 {
+		t.Errorf("ResetUser() returned %+v, expected 100 uplink bytes, 200 downlink bytes, 1 active TCP connection", u)
+	}
+
+	// Counters start over, and active connections are kept.
+	c.TCPConnClosed("alice", 10, 20)
+	u, _ = c.UserSnapshot("alice")
+	if u.UplinkBytes != 10 || u.DownlinkBytes != 20 || u.ActiveTCPConns != 0 {
+		t.Errorf("UserSnapshot() after reset returned %+v, expected 10 uplink bytes, 20 downlink bytes, 0 active TCP connections", u)
+	}
+
+	if _, ok = c.ResetUser("bob"); ok {
+		t.Error("ResetUser() returned true for untracked user")
+	}
+}
+
+func TestCollectorResetUserConcurrent(t *testing.T) {
+	const (
+		writers   = 4
+		transfers = 10000
+	)
+
+	c := NewCollector(0)
+	c.TCPConnOpened("alice")
+
+	var wg sync.WaitGroup
+	wg.Add(writers)
+	for i := 0; i < writers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < transfers; j++ {
+				c.TCPConnTransferred("alice", 1, 2)
+			}
+		}()
+	}
+
+	var uplink, downlink uint64
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for polling := true; polling; {
+		select {
+		case <-done:
+			polling = false
+		default:
+		}
+		u, _ := c.ResetUser("alice")
+		uplink += u.UplinkBytes
+		downlink += u.DownlinkBytes
+	}
+
+	if uplink != writers*transfers || downlink != 2*writers*transfers {
+		t.Errorf("Polled %d uplink and %d downlink bytes, expected %d and %d", uplink, downlink, writers*transfers, 2*writers*transfers)
+	}
+}
+
+func TestCollectorBounded(t *testing.T) {
+	c := newTestCollector(2)
+
+	c.TCPConnOpened("alice")
+	c.TCPConnOpened("bob")
+	c.TCPConnClosed("bob", 0, 0)
+
+	// bob is the only inactive user and is evicted.
+	c.TCPConnOpened("carol")
+	if _, ok := c.UserSnapshot("bob"); ok {
+		t.Error("Inactive user bob was not evicted")
+	}
+
+	// All users are active, so dave is not tracked.
+	c.TCPConnOpened("dave")
+	if _, ok := c.UserSnapshot("dave"); ok {
+		t.Error("User dave was tracked beyond the limit")
+	}
+	c.TCPConnClosed("dave", 1, 1)
+	if _, ok := c.UserSnapshot("dave"); ok {
+		t.Error("Close of untracked user dave created an entry")
+	}
+
+	for _, username := range []string{"alice", "carol"} {
+		if _, ok := c.UserSnapshot(username); !ok {
+			t.Errorf("Active user %s was evicted", username)
+		}
+	}
+}
+
+func TestCollectorPruneIdle(t *testing.T) {
+	c := newTestCollector(0)
+
+	c.TCPConnOpened("alice")       // t=1
+	c.TCPConnClosed("alice", 0, 0) // t=2
+	c.UDPSessionOpened("bob")      // t=3
+	c.TCPConnOpened("carol")       // t=4
+	c.TCPConnClosed("carol", 0, 0) // t=5
+
+	// now = 6, so alice has been idle for 4s and carol for 1s. bob is active.
+	if n := c.PruneIdle(2 * time.Second); n != 1 {
+		t.Errorf("PruneIdle() returned %d, expected 1", n)
+	}
+	if _, ok := c.UserSnapshot("alice"); ok {
+		t.Error("Idle user alice was not pruned")
+	}
+	for _, username := range []string{"bob", "carol"} {
+		if _, ok := c.UserSnapshot(username); !ok {
+			t.Errorf("User %s was pruned", username)
+		}
+	}
+}
+
+func TestNilCollector(t *testing.T) {
+	var c *Collector
+	c.TCPConnOpened("alice")
+	c.TCPConnTransferred("alice", 1, 1)
+	c.TCPConnClosed("alice", 1, 1)
+	c.UDPSessionOpened("alice")
+	c.UDPSessionClosed("alice", 1, 1)
+	if _, ok := c.UserSnapshot("alice"); ok {
+		t.Error("Nil collector returned a snapshot")
+	}
+	if _, ok := c.ResetUser("alice"); ok {
+		t.Error("Nil collector reset a user")
+	}
+	if users := c.Users(); len(users) != 0 {
+		t.Errorf("Nil collector returned %d users", len(users))
+	}
+	if n := c.PruneIdle(0); n != 0 {
+		t.Errorf("Nil collector PruneIdle() returned %d", n)
+	}
+	c.CollectSessionSetupFailure(SessionSetupFailureSocket)
+	if n := c.SessionSetupFailures()["socket"]; n != 0 {
+		t.Errorf("Nil collector counted %d socket failures", n)
+	}
+	c.CollectNATConnError(NATConnErrorTransient)
+	if n := c.NATConnErrors()["transient"]; n != 0 {
+		t.Errorf("Nil collector counted %d transient NAT socket failures", n)
+	}
+	c.CollectPacketDrops(PacketDropSendBufferFull, 1)
+	if n := c.PacketDrops()["send_buffer_full"]; n != 0 {
+		t.Errorf("Nil collector counted %d packets dropped on full send buffers", n)
+	}
+	c.CollectUplinkSendmmsgBatch(1)
+	c.CollectDownlinkSendmmsgBatch(1)
+	if uplink, downlink := c.SendmmsgBatchSizes(); uplink.Count != 0 || downlink.Count != 0 {
+		t.Errorf("Nil collector counted %d uplink and %d downlink batches", uplink.Count, downlink.Count)
+	}
+	c.ObserveSessionSetupLatency(time.Millisecond)
+	c.ObserveRelayDelay(time.Microsecond)
+	if setup, delay := c.SessionSetupLatency(), c.RelayDelay(); setup.Count != 0 || delay.Count != 0 {
+		t.Errorf("Nil collector observed %d setup latencies and %d relay delays", setup.Count, delay.Count)
+	}
+}
+
+func TestCollectorSessionSetupFailures(t *testing.T) {
+	c := newTestCollector(1)
+	c.CollectSessionSetupFailure(SessionSetupFailureSocket)
+	c.CollectSessionSetupFailure(SessionSetupFailureSocket)
+	c.CollectSessionSetupFailure(SessionSetupFailureRoute)
+	c.CollectSessionSetupFailure(sessionSetupFailureReasonCount)
+
+	expected := map[string]uint64{
+		"route":              1,
+		"client_session":     0,
+		"server_packer":      0,
+		"socket":             2,
+		"deadline":           0,
+		"queue":              0,
+		"target_not_allowed": 0,
+	}
+	failures := c.SessionSetupFailures()
+	if len(failures) != len(expected) {
+		t.Errorf("SessionSetupFailures() returned %d reasons, expected %d: %v", len(failures), len(expected), failures)
+	}
+	for reason, n := range expected {
+		if failures[reason] != n {
+			t.Errorf("Reason %q has %d failures, expected %d", reason, failures[reason], n)
+		}
+	}
+}
+
+func TestCollectorNATConnErrors(t *testing.T) {
+	c := newTestCollector(1)
+	c.CollectNATConnError(NATConnErrorTransient)
+	c.CollectNATConnError(NATConnErrorTransient)
+	c.CollectNATConnError(NATConnErrorPermanent)
+	c.CollectNATConnError(natConnErrorKindCount)
+
+	expected := map[string]uint64{
+		"transient": 2,
+		"permanent": 1,
+	}
+	errs := c.NATConnErrors()
+	if len(errs) != len(expected) {
+		t.Errorf("NATConnErrors() returned %d kinds, expected %d: %v", len(errs), len(expected), errs)
+	}
+	for kind, n := range expected {
+		if errs[kind] != n {
+			t.Errorf("Kind %q has %d failures, expected %d", kind, errs[kind], n)
+		}
+	}
+}
+
+func TestCollectorPacketDrops(t *testing.T) {
+	c := newTestCollector(1)
+	c.CollectPacketDrops(PacketDropSendBufferFull, 2)
+	c.CollectPacketDrops(PacketDropSendBufferFull, 3)
+	c.CollectPacketDrops(PacketDropSendError, 1)
+	c.CollectPacketDrops(packetDropReasonCount, 1)
+
+	expected := map[string]uint64{
+		"send_buffer_full": 5,
+		"send_error":       1,
+	}
+	drops := c.PacketDrops()
+	if len(drops) != len(expected) {
+		t.Errorf("PacketDrops() returned %d reasons, expected %d: %v", len(drops), len(expected), drops)
+	}
+	for reason, n := range expected {
+		if drops[reason] != n {
+			t.Errorf("Reason %q has %d drops, expected %d", reason, drops[reason], n)
+		}
+	}
+}
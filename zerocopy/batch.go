@@ -0,0 +1,12 @@
+package zerocopy
+
+import "net/netip"
+
+// Packet is a packed packet ready to be written to its destination.
+type Packet struct {
+	// Buf is the packet.
+	Buf []byte
+
+	// Addr is the destination address.
+	Addr netip.AddrPort
+}
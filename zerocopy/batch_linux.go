@@ -0,0 +1,76 @@
+package zerocopy
+
+import (
+	"net"
+	"unsafe"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"golang.org/x/sys/unix"
+)
+
+// PacketBatchWriter writes batches of packets to an unconnected UDP socket.
+//
+// On Linux, each batch is written with as few sendmmsg(2) calls as possible.
+// On other platforms, packets are written one by one.
+// On Linux, the socket must be able to send to IPv6 addresses, i.e. an IPv6 or dual-stack socket.
+//
+// PacketBatchWriter is not safe for concurrent use.
+type PacketBatchWriter struct {
+	conn    *net.UDPConn
+	namevec []unix.RawSockaddrInet6
+	iovec   []unix.Iovec
+	msgvec  []conn.Mmsghdr
+}
+
+// NewPacketBatchWriter returns a new batch writer for c.
+// Batches larger than maxBatchSize are split into multiple writes.
+func NewPacketBatchWriter(c *net.UDPConn, maxBatchSize int) *PacketBatchWriter {
+	w := PacketBatchWriter{
+		conn:    c,
+		namevec: make([]unix.RawSockaddrInet6, maxBatchSize),
+		iovec:   make([]unix.Iovec, maxBatchSize),
+		msgvec:  make([]conn.Mmsghdr, maxBatchSize),
+	}
+
+	for i := range w.msgvec {
+		w.msgvec[i].Msghdr.Name = (*byte)(unsafe.Pointer(&w.namevec[i]))
+		w.msgvec[i].Msghdr.Namelen = unix.SizeofSockaddrInet6
+		w.msgvec[i].Msghdr.Iov = &w.iovec[i]
+		w.msgvec[i].Msghdr.SetIovlen(1)
+	}
+
+	return &w
+}
+
+// WriteBatch writes all packets to their destinations.
+//
+// A packet that fails to be written is dropped, and writing continues with the next packet.
+// It returns the number of packets written. Only the last encountered error is returned.
+// On Linux, the error may be a *conn.DroppedMessagesError.
+func (w *PacketBatchWriter) WriteBatch(packets []Packet) (n int, err error) {
+	for len(packets) > 0 {
+		count := len(packets)
+		if count > len(w.msgvec) {
+			count = len(w.msgvec)
+		}
+
+		for i := range packets[:count] {
+			w.namevec[i] = conn.AddrPortToSockaddrInet6(packets[i].Addr)
+			if len(packets[i].Buf) > 0 {
+				w.iovec[i].Base = &packets[i].Buf[0]
+			} else {
+				w.iovec[i].Base = nil
+			}
+			w.iovec[i].SetLen(len(packets[i].Buf))
+		}
+
+		sent, werr := conn.WriteMsgvec(w.conn, w.msgvec[:count])
+		if werr != nil {
+			err = werr
+		}
+		n += sent
+
+		packets = packets[count:]
+	}
+	return
+}
@@ -0,0 +1,40 @@
+//go:build !linux
+
+package zerocopy
+
+import "net"
+
+// PacketBatchWriter writes batches of packets to an unconnected UDP socket.
+//
+// On Linux, each batch is written with as few sendmmsg(2) calls as possible.
+// On other platforms, packets are written one by one.
+// On Linux, the socket must be able to send to IPv6 addresses, i.e. an IPv6 or dual-stack socket.
+//
+// PacketBatchWriter is not safe for concurrent use.
+type PacketBatchWriter struct {
+	conn *net.UDPConn
+}
+
+// NewPacketBatchWriter returns a new batch writer for c.
+// Batches larger than maxBatchSize are split into multiple writes.
+func NewPacketBatchWriter(c *net.UDPConn, maxBatchSize int) *PacketBatchWriter {
+	return &PacketBatchWriter{
+		conn: c,
+	}
+}
+
+// WriteBatch writes all packets to their destinations.
+//
+// A packet that fails to be written is dropped, and writing continues with the next packet.
+// It returns the number of packets written. Only the last encountered error is returned.
+// On Linux, the error may be a *conn.DroppedMessagesError.
+func (w *PacketBatchWriter) WriteBatch(packets []Packet) (n int, err error) {
+	for i := range packets {
+		if _, werr := w.conn.WriteToUDPAddrPort(packets[i].Buf, packets[i].Addr); werr != nil {
+			err = werr
+			continue
+		}
+		n++
+	}
+	return
+}
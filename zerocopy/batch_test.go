@@ -0,0 +1,71 @@
+package zerocopy
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestPacketBatchWriter(t *testing.T) {
+	const (
+		maxBatchSize = 2
+		packetCount  = 5
+	)
+
+	// On Linux, destination addresses are always passed as IPv6 socket addresses,
+	// so the writing socket must be dual-stack, like the relay's natConn.
+	src, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	dsts := make([]*net.UDPConn, 2)
+	for i := range dsts {
+		dsts[i], err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dsts[i].Close()
+	}
+
+	packets := make([]Packet, packetCount)
+	for i := range packets {
+		packets[i] = Packet{
+			Buf:  []byte{byte(i), byte(i), byte(i)},
+			Addr: dsts[i%len(dsts)].LocalAddr().(*net.UDPAddr).AddrPort(),
+		}
+	}
+
+	w := NewPacketBatchWriter(src, maxBatchSize)
+	n, err := w.WriteBatch(packets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(packets) {
+		t.Fatalf("WriteBatch() wrote %d packets, expected %d", n, len(packets))
+	}
+
+	srcAddrPort := netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), src.LocalAddr().(*net.UDPAddr).AddrPort().Port())
+	b := make([]byte, 16)
+
+	for i := range packets {
+		dst := dsts[i%len(dsts)]
+		if err = dst.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		n, addrPort, err := dst.ReadFromUDPAddrPort(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrPort = netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+		if addrPort != srcAddrPort {
+			t.Errorf("Packet %d source is %s, expected %s", i, addrPort, srcAddrPort)
+		}
+		if !bytes.Equal(b[:n], packets[i].Buf) {
+			t.Errorf("Packet %d is %v, expected %v", i, b[:n], packets[i].Buf)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package zerocopy
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ByteCounter counts the bytes read from and written to a stream.
+type ByteCounter interface {
+	// BytesRead returns the number of bytes read from the stream.
+	BytesRead() uint64
+
+	// BytesWritten returns the number of bytes written to the stream.
+	BytesWritten() uint64
+
+	// Unreported returns the number of bytes read and written since the previous call,
+	// and marks them as reported. Summing the results of all calls gives the total counts.
+	Unreported() (bytesRead, bytesWritten uint64)
+
+	// StartReporting calls report with the unreported byte counts every interval,
+	// until the returned stop function is called. The stop function reports
+	// the remaining counts before returning, so no bytes are left unreported.
+	// report is not called with zero counts.
+	StartReporting(interval time.Duration, report func(bytesRead, bytesWritten uint64)) (stop func())
+}
+
+// byteCounter implements [ByteCounter].
+type byteCounter struct {
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+
+	// reportMu protects the reported counters.
+	reportMu             sync.Mutex
+	bytesReadReported    uint64
+	bytesWrittenReported uint64
+}
+
+// CountingConn wraps a [DirectReadWriteCloser] and counts the bytes read from and written to it.
+//
+// CountingConn implements [io.ReaderFrom] and [io.WriterTo] by delegating to the underlying connection
+// when it implements them, so wrapping a [*net.TCPConn] does not defeat splice(2).
+// Bytes transferred by a delegated call are counted when the call returns.
+//
+// Counters may be read concurrently with reads and writes. See [ByteCounter].
+type CountingConn struct {
+	DirectReadWriteCloser
+	byteCounter
+}
+
+// NewCountingConn returns a new CountingConn that wraps rwc.
+func NewCountingConn(rwc DirectReadWriteCloser) *CountingConn {
+	return &CountingConn{DirectReadWriteCloser: rwc}
+}
+
+// Read implements the io.Reader Read method.
+func (c *CountingConn) Read(b []byte) (n int, err error) {
+	n, err = c.DirectReadWriteCloser.Read(b)
+	c.bytesRead.Add(uint64(n))
+	return
+}
+
+// Write implements the io.Writer Write method.
+func (c *CountingConn) Write(b []byte) (n int, err error) {
+	n, err = c.DirectReadWriteCloser.Write(b)
+	c.bytesWritten.Add(uint64(n))
+	return
+}
+
+// ReadFrom implements the io.ReaderFrom ReadFrom method.
+func (c *CountingConn) ReadFrom(r io.Reader) (n int64, err error) {
+	if rf, ok := c.DirectReadWriteCloser.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+		c.bytesWritten.Add(uint64(n))
+		return
+	}
+	// Hide ReadFrom from io.Copy. Write does the counting.
+	return io.Copy(struct{ io.Writer }{c}, r)
+}
+
+// WriteTo implements the io.WriterTo WriteTo method.
+func (c *CountingConn) WriteTo(w io.Writer) (n int64, err error) {
+	if wt, ok := c.DirectReadWriteCloser.(io.WriterTo); ok {
+		n, err = wt.WriteTo(w)
+		c.bytesRead.Add(uint64(n))
+		return
+	}
+	// Hide WriteTo from io.Copy. Read does the counting.
+	return io.Copy(w, struct{ io.Reader }{c})
+}
+
+// BytesRead implements the ByteCounter BytesRead method.
+func (c *byteCounter) BytesRead() uint64 {
+	return c.bytesRead.Load()
+}
+
+// BytesWritten implements the ByteCounter BytesWritten method.
+func (c *byteCounter) BytesWritten() uint64 {
+	return c.bytesWritten.Load()
+}
+
+// Unreported implements the ByteCounter Unreported method.
+func (c *byteCounter) Unreported() (bytesRead, bytesWritten uint64) {
+	c.reportMu.Lock()
+	defer c.reportMu.Unlock()
+
+	totalRead := c.bytesRead.Load()
+	totalWritten := c.bytesWritten.Load()
+	bytesRead = totalRead - c.bytesReadReported
+	bytesWritten = totalWritten - c.bytesWrittenReported
+	c.bytesReadReported = totalRead
+	c.bytesWrittenReported = totalWritten
+	return
+}
+
+// StartReporting implements the ByteCounter StartReporting method.
+func (c *byteCounter) StartReporting(interval time.Duration, report func(bytesRead, bytesWritten uint64)) (stop func()) {
+	flush := func() {
+		if bytesRead, bytesWritten := c.Unreported(); bytesRead != 0 || bytesWritten != 0 {
+			report(bytesRead, bytesWritten)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	exited := make(chan struct{})
+
+	go func() {
+		defer close(exited)
+		for {
+			select {
+			case <-ticker.C:
+				flush()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-exited
+		flush()
+	}
+}
+
+// countingChunkSize is the maximum number of bytes transferred by a single delegated
+// [io.ReaderFrom] call of a counting ReadWriter, so that long transfers are counted as they progress.
+const countingChunkSize = 1 << 20
+
+// NewCountingReadWriter returns a [ReadWriter] that wraps rw and counts the payload bytes read from and written to it,
+// and the counter of the returned ReadWriter.
+//
+// If rw provides direct access to its underlying reader and writer, so does the returned ReadWriter,
+// with the underlying reader and writer wrapped for counting. The wrappers delegate [io.ReaderFrom]
+// with the underlying reader limited by an [*io.LimitedReader], so that splice(2) is not defeated.
+// Each delegated call transfers up to 1 MiB, and is counted when it returns.
+func NewCountingReadWriter(rw ReadWriter) (ReadWriter, ByteCounter) {
+	crw := &countingReadWriter{ReadWriter: rw}
+	if _, ok := rw.(DirectReadCloser); ok {
+		if _, ok := rw.(DirectWriteCloser); ok {
+			return &countingDirectReadWriter{crw}, crw
+		}
+	}
+	return crw, crw
+}
+
+// countingReadWriter counts the payload bytes read from and written to a ReadWriter.
+type countingReadWriter struct {
+	ReadWriter
+	byteCounter
+}
+
+// ReadZeroCopy implements the Reader ReadZeroCopy method.
+func (rw *countingReadWriter) ReadZeroCopy(b []byte, payloadBufStart, payloadBufLen int) (payloadLen int, err error) {
+	payloadLen, err = rw.ReadWriter.ReadZeroCopy(b, payloadBufStart, payloadBufLen)
+	rw.bytesRead.Add(uint64(payloadLen))
+	return
+}
+
+// WriteZeroCopy implements the Writer WriteZeroCopy method.
+func (rw *countingReadWriter) WriteZeroCopy(b []byte, payloadStart, payloadLen int) (payloadWritten int, err error) {
+	payloadWritten, err = rw.ReadWriter.WriteZeroCopy(b, payloadStart, payloadLen)
+	rw.bytesWritten.Add(uint64(payloadWritten))
+	return
+}
+
+// countingDirectReadWriter is a countingReadWriter that provides direct access to
+// the underlying reader and writer of a ReadWriter, wrapped for counting.
+type countingDirectReadWriter struct {
+	*countingReadWriter
+}
+
+// DirectReadCloser implements the DirectReadCloser DirectReadCloser method.
+func (rw *countingDirectReadWriter) DirectReadCloser() io.ReadCloser {
+	return &countingReadCloser{
+		ReadCloser: rw.ReadWriter.(DirectReadCloser).DirectReadCloser(),
+		n:          &rw.bytesRead,
+	}
+}
+
+// DirectWriteCloser implements the DirectWriteCloser DirectWriteCloser method.
+func (rw *countingDirectReadWriter) DirectWriteCloser() io.WriteCloser {
+	return &countingWriteCloser{
+		WriteCloser: rw.ReadWriter.(DirectWriteCloser).DirectWriteCloser(),
+		n:           &rw.bytesWritten,
+	}
+}
+
+// countingReadCloser counts the bytes read from an io.ReadCloser in n.
+type countingReadCloser struct {
+	io.ReadCloser
+	n *atomic.Uint64
+}
+
+// Read implements the io.Reader Read method.
+func (r *countingReadCloser) Read(b []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(b)
+	r.n.Add(uint64(n))
+	return
+}
+
+// WriteTo implements the io.WriterTo WriteTo method.
+func (r *countingReadCloser) WriteTo(w io.Writer) (n int64, err error) {
+	if cw, ok := w.(*countingWriteCloser); ok {
+		return cw.ReadFrom(r)
+	}
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return readFromChunked(rf, r.ReadCloser, r.n, nil)
+	}
+	// Hide WriteTo from io.Copy. Read does the counting.
+	return io.Copy(w, struct{ io.Reader }{r})
+}
+
+// countingWriteCloser counts the bytes written to an io.WriteCloser in n.
+type countingWriteCloser struct {
+	io.WriteCloser
+	n *atomic.Uint64
+}
+
+// Write implements the io.Writer Write method.
+func (w *countingWriteCloser) Write(b []byte) (n int, err error) {
+	n, err = w.WriteCloser.Write(b)
+	w.n.Add(uint64(n))
+	return
+}
+
+// ReadFrom implements the io.ReaderFrom ReadFrom method.
+func (w *countingWriteCloser) ReadFrom(r io.Reader) (n int64, err error) {
+	if rf, ok := w.WriteCloser.(io.ReaderFrom); ok {
+		// Pass the underlying reader, so that the writer may splice from it.
+		if cr, ok := r.(*countingReadCloser); ok {
+			return readFromChunked(rf, cr.ReadCloser, cr.n, w.n)
+		}
+		return readFromChunked(rf, r, nil, w.n)
+	}
+	// Hide ReadFrom from io.Copy. Write does the counting.
+	return io.Copy(struct{ io.Writer }{w}, r)
+}
+
+// readFromChunked calls rf.ReadFrom with r limited to countingChunkSize bytes until r is drained,
+// and adds the bytes transferred by each call to the non-nil counters of rn and wn.
+func readFromChunked(rf io.ReaderFrom, r io.Reader, rn, wn *atomic.Uint64) (n int64, err error) {
+	lr := io.LimitedReader{R: r}
+	for {
+		lr.N = countingChunkSize
+		var nr int64
+		nr, err = rf.ReadFrom(&lr)
+		n += nr
+		if rn != nil {
+			rn.Add(uint64(nr))
+		}
+		if wn != nil {
+			wn.Add(uint64(nr))
+		}
+		// A short transfer without error means r has reached EOF.
+		if err != nil || lr.N > 0 {
+			return
+		}
+	}
+}
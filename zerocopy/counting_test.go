@@ -0,0 +1,196 @@
+package zerocopy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCountingConn(t *testing.T) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Echo until the client closes its write side.
+	go func() {
+		c, err := l.AcceptTCP()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if _, err = io.Copy(c, c); err != nil {
+			return
+		}
+		c.CloseWrite()
+	}()
+
+	tc, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCountingConn(tc)
+	defer c.Close()
+
+	var (
+		mu                          sync.Mutex
+		reportedRead, reportedWrite uint64
+	)
+	stop := c.StartReporting(time.Millisecond, func(bytesRead, bytesWritten uint64) {
+		mu.Lock()
+		reportedRead += bytesRead
+		reportedWrite += bytesWritten
+		mu.Unlock()
+	})
+
+	data := make([]byte, 64*1024)
+	if _, err = rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Written with io.ReaderFrom, and the first few bytes with io.Writer.
+	if _, err = c.Write(data[:16]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.Copy(c, bytes.NewReader(data[16:])); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read with io.WriterTo.
+	var echo bytes.Buffer
+	if _, err = io.Copy(&echo, c); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echo.Bytes(), data) {
+		t.Error("Echoed data mismatch")
+	}
+
+	if n := c.BytesWritten(); n != uint64(len(data)) {
+		t.Errorf("BytesWritten() = %d, expected %d", n, len(data))
+	}
+	if n := c.BytesRead(); n != uint64(len(data)) {
+		t.Errorf("BytesRead() = %d, expected %d", n, len(data))
+	}
+
+	stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if reportedRead != uint64(len(data)) || reportedWrite != uint64(len(data)) {
+		t.Errorf("Reported %d bytes read and %d bytes written, expected %d each", reportedRead, reportedWrite, len(data))
+	}
+
+	if bytesRead, bytesWritten := c.Unreported(); bytesRead != 0 || bytesWritten != 0 {
+		t.Errorf("Unreported() = %d, %d after stop, expected 0, 0", bytesRead, bytesWritten)
+	}
+}
+
+// testStreamReadWriter is a ReadWriter over an io.ReadCloser and an io.WriteCloser,
+// which it also provides direct access to.
+type testStreamReadWriter struct {
+	ZeroHeadroom
+	r io.ReadCloser
+	w io.WriteCloser
+}
+
+func (rw *testStreamReadWriter) MinPayloadBufferSizePerRead() int {
+	return 0
+}
+
+func (rw *testStreamReadWriter) ReadZeroCopy(b []byte, payloadBufStart, payloadBufLen int) (payloadLen int, err error) {
+	return rw.r.Read(b[payloadBufStart : payloadBufStart+payloadBufLen])
+}
+
+func (rw *testStreamReadWriter) MaxPayloadSizePerWrite() int {
+	return 0
+}
+
+func (rw *testStreamReadWriter) WriteZeroCopy(b []byte, payloadStart, payloadLen int) (payloadWritten int, err error) {
+	return rw.w.Write(b[payloadStart : payloadStart+payloadLen])
+}
+
+func (rw *testStreamReadWriter) DirectReadCloser() io.ReadCloser {
+	return rw.r
+}
+
+func (rw *testStreamReadWriter) DirectWriteCloser() io.WriteCloser {
+	return rw.w
+}
+
+func (rw *testStreamReadWriter) CloseRead() error {
+	return nil
+}
+
+func (rw *testStreamReadWriter) CloseWrite() error {
+	return nil
+}
+
+func (rw *testStreamReadWriter) Close() error {
+	return nil
+}
+
+// testReaderFromRecorder records the reader passed to its ReadFrom method.
+type testReaderFromRecorder struct {
+	testBytesBufferCloser
+	r io.Reader
+}
+
+func (w *testReaderFromRecorder) ReadFrom(r io.Reader) (int64, error) {
+	w.r = r
+	return w.Buffer.ReadFrom(r)
+}
+
+func TestCountingReadWriter(t *testing.T) {
+	for _, direct := range []bool{false, true} {
+		// Longer than a chunk, so that delegated transfers are split.
+		data := make([]byte, countingChunkSize+64*1024)
+		if _, err := rand.Read(data); err != nil {
+			t.Fatal(err)
+		}
+		srcReader := &testBytesReadCloser{bytes.NewReader(data)}
+		dstWriter := &testReaderFromRecorder{testBytesBufferCloser: testBytesBufferCloser{&bytes.Buffer{}}}
+
+		var src, dst ReadWriter = &testStreamReadWriter{r: srcReader}, &testStreamReadWriter{w: dstWriter}
+		if !direct {
+			// Hide the direct access methods.
+			src = struct{ ReadWriter }{src}
+			dst = struct{ ReadWriter }{dst}
+		}
+
+		src, srcCounter := NewCountingReadWriter(src)
+		dst, dstCounter := NewCountingReadWriter(dst)
+		if _, ok := src.(DirectReadCloser); ok != direct {
+			t.Errorf("direct: %v, counting ReadWriter provides direct access: %v", direct, ok)
+		}
+
+		n, err := Relay(dst, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(data)) || !bytes.Equal(dstWriter.Bytes(), data) {
+			t.Errorf("direct: %v, relayed %d bytes, expected %d", direct, n, len(data))
+		}
+
+		if got := srcCounter.BytesRead(); got != uint64(len(data)) {
+			t.Errorf("direct: %v, BytesRead() = %d, expected %d", direct, got, len(data))
+		}
+		if got := dstCounter.BytesWritten(); got != uint64(len(data)) {
+			t.Errorf("direct: %v, BytesWritten() = %d, expected %d", direct, got, len(data))
+		}
+
+		// The writer is handed the underlying reader, so that it may splice from it.
+		if direct {
+			if lr, ok := dstWriter.r.(*io.LimitedReader); !ok || lr.R != io.Reader(srcReader) {
+				t.Errorf("ReadFrom got reader %#v, expected the underlying reader limited by *io.LimitedReader", dstWriter.r)
+			}
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package zerocopy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"github.com/database64128/shadowsocks-go/conn"
+)
+
+// FakeSessionHeaderLength is the length of the header of a fake session packet.
+//
+// A fake session packet is laid out as follows:
+//
+//	+------------+---------+------+---------------------+
+//	| session ID | address | port |       payload       |
+//	+------------+---------+------+---------------------+
+//	|  u64be     |   16B   | u16be| XOR'ed with the key |
+//	+------------+---------+------+---------------------+
+//
+// In client packets, the address and port are the target address.
+// In server packets, they are the payload source address.
+const FakeSessionHeaderLength = 8 + 16 + 2
+
+var (
+	ErrFakeSessionIDMismatch = errors.New("fake session ID mismatch")
+	ErrFakeSessionDomainName = errors.New("fake session packets do not support domain name targets")
+)
+
+// fakeSessionHeadroom implements the Headroom interface for fake session packers and unpackers.
+type fakeSessionHeadroom struct{}
+
+// FrontHeadroom implements the Headroom FrontHeadroom method.
+func (fakeSessionHeadroom) FrontHeadroom() int {
+	return FakeSessionHeaderLength
+}
+
+// RearHeadroom implements the Headroom RearHeadroom method.
+func (fakeSessionHeadroom) RearHeadroom() int {
+	return 0
+}
+
+func xorBytes(b []byte, key byte) {
+	if key == 0 {
+		return
+	}
+	for i := range b {
+		b[i] ^= key
+	}
+}
+
+func putFakeSessionHeader(b []byte, csid uint64, addrPort netip.AddrPort) {
+	binary.BigEndian.PutUint64(b, csid)
+	addr16 := addrPort.Addr().As16()
+	copy(b[8:], addr16[:])
+	binary.BigEndian.PutUint16(b[8+16:], addrPort.Port())
+}
+
+func parseFakeSessionHeader(b []byte) (csid uint64, addrPort netip.AddrPort) {
+	csid = binary.BigEndian.Uint64(b)
+	addr := netip.AddrFrom16(*(*[16]byte)(b[8:])).Unmap()
+	port := binary.BigEndian.Uint16(b[8+16:])
+	addrPort = netip.AddrPortFrom(addr, port)
+	return
+}
+
+// FakeSessionServer is an in-memory UDP session server for tests.
+// It frames packets with a plaintext header and XORs payloads with Key.
+// A zero Key leaves payloads unchanged.
+//
+// FakeSessionServer implements the UDPSessionServer interface.
+type FakeSessionServer struct {
+	fakeSessionHeadroom
+	Key byte
+
+	// SessionID, if not nil, maps the session ID in client packets to the session ID
+	// reported by SessionInfo and expected by unpackers. Server packets carry the mapped ID.
+	//
+	// Tests use it to control the session IDs seen by the session table,
+	// for example to make sessions of different clients collide.
+	SessionID func(wireID uint64) uint64
+
+	// Username, if not empty, is reported by unpackers as the authenticated username of every session.
+	Username string
+}
+
+func (s *FakeSessionServer) sessionID(wireID uint64) uint64 {
+	if s.SessionID == nil {
+		return wireID
+	}
+	return s.SessionID(wireID)
+}
+
+// SessionInfo implements the UDPSessionServer SessionInfo method.
+func (s *FakeSessionServer) SessionInfo(b []byte) (csid uint64, err error) {
+	if len(b) < FakeSessionHeaderLength {
+		err = fmt.Errorf("%w: %d", ErrPacketTooSmall, len(b))
+		return
+	}
+	csid = s.sessionID(binary.BigEndian.Uint64(b))
+	return
+}
+
+// NewUnpacker implements the UDPSessionServer NewUnpacker method.
+func (s *FakeSessionServer) NewUnpacker(b []byte, csid uint64) (ServerUnpacker, error) {
+	return &FakeSessionServerUnpacker{
+		csid:      csid,
+		key:       s.Key,
+		sessionID: s.sessionID,
+		username:  s.Username,
+	}, nil
+}
+
+// NewPacker implements the UDPSessionServer NewPacker method.
+func (s *FakeSessionServer) NewPacker(csid uint64) (ServerPacker, error) {
+	return &FakeSessionServerPacker{
+		csid: csid,
+		key:  s.Key,
+	}, nil
+}
+
+// FakeSessionIDCounter assigns sequential session IDs to client session IDs in order of first appearance.
+// The zero value starts from 0. Set Next to start elsewhere, such as near the wraparound point.
+//
+// Its SessionID method can be used as [FakeSessionServer.SessionID].
+type FakeSessionIDCounter struct {
+	// Next is the session ID assigned to the next new client session ID.
+	Next uint64
+
+	mu  sync.Mutex
+	ids map[uint64]uint64
+}
+
+// SessionID returns the session ID assigned to wireID, assigning the next one if wireID is new.
+func (c *FakeSessionIDCounter) SessionID(wireID uint64) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if id, ok := c.ids[wireID]; ok {
+		return id
+	}
+	if c.ids == nil {
+		c.ids = make(map[uint64]uint64)
+	}
+	id := c.Next
+	c.ids[wireID] = id
+	c.Next++
+	return id
+}
+
+// FakeSessionServerPacker packs fake session packets for the client.
+//
+// FakeSessionServerPacker implements the ServerPacker interface.
+type FakeSessionServerPacker struct {
+	fakeSessionHeadroom
+	csid uint64
+	key  byte
+}
+
+// PackInPlace implements the ServerPacker PackInPlace method.
+func (p *FakeSessionServerPacker) PackInPlace(b []byte, sourceAddrPort netip.AddrPort, payloadStart, payloadLen, maxPacketLen int) (packetStart, packetLen int, err error) {
+	packetStart = payloadStart - FakeSessionHeaderLength
+	packetLen = FakeSessionHeaderLength + payloadLen
+	if packetLen > maxPacketLen {
+		err = fmt.Errorf("%w: payloadLen: %d maxPacketLen: %d", ErrPayloadTooBig, payloadLen, maxPacketLen)
+		return
+	}
+	putFakeSessionHeader(b[packetStart:], p.csid, sourceAddrPort)
+	xorBytes(b[payloadStart:payloadStart+payloadLen], p.key)
+	return
+}
+
+// FakeSessionServerUnpacker unpacks fake session packets from the client.
+//
+// FakeSessionServerUnpacker implements the ServerUnpacker and UserIdentifier interfaces.
+type FakeSessionServerUnpacker struct {
+	fakeSessionHeadroom
+	csid      uint64
+	key       byte
+	sessionID func(wireID uint64) uint64
+	username  string
+}
+
+// Username implements the UserIdentifier Username method.
+func (p *FakeSessionServerUnpacker) Username() string {
+	return p.username
+}
+
+// UnpackInPlace implements the ServerUnpacker UnpackInPlace method.
+func (p *FakeSessionServerUnpacker) UnpackInPlace(b []byte, sourceAddrPort netip.AddrPort, packetStart, packetLen int) (targetAddr conn.Addr, payloadStart, payloadLen int, err error) {
+	if packetLen < FakeSessionHeaderLength {
+		err = fmt.Errorf("%w: %d", ErrPacketTooSmall, packetLen)
+		return
+	}
+	csid, targetAddrPort := parseFakeSessionHeader(b[packetStart:])
+	if p.sessionID != nil {
+		csid = p.sessionID(csid)
+	}
+	if csid != p.csid {
+		err = fmt.Errorf("%w: expected %d, got %d", ErrFakeSessionIDMismatch, p.csid, csid)
+		return
+	}
+	targetAddr = conn.AddrFromIPPort(targetAddrPort)
+	payloadStart = packetStart + FakeSessionHeaderLength
+	payloadLen = packetLen - FakeSessionHeaderLength
+	xorBytes(b[payloadStart:payloadStart+payloadLen], p.key)
+	return
+}
+
+// FakeSessionClientPackUnpacker is the client side of a fake session.
+// All packets are sent to the server address.
+//
+// FakeSessionClientPackUnpacker implements the ClientPackUnpacker interface.
+type FakeSessionClientPackUnpacker struct {
+	fakeSessionHeadroom
+	csid           uint64
+	key            byte
+	serverAddrPort netip.AddrPort
+}
+
+// NewFakeSessionClientPackUnpacker returns a new fake session client packer and unpacker
+// for the given session ID, XOR key and server address.
+func NewFakeSessionClientPackUnpacker(csid uint64, key byte, serverAddrPort netip.AddrPort) *FakeSessionClientPackUnpacker {
+	return &FakeSessionClientPackUnpacker{
+		csid:           csid,
+		key:            key,
+		serverAddrPort: serverAddrPort,
+	}
+}
+
+// PackInPlace implements the ClientPacker PackInPlace method.
+func (p *FakeSessionClientPackUnpacker) PackInPlace(b []byte, targetAddr conn.Addr, payloadStart, payloadLen int) (destAddrPort netip.AddrPort, packetStart, packetLen int, err error) {
+	if !targetAddr.IsIP() {
+		err = ErrFakeSessionDomainName
+		return
+	}
+	packetStart = payloadStart - FakeSessionHeaderLength
+	packetLen = FakeSessionHeaderLength + payloadLen
+	putFakeSessionHeader(b[packetStart:], p.csid, targetAddr.IPPort())
+	xorBytes(b[payloadStart:payloadStart+payloadLen], p.key)
+	destAddrPort = p.serverAddrPort
+	return
+}
+
+// UnpackInPlace implements the ClientUnpacker UnpackInPlace method.
+func (p *FakeSessionClientPackUnpacker) UnpackInPlace(b []byte, packetSourceAddrPort netip.AddrPort, packetStart, packetLen int) (payloadSourceAddrPort netip.AddrPort, payloadStart, payloadLen int, err error) {
+	if packetLen < FakeSessionHeaderLength {
+		err = fmt.Errorf("%w: %d", ErrPacketTooSmall, packetLen)
+		return
+	}
+	csid, payloadSourceAddrPort := parseFakeSessionHeader(b[packetStart:])
+	if csid != p.csid {
+		err = fmt.Errorf("%w: expected %d, got %d", ErrFakeSessionIDMismatch, p.csid, csid)
+		return
+	}
+	payloadStart = packetStart + FakeSessionHeaderLength
+	payloadLen = packetLen - FakeSessionHeaderLength
+	xorBytes(b[payloadStart:payloadStart+payloadLen], p.key)
+	return
+}
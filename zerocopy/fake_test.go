@@ -0,0 +1,96 @@
+package zerocopy
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/database64128/shadowsocks-go/conn"
+)
+
+func TestFakeSessionPackerUnpacker(t *testing.T) {
+	const csid = 42
+	serverAddrPort := netip.MustParseAddrPort("127.0.0.1:20220")
+
+	for _, key := range []byte{0, 0x5a} {
+		s := &FakeSessionServer{Key: key}
+		serverPacker, err := s.NewPacker(csid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverUnpacker, err := s.NewUnpacker(nil, csid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := NewFakeSessionClientPackUnpacker(csid, key, serverAddrPort)
+		ClientServerPackerUnpackerTestFunc(t, c, c, serverPacker, serverUnpacker)
+	}
+}
+
+func TestFakeSessionServerSessionIDMismatch(t *testing.T) {
+	s := &FakeSessionServer{}
+	c := NewFakeSessionClientPackUnpacker(1, 0, netip.MustParseAddrPort("127.0.0.1:20220"))
+	targetAddrPort := netip.MustParseAddrPort("127.0.0.1:53")
+
+	b := make([]byte, FakeSessionHeaderLength+1)
+	_, packetStart, packetLen, err := c.PackInPlace(b, conn.AddrFromIPPort(targetAddrPort), FakeSessionHeaderLength, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csid, err := s.SessionInfo(b[packetStart : packetStart+packetLen])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if csid != 1 {
+		t.Errorf("SessionInfo returned %d, expected 1", csid)
+	}
+
+	unpacker, err := s.NewUnpacker(b, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = unpacker.UnpackInPlace(b, targetAddrPort, packetStart, packetLen); !errors.Is(err, ErrFakeSessionIDMismatch) {
+		t.Errorf("Expected ErrFakeSessionIDMismatch, got %v", err)
+	}
+}
+
+func TestFakeSessionServerSessionID(t *testing.T) {
+	counter := FakeSessionIDCounter{Next: 1<<64 - 1}
+	s := &FakeSessionServer{SessionID: counter.SessionID}
+	targetAddrPort := netip.MustParseAddrPort("127.0.0.1:53")
+
+	// IDs are assigned in order of first appearance, and wrap around.
+	for _, c := range []struct {
+		wireID uint64
+		csid   uint64
+	}{
+		{100, 1<<64 - 1},
+		{50, 0},
+		{100, 1<<64 - 1},
+		{200, 1},
+	} {
+		cpu := NewFakeSessionClientPackUnpacker(c.wireID, 0, netip.MustParseAddrPort("127.0.0.1:20220"))
+		b := make([]byte, FakeSessionHeaderLength+1)
+		_, packetStart, packetLen, err := cpu.PackInPlace(b, conn.AddrFromIPPort(targetAddrPort), FakeSessionHeaderLength, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		csid, err := s.SessionInfo(b[packetStart : packetStart+packetLen])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if csid != c.csid {
+			t.Errorf("SessionInfo returned %d for wire ID %d, expected %d", csid, c.wireID, c.csid)
+		}
+
+		unpacker, err := s.NewUnpacker(b, csid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err = unpacker.UnpackInPlace(b, targetAddrPort, packetStart, packetLen); err != nil {
+			t.Errorf("Failed to unpack packet with wire ID %d: %v", c.wireID, err)
+		}
+	}
+}
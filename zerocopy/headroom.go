@@ -0,0 +1,77 @@
+package zerocopy
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNegativeHeadroom = errors.New("negative headroom")
+	ErrHeadroomTooLarge = errors.New("headroom leaves no room for payload")
+)
+
+// FixedHeadroom is a Headroom with fixed values.
+type FixedHeadroom struct {
+	Front int
+	Rear  int
+}
+
+// FrontHeadroom implements the Headroom FrontHeadroom method.
+func (h FixedHeadroom) FrontHeadroom() int {
+	return h.Front
+}
+
+// RearHeadroom implements the Headroom RearHeadroom method.
+func (h FixedHeadroom) RearHeadroom() int {
+	return h.Rear
+}
+
+// HeadroomOf returns the fixed values of h.
+func HeadroomOf(h Headroom) FixedHeadroom {
+	return FixedHeadroom{h.FrontHeadroom(), h.RearHeadroom()}
+}
+
+// MaxHeadroom returns the maximum front and rear headroom of a and b.
+func MaxHeadroom(a, b Headroom) FixedHeadroom {
+	h := HeadroomOf(a)
+	if front := b.FrontHeadroom(); front > h.Front {
+		h.Front = front
+	}
+	if rear := b.RearHeadroom(); rear > h.Rear {
+		h.Rear = rear
+	}
+	return h
+}
+
+// ExcessHeadroom returns the headroom required by a in excess of b.
+// Negative values are clamped to zero.
+//
+// This is typically used to calculate the extra headroom to reserve in a buffer
+// that is first used by b, then reused in-place by a.
+func ExcessHeadroom(a, b Headroom) FixedHeadroom {
+	h := FixedHeadroom{
+		Front: a.FrontHeadroom() - b.FrontHeadroom(),
+		Rear:  a.RearHeadroom() - b.RearHeadroom(),
+	}
+	if h.Front < 0 {
+		h.Front = 0
+	}
+	if h.Rear < 0 {
+		h.Rear = 0
+	}
+	return h
+}
+
+// CheckHeadroom returns an error if h has negative values,
+// or if h leaves no room for payload in a packet of maxPacketSize bytes.
+func CheckHeadroom(h Headroom, maxPacketSize int) error {
+	front, rear := h.FrontHeadroom(), h.RearHeadroom()
+	if front < 0 || rear < 0 {
+		return fmt.Errorf("%w: front %d, rear %d", ErrNegativeHeadroom, front, rear)
+	}
+	// Compare without adding front and rear, which may overflow.
+	if front >= maxPacketSize || rear >= maxPacketSize-front {
+		return fmt.Errorf("%w: front %d, rear %d, max packet size %d", ErrHeadroomTooLarge, front, rear, maxPacketSize)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package zerocopy
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestMaxHeadroom(t *testing.T) {
+	h := MaxHeadroom(FixedHeadroom{8, 32}, FixedHeadroom{16, 16})
+	if h != (FixedHeadroom{16, 32}) {
+		t.Errorf("Expected {16 32}, got %v", h)
+	}
+}
+
+func TestExcessHeadroom(t *testing.T) {
+	for _, c := range []struct {
+		a, b     FixedHeadroom
+		expected FixedHeadroom
+	}{
+		{FixedHeadroom{32, 16}, FixedHeadroom{8, 0}, FixedHeadroom{24, 16}},
+		{FixedHeadroom{8, 0}, FixedHeadroom{32, 16}, FixedHeadroom{0, 0}},
+		{FixedHeadroom{8, 16}, FixedHeadroom{8, 16}, FixedHeadroom{0, 0}},
+		{FixedHeadroom{8, 16}, HeadroomOf(ZeroHeadroom{}), FixedHeadroom{8, 16}},
+	} {
+		if h := ExcessHeadroom(c.a, c.b); h != c.expected {
+			t.Errorf("ExcessHeadroom(%v, %v) = %v, expected %v", c.a, c.b, h, c.expected)
+		}
+	}
+}
+
+func TestCheckHeadroom(t *testing.T) {
+	for _, c := range []struct {
+		h             FixedHeadroom
+		maxPacketSize int
+		expectedErr   error
+	}{
+		{FixedHeadroom{48, 16}, 1452, nil},
+		{FixedHeadroom{0, 0}, 1, nil},
+		{FixedHeadroom{-1, 0}, 1452, ErrNegativeHeadroom},
+		{FixedHeadroom{0, -1}, 1452, ErrNegativeHeadroom},
+		{FixedHeadroom{1452, 0}, 1452, ErrHeadroomTooLarge},
+		{FixedHeadroom{1000, 452}, 1452, ErrHeadroomTooLarge},
+		{FixedHeadroom{math.MaxInt, math.MaxInt}, 1452, ErrHeadroomTooLarge},
+	} {
+		if err := CheckHeadroom(c.h, c.maxPacketSize); !errors.Is(err, c.expectedErr) {
+			t.Errorf("CheckHeadroom(%v, %d) = %v, expected %v", c.h, c.maxPacketSize, err, c.expectedErr)
+		}
+	}
+}
@@ -22,6 +22,10 @@ const (
 var (
 	ErrPacketTooSmall = errors.New("packet too small to unpack")
 	ErrPayloadTooBig  = errors.New("payload too big to pack")
+
+	// ErrPacketAuthenticationFailed is returned by unpackers when a packet fails authentication,
+	// which indicates a forged or corrupted packet, or a mismatched key.
+	ErrPacketAuthenticationFailed = errors.New("packet authentication failed")
 )
 
 // MaxPacketSizeForAddr calculates the maximum packet size for the given address
@@ -70,6 +74,48 @@ type ServerUnpacker interface {
 	UnpackInPlace(b []byte, sourceAddrPort netip.AddrPort, packetStart, packetLen int) (targetAddr conn.Addr, payloadStart, payloadLen int, err error)
 }
 
+// ReorderStats summarizes the ordering of packets seen by an unpacker that tracks packet sequence numbers.
+type ReorderStats struct {
+	// Accepted is the number of packets that passed the replay check and were successfully unpacked.
+	Accepted uint64 `json:"accepted"`
+
+	// OutOfOrder is the number of accepted packets that arrived after a packet with a higher sequence number.
+	OutOfOrder uint64 `json:"outOfOrder"`
+
+	// MaxReorderDistance is the largest observed difference between the highest accepted
+	// sequence number and the sequence number of an out-of-order packet.
+	MaxReorderDistance uint64 `json:"maxReorderDistance"`
+
+	// Missing is the number of sequence numbers between the first and the highest accepted
+	// that have not been accepted. These packets were either lost or are still in flight.
+	Missing uint64 `json:"missing"`
+
+	// Replayed is the number of packets rejected because their sequence number had already been accepted.
+	Replayed uint64 `json:"replayed"`
+
+	// TooOld is the number of packets rejected because their sequence number fell behind the replay window.
+	TooOld uint64 `json:"tooOld"`
+}
+
+// ReorderStatsReporter is implemented by server unpackers that track packet sequence numbers.
+type ReorderStatsReporter interface {
+	// ReorderStats returns the packet ordering statistics of the unpacker.
+	//
+	// ReorderStats must not be called concurrently with UnpackInPlace.
+	ReorderStats() ReorderStats
+}
+
+// SequenceGapCounter is implemented by unpackers that track packet sequence numbers
+// and count gaps in them.
+type SequenceGapCounter interface {
+	// SequenceGaps returns the number of accepted packets whose sequence number
+	// skipped ahead of the next expected sequence number.
+	// A gap indicates that packets were lost or reordered before reaching the unpacker.
+	//
+	// SequenceGaps is safe for concurrent use with UnpackInPlace.
+	SequenceGaps() uint64
+}
+
 // ClientPackUnpacker implements both ClientPacker and ClientUnpacker interfaces.
 type ClientPackUnpacker interface {
 	ClientPacker
@@ -82,6 +128,38 @@ type ServerPackUnpacker interface {
 	ServerUnpacker
 }
 
+// ClientPackDatagram copies the payload into a newly allocated buffer with enough headroom
+// and packs it with the client packer. It returns the destination address and the packet.
+//
+// This is a convenience helper for callers that send a single datagram at a time
+// and do not manage their own buffers.
+func ClientPackDatagram(packer ClientPacker, targetAddr conn.Addr, payload []byte) (destAddrPort netip.AddrPort, packet []byte, err error) {
+	frontHeadroom := packer.FrontHeadroom()
+	b := make([]byte, frontHeadroom+len(payload)+packer.RearHeadroom())
+	copy(b[frontHeadroom:], payload)
+
+	destAddrPort, packetStart, packetLen, err := packer.PackInPlace(b, targetAddr, frontHeadroom, len(payload))
+	if err != nil {
+		return
+	}
+	packet = b[packetStart : packetStart+packetLen]
+	return
+}
+
+// ClientUnpackDatagram unpacks the packet in-place with the client unpacker.
+// It returns the payload source address and the payload, which is a subslice of packet.
+//
+// This is a convenience helper for callers that receive a single datagram at a time
+// and do not manage their own buffers.
+func ClientUnpackDatagram(unpacker ClientUnpacker, packetSourceAddrPort netip.AddrPort, packet []byte) (payloadSourceAddrPort netip.AddrPort, payload []byte, err error) {
+	payloadSourceAddrPort, payloadStart, payloadLen, err := unpacker.UnpackInPlace(packet, packetSourceAddrPort, 0, len(packet))
+	if err != nil {
+		return
+	}
+	payload = packet[payloadStart : payloadStart+payloadLen]
+	return
+}
+
 // ClientServerPackerUnpackerTestFunc tests the client and server following these steps:
 // 1. Client packer packs.
 // 2. Server unpacker unpacks.
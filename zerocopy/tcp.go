@@ -34,7 +34,9 @@ type TCPClient interface {
 
 	// Dial creates a connection to the target address under the protocol's
 	// encapsulation and returns the established connection and a ReadWriter for read-write access.
-	Dial(targetAddr conn.Addr, payload []byte) (tc *net.TCPConn, rw ReadWriter, err error)
+	//
+	// The returned connection is usually a *net.TCPConn, but clients may use other stream transports.
+	Dial(targetAddr conn.Addr, payload []byte) (rawConn net.Conn, rw ReadWriter, err error)
 }
 
 // TCPServer provides a protocol's TCP service.
@@ -57,6 +59,20 @@ type TCPServer interface {
 	DefaultTCPConnCloser() TCPConnCloser
 }
 
+// UserIdentifier is optionally implemented by the ReadWriter returned by a TCPServer's Accept method
+// to identify the user the client authenticated as.
+type UserIdentifier interface {
+	// Username returns the authenticated username, or an empty string if the client is anonymous.
+	Username() string
+}
+
+// FamilyDialer is optionally implemented by a TCPClient that resolves domain targets itself,
+// such as a direct client. Proxy clients pass domain targets to the proxy server unresolved.
+type FamilyDialer interface {
+	// DialFamily is like Dial, but a domain target is resolved preferring addresses of family.
+	DialFamily(targetAddr conn.Addr, family conn.AddrFamily, payload []byte) (rawConn net.Conn, rw ReadWriter, err error)
+}
+
 // TCPConnOpener stores information for opening TCP connections.
 //
 // TCPConnOpener implements the DirectReadWriteCloserOpener interface.
@@ -1,6 +1,39 @@
 package zerocopy
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+
+	"github.com/database64128/shadowsocks-go/conn"
+)
+
+// ClientInfo contains information about a client session.
+type ClientInfo struct {
+	// Name is the name of the client.
+	Name string
+
+	// MaxPacketSize is the maximum size of outgoing packets.
+	MaxPacketSize int
+
+	// Fwmark is the fwmark to set on the session's socket.
+	Fwmark int
+
+	// LocalPortRange is the range of local ports to bind the session's socket to.
+	// The zero value means any port.
+	LocalPortRange conn.PortRange
+
+	// Netns is the name of the network namespace to create the session's socket in.
+	// If empty, the socket is created in the current network namespace.
+	Netns string
+
+	// Interface is the name of the network interface to bind the session's socket to.
+	// If empty, the socket is not bound to an interface.
+	Interface string
+
+	// Closer releases resources held by the session besides its socket, such as a control connection.
+	// If not nil, it must be closed when the session ends.
+	Closer io.Closer
+}
 
 // UDPClient stores information for creating new client sessions.
 type UDPClient interface {
@@ -9,12 +42,9 @@ type UDPClient interface {
 	// Headroom reports client packer headroom requirements.
 	Headroom
 
-	// LinkInfo returns the maximum size of outgoing packets and fwmark.
-	LinkInfo() (maxPacketSize, fwmark int)
-
-	// NewSession creates a new session and returns the packet packer
-	// and unpacker for the session, or an error.
-	NewSession() (ClientPacker, ClientUnpacker, error)
+	// NewSession creates a new session and returns the client info,
+	// the packet packer and unpacker for the session, or an error.
+	NewSession() (ClientInfo, ClientPacker, ClientUnpacker, error)
 }
 
 // UDPNATServer stores information for creating new server sessions.
@@ -56,29 +86,31 @@ type UDPSessionServer interface {
 // SimpleUDPClient implements the UDPClient interface.
 type SimpleUDPClient struct {
 	Headroom
-	packer        ClientPacker
-	unpacker      ClientUnpacker
-	name          string
-	maxPacketSize int
-	fwmark        int
+	packer   ClientPacker
+	unpacker ClientUnpacker
+	info     ClientInfo
 }
 
 // NewSimpleUDPClient wraps a PackUnpacker into a UDPClient and uses it for all sessions.
 func NewSimpleUDPClient(h Headroom, packer ClientPacker, unpacker ClientUnpacker, name string, maxPacketSize, fwmark int) *SimpleUDPClient {
-	return &SimpleUDPClient{h, packer, unpacker, name, maxPacketSize, fwmark}
+	return &SimpleUDPClient{
+		Headroom: h,
+		packer:   packer,
+		unpacker: unpacker,
+		info: ClientInfo{
+			Name:          name,
+			MaxPacketSize: maxPacketSize,
+			Fwmark:        fwmark,
+		},
+	}
 }
 
 // String implements the UDPClient String method.
 func (c *SimpleUDPClient) String() string {
-	return c.name
-}
-
-// LinkInfo implements the UDPClient LinkInfo method.
-func (c *SimpleUDPClient) LinkInfo() (int, int) {
-	return c.maxPacketSize, c.fwmark
+	return c.info.Name
 }
 
 // NewSession implements the UDPClient NewSession method.
-func (c *SimpleUDPClient) NewSession() (ClientPacker, ClientUnpacker, error) {
-	return c.packer, c.unpacker, nil
+func (c *SimpleUDPClient) NewSession() (ClientInfo, ClientPacker, ClientUnpacker, error) {
+	return c.info, c.packer, c.unpacker, nil
 }